@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Routes require one of the roles below, granted to the bearer credential
+// of a request: an API key, or a JSON Web Token. Admin routes require the
+// admin role, the routes feeding the corpus the ingest role or the admin
+// role, and queries the query role if QUERY_AUTH_REQUIRED is set, queries
+// being open to anyone otherwise. The admin role grants every other.
+//
+// The key in ADMIN_API_KEY has the admin role. API_KEYS grants other keys
+// their roles, as a JSON object such as {"3f9…": ["ingest"]}, or binds them
+// to a tenant as well, as in {"3f9…": {"roles": ["query"], "tenant":
+// "acme"}}, see withTenantAuth. Tokens are
+// verified with JWT_HMAC_SECRET (HS256) or the PEM public key in
+// JWT_PUBLIC_KEY (RS256 or ES256), must not have expired, must name
+// JWT_ISSUER and JWT_AUDIENCE when they are set, and carry their roles in
+// the roles claim, or in a space-separated scope claim. The server also
+// issues its own short-lived tokens, see token.go. Requests can also be
+// signed with an API key instead of carrying it, see signing.go. The
+// evaluator role is that of the server calling a split-key evaluator, see
+// splitkey.go, and the preview role that of callers querying the next
+// corpus, see nextcorpus.go.
+const (
+	roleQuery  = "query"
+	roleIngest = "ingest"
+	roleAdmin  = "admin"
+)
+
+// grants reports whether roles include role.
+func grants(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role || r == roleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// credentials verifies the bearer credentials of requests.
+type credentials struct {
+	// keys maps the SHA-256 digests of API keys to their grants, so that
+	// looking a key up does not compare it byte by byte.
+	keys map[[32]byte]apiKey
+	// signingKeys maps the key IDs of API keys to the keys, see
+	// signingKeyID.
+	signingKeys map[string]signingKey
+
+	hmacSecret []byte
+	publicKey  crypto.PublicKey
+	issuer     string
+	audience   string
+
+	// issuedSecret verifies the tokens issued by /api/auth/token.
+	issuedSecret []byte
+}
+
+// newCredentials returns the credentials configured as described above.
+// Invalid API_KEYS and JWT_PUBLIC_KEY values are logged and ignored.
+func newCredentials() *credentials {
+	c := &credentials{
+		keys:        map[[32]byte]apiKey{},
+		signingKeys: map[string]signingKey{},
+		hmacSecret:  []byte(os.Getenv("JWT_HMAC_SECRET")),
+		issuer:      os.Getenv("JWT_ISSUER"),
+		audience:    os.Getenv("JWT_AUDIENCE"),
+
+		issuedSecret: []byte(os.Getenv("AUTH_TOKEN_SECRET")),
+	}
+	if val := os.Getenv("API_KEYS"); val != "" {
+		var keys map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(val), &keys); err != nil {
+			log.Println("Invalid API_KEYS value. Ignoring API keys:", err)
+		}
+		for key, raw := range keys {
+			grant, err := parseAPIKey(raw)
+			if err != nil {
+				log.Println("Invalid API_KEYS grant. Ignoring the key:", err)
+				continue
+			}
+			c.keys[sha256.Sum256([]byte(key))] = grant
+			c.signingKeys[signingKeyID(key)] = signingKey{secret: []byte(key), apiKey: grant}
+		}
+	}
+	if adminKey := os.Getenv("ADMIN_API_KEY"); adminKey != "" {
+		grant := apiKey{roles: []string{roleAdmin}}
+		c.keys[sha256.Sum256([]byte(adminKey))] = grant
+		c.signingKeys[signingKeyID(adminKey)] = signingKey{secret: []byte(adminKey), apiKey: grant}
+	}
+	if val := os.Getenv("JWT_PUBLIC_KEY"); val != "" {
+		key, err := parsePublicKey(val)
+		if err != nil {
+			log.Println("Invalid JWT_PUBLIC_KEY value. Ignoring it:", err)
+		}
+		c.publicKey = key
+	}
+	return c
+}
+
+// apiKey is the grant of an API key: its roles, and the tenant it is bound
+// to, if any.
+type apiKey struct {
+	roles  []string
+	tenant string
+}
+
+// parseAPIKey parses the grant of a key in API_KEYS, a list of roles or an
+// object with the roles and the tenant.
+func parseAPIKey(raw json.RawMessage) (apiKey, error) {
+	var roles []string
+	if err := json.Unmarshal(raw, &roles); err == nil {
+		return apiKey{roles: roles}, nil
+	}
+	var grant struct {
+		Roles  []string `json:"roles"`
+		Tenant string   `json:"tenant"`
+	}
+	if err := json.Unmarshal(raw, &grant); err != nil {
+		return apiKey{}, err
+	}
+	return apiKey{roles: grant.Roles, tenant: grant.Tenant}, nil
+}
+
+// parsePublicKey parses a PEM-encoded RSA or ECDSA public key.
+func parsePublicKey(s string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// principal is the holder of a credential.
+type principal struct {
+	roles []string
+
+	// tenant is the tenant the credential is bound to, or empty.
+	tenant string
+
+	// issued is set for the tokens issued by the server.
+	issued bool
+
+	// signed is set for signed requests.
+	signed bool
+}
+
+// authentication is the outcome of authenticating a request, kept in its
+// context by withTenantAuth so that a signed request, whose nonce is spent
+// once verified, is only verified once.
+type authentication struct {
+	principal principal
+	ok        bool
+}
+
+// authenticationKey is the context key of the authentication of a request.
+type authenticationKey struct{}
+
+// authenticated returns the holder of the credential of req as
+// authenticated by withTenantAuth, or ok false if it has none or an invalid
+// one.
+func authenticated(req *http.Request) (principal, bool) {
+	a, _ := req.Context().Value(authenticationKey{}).(authentication)
+	return a.principal, a.ok
+}
+
+// principal returns the holder of the bearer credential of req, or of the
+// key a signed request was signed with, or ok false if it has none or an
+// invalid one.
+func (c *credentials) principal(req *http.Request) (p principal, ok bool) {
+	if a, found := req.Context().Value(authenticationKey{}).(authentication); found {
+		return a.principal, a.ok
+	}
+	return c.authenticate(req)
+}
+
+// authenticate verifies the credential of req, see principal.
+func (c *credentials) authenticate(req *http.Request) (p principal, ok bool) {
+	if strings.HasPrefix(req.Header.Get("Authorization"), signatureScheme+" ") {
+		p, err := c.verifySigned(req, time.Now())
+		return p, err == nil
+	}
+	bearer, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found || bearer == "" {
+		return p, false
+	}
+	digest := sha256.Sum256([]byte(bearer))
+	for d, grant := range c.keys {
+		if subtle.ConstantTimeCompare(d[:], digest[:]) == 1 {
+			return principal{roles: grant.roles, tenant: grant.tenant}, true
+		}
+	}
+	if strings.Count(bearer, ".") != 2 {
+		return p, false
+	}
+	claims, err := c.verifyToken(bearer, time.Now())
+	if err != nil {
+		return p, false
+	}
+	return principal{roles: claims.roles(), tenant: claims.Tenant, issued: claims.Issuer == issuedTokenIssuer}, true
+}
+
+// tokenClaims are the claims of a JSON Web Token read by the server.
+type tokenClaims struct {
+	Issuer    string          `json:"iss,omitempty"`
+	Subject   string          `json:"sub,omitempty"`
+	Audience  json.RawMessage `json:"aud,omitempty"`
+	ExpiresAt int64           `json:"exp,omitempty"`
+	NotBefore int64           `json:"nbf,omitempty"`
+	IssuedAt  int64           `json:"iat,omitempty"`
+	Roles     []string        `json:"roles,omitempty"`
+	Scope     string          `json:"scope,omitempty"`
+	Tenant    string          `json:"tenant,omitempty"`
+}
+
+// roles returns the roles the claims grant.
+func (c tokenClaims) roles() []string {
+	if len(c.Roles) > 0 {
+		return c.Roles
+	}
+	return strings.Fields(c.Scope)
+}
+
+// audiences returns the audiences of the claims, which JWT allows as a
+// string or an array.
+func (c tokenClaims) audiences() []string {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return []string{one}
+	}
+	var many []string
+	json.Unmarshal(c.Audience, &many)
+	return many
+}
+
+// verifyToken checks the signature and validity of token at now and
+// returns its claims.
+func (c *credentials) verifyToken(token string, now time.Time) (tokenClaims, error) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return claims, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	issued := header.Kid == issuedTokenKeyID
+	if issued {
+		err = verifyIssuedSignature(c.issuedSecret, header.Alg, signed, sig)
+	} else {
+		err = c.verifySignature(header.Alg, signed, sig)
+	}
+	if err != nil {
+		return claims, err
+	}
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return claims, err
+	}
+	switch {
+	case claims.ExpiresAt == 0 || now.Unix() >= claims.ExpiresAt:
+		return claims, errors.New("token expired")
+	case claims.NotBefore != 0 && now.Unix() < claims.NotBefore:
+		return claims, errors.New("token not yet valid")
+	case issued && claims.Issuer != issuedTokenIssuer:
+		return claims, errors.New("token issuer mismatch")
+	case issued:
+		return claims, nil
+	case c.issuer != "" && claims.Issuer != c.issuer:
+		return claims, errors.New("token issuer mismatch")
+	}
+	if c.audience != "" {
+		var found bool
+		for _, aud := range claims.audiences() {
+			found = found || aud == c.audience
+		}
+		if !found {
+			return claims, errors.New("token audience mismatch")
+		}
+	}
+	return claims, nil
+}
+
+// verifySignature checks the signature sig of signed with the algorithm alg.
+func (c *credentials) verifySignature(alg string, signed, sig []byte) error {
+	digest := sha256.Sum256(signed)
+	switch key := c.publicKey.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" {
+			return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" && len(sig) == 64 {
+			r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+			if ecdsa.Verify(key, digest[:], r, s) {
+				return nil
+			}
+			return errors.New("invalid signature")
+		}
+	}
+	return verifyIssuedSignature(c.hmacSecret, alg, signed, sig)
+}
+
+// verifyIssuedSignature checks the HS256 signature sig of signed with
+// secret.
+func verifyIssuedSignature(secret []byte, alg string, signed, sig []byte) error {
+	if alg != "HS256" || len(secret) == 0 {
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// decodeTokenPart decodes a base64url-encoded JSON part of a token into v.
+func decodeTokenPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// requireRole wraps a handler so that it is only reachable with a
+// credential granting role. Requests without a valid credential get a 401
+// and those whose credential lacks the role a 403. Requests with a
+// credential bound to a tenant are handled as requests of that tenant. With
+// SIGNED_REQUESTS_REQUIRED set, roles other than the query role are only
+// granted to signed requests.
+func requireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	c := newCredentials()
+	signed := role != roleQuery && envBool("SIGNED_REQUESTS_REQUIRED", false)
+	return func(w http.ResponseWriter, req *http.Request) {
+		p, ok := c.principal(req)
+		if !ok || signed && !p.signed {
+			writeError(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if !grants(p.roles, role) {
+			writeErrorCode(w, errForbidden, "credential lacks the "+role+" role", http.StatusForbidden)
+			return
+		}
+		if p.tenant != "" {
+			req.Header.Set(tenantHeader(), p.tenant)
+		}
+		h(w, req)
+	}
+}
+
+// requireAdmin wraps an admin handler so that it is only reachable with the
+// admin role. Admin routes are disabled when no credential grants it, see
+// adminDisabled.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return requireRole(roleAdmin, h)
+}
+
+// adminDisabled reports whether no credential can grant the admin role, in
+// which case the admin routes refuse every request.
+func adminDisabled() bool {
+	return os.Getenv("ADMIN_API_KEY") == "" && os.Getenv("API_KEYS") == "" && os.Getenv("JWT_HMAC_SECRET") == "" && os.Getenv("JWT_PUBLIC_KEY") == ""
+}
+
+// requireIngest wraps a handler feeding the corpus so that it is only
+// reachable with the ingest role.
+func requireIngest(h http.HandlerFunc) http.HandlerFunc {
+	return requireRole(roleIngest, h)
+}
+
+// withTenantAuth authenticates the credential of requests and resolves
+// their tenant from it, so that no caller can act as a tenant it does not
+// hold a credential for. Requests with a credential bound to a tenant are
+// requests of that tenant, and refused with a 403 if the tenant header
+// names another. Otherwise the header may only name a tenant on requests
+// with the admin role, which acts for every tenant, or with
+// TENANT_HEADER_TRUSTED set, for deployments behind an API gateway that
+// authenticates tenants and sets the header itself. Other requests naming a
+// tenant are refused, with a 401 if they have no valid credential.
+func withTenantAuth(h http.Handler) http.Handler {
+	c := newCredentials()
+	trusted := envBool("TENANT_HEADER_TRUSTED", false)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p, ok := c.authenticate(req)
+		req = req.WithContext(context.WithValue(req.Context(), authenticationKey{}, authentication{p, ok}))
+		named := tenantOf(req)
+		switch {
+		case ok && p.tenant != "":
+			if named != "" && named != p.tenant {
+				writeErrorCode(w, errForbidden, "credential is bound to another tenant", http.StatusForbidden)
+				return
+			}
+			req.Header.Set(tenantHeader(), p.tenant)
+		case named == "" || trusted || ok && grants(p.roles, roleAdmin):
+		case !ok:
+			writeError(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		default:
+			writeErrorCode(w, errForbidden, "credential is not bound to tenant "+named, http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// withQueryAuth requires the query role for queries if QUERY_AUTH_REQUIRED
+// is set.
+func withQueryAuth(h http.HandlerFunc) http.HandlerFunc {
+	if !envBool("QUERY_AUTH_REQUIRED", false) {
+		return h
+	}
+	return requireRole(roleQuery, h)
+}
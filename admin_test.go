@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signToken returns an HS256 token of claims signed with secret.
+func signToken(t *testing.T, secret string, claims tokenClaims) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestRoles(t *testing.T) {
+	t.Setenv("API_KEYS", `{"ingest-key": ["ingest"], "query-key": ["query"]}`)
+	t.Setenv("JWT_HMAC_SECRET", "jwt-secret")
+	t.Setenv("JWT_AUDIENCE", "migp")
+	t.Setenv("QUERY_AUTH_REQUIRED", "true")
+	t.Setenv("SEED_ENABLED", "true")
+	_, srv := newTestServer(t)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	queryToken := signToken(t, "jwt-secret", tokenClaims{Audience: json.RawMessage(`"migp"`), ExpiresAt: exp, Scope: "query"})
+	tests := []struct {
+		name   string
+		bearer string
+		method string
+		path   string
+		want   int
+	}{
+		{"no credential queries", "", http.MethodPost, "/api/query", http.StatusUnauthorized},
+		{"query key queries", "query-key", http.MethodPost, "/api/query", http.StatusBadRequest},
+		{"query key ingests", "query-key", http.MethodPost, "/api/admin/seed", http.StatusForbidden},
+		{"ingest key ingests", "ingest-key", http.MethodPost, "/api/admin/seed", http.StatusBadRequest},
+		{"ingest key reads the key", "ingest-key", http.MethodGet, "/api/admin/key", http.StatusForbidden},
+		{"ingest key queries", "ingest-key", http.MethodPost, "/api/query", http.StatusForbidden},
+		{"admin key queries", testAdminKey, http.MethodPost, "/api/query", http.StatusBadRequest},
+		{"query token queries", queryToken, http.MethodPost, "/api/query", http.StatusBadRequest},
+		{"query token reads jobs", queryToken, http.MethodGet, "/api/admin/jobs", http.StatusForbidden},
+		{"expired token", signToken(t, "jwt-secret", tokenClaims{Audience: json.RawMessage(`"migp"`), ExpiresAt: time.Now().Add(-time.Minute).Unix(), Scope: "query"}), http.MethodPost, "/api/query", http.StatusUnauthorized},
+		{"other audience", signToken(t, "jwt-secret", tokenClaims{Audience: json.RawMessage(`["other"]`), ExpiresAt: exp, Scope: "query"}), http.MethodPost, "/api/query", http.StatusUnauthorized},
+		{"other secret", signToken(t, "wrong", tokenClaims{Audience: json.RawMessage(`"migp"`), ExpiresAt: exp, Scope: "admin"}), http.MethodGet, "/api/admin/jobs", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader("{"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
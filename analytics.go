@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math"
+	"math/bits"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Usage analytics summarize which parts of the corpus are queried without
+// recording per-bucket access counts anywhere. Accesses are counted in memory
+// for one window at a time, and only aggregates of each window are stored:
+// the number of queries, of distinct buckets queried, a histogram of how many
+// buckets were queried how often, and query counts per coarse bucket prefix.
+// With ANALYTICS_DP_EPSILON set, Laplace noise calibrated to that privacy
+// budget is added to every stored aggregate, so that no single query can be
+// inferred from them either.
+
+// usageAggregates are the stored analytics of one window of one instance.
+type usageAggregates struct {
+	Version uint16 `json:"version"`
+	Queries int64  `json:"queries"`
+	Buckets int64  `json:"buckets"`
+
+	// AccessHistogram counts the buckets queried at most 2^i times, and
+	// more than 2^(i-1) times, at index i.
+	AccessHistogram []int64 `json:"accessHistogram"`
+
+	// Prefixes counts the queries for the buckets whose ID starts with the
+	// index, PrefixBits long.
+	PrefixBits int     `json:"prefixBits"`
+	Prefixes   []int64 `json:"prefixes"`
+
+	// Epsilon is the privacy budget of the noise added to the aggregates,
+	// 0 if they are exact.
+	Epsilon float64 `json:"epsilon"`
+}
+
+// usageAnalytics counts the bucket accesses of the current window.
+type usageAnalytics struct {
+	window     time.Duration
+	prefixBits int
+	epsilon    float64
+
+	mu       sync.Mutex
+	start    time.Time
+	accesses map[uint16]*bucketAccesses
+}
+
+// newUsageAnalytics returns the recorder configured by ANALYTICS_ENABLED
+// (default false), ANALYTICS_WINDOW (default 1h), ANALYTICS_PREFIX_BITS
+// (default 8) and ANALYTICS_DP_EPSILON (default 0, no noise), or nil if
+// analytics are disabled.
+func newUsageAnalytics() *usageAnalytics {
+	if !envBool("ANALYTICS_ENABLED", false) {
+		return nil
+	}
+	a := &usageAnalytics{
+		window:     envDuration("ANALYTICS_WINDOW", time.Hour),
+		prefixBits: envInt("ANALYTICS_PREFIX_BITS", 8),
+		start:      time.Now().UTC(),
+		accesses:   map[uint16]*bucketAccesses{},
+	}
+	if a.prefixBits < 0 || a.prefixBits > 16 {
+		log.Printf("Invalid ANALYTICS_PREFIX_BITS value %d. Using 8.", a.prefixBits)
+		a.prefixBits = 8
+	}
+	if val := os.Getenv("ANALYTICS_DP_EPSILON"); val != "" {
+		eps, err := strconv.ParseFloat(val, 64)
+		if err != nil || eps < 0 {
+			log.Printf("Invalid ANALYTICS_DP_EPSILON value %q. Recording analytics without noise.", val)
+		} else {
+			a.epsilon = eps
+		}
+	}
+	return a
+}
+
+// bucketAccesses counts the queries for each bucket of one suite.
+type bucketAccesses struct {
+	bits   int
+	counts map[uint32]int64
+}
+
+// record counts a query for bucketID, of bits bits, in the corpus of cs. A
+// nil recorder does nothing.
+func (a *usageAnalytics) record(cs *cryptoSuite, bucketID string, bits int) {
+	if a == nil {
+		return
+	}
+	raw, err := hex.DecodeString(bucketID)
+	if err != nil || len(raw) != 4 {
+		return
+	}
+	if bits < cs.cfg.BucketIDBitSize {
+		bits = cs.cfg.BucketIDBitSize
+	}
+	// A sub-bucket query is counted against its bucket.
+	bucket := binary.BigEndian.Uint32(raw) >> (bits - cs.cfg.BucketIDBitSize)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	acc := a.accesses[cs.cfg.Version]
+	if acc == nil {
+		acc = &bucketAccesses{bits: cs.cfg.BucketIDBitSize, counts: map[uint32]int64{}}
+		a.accesses[cs.cfg.Version] = acc
+	}
+	acc.counts[bucket]++
+}
+
+// rotate ends the current window and returns its start and the aggregates
+// of every version queried in it.
+func (a *usageAnalytics) rotate() (time.Time, []usageAggregates) {
+	a.mu.Lock()
+	start, accesses := a.start, a.accesses
+	a.start, a.accesses = time.Now().UTC(), map[uint16]*bucketAccesses{}
+	a.mu.Unlock()
+
+	var all []usageAggregates
+	for version, acc := range accesses {
+		prefixBits := min(a.prefixBits, acc.bits)
+		agg := usageAggregates{
+			Version:         version,
+			Buckets:         int64(len(acc.counts)),
+			AccessHistogram: make([]int64, 64),
+			PrefixBits:      prefixBits,
+			Prefixes:        make([]int64, 1<<prefixBits),
+			Epsilon:         a.epsilon,
+		}
+		top := 0
+		for bucket, n := range acc.counts {
+			agg.Queries += n
+			class := bits.Len64(uint64(n - 1))
+			agg.AccessHistogram[class]++
+			top = max(top, class)
+			agg.Prefixes[bucket>>(acc.bits-prefixBits)] += n
+		}
+		agg.AccessHistogram = agg.AccessHistogram[:top+1]
+		if a.epsilon > 0 {
+			agg.addNoise(a.epsilon)
+		}
+		all = append(all, agg)
+	}
+	return start, all
+}
+
+// addNoise adds Laplace noise for an epsilon privacy budget to the
+// aggregates, split evenly between the four released statistics. A single
+// query changes Queries, Buckets and one prefix count by at most 1, and
+// moves one bucket between two histogram classes, a change of 2.
+func (agg *usageAggregates) addNoise(epsilon float64) {
+	share := epsilon / 4
+	agg.Queries = noisy(agg.Queries, 1/share)
+	agg.Buckets = noisy(agg.Buckets, 1/share)
+	for i := range agg.AccessHistogram {
+		agg.AccessHistogram[i] = noisy(agg.AccessHistogram[i], 2/share)
+	}
+	for i := range agg.Prefixes {
+		agg.Prefixes[i] = noisy(agg.Prefixes[i], 1/share)
+	}
+}
+
+// noisy returns n with Laplace noise of the given scale added, rounded and
+// clamped at zero.
+func noisy(n int64, scale float64) int64 {
+	return max(0, int64(math.Round(float64(n)+laplaceNoise(scale))))
+}
+
+// laplaceNoise returns a sample of the Laplace distribution of the given
+// scale centered on zero.
+func laplaceNoise(scale float64) float64 {
+	var b [8]byte
+	rand.Read(b[:]) // never fails since Go 1.24
+	u := float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) - 0.5
+	return -scale * math.Copysign(math.Log(1-2*math.Abs(u)), u)
+}
+
+// recordAnalytics stores the aggregates of a window every ANALYTICS_WINDOW.
+func (s *server) recordAnalytics() {
+	ticker := time.NewTicker(s.analytics.window)
+	defer ticker.Stop()
+	for range ticker.C {
+		start, all := s.analytics.rotate()
+		end := time.Now().UTC()
+		for _, agg := range all {
+			body, err := json.Marshal(agg)
+			if err != nil {
+				log.Println("Usage analytics serialization failed:", err)
+				continue
+			}
+			query := `INSERT INTO usage_analytics (version, window_start, window_end, aggregates) VALUES ($1, $2, $3, $4)`
+			if _, err := s.kv.db().Exec(query, agg.Version, start, end, body); err != nil {
+				log.Println("Storing usage analytics failed:", err)
+			}
+		}
+	}
+}
+
+// usageWindow is the sum of the aggregates every instance stored for one
+// window.
+type usageWindow struct {
+	Start      time.Time         `json:"start"`
+	Instances  int               `json:"instances"`
+	Aggregates []usageAggregates `json:"aggregates"`
+}
+
+// handleAnalytics serves the usage analytics stored since the since query
+// parameter (RFC 3339, default 24 hours ago), summed across instances by
+// window and version.
+func (s *server) handleAnalytics(w http.ResponseWriter, req *http.Request) {
+	since := time.Now().Add(-24 * time.Hour)
+	if v := req.URL.Query().Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	// Instances start their windows at different times, so windows are
+	// grouped by the ANALYTICS_WINDOW interval they started in.
+	query := `
+	SELECT to_timestamp(floor(extract(epoch FROM window_start) / $2) * $2), aggregates FROM usage_analytics
+	WHERE window_start >= $1 ORDER BY window_start`
+	window := envDuration("ANALYTICS_WINDOW", time.Hour)
+	rows, err := s.kv.db().QueryContext(req.Context(), query, since, window.Seconds())
+	if err != nil {
+		storageError(w, "Loading usage analytics", err)
+		return
+	}
+	defer rows.Close()
+	windows := []*usageWindow{}
+	byStart := map[time.Time]*usageWindow{}
+	for rows.Next() {
+		var start time.Time
+		var body []byte
+		var agg usageAggregates
+		if err := rows.Scan(&start, &body); err == nil {
+			err = json.Unmarshal(body, &agg)
+		}
+		if err != nil {
+			storageError(w, "Loading usage analytics", err)
+			return
+		}
+		win := byStart[start]
+		if win == nil {
+			win = &usageWindow{Start: start}
+			byStart[start] = win
+			windows = append(windows, win)
+		}
+		win.Instances++
+		win.add(agg)
+	}
+	if err := rows.Err(); err != nil {
+		storageError(w, "Loading usage analytics", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, windows)
+}
+
+// add sums agg into the window's aggregates of its version. Distinct bucket
+// counts are summed too, which overcounts buckets queried on several
+// instances.
+func (win *usageWindow) add(agg usageAggregates) {
+	for i := range win.Aggregates {
+		sum := &win.Aggregates[i]
+		if sum.Version != agg.Version || sum.PrefixBits != agg.PrefixBits {
+			continue
+		}
+		sum.Queries += agg.Queries
+		sum.Buckets += agg.Buckets
+		sum.AccessHistogram = addCounts(sum.AccessHistogram, agg.AccessHistogram)
+		sum.Prefixes = addCounts(sum.Prefixes, agg.Prefixes)
+		sum.Epsilon = max(sum.Epsilon, agg.Epsilon)
+		return
+	}
+	win.Aggregates = append(win.Aggregates, agg)
+}
+
+// addCounts returns the element-wise sum of a and b.
+func addCounts(a, b []int64) []int64 {
+	for len(a) < len(b) {
+		a = append(a, 0)
+	}
+	for i, n := range b {
+		a[i] += n
+	}
+	return a
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestUsageAnalytics(t *testing.T) {
+	if newUsageAnalytics() != nil {
+		t.Fatal("analytics enabled without ANALYTICS_ENABLED")
+	}
+	t.Setenv("ANALYTICS_ENABLED", "true")
+	t.Setenv("ANALYTICS_PREFIX_BITS", "4")
+	s, _ := newTestServer(t)
+	cs := s.suites[0]
+	bits := cs.cfg.BucketIDBitSize
+	a := newUsageAnalytics()
+	busy, quiet := uint32(0xa)<<(bits-4)|1, uint32(0x3)<<(bits-4)|2
+	for _, q := range []struct {
+		bucketID string
+		bits     int
+	}{
+		{migp.BucketIDToHex(busy), bits},
+		{migp.BucketIDToHex(busy), 0},
+		{migp.BucketIDToHex(busy<<4 | 7), bits + 4},
+		{migp.BucketIDToHex(busy), bits},
+		{migp.BucketIDToHex(quiet), bits},
+		{"not hex", bits},
+	} {
+		a.record(cs, q.bucketID, q.bits)
+	}
+
+	_, all := a.rotate()
+	if len(all) != 1 {
+		t.Fatalf("%d aggregates, want one for the queried version", len(all))
+	}
+	agg := all[0]
+	if agg.Queries != 5 || agg.Buckets != 2 || agg.Epsilon != 0 {
+		t.Errorf("aggregates %+v, want 5 queries for 2 buckets", agg)
+	}
+	if want := []int64{1, 0, 1}; len(agg.AccessHistogram) != len(want) || agg.AccessHistogram[0] != 1 || agg.AccessHistogram[2] != 1 {
+		t.Errorf("access histogram %v, want %v", agg.AccessHistogram, want)
+	}
+	if agg.PrefixBits != 4 || agg.Prefixes[0xa] != 4 || agg.Prefixes[0x3] != 1 {
+		t.Errorf("prefix counts %v at %d bits", agg.Prefixes, agg.PrefixBits)
+	}
+	if _, all := a.rotate(); len(all) != 0 {
+		t.Errorf("new window starts with %+v", all)
+	}
+}
+
+func TestLaplaceNoise(t *testing.T) {
+	const n, scale = 20000, 2.0
+	var sum, abs float64
+	for i := 0; i < n; i++ {
+		x := laplaceNoise(scale)
+		sum, abs = sum+x, abs+math.Abs(x)
+	}
+	if mean := sum / n; math.Abs(mean) > 0.1 {
+		t.Errorf("noise mean %g, want 0", mean)
+	}
+	if spread := abs / n; math.Abs(spread-scale) > 0.1 {
+		t.Errorf("mean absolute noise %g, want the scale %g", spread, scale)
+	}
+	for i := 0; i < 100; i++ {
+		if noisy(0, 10) < 0 {
+			t.Fatal("noisy count below zero")
+		}
+	}
+}
+
+func TestUsageWindowAdd(t *testing.T) {
+	win := &usageWindow{}
+	win.add(usageAggregates{Version: 1, Queries: 3, Buckets: 2, AccessHistogram: []int64{1, 1}, PrefixBits: 1, Prefixes: []int64{3, 0}})
+	win.add(usageAggregates{Version: 1, Queries: 4, Buckets: 1, AccessHistogram: []int64{0, 0, 1}, PrefixBits: 1, Prefixes: []int64{0, 4}, Epsilon: 1})
+	win.add(usageAggregates{Version: 2, Queries: 1})
+	if len(win.Aggregates) != 2 {
+		t.Fatalf("%d aggregates, want one per version", len(win.Aggregates))
+	}
+	sum := win.Aggregates[0]
+	if sum.Queries != 7 || sum.Buckets != 3 || len(sum.AccessHistogram) != 3 || sum.AccessHistogram[2] != 1 || sum.Prefixes[1] != 4 || sum.Epsilon != 1 {
+		t.Errorf("summed aggregates %+v", sum)
+	}
+}
+
+func TestHandleAnalytics(t *testing.T) {
+	s, srv := newDBTestServer(t)
+	start := time.Now().UTC().Add(-time.Minute)
+	body, err := json.Marshal(usageAggregates{Version: 9, Queries: 3, Buckets: 2, PrefixBits: 1, Prefixes: []int64{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := `INSERT INTO usage_analytics (version, window_start, window_end, aggregates) VALUES (9, $1, $2, $3)`
+	if _, err := s.kv.db().Exec(query, start, time.Now().UTC(), body); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.kv.db().Exec(`DELETE FROM usage_analytics WHERE version = 9`) })
+
+	resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodGet, srv.URL+"/api/admin/analytics?since="+start.Add(-time.Second).Format(time.RFC3339), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var windows []usageWindow
+	if err := json.NewDecoder(resp.Body).Decode(&windows); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("analytics answered %d: %v", resp.StatusCode, err)
+	}
+	found := false
+	for _, win := range windows {
+		for _, agg := range win.Aggregates {
+			found = found || agg.Version == 9 && agg.Queries >= 3
+		}
+	}
+	if !found {
+		t.Errorf("analytics %+v lack the stored window", windows)
+	}
+
+	resp, err = http.DefaultClient.Do(adminRequest(t, http.MethodGet, srv.URL+"/api/admin/analytics?since=yesterday", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid since answered %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
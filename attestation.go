@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// /api/attestation serves a statement of the running configuration signed
+// with the Ed25519 key in ATTESTATION_SIGNING_KEY, a hex encoded 32-byte
+// seed: the public parameters of the suites served to the caller, see
+// tenantOf, with the fingerprints of their keys, the corpus generation, the
+// privacy report of /api/config and the build of the binary, see version.go.
+// Servers without a metadata database have no corpus generation. The
+// signature covers the statement exactly as served:
+//
+//	{"statement": {...}, "signature": "<base64>", "publicKey": "<base64>"}
+//
+// As with snapshot manifests, auditors should pin the public key rather than
+// trust the one served alongside the statement. Without the key set the
+// endpoint is disabled.
+
+// attestationKey returns the key of ATTESTATION_SIGNING_KEY, or nil if it is
+// not set.
+func attestationKey() (ed25519.PrivateKey, error) {
+	value := os.Getenv("ATTESTATION_SIGNING_KEY")
+	if value == "" {
+		return nil, nil
+	}
+	seed, err := hex.DecodeString(value)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("ATTESTATION_SIGNING_KEY must be a hex encoded 32-byte Ed25519 seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// attestedSuite is a suite in an attestation. KeyFingerprint is that of
+// keyFingerprint, and is left out for suites evaluated elsewhere, whose
+// configured key is a placeholder.
+type attestedSuite struct {
+	migp.Config
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+	Evaluation     string `json:"evaluation"`
+}
+
+// attestation is the statement of /api/attestation.
+type attestation struct {
+	IssuedAt         time.Time       `json:"issuedAt"`
+	Tenant           string          `json:"tenant,omitempty"`
+	Suites           []attestedSuite `json:"suites"`
+	CorpusGeneration int64           `json:"corpusGeneration,omitempty"`
+	Privacy          privacyReport   `json:"privacy"`
+	Build            buildReport     `json:"build"`
+}
+
+// evaluationKind names how the OPRF of cs is evaluated.
+func evaluationKind(cs *cryptoSuite) string {
+	switch cs.remote.(type) {
+	case nil:
+		return "local"
+	case *splitKey:
+		return "split"
+	default:
+		return "hsm"
+	}
+}
+
+// handleAttestation serves the signed statement, see above.
+func (s *server) handleAttestation(w http.ResponseWriter, req *http.Request) {
+	key, err := attestationKey()
+	if err != nil {
+		log.Println("Loading attestation key failed:", err)
+	}
+	if key == nil {
+		writeErrorCode(w, errFeatureDisabled, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	tenant := tenantOf(req)
+	a := attestation{
+		IssuedAt: time.Now().UTC(),
+		Privacy:  s.privacyReport(),
+		Build:    runningBuild(),
+	}
+	if !s.detached {
+		if a.CorpusGeneration, err = s.generation(); err != nil {
+			storageError(w, "reading corpus generation", err)
+			return
+		}
+	}
+	if s.tenants[tenant] != nil {
+		a.Tenant = tenant
+	}
+	for _, cs := range s.tenantSuites(tenant) {
+		suite := attestedSuite{Config: cs.cfg.Config, Evaluation: evaluationKind(cs)}
+		if cs.remote == nil {
+			if suite.KeyFingerprint, err = keyFingerprint(&cs.cfg); err != nil {
+				log.Println("Computing key fingerprint failed:", err)
+				writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+		a.Suites = append(a.Suites, suite)
+	}
+	statement, err := json.Marshal(a)
+	if err != nil {
+		log.Println("Encoding attestation failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(s.tenants) > 0 {
+		w.Header().Set("Vary", tenantHeader())
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, struct {
+		Statement json.RawMessage `json:"statement"`
+		Signature []byte          `json:"signature"`
+		PublicKey []byte          `json:"publicKey"`
+	}{statement, ed25519.Sign(key, statement), key.Public().(ed25519.PublicKey)})
+}
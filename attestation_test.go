@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAttestation(t *testing.T) {
+	_, srv := newTestServer(t)
+	resp, err := http.Get(srv.URL + "/api/attestation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("attestation without a key: got %d, want 404", resp.StatusCode)
+	}
+
+	t.Setenv("ATTESTATION_SIGNING_KEY", strings.Repeat("01", ed25519.SeedSize))
+	resp, err = http.Get(srv.URL + "/api/attestation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("attestation: got %d", resp.StatusCode)
+	}
+	var signed struct {
+		Statement json.RawMessage
+		Signature []byte
+		PublicKey []byte
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(signed.PublicKey, signed.Statement, signed.Signature) {
+		t.Fatal("attestation signature does not verify")
+	}
+	var a attestation
+	if err := json.Unmarshal(signed.Statement, &a); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Suites) == 0 || a.Suites[0].KeyFingerprint == "" || a.Suites[0].Evaluation != "local" {
+		t.Errorf("attested suites %+v", a.Suites)
+	}
+	if a.Privacy.Mode != privacyStandard || a.Build.GoVersion == "" {
+		t.Errorf("attestation %+v", a)
+	}
+}
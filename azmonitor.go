@@ -0,0 +1,296 @@
+//go:build full || azure || !(minimal || aws)
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With AZURE_MONITOR_RESOURCE_ID set, the resource ID of the function app,
+// key metrics are pushed every AZURE_MONITOR_INTERVAL (default 1m) to Azure
+// Monitor as custom metrics of that resource, in the AZURE_MONITOR_NAMESPACE
+// namespace (default MIGP), so that autoscale rules of the plan can scale on
+// them. They are sent to the regional endpoint of AZURE_MONITOR_REGION, by
+// default the region of the app, or to AZURE_MONITOR_ENDPOINT, with a token of the managed identity of the
+// instance, which needs the Monitoring Metrics Publisher role. Each metric
+// covers the interval and has the instance as its dimension:
+//
+//	QueriesPerSecond   queries served per second
+//	QueryErrors        queries failed with a server error
+//	QueryLatencyMs     query latency, its minimum and maximum to the
+//	                   precision of migp_request_duration_seconds
+//	QueryLatencyP95Ms  the 95th percentile of the query latency
+//	CacheHitRate       percentage of cacheable queries answered as unchanged
+//	CorpusEntries      entries of the corpus, when last computed
+//
+// Failed pushes are logged and counted; the next push covers its interval
+// only.
+
+func init() {
+	exporters = append(exporters, func(ctx context.Context) {
+		if m := newAzureMonitor(); m != nil {
+			m.run(ctx)
+		}
+	})
+}
+
+var azureMonitorFailures = newCounter("migp_azure_monitor_failures_total", "Failed pushes of custom metrics to Azure Monitor.")
+
+// queryRoutes are the routes whose requests are queries.
+var queryRoutes = map[string]bool{
+	"/api/query":           true,
+	"/api/query/next":      true,
+	"/api/query/batch":     true,
+	"/api/passwords/query": true,
+	"/api/range/":          true,
+	"/api/pir":             true,
+}
+
+// monitorSnapshot holds the cumulative metrics deltas are computed from.
+type monitorSnapshot struct {
+	at           time.Time
+	queries      float64
+	errors       float64
+	latency      []uint64
+	latencySum   float64
+	latencyCount uint64
+	cacheHits    float64
+	cacheAll     float64
+}
+
+// takeMonitorSnapshot reads the cumulative metrics at now.
+func takeMonitorSnapshot(now time.Time) monitorSnapshot {
+	s := monitorSnapshot{at: now}
+	s.queries, _, _, _ = sloEvents.total(func(v []string) bool { return queryRoutes[v[0]] && v[1] == sloAvailability })
+	s.errors, _, _, _ = sloEvents.total(func(v []string) bool { return queryRoutes[v[0]] && v[1] == sloAvailability && v[2] == "bad" })
+	_, s.latency, s.latencySum, s.latencyCount = requestDuration.total(func(v []string) bool { return queryRoutes[v[0]] })
+	s.cacheHits, _, _, _ = queryCacheRequests.total(func(v []string) bool { return v[0] == "hit" })
+	s.cacheAll, _, _, _ = queryCacheRequests.total(nil)
+	return s
+}
+
+// monitorSeries is one custom metric value: the aggregate of its samples
+// over the interval.
+type monitorSeries struct {
+	DimValues []string `json:"dimValues"`
+	Min       float64  `json:"min"`
+	Max       float64  `json:"max"`
+	Sum       float64  `json:"sum"`
+	Count     uint64   `json:"count"`
+}
+
+// gaugeSeries returns the series of the single sample v.
+func gaugeSeries(instance string, v float64) monitorSeries {
+	return monitorSeries{DimValues: []string{instance}, Min: v, Max: v, Sum: v, Count: 1}
+}
+
+// monitorMetrics returns the custom metrics of the interval from prev to
+// cur by name. Metrics without samples in the interval are left out.
+func monitorMetrics(prev, cur monitorSnapshot, instance string) map[string]monitorSeries {
+	metrics := map[string]monitorSeries{}
+	if seconds := cur.at.Sub(prev.at).Seconds(); seconds > 0 {
+		metrics["QueriesPerSecond"] = gaugeSeries(instance, (cur.queries-prev.queries)/seconds)
+	}
+	metrics["QueryErrors"] = gaugeSeries(instance, cur.errors-prev.errors)
+
+	if n := cur.latencyCount - prev.latencyCount; n > 0 {
+		counts := make([]uint64, len(cur.latency))
+		for i := range counts {
+			counts[i] = cur.latency[i] - prev.latency[i]
+		}
+		mean := (cur.latencySum - prev.latencySum) * 1000 / float64(n)
+		lo, hi := latencyRange(counts, n)
+		metrics["QueryLatencyMs"] = monitorSeries{DimValues: []string{instance}, Min: min(lo, mean), Max: max(hi, mean), Sum: mean * float64(n), Count: n}
+		metrics["QueryLatencyP95Ms"] = gaugeSeries(instance, latencyQuantile(counts, n, 0.95))
+	}
+	if all := cur.cacheAll - prev.cacheAll; all > 0 {
+		metrics["CacheHitRate"] = gaugeSeries(instance, 100*(cur.cacheHits-prev.cacheHits)/all)
+	}
+	if entries, _, _, _ := corpusEntries.total(nil); entries > 0 {
+		metrics["CorpusEntries"] = gaugeSeries(instance, entries)
+	}
+	return metrics
+}
+
+// latencyRange returns the lower bound of the first and the upper bound of
+// the last non-empty bucket of the latency histogram counts of n samples,
+// in milliseconds. Samples above the last bucket count as its bound.
+func latencyRange(counts []uint64, n uint64) (lo, hi float64) {
+	var seen uint64
+	lo = -1
+	for i, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if lo < 0 {
+			if i > 0 {
+				lo = defaultLatencyBuckets[i-1] * 1000
+			} else {
+				lo = 0
+			}
+		}
+		hi = defaultLatencyBuckets[i] * 1000
+		seen += c
+	}
+	if seen < n {
+		if lo < 0 {
+			lo = defaultLatencyBuckets[len(defaultLatencyBuckets)-1] * 1000
+		}
+		hi = defaultLatencyBuckets[len(defaultLatencyBuckets)-1] * 1000
+	}
+	return lo, hi
+}
+
+// latencyQuantile returns the upper bound, in milliseconds, of the bucket of
+// the latency histogram counts of n samples holding the q quantile.
+func latencyQuantile(counts []uint64, n uint64, q float64) float64 {
+	rank := uint64(q * float64(n))
+	var seen uint64
+	for i, c := range counts {
+		seen += c
+		if seen > rank {
+			return defaultLatencyBuckets[i] * 1000
+		}
+	}
+	return defaultLatencyBuckets[len(defaultLatencyBuckets)-1] * 1000
+}
+
+// azureMonitor pushes custom metrics, see above.
+type azureMonitor struct {
+	endpoint  string
+	namespace string
+	instance  string
+	client    *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newAzureMonitor returns the exporter configured as described above, or
+// nil if AZURE_MONITOR_RESOURCE_ID is not set.
+func newAzureMonitor() *azureMonitor {
+	resource := os.Getenv("AZURE_MONITOR_RESOURCE_ID")
+	if resource == "" {
+		return nil
+	}
+	endpoint := os.Getenv("AZURE_MONITOR_ENDPOINT")
+	if endpoint == "" {
+		region := os.Getenv("AZURE_MONITOR_REGION")
+		if region == "" {
+			region = strings.ToLower(strings.ReplaceAll(os.Getenv("REGION_NAME"), " ", ""))
+		}
+		if region == "" {
+			log.Println("AZURE_MONITOR_REGION environment variable not set. Azure Monitor export disabled.")
+			return nil
+		}
+		endpoint = "https://" + region + ".monitoring.azure.com"
+	}
+	namespace := os.Getenv("AZURE_MONITOR_NAMESPACE")
+	if namespace == "" {
+		namespace = "MIGP"
+	}
+	instance := os.Getenv("WEBSITE_INSTANCE_ID")
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	return &azureMonitor{
+		endpoint:  strings.TrimSuffix(endpoint, "/") + "/" + strings.TrimPrefix(resource, "/") + "/metrics",
+		namespace: namespace,
+		instance:  instance,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// run pushes the metrics of every interval until ctx is done.
+func (m *azureMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(envDuration("AZURE_MONITOR_INTERVAL", time.Minute))
+	defer ticker.Stop()
+	prev := takeMonitorSnapshot(time.Now())
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		cur := takeMonitorSnapshot(time.Now())
+		if err := m.push(ctx, cur.at, monitorMetrics(prev, cur, m.instance)); err != nil && ctx.Err() == nil {
+			azureMonitorFailures.Inc()
+			log.Println("Pushing metrics to Azure Monitor failed:", err)
+		}
+		prev = cur
+	}
+}
+
+// push sends metrics measured at, one request per metric as the custom
+// metrics API takes them.
+func (m *azureMonitor) push(ctx context.Context, at time.Time, metrics map[string]monitorSeries) error {
+	token, err := m.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	for name, series := range metrics {
+		var body struct {
+			Time string `json:"time"`
+			Data struct {
+				BaseData struct {
+					Metric    string          `json:"metric"`
+					Namespace string          `json:"namespace"`
+					DimNames  []string        `json:"dimNames"`
+					Series    []monitorSeries `json:"series"`
+				} `json:"baseData"`
+			} `json:"data"`
+		}
+		body.Time = at.UTC().Format(time.RFC3339)
+		body.Data.BaseData.Metric = name
+		body.Data.BaseData.Namespace = m.namespace
+		body.Data.BaseData.DimNames = []string{"Instance"}
+		body.Data.BaseData.Series = []monitorSeries{series}
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.endpoint, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := m.client.Do(req)
+		if err != nil {
+			return err
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("metric %s: %s: %s", name, resp.Status, strings.TrimSpace(string(msg)))
+		}
+	}
+	return nil
+}
+
+// accessToken returns a monitoring token of the managed identity, reusing it
+// until shortly before it expires.
+func (m *azureMonitor) accessToken(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token != "" && time.Until(m.expires) > 5*time.Minute {
+		return m.token, nil
+	}
+	token, expires, err := managedIdentityToken(ctx, m.client, "https://monitoring.azure.com/")
+	if err != nil {
+		return "", err
+	}
+	m.token, m.expires = token, expires
+	return token, nil
+}
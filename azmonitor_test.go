@@ -0,0 +1,75 @@
+//go:build full || azure || !(minimal || aws)
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMonitorMetrics(t *testing.T) {
+	start := time.Unix(1000, 0)
+	prev := monitorSnapshot{at: start, queries: 100, errors: 1, latency: make([]uint64, len(defaultLatencyBuckets)), cacheHits: 10, cacheAll: 20}
+	cur := prev
+	cur.at = start.Add(time.Minute)
+	cur.queries, cur.errors = 220, 3
+	cur.cacheHits, cur.cacheAll = 25, 40
+	cur.latency = make([]uint64, len(defaultLatencyBuckets))
+	cur.latency[1], cur.latency[3] = 19, 1 // 19 within 5ms, 1 within 25ms
+	cur.latencySum, cur.latencyCount = 0.1, 20
+
+	m := monitorMetrics(prev, cur, "i1")
+	for name, want := range map[string]float64{"QueriesPerSecond": 2, "QueryErrors": 2, "CacheHitRate": 75, "QueryLatencyP95Ms": 25} {
+		if got := m[name].Sum; got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	lat := m["QueryLatencyMs"]
+	if lat.Count != 20 || lat.Sum != 100 || lat.Min != 1 || lat.Max != 25 {
+		t.Errorf("QueryLatencyMs = %+v, want 20 samples of 5ms mean within 1ms and 25ms", lat)
+	}
+}
+
+func TestAzureMonitorPush(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Data struct {
+				BaseData struct {
+					Metric    string `json:"metric"`
+					Namespace string `json:"namespace"`
+				} `json:"baseData"`
+			} `json:"data"`
+		}
+		if req.URL.Path != "/subscriptions/s/app/metrics" || req.Header.Get("Authorization") != "Bearer tok" || json.NewDecoder(req.Body).Decode(&body) != nil || body.Data.BaseData.Namespace != "MIGP" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		got = append(got, body.Data.BaseData.Metric)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	t.Setenv("AZURE_MONITOR_RESOURCE_ID", "/subscriptions/s/app")
+	t.Setenv("AZURE_MONITOR_ENDPOINT", srv.URL)
+	m := newAzureMonitor()
+	m.token, m.expires = "tok", time.Now().Add(time.Hour)
+
+	metrics := map[string]monitorSeries{"QueriesPerSecond": gaugeSeries("i1", 2), "QueryErrors": gaugeSeries("i1", 0)}
+	if err := m.push(context.Background(), time.Now(), metrics); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("pushed %v, want both metrics", got)
+	}
+	m.token = "wrong"
+	if err := m.push(context.Background(), time.Now(), metrics); err == nil {
+		t.Error("push with a rejected token succeeded")
+	}
+}
@@ -0,0 +1,619 @@
+//go:build full || azure || !(minimal || aws)
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	bucketBackends["aztable"] = func(manageSchema bool) (bucketBackend, error) {
+		b, err := openTableBackend(manageSchema)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+}
+
+// tableBackend keeps the corpus buckets in Azure Table Storage, selected with
+// STORAGE_BACKEND=aztable, as the cheapest Azure-native option. It connects
+// with the storage connection string in TABLE_CONNECTION_ST, defaulting to
+// the AzureWebJobsStorage account of the function app, and stores buckets in
+// the TABLE_NAME table (default migpbuckets).
+//
+// Buckets are partitioned by the first TABLE_PARTITION_PREFIX (default 3) hex
+// digits of their ID. A partition holds the row b|<id> of each of its buckets,
+// with the contents split across binary properties of at most 64 KiB, and the
+// row e|<id>|<sha256> of each of their entries. An append is an entity group
+// transaction inserting the new entry rows and replacing the bucket row if
+// its ETag is unchanged, so that a batch of entries of one bucket, as
+// ingested for a credential, is a single request. Entities are limited to
+// 1 MiB, which bounds the size of a bucket.
+type tableBackend struct {
+	endpoint   string // table service URL, without a trailing slash
+	account    string
+	key        []byte
+	sas        string
+	table      string
+	prefixLen  int
+	httpClient *http.Client
+}
+
+const (
+	// tableChunkSize is the largest binary property of an entity.
+	tableChunkSize = 64 << 10
+
+	// tableMaxChunks bounds the properties of a bucket row, which must stay
+	// below the 1 MiB entity limit.
+	tableMaxChunks = 15
+
+	// tableBatchOps is the maximum number of operations of an entity group
+	// transaction.
+	tableBatchOps = 100
+)
+
+var (
+	// errTableConflict is returned when a transaction lost an ETag race.
+	errTableConflict = errors.New("table transaction conflict")
+
+	// errTableBucketTooLarge is returned for appends that would make a
+	// bucket exceed the entity size limit.
+	errTableBucketTooLarge = errors.New("bucket exceeds the table entity size limit")
+)
+
+// devStorageKey is the well-known account key of the storage emulator.
+const devStorageKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+// openTableBackend connects to the table service configured by the
+// environment, creating the table if manageSchema is set.
+func openTableBackend(manageSchema bool) (*tableBackend, error) {
+	conn := os.Getenv("TABLE_CONNECTION_ST")
+	if conn == "" {
+		conn = os.Getenv("AzureWebJobsStorage")
+	}
+	if conn == "" {
+		return nil, errors.New("TABLE_CONNECTION_ST is not set")
+	}
+	b, err := parseTableConnection(conn)
+	if err != nil {
+		return nil, err
+	}
+	b.table = os.Getenv("TABLE_NAME")
+	if b.table == "" {
+		b.table = "migpbuckets"
+	}
+	b.prefixLen = envInt("TABLE_PARTITION_PREFIX", 3)
+	b.httpClient = &http.Client{Timeout: time.Minute}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if manageSchema {
+		body, _ := json.Marshal(map[string]string{"TableName": b.table})
+		status, _, _, err := b.do(ctx, http.MethodPost, "Tables", nil, body, nil)
+		if err != nil && status != http.StatusConflict {
+			return nil, fmt.Errorf("creating table %s: %w", b.table, err)
+		}
+		return b, nil
+	}
+	if _, _, _, err := b.do(ctx, http.MethodGet, "Tables('"+b.table+"')", nil, nil, nil); err != nil {
+		return nil, fmt.Errorf("connecting to table %s: %w", b.table, err)
+	}
+	return b, nil
+}
+
+// parseTableConnection parses an Azure Storage connection string.
+func parseTableConnection(conn string) (*tableBackend, error) {
+	fields := map[string]string{}
+	for _, part := range strings.Split(conn, ";") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			fields[k] = v
+		}
+	}
+	b := &tableBackend{account: fields["AccountName"], endpoint: fields["TableEndpoint"], sas: fields["SharedAccessSignature"]}
+	if fields["UseDevelopmentStorage"] == "true" {
+		b.account, fields["AccountKey"] = "devstoreaccount1", devStorageKey
+		b.endpoint = "http://127.0.0.1:10002/devstoreaccount1"
+	}
+	if b.endpoint == "" {
+		protocol, suffix := fields["DefaultEndpointsProtocol"], fields["EndpointSuffix"]
+		if protocol == "" {
+			protocol = "https"
+		}
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+		b.endpoint = fmt.Sprintf("%s://%s.table.%s", protocol, b.account, suffix)
+	}
+	b.endpoint = strings.TrimSuffix(b.endpoint, "/")
+	if key := fields["AccountKey"]; key != "" {
+		k, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, errors.New("invalid AccountKey in the table connection string")
+		}
+		b.key = k
+	}
+	if b.key == nil && b.sas == "" {
+		return nil, errors.New("the table connection string has neither AccountKey nor SharedAccessSignature")
+	}
+	return b, nil
+}
+
+// do sends a request for resource, relative to the endpoint, and returns the
+// status, headers and body of the response. The error is set for any status
+// but 2xx.
+func (b *tableBackend) do(ctx context.Context, method, resource string, query url.Values, body []byte, header http.Header) (int, http.Header, []byte, error) {
+	u, err := url.Parse(b.endpoint + "/" + resource)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	if b.sas != "" {
+		sas, _ := url.ParseQuery(strings.TrimPrefix(b.sas, "?"))
+		for k, v := range sas {
+			query[k] = v
+		}
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if req.Header.Get("Content-Type") == "" && body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json;odata=nometadata")
+	req.Header.Set("DataServiceVersion", "3.0;NetFx")
+	req.Header.Set("MaxDataServiceVersion", "3.0;NetFx")
+	req.Header.Set("x-ms-version", "2019-02-02")
+	b.sign(req)
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, resp.Header, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, resp.Header, data, fmt.Errorf("table %s %s: status %d: %s", method, resource, resp.StatusCode, bytes.TrimSpace(data))
+	}
+	return resp.StatusCode, resp.Header, data, nil
+}
+
+// sign sets the date and SharedKeyLite authorization of req, unless a shared
+// access signature is used instead.
+func (b *tableBackend) sign(req *http.Request) {
+	date := time.Now().UTC().Format(http.TimeFormat)
+	req.Header.Set("x-ms-date", date)
+	if b.key == nil {
+		return
+	}
+	resource := "/" + b.account + req.URL.EscapedPath()
+	if comp := req.URL.Query().Get("comp"); comp != "" {
+		resource += "?comp=" + comp
+	}
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write([]byte(date + "\n" + resource))
+	req.Header.Set("Authorization", "SharedKeyLite "+b.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// tableKeyChars are not allowed in partition and row keys.
+var tableKeyChars = strings.NewReplacer("/", "!", `\`, "!", "#", "!", "?", "!")
+
+// tableKeys returns the partition key of the bucket stored under id and the
+// form of id used in row keys. Bucket IDs are the last element of id.
+func (b *tableBackend) tableKeys(id string) (partition, row string) {
+	row = tableKeyChars.Replace(id)
+	i := strings.LastIndex(id, "/") + 1
+	n := min(len(id)-i, b.prefixLen)
+	return tableKeyChars.Replace(id[:i+n]), row
+}
+
+// entityPath returns the resource of the entity with the given keys.
+func (b *tableBackend) entityPath(partition, row string) string {
+	escape := func(s string) string { return url.PathEscape(strings.ReplaceAll(s, "'", "''")) }
+	return fmt.Sprintf("%s(PartitionKey='%s',RowKey='%s')", b.table, escape(partition), escape(row))
+}
+
+// tableBucket is a bucket row.
+type tableBucket struct {
+	value []byte
+	etag  string // empty if the bucket does not exist
+}
+
+// bucket reads the bucket stored under id.
+func (b *tableBackend) bucket(ctx context.Context, id string) (tableBucket, error) {
+	partition, row := b.tableKeys(id)
+	status, header, data, err := b.do(ctx, http.MethodGet, b.entityPath(partition, "b|"+row), nil, nil, nil)
+	if status == http.StatusNotFound {
+		return tableBucket{value: []byte{}}, nil
+	}
+	if err != nil {
+		return tableBucket{}, err
+	}
+	var props map[string]interface{}
+	if err := json.Unmarshal(data, &props); err != nil {
+		return tableBucket{}, err
+	}
+	n, _ := props["N"].(float64)
+	value := []byte{}
+	for i := 0; i < int(n); i++ {
+		chunk, _ := props["V"+strconv.Itoa(i)].(string)
+		raw, err := base64.StdEncoding.DecodeString(chunk)
+		if err != nil {
+			return tableBucket{}, err
+		}
+		value = append(value, raw...)
+	}
+	return tableBucket{value: value, etag: header.Get("ETag")}, nil
+}
+
+// Get returns the bucket stored under id.
+func (b *tableBackend) Get(ctx context.Context, id string) ([]byte, error) {
+	bucket, err := b.bucket(ctx, id)
+	return bucket.value, err
+}
+
+// tableEntry is an entry row.
+type tableEntry struct {
+	bucket     string
+	hash       string
+	value      []byte
+	bucketHash sql.NullInt64
+}
+
+// query returns the rows matching filter, following continuations.
+func (b *tableBackend) query(ctx context.Context, filter string) ([]map[string]interface{}, error) {
+	var rows []map[string]interface{}
+	query := url.Values{"$filter": {filter}}
+	for {
+		_, header, data, err := b.do(ctx, http.MethodGet, b.table+"()", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Value []map[string]interface{} `json:"value"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, err
+		}
+		rows = append(rows, page.Value...)
+		next := header.Get("x-ms-continuation-NextPartitionKey")
+		if next == "" {
+			return rows, nil
+		}
+		query = url.Values{
+			"$filter":          {filter},
+			"NextPartitionKey": {next},
+			"NextRowKey":       {header.Get("x-ms-continuation-NextRowKey")},
+		}
+	}
+}
+
+// odataString quotes s as an OData string literal.
+func odataString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// entries returns the entry rows of the bucket stored under id. The filter
+// selects the row keys starting with e|<id>|, as '}' sorts after '|'.
+func (b *tableBackend) entries(ctx context.Context, id string) ([]tableEntry, error) {
+	partition, row := b.tableKeys(id)
+	filter := fmt.Sprintf("PartitionKey eq %s and RowKey gt %s and RowKey lt %s",
+		odataString(partition), odataString("e|"+row+"|"), odataString("e|"+row+"}"))
+	rows, err := b.query(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return b.parseEntries(rows)
+}
+
+// parseEntries decodes entry rows.
+func (b *tableBackend) parseEntries(rows []map[string]interface{}) ([]tableEntry, error) {
+	entries := make([]tableEntry, 0, len(rows))
+	for _, r := range rows {
+		rowKey, _ := r["RowKey"].(string)
+		rest := strings.TrimPrefix(rowKey, "e|")
+		i := strings.LastIndex(rest, "|")
+		if i < 0 {
+			continue
+		}
+		encoded, _ := r["V"].(string)
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		e := tableEntry{bucket: strings.ReplaceAll(rest[:i], "!", "/"), hash: rest[i+1:], value: value}
+		if h, ok := r["H"].(string); ok {
+			if n, err := strconv.ParseInt(h, 10, 64); err == nil {
+				e.bucketHash = sql.NullInt64{Int64: n, Valid: true}
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// tableOp is an operation of an entity group transaction.
+type tableOp struct {
+	method string
+	path   string
+	etag   string
+	body   map[string]interface{}
+}
+
+// bucketOp returns the operation storing value as the bucket stored under
+// id, inserting it if etag is empty and replacing the row with etag
+// otherwise.
+func (b *tableBackend) bucketOp(id string, value []byte, etag string) (tableOp, error) {
+	chunks := (len(value) + tableChunkSize - 1) / tableChunkSize
+	if chunks > tableMaxChunks {
+		return tableOp{}, errTableBucketTooLarge
+	}
+	partition, row := b.tableKeys(id)
+	body := map[string]interface{}{"PartitionKey": partition, "RowKey": "b|" + row, "N": chunks}
+	for i := 0; i < chunks; i++ {
+		name := "V" + strconv.Itoa(i)
+		body[name] = base64.StdEncoding.EncodeToString(value[i*tableChunkSize : min((i+1)*tableChunkSize, len(value))])
+		body[name+"@odata.type"] = "Edm.Binary"
+	}
+	if etag == "" {
+		return tableOp{method: http.MethodPost, path: b.table, body: body}, nil
+	}
+	return tableOp{method: http.MethodPut, path: b.entityPath(partition, "b|"+row), etag: etag, body: body}, nil
+}
+
+// entryOp returns the operation inserting the entry row of value.
+func (b *tableBackend) entryOp(id, hash string, value []byte, bucketHash sql.NullInt64) tableOp {
+	partition, row := b.tableKeys(id)
+	body := map[string]interface{}{
+		"PartitionKey": partition,
+		"RowKey":       "e|" + row + "|" + hash,
+		"V":            base64.StdEncoding.EncodeToString(value),
+		"V@odata.type": "Edm.Binary",
+	}
+	if bucketHash.Valid {
+		body["H"] = strconv.FormatInt(bucketHash.Int64, 10)
+		body["H@odata.type"] = "Edm.Int64"
+	}
+	return tableOp{method: http.MethodPost, path: b.table, body: body}
+}
+
+// batchStatus matches the status lines of the operation responses of a
+// batch.
+var batchStatus = regexp.MustCompile(`HTTP/1\.1 (\d{3})`)
+
+// batch runs ops, which must share a partition, as one entity group
+// transaction.
+func (b *tableBackend) batch(ctx context.Context, ops []tableOp) error {
+	var boundary, changeset [8]byte
+	rand.Read(boundary[:])
+	rand.Read(changeset[:])
+	batchID, changesetID := "batch_"+hex.EncodeToString(boundary[:]), "changeset_"+hex.EncodeToString(changeset[:])
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "--%s\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n", batchID, changesetID)
+	for _, op := range ops {
+		payload, err := json.Marshal(op.body)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&body, "--%s\r\nContent-Type: application/http\r\nContent-Transfer-Encoding: binary\r\n\r\n", changesetID)
+		fmt.Fprintf(&body, "%s %s/%s HTTP/1.1\r\n", op.method, b.endpoint, op.path)
+		body.WriteString("Content-Type: application/json\r\nAccept: application/json;odata=nometadata\r\nPrefer: return-no-content\r\nDataServiceVersion: 3.0;\r\n")
+		if op.etag != "" {
+			fmt.Fprintf(&body, "If-Match: %s\r\n", op.etag)
+		}
+		fmt.Fprintf(&body, "\r\n%s\r\n", payload)
+	}
+	fmt.Fprintf(&body, "--%s--\r\n--%s--\r\n", changesetID, batchID)
+
+	header := http.Header{"Content-Type": {"multipart/mixed; boundary=" + batchID}}
+	_, _, data, err := b.do(ctx, http.MethodPost, "$batch", nil, body.Bytes(), header)
+	if err != nil {
+		return err
+	}
+	for _, m := range batchStatus.FindAllSubmatch(data, -1) {
+		switch status := string(m[1]); {
+		case status == "409" || status == "412":
+			return errTableConflict
+		case status[0] != '2':
+			return fmt.Errorf("table batch operation failed with status %s: %s", status, bytes.TrimSpace(data))
+		}
+	}
+	return nil
+}
+
+// AppendUnique appends value to the bucket stored under id unless it was
+// appended before.
+func (b *tableBackend) AppendUnique(ctx context.Context, id string, bucketHash sql.NullInt64, value []byte) (bool, error) {
+	e := journalEntry{Key: id, Value: value}
+	if bucketHash.Valid {
+		e.BucketHash = &bucketHash.Int64
+	}
+	n, err := b.AppendBatch(ctx, []journalEntry{e})
+	return n > 0, err
+}
+
+// AppendBatch appends entries with one entity group transaction for each
+// bucket, retrying those that lost a race with another change of it.
+func (b *tableBackend) AppendBatch(ctx context.Context, entries []journalEntry) (int, error) {
+	var keys []string
+	byKey := map[string][]journalEntry{}
+	for _, e := range entries {
+		if _, ok := byKey[e.Key]; !ok {
+			keys = append(keys, e.Key)
+		}
+		byKey[e.Key] = append(byKey[e.Key], e)
+	}
+	added := 0
+	for _, key := range keys {
+		n, err := b.appendBucket(ctx, key, byKey[key])
+		added += n
+		if err != nil {
+			return added, err
+		}
+	}
+	return added, nil
+}
+
+// appendBucket appends entries to the bucket stored under id.
+func (b *tableBackend) appendBucket(ctx context.Context, id string, entries []journalEntry) (int, error) {
+	for attempt := 0; attempt < conflictAttempts; attempt++ {
+		if attempt > 0 {
+			if err := conflictBackoff(ctx, attempt); err != nil {
+				return 0, err
+			}
+		}
+		bucket, err := b.bucket(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		stored, err := b.entries(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		seen := map[string]bool{}
+		for _, e := range stored {
+			seen[e.hash] = true
+		}
+		var ops []tableOp
+		value := bucket.value
+		for _, e := range entries {
+			sum := sha256.Sum256(e.Value)
+			hash := hex.EncodeToString(sum[:])
+			if seen[hash] || len(ops) == tableBatchOps-1 {
+				continue
+			}
+			seen[hash] = true
+			ops = append(ops, b.entryOp(id, hash, e.Value, e.bucketHash()))
+			value = append(value[:len(value):len(value)], e.Value...)
+		}
+		if len(ops) == 0 {
+			return 0, nil
+		}
+		op, err := b.bucketOp(id, value, bucket.etag)
+		if err != nil {
+			return 0, err
+		}
+		err = b.batch(ctx, append(ops, op))
+		if err == errTableConflict {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(ops) == tableBatchOps-1 {
+			// The rest did not fit in the transaction.
+			more, err := b.appendBucket(ctx, id, entries)
+			return len(ops) + more, err
+		}
+		return len(ops), nil
+	}
+	return 0, errTableConflict
+}
+
+// RemoveEntries removes values from the bucket stored under id and rebuilds
+// it from the remaining entries.
+func (b *tableBackend) RemoveEntries(ctx context.Context, id string, values [][]byte) (int, error) {
+	remove := map[string]bool{}
+	for _, value := range values {
+		sum := sha256.Sum256(value)
+		remove[hex.EncodeToString(sum[:])] = true
+	}
+	partition, row := b.tableKeys(id)
+	for attempt := 0; attempt < conflictAttempts; attempt++ {
+		if attempt > 0 {
+			if err := conflictBackoff(ctx, attempt); err != nil {
+				return 0, err
+			}
+		}
+		bucket, err := b.bucket(ctx, id)
+		if err != nil || bucket.etag == "" {
+			return 0, err
+		}
+		stored, err := b.entries(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		var ops []tableOp
+		value := []byte{}
+		for _, e := range stored {
+			if remove[e.hash] && len(ops) < tableBatchOps-1 {
+				ops = append(ops, tableOp{method: http.MethodDelete, path: b.entityPath(partition, "e|"+row+"|"+e.hash), etag: "*"})
+				continue
+			}
+			value = append(value, e.value...)
+		}
+		if len(ops) == 0 {
+			return 0, nil
+		}
+		op, err := b.bucketOp(id, value, bucket.etag)
+		if err != nil {
+			return 0, err
+		}
+		err = b.batch(ctx, append(ops, op))
+		if err == errTableConflict {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(ops) == tableBatchOps-1 {
+			more, err := b.RemoveEntries(ctx, id, values)
+			return len(ops) + more, err
+		}
+		return len(ops), nil
+	}
+	return 0, errTableConflict
+}
+
+// Entries calls f for every entry row of the table.
+func (b *tableBackend) Entries(f func(id string, bucketHash sql.NullInt64, value []byte) error) error {
+	rows, err := b.query(context.Background(), "RowKey gt 'e|' and RowKey lt 'e}'")
+	if err != nil {
+		return err
+	}
+	entries, err := b.parseEntries(rows)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := f(e.bucket, e.bucketHash, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close releases idle connections.
+func (b *tableBackend) Close() error {
+	b.httpClient.CloseIdleConnections()
+	return nil
+}
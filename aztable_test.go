@@ -0,0 +1,262 @@
+//go:build full || azure || !(minimal || aws)
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTables is the subset of the Azure Table service REST API used by
+// tableBackend, for one account and table. It checks SharedKeyLite
+// signatures and pages queries to exercise continuations.
+type fakeTables struct {
+	t       *testing.T
+	account string
+	key     []byte
+
+	mu       sync.Mutex
+	etag     int
+	entities map[[2]string]fakeEntity
+}
+
+type fakeEntity struct {
+	props map[string]interface{}
+	etag  string
+}
+
+// fakeTablePageSize is the number of rows of a query response page.
+const fakeTablePageSize = 8
+
+var (
+	fakeEntityPath = regexp.MustCompile(`^/[^/]+/(\w+)\(PartitionKey='((?:[^']|'')*)',RowKey='((?:[^']|'')*)'\)$`)
+	fakeFilterTerm = regexp.MustCompile(`(PartitionKey|RowKey) (eq|gt|lt) '((?:[^']|'')*)'`)
+)
+
+func newFakeTables(t *testing.T) (*httptest.Server, string) {
+	f := &fakeTables{t: t, account: "devstoreaccount1", key: []byte("fake account key"), entities: map[[2]string]fakeEntity{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	conn := fmt.Sprintf("AccountName=%s;AccountKey=%s;TableEndpoint=%s/%s", f.account, base64.StdEncoding.EncodeToString(f.key), srv.URL, f.account)
+	return srv, conn
+}
+
+func (f *fakeTables) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(req.Header.Get("x-ms-date") + "\n/" + f.account + req.URL.EscapedPath()))
+	if want := "SharedKeyLite " + f.account + ":" + base64.StdEncoding.EncodeToString(mac.Sum(nil)); req.Header.Get("Authorization") != want {
+		http.Error(w, "signature mismatch", http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	path := strings.TrimPrefix(req.URL.Path, "/"+f.account+"/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case req.Method == http.MethodPost && path == "Tables":
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodPost && path == "$batch":
+		f.batch(w, req.Header.Get("Content-Type"), body)
+	case req.Method == http.MethodGet && strings.HasSuffix(path, "()"):
+		f.query(w, req.URL.Query())
+	case req.Method == http.MethodGet:
+		m := fakeEntityPath.FindStringSubmatch(req.URL.Path)
+		if m == nil {
+			http.NotFound(w, req)
+			return
+		}
+		e, ok := f.entities[[2]string{unquote(m[2]), unquote(m[3])}]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("ETag", e.etag)
+		json.NewEncoder(w).Encode(e.props)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func unquote(s string) string { return strings.ReplaceAll(s, "''", "'") }
+
+// query serves the rows matching a filter of PartitionKey and RowKey
+// comparisons joined by and, in key order.
+func (f *fakeTables) query(w http.ResponseWriter, q url.Values) {
+	terms := fakeFilterTerm.FindAllStringSubmatch(q.Get("$filter"), -1)
+	var keys [][2]string
+	for k := range f.entities {
+		match := true
+		for _, term := range terms {
+			v := k[1]
+			if term[1] == "PartitionKey" {
+				v = k[0]
+			}
+			switch lit := unquote(term[3]); term[2] {
+			case "eq":
+				match = match && v == lit
+			case "gt":
+				match = match && v > lit
+			case "lt":
+				match = match && v < lit
+			}
+		}
+		next := [2]string{q.Get("NextPartitionKey"), q.Get("NextRowKey")}
+		if match && (next[0] == "" || k[0] > next[0] || k[0] == next[0] && k[1] >= next[1]) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	if len(keys) > fakeTablePageSize {
+		w.Header().Set("x-ms-continuation-NextPartitionKey", keys[fakeTablePageSize][0])
+		w.Header().Set("x-ms-continuation-NextRowKey", keys[fakeTablePageSize][1])
+		keys = keys[:fakeTablePageSize]
+	}
+	rows := []map[string]interface{}{}
+	for _, k := range keys {
+		rows = append(rows, f.entities[k].props)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"value": rows})
+}
+
+// batch applies the operations of an entity group transaction if they all
+// succeed, and otherwise answers with the status of the first that fails.
+func (f *fakeTables) batch(w http.ResponseWriter, contentType string, body []byte) {
+	fail := func(status int) {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "--batchresponse\r\nContent-Type: application/http\r\n\r\nHTTP/1.1 %d %s\r\n\r\n--batchresponse--\r\n", status, http.StatusText(status))
+	}
+	_, params, _ := mime.ParseMediaType(contentType)
+	batch := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	part, err := batch.NextPart()
+	if err != nil {
+		fail(http.StatusBadRequest)
+		return
+	}
+	_, params, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	changeset := multipart.NewReader(part, params["boundary"])
+	next := map[[2]string]fakeEntity{}
+	for k, e := range f.entities {
+		next[k] = e
+	}
+	ops := 0
+	for {
+		op, err := changeset.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(http.StatusBadRequest)
+			return
+		}
+		// Operations carry no Content-Length, their body runs to the end
+		// of the part.
+		r := bufio.NewReader(op)
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			fail(http.StatusBadRequest)
+			return
+		}
+		var props map[string]interface{}
+		json.NewDecoder(r).Decode(&props)
+		var key [2]string
+		if m := fakeEntityPath.FindStringSubmatch(req.URL.Path); m != nil {
+			key = [2]string{unquote(m[2]), unquote(m[3])}
+		} else {
+			pk, _ := props["PartitionKey"].(string)
+			rk, _ := props["RowKey"].(string)
+			key = [2]string{pk, rk}
+		}
+		existing, exists := next[key]
+		ifMatch := req.Header.Get("If-Match")
+		switch {
+		case req.Method == http.MethodPost && exists:
+			fail(http.StatusConflict)
+			return
+		case req.Method == http.MethodPut && (!exists || ifMatch != "*" && ifMatch != existing.etag):
+			fail(http.StatusPreconditionFailed)
+			return
+		case req.Method == http.MethodDelete && !exists:
+			fail(http.StatusNotFound)
+			return
+		case req.Method == http.MethodDelete:
+			delete(next, key)
+		default:
+			f.etag++
+			next[key] = fakeEntity{props: props, etag: `W/"` + strconv.Itoa(f.etag) + `"`}
+		}
+		ops++
+	}
+	if ops > tableBatchOps {
+		fail(http.StatusBadRequest)
+		return
+	}
+	f.entities = next
+	w.WriteHeader(http.StatusAccepted)
+	for i := 0; i < ops; i++ {
+		fmt.Fprint(w, "--batchresponse\r\nContent-Type: application/http\r\n\r\nHTTP/1.1 204 No Content\r\n\r\n")
+	}
+	fmt.Fprint(w, "--batchresponse--\r\n")
+}
+
+func TestParseTableConnection(t *testing.T) {
+	for _, tt := range []struct {
+		conn, endpoint string
+		ok             bool
+	}{
+		{"DefaultEndpointsProtocol=https;AccountName=migp;AccountKey=a2V5;EndpointSuffix=core.windows.net", "https://migp.table.core.windows.net", true},
+		{"AccountName=migp;SharedAccessSignature=sv=2019-02-02&sig=abc", "https://migp.table.core.windows.net", true},
+		{"UseDevelopmentStorage=true", "http://127.0.0.1:10002/devstoreaccount1", true},
+		{"AccountName=migp;TableEndpoint=https://tables.example/;AccountKey=a2V5", "https://tables.example", true},
+		{"AccountName=migp;AccountKey=not base64!", "", false},
+		{"AccountName=migp", "", false},
+	} {
+		b, err := parseTableConnection(tt.conn)
+		if (err == nil) != tt.ok || err == nil && b.endpoint != tt.endpoint {
+			t.Errorf("parseTableConnection(%q) = %+v, %v, want endpoint %q", tt.conn, b, err, tt.endpoint)
+		}
+	}
+}
+
+func TestTableKeys(t *testing.T) {
+	b := &tableBackend{table: "migpbuckets", prefixLen: 3}
+	partition, row := b.tableKeys("v1/0a1b2")
+	if partition != "v1!0a1" || row != "v1!0a1b2" {
+		t.Errorf("tableKeys = %q, %q", partition, row)
+	}
+	if got := b.entityPath("it's", "b|x"); got != "migpbuckets(PartitionKey='it%27%27s',RowKey='b%7Cx')" {
+		t.Errorf("entityPath = %q", got)
+	}
+	if _, err := b.bucketOp("v1/0a1b2", make([]byte, tableMaxChunks*tableChunkSize+1), ""); err != errTableBucketTooLarge {
+		t.Errorf("oversized bucket: %v, want errTableBucketTooLarge", err)
+	}
+}
+
+func TestTableBackend(t *testing.T) {
+	_, conn := newFakeTables(t)
+	t.Setenv("TABLE_CONNECTION_ST", conn)
+	b, err := openTableBackend(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	runBackendChecks(t, b, "conformance/", BackendChecks(256<<10))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// backupLockID is the advisory lock key held by the instance running a
+// backup, so that two backups never pause and resume writes under each
+// other.
+const backupLockID = schemaLockID + 1
+
+// errBackupRunning is returned when another backup holds the backup lock.
+var errBackupRunning = errors.New("a backup is already running")
+
+// backupRecord describes a completed backup: the corpus generation and
+// journal position it captured and the snapshot generation exported for
+// each version. Restoring a snapshot and replaying the journal after
+// JournalSeq brings the corpus back to any later point.
+type backupRecord struct {
+	ID               int64            `json:"id"`
+	CorpusGeneration int64            `json:"corpusGeneration"`
+	JournalSeq       int64            `json:"journalSeq"`
+	Snapshots        map[uint16]int64 `json:"snapshots"`
+	StartedAt        time.Time        `json:"startedAt"`
+	CompletedAt      time.Time        `json:"completedAt"`
+}
+
+// lockBackup takes the backup lock and returns a function releasing it.
+func (s *server) lockBackup(ctx context.Context) (func(), error) {
+	return s.tryAdvisoryLock(ctx, backupLockID, "backup", errBackupRunning)
+}
+
+// tryAdvisoryLock takes the advisory lock key and returns a function
+// releasing it, or busy if another session holds it. The lock is
+// transaction-level, held by a transaction kept open until the release: a
+// transaction stays on one server session behind a transaction pooler
+// (DB_POOLER_MODE), where the lock and unlock of a session-level lock could
+// run on different sessions and the lock leak or never be held. The
+// transaction outlives ctx, which only bounds taking the lock.
+func (s *server) tryAdvisoryLock(ctx context.Context, key int64, name string, busy error) (func(), error) {
+	tx, err := s.kv.db().BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, key).Scan(&locked); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if !locked {
+		tx.Rollback()
+		return nil, busy
+	}
+	return func() {
+		if err := tx.Rollback(); err != nil {
+			log.Printf("Releasing %s lock failed: %v", name, err)
+		}
+	}, nil
+}
+
+// awaitQuiesce waits until no journaled ingestion batch is still being
+// applied, failing after timeout. Batches left pending for longer than
+// INGEST_JOURNAL_REPLAY_AFTER were interrupted and are not waited for.
+func (s *server) awaitQuiesce(ctx context.Context, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	query := `
+	SELECT count(*) FROM ingest_journal
+	WHERE applied_at IS NULL AND skipped_at IS NULL AND created_at > now() - make_interval(secs => $1)`
+	for {
+		var pending int
+		if err := s.kv.db().QueryRowContext(ctx, query, journalReplayAfter().Seconds()).Scan(&pending); err != nil {
+			return err
+		}
+		if pending == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("writes did not quiesce within %s, %d journal batches are still being applied", timeout, pending)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// backup takes a consistent backup of the corpus. Writes are paused through
+// the read_only flag, unless it is already enabled, and resumed once the
+// backup is recorded or has failed. With writes quiesced it records the
+// corpus generation and journal position, exports a snapshot of every suite
+// to sink and calls BACKUP_HOOK_URL, if set, to trigger a storage-level
+// snapshot of the database. The caller must hold the backup lock.
+//
+// Only journaled writes are waited for, so rebalance jobs and commands run
+// outside the server should not overlap a backup.
+func (s *server) backup(ctx context.Context, sink snapshotSink, baseURL string, key ed25519.PrivateKey) (*backupRecord, error) {
+	rec := &backupRecord{StartedAt: time.Now().UTC(), Snapshots: map[uint16]int64{}}
+	if !s.readOnly() {
+		if err := s.setFlag(ctx, flagRule{Name: flagReadOnly, Enabled: true}); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := s.clearFlag(context.WithoutCancel(ctx), flagReadOnly, ""); err != nil {
+				log.Println("Resuming writes after backup failed:", err)
+			}
+		}()
+		// Other instances see the flag once their cached rules expire.
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(s.flags.ttl):
+		}
+	}
+	if err := s.awaitQuiesce(ctx, envDuration("BACKUP_QUIESCE_TIMEOUT", time.Minute)); err != nil {
+		return nil, err
+	}
+
+	query := `
+	SELECT COALESCE((SELECT generation FROM corpus_generation WHERE id = 1), 0),
+		COALESCE((SELECT max(seq) FROM ingest_journal), 0)`
+	if err := s.kv.db().QueryRowContext(ctx, query).Scan(&rec.CorpusGeneration, &rec.JournalSeq); err != nil {
+		return nil, err
+	}
+	for _, cs := range s.suites {
+		m, err := s.exportSnapshot(cs, sink, baseURL, key)
+		if err != nil {
+			return nil, fmt.Errorf("exporting version %d: %w", cs.cfg.Version, err)
+		}
+		rec.Snapshots[cs.cfg.Version] = m.Generation
+	}
+	if hook := os.Getenv("BACKUP_HOOK_URL"); hook != "" {
+		if err := callBackupHook(ctx, hook, rec); err != nil {
+			return nil, err
+		}
+	}
+
+	snapshots, err := json.Marshal(rec.Snapshots)
+	if err != nil {
+		return nil, err
+	}
+	query = `
+	INSERT INTO backups (corpus_generation, journal_seq, snapshots, started_at) VALUES ($1, $2, $3, $4)
+	RETURNING id, completed_at`
+	err = s.kv.db().QueryRowContext(ctx, query, rec.CorpusGeneration, rec.JournalSeq, snapshots, rec.StartedAt).Scan(&rec.ID, &rec.CompletedAt)
+	return rec, err
+}
+
+// callBackupHook posts rec to url, which is expected to take a storage-level
+// snapshot of the database before it responds.
+func callBackupHook(ctx context.Context, url string, rec *backupRecord) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: envDuration("BACKUP_HOOK_TIMEOUT", 5*time.Minute)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("backup hook: status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// backups returns the most recent backups, newest first.
+func (s *server) backups(ctx context.Context, limit int) ([]backupRecord, error) {
+	query := `
+	SELECT id, corpus_generation, journal_seq, snapshots, started_at, completed_at
+	FROM backups ORDER BY id DESC LIMIT $1`
+	rows, err := s.kv.db().QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []backupRecord{}
+	for rows.Next() {
+		var rec backupRecord
+		var snapshots []byte
+		if err := rows.Scan(&rec.ID, &rec.CorpusGeneration, &rec.JournalSeq, &snapshots, &rec.StartedAt, &rec.CompletedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(snapshots, &rec.Snapshots); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// handleBackup lists recent backups on GET and starts a backup job on POST.
+// Job progress is reported through job events.
+func (s *server) handleBackup(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		records, err := s.backups(req.Context(), 50)
+		if err != nil {
+			storageError(w, "Listing backups", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, records)
+		return
+	case http.MethodPost:
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, err := snapshotSigningKey()
+	if err != nil {
+		writeErrorCode(w, errForbidden, err.Error(), http.StatusForbidden)
+		return
+	}
+	sink, baseURL, err := snapshotTarget("")
+	if err != nil {
+		writeErrorCode(w, errForbidden, err.Error(), http.StatusForbidden)
+		return
+	}
+	release, err := s.lockBackup(req.Context())
+	if err == errBackupRunning {
+		writeErrorCode(w, errConflict, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		storageError(w, "Taking backup lock", err)
+		return
+	}
+	jobID, err := randomID()
+	if err != nil {
+		release()
+		log.Println("Job ID generation failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	subject := "migp/jobs/" + jobID
+	s.events.Publish(eventJobStarted, subject, map[string]interface{}{"jobId": jobID, "type": "backup"})
+
+	go func() {
+		defer release()
+		start := time.Now()
+		rec, err := s.backup(context.Background(), sink, baseURL, key)
+		if err != nil {
+			log.Printf("Backup job %s failed: %v", jobID, err)
+			s.events.Publish(eventJobFailed, subject, map[string]interface{}{"jobId": jobID, "error": err.Error()})
+			return
+		}
+		log.Printf("Backup job %s recorded backup %d at journal position %d in %s", jobID, rec.ID, rec.JournalSeq, time.Since(start))
+		s.events.Publish(eventJobCompleted, subject, map[string]interface{}{"jobId": jobID, "result": rec})
+	}()
+
+	s.acceptJob(w, req, jobID, map[string]string{"jobId": jobID})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCallBackupHook(t *testing.T) {
+	var got backupRecord
+	status := http.StatusOK
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer hook.Close()
+
+	rec := &backupRecord{CorpusGeneration: 4, JournalSeq: 17, Snapshots: map[uint16]int64{1: 3}}
+	if err := callBackupHook(context.Background(), hook.URL, rec); err != nil {
+		t.Fatal(err)
+	}
+	if got.JournalSeq != 17 || got.Snapshots[1] != 3 {
+		t.Errorf("hook received %+v, want %+v", got, rec)
+	}
+	status = http.StatusServiceUnavailable
+	if err := callBackupHook(context.Background(), hook.URL, rec); err == nil {
+		t.Error("failed hook call succeeded")
+	}
+}
+
+func TestHandleBackupMemory(t *testing.T) {
+	_, srv := newTestServer(t)
+	resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodGet, srv.URL+"/api/admin/backup", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("backup on the memory backend answered %d, want %d", resp.StatusCode, http.StatusNotImplemented)
+	}
+}
+
+func TestLockBackup(t *testing.T) {
+	s, _ := newDBTestServer(t)
+	release, err := s.lockBackup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.lockBackup(context.Background()); err != errBackupRunning {
+		t.Errorf("second backup lock: %v, want errBackupRunning", err)
+	}
+	release()
+	release, err = s.lockBackup(context.Background())
+	if err != nil {
+		t.Fatalf("backup lock after release: %v", err)
+	}
+	release()
+}
+
+func TestBackup(t *testing.T) {
+	t.Setenv("FEATURE_FLAGS_TTL", "10ms")
+	t.Setenv("SNAPSHOT_SIGNING_KEY", testSnapshotSeed)
+	s, _ := newDBTestServer(t)
+	ctx := context.Background()
+	key, err := snapshotSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := testName(t) + "@example.com"
+	if result := s.ingestParallel(ctx, ingestRequest{Credentials: []string{username + ":password1"}}, 1, nil); result.Successes != 1 {
+		t.Fatalf("ingestion %+v", result)
+	}
+
+	release, err := s.lockBackup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := s.backup(ctx, dirSink(t.TempDir()), "https://cdn.example/snapshots", key)
+	release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ID == 0 || rec.JournalSeq == 0 || rec.Snapshots[s.suites[0].cfg.Version] == 0 {
+		t.Errorf("backup record %+v lacks its position or snapshot", rec)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if s.readOnly() {
+		t.Error("writes still paused after the backup")
+	}
+
+	records, err := s.backups(ctx, 1)
+	if err != nil || len(records) != 1 || records[0].ID != rec.ID || records[0].JournalSeq != rec.JournalSeq {
+		t.Errorf("latest backup %+v, %v, want %+v", records, err, rec)
+	}
+}
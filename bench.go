@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// benchQuery is a precomputed MIGP query and the breach status its response
+// should decode to.
+type benchQuery struct {
+	body     []byte
+	ctx      migp.ClientRequestContext
+	expected migp.BreachStatus
+}
+
+// benchResult aggregates the outcome of a load run.
+type benchResult struct {
+	elapsed    time.Duration
+	latencies  []time.Duration
+	errors     int
+	mismatches int
+}
+
+// runBench implements the bench command. It ingests a synthetic corpus into
+// the storage configured by the usual environment variables, then drives
+// concurrent query load against a target server and reports latency
+// percentiles and error rates. The time and allocations of each stage of the
+// query path are measured by the benchmarks of bench_test.go instead.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	numCredentials := fs.Int("n", 1000, "number of synthetic credentials in the corpus")
+	numVariants := fs.Int("num-variants", 9, "number of password variants to ingest per credential")
+	skipIngest := fs.Bool("skip-ingest", false, "skip ingestion and query a corpus ingested by an earlier run with the same -n and -seed")
+	ingestWorkers := fs.Int("ingest-workers", runtime.NumCPU(), "number of concurrent ingestion workers")
+	target := fs.String("target", "http://localhost:8080/api/query", "query endpoint of the server under test")
+	concurrency := fs.Int("concurrency", 16, "number of concurrent query workers")
+	duration := fs.Duration("duration", 30*time.Second, "duration of the query load")
+	numQueries := fs.Int("queries", 256, "number of distinct precomputed queries to replay")
+	missRatio := fs.Float64("miss-ratio", 0.5, "fraction of queries for credentials not in the corpus")
+	seed := fs.Int64("seed", 1, "seed for the synthetic corpus")
+	chunkSize := fs.Int("chunk-size", 0, "ask for oversized buckets in chunks of this many bytes (0 for single responses)")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	credentials := syntheticCredentials(*numCredentials, *seed)
+
+	if !*skipIngest {
+		start := time.Now()
+		result, err := benchIngest(cfg, credentials, *numVariants, *ingestWorkers)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Ingested %d credentials (%d entries, %d failures) in %s\n",
+			result.Successes, result.Entries, result.Failures, time.Since(start).Round(time.Millisecond))
+	}
+
+	queries, err := prepareQueries(cfg.Config, credentials, *numQueries, *missRatio, *seed)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Querying %s with %d workers for %s\n", *target, *concurrency, *duration)
+	driveLoad(*target, queries, *concurrency, *duration, *chunkSize).report(os.Stdout)
+	return nil
+}
+
+// syntheticCredentials returns n deterministic fake <username>:<password>
+// credentials.
+func syntheticCredentials(n int, seed int64) []string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	rng := rand.New(rand.NewSource(seed))
+	credentials := make([]string, n)
+	for i := range credentials {
+		password := make([]byte, 8+rng.Intn(9))
+		for j := range password {
+			password[j] = alphabet[rng.Intn(len(alphabet))]
+		}
+		credentials[i] = fmt.Sprintf("bench-user-%d@example.com:%s", i, password)
+	}
+	return credentials
+}
+
+// benchIngest ingests credentials into the configured storage using workers
+// concurrent batches.
+func benchIngest(cfg migp.ServerConfig, credentials []string, numVariants, workers int) (ingestResult, error) {
+	s, err := newServer(cfg)
+	if err != nil {
+		return ingestResult{}, err
+	}
+	if err := s.ensureStorage(); err != nil {
+		return ingestResult{}, err
+	}
+	return s.ingestParallel(context.Background(), ingestRequest{
+		Credentials:            credentials,
+		NumVariants:            numVariants,
+		IncludeUsernameVariant: true,
+	}, workers, nil), nil
+}
+
+// prepareQueries precomputes n queries, a missRatio fraction of which are for
+// credentials that are not in the corpus. Blinding is expensive, so queries
+// are computed once and replayed during the load run.
+func prepareQueries(cfg migp.Config, credentials []string, n int, missRatio float64, seed int64) ([]benchQuery, error) {
+	client, err := migp.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	rng := rand.New(rand.NewSource(seed + 1))
+	queries := make([]benchQuery, n)
+	for i := range queries {
+		username, password := fmt.Sprintf("bench-miss-%d@example.com", i), "not-breached"
+		expected := migp.NotInBreach
+		if rng.Float64() >= missRatio && len(credentials) > 0 {
+			fields := bytes.SplitN([]byte(credentials[rng.Intn(len(credentials))]), []byte(":"), 2)
+			username, password = string(fields[0]), string(fields[1])
+			expected = migp.InBreach
+		}
+
+		request, ctx, err := client.Request([]byte(username), []byte(password))
+		if err != nil {
+			return nil, err
+		}
+		body, err := json.Marshal(request)
+		if err != nil {
+			return nil, err
+		}
+		queries[i] = benchQuery{body: body, ctx: ctx, expected: expected}
+	}
+	return queries, nil
+}
+
+// driveLoad replays queries against target from concurrency workers until
+// duration has elapsed, asking for chunked responses if chunkSize is positive.
+func driveLoad(target string, queries []benchQuery, concurrency int, duration time.Duration, chunkSize int) benchResult {
+	client := &http.Client{Timeout: 30 * time.Second}
+	deadline := time.Now().Add(duration)
+	var next atomic.Int64
+
+	var (
+		mu     sync.Mutex
+		result benchResult
+		wg     sync.WaitGroup
+	)
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local benchResult
+			for time.Now().Before(deadline) {
+				q := queries[int(next.Add(1))%len(queries)]
+				reqStart := time.Now()
+				status, err := queryStatus(client, target, q.body, q.ctx, chunkSize)
+				local.latencies = append(local.latencies, time.Since(reqStart))
+				switch {
+				case err != nil:
+					local.errors++
+				case status != q.expected:
+					local.mismatches++
+				}
+			}
+			mu.Lock()
+			result.latencies = append(result.latencies, local.latencies...)
+			result.errors += local.errors
+			result.mismatches += local.mismatches
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	result.elapsed = time.Since(start)
+	return result
+}
+
+// report writes a human-readable summary of the run to w.
+func (r benchResult) report(w io.Writer) {
+	total := len(r.latencies)
+	if total == 0 {
+		fmt.Fprintln(w, "No requests completed")
+		return
+	}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return r.latencies[int(p*float64(total-1))].Round(10 * time.Microsecond)
+	}
+
+	fmt.Fprintf(w, "Requests:    %d (%.1f/s)\n", total, float64(total)/r.elapsed.Seconds())
+	fmt.Fprintf(w, "Errors:      %d (%.2f%%)\n", r.errors, 100*float64(r.errors)/float64(total))
+	fmt.Fprintf(w, "Mismatches:  %d (%.2f%%)\n", r.mismatches, 100*float64(r.mismatches)/float64(total))
+	fmt.Fprintf(w, "Latency p50: %s\n", percentile(.50))
+	fmt.Fprintf(w, "Latency p90: %s\n", percentile(.90))
+	fmt.Fprintf(w, "Latency p99: %s\n", percentile(.99))
+	fmt.Fprintf(w, "Latency max: %s\n", r.latencies[total-1].Round(10*time.Microsecond))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// The benchmarks below measure the time and allocations per query of each
+// stage of the query path, against the golden vector fixture corpus so that
+// no storage is involved, and of the whole path through the handler on the
+// in-memory backend. Run them with go test -run - -bench . -benchmem.
+
+// discardResponse is an http.ResponseWriter that drops the response.
+type discardResponse http.Header
+
+func (d discardResponse) Header() http.Header         { return http.Header(d) }
+func (d discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+func (d discardResponse) WriteHeader(int)             {}
+
+// benchVectors returns the golden vectors of the default configuration with
+// a query of the first one, its JSON body and the response to it.
+func benchVectors(b *testing.B) (*goldenVectors, migp.ClientRequest, []byte, migp.ServerResponse) {
+	b.Helper()
+	cfg := migp.DefaultServerConfig().Config
+	vectors, err := newGoldenVectors(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	client, err := migp.NewClient(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	v := vectors.Vectors[0]
+	request, _, err := client.Request([]byte(v.Username), []byte(v.Password))
+	if err != nil {
+		b.Fatal(err)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		b.Fatal(err)
+	}
+	response, err := vectors.server.HandleRequest(request, vectors.buckets)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return vectors, request, body, response
+}
+
+func BenchmarkDecode(b *testing.B) {
+	_, _, body, _ := benchVectors(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := readBody(bytes.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		var request migp.ClientRequest
+		if err := json.Unmarshal(buf.Bytes(), &request); err != nil {
+			b.Fatal(err)
+		}
+		putBuffer(buf)
+	}
+}
+
+func BenchmarkEvaluate(b *testing.B) {
+	vectors, request, _, _ := benchVectors(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := vectors.server.HandleRequest(request, vectors.buckets); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	_, _, _, response := benchVectors(b)
+	w := discardResponse{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := writeMIGPResponse(w, &response); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkQuery(b *testing.B) {
+	s, _ := newTestServer(b)
+	credentials := syntheticCredentials(100, 1)
+	if result := s.ingestParallel(context.Background(), ingestRequest{Credentials: credentials}, 1, nil); result.Successes != len(credentials) {
+		b.Fatalf("ingestion %+v", result)
+	}
+	client, err := migp.NewClient(s.suites[0].cfg.Config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	request, _, err := client.Request([]byte("bench-user-0@example.com"), []byte("password"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		b.Fatal(err)
+	}
+	h := s.handler()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/query", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			b.Fatalf("query answered %d: %s", w.Code, w.Body)
+		}
+	}
+}
+
+func BenchmarkIngest(b *testing.B) {
+	s, _ := newTestServer(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		credential := fmt.Sprintf("bench-user-%d@example.com:password", i)
+		if result := s.ingestParallel(context.Background(), ingestRequest{Credentials: []string{credential}}, 1, nil); result.Successes != 1 {
+			b.Fatalf("ingestion %+v", result)
+		}
+	}
+}
+
+func TestBenchLoad(t *testing.T) {
+	credentials := syntheticCredentials(20, 1)
+	if again := syntheticCredentials(20, 1); strings.Join(again, "\n") != strings.Join(credentials, "\n") {
+		t.Fatal("synthetic corpus differs between runs with the same seed")
+	}
+	s, srv := newTestServer(t)
+	if result := s.ingestParallel(context.Background(), ingestRequest{Credentials: credentials}, 2, nil); result.Successes != len(credentials) {
+		t.Fatalf("ingestion %+v", result)
+	}
+	queries, err := prepareQueries(s.suites[0].cfg.Config, credentials, 8, 0.5, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := driveLoad(srv.URL+"/api/query", queries, 2, 200*time.Millisecond, 0)
+	if len(result.latencies) == 0 || result.errors != 0 || result.mismatches != 0 {
+		t.Fatalf("load run: %d requests, %d errors, %d mismatches", len(result.latencies), result.errors, result.mismatches)
+	}
+	var report strings.Builder
+	result.report(&report)
+	if !strings.Contains(report.String(), "Latency p99:") {
+		t.Errorf("report %q", report.String())
+	}
+}
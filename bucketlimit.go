@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Bucket limits cap the entries and bytes of a bucket at ingestion, so that
+// the query path never has to serve a pathological bucket. BUCKET_MAX_ENTRIES
+// and BUCKET_MAX_BYTES set the limits (default 0, unlimited), and
+// BUCKET_OVERFLOW_STRATEGY what happens to an entry that would exceed them:
+//
+//   - reject (the default) drops the entry.
+//   - overflow parks the entry in the bucket_overflow table, where it is not
+//     served, until POST /api/admin/buckets/overflow moves it back once its
+//     bucket has room, for example after the limits were raised.
+//   - alert appends the entry anyway.
+//
+// Every strategy publishes eventBucketLimitExceeded, prompting a rebalance or
+// rebucket of the corpus.
+
+// Overflow strategies selected by BUCKET_OVERFLOW_STRATEGY.
+const (
+	overflowReject = "reject"
+	overflowPark   = "overflow"
+	overflowAlert  = "alert"
+)
+
+// eventBucketLimitExceeded is published when an append exceeds the bucket
+// limits, at most once per BUCKET_LIMIT_ALERT_INTERVAL (default 10m) for each
+// bucket.
+const eventBucketLimitExceeded = "MIGP.Corpus.BucketLimitExceeded"
+
+var bucketLimitExceeded = newCounter("migp_bucket_limit_exceeded_total", "Appends exceeding the bucket limits by overflow strategy.", "strategy")
+
+var (
+	// errBucketFull is returned for entries rejected by the bucket limits.
+	errBucketFull = errors.New("bucket is full")
+
+	// errBucketOverflowed is returned for entries parked in the overflow
+	// table by the bucket limits.
+	errBucketOverflowed = errors.New("bucket is full, entry moved to overflow")
+)
+
+// bucketLimits is the maximum size of a bucket. Zero limits are unlimited.
+type bucketLimits struct {
+	maxEntries int
+	maxBytes   int
+	strategy   string
+}
+
+// bucketLimitsFromEnv returns the bucket limits configured by
+// BUCKET_MAX_ENTRIES, BUCKET_MAX_BYTES and BUCKET_OVERFLOW_STRATEGY.
+func bucketLimitsFromEnv() bucketLimits {
+	l := bucketLimits{
+		maxEntries: envInt("BUCKET_MAX_ENTRIES", 0),
+		maxBytes:   envInt("BUCKET_MAX_BYTES", 0),
+		strategy:   overflowReject,
+	}
+	switch strategy := os.Getenv("BUCKET_OVERFLOW_STRATEGY"); strategy {
+	case "", overflowReject:
+	case overflowPark, overflowAlert:
+		l.strategy = strategy
+	default:
+		log.Printf("Invalid BUCKET_OVERFLOW_STRATEGY value %q. Using %s.", strategy, overflowReject)
+	}
+	return l
+}
+
+// enabled reports whether any limit is set.
+func (l bucketLimits) enabled() bool {
+	return l.maxEntries > 0 || l.maxBytes > 0
+}
+
+// bucketUsage is the size of a bucket.
+type bucketUsage struct {
+	Entries int `json:"entries"`
+	Bytes   int `json:"bytes"`
+}
+
+// exceeds reports whether u is over the limits.
+func (l bucketLimits) exceeds(u bucketUsage) bool {
+	return (l.maxEntries > 0 && u.Entries > l.maxEntries) || (l.maxBytes > 0 && u.Bytes > l.maxBytes)
+}
+
+// checkLimits applies the bucket limits to appending value to the bucket
+// stored under id, within tx after the entry was added to the shadow table.
+// It locks the bucket row, so that concurrent appends are checked against
+// each other. It returns whether the append may proceed, and otherwise
+// errBucketFull or errBucketOverflowed once the entry has been dropped or
+// parked.
+func (kv *kvStore) checkLimits(ctx context.Context, tx *sql.Tx, id string, bucketHash sql.NullInt64, value []byte) (bool, error) {
+	var u bucketUsage
+	query := `SELECT coalesce((SELECT length(value) FROM kv_store WHERE id = $1 FOR UPDATE), 0), (SELECT count(*) FROM kv_store_shadow WHERE id = $1 AND deleted_at IS NULL)`
+	if err := tx.QueryRowContext(ctx, query, id).Scan(&u.Bytes, &u.Entries); err != nil {
+		return false, err
+	}
+	u.Bytes += len(value)
+	if !kv.limits.exceeds(u) {
+		return true, nil
+	}
+	bucketLimitExceeded.Inc(kv.limits.strategy)
+	if kv.limitExceeded != nil {
+		defer kv.limitExceeded(id, u)
+	}
+	switch kv.limits.strategy {
+	case overflowAlert:
+		return true, nil
+	case overflowPark:
+		if _, err := tx.ExecContext(ctx, `DELETE FROM kv_store_shadow WHERE id = $1 AND value = $2`, id, value); err != nil {
+			return false, err
+		}
+		query := `INSERT INTO bucket_overflow (id, value, bucket_hash) VALUES ($1, $2, $3) ON CONFLICT (id, value) DO NOTHING`
+		if _, err := tx.ExecContext(ctx, query, id, value, bucketHash); err != nil {
+			return false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return false, err
+		}
+		return false, errBucketOverflowed
+	default:
+		return false, errBucketFull
+	}
+}
+
+// bucketLimitAlerts throttles eventBucketLimitExceeded by bucket.
+type bucketLimitAlerts struct {
+	mu      sync.Mutex
+	alerted map[string]time.Time
+}
+
+// alertBucketLimit publishes eventBucketLimitExceeded for the bucket stored
+// under key, of size u, unless it was published recently.
+func (s *server) alertBucketLimit(key string, u bucketUsage) {
+	a := &s.limitAlerts
+	a.mu.Lock()
+	if a.alerted == nil {
+		a.alerted = map[string]time.Time{}
+	}
+	if time.Since(a.alerted[key]) < envDuration("BUCKET_LIMIT_ALERT_INTERVAL", 10*time.Minute) {
+		a.mu.Unlock()
+		return
+	}
+	a.alerted[key] = time.Now()
+	a.mu.Unlock()
+
+	label := s.kv.bucketLabel(key)
+	log.Printf("Bucket %s exceeds its limits with %d entries and %d bytes; applying strategy %s", label, u.Entries, u.Bytes, s.kv.limits.strategy)
+	s.events.Publish(eventBucketLimitExceeded, "migp/buckets/"+label, map[string]interface{}{
+		"bucket":     label,
+		"entries":    u.Entries,
+		"bytes":      u.Bytes,
+		"maxEntries": s.kv.limits.maxEntries,
+		"maxBytes":   s.kv.limits.maxBytes,
+		"strategy":   s.kv.limits.strategy,
+	})
+}
+
+// overflowSummary counts the entries parked in the overflow table.
+type overflowSummary struct {
+	Entries int            `json:"entries"`
+	Buckets map[string]int `json:"buckets"`
+}
+
+// drainResult summarizes a drain of the overflow table.
+type drainResult struct {
+	Moved    int `json:"moved"`
+	Full     int `json:"full"`
+	Failures int `json:"failures"`
+}
+
+// drainOverflow appends every parked entry whose bucket now has room and
+// removes it from the overflow table.
+func (s *server) drainOverflow(ctx context.Context) (drainResult, error) {
+	var result drainResult
+	type parked struct {
+		id         string
+		bucketHash sql.NullInt64
+		value      []byte
+	}
+	rows, err := s.kv.db().QueryContext(ctx, `SELECT id, bucket_hash, value FROM bucket_overflow ORDER BY created_at`)
+	if err != nil {
+		return result, err
+	}
+	var entries []parked
+	for rows.Next() {
+		var p parked
+		if err := rows.Scan(&p.id, &p.bucketHash, &p.value); err != nil {
+			rows.Close()
+			return result, err
+		}
+		entries = append(entries, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for _, p := range entries {
+		_, err := s.kv.AppendUnique(ctx, p.id, p.bucketHash, p.value)
+		switch {
+		case err == errBucketFull || err == errBucketOverflowed:
+			result.Full++
+			continue
+		case err != nil:
+			log.Printf("Draining overflow entry of bucket %s failed: %v", s.kv.bucketLabel(p.id), err)
+			result.Failures++
+			continue
+		}
+		if _, err := s.kv.db().ExecContext(ctx, `DELETE FROM bucket_overflow WHERE id = $1 AND value = $2`, p.id, p.value); err != nil {
+			return result, err
+		}
+		result.Moved++
+	}
+	if result.Moved > 0 {
+		s.corpusChanged()
+	}
+	return result, nil
+}
+
+// handleOverflow reports the entries parked by the bucket limits on GET, and
+// starts a job draining them on POST.
+func (s *server) handleOverflow(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		rows, err := s.kv.db().QueryContext(req.Context(), `SELECT id, count(*) FROM bucket_overflow GROUP BY id ORDER BY id`)
+		if err != nil {
+			storageError(w, "Listing overflow entries", err)
+			return
+		}
+		defer rows.Close()
+		summary := overflowSummary{Buckets: map[string]int{}}
+		for rows.Next() {
+			var key string
+			var n int
+			if err := rows.Scan(&key, &n); err != nil {
+				storageError(w, "Listing overflow entries", err)
+				return
+			}
+			summary.Entries += n
+			summary.Buckets[key] = n
+		}
+		if err := rows.Err(); err != nil {
+			storageError(w, "Listing overflow entries", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, summary)
+
+	case http.MethodPost:
+		jobID, err := randomID()
+		if err != nil {
+			log.Println("Job ID generation failed:", err)
+			writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		subject := "migp/jobs/" + jobID
+		s.events.Publish(eventJobStarted, subject, map[string]interface{}{"jobId": jobID, "type": "overflow-drain"})
+
+		go func() {
+			result, err := s.drainOverflow(context.Background())
+			if err != nil {
+				log.Printf("Overflow drain job %s failed: %v", jobID, err)
+				s.events.Publish(eventJobFailed, subject, map[string]interface{}{"jobId": jobID, "error": err.Error(), "result": result})
+				return
+			}
+			log.Printf("Overflow drain job %s moved %d entries, %d still over the bucket limits", jobID, result.Moved, result.Full)
+			s.events.Publish(eventJobCompleted, subject, map[string]interface{}{"jobId": jobID, "result": result})
+		}()
+
+		s.acceptJob(w, req, jobID, map[string]string{"jobId": jobID})
+
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
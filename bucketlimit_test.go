@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+)
+
+func TestBucketLimitsFromEnv(t *testing.T) {
+	for _, tt := range []struct {
+		strategy, want string
+	}{
+		{"", overflowReject},
+		{overflowPark, overflowPark},
+		{overflowAlert, overflowAlert},
+		{"truncate", overflowReject},
+	} {
+		t.Setenv("BUCKET_OVERFLOW_STRATEGY", tt.strategy)
+		if got := bucketLimitsFromEnv().strategy; got != tt.want {
+			t.Errorf("BUCKET_OVERFLOW_STRATEGY=%q selected %s, want %s", tt.strategy, got, tt.want)
+		}
+	}
+
+	if bucketLimitsFromEnv().enabled() {
+		t.Error("limits enabled by default")
+	}
+	t.Setenv("BUCKET_MAX_ENTRIES", "2")
+	t.Setenv("BUCKET_MAX_BYTES", "100")
+	l := bucketLimitsFromEnv()
+	for _, tt := range []struct {
+		usage bucketUsage
+		want  bool
+	}{
+		{bucketUsage{Entries: 2, Bytes: 100}, false},
+		{bucketUsage{Entries: 3, Bytes: 10}, true},
+		{bucketUsage{Entries: 1, Bytes: 101}, true},
+	} {
+		if got := l.exceeds(tt.usage); got != tt.want {
+			t.Errorf("exceeds(%+v) = %v, want %v", tt.usage, got, tt.want)
+		}
+	}
+}
+
+func TestAlertBucketLimit(t *testing.T) {
+	receiver, deliveries := newEventReceiver(t)
+	t.Setenv("EVENT_WEBHOOK_URLS", receiver.URL)
+	s, _ := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		s.alertBucketLimit("v1/0a1b2", bucketUsage{Entries: 5 + i})
+	}
+	s.alertBucketLimit("v1/0a1b3", bucketUsage{Entries: 5})
+	s.events.Wait()
+	alerts := map[string]int{}
+	for _, d := range deliveries() {
+		var ev event
+		if err := json.Unmarshal(d.body, &ev); err == nil && ev.EventType == eventBucketLimitExceeded {
+			alerts[ev.Subject]++
+		}
+	}
+	if alerts["migp/buckets/v1/0a1b2"] != 1 || alerts["migp/buckets/v1/0a1b3"] != 1 {
+		t.Errorf("alerts by bucket %v, want one each", alerts)
+	}
+}
+
+func TestBucketLimitStrategies(t *testing.T) {
+	s, _ := newDBTestServer(t)
+	ctx := context.Background()
+	for _, tt := range []struct {
+		strategy string
+		err      error
+	}{
+		{overflowReject, errBucketFull},
+		{overflowPark, errBucketOverflowed},
+		{overflowAlert, nil},
+	} {
+		key := "test/" + testName(t)
+		t.Cleanup(func() {
+			db := s.kv.db()
+			db.Exec(`DELETE FROM kv_store WHERE id = $1`, key)
+			db.Exec(`DELETE FROM kv_store_shadow WHERE id = $1`, key)
+			db.Exec(`DELETE FROM bucket_overflow WHERE id = $1`, key)
+		})
+		s.kv.limits = bucketLimits{maxEntries: 1, strategy: tt.strategy}
+		if _, err := s.kv.AppendUnique(ctx, key, sql.NullInt64{}, []byte("first")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.kv.AppendUnique(ctx, key, sql.NullInt64{}, []byte("second")); err != tt.err {
+			t.Errorf("%s strategy: second append %v, want %v", tt.strategy, err, tt.err)
+		}
+		var parked int
+		if err := s.kv.db().QueryRow(`SELECT count(*) FROM bucket_overflow WHERE id = $1`, key).Scan(&parked); err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.strategy == overflowPark; (parked == 1) != want {
+			t.Errorf("%s strategy parked %d entries", tt.strategy, parked)
+		}
+		if tt.strategy != overflowPark {
+			continue
+		}
+
+		if result, err := s.drainOverflow(ctx); err != nil || result.Full == 0 {
+			t.Errorf("drain of a full bucket: %+v, %v", result, err)
+		}
+		s.kv.limits = bucketLimits{strategy: overflowPark}
+		if result, err := s.drainOverflow(ctx); err != nil || result.Moved == 0 {
+			t.Errorf("drain after raising the limits: %+v, %v", result, err)
+		}
+		value, err := s.kv.Get(ctx, key)
+		if err != nil || len(value) != len("firstsecond") {
+			t.Errorf("drained bucket %q, %v, want both entries", value, err)
+		}
+	}
+	s.kv.limits = bucketLimits{}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// A split bucket keeps its full contents under its usual key, so clients that
+// only know the suite's bucket ID bit length are unaffected, and additionally
+// stores copies of its entries in sub-buckets keyed by more bits of the
+// username hash. Clients that look up the published layout can then fetch a
+// much smaller sub-bucket for hot ranges, at the cost of revealing those extra
+// bits of their username hash.
+
+// appendSplitQuery appends an entry to the sub-bucket it belongs to when its
+// bucket ($1) has been split. $3 is the entry's 32-bit username hash.
+const appendSplitQuery = `
+	INSERT INTO kv_store (id, value)
+	SELECT s.id || '/' || s.bits || '/' || lpad(to_hex($3::BIGINT >> (32 - s.bits)), 8, '0'), $2
+	FROM bucket_splits s WHERE s.id = $1
+	ON CONFLICT (id) DO UPDATE SET value = kv_store.value || EXCLUDED.value, version = kv_store.version + 1`
+
+// errUnsplittable is returned for buckets holding entries ingested before
+// username hashes were recorded. Re-ingesting them makes the bucket splittable.
+var errUnsplittable = errors.New("bucket has entries without a recorded username hash")
+
+// subBucketKey returns the storage key of the sub-bucket of baseKey holding
+// entries whose username hash starts with the top bits of bucketHash.
+func subBucketKey(baseKey string, bits int, bucketHash uint32) string {
+	return fmt.Sprintf("%s/%d/%s", baseKey, bits, migp.BucketIDToHex(bucketHash>>(32-bits)))
+}
+
+// splitBits returns the bit length the bucket stored under key is split at,
+// or zero if it is not split.
+func (kv *kvStore) splitBits(ctx context.Context, key string) (int, error) {
+	var bits int
+	err := kv.db().QueryRowContext(ctx, `SELECT bits FROM bucket_splits WHERE id = $1`, key).Scan(&bits)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return bits, err
+}
+
+// getSplit returns the smallest stored bucket of cs containing every entry for
+// id, a bucket ID of the given bit length. That is the matching sub-bucket if
+// the bucket is split at no more than bits, and the whole bucket otherwise.
+func (kv *kvStore) getSplit(ctx context.Context, cs *cryptoSuite, id string, bits int) ([]byte, error) {
+	raw, err := hex.DecodeString(id)
+	if err != nil || len(raw) != 4 {
+		return nil, errors.New("bucket ID not valid hex")
+	}
+	hash := binary.BigEndian.Uint32(raw) << (32 - bits)
+
+	baseKey := cs.bucketKey(migp.BucketIDToHex(hash >> (32 - cs.cfg.BucketIDBitSize)))
+	split, err := kv.splitBits(ctx, baseKey)
+	if err != nil {
+		return nil, err
+	}
+	if split == 0 || split > bits {
+		return kv.Get(ctx, baseKey)
+	}
+	return kv.Get(ctx, subBucketKey(baseKey, split, hash))
+}
+
+// splitBucket splits the bucket stored under key at the smallest bit length,
+// no larger than maxBits, whose sub-buckets all fit in threshold bytes. It
+// returns the chosen bit length, which is left unchanged if it matches the
+// bucket's current split. The sub-buckets are computed without blocking
+// appends, and recomputed if an append lands in between.
+func (kv *kvStore) splitBucket(key string, baseBits, maxBits, threshold int) (int, error) {
+	var bits int
+	err := retryConflicts(func() error {
+		var err error
+		bits, err = kv.trySplitBucket(key, baseBits, maxBits, threshold)
+		return err
+	})
+	return bits, err
+}
+
+// trySplitBucket makes a single attempt of splitBucket.
+func (kv *kvStore) trySplitBucket(key string, baseBits, maxBits, threshold int) (int, error) {
+	tx, err := kv.db().Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	version, err := bucketVersion(tx, key)
+	if err != nil || version == 0 {
+		// A missing bucket has nothing to split.
+		return 0, err
+	}
+	type entry struct {
+		hash  uint32
+		value []byte
+	}
+	var entries []entry
+	rows, err := tx.Query(`SELECT bucket_hash, value FROM kv_store_shadow WHERE id = $1 AND deleted_at IS NULL`, key)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var hash sql.NullInt64
+		var value []byte
+		if err := rows.Scan(&hash, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !hash.Valid {
+			rows.Close()
+			return 0, errUnsplittable
+		}
+		entries = append(entries, entry{uint32(hash.Int64), value})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var subBuckets map[string][]byte
+	bits := baseBits
+	for bits < maxBits {
+		bits++
+		subBuckets = map[string][]byte{}
+		largest := 0
+		for _, e := range entries {
+			sub := subBucketKey(key, bits, e.hash)
+			subBuckets[sub] = append(subBuckets[sub], e.value...)
+			if len(subBuckets[sub]) > largest {
+				largest = len(subBuckets[sub])
+			}
+		}
+		if largest <= threshold {
+			break
+		}
+	}
+
+	var current int
+	err = tx.QueryRow(`SELECT bits FROM bucket_splits WHERE id = $1`, key).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if current == bits {
+		return bits, nil
+	}
+
+	if _, err := tx.Exec(`DELETE FROM kv_store WHERE id LIKE $1 || '/%'`, key); err != nil {
+		return 0, err
+	}
+	for sub, value := range subBuckets {
+		if _, err := tx.Exec(`INSERT INTO kv_store (id, value) VALUES ($1, $2)`, sub, value); err != nil {
+			return 0, err
+		}
+	}
+	query := `
+	INSERT INTO bucket_splits (id, bits) VALUES ($1, $2)
+	ON CONFLICT (id) DO UPDATE SET bits = $2, created_at = now()`
+	if _, err := tx.Exec(query, key, bits); err != nil {
+		return 0, err
+	}
+	if err := checkVersion(tx, key, version); err != nil {
+		return 0, err
+	}
+	return bits, tx.Commit()
+}
+
+// mergeBucket undoes the split of the bucket stored under key.
+func (kv *kvStore) mergeBucket(key string) error {
+	tx, err := kv.db().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT 1 FROM kv_store WHERE id = $1 FOR UPDATE`, key); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM bucket_splits WHERE id = $1`, key); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM kv_store WHERE id LIKE $1 || '/%'`, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// bucketSplits returns the split bit length of every split bucket of cs, by
+// bucket ID.
+func (kv *kvStore) bucketSplits(cs *cryptoSuite) (map[string]int, error) {
+	rows, err := kv.db().Query(`SELECT id, bits FROM bucket_splits`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	splits := map[string]int{}
+	for rows.Next() {
+		var key string
+		var bits int
+		if err := rows.Scan(&key, &bits); err != nil {
+			return nil, err
+		}
+		if id, ok := cs.bucketID(key); ok {
+			splits[id] = bits
+		}
+	}
+	return splits, rows.Err()
+}
+
+// rebalanceSpec configures a bucket rebalancing job. Buckets larger than
+// SplitThreshold bytes are split, and split buckets that shrank to at most
+// MergeThreshold bytes, for example after compaction, are merged again.
+type rebalanceSpec struct {
+	Version        uint16 `json:"version"`
+	SplitThreshold int    `json:"splitThreshold"`
+	MergeThreshold int    `json:"mergeThreshold"`
+	MaxBits        int    `json:"maxBits"`
+}
+
+// rebalanceResult summarizes a rebalancing job.
+type rebalanceResult struct {
+	Oversized    int `json:"oversized"`
+	Split        int `json:"split"`
+	Unchanged    int `json:"unchanged"`
+	Unsplittable int `json:"unsplittable"`
+	Merged       int `json:"merged"`
+	Failures     int `json:"failures"`
+}
+
+// defaultRebalanceSpec returns the rebalanceSpec used for omitted fields.
+func defaultRebalanceSpec() rebalanceSpec {
+	split := envInt("BUCKET_SPLIT_THRESHOLD", 64<<10)
+	return rebalanceSpec{
+		SplitThreshold: split,
+		MergeThreshold: split / 2,
+		MaxBits:        envInt("BUCKET_SPLIT_MAX_BITS", 28),
+	}
+}
+
+// rebalance splits oversized buckets of cs and merges split buckets that are
+// no longer oversized, reporting its progress in percent to progress.
+func (s *server) rebalance(cs *cryptoSuite, spec rebalanceSpec, progress func(percent int)) (rebalanceResult, error) {
+	var result rebalanceResult
+	rows, err := s.kv.db().Query(`SELECT id FROM kv_store WHERE length(value) > $1`, spec.SplitThreshold)
+	if err != nil {
+		return result, err
+	}
+	var oversized []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return result, err
+		}
+		if _, ok := cs.bucketID(key); ok {
+			oversized = append(oversized, key)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	result.Oversized = len(oversized)
+	for i, key := range oversized {
+		progress(i * 50 / len(oversized))
+		before, err := s.kv.splitBits(context.Background(), key)
+		if err != nil {
+			return result, err
+		}
+		bits, err := s.kv.splitBucket(key, cs.cfg.BucketIDBitSize, spec.MaxBits, spec.SplitThreshold)
+		switch {
+		case err == errUnsplittable:
+			result.Unsplittable++
+		case err != nil:
+			log.Printf("Splitting bucket %s failed: %v", key, err)
+			result.Failures++
+		case bits == before:
+			result.Unchanged++
+		default:
+			result.Split++
+		}
+	}
+
+	query := `
+	SELECT s.id FROM bucket_splits s JOIN kv_store k ON k.id = s.id
+	WHERE length(k.value) <= $1`
+	rows, err = s.kv.db().Query(query, spec.MergeThreshold)
+	if err != nil {
+		return result, err
+	}
+	var shrunk []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return result, err
+		}
+		if _, ok := cs.bucketID(key); ok {
+			shrunk = append(shrunk, key)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	for i, key := range shrunk {
+		progress(50 + i*50/len(shrunk))
+		if err := s.kv.mergeBucket(key); err != nil {
+			log.Printf("Merging bucket %s failed: %v", key, err)
+			result.Failures++
+			continue
+		}
+		result.Merged++
+	}
+	if result.Split > 0 || result.Merged > 0 {
+		s.corpusChanged()
+	}
+	return result, nil
+}
+
+// handleRebalance starts a background job splitting oversized buckets and
+// merging split buckets that shrank. Job progress is reported through job
+// events.
+func (s *server) handleRebalance(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	spec := defaultRebalanceSpec()
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+			log.Println("Request body unmarshal failed:", err)
+			writeError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	cs := s.suites[0]
+	if spec.Version != 0 {
+		if cs = s.suite(spec.Version); cs == nil {
+			writeErrorCode(w, errUnsupportedVersion, "unsupported version", http.StatusBadRequest)
+			return
+		}
+	}
+	if spec.SplitThreshold < 1 || spec.MergeThreshold >= spec.SplitThreshold {
+		writeError(w, "splitThreshold must be positive and larger than mergeThreshold", http.StatusBadRequest)
+		return
+	}
+	if spec.MaxBits <= cs.cfg.BucketIDBitSize || spec.MaxBits > 32 {
+		writeError(w, fmt.Sprintf("maxBits must be between %d and 32", cs.cfg.BucketIDBitSize+1), http.StatusBadRequest)
+		return
+	}
+
+	jobID, err := randomID()
+	if err != nil {
+		log.Println("Job ID generation failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	subject := "migp/jobs/" + jobID
+	s.events.Publish(eventJobStarted, subject, map[string]interface{}{"jobId": jobID, "type": "rebalance", "spec": spec})
+
+	go func() {
+		start := time.Now()
+		result, err := s.rebalance(cs, spec, s.jobProgress(jobID))
+		if err != nil {
+			log.Printf("Rebalance job %s failed: %v", jobID, err)
+			s.events.Publish(eventJobFailed, subject, map[string]interface{}{"jobId": jobID, "error": err.Error(), "result": result})
+			return
+		}
+		log.Printf("Rebalance job %s split %d and merged %d buckets in %s", jobID, result.Split, result.Merged, time.Since(start))
+		s.events.Publish(eventJobCompleted, subject, map[string]interface{}{"jobId": jobID, "result": result})
+	}()
+
+	s.acceptJob(w, req, jobID, map[string]string{"jobId": jobID})
+}
+
+// handleBucketLayout returns the split buckets of the current suite, or of the
+// suite for the version query parameter, so that clients can request
+// sub-buckets by sending bucketIDBitSize with their query.
+func (s *server) handleBucketLayout(w http.ResponseWriter, req *http.Request) {
+	cs := s.suiteParam(w, req)
+	if cs == nil {
+		return
+	}
+
+	splits, err := s.kv.bucketSplits(cs)
+	if err != nil {
+		log.Println("Listing bucket splits failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version":         cs.cfg.Version,
+		"bucketIDBitSize": cs.cfg.BucketIDBitSize,
+		"splits":          splits,
+	})
+}
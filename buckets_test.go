@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestSubBucketKey(t *testing.T) {
+	for _, tt := range []struct {
+		bits int
+		hash uint32
+		want string
+	}{
+		{24, 0xdeadbeef, "0deadb/24/00deadbe"},
+		{32, 0xdeadbeef, "0deadb/32/deadbeef"},
+		{21, 0x80000000, "0deadb/21/00100000"},
+	} {
+		if got := subBucketKey("0deadb", tt.bits, tt.hash); got != tt.want {
+			t.Errorf("subBucketKey(%d, %x) = %q, want %q", tt.bits, tt.hash, got, tt.want)
+		}
+	}
+}
+
+func TestHandleRebalanceValidation(t *testing.T) {
+	t.Setenv("BUCKET_SPLIT_THRESHOLD", "1024")
+	spec := defaultRebalanceSpec()
+	if spec.SplitThreshold != 1024 || spec.MergeThreshold != 512 || spec.MaxBits != 28 {
+		t.Fatalf("default spec %+v", spec)
+	}
+
+	_, srv := newTestServer(t)
+	resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodPost, srv.URL+"/api/admin/buckets/rebalance", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("rebalance on the memory backend answered %d, want %d", resp.StatusCode, http.StatusNotImplemented)
+	}
+}
+
+func TestSplitBucket(t *testing.T) {
+	s, srv := newDBTestServer(t)
+	ctx := context.Background()
+	cs := s.suites[0]
+	username := testName(t) + "@example.com"
+	id := migp.BucketIDToHex(cs.server.BucketID([]byte(username)))
+	key := cs.bucketKey(id)
+	db := s.kv.db()
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM bucket_splits WHERE id = $1`, key)
+		db.Exec(`DELETE FROM kv_store WHERE id = $1 OR id LIKE $1 || '/%'`, key)
+		db.Exec(`DELETE FROM kv_store_shadow WHERE id = $1`, key)
+	})
+
+	if result := s.ingestParallel(ctx, ingestRequest{Credentials: []string{username + ":password1"}, NumVariants: 9}, 1, nil); result.Successes != 1 {
+		t.Fatalf("ingestion %+v", result)
+	}
+	full, err := s.kv.Get(ctx, key)
+	if err != nil || len(full) == 0 {
+		t.Fatalf("bucket %s: %d bytes, %v", key, len(full), err)
+	}
+
+	// Every entry has the same username hash, so no split below maxBits
+	// gets under the threshold.
+	bits, err := s.kv.splitBucket(key, cs.cfg.BucketIDBitSize, 24, 1)
+	if err != nil || bits != 24 {
+		t.Fatalf("split at %d bits, %v, want 24", bits, err)
+	}
+	if stored, err := s.kv.splitBits(ctx, key); err != nil || stored != bits {
+		t.Fatalf("stored split %d, %v", stored, err)
+	}
+	hash := cs.bucketHash([]byte(username))
+	sub, err := s.kv.getSplit(ctx, cs, migp.BucketIDToHex(hash>>(32-28)), 28)
+	if err != nil || !bytes.Equal(sub, full) {
+		t.Fatalf("sub-bucket %d bytes, %v, want the %d entry bytes of the user", len(sub), err, len(full))
+	}
+
+	resp, err := http.Get(srv.URL + "/api/buckets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !strings.Contains(string(layout), `"`+id+`":24`) {
+		t.Errorf("bucket layout %s lacks the split", layout)
+	}
+
+	if err := s.kv.mergeBucket(key); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := s.kv.splitBits(ctx, key); err != nil || stored != 0 {
+		t.Fatalf("split %d, %v after merging", stored, err)
+	}
+	if sub, err := s.kv.Get(ctx, subBucketKey(key, bits, hash)); err != nil || len(sub) != 0 {
+		t.Fatalf("sub-bucket %d bytes, %v after merging", len(sub), err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A tenant can keep custody of its MIGP key: a configuration in
+// TENANT_CONFIGS may give privateKeyRef, a reference to a Key Vault secret
+// the tenant controls holding the key as privateKey would, instead of the key
+// itself:
+//
+//	{"acme": {"version": 1, …, "privateKeyRef": "keyvault://acme-vault/migp-key"}}
+//
+// The reference is in any Key Vault form of secrets.go and the vault is read
+// with the managed identity of the instance, which the tenant grants read
+// access to the secret. Referenced keys are loaded at startup and again every
+// TENANT_KEY_REFRESH (default 15m), held in memory only and never written to
+// storage, logs or backups. When the vault refuses the identity or no longer
+// has the secret, the tenant has withdrawn its key: its suites are dropped
+// and its requests fail with a 503 until a refresh reads the key again. Other
+// failures, such as the vault being unreachable, keep the loaded key.
+
+var tenantKeyAvailable = newGauge("migp_tenant_key_available", "Whether the referenced key of a tenant is loaded.", "tenant")
+
+// tenantKeyRef returns the key reference of the raw tenant configuration
+// cfg, or an empty string if it holds its key.
+func tenantKeyRef(cfg json.RawMessage) (string, error) {
+	var fields struct {
+		PrivateKey    *json.RawMessage `json:"privateKey"`
+		PrivateKeyRef string           `json:"privateKeyRef"`
+	}
+	if err := json.Unmarshal(cfg, &fields); err != nil {
+		return "", err
+	}
+	if fields.PrivateKeyRef == "" {
+		return "", nil
+	}
+	if fields.PrivateKey != nil {
+		return "", errors.New("both privateKey and privateKeyRef are set")
+	}
+	if p, _, ok := secretReference(fields.PrivateKeyRef); !ok || p != secretProviders["keyvault"] {
+		return "", fmt.Errorf("privateKeyRef %q is not a Key Vault reference", fields.PrivateKeyRef)
+	}
+	return fields.PrivateKeyRef, nil
+}
+
+// resolveTenantKey returns the raw tenant configuration cfg with its key
+// reference, if any, replaced by the key.
+func resolveTenantKey(ctx context.Context, cfg json.RawMessage) (json.RawMessage, error) {
+	ref, err := tenantKeyRef(cfg)
+	if err != nil || ref == "" {
+		return cfg, err
+	}
+	p, name, _ := secretReference(ref)
+	key, err := p.secret(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("reading the referenced key: %w", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(cfg, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "privateKeyRef")
+	if fields["privateKey"], err = json.Marshal(strings.TrimSpace(key)); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// keyWithdrawn reports whether err says the vault refused the key to this
+// deployment, rather than failing to answer.
+func keyWithdrawn(err error) bool {
+	var status secretStatusError
+	if !errors.As(err, &status) {
+		return false
+	}
+	return status.status == http.StatusUnauthorized || status.status == http.StatusForbidden || status.status == http.StatusNotFound
+}
+
+// loadReferenced loads the referenced keys of t at startup. A tenant whose
+// key cannot be read stays unavailable until a refresh reads it.
+func (t *tenant) loadReferenced() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := t.load(ctx); err != nil {
+		log.Printf("Loading the key of tenant %s failed, its requests are refused: %v", t.name, err)
+		tenantKeyAvailable.Set(0, t.name)
+		return
+	}
+	tenantKeyAvailable.Set(1, t.name)
+}
+
+// refresh reloads the referenced keys of t, dropping its suites if the key
+// was withdrawn.
+func (t *tenant) refresh(ctx context.Context) {
+	err := t.load(ctx)
+	switch {
+	case err == nil:
+		tenantKeyAvailable.Set(1, t.name)
+	case ctx.Err() != nil:
+	case keyWithdrawn(err):
+		if t.suites.Swap(nil) != nil {
+			log.Printf("The key of tenant %s was withdrawn, its requests are refused: %v", t.name, err)
+		}
+		tenantKeyAvailable.Set(0, t.name)
+	default:
+		log.Printf("Refreshing the key of tenant %s failed, keeping the loaded one: %v", t.name, err)
+	}
+}
+
+// runTenantKeyRefresh refreshes the referenced tenant keys until ctx is
+// done.
+func (s *server) runTenantKeyRefresh(ctx context.Context) {
+	var byok []*tenant
+	for _, t := range s.tenants {
+		if t.byok {
+			byok = append(byok, t)
+		}
+	}
+	if len(byok) == 0 {
+		return
+	}
+	ticker := time.NewTicker(envDuration("TENANT_KEY_REFRESH", 15*time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		for _, t := range byok {
+			t.refresh(ctx)
+		}
+	}
+}
+
+// withTenantKey refuses requests of tenants whose referenced key is
+// unavailable.
+func (s *server) withTenantKey(h http.HandlerFunc) http.HandlerFunc {
+	if len(s.tenants) == 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.tenantSuites(tenantOf(req)) == nil {
+			w.Header().Set("Retry-After", "60")
+			writeErrorCode(w, errUnavailable, "the key of the tenant is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h(w, req)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestTenantKeyReference(t *testing.T) {
+	acme := migp.DefaultServerConfig()
+	acme.Version = 2
+	data, err := json.Marshal(&acme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	key := fields["privateKey"].(string)
+
+	var status atomic.Int32 // of the secret, 0 for found
+	keyVault := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/token":
+			w.Write([]byte(`{"access_token": "kv-token"}`))
+		case req.URL.Path == "/secrets/acme-key" && status.Load() == 0:
+			json.NewEncoder(w).Encode(map[string]string{"value": key})
+		case req.URL.Path == "/secrets/acme-key":
+			http.Error(w, "no", int(status.Load()))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer keyVault.Close()
+	defer func(p secretProvider) { secretProviders["keyvault"] = p }(secretProviders["keyvault"])
+	secretProviders["keyvault"] = keyVaultSecrets{client: keyVault.Client()}
+	t.Setenv("IDENTITY_ENDPOINT", keyVault.URL+"/token")
+
+	delete(fields, "privateKey")
+	fields["privateKeyRef"] = "@Microsoft.KeyVault(SecretUri=" + keyVault.URL + "/secrets/acme-key)"
+	configs, err := json.Marshal(map[string]interface{}{"acme": fields})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TENANT_CONFIGS", string(configs))
+	t.Setenv("TENANT_HEADER_TRUSTED", "true")
+	s, srv := newTestServer(t)
+	acmeTenant := s.tenants["acme"]
+	if !acmeTenant.byok || acmeTenant.suites.Load() == nil {
+		t.Fatal("referenced key not loaded")
+	}
+	got, err := keyFingerprint(&s.tenantSuite("acme", 2).cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := keyFingerprint(&acme); got != want {
+		t.Fatal("loaded a different key")
+	}
+
+	config := func() int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/config", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(tenantHeader(), "acme")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	tests := []struct {
+		name   string
+		status int32
+		want   int
+	}{
+		{"vault down", http.StatusInternalServerError, http.StatusOK},
+		{"withdrawn", http.StatusForbidden, http.StatusServiceUnavailable},
+		{"still withdrawn", http.StatusInternalServerError, http.StatusServiceUnavailable},
+		{"granted again", 0, http.StatusOK},
+	}
+	for _, tt := range tests {
+		status.Store(tt.status)
+		acmeTenant.refresh(context.Background())
+		if got := config(); got != tt.want {
+			t.Errorf("%s: config status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	for _, cfg := range []string{
+		`{"privateKey": "AA==", "privateKeyRef": "keyvault://v/k"}`,
+		`{"privateKeyRef": "file:/etc/key"}`,
+	} {
+		if _, err := tenantKeyRef(json.RawMessage(cfg)); err == nil {
+			t.Errorf("key reference of %s accepted", cfg)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+var (
+	canaryEvaluations = newCounter("migp_canary_evaluations_total", "Shadow evaluations against the canary by outcome.", "outcome")
+	canaryLatency     = newHistogram("migp_canary_duration_seconds", "Duration of shadowed evaluations by side.", defaultLatencyBuckets, "side")
+)
+
+// canary shadows a sample of queries against a candidate configuration, a
+// candidate storage backend or both, to de-risk key rotations and backend
+// migrations. The primary's answer is always the one served; the candidate's
+// is only compared with it, and divergences are logged and counted.
+type canary struct {
+	// suite is the candidate suite, or nil to shadow the primary suite.
+	suite *cryptoSuite
+	// fingerprint is the candidate key fingerprint, if suite is set.
+	fingerprint string
+
+	// dsns are the candidate storage connection strings, or nil to shadow
+	// against the primary storage.
+	dsns []string
+	kvMu sync.Mutex
+	kv   *kvStore
+
+	rate    float64
+	timeout time.Duration
+	slots   chan struct{}
+}
+
+// newCanary returns the canary configured by CANARY_CONFIG_JSON, a candidate
+// server configuration in the format of CONFIG_JSON, and
+// CANARY_DB_CONNECTION_ST, a comma-separated list of candidate database
+// connection strings. It returns nil if neither is set. CANARY_SAMPLE_RATE
+// (default 0.1) is the fraction of queries shadowed, and at most
+// CANARY_MAX_CONCURRENCY shadow evaluations run at once; queries sampled
+// beyond that are not shadowed.
+func newCanary() (*canary, error) {
+	configJSON := strings.TrimSpace(os.Getenv("CANARY_CONFIG_JSON"))
+	dsns := os.Getenv("CANARY_DB_CONNECTION_ST")
+	if configJSON == "" && dsns == "" {
+		return nil, nil
+	}
+
+	c := &canary{
+		rate:    0.1,
+		timeout: envDuration("CANARY_TIMEOUT", 5*time.Second),
+		slots:   make(chan struct{}, envInt("CANARY_MAX_CONCURRENCY", 16)),
+	}
+	if _, ok := os.LookupEnv("CANARY_SAMPLE_RATE"); ok {
+		c.rate = envRate("CANARY_SAMPLE_RATE")
+	}
+	if configJSON != "" {
+		var cfg migp.ServerConfig
+		if err := json.Unmarshal([]byte(configJSON), &cfg); err != nil {
+			return nil, fmt.Errorf("parsing CANARY_CONFIG_JSON: %w", err)
+		}
+		cs, err := newCryptoSuite(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("canary: %w", err)
+		}
+		if c.fingerprint, err = keyFingerprint(&cfg); err != nil {
+			return nil, fmt.Errorf("canary: %w", err)
+		}
+		c.suite = cs
+	}
+	for _, dsn := range strings.Split(dsns, ",") {
+		if dsn = strings.TrimSpace(dsn); dsn != "" {
+			c.dsns = append(c.dsns, dsn)
+		}
+	}
+	return c, nil
+}
+
+// store returns the candidate storage, connecting to it on first use, or
+// primary if no candidate storage is configured.
+func (c *canary) store(primary *kvStore) (*kvStore, error) {
+	if c.dsns == nil {
+		return primary, nil
+	}
+	c.kvMu.Lock()
+	defer c.kvMu.Unlock()
+	if c.kv == nil {
+		cluster, err := openCluster(c.dsns, newConnectionOptions())
+		if err != nil {
+			return nil, err
+		}
+		c.kv = newKVStore(cluster, primary.slowThreshold, primary.retryPolicy)
+		c.kv.verifyChecksums = primary.verifyChecksums
+		c.kv.redactBuckets = primary.redactBuckets
+	}
+	return c.kv, nil
+}
+
+// evaluation is the outcome of one side of a shadowed query.
+type evaluation struct {
+	response migp.ServerResponse
+	err      error
+	elapsed  time.Duration
+}
+
+// shadow evaluates request, a query for a bucket ID of the given bit length
+// already answered by the primary suite with primary, against the candidate
+// in the background. A nil canary does nothing.
+func (c *canary) shadow(s *server, primarySuite *cryptoSuite, request migp.ClientRequest, bits int, primary evaluation) {
+	if c == nil || rand.Float64() >= c.rate {
+		return
+	}
+	select {
+	case c.slots <- struct{}{}:
+	default:
+		canaryEvaluations.Inc("skipped")
+		return
+	}
+
+	go func() {
+		defer func() { <-c.slots }()
+		cs, sameKey := primarySuite, true
+		if c.suite != nil {
+			cs = c.suite
+			primaryFingerprint, err := keyFingerprint(&primarySuite.cfg)
+			sameKey = err == nil && primaryFingerprint == c.fingerprint
+		}
+		if bits < primarySuite.cfg.BucketIDBitSize {
+			bits = primarySuite.cfg.BucketIDBitSize
+		}
+		if bits < cs.cfg.BucketIDBitSize {
+			// The client's bucket ID is too short to address a candidate
+			// bucket.
+			canaryEvaluations.Inc("incomparable")
+			return
+		}
+		kv, err := c.store(s.kv)
+		if err != nil {
+			log.Println("Connecting to canary storage failed:", err)
+			canaryEvaluations.Inc("error")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		defer cancel()
+		request.Version = uint32(cs.cfg.Version)
+		start := time.Now()
+		response, err := cs.server.HandleRequest(request, suiteGetter{ctx, cs, kv, bits})
+		candidate := evaluation{response, err, time.Since(start)}
+
+		canaryLatency.Observe(primary.elapsed.Seconds(), "primary")
+		canaryLatency.Observe(candidate.elapsed.Seconds(), "candidate")
+		if reason := diverges(primary, candidate, sameKey); reason != "" {
+			canaryEvaluations.Inc("diverged")
+			log.Printf("Canary diverged: bucket=%s reason=%s primary=%s candidate=%s",
+				kv.bucketLabel(request.BucketID), reason, primary.elapsed, candidate.elapsed)
+			return
+		}
+		canaryEvaluations.Inc("match")
+	}()
+}
+
+// diverges returns why candidate's answer disagrees with primary's, or an
+// empty string if it does not. Evaluations and bucket contents only match
+// byte for byte under the same key; otherwise only the presence of a
+// non-empty bucket is compared.
+func diverges(primary, candidate evaluation, sameKey bool) string {
+	switch {
+	case (primary.err == nil) != (candidate.err == nil):
+		return fmt.Sprintf("error mismatch: primary=%v candidate=%v", primary.err, candidate.err)
+	case primary.err != nil:
+		return ""
+	case sameKey && !bytes.Equal(primary.response.EvaluatedElement, candidate.response.EvaluatedElement):
+		return "evaluated element mismatch"
+	case sameKey && !bytes.Equal(primary.response.BucketContents, candidate.response.BucketContents):
+		return fmt.Sprintf("bucket contents mismatch: primary=%d bytes candidate=%d bytes",
+			len(primary.response.BucketContents), len(candidate.response.BucketContents))
+	case (len(primary.response.BucketContents) == 0) != (len(candidate.response.BucketContents) == 0):
+		return fmt.Sprintf("bucket presence mismatch: primary=%d bytes candidate=%d bytes",
+			len(primary.response.BucketContents), len(candidate.response.BucketContents))
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestDiverges(t *testing.T) {
+	answer := func(element, contents string) evaluation {
+		return evaluation{response: migp.ServerResponse{EvaluatedElement: []byte(element), BucketContents: []byte(contents)}}
+	}
+	failed := evaluation{err: errors.New("timeout")}
+	for _, tt := range []struct {
+		name               string
+		primary, candidate evaluation
+		sameKey            bool
+		diverges           bool
+	}{
+		{"identical", answer("e", "bucket"), answer("e", "bucket"), true, false},
+		{"both failed", failed, failed, true, false},
+		{"candidate failed", answer("e", "bucket"), failed, true, true},
+		{"other element", answer("e", "bucket"), answer("f", "bucket"), true, true},
+		{"other contents", answer("e", "bucket"), answer("e", "bucket2"), true, true},
+		{"other key", answer("e", "bucket"), answer("f", "other"), false, false},
+		{"other key, missing bucket", answer("e", "bucket"), answer("f", ""), false, true},
+	} {
+		if reason := diverges(tt.primary, tt.candidate, tt.sameKey); (reason != "") != tt.diverges {
+			t.Errorf("%s: diverges() = %q", tt.name, reason)
+		}
+	}
+}
+
+func TestNewCanary(t *testing.T) {
+	if c, err := newCanary(); c != nil || err != nil {
+		t.Fatalf("canary %+v, %v without configuration", c, err)
+	}
+	t.Setenv("CANARY_DB_CONNECTION_ST", " host=a , ,host=b")
+	t.Setenv("CANARY_SAMPLE_RATE", "0.5")
+	c, err := newCanary()
+	if err != nil || c.suite != nil || len(c.dsns) != 2 || c.rate != 0.5 {
+		t.Fatalf("canary %+v, %v", c, err)
+	}
+	t.Setenv("CANARY_CONFIG_JSON", "{")
+	if _, err := newCanary(); err == nil {
+		t.Error("malformed CANARY_CONFIG_JSON accepted")
+	}
+}
+
+// TestCanaryShadow shadows every query against the primary suite and against
+// a suite under another key, both on the primary storage, and expects them to
+// match.
+func TestCanaryShadow(t *testing.T) {
+	s, srv := newTestServer(t)
+	credentials := syntheticCredentials(4, 5)
+	if result := s.ingestParallel(context.Background(), ingestRequest{Credentials: credentials}, 1, nil); result.Failures != 0 {
+		t.Fatalf("ingestion %+v", result)
+	}
+	queries, err := prepareQueries(s.suites[0].cfg.Config, credentials, 4, 0.5, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidate, err := newCryptoSuite(migp.DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := keyFingerprint(&candidate.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outcomes := func(outcome string) float64 {
+		v, _, _, _ := canaryEvaluations.total(func(v []string) bool { return v[0] == outcome })
+		return v
+	}
+	for _, c := range []*canary{
+		{rate: 1, timeout: time.Second, slots: make(chan struct{}, len(queries))},
+		{suite: candidate, fingerprint: fingerprint, rate: 1, timeout: time.Second, slots: make(chan struct{}, len(queries))},
+	} {
+		s.canary = c
+		before := outcomes("match")
+		for _, q := range queries {
+			if _, err := queryStatus(http.DefaultClient, srv.URL+"/api/query", q.body, q.ctx, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for deadline := time.Now().Add(5 * time.Second); outcomes("match")-before < float64(len(queries)); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%g of %d shadowed queries matched, %g diverged", outcomes("match")-before, len(queries), outcomes("diverged"))
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	s, _ := newDBTestServer(t)
+	ctx := context.Background()
+	key := testName(t) + "/cas"
+	t.Cleanup(func() { s.kv.db().Exec(`DELETE FROM kv_store WHERE id = $1`, key) })
+
+	// Each step runs on the state the previous ones left.
+	tests := []struct {
+		name    string
+		version int64
+		value   string
+		swapped bool
+		want    string
+		wantVer int64
+	}{
+		{"create", 0, "a", true, "a", 1},
+		{"create existing", 0, "b", false, "a", 1},
+		{"current version", 1, "c", true, "c", 2},
+		{"stale version", 1, "d", false, "c", 2},
+		{"future version", 5, "e", false, "c", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			swapped, err := s.kv.CompareAndSwap(ctx, key, tt.version, []byte(tt.value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if swapped != tt.swapped {
+				t.Fatalf("CompareAndSwap(%d, %q) = %v, want %v", tt.version, tt.value, swapped, tt.swapped)
+			}
+			value, version, err := s.kv.GetVersioned(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(value) != tt.want || version != tt.wantVer {
+				t.Fatalf("GetVersioned() = %q, %d, want %q, %d", value, version, tt.want, tt.wantVer)
+			}
+		})
+	}
+}
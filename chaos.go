@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// errInjectedFault is returned by storage calls failed by the fault injector.
+// It is classified as transient so that it exercises the retry path.
+var errInjectedFault = errors.New("injected storage fault")
+
+var chaosInjected = newCounter("migp_chaos_injected_total", "Faults injected by the chaos mode by layer and kind.", "layer", "kind")
+
+// faultInjector adds random latency and errors to storage calls and HTTP
+// requests, for resilience testing. A nil faultInjector injects nothing.
+type faultInjector struct {
+	storageErrorRate float64
+	storageLatency   time.Duration
+	httpErrorRate    float64
+	httpLatency      time.Duration
+}
+
+// newFaultInjector returns a faultInjector configured from the CHAOS_*
+// environment variables, or nil unless CHAOS_ENABLED is set. Latencies are
+// upper bounds; each call sleeps a uniformly random duration up to them.
+func newFaultInjector() *faultInjector {
+	if !envBool("CHAOS_ENABLED", false) {
+		return nil
+	}
+	f := &faultInjector{
+		storageErrorRate: envRate("CHAOS_STORAGE_ERROR_RATE"),
+		storageLatency:   envDuration("CHAOS_STORAGE_LATENCY", 0),
+		httpErrorRate:    envRate("CHAOS_HTTP_ERROR_RATE"),
+		httpLatency:      envDuration("CHAOS_HTTP_LATENCY", 0),
+	}
+	log.Printf("CHAOS MODE ENABLED: storage error rate %g, latency up to %s; HTTP error rate %g, latency up to %s",
+		f.storageErrorRate, f.storageLatency, f.httpErrorRate, f.httpLatency)
+	return f
+}
+
+// envRate returns the named environment variable as a probability in [0, 1],
+// or zero if it is unset or invalid.
+func envRate(name string) float64 {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return 0
+	}
+	rate, err := strconv.ParseFloat(val, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		log.Printf("Invalid %s value %q. Using 0.", name, val)
+		return 0
+	}
+	return rate
+}
+
+// sleep waits a random duration up to max.
+func (f *faultInjector) sleep(layer string, max time.Duration) {
+	if max <= 0 {
+		return
+	}
+	chaosInjected.Inc(layer, "latency")
+	time.Sleep(time.Duration(rand.Int63n(int64(max) + 1)))
+}
+
+// storageFault delays a storage call and returns errInjectedFault for the
+// configured fraction of calls.
+func (f *faultInjector) storageFault() error {
+	if f == nil {
+		return nil
+	}
+	f.sleep("storage", f.storageLatency)
+	if rand.Float64() < f.storageErrorRate {
+		chaosInjected.Inc("storage", "error")
+		return errInjectedFault
+	}
+	return nil
+}
+
+// wrap delays requests to h and fails the configured fraction of them with a
+// 503.
+func (f *faultInjector) wrap(h http.HandlerFunc) http.HandlerFunc {
+	if f == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		f.sleep("http", f.httpLatency)
+		if rand.Float64() < f.httpErrorRate {
+			chaosInjected.Inc("http", "error")
+			writeError(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		h(w, req)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFaultInjector(t *testing.T) {
+	if f := newFaultInjector(); f != nil {
+		t.Fatal("fault injector enabled without CHAOS_ENABLED")
+	}
+	var f *faultInjector
+	if err := f.storageFault(); err != nil {
+		t.Fatalf("nil injector failed a storage call: %v", err)
+	}
+
+	t.Setenv("CHAOS_ENABLED", "true")
+	t.Setenv("CHAOS_STORAGE_ERROR_RATE", "1")
+	t.Setenv("CHAOS_HTTP_ERROR_RATE", "1.5")
+	f = newFaultInjector()
+	if f.httpErrorRate != 0 {
+		t.Errorf("HTTP error rate %g out of range accepted", f.httpErrorRate)
+	}
+	if err := f.storageFault(); err != errInjectedFault || !isTransient(err) {
+		t.Errorf("storage fault %v, want the transient errInjectedFault", err)
+	}
+
+	f.httpErrorRate = 1
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	rec := httptest.NewRecorder()
+	f.wrap(ok)(rec, httptest.NewRequest(http.MethodGet, "/api/query", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("injected HTTP fault answered %d, want 503", rec.Code)
+	}
+	f.httpErrorRate = 0
+	rec = httptest.NewRecorder()
+	f.wrap(ok)(rec, httptest.NewRequest(http.MethodGet, "/api/query", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("request answered %d without faults", rec.Code)
+	}
+}
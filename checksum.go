@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Every kv_store row carries the SHA-256 checksum of its value, set by a
+// trigger whenever the value is written, so every write path keeps it current
+// without computing it. Reads compare the two, which catches values corrupted
+// at rest, such as BYTEA pages damaged by a failed failover, before they are
+// served. The checksum is a plain nullable column, because adding a generated
+// one rewrites kv_store under an exclusive lock. Rows written before it was
+// added have none, are served unverified, and get one from the next scrub,
+// see backfillChecksums.
+
+var checksumMismatches = newCounter("migp_bucket_checksum_mismatches_total", "Bucket values not matching their stored checksum by where they were read.", "source")
+
+// errChecksumMismatch is returned for a bucket whose value does not match its
+// stored checksum.
+var errChecksumMismatch = errors.New("bucket value does not match its checksum")
+
+// kvStorePartitions is the number of hash partitions of kv_store created by
+// schemaDDL.
+const kvStorePartitions = 4
+
+// verifyChecksum checks value, read from the key identified by id, against
+// its stored checksum. Rows written before checksums were added have none
+// until their next write. source labels the mismatch metric.
+func (kv *kvStore) verifyChecksum(source, id string, value, checksum []byte) error {
+	if !kv.verifyChecksums || checksum == nil {
+		return nil
+	}
+	if sum := sha256.Sum256(value); bytes.Equal(sum[:], checksum) {
+		return nil
+	}
+	checksumMismatches.Inc(source)
+	log.Printf("Bucket %s does not match its checksum", kv.bucketLabel(id))
+	return fmt.Errorf("bucket %s: %w", kv.bucketLabel(id), errChecksumMismatch)
+}
+
+// scrubResult reports the outcome of a scrub.
+type scrubResult struct {
+	Partitions int      `json:"partitions"`
+	Buckets    int      `json:"buckets"`
+	Backfilled int64    `json:"backfilled"`
+	Corrupt    []string `json:"corrupt"`
+}
+
+// checksumBackfillBatch is the number of rows backfillChecksums updates per
+// transaction.
+const checksumBackfillBatch = 1000
+
+// backfillChecksums sets the checksum of the rows of partition p that have
+// none, checksumBackfillBatch rows at a time so that no transaction locks
+// many rows for long.
+func (kv *kvStore) backfillChecksums(ctx context.Context, p int) (int64, error) {
+	query := fmt.Sprintf(`
+	UPDATE kv_store SET checksum = sha256(value)
+	WHERE id IN (SELECT id FROM kv_store_p%d WHERE checksum IS NULL AND value IS NOT NULL LIMIT %d)`, p, checksumBackfillBatch)
+	var total int64
+	for {
+		if err := maintenancePause(ctx); err != nil {
+			return total, err
+		}
+		res, err := kv.db().ExecContext(ctx, query)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < checksumBackfillBatch {
+			return total, nil
+		}
+	}
+}
+
+// scrub recomputes the checksum of every stored bucket, one partition at a
+// time, and returns the keys of the buckets that do not match, after
+// backfilling the checksums of the partition. The checksums are computed by
+// the database, so bucket values are not transferred.
+func (s *server) scrub(ctx context.Context) (scrubResult, error) {
+	result := scrubResult{Corrupt: []string{}}
+	for p := 0; p < kvStorePartitions; p++ {
+		backfilled, err := s.kv.backfillChecksums(ctx, p)
+		if err != nil {
+			return result, err
+		}
+		result.Backfilled += backfilled
+		query := fmt.Sprintf(`
+		SELECT count(*), COALESCE(array_agg(id) FILTER (WHERE checksum <> sha256(value)), '{}')
+		FROM kv_store_p%d`, p)
+		var buckets int
+		var corrupt []string
+		if err := s.kv.db().QueryRowContext(ctx, query).Scan(&buckets, pq.Array(&corrupt)); err != nil {
+			return result, err
+		}
+		for _, id := range corrupt {
+			log.Printf("Scrub found bucket %s not matching its checksum", id)
+		}
+		checksumMismatches.Add(float64(len(corrupt)), "scrub")
+		result.Partitions++
+		result.Buckets += buckets
+		result.Corrupt = append(result.Corrupt, corrupt...)
+	}
+	return result, nil
+}
+
+// handleScrub starts a background job scrubbing the corpus for corrupted
+// buckets, unless another instance is running one. Job progress is reported
+// through job events.
+func (s *server) handleScrub(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	release := s.lockJobRequest(w, req, "scrub")
+	if release == nil {
+		return
+	}
+	jobID, err := randomID()
+	if err != nil {
+		release()
+		log.Println("Job ID generation failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	subject := "migp/jobs/" + jobID
+	s.events.Publish(eventJobStarted, subject, map[string]interface{}{"jobId": jobID, "type": "scrub"})
+
+	go func() {
+		defer release()
+		start := time.Now()
+		result, err := s.scrub(context.Background())
+		if err != nil {
+			log.Printf("Scrub job %s failed: %v", jobID, err)
+			s.events.Publish(eventJobFailed, subject, map[string]interface{}{"jobId": jobID, "error": err.Error(), "result": result})
+			return
+		}
+		log.Printf("Scrub job %s checked %d buckets and found %d corrupt in %s", jobID, result.Buckets, len(result.Corrupt), time.Since(start))
+		s.events.Publish(eventJobCompleted, subject, map[string]interface{}{"jobId": jobID, "result": result})
+	}()
+
+	s.acceptJob(w, req, jobID, map[string]string{"jobId": jobID})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestChecksums(t *testing.T) {
+	s, _ := newDBTestServer(t)
+	ctx := context.Background()
+	id := testName(t)
+	db := s.kv.db()
+	t.Cleanup(func() { db.Exec(`DELETE FROM kv_store WHERE id = $1`, id) })
+
+	if _, err := db.Exec(`INSERT INTO kv_store (id, value) VALUES ($1, $2)`, id, []byte("bucket")); err != nil {
+		t.Fatal(err)
+	}
+	var checksum []byte
+	if err := db.QueryRow(`SELECT checksum FROM kv_store WHERE id = $1`, id).Scan(&checksum); err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256([]byte("bucket")); !slices.Equal(checksum, sum[:]) {
+		t.Fatalf("written row has checksum %x, want %x", checksum, sum)
+	}
+
+	// Rows from before checksums are served unverified until scrubbed.
+	if _, err := db.Exec(`UPDATE kv_store SET checksum = NULL WHERE id = $1`, id); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := s.kv.get(ctx, id); err != nil || string(value) != "bucket" {
+		t.Fatalf("row without checksum read as %q, %v", value, err)
+	}
+	result, err := s.scrub(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Backfilled == 0 || slices.Contains(result.Corrupt, id) {
+		t.Fatalf("scrub %+v did not backfill the row", result)
+	}
+	if err := db.QueryRow(`SELECT checksum FROM kv_store WHERE id = $1`, id).Scan(&checksum); err != nil || checksum == nil {
+		t.Fatalf("backfilled checksum %x, %v", checksum, err)
+	}
+
+	if _, err := db.Exec(`UPDATE kv_store SET checksum = sha256('other') WHERE id = $1`, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.kv.get(ctx, id); !errors.Is(err, errChecksumMismatch) {
+		t.Fatalf("corrupt row read with %v, want errChecksumMismatch", err)
+	}
+	if result, err := s.scrub(ctx); err != nil || !slices.Contains(result.Corrupt, id) {
+		t.Fatalf("scrub %+v, %v did not find the corrupt row", result, err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// Oversized buckets can be returned over several responses, so that no
+// single write runs past the Functions proxy timeout. A client opts in by
+// sending the largest response body it wants in the X-MIGP-Chunk-Size
+// request header. Responses to queries for buckets larger than
+// CHUNKED_RESPONSE_THRESHOLD (default 1 MiB) then carry only the start of the
+// bucket contents, with the full bucket length in X-MIGP-Bucket-Length and a
+// token in X-MIGP-Continuation. GET /api/query/next?token=… returns the next
+// part of the contents, with a further token until the last part. The client
+// appends every part to the first response before decoding it as usual.
+//
+// Tokens pin the bucket by digest: if it changes between parts, the
+// continuation fails with a 409 and the client must query again. For
+// buckets in kv_store the digest is compared with the stored checksum and
+// only the requested part is read; other backends, split buckets and rows
+// without a checksum are read in full and hashed. Continuations take an evaluation slot like the
+// query that started them.
+
+const (
+	chunkSizeHeader    = "X-MIGP-Chunk-Size"
+	bucketLengthHeader = "X-MIGP-Bucket-Length"
+	continuationHeader = "X-MIGP-Continuation"
+
+	// minChunkSize bounds the number of round trips a client can ask for.
+	minChunkSize = 64 << 10
+)
+
+// errBucketChanged is returned for a continuation of a bucket that changed
+// since the query.
+var errBucketChanged = errors.New("bucket changed since the query, retry the query")
+
+// continuation identifies the next part of a chunked bucket.
+type continuation struct {
+	Version  uint16 `json:"v"`
+	BucketID string `json:"b"`
+	Bits     int    `json:"n,omitempty"`
+	Offset   int    `json:"o"`
+	Chunk    int    `json:"c"`
+	Digest   []byte `json:"d"`
+}
+
+// encode returns c as an opaque URL-safe token.
+func (c continuation) encode() string {
+	body, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(body)
+}
+
+// decodeContinuation parses a token returned by encode.
+func decodeContinuation(token string) (continuation, error) {
+	var c continuation
+	body, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(body, &c)
+	}
+	if err == nil && (c.Offset <= 0 || c.Chunk < minChunkSize) {
+		err = errors.New("out of range")
+	}
+	return c, err
+}
+
+// bucketDigest returns the digest pinning contents in continuation tokens.
+func bucketDigest(contents []byte) []byte {
+	sum := sha256.Sum256(contents)
+	return sum[:16]
+}
+
+// requestedChunkSize returns the chunk size req asked for, or 0 if the
+// client does not accept chunked responses.
+func requestedChunkSize(req *http.Request) int {
+	n, err := strconv.Atoi(req.Header.Get(chunkSizeHeader))
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return max(n, minChunkSize)
+}
+
+// writeChunkedResponse writes resp, the answer to a query for bucketID of
+// the given bit length in cs, as the first part of a chunked response if the
+// client asked for one and the bucket is large enough, and in full
+// otherwise, as for queries of the next corpus.
+func writeChunkedResponse(w http.ResponseWriter, req *http.Request, cs *cryptoSuite, bucketID string, bits int, resp *migp.ServerResponse) error {
+	chunk := requestedChunkSize(req)
+	if chunk == 0 || queriesNextCorpus(req.Context()) || len(resp.BucketContents) <= envInt("CHUNKED_RESPONSE_THRESHOLD", 1<<20) {
+		return writeMIGPResponse(w, resp)
+	}
+	first := chunk - 4 - len(resp.EvaluatedElement)
+	if first < 0 {
+		first = 0
+	}
+	if first >= len(resp.BucketContents) {
+		return writeMIGPResponse(w, resp)
+	}
+	next := continuation{
+		Version:  cs.cfg.Version,
+		BucketID: bucketID,
+		Bits:     bits,
+		Offset:   first,
+		Chunk:    chunk,
+		Digest:   bucketDigest(resp.BucketContents),
+	}
+	w.Header().Set(bucketLengthHeader, strconv.Itoa(len(resp.BucketContents)))
+	w.Header().Set(continuationHeader, next.encode())
+	part := *resp
+	part.BucketContents = resp.BucketContents[:first]
+	return writeMIGPResponse(w, &part)
+}
+
+// handleQueryContinuation serves the next part of a chunked bucket.
+func (s *server) handleQueryContinuation(w http.ResponseWriter, req *http.Request) {
+	c, err := decodeContinuation(req.URL.Query().Get("token"))
+	if err != nil {
+		invalid(errInvalidRequest, "invalid continuation token").write(w)
+		return
+	}
+	cs := s.tenantSuite(tenantOf(req), c.Version)
+	if cs == nil {
+		invalid(errUnsupportedVersion, "unsupported version %d", c.Version).write(w)
+		return
+	}
+	if c.Bits < 0 || c.Bits > 32 {
+		invalid(errInvalidBucketIDBits, "bucketIDBitSize must be between 0 and 32, got %d", c.Bits).write(w)
+		return
+	}
+	if verr := validateBucketID(c.BucketID, max(c.Bits, cs.cfg.BucketIDBitSize)); verr != nil {
+		verr.write(w)
+		return
+	}
+	release := s.limiter.acquire(w, req)
+	if release == nil {
+		return
+	}
+	part, total, digest, err := s.continuationPart(req.Context(), cs, c)
+	release()
+	if err != nil {
+		storageError(w, "Reading bucket continuation", err)
+		return
+	}
+	if !bytes.Equal(digest, c.Digest) || c.Offset >= total {
+		writeErrorCode(w, errConflict, errBucketChanged.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set(bucketLengthHeader, strconv.Itoa(total))
+	if end := c.Offset + len(part); end < total {
+		next := c
+		next.Offset = end
+		w.Header().Set(continuationHeader, next.encode())
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(part)))
+	w.Write(part)
+}
+
+// continuationPart returns the part of the bucket c continues, with the
+// length and digest of the whole bucket.
+func (s *server) continuationPart(ctx context.Context, cs *cryptoSuite, c continuation) ([]byte, int, []byte, error) {
+	if c.Bits <= cs.cfg.BucketIDBitSize {
+		part, total, digest, ok, err := s.kv.getRange(ctx, cs.bucketKey(c.BucketID), c.Offset, c.Chunk)
+		if ok || err != nil {
+			return part, total, digest, err
+		}
+	}
+	contents, err := suiteGetter{ctx, cs, s.kv, c.Bits}.Get(c.BucketID)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if c.Offset >= len(contents) {
+		return nil, len(contents), bucketDigest(contents), nil
+	}
+	return contents[c.Offset:min(c.Offset+c.Chunk, len(contents))], len(contents), bucketDigest(contents), nil
+}
+
+// getRange returns up to length bytes of the value in the key identified by
+// id from offset on, with the length of the whole value and its digest from
+// the stored checksum, without reading the rest of it. ok is false if the
+// value is kept in another backend, which has neither, if it has no checksum
+// yet, or if it has tombstones, which the stored value and checksum still
+// include.
+func (kv *kvStore) getRange(ctx context.Context, id string, offset, length int) (part []byte, total int, digest []byte, ok bool, err error) {
+	if kv.buckets != nil {
+		return nil, 0, nil, false, nil
+	}
+	defer kv.observe(ctx, "get_range", id, time.Now())
+	query := `
+	SELECT substring(value FROM $2 FOR $3), length(value), substring(checksum FROM 1 FOR 16), tombstones
+	FROM kv_store WHERE id = $1`
+	var tombstones int
+	err = kv.retry(ctx, "get_range", func() error {
+		if err := kv.chaos.storageFault(); err != nil {
+			return err
+		}
+		return kv.db().QueryRowContext(ctx, query, id, offset+1, length).Scan(&part, &total, &digest, &tombstones)
+	})
+	if err == sql.ErrNoRows {
+		return nil, 0, bucketDigest(nil), true, nil
+	}
+	return part, total, digest, err == nil && tombstones == 0 && digest != nil, err
+}
+
+// fetchMIGPResponse posts the query body to target and returns the decoded
+// response, asking for chunks of at most chunkSize bytes and following the
+// continuations if chunkSize is positive. It is the client side of chunked
+// responses.
+func fetchMIGPResponse(client *http.Client, target string, body []byte, chunkSize int) (migp.ServerResponse, error) {
+	var response migp.ServerResponse
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return response, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if chunkSize > 0 {
+		req.Header.Set(chunkSizeHeader, strconv.Itoa(chunkSize))
+	}
+	data, token, err := readMIGPPart(client, req)
+	if err != nil {
+		return response, err
+	}
+	for token != "" {
+		next, err := url.Parse(target)
+		if err != nil {
+			return response, err
+		}
+		next.Path += "/next"
+		next.RawQuery = url.Values{"token": {token}}.Encode()
+		req, err := http.NewRequest(http.MethodGet, next.String(), nil)
+		if err != nil {
+			return response, err
+		}
+		var part []byte
+		if part, token, err = readMIGPPart(client, req); err != nil {
+			return response, err
+		}
+		data = append(data, part...)
+	}
+	err = response.UnmarshalBinary(data)
+	return response, err
+}
+
+// queryStatus posts the query body to target with fetchMIGPResponse and
+// finalizes the response with the client state of the query, ctx.
+func queryStatus(client *http.Client, target string, body []byte, ctx migp.ClientRequestContext, chunkSize int) (migp.BreachStatus, error) {
+	response, err := fetchMIGPResponse(client, target, body, chunkSize)
+	if err != nil {
+		return 0, err
+	}
+	status, _, err := ctx.Finalize(response)
+	return status, err
+}
+
+// readMIGPPart sends req and returns the response body and continuation
+// token.
+func readMIGPPart(client *http.Client, req *http.Request) ([]byte, string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return body, resp.Header.Get(continuationHeader), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestQueryContinuation(t *testing.T) {
+	s, srv := newTestServer(t)
+	cs := s.suites[0]
+	bucketID := "00000001"
+	contents := make([]byte, 2*minChunkSize+100)
+	for i := range contents {
+		contents[i] = byte(i)
+	}
+	if _, err := s.kv.buckets.AppendUnique(context.Background(), cs.bucketKey(bucketID), sql.NullInt64{}, contents); err != nil {
+		t.Fatal(err)
+	}
+	pin := continuation{
+		Version:  cs.cfg.Version,
+		BucketID: bucketID,
+		Bits:     cs.cfg.BucketIDBitSize,
+		Chunk:    minChunkSize,
+		Digest:   bucketDigest(contents),
+	}
+	at := func(offset int) continuation {
+		c := pin
+		c.Offset = offset
+		return c
+	}
+	changed := at(minChunkSize)
+	changed.Digest = bucketDigest([]byte("other"))
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+		part   []byte
+		next   string
+	}{
+		{"middle", at(100).encode(), http.StatusOK, contents[100 : 100+minChunkSize], at(100 + minChunkSize).encode()},
+		{"last", at(2 * minChunkSize).encode(), http.StatusOK, contents[2*minChunkSize:], ""},
+		{"changed", changed.encode(), http.StatusConflict, nil, ""},
+		{"past the end", at(len(contents)).encode(), http.StatusConflict, nil, ""},
+		{"malformed", "not a token", http.StatusBadRequest, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + "/api/query/next?token=" + tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d (%s), want %d", resp.StatusCode, body, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if !bytes.Equal(body, tt.part) {
+				t.Fatalf("got %d bytes, want %d bytes of the bucket", len(body), len(tt.part))
+			}
+			if got := resp.Header.Get(bucketLengthHeader); got != strconv.Itoa(len(contents)) {
+				t.Fatalf("%s %q, want %d", bucketLengthHeader, got, len(contents))
+			}
+			if got := resp.Header.Get(continuationHeader); got != tt.next {
+				t.Fatalf("%s %q, want %q", continuationHeader, got, tt.next)
+			}
+		})
+	}
+}
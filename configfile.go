@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The server is configured with environment variables, which deployments
+// outside Azure Functions may also keep in a file named by CONFIG_FILE, or
+// by the -config flag of the serve subcommand, and set on the command line
+// with its repeatable -set NAME=VALUE flag. Flags take precedence over the
+// environment, which takes precedence over the file, so that a file can hold
+// the defaults of a deployment and app settings or flags override them.
+//
+// A .json file holds an object mapping variable names to values, which are
+// used as they are if strings and as JSON otherwise, so that CONFIG_JSON or
+// FEATURE_FLAGS may be written as nested objects. A .yaml or .yml file holds
+// a flat mapping of variable names to scalar values, one per line; nested
+// YAML documents are not supported.
+
+// configName matches the names of configuration variables.
+var configName = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+
+// parseConfigFile parses the settings of the configuration file name.
+func parseConfigFile(name string, data []byte) (map[string]string, error) {
+	var settings map[string]string
+	var err error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		settings, err = parseConfigJSON(data)
+	case ".yaml", ".yml":
+		settings, err = parseConfigYAML(data)
+	default:
+		return nil, fmt.Errorf("configuration file %s is neither .json nor .yaml", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	for k := range settings {
+		if !configName.MatchString(k) {
+			return nil, fmt.Errorf("parsing %s: %q is not a variable name", name, k)
+		}
+	}
+	return settings, nil
+}
+
+// parseConfigJSON parses a JSON configuration file.
+func parseConfigJSON(data []byte) (map[string]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string, len(raw))
+	for k, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			settings[k] = s
+			continue
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, v); err != nil {
+			return nil, err
+		}
+		settings[k] = compact.String()
+	}
+	return settings, nil
+}
+
+// parseConfigYAML parses a YAML configuration file holding a flat mapping.
+func parseConfigYAML(data []byte) (map[string]string, error) {
+	settings := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(scanner.Text(), " ") || strings.HasPrefix(scanner.Text(), "\t") {
+			return nil, fmt.Errorf("line %d: nested values are not supported", line)
+		}
+		key, value, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: not a key: value pair", line)
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(value, `"`):
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			value = unquoted
+		case strings.HasPrefix(value, "'"):
+			if len(value) < 2 || !strings.HasSuffix(value, "'") {
+				return nil, fmt.Errorf("line %d: unterminated quoted value", line)
+			}
+			value = strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		settings[strings.TrimSpace(key)] = value
+	}
+	return settings, scanner.Err()
+}
+
+// loadConfigFile sets the variables of CONFIG_FILE that are not already set
+// in the environment. It does nothing if CONFIG_FILE is unset.
+func loadConfigFile() error {
+	name := os.Getenv("CONFIG_FILE")
+	if name == "" {
+		return nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	settings, err := parseConfigFile(name, data)
+	if err != nil {
+		return err
+	}
+	var applied int
+	for k, v := range settings {
+		if _, ok := os.LookupEnv(k); ok {
+			continue
+		}
+		if err := os.Setenv(k, v); err != nil {
+			return err
+		}
+		applied++
+	}
+	log.Printf("Loaded %d of %d settings from %s", applied, len(settings), name)
+	return nil
+}
+
+// configFlags holds the -set flags of the serve subcommand.
+type configFlags map[string]string
+
+func (f configFlags) String() string { return "" }
+
+func (f configFlags) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || !configName.MatchString(k) {
+		return errors.New("want NAME=VALUE")
+	}
+	f[k] = val
+	return nil
+}
+
+// parseServeFlags applies the flags of the serve subcommand to the
+// environment and loads the configuration file beneath them.
+func parseServeFlags(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	config := fs.String("config", os.Getenv("CONFIG_FILE"), "JSON or YAML file of configuration variables")
+	settings := configFlags{}
+	fs.Var(settings, "set", "set the configuration variable `NAME=VALUE`, overriding the environment (repeatable)")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	for k, v := range settings {
+		if err := os.Setenv(k, v); err != nil {
+			return err
+		}
+	}
+	if err := os.Setenv("CONFIG_FILE", *config); err != nil {
+		return err
+	}
+	return loadConfigFile()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want map[string]string
+	}{
+		{"config.json", `{"STORAGE_BACKEND": "memory", "QUERY_MAX_INFLIGHT": 8, "READ_ONLY": false, "FEATURE_FLAGS": {"flags": {"pir": true}}}`,
+			map[string]string{"STORAGE_BACKEND": "memory", "QUERY_MAX_INFLIGHT": "8", "READ_ONLY": "false", "FEATURE_FLAGS": `{"flags":{"pir":true}}`}},
+		{"config.yaml", "# defaults\n---\nSTORAGE_BACKEND: memory\nQUERY_MAX_INFLIGHT: 8 # per instance\nADMIN_KEY: \"a#b\"\nDSN: 'it''s'\nEMPTY:\n",
+			map[string]string{"STORAGE_BACKEND": "memory", "QUERY_MAX_INFLIGHT": "8", "ADMIN_KEY": "a#b", "DSN": "it's", "EMPTY": ""}},
+	}
+	for _, tt := range tests {
+		got, err := parseConfigFile(tt.name, []byte(tt.data))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	for name, data := range map[string]string{
+		"nested.yaml":  "STORAGE:\n  BACKEND: memory\n",
+		"lower.json":   `{"storage_backend": "memory"}`,
+		"config.toml":  `STORAGE_BACKEND = "memory"`,
+		"invalid.json": `["STORAGE_BACKEND"]`,
+	} {
+		if _, err := parseConfigFile(name, []byte(data)); err == nil {
+			t.Errorf("%s parsed", name)
+		}
+	}
+}
+
+func TestServeFlagsPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	data := `{"MIGP_TEST_FILE_ONLY": "file", "MIGP_TEST_ENV": "file", "MIGP_TEST_FLAG": "file"}`
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("MIGP_TEST_ENV", "env")
+	t.Setenv("MIGP_TEST_FLAG", "env")
+	t.Setenv("MIGP_TEST_FILE_ONLY", "")
+	os.Unsetenv("MIGP_TEST_FILE_ONLY")
+
+	if err := parseServeFlags([]string{"-config", file, "-set", "MIGP_TEST_FLAG=flag"}); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{"MIGP_TEST_FILE_ONLY": "file", "MIGP_TEST_ENV": "env", "MIGP_TEST_FLAG": "flag"} {
+		if got := os.Getenv(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// BackendCheck is a conformance check of a bucketBackend. Each check works on
+// buckets below prefix only, so that checks can run against a backend that
+// holds a real corpus, and removes what it appended when it succeeds.
+//
+// The checks are exported so that tests of a backend can run them one by one
+// with t.Run, as TestBackendConformance does against a live backend.
+type BackendCheck struct {
+	Name string
+	Run  func(ctx context.Context, b bucketBackend, prefix string) error
+}
+
+// conformanceEntrySize is the size of the entries appended by the checks.
+// The order of the entries of a bucket is not part of the contract, so
+// buckets are compared as sets of entries of this size.
+const conformanceEntrySize = 16
+
+// BackendChecks returns the conformance checks. Large values are appended to
+// reach a bucket of largeBucket bytes, which must be within the limits of the
+// backend.
+func BackendChecks(largeBucket int) []BackendCheck {
+	return []BackendCheck{
+		{"EmptyBucket", checkEmptyBucket},
+		{"AppendAndGet", checkAppendAndGet},
+		{"AppendIsIdempotent", checkAppendIsIdempotent},
+		{"BatchAppend", checkBatchAppend},
+		{"MultiBucketBatchAppend", checkMultiBucketBatchAppend},
+		{"RemoveEntries", checkRemoveEntries},
+		{"EntriesKeepBucketHashes", checkEntries},
+		{"ConcurrentAppends", checkConcurrentAppends},
+		{"LargeBucket", func(ctx context.Context, b bucketBackend, prefix string) error {
+			return checkLargeBucket(ctx, b, prefix, largeBucket)
+		}},
+		{"GoldenVectors", checkGoldenVectors},
+	}
+}
+
+// conformanceValue returns the i-th distinct entry of a check.
+func conformanceValue(i int) []byte {
+	value := make([]byte, conformanceEntrySize)
+	copy(value, "conformance")
+	binary.BigEndian.PutUint32(value[conformanceEntrySize-4:], uint32(i))
+	return value
+}
+
+// expectBucket fails unless the bucket stored under id holds exactly values,
+// in any order, as entries of size bytes.
+func expectBucket(ctx context.Context, b bucketBackend, id string, size int, values ...[]byte) error {
+	got, err := b.Get(ctx, id)
+	if err != nil {
+		return fmt.Errorf("Get(%q): %w", id, err)
+	}
+	if got == nil {
+		return fmt.Errorf("Get(%q) returned a nil bucket", id)
+	}
+	if len(got)%size != 0 {
+		return fmt.Errorf("Get(%q) returned %d bytes, not a multiple of the entry size %d", id, len(got), size)
+	}
+	var gotEntries, wantEntries []string
+	for i := 0; i < len(got); i += size {
+		gotEntries = append(gotEntries, string(got[i:i+size]))
+	}
+	for _, v := range values {
+		wantEntries = append(wantEntries, string(v))
+	}
+	sort.Strings(gotEntries)
+	sort.Strings(wantEntries)
+	if strings.Join(gotEntries, "") != strings.Join(wantEntries, "") {
+		return fmt.Errorf("Get(%q) returned %d entries, want %d", id, len(gotEntries), len(wantEntries))
+	}
+	return nil
+}
+
+// cleanup removes values from the bucket stored under id.
+func cleanup(ctx context.Context, b bucketBackend, id string, values ...[]byte) error {
+	if _, err := b.RemoveEntries(ctx, id, values); err != nil {
+		return fmt.Errorf("cleaning up %q: %w", id, err)
+	}
+	return nil
+}
+
+func checkEmptyBucket(ctx context.Context, b bucketBackend, prefix string) error {
+	return expectBucket(ctx, b, prefix+"empty", conformanceEntrySize)
+}
+
+func checkAppendAndGet(ctx context.Context, b bucketBackend, prefix string) error {
+	id := prefix + "append"
+	v0, v1 := conformanceValue(0), conformanceValue(1)
+	for _, v := range [][]byte{v0, v1} {
+		added, err := b.AppendUnique(ctx, id, sql.NullInt64{}, v)
+		if err != nil {
+			return fmt.Errorf("AppendUnique: %w", err)
+		}
+		if !added {
+			return errors.New("AppendUnique of a new value reported it as present")
+		}
+	}
+	if err := expectBucket(ctx, b, id, conformanceEntrySize, v0, v1); err != nil {
+		return err
+	}
+	return cleanup(ctx, b, id, v0, v1)
+}
+
+func checkAppendIsIdempotent(ctx context.Context, b bucketBackend, prefix string) error {
+	id := prefix + "idempotent"
+	v := conformanceValue(0)
+	for i := 0; i < 3; i++ {
+		added, err := b.AppendUnique(ctx, id, sql.NullInt64{Int64: 7, Valid: true}, v)
+		if err != nil {
+			return fmt.Errorf("AppendUnique: %w", err)
+		}
+		if added != (i == 0) {
+			return fmt.Errorf("AppendUnique #%d reported added=%v", i+1, added)
+		}
+	}
+	if err := expectBucket(ctx, b, id, conformanceEntrySize, v); err != nil {
+		return err
+	}
+	return cleanup(ctx, b, id, v)
+}
+
+func checkBatchAppend(ctx context.Context, b bucketBackend, prefix string) error {
+	ba, ok := b.(batchAppender)
+	if !ok {
+		return nil
+	}
+	id := prefix + "batch"
+	v0, v1, v2 := conformanceValue(0), conformanceValue(1), conformanceValue(2)
+	if _, err := b.AppendUnique(ctx, id, sql.NullInt64{}, v0); err != nil {
+		return fmt.Errorf("AppendUnique: %w", err)
+	}
+	entries := []journalEntry{{Key: id, Value: v1}, {Key: id, Value: v0}, {Key: id, Value: v2}, {Key: id, Value: v1}}
+	added, err := ba.AppendBatch(ctx, entries)
+	if err != nil {
+		return fmt.Errorf("AppendBatch: %w", err)
+	}
+	if added != 2 {
+		return fmt.Errorf("AppendBatch added %d entries, want 2", added)
+	}
+	if err := expectBucket(ctx, b, id, conformanceEntrySize, v0, v1, v2); err != nil {
+		return err
+	}
+	return cleanup(ctx, b, id, v0, v1, v2)
+}
+
+func checkMultiBucketBatchAppend(ctx context.Context, b bucketBackend, prefix string) error {
+	ba, ok := b.(batchAppender)
+	if !ok {
+		return nil
+	}
+	ids := []string{prefix + "multi/a", prefix + "multi/b", prefix + "multi/c"}
+	var entries []journalEntry
+	for i := 0; i < 9; i++ {
+		entries = append(entries, journalEntry{Key: ids[i%3], Value: conformanceValue(i)})
+	}
+	added, err := ba.AppendBatch(ctx, entries)
+	if err != nil {
+		return fmt.Errorf("AppendBatch: %w", err)
+	}
+	if added != len(entries) {
+		return fmt.Errorf("AppendBatch added %d entries, want %d", added, len(entries))
+	}
+	for j, id := range ids {
+		values := [][]byte{conformanceValue(j), conformanceValue(j + 3), conformanceValue(j + 6)}
+		if err := expectBucket(ctx, b, id, conformanceEntrySize, values...); err != nil {
+			return err
+		}
+		if err := cleanup(ctx, b, id, values...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkRemoveEntries(ctx context.Context, b bucketBackend, prefix string) error {
+	id := prefix + "remove"
+	values := [][]byte{conformanceValue(0), conformanceValue(1), conformanceValue(2)}
+	for _, v := range values {
+		if _, err := b.AppendUnique(ctx, id, sql.NullInt64{}, v); err != nil {
+			return fmt.Errorf("AppendUnique: %w", err)
+		}
+	}
+	removed, err := b.RemoveEntries(ctx, id, [][]byte{values[1], conformanceValue(99)})
+	if err != nil {
+		return fmt.Errorf("RemoveEntries: %w", err)
+	}
+	if removed != 1 {
+		return fmt.Errorf("RemoveEntries removed %d entries, want 1", removed)
+	}
+	if err := expectBucket(ctx, b, id, conformanceEntrySize, values[0], values[2]); err != nil {
+		return err
+	}
+	// A removed value can be appended again.
+	added, err := b.AppendUnique(ctx, id, sql.NullInt64{}, values[1])
+	if err != nil {
+		return fmt.Errorf("AppendUnique: %w", err)
+	}
+	if !added {
+		return errors.New("AppendUnique of a removed value reported it as present")
+	}
+	if err := cleanup(ctx, b, id, values...); err != nil {
+		return err
+	}
+	return expectBucket(ctx, b, id, conformanceEntrySize)
+}
+
+func checkEntries(ctx context.Context, b bucketBackend, prefix string) error {
+	id := prefix + "entries"
+	v0, v1 := conformanceValue(0), conformanceValue(1)
+	if _, err := b.AppendUnique(ctx, id, sql.NullInt64{Int64: 42, Valid: true}, v0); err != nil {
+		return fmt.Errorf("AppendUnique: %w", err)
+	}
+	if _, err := b.AppendUnique(ctx, id, sql.NullInt64{}, v1); err != nil {
+		return fmt.Errorf("AppendUnique: %w", err)
+	}
+	found := 0
+	err := b.Entries(func(entryID string, bucketHash sql.NullInt64, value []byte) error {
+		if entryID != id {
+			return nil
+		}
+		found++
+		switch {
+		case bytes.Equal(value, v0) && bucketHash != (sql.NullInt64{Int64: 42, Valid: true}):
+			return fmt.Errorf("entry has bucket hash %+v, want 42", bucketHash)
+		case bytes.Equal(value, v1) && bucketHash.Valid:
+			return fmt.Errorf("entry has bucket hash %+v, want none", bucketHash)
+		case !bytes.Equal(value, v0) && !bytes.Equal(value, v1):
+			return fmt.Errorf("unexpected entry %x", value)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Entries: %w", err)
+	}
+	if found != 2 {
+		return fmt.Errorf("Entries returned %d entries of the bucket, want 2", found)
+	}
+	return cleanup(ctx, b, id, v0, v1)
+}
+
+func checkConcurrentAppends(ctx context.Context, b bucketBackend, prefix string) error {
+	const workers, perWorker = 8, 4
+	id := prefix + "concurrent"
+	shared := conformanceValue(1000)
+	values := [][]byte{shared}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	sharedAdds := 0
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				v := conformanceValue(w*perWorker + i)
+				_, err := b.AppendUnique(ctx, id, sql.NullInt64{}, v)
+				mu.Lock()
+				values = append(values, v)
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+			added, err := b.AppendUnique(ctx, id, sql.NullInt64{}, shared)
+			mu.Lock()
+			if added {
+				sharedAdds++
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			mu.Unlock()
+		}(w)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return fmt.Errorf("AppendUnique: %w", firstErr)
+	}
+	if sharedAdds != 1 {
+		return fmt.Errorf("a value appended concurrently was added %d times", sharedAdds)
+	}
+	if err := expectBucket(ctx, b, id, conformanceEntrySize, values...); err != nil {
+		return err
+	}
+	return cleanup(ctx, b, id, values...)
+}
+
+func checkLargeBucket(ctx context.Context, b bucketBackend, prefix string, size int) error {
+	const entrySize = 16 << 10
+	id := prefix + "large"
+	var values [][]byte
+	for i := 0; i < size/entrySize; i++ {
+		sum := sha256.Sum256(conformanceValue(i))
+		v := bytes.Repeat(sum[:], entrySize/len(sum))
+		if _, err := b.AppendUnique(ctx, id, sql.NullInt64{}, v); err != nil {
+			return fmt.Errorf("AppendUnique of entry %d: %w", i, err)
+		}
+		values = append(values, v)
+	}
+	if err := expectBucket(ctx, b, id, entrySize, values...); err != nil {
+		return err
+	}
+	return cleanup(ctx, b, id, values...)
+}
+
+// backendGetter is a migp.Getter reading the buckets below prefix of b.
+type backendGetter struct {
+	ctx    context.Context
+	b      bucketBackend
+	prefix string
+}
+
+// Get returns the contents of the bucket identified by id.
+func (g backendGetter) Get(id string) ([]byte, error) {
+	return g.b.Get(g.ctx, g.prefix+id)
+}
+
+// checkGoldenVectors stores the fixture corpus of the golden vectors, see
+// vectors.go, and checks that queries answered from the backend finalize to
+// the status and metadata of every vector.
+func checkGoldenVectors(ctx context.Context, b bucketBackend, prefix string) error {
+	vectors, err := newGoldenVectors(migp.DefaultConfig())
+	if err != nil {
+		return err
+	}
+	for id, contents := range vectors.buckets {
+		if _, err := b.AppendUnique(ctx, prefix+id, sql.NullInt64{}, contents); err != nil {
+			return fmt.Errorf("AppendUnique: %w", err)
+		}
+	}
+	client, err := migp.NewClient(vectors.Config)
+	if err != nil {
+		return err
+	}
+	for _, v := range vectors.Vectors {
+		request, qctx, err := client.Request([]byte(v.Username), []byte(v.Password))
+		if err != nil {
+			return err
+		}
+		response, err := vectors.server.HandleRequest(request, backendGetter{ctx, b, prefix})
+		if err != nil {
+			return fmt.Errorf("querying %s: %w", v.Username, err)
+		}
+		status, metadata, err := qctx.Finalize(response)
+		if err != nil {
+			return fmt.Errorf("finalizing %s: %w", v.Username, err)
+		}
+		if status.String() != v.Status || string(metadata) != v.Metadata {
+			return fmt.Errorf("querying %s:%s returned %s %q, want %s %q", v.Username, v.Password, status, metadata, v.Status, v.Metadata)
+		}
+	}
+	for id, contents := range vectors.buckets {
+		if err := cleanup(ctx, b, prefix+id, contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBackendChecks runs checks against b below prefix as subtests of t.
+func runBackendChecks(t *testing.T, b bucketBackend, prefix string, checks []BackendCheck) {
+	for _, check := range checks {
+		t.Run(check.Name, func(t *testing.T) {
+			if err := check.Run(context.Background(), b, prefix+check.Name+"/"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMemoryBackendConformance(t *testing.T) {
+	runBackendChecks(t, newMemoryBackend(), "test/", BackendChecks(1<<20))
+}
+
+// testBackendEnv names the storage backend TestBackendConformance checks,
+// configured by the usual environment variables of that backend. The test is
+// skipped if it is not set.
+const testBackendEnv = "MIGP_TEST_BACKEND"
+
+func TestBackendConformance(t *testing.T) {
+	name := os.Getenv(testBackendEnv)
+	if name == "" {
+		t.Skipf("%s is not set", testBackendEnv)
+	}
+	b, err := openBucketBackend(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b == nil {
+		t.Skip("the postgres backend is checked through the kv_store tables, not the storage interface")
+	}
+	defer b.Close()
+	runBackendChecks(t, b, "conformance/"+testName(t)+"/", BackendChecks(256<<10))
+}
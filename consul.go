@@ -0,0 +1,399 @@
+//go:build full || !(minimal || azure || aws)
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	bucketBackends["consul"] = func(bool) (bucketBackend, error) {
+		b, err := openConsulBackend()
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+}
+
+// consulBackend keeps the corpus buckets in the Consul KV store, selected
+// with STORAGE_BACKEND=consul, for small corpora on infrastructure that
+// already runs Consul. It talks to the agent at CONSUL_HTTP_ADDR (default
+// http://127.0.0.1:8500) with the ACL token in CONSUL_HTTP_TOKEN, below the
+// CONSUL_KV_PREFIX key prefix (default migp/). Consul limits values to
+// 512 KiB, which bounds the size of a bucket.
+//
+// Each bucket is stored under buckets/<id>, and each of its entries under
+// entries/<id>/<sha256> with the username hash, plus one, in the key flags.
+// Appends and removals are Consul transactions that check-and-set the bucket
+// and its entries together.
+//
+// Reads are served from an in-memory copy of every bucket, kept current by a
+// blocking query on the buckets prefix, so that changes made by any instance
+// invalidate the copy within moments. Writes of the instance update it as
+// soon as they succeed.
+type consulBackend struct {
+	addr   string
+	token  string
+	prefix string
+	client *http.Client
+
+	mu    sync.RWMutex
+	cache map[string][]byte // nil until the watch has loaded it
+
+	stop context.CancelFunc
+}
+
+// consulKV is a key of the Consul KV API.
+type consulKV struct {
+	Key         string
+	Value       []byte
+	Flags       uint64
+	ModifyIndex uint64
+}
+
+// consulTxnOps is the maximum number of operations in a Consul transaction.
+const consulTxnOps = 64
+
+// errConsulConflict is returned when a transaction lost a check-and-set race.
+var errConsulConflict = errors.New("consul transaction conflict")
+
+// openConsulBackend connects to the Consul agent configured by the
+// environment and starts watching the buckets.
+func openConsulBackend() (*consulBackend, error) {
+	addr := os.Getenv("CONSUL_HTTP_ADDR")
+	if addr == "" {
+		addr = "http://127.0.0.1:8500"
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	prefix := os.Getenv("CONSUL_KV_PREFIX")
+	if prefix == "" {
+		prefix = "migp/"
+	}
+	b := &consulBackend{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  os.Getenv("CONSUL_HTTP_TOKEN"),
+		prefix: prefix,
+		client: &http.Client{Timeout: 10 * time.Minute},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, _, err := b.list(ctx, "buckets/", 0, true); err != nil {
+		return nil, fmt.Errorf("connecting to Consul: %w", err)
+	}
+	watchCtx, stop := context.WithCancel(context.Background())
+	b.stop = stop
+	go b.watch(watchCtx)
+	return b, nil
+}
+
+// do sends a Consul API request and returns the response body and its
+// X-Consul-Index. A 404 returns a nil body and no error.
+func (b *consulBackend) do(ctx context.Context, method, path string, query url.Values, body []byte) ([]byte, uint64, error) {
+	u := b.addr + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	if b.token != "" {
+		req.Header.Set("X-Consul-Token", b.token)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, index, nil
+	case resp.StatusCode == http.StatusConflict && path == "/v1/txn":
+		return nil, index, errConsulConflict
+	case resp.StatusCode != http.StatusOK:
+		return nil, index, fmt.Errorf("consul %s %s: status %d: %s", method, path, resp.StatusCode, bytes.TrimSpace(data))
+	}
+	return data, index, nil
+}
+
+// list returns the keys below the prefix and key, blocking until the index
+// of the prefix exceeds index if it is not zero.
+func (b *consulBackend) list(ctx context.Context, key string, index uint64, recurse bool) ([]consulKV, uint64, error) {
+	query := url.Values{}
+	if recurse {
+		query.Set("recurse", "")
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", "5m")
+	}
+	data, index, err := b.do(ctx, http.MethodGet, "/v1/kv/"+b.prefix+key, query, nil)
+	if err != nil || data == nil {
+		return nil, index, err
+	}
+	var kvs []consulKV
+	err = json.Unmarshal(data, &kvs)
+	return kvs, index, err
+}
+
+// watch keeps the cache of every bucket current with blocking queries.
+func (b *consulBackend) watch(ctx context.Context) {
+	var index uint64
+	for ctx.Err() == nil {
+		kvs, next, err := b.list(ctx, "buckets/", index, true)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Watching Consul buckets failed:", err)
+				b.mu.Lock()
+				b.cache = nil
+				b.mu.Unlock()
+				time.Sleep(5 * time.Second)
+			}
+			index = 0
+			continue
+		}
+		cache := make(map[string][]byte, len(kvs))
+		for _, kv := range kvs {
+			cache[strings.TrimPrefix(kv.Key, b.prefix+"buckets/")] = kv.Value
+		}
+		b.mu.Lock()
+		b.cache = cache
+		b.mu.Unlock()
+		if next < index {
+			// The index went backwards, as after a snapshot restore.
+			next = 0
+		}
+		index = next
+	}
+}
+
+// Get returns the bucket stored under id, from the cache once it is loaded.
+func (b *consulBackend) Get(ctx context.Context, id string) ([]byte, error) {
+	b.mu.RLock()
+	cache := b.cache
+	b.mu.RUnlock()
+	if cache != nil {
+		if value, ok := cache[id]; ok {
+			return value, nil
+		}
+		return []byte{}, nil
+	}
+	bucket, err := b.bucket(ctx, id)
+	if err != nil || bucket == nil {
+		return []byte{}, err
+	}
+	return bucket.Value, nil
+}
+
+// cacheBucket records contents, just written, as the bucket stored under id,
+// so that reads on this instance see its writes before the watch does.
+func (b *consulBackend) cacheBucket(id string, contents []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cache != nil {
+		b.cache[id] = contents
+	}
+}
+
+// bucket reads the bucket stored under id from Consul, or nil if there is
+// none.
+func (b *consulBackend) bucket(ctx context.Context, id string) (*consulKV, error) {
+	kvs, _, err := b.list(ctx, "buckets/"+id, 0, false)
+	if err != nil || len(kvs) == 0 {
+		return nil, err
+	}
+	return &kvs[0], nil
+}
+
+// entryKey returns the key, below the prefix, of value in the bucket id.
+func entryKey(id string, value []byte) string {
+	sum := sha256.Sum256(value)
+	return "entries/" + id + "/" + hex.EncodeToString(sum[:])
+}
+
+// consulTxnOp is an operation of a Consul transaction.
+type consulTxnOp struct {
+	KV struct {
+		Verb  string
+		Key   string
+		Value string `json:",omitempty"`
+		Flags uint64 `json:",omitempty"`
+		Index uint64
+	}
+}
+
+// kvOp returns a transaction operation on key, below the prefix.
+func (b *consulBackend) kvOp(verb, key string, value []byte, flags, index uint64) consulTxnOp {
+	var op consulTxnOp
+	op.KV.Verb = verb
+	op.KV.Key = b.prefix + key
+	if value != nil {
+		op.KV.Value = base64.StdEncoding.EncodeToString(value)
+	}
+	op.KV.Flags = flags
+	op.KV.Index = index
+	return op
+}
+
+// txn runs ops as one transaction.
+func (b *consulBackend) txn(ctx context.Context, ops []consulTxnOp) error {
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	_, _, err = b.do(ctx, http.MethodPut, "/v1/txn", nil, body)
+	return err
+}
+
+// AppendUnique appends value to the bucket stored under id unless it was
+// appended before, creating its entry key and updating the bucket in one
+// transaction.
+func (b *consulBackend) AppendUnique(ctx context.Context, id string, bucketHash sql.NullInt64, value []byte) (bool, error) {
+	var flags uint64
+	if bucketHash.Valid {
+		flags = uint64(bucketHash.Int64) + 1
+	}
+	key := entryKey(id, value)
+	for attempt := 0; attempt < conflictAttempts; attempt++ {
+		if attempt > 0 {
+			if err := conflictBackoff(ctx, attempt); err != nil {
+				return false, err
+			}
+		}
+		bucket, err := b.bucket(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		contents, index := []byte{}, uint64(0)
+		if bucket != nil {
+			contents, index = bucket.Value, bucket.ModifyIndex
+		}
+		contents = append(contents[:len(contents):len(contents)], value...)
+		err = b.txn(ctx, []consulTxnOp{
+			b.kvOp("cas", key, value, flags, 0),
+			b.kvOp("cas", "buckets/"+id, contents, 0, index),
+		})
+		if err == nil {
+			b.cacheBucket(id, contents)
+		}
+		if err != errConsulConflict {
+			return err == nil, err
+		}
+		existing, _, err := b.list(ctx, key, 0, false)
+		if err != nil {
+			return false, err
+		}
+		if len(existing) > 0 {
+			return false, nil
+		}
+	}
+	return false, errConsulConflict
+}
+
+// RemoveEntries removes values from the bucket stored under id and rebuilds
+// it from the remaining entries.
+func (b *consulBackend) RemoveEntries(ctx context.Context, id string, values [][]byte) (int, error) {
+	remove := map[string]bool{}
+	for _, value := range values {
+		remove[b.prefix+entryKey(id, value)] = true
+	}
+	for attempt := 0; attempt < conflictAttempts; attempt++ {
+		if attempt > 0 {
+			if err := conflictBackoff(ctx, attempt); err != nil {
+				return 0, err
+			}
+		}
+		bucket, err := b.bucket(ctx, id)
+		if err != nil || bucket == nil {
+			return 0, err
+		}
+		entries, _, err := b.list(ctx, "entries/"+id+"/", 0, true)
+		if err != nil {
+			return 0, err
+		}
+		var ops []consulTxnOp
+		contents := []byte{}
+		for _, e := range entries {
+			if remove[e.Key] && len(ops) < consulTxnOps-1 {
+				ops = append(ops, b.kvOp("delete-cas", strings.TrimPrefix(e.Key, b.prefix), nil, 0, e.ModifyIndex))
+				continue
+			}
+			contents = append(contents, e.Value...)
+		}
+		if len(ops) == 0 {
+			return 0, nil
+		}
+		removed := len(ops)
+		ops = append(ops, b.kvOp("cas", "buckets/"+id, contents, 0, bucket.ModifyIndex))
+		err = b.txn(ctx, ops)
+		if err == errConsulConflict {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		b.cacheBucket(id, contents)
+		if removed == consulTxnOps-1 {
+			// A transaction holds a limited number of operations, so
+			// the rest are removed by another one.
+			more, err := b.RemoveEntries(ctx, id, values)
+			return removed + more, err
+		}
+		return removed, nil
+	}
+	return 0, errConsulConflict
+}
+
+// Entries calls f for every entry below the entries prefix.
+func (b *consulBackend) Entries(f func(id string, bucketHash sql.NullInt64, value []byte) error) error {
+	entries, _, err := b.list(context.Background(), "entries/", 0, true)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		key := strings.TrimPrefix(e.Key, b.prefix+"entries/")
+		i := strings.LastIndex(key, "/")
+		if i < 0 {
+			continue
+		}
+		var bucketHash sql.NullInt64
+		if e.Flags > 0 {
+			bucketHash = sql.NullInt64{Int64: int64(e.Flags - 1), Valid: true}
+		}
+		if err := f(key[:i], bucketHash, e.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the watch.
+func (b *consulBackend) Close() error {
+	b.stop()
+	return nil
+}
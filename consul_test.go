@@ -0,0 +1,120 @@
+//go:build full || !(minimal || azure || aws)
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul is the subset of the Consul KV and transaction APIs used by
+// consulBackend, with blocking queries.
+type fakeConsul struct {
+	mu      sync.Mutex
+	index   uint64
+	kvs     map[string]consulKV
+	changed chan struct{} // closed on every change
+}
+
+func newFakeConsul(t *testing.T) *httptest.Server {
+	f := &fakeConsul{kvs: map[string]consulKV{}, changed: make(chan struct{})}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/v1/kv/"):
+		f.get(w, req)
+	case req.Method == http.MethodPut && req.URL.Path == "/v1/txn":
+		f.txn(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (f *fakeConsul) get(w http.ResponseWriter, req *http.Request) {
+	key := strings.TrimPrefix(req.URL.Path, "/v1/kv/")
+	_, recurse := req.URL.Query()["recurse"]
+	f.mu.Lock()
+	if index, _ := strconv.ParseUint(req.URL.Query().Get("index"), 10, 64); index > 0 && index >= f.index {
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+			// Watches learn of changes a little after the writer does.
+			time.Sleep(20 * time.Millisecond)
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+		f.mu.Lock()
+	}
+	var kvs []consulKV
+	for k, kv := range f.kvs {
+		if k == key || recurse && strings.HasPrefix(k, key) {
+			kvs = append(kvs, kv)
+		}
+	}
+	index := f.index
+	f.mu.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	if len(kvs) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	json.NewEncoder(w).Encode(kvs)
+}
+
+func (f *fakeConsul) txn(w http.ResponseWriter, req *http.Request) {
+	var ops []consulTxnOp
+	if err := json.NewDecoder(req.Body).Decode(&ops); err != nil || len(ops) > consulTxnOps {
+		http.Error(w, "invalid transaction", http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, op := range ops {
+		if f.kvs[op.KV.Key].ModifyIndex != op.KV.Index {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+	}
+	f.index++
+	for _, op := range ops {
+		switch op.KV.Verb {
+		case "cas":
+			value, _ := base64.StdEncoding.DecodeString(op.KV.Value)
+			f.kvs[op.KV.Key] = consulKV{Key: op.KV.Key, Value: value, Flags: op.KV.Flags, ModifyIndex: f.index}
+		case "delete-cas":
+			delete(f.kvs, op.KV.Key)
+		}
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func TestConsulBackend(t *testing.T) {
+	t.Setenv("CONSUL_HTTP_ADDR", "127.0.0.1:1")
+	if _, err := openConsulBackend(); err == nil {
+		t.Fatal("backend opened without a reachable agent")
+	}
+	t.Setenv("CONSUL_HTTP_ADDR", newFakeConsul(t).URL)
+	t.Setenv("CONSUL_KV_PREFIX", "test/")
+	b, err := openConsulBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	runBackendChecks(t, b, "conformance/", BackendChecks(64<<10))
+}
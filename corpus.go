@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// corpusGeneration caches the corpus generation, a counter bumped whenever
+// stored buckets change. It keys HTTP caching of query responses, and every
+// API response carries it once known as X-Corpus-Generation, so that clients
+// can tell when to drop what they cached.
+type corpusGeneration struct {
+	mu         sync.Mutex
+	value      int64
+	fetchedAt  time.Time
+	refreshing atomic.Bool
+}
+
+// corpusGenerationTTL bounds how stale the cached generation may be, and thus
+// how long a cache may serve a response from before a corpus change.
+const corpusGenerationTTL = 5 * time.Second
+
+// generation returns the current corpus generation.
+func (s *server) generation() (int64, error) {
+	g := &s.corpusGeneration
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.fetchedAt) < corpusGenerationTTL {
+		return g.value, nil
+	}
+
+	var value int64
+	err := s.kv.db().QueryRow(`SELECT generation FROM corpus_generation WHERE id = 1`).Scan(&value)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	g.value, g.fetchedAt = value, time.Now()
+	return value, nil
+}
+
+// cachedGeneration returns the cached corpus generation without waiting on
+// the database, refreshing it in the background once stale, and false if it
+// was never read.
+func (s *server) cachedGeneration() (int64, bool) {
+	g := &s.corpusGeneration
+	g.mu.Lock()
+	value, fetchedAt := g.value, g.fetchedAt
+	g.mu.Unlock()
+	if time.Since(fetchedAt) >= corpusGenerationTTL && g.refreshing.CompareAndSwap(false, true) {
+		go func() {
+			defer g.refreshing.Store(false)
+			if _, err := s.generation(); err != nil {
+				log.Println("Reading corpus generation failed:", err)
+			}
+		}()
+	}
+	return value, !fetchedAt.IsZero()
+}
+
+// withCorpusGeneration sets X-Corpus-Generation on every API response once
+// the generation is known, see corpusGeneration.
+func (s *server) withCorpusGeneration(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/api/") && !s.detached && s.storageReady.Load() {
+			if generation, ok := s.cachedGeneration(); ok {
+				w.Header().Set("X-Corpus-Generation", strconv.FormatInt(generation, 10))
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// corpusChanged bumps the corpus generation after buckets were modified and
+// announces the new one. Failures are logged, as the change itself has
+// already been applied.
+func (s *server) corpusChanged() {
+	query := `
+	INSERT INTO corpus_generation (id, generation) VALUES (1, 1)
+	ON CONFLICT (id) DO UPDATE SET generation = corpus_generation.generation + 1, updated_at = now()
+	RETURNING generation`
+	var generation int64
+	if err := s.kv.db().QueryRow(query).Scan(&generation); err != nil {
+		log.Println("Bumping corpus generation failed:", err)
+		return
+	}
+	g := &s.corpusGeneration
+	g.mu.Lock()
+	g.value, g.fetchedAt = generation, time.Now()
+	g.mu.Unlock()
+	s.events.Publish(eventGenerationSwitched, "migp/corpus", map[string]int64{"generation": generation})
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/mutator"
+	"github.com/lib/pq"
+)
+
+// The build-corpus command does the expensive part of ingestion, slow
+// hashing and encryption, offline: it reads breach dumps and writes their
+// encrypted entries to a corpus artifact, which the import-corpus command
+// then bulk loads into the storage of a deployment. Only the machine
+// building the artifact needs the plaintext dumps and CONFIG_JSON; the
+// artifact holds nothing but encrypted bucket entries.
+//
+// An artifact is a directory holding manifest.json and shard files. An
+// entry is written to the shard selected by the leading
+// corpusArtifactShardBits bits of its bucket hash, as a 4-byte big-endian
+// bucket hash followed by the entry, whose header holds its length.
+
+// corpusArtifactFormat is the version of the corpus artifact layout.
+const corpusArtifactFormat = 1
+
+// corpusArtifactShardBits is the number of leading bucket hash bits
+// selecting the shard file an entry is written to.
+const corpusArtifactShardBits = 8
+
+// corpusManifest describes a corpus artifact. KeyFingerprint is that of the
+// key the entries were encrypted with, so that an artifact is never imported
+// into a corpus with another key.
+type corpusManifest struct {
+	Format                 int             `json:"format"`
+	Version                uint16          `json:"version"`
+	BucketIDBitSize        int             `json:"bucketIDBitSize"`
+	KeyFingerprint         string          `json:"keyFingerprint"`
+	Metadata               string          `json:"metadata"`
+	NumVariants            int             `json:"numVariants"`
+	IncludeUsernameVariant bool            `json:"includeUsernameVariant"`
+	Credentials            int             `json:"credentials"`
+	Malformed              int             `json:"malformed"`
+	Failures               int             `json:"failures"`
+	Entries                int             `json:"entries"`
+	Shards                 []artifactShard `json:"shards"`
+	CreatedAt              time.Time       `json:"createdAt"`
+}
+
+// artifactShard is one shard file of a corpus artifact.
+type artifactShard struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+	SHA256  string `json:"sha256"`
+}
+
+// artifactWriter writes the shard files of a corpus artifact.
+type artifactWriter struct {
+	dir    string
+	files  [1 << corpusArtifactShardBits]*os.File
+	bufs   [1 << corpusArtifactShardBits]*bufio.Writer
+	sums   [1 << corpusArtifactShardBits]hash.Hash
+	shards [1 << corpusArtifactShardBits]artifactShard
+}
+
+// newArtifactWriter creates the shard files of an artifact in dir, which
+// must not hold one already.
+func newArtifactWriter(dir string) (*artifactWriter, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+		return nil, fmt.Errorf("%s already holds a corpus artifact", dir)
+	}
+	w := &artifactWriter{dir: dir}
+	for i := range w.files {
+		name := fmt.Sprintf("shard-%02x.bin", i)
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			w.abort()
+			return nil, err
+		}
+		w.files[i], w.sums[i], w.shards[i] = f, sha256.New(), artifactShard{Name: name}
+		w.bufs[i] = bufio.NewWriterSize(io.MultiWriter(f, w.sums[i]), 1<<16)
+	}
+	return w, nil
+}
+
+// write appends entries to their shards.
+func (w *artifactWriter) write(entries []journalEntry) error {
+	var prefix [4]byte
+	for _, e := range entries {
+		bucketHash := uint32(*e.BucketHash)
+		i := bucketHash >> (32 - corpusArtifactShardBits)
+		binary.BigEndian.PutUint32(prefix[:], bucketHash)
+		if _, err := w.bufs[i].Write(prefix[:]); err != nil {
+			return err
+		}
+		if _, err := w.bufs[i].Write(e.Value); err != nil {
+			return err
+		}
+		w.shards[i].Entries += 1
+		w.shards[i].Bytes += int64(len(prefix) + len(e.Value))
+	}
+	return nil
+}
+
+// close flushes the shard files, removes empty ones and returns the others.
+func (w *artifactWriter) close() ([]artifactShard, error) {
+	var shards []artifactShard
+	for i, f := range w.files {
+		if err := w.bufs[i].Flush(); err != nil {
+			w.abort()
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+		if w.shards[i].Entries == 0 {
+			os.Remove(f.Name())
+			continue
+		}
+		w.shards[i].SHA256 = hex.EncodeToString(w.sums[i].Sum(nil))
+		shards = append(shards, w.shards[i])
+	}
+	return shards, nil
+}
+
+// abort closes and removes the shard files.
+func (w *artifactWriter) abort() {
+	for _, f := range w.files {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+}
+
+// readDumps sends the <username>:<password> lines of the files at paths to
+// lines in slices of journalBatchSize, and closes it.
+func readDumps(paths []string, lines chan<- []string) error {
+	defer close(lines)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+		batch := make([]string, 0, journalBatchSize)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				batch = append(batch, line)
+			}
+			if len(batch) == journalBatchSize {
+				lines <- batch
+				batch = make([]string, 0, journalBatchSize)
+			}
+		}
+		if len(batch) > 0 {
+			lines <- batch
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// buildCorpus encrypts the credentials read by read for the corpus of cs
+// with workers concurrent goroutines, writing them to w and counting them in
+// m. read sends batches of lines to its channel and closes it.
+func buildCorpus(cs *cryptoSuite, read func(lines chan<- []string) error, workers int, w *artifactWriter, m *corpusManifest) error {
+	lines := make(chan []string, workers)
+	readErr := make(chan error, 1)
+	go func() { readErr <- read(lines) }()
+
+	var (
+		mu       sync.Mutex
+		writeErr error
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mut := mutator.NewRDasMutator()
+			for batch := range lines {
+				var entries []journalEntry
+				var credentials, malformed, failures int
+				for _, credential := range batch {
+					username, password, ok := splitCredential(credential)
+					if !ok {
+						malformed += 1
+						continue
+					}
+					e, err := encryptCredential(mut, cs, username, password, []byte(m.Metadata), m.NumVariants, m.IncludeUsernameVariant)
+					if err != nil {
+						failures += 1
+						continue
+					}
+					credentials += 1
+					entries = append(entries, e...)
+				}
+
+				mu.Lock()
+				m.Credentials += credentials
+				m.Malformed += malformed
+				m.Failures += failures
+				m.Entries += len(entries)
+				if writeErr == nil {
+					writeErr = w.write(entries)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if err := <-readErr; err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// runBuildCorpus implements the build-corpus command, which encrypts the
+// credentials of breach dumps into a corpus artifact without connecting to
+// any database. It needs the CONFIG_JSON of the deployment the artifact is
+// built for.
+func runBuildCorpus(args []string) error {
+	fs := flag.NewFlagSet("build-corpus", flag.ExitOnError)
+	out := fs.String("out", "", "directory to write the corpus artifact to")
+	version := fs.Uint("version", 0, "MIGP version to build the corpus of (default the current suite)")
+	metadata := fs.String("metadata", "", "metadata string stored alongside the entries")
+	numVariants := fs.Int("num-variants", 9, "number of password variants to encrypt per credential")
+	usernameVariant := fs.Bool("username-variant", true, "include a username-only variant")
+	workers := fs.Int("workers", runtime.NumCPU(), "number of concurrent encryption workers")
+	coordinator := fs.String("coordinator", "", "PostgreSQL connection string of the coordinator database of a distributed build")
+	build := fs.String("build", "", "ID of the distributed build to work on")
+	partitionSize := fs.Int64("partition-size", 256<<20, "bytes of dump per partition of a distributed build")
+	lease := fs.Duration("lease", 2*time.Minute, "lease on a partition of a distributed build, renewed while it is built")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: build-corpus -out DIR [flags] DUMP...")
+		fmt.Fprintln(fs.Output(), "With -coordinator, partition artifacts are written below DIR for merge-corpus.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *out == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("an output directory and at least one dump are required")
+	}
+
+	cs, m, err := newCorpusBuild(uint16(*version), *metadata, *numVariants, *usernameVariant)
+	if err != nil {
+		return err
+	}
+	if *coordinator != "" {
+		return runDistributedBuildCorpus(*coordinator, *build, *partitionSize, *lease, cs, m, fs.Args(), max(*workers, 1), *out)
+	}
+	start := time.Now()
+	read := func(lines chan<- []string) error { return readDumps(fs.Args(), lines) }
+	if err := buildArtifact(cs, read, max(*workers, 1), *out, m); err != nil {
+		return err
+	}
+	fmt.Printf("Built %d credentials (%d entries, %d failures, %d malformed) into %d shards in %s\n",
+		m.Credentials, m.Entries, m.Failures, m.Malformed, len(m.Shards), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// newCorpusBuild returns the suite of CONFIG_JSON for version, or the
+// current one if it is zero, and the manifest of an empty artifact built for
+// it with the given ingestion parameters.
+func newCorpusBuild(version uint16, metadata string, numVariants int, usernameVariant bool) (*cryptoSuite, *corpusManifest, error) {
+	configs, err := loadConfigs()
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := configs[0]
+	if version != 0 {
+		found := false
+		for _, c := range configs {
+			if c.Version == version {
+				cfg, found = c, true
+			}
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("MIGP version %d is not configured", version)
+		}
+	}
+	cs, err := newCryptoSuite(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	fingerprint, err := keyFingerprint(&cs.cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cs, &corpusManifest{
+		Format:                 corpusArtifactFormat,
+		Version:                cfg.Version,
+		BucketIDBitSize:        cfg.BucketIDBitSize,
+		KeyFingerprint:         fingerprint,
+		Metadata:               metadata,
+		NumVariants:            numVariants,
+		IncludeUsernameVariant: usernameVariant,
+	}, nil
+}
+
+// buildArtifact builds the credentials read by read into an artifact in
+// dir, filling in m and writing it as its manifest.
+func buildArtifact(cs *cryptoSuite, read func(lines chan<- []string) error, workers int, dir string, m *corpusManifest) error {
+	w, err := newArtifactWriter(dir)
+	if err != nil {
+		return err
+	}
+	if err := buildCorpus(cs, read, workers, w, m); err != nil {
+		w.abort()
+		return err
+	}
+	if m.Shards, err = w.close(); err != nil {
+		return err
+	}
+	return writeCorpusManifest(dir, m)
+}
+
+// writeCorpusManifest writes m as the manifest of the artifact in dir. It is
+// written last, so that a directory with a manifest holds a complete
+// artifact.
+func writeCorpusManifest(dir string, m *corpusManifest) error {
+	m.CreatedAt = time.Now().UTC()
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "manifest.json"), body, 0o644)
+}
+
+// readCorpusManifest reads the manifest of the corpus artifact in dir.
+func readCorpusManifest(dir string) (*corpusManifest, error) {
+	body, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var m corpusManifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("parsing manifest: %w", err)
+	}
+	if m.Format != corpusArtifactFormat {
+		return nil, fmt.Errorf("unsupported corpus artifact format %d", m.Format)
+	}
+	return &m, nil
+}
+
+// readShardFile reads a shard of the artifact in dir and verifies its
+// checksum.
+func readShardFile(dir string, shard artifactShard) ([]byte, error) {
+	contents, err := os.ReadFile(filepath.Join(dir, filepath.Base(shard.Name)))
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(contents); hex.EncodeToString(sum[:]) != shard.SHA256 {
+		return nil, fmt.Errorf("%s: shard %s does not match its checksum", dir, shard.Name)
+	}
+	return contents, nil
+}
+
+// readArtifactShard reads and verifies a shard of the artifact in dir and
+// returns its entries for the corpus of cs.
+func readArtifactShard(dir string, shard artifactShard, cs *cryptoSuite) ([]journalEntry, error) {
+	contents, err := readShardFile(dir, shard)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]journalEntry, 0, shard.Entries)
+	for len(contents) > 0 {
+		if len(contents) < 4+migp.HeaderSize {
+			return nil, fmt.Errorf("shard %s: truncated entry", shard.Name)
+		}
+		bucketHash := binary.BigEndian.Uint32(contents)
+		n := 4 + migp.HeaderSize + int(binary.BigEndian.Uint32(contents[4+migp.HeaderSize-4:4+migp.HeaderSize]))
+		if n > len(contents) {
+			return nil, fmt.Errorf("shard %s: truncated entry body", shard.Name)
+		}
+		hash := int64(bucketHash)
+		bucketID := bucketHash >> (32 - cs.cfg.BucketIDBitSize)
+		entries = append(entries, journalEntry{Key: cs.bucketKey(migp.BucketIDToHex(bucketID)), BucketHash: &hash, Value: contents[4:n]})
+		contents = contents[n:]
+	}
+	if len(entries) != shard.Entries {
+		return nil, fmt.Errorf("shard %s holds %d entries, not %d", shard.Name, len(entries), shard.Entries)
+	}
+	return entries, nil
+}
+
+// importMergeQuery merges the entries staged in corpus_import into the
+// corpus, skipping those already stored, as AppendUnique does for each, and
+// returns the number added. New entries are appended to the sub-buckets of
+// split buckets too.
+const importMergeQuery = `
+	WITH added AS (
+		INSERT INTO kv_store_shadow (id, value, bucket_hash)
+		SELECT id, value, bucket_hash FROM corpus_import ORDER BY id
+		ON CONFLICT (id, value) DO NOTHING
+		RETURNING id, value, bucket_hash
+	), base AS (
+		INSERT INTO kv_store (id, value)
+		SELECT id, string_agg(value, ''::bytea) FROM added GROUP BY id ORDER BY id
+		ON CONFLICT (id) DO UPDATE SET value = kv_store.value || EXCLUDED.value, version = kv_store.version + 1
+	), split AS (
+		INSERT INTO kv_store (id, value)
+		SELECT s.id || '/' || s.bits || '/' || lpad(to_hex(a.bucket_hash >> (32 - s.bits)), 8, '0'), string_agg(a.value, ''::bytea)
+		FROM added a JOIN bucket_splits s ON s.id = a.id
+		GROUP BY 1 ORDER BY 1
+		ON CONFLICT (id) DO UPDATE SET value = kv_store.value || EXCLUDED.value, version = kv_store.version + 1
+	)
+	SELECT count(*) FROM added`
+
+// copyImport bulk loads entries into the kv_store tables with COPY, in one
+// transaction, and returns the number of entries added.
+func (s *server) copyImport(ctx context.Context, entries []journalEntry) (int, error) {
+	tx, err := s.kv.db().BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `CREATE TEMP TABLE corpus_import (id TEXT, value BYTEA, bucket_hash BIGINT) ON COMMIT DROP`); err != nil {
+		return 0, err
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("corpus_import", "id", "value", "bucket_hash"))
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if _, err := stmt.ExecContext(ctx, e.Key, e.Value, e.bucketHash()); err != nil {
+			stmt.Close()
+			return 0, err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return 0, err
+	}
+	if err := stmt.Close(); err != nil {
+		return 0, err
+	}
+	var added int
+	if err := tx.QueryRowContext(ctx, importMergeQuery).Scan(&added); err != nil {
+		return 0, err
+	}
+	return added, tx.Commit()
+}
+
+// importShard loads the entries of one artifact shard into the corpus,
+// with COPY for the postgres backend and through the backend otherwise.
+func (s *server) importShard(ctx context.Context, entries []journalEntry) (int, error) {
+	if s.kv.buckets == nil {
+		return s.copyImport(ctx, entries)
+	}
+	added := 0
+	for i := 0; i < len(entries); i += journalBatchSize {
+		n, err := s.insert(ctx, entries[i:min(i+journalBatchSize, len(entries))])
+		added += n
+		if err != nil {
+			return added, err
+		}
+	}
+	return added, nil
+}
+
+// runImportCorpus implements the import-corpus command, which loads a corpus
+// artifact built by build-corpus into the corpus of its version, or with
+// -next into its next corpus, see nextcorpus.go. Entries already stored are
+// skipped, so an interrupted import can be rerun. The import bypasses the
+// journal and the bucket limits, so ingestion should be paused while it
+// runs, and a backup taken after it.
+func runImportCorpus(args []string) error {
+	fs := flag.NewFlagSet("import-corpus", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory holding the corpus artifact")
+	workers := fs.Int("workers", 4, "number of shards imported concurrently")
+	next := fs.Bool("next", false, "import into the next corpus, to be promoted later")
+	fs.Parse(args)
+	if *dir == "" {
+		return errors.New("-dir is required")
+	}
+
+	m, err := readCorpusManifest(*dir)
+	if err != nil {
+		return err
+	}
+	configs, err := loadConfigs()
+	if err != nil {
+		return err
+	}
+	s, err := newServer(configs[0], configs[1:]...)
+	if err != nil {
+		return err
+	}
+	cs := s.suite(m.Version)
+	if cs == nil {
+		return fmt.Errorf("the artifact is for MIGP version %d, which is not configured", m.Version)
+	}
+	fingerprint, err := keyFingerprint(&cs.cfg)
+	if err != nil {
+		return err
+	}
+	if fingerprint != m.KeyFingerprint || cs.cfg.BucketIDBitSize != m.BucketIDBitSize {
+		return fmt.Errorf("the artifact was built for another key or bucket ID length than version %d uses", m.Version)
+	}
+	if *next {
+		cs = cs.next()
+	}
+	if err := s.ensureStorage(); err != nil {
+		return err
+	}
+	// With fewer bucket ID bits than shard bits, shards share buckets, and
+	// concurrent merges would contend on their rows.
+	if cs.cfg.BucketIDBitSize < corpusArtifactShardBits {
+		*workers = 1
+	}
+
+	start := time.Now()
+	var (
+		mu           sync.Mutex
+		added, total int
+		firstErr     error
+		wg           sync.WaitGroup
+	)
+	shards := make(chan artifactShard)
+	for i := 0; i < max(*workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shard := range shards {
+				entries, err := readArtifactShard(*dir, shard, cs)
+				n := 0
+				if err == nil {
+					n, err = s.importShard(context.Background(), entries)
+				}
+				mu.Lock()
+				added += n
+				total += len(entries)
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("importing shard %s: %w", shard.Name, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, shard := range m.Shards {
+		shards <- shard
+	}
+	close(shards)
+	wg.Wait()
+	if added > 0 {
+		s.corpusChanged()
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	fmt.Printf("Imported %d of %d entries into version %d in %s, the others were already stored\n",
+		added, total, m.Version, time.Since(start).Round(time.Millisecond))
+	return nil
+}
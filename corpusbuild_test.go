@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// writeDump writes lines to a dump file in dir and returns its path.
+func writeDump(t *testing.T, dir string, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(dir, "dump.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setConfigJSON sets CONFIG_JSON to the configuration of cs, as on the
+// machine building artifacts for its deployment.
+func setConfigJSON(t *testing.T, cs *cryptoSuite) {
+	configJSON, err := json.Marshal(&cs.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_JSON", string(configJSON))
+}
+
+func TestNewCorpusBuild(t *testing.T) {
+	s, _ := newTestServer(t)
+	setConfigJSON(t, s.suites[0])
+	cs, m, err := newCorpusBuild(0, "offline", 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, _ := keyFingerprint(&s.suites[0].cfg)
+	if cs.cfg.Version != s.suites[0].cfg.Version || m.KeyFingerprint != fingerprint || m.Format != corpusArtifactFormat ||
+		m.Metadata != "offline" || m.NumVariants != 3 || m.IncludeUsernameVariant {
+		t.Errorf("corpus build manifest %+v", m)
+	}
+	if _, _, err := newCorpusBuild(99, "", 0, false); err == nil {
+		t.Error("build for an unconfigured version accepted")
+	}
+}
+
+func TestBuildAndImportArtifact(t *testing.T) {
+	s, srv := newTestServer(t)
+	setConfigJSON(t, s.suites[0])
+	cs, m, err := newCorpusBuild(0, "", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := []string{"a@example.com:password1", "b@example.com:hunter2", "c@example.com:letmein"}
+	dump := writeDump(t, t.TempDir(), append(credentials, "", "no separator")...)
+	dir := filepath.Join(t.TempDir(), "artifact")
+	read := func(lines chan<- []string) error { return readDumps([]string{dump}, lines) }
+	if err := buildArtifact(cs, read, 2, dir, m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Credentials != 3 || m.Malformed != 1 || m.Failures != 0 || m.Entries != 3 {
+		t.Fatalf("manifest %+v, want 3 credentials of one entry and 1 malformed line", m)
+	}
+	if err := buildArtifact(cs, read, 2, dir, m); err == nil {
+		t.Fatal("artifact written over an existing one")
+	}
+
+	stored, err := readCorpusManifest(dir)
+	if err != nil || stored.Entries != m.Entries || len(stored.Shards) != len(m.Shards) {
+		t.Fatalf("manifest read back as %+v, %v", stored, err)
+	}
+	total := 0
+	for _, shard := range stored.Shards {
+		entries, err := readArtifactShard(dir, shard, s.suites[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := s.importShard(context.Background(), entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += n
+	}
+	if total != m.Entries {
+		t.Fatalf("imported %d entries, want %d", total, m.Entries)
+	}
+
+	client, err := migp.NewClient(cs.cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, credential := range credentials {
+		username, password, _ := splitCredential(credential)
+		request, ctx, err := client.Request(username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(request)
+		if status, err := queryStatus(http.DefaultClient, srv.URL+"/api/query", body, ctx, 0); err != nil || status != migp.InBreach {
+			t.Errorf("query for imported %s: %s, %v, want %s", credential, status, err, migp.InBreach)
+		}
+	}
+}
+
+func TestCorruptArtifact(t *testing.T) {
+	s, _ := newTestServer(t)
+	setConfigJSON(t, s.suites[0])
+	cs, m, err := newCorpusBuild(0, "", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := writeDump(t, t.TempDir(), "a@example.com:password1")
+	dir := t.TempDir()
+	if err := buildArtifact(cs, func(lines chan<- []string) error { return readDumps([]string{dump}, lines) }, 1, dir, m); err != nil {
+		t.Fatal(err)
+	}
+	shard := m.Shards[0]
+	path := filepath.Join(dir, shard.Name)
+	contents, _ := os.ReadFile(path)
+	os.WriteFile(path, contents[:len(contents)-1], 0o644)
+	if _, err := readArtifactShard(dir, shard, cs); err == nil {
+		t.Error("truncated shard passed its checksum")
+	}
+	os.WriteFile(path, contents, 0o644)
+	shard.Entries++
+	if _, err := readArtifactShard(dir, shard, cs); err == nil {
+		t.Error("shard with a wrong entry count accepted")
+	}
+
+	manifest, _ := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	os.WriteFile(filepath.Join(dir, "manifest.json"), []byte(strings.Replace(string(manifest), `"format": 1`, `"format": 2`, 1)), 0o644)
+	if _, err := readCorpusManifest(dir); err == nil {
+		t.Error("manifest of an unknown format accepted")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// OPRF evaluations run on a bounded pool of CRYPTO_WORKERS goroutines
+// (default one less than GOMAXPROCS, at least one), apart from the
+// goroutines waiting on storage, so that a spike of CPU-bound evaluations
+// leaves processors to health checks and admin routes. Evaluations wait in a
+// queue of CRYPTO_QUEUE_SIZE (default 64 per worker); queries finding it
+// full are shed with a 503. CRYPTO_WORKERS=0 evaluates on the goroutine of
+// each request instead.
+
+var (
+	cryptoWorkers  = newGauge("migp_crypto_workers", "Goroutines of the crypto worker pool.")
+	cryptoBusy     = newGauge("migp_crypto_busy_workers", "Crypto workers evaluating.")
+	cryptoQueued   = newGauge("migp_crypto_queued", "Evaluations waiting for a crypto worker.")
+	cryptoWait     = newHistogram("migp_crypto_wait_seconds", "Time evaluations waited for a crypto worker.", defaultLatencyBuckets)
+	cryptoRejected = newCounter("migp_crypto_rejected_total", "Evaluations rejected because the crypto queue was full.")
+)
+
+// errCryptoBusy is returned for evaluations finding the crypto queue full.
+var errCryptoBusy = errors.New("crypto worker queue full")
+
+// cryptoPool runs evaluations on a fixed set of goroutines.
+type cryptoPool struct {
+	tasks chan func()
+}
+
+// newCryptoPool returns the pool configured as described above, or nil if
+// CRYPTO_WORKERS is 0.
+func newCryptoPool() *cryptoPool {
+	workers := envInt("CRYPTO_WORKERS", max(1, runtime.GOMAXPROCS(0)-1))
+	if workers <= 0 {
+		return nil
+	}
+	size := envInt("CRYPTO_QUEUE_SIZE", 64*workers)
+	if size < 0 {
+		log.Printf("Invalid CRYPTO_QUEUE_SIZE value %d. Using 0.", size)
+		size = 0
+	}
+	p := &cryptoPool{tasks: make(chan func(), size)}
+	for range workers {
+		go p.work()
+	}
+	cryptoWorkers.Set(float64(workers))
+	return p
+}
+
+// work runs tasks until the pool is dropped.
+func (p *cryptoPool) work() {
+	for task := range p.tasks {
+		cryptoQueued.Add(-1)
+		cryptoBusy.Add(1)
+		task()
+		cryptoBusy.Add(-1)
+	}
+}
+
+// run runs f on a worker and waits for it, or until ctx is done. f is
+// skipped if ctx is done before a worker takes it. A nil pool runs f on the
+// calling goroutine.
+func (p *cryptoPool) run(ctx context.Context, f func()) error {
+	if p == nil {
+		f()
+		return nil
+	}
+	done := make(chan struct{})
+	queued := time.Now()
+	task := func() {
+		defer close(done)
+		cryptoWait.Observe(time.Since(queued).Seconds())
+		if ctx.Err() == nil {
+			f()
+		}
+	}
+	cryptoQueued.Add(1)
+	select {
+	case p.tasks <- task:
+	default:
+		cryptoQueued.Add(-1)
+		cryptoRejected.Inc()
+		return errCryptoBusy
+	}
+	select {
+	case <-done:
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// evaluate handles request with cs. The pool evaluates the OPRF and the
+// bucket is then fetched from getter on the calling goroutine, so that
+// workers do not wait on storage.
+func (s *server) evaluate(ctx context.Context, cs *cryptoSuite, request migp.ClientRequest, getter migp.Getter) (migp.ServerResponse, error) {
+	start := time.Now()
+	evaluated, err := s.evaluateBatch(ctx, cs, [][]byte{request.BlindElement})
+	queryStatsFrom(ctx).evaluated(start)
+	if err != nil {
+		return migp.ServerResponse{}, err
+	}
+	if _, err := hex.DecodeString(request.BucketID); err != nil {
+		return migp.ServerResponse{}, errors.New("bucket ID not valid hex")
+	}
+	contents, err := getter.Get(request.BucketID)
+	return migp.ServerResponse{Version: request.Version, EvaluatedElement: evaluated[0], BucketContents: contents}, err
+}
+
+// evaluateBatch evaluates the blinded elements with the key of cs in a
+// single task on the pool.
+func (s *server) evaluateBatch(ctx context.Context, cs *cryptoSuite, elements [][]byte) ([][]byte, error) {
+	if cs.remote != nil {
+		return cs.remote.evaluate(ctx, s.crypto, elements)
+	}
+	var (
+		evaluated [][]byte
+		err       error
+	)
+	if perr := s.crypto.run(ctx, func() { evaluated, err = cs.key.evaluate(elements) }); perr != nil {
+		return nil, perr
+	}
+	return evaluated, err
+}
+
+// evaluationError responds to a failed evaluation: a 503 if it was shed or
+// a remote evaluator failed, and as a storage error otherwise.
+func evaluationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errCryptoBusy) {
+		w.Header().Set("Retry-After", "1")
+		writeErrorCode(w, errOverloaded, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errEvaluatorUnavailable) {
+		log.Println("Remote OPRF evaluation failed:", err)
+		w.Header().Set("Retry-After", "1")
+		writeErrorCode(w, errUnavailable, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	storageError(w, "HandleRequest", err)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCryptoPool(t *testing.T) {
+	t.Setenv("CRYPTO_WORKERS", "1")
+	t.Setenv("CRYPTO_QUEUE_SIZE", "1")
+	p := newCryptoPool()
+
+	block, started := make(chan struct{}), make(chan struct{})
+	go p.run(context.Background(), func() { close(started); <-block })
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := false
+	queued := make(chan error)
+	go func() { queued <- p.run(ctx, func() { ran = true }) }()
+	for len(p.tasks) == 0 {
+	}
+	if err := p.run(context.Background(), func() {}); !errors.Is(err, errCryptoBusy) {
+		t.Fatalf("run with a full queue: %v, want errCryptoBusy", err)
+	}
+	cancel()
+	if err := <-queued; !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled run: %v", err)
+	}
+	close(block)
+	for len(p.tasks) > 0 {
+	}
+	if err := p.run(context.Background(), func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if ran {
+		t.Fatal("canceled evaluation ran")
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardCSP lets the dashboard load its own scripts and styles and call
+// the admin APIs of the server, and nothing else.
+const dashboardCSP = "default-src 'none'; script-src 'self'; style-src 'self'; connect-src 'self'; " +
+	"img-src 'self'; form-action 'none'; base-uri 'none'; frame-ancestors 'none'"
+
+// newDashboardHandler serves the admin dashboard under /api/admin/ui/. The
+// page holds no data of its own: it asks for the admin API key and polls the
+// metrics and admin JSON APIs with it, so it is served without
+// authentication. It is disabled with ADMIN_UI_ENABLED=false.
+func newDashboardHandler() http.HandlerFunc {
+	if !envBool("ADMIN_UI_ENABLED", true) {
+		return http.NotFound
+	}
+	return newStaticHandler(dashboardFiles, "dashboard", "/api/admin/ui/", dashboardCSP)
+}
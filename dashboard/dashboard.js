@@ -0,0 +1,272 @@
+// The dashboard polls the metrics and admin JSON APIs with the admin API key
+// and renders them. Rates are computed from the difference between two
+// scrapes of the Prometheus counters, so they appear from the second refresh.
+(() => {
+  const api = new URL("../../", location.href); // /api/
+  const refreshInterval = 10000;
+  const storageKey = "migpAdminKey";
+  const $ = (id) => document.getElementById(id);
+
+  let previous = null;
+  let timer = null;
+  // events holds the latest events of the feed, newest first.
+  let events = [];
+  const eventRows = 20;
+
+  // parseMetrics turns the Prometheus text format into a list of samples.
+  const parseMetrics = (text) => {
+    const samples = [];
+    for (const line of text.split("\n")) {
+      const m = line.match(/^([a-zA-Z_:][a-zA-Z0-9_:]*)(?:\{(.*)\})? (\S+)$/);
+      if (!m) {
+        continue;
+      }
+      const labels = {};
+      for (const [, k, v] of (m[2] || "").matchAll(/([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\]|\\.)*)"/g)) {
+        labels[k] = v.replace(/\\(.)/g, (_, c) => (c === "n" ? "\n" : c));
+      }
+      samples.push({ name: m[1], labels, value: Number(m[3]) });
+    }
+    return samples;
+  };
+
+  // sum adds up the samples of name whose labels match.
+  const sum = (samples, name, match = {}) =>
+    samples
+      .filter((s) => s.name === name && Object.entries(match).every(([k, v]) => s.labels[k] === v))
+      .reduce((total, s) => total + s.value, 0);
+
+  const fmt = {
+    rate: (v) => (v === null ? "–" : `${v.toFixed(v < 10 ? 2 : 0)}/s`),
+    ratio: (v) => (v === null || Number.isNaN(v) ? "–" : `${(100 * v).toFixed(2)}%`),
+    bytes: (v) => {
+      const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+      let i = 0;
+      while (v >= 1024 && i < units.length - 1) {
+        v /= 1024;
+        i++;
+      }
+      return `${v.toFixed(i ? 1 : 0)} ${units[i]}`;
+    },
+    time: (v) => (v ? new Date(v).toLocaleString() : "–"),
+  };
+
+  const fill = (id, rows) => {
+    const el = $(id);
+    el.replaceChildren();
+    for (const [label, value, kind] of rows) {
+      const dt = document.createElement("dt");
+      dt.textContent = label;
+      const dd = document.createElement("dd");
+      dd.textContent = value;
+      if (kind) {
+        dd.className = kind;
+      }
+      el.append(dt, dd);
+    }
+  };
+
+  const table = (id, rows, empty) => {
+    const el = $(id);
+    el.replaceChildren();
+    if (rows.length === 0) {
+      rows = [[empty]];
+    }
+    for (const cells of rows) {
+      const tr = document.createElement("tr");
+      for (const cell of cells) {
+        const td = document.createElement("td");
+        td.textContent = cell;
+        if (cells.length === 1) {
+          td.colSpan = 6;
+        }
+        tr.append(td);
+      }
+      el.append(tr);
+    }
+  };
+
+  // get fetches an API path with the admin key, returning the parsed body or
+  // an Error, so that one failing API does not blank the whole dashboard.
+  const get = async (path, key, text = false) => {
+    try {
+      const response = await fetch(new URL(path, api), { headers: { Authorization: `Bearer ${key}` } });
+      if (response.status === 401) {
+        throw new Error("the admin API key was rejected");
+      }
+      if (!response.ok) {
+        return new Error(`${path}: status ${response.status}`);
+      }
+      return text ? await response.text() : await response.json();
+    } catch (err) {
+      if (err.message === "the admin API key was rejected") {
+        throw err;
+      }
+      return new Error(`${path}: ${err.message}`);
+    }
+  };
+
+  const render = async (key) => {
+    const after = events.length ? `?after=${encodeURIComponent(events[0].id)}` : "";
+    const [metricsText, config, db, stats, keyStatus, jobs, feed] = await Promise.all([
+      get("metrics", key, true),
+      get("config", key),
+      get("admin/db", key),
+      get("admin/stats/corpus", key),
+      get("admin/key", key),
+      get("admin/jobs", key),
+      get(`admin/events${after}`, key),
+    ]);
+    const errors = [metricsText, config, db, stats, keyStatus, jobs, feed].filter((r) => r instanceof Error);
+    $("error").hidden = errors.length === 0;
+    $("error").textContent = errors.map((e) => e.message).join("; ");
+
+    const now = Date.now();
+    const samples = metricsText instanceof Error ? [] : parseMetrics(metricsText);
+    const delta = (name, match) => {
+      if (!previous || metricsText instanceof Error) {
+        return null;
+      }
+      const elapsed = (now - previous.at) / 1000;
+      return Math.max(0, sum(samples, name, match) - sum(previous.samples, name, match)) / elapsed;
+    };
+
+    // Health.
+    const endpoints = db instanceof Error ? [] : db.endpoints;
+    const healthRows = [["API", config instanceof Error ? "unreachable" : "reachable", config instanceof Error ? "bad" : "ok"]];
+    for (const ep of endpoints) {
+      const healthy = samples.find((s) => s.name === "migp_db_endpoint_healthy" && s.labels.endpoint === String(ep.endpoint));
+      const state = healthy === undefined ? "unknown" : healthy.value === 1 ? "healthy" : "unhealthy";
+      healthRows.push([
+        `Database endpoint ${ep.endpoint}${ep.active ? " (active)" : ""}`,
+        `${state}, ${ep.pool.inUse} of ${ep.pool.maxOpenConnections || "∞"} connections in use`,
+        state === "unhealthy" ? "bad" : state === "healthy" ? "ok" : "",
+      ]);
+    }
+    healthRows.push(["Handler panics", String(sum(samples, "migp_handler_panics_total")), sum(samples, "migp_handler_panics_total") ? "bad" : ""]);
+    healthRows.push(["Queries shed", String(sum(samples, "migp_query_shed_total"))]);
+    fill("health", healthRows);
+
+    // Traffic.
+    const availability = { slo: "availability" };
+    const all = delta("migp_slo_events_total", availability);
+    const bad = delta("migp_slo_events_total", { ...availability, result: "bad" });
+    const hits = sum(samples, "migp_query_cache_requests_total", { result: "hit" });
+    const misses = sum(samples, "migp_query_cache_requests_total", { result: "miss" });
+    fill("traffic", [
+      ["Requests", fmt.rate(all)],
+      ["Queries", fmt.rate(delta("migp_slo_events_total", { ...availability, route: "/api/query" }))],
+      ["Server error rate", fmt.ratio(all ? bad / all : null), bad ? "bad" : ""],
+      ["Invalid queries", fmt.rate(delta("migp_requests_invalid_total"))],
+      ["Query cache revalidation hit ratio", hits + misses ? fmt.ratio(hits / (hits + misses)) : "–"],
+      ["Queries in flight", String(sum(samples, "migp_query_inflight"))],
+    ]);
+    const routes = [...new Set(samples.filter((s) => s.name === "migp_slo_events_total").map((s) => s.labels.route))].sort();
+    table(
+      "routes",
+      routes.map((route) => {
+        const total = delta("migp_slo_events_total", { route, slo: "availability" });
+        const errs = delta("migp_slo_events_total", { route, slo: "availability", result: "bad" });
+        const slow = delta("migp_slo_events_total", { route, slo: "latency", result: "bad" });
+        return [route, fmt.rate(total), fmt.ratio(total ? errs / total : null), fmt.ratio(total ? slow / total : null)];
+      }),
+      "No requests yet",
+    );
+
+    // Corpus.
+    table(
+      "corpus",
+      (stats instanceof Error ? [] : stats).map((st) => [
+        `v${st.version}`,
+        st.buckets.toLocaleString(),
+        st.entries.toLocaleString(),
+        fmt.bytes(st.totalBytes),
+        fmt.bytes(st.p99Bytes),
+        fmt.time(st.computedAt),
+      ]),
+      stats instanceof Error ? "Unavailable" : "Not computed yet",
+    );
+
+    // Key.
+    if (keyStatus instanceof Error) {
+      fill("key", [["Status", "unavailable", "bad"]]);
+    } else {
+      fill("key", [
+        ...keyStatus.suites.map((s, i) => [`Suite v${s.version}${i === 0 ? " (current)" : ""}`, s.fingerprint]),
+        ["Recorded fingerprint", keyStatus.recordedFingerprint || "none"],
+        ["Last rotation", fmt.time(keyStatus.recordedAt)],
+        ["Status", keyStatus.current ? "current key recorded" : "recorded key differs", keyStatus.current ? "ok" : "bad"],
+      ]);
+    }
+
+    // Jobs.
+    table(
+      "jobs",
+      (jobs instanceof Error ? [] : jobs.jobs).map((j) => [
+        j.jobId.slice(0, 12),
+        j.type || "–",
+        j.state === "running" && j.percent ? `running (${j.percent}%)` : j.state + (j.error ? `: ${j.error}` : ""),
+        fmt.time(j.startedAt),
+        fmt.time(j.updatedAt),
+      ]),
+      "No jobs since this instance started",
+    );
+
+    // Events.
+    if (!(feed instanceof Error)) {
+      // An ID that is no longer recent returns every recent event again.
+      const seen = new Set(events.map((e) => e.id));
+      events = [...feed.events.filter((e) => !seen.has(e.id)).reverse(), ...events].slice(0, eventRows);
+    }
+    table(
+      "events",
+      events.map((e) => [fmt.time(e.eventTime), e.eventType, e.subject]),
+      feed instanceof Error ? "Unavailable" : "No events since this instance started",
+    );
+
+    if (!(metricsText instanceof Error)) {
+      previous = { at: now, samples };
+    }
+    $("updated").textContent = `Updated ${new Date(now).toLocaleTimeString()}`;
+  };
+
+  const signOut = (message) => {
+    clearTimeout(timer);
+    sessionStorage.removeItem(storageKey);
+    previous = null;
+    events = [];
+    $("dashboard").hidden = true;
+    $("signout").hidden = true;
+    $("login").hidden = false;
+    $("updated").textContent = message || "";
+  };
+
+  const start = (key) => {
+    $("login").hidden = true;
+    $("dashboard").hidden = false;
+    $("signout").hidden = false;
+    const tick = async () => {
+      try {
+        await render(key);
+        timer = setTimeout(tick, refreshInterval);
+      } catch (err) {
+        signOut(err.message);
+      }
+    };
+    tick();
+  };
+
+  $("login").addEventListener("submit", (event) => {
+    event.preventDefault();
+    const key = new FormData(event.target).get("key");
+    sessionStorage.setItem(storageKey, key);
+    event.target.reset();
+    start(key);
+  });
+  $("signout").addEventListener("click", () => signOut());
+
+  const saved = sessionStorage.getItem(storageKey);
+  if (saved) {
+    start(saved);
+  }
+})();
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboardHandler(t *testing.T) {
+	_, srv := newTestServer(t)
+	resp, err := http.Get(srv.URL + "/api/admin/ui/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "<title>MIGP admin</title>") {
+		t.Fatalf("dashboard without an admin key answered %d", resp.StatusCode)
+	}
+	if csp := resp.Header.Get("Content-Security-Policy"); csp != dashboardCSP {
+		t.Errorf("dashboard served with policy %q", csp)
+	}
+
+	t.Setenv("ADMIN_UI_ENABLED", "false")
+	rec := httptest.NewRecorder()
+	newDashboardHandler()(rec, httptest.NewRequest(http.MethodGet, "/api/admin/ui/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("disabled dashboard answered %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestJobTracker(t *testing.T) {
+	tracker := newJobTracker()
+	tracker.record(eventJobStarted, "migp/jobs/a", map[string]interface{}{"type": "ingest"})
+	tracker.record(eventJobProgress, "migp/jobs/a", map[string]interface{}{"percent": 40})
+	tracker.record(eventJobStarted, "migp/jobs/b", map[string]interface{}{"type": "repair"})
+	tracker.record(eventJobFailed, "migp/jobs/b", map[string]interface{}{"error": "storage unavailable"})
+	tracker.record(eventCorpusRestored, "migp/corpus", map[string]interface{}{})
+	jobs := tracker.list()
+	if len(jobs) != 2 || jobs[0].ID != "b" || jobs[1].ID != "a" {
+		t.Fatalf("tracked jobs %+v, want b then a", jobs)
+	}
+	if b := jobs[0]; b.Type != "repair" || b.State != "failed" || b.Error != "storage unavailable" {
+		t.Errorf("failed job %+v", b)
+	}
+	if a := jobs[1]; a.Type != "ingest" || a.State != "running" || a.Percent != 40 {
+		t.Errorf("running job %+v", a)
+	}
+	tracker.record(eventJobCompleted, "migp/jobs/a", map[string]interface{}{"result": "done"})
+	if a := tracker.list()[1]; a.State != "completed" || a.Percent != 100 || a.Result != "done" {
+		t.Errorf("completed job %+v", a)
+	}
+
+	for i := 0; i < maxTrackedJobs; i++ {
+		tracker.record(eventJobStarted, fmt.Sprintf("migp/jobs/%d", i), nil)
+	}
+	if jobs := tracker.list(); len(jobs) != maxTrackedJobs || jobs[len(jobs)-1].ID != "0" {
+		t.Errorf("%d jobs tracked, oldest %q, want the last %d", len(jobs), jobs[len(jobs)-1].ID, maxTrackedJobs)
+	}
+}
+
+func TestHandleJobs(t *testing.T) {
+	s, srv := newTestServer(t)
+	s.events.Publish(eventJobStarted, "migp/jobs/job1", map[string]interface{}{"type": "seed"})
+	resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodGet, srv.URL+"/api/admin/jobs", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Jobs []jobStatus `json:"jobs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("jobs answered %d: %v", resp.StatusCode, err)
+	}
+	if len(list.Jobs) != 1 || list.Jobs[0].ID != "job1" || list.Jobs[0].Type != "seed" || list.Jobs[0].State != "running" {
+		t.Errorf("jobs %+v, want the running seed job", list.Jobs)
+	}
+}
+
+func TestHandleKeyStatus(t *testing.T) {
+	s, srv := newDBTestServer(t)
+	resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodGet, srv.URL+"/api/admin/key", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status struct {
+		Suites  []suiteKey `json:"suites"`
+		Current bool       `json:"current"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("key status answered %d: %v", resp.StatusCode, err)
+	}
+	fingerprint, err := keyFingerprint(&s.suites[0].cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Suites) != len(s.suites) || status.Suites[0].Fingerprint != fingerprint {
+		t.Errorf("key status suites %+v, want fingerprint %s", status.Suites, fingerprint)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	storageDuration = newHistogram("migp_storage_duration_seconds", "Duration of storage calls by operation.", defaultLatencyBuckets, "op")
+	storageSlow     = newCounter("migp_storage_slow_calls_total", "Storage calls exceeding DB_SLOW_QUERY_THRESHOLD by operation.", "op")
+	storageRetries  = newCounter("migp_storage_retries_total", "Storage calls retried after a transient error by operation.", "op")
+)
+
+// retryPolicy bounds the retries of transient storage errors.
+type retryPolicy struct {
+	attempts int
+	budget   time.Duration
+	backoff  time.Duration
+}
+
+// newRetryPolicy returns a retryPolicy configured from DB_RETRY_ATTEMPTS and
+// DB_RETRY_BUDGET.
+func newRetryPolicy() retryPolicy {
+	return retryPolicy{
+		attempts: envInt("DB_RETRY_ATTEMPTS", 3),
+		budget:   envDuration("DB_RETRY_BUDGET", 2*time.Second),
+		backoff:  50 * time.Millisecond,
+	}
+}
+
+// connectionOptions holds driver and session settings applied on top of the
+// configured connection string.
+type connectionOptions struct {
+	// statementTimeout makes the database abort any statement running
+	// longer than it. Zero disables the timeout.
+	statementTimeout time.Duration
+
+	// poolerMode makes every connection safe to use behind a transaction
+	// pooler such as PgBouncer or the Azure Flexible Server built-in pooler.
+	poolerMode bool
+
+	// Connection pool limits of each endpoint, as taken by sql.DB. Zero
+	// values keep the database/sql defaults.
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	connMaxIdleTime time.Duration
+}
+
+// newConnectionOptions returns connectionOptions configured from
+// DB_STATEMENT_TIMEOUT, DB_POOLER_MODE, DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS,
+// DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME.
+func newConnectionOptions() connectionOptions {
+	opts := connectionOptions{
+		statementTimeout: envDuration("DB_STATEMENT_TIMEOUT", 0),
+		poolerMode:       envBool("DB_POOLER_MODE", false),
+		maxOpenConns:     envInt("DB_MAX_OPEN_CONNS", 0),
+		maxIdleConns:     envInt("DB_MAX_IDLE_CONNS", 0),
+		connMaxLifetime:  envDuration("DB_CONN_MAX_LIFETIME", 0),
+		connMaxIdleTime:  envDuration("DB_CONN_MAX_IDLE_TIME", 0),
+	}
+	if opts.poolerMode && opts.statementTimeout > 0 {
+		// Transaction poolers reject or leak session parameters, so the
+		// timeout has to be configured on the database role instead.
+		log.Println("DB_STATEMENT_TIMEOUT is ignored when DB_POOLER_MODE is set. Use ALTER ROLE ... SET statement_timeout instead.")
+		opts.statementTimeout = 0
+	}
+	return opts
+}
+
+// configure applies the pool limits of opts to db.
+func (opts connectionOptions) configure(db *sql.DB) {
+	db.SetMaxOpenConns(opts.maxOpenConns)
+	if opts.maxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.maxIdleConns)
+	}
+	db.SetConnMaxLifetime(opts.connMaxLifetime)
+	db.SetConnMaxIdleTime(opts.connMaxIdleTime)
+}
+
+// apply returns dsn, in either URL or key/value form, as a key/value
+// connection string with opts applied.
+//
+// In pooler mode no session parameters are sent, and binary_parameters makes
+// lib/pq send each parameterized query as a single Parse/Bind/Execute
+// sequence on the unnamed statement, so no prepared statement outlives the
+// server connection a pooler assigned to it.
+func (opts connectionOptions) apply(dsn string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			return "", err
+		}
+	}
+	if opts.statementTimeout > 0 {
+		dsn = fmt.Sprintf("%s statement_timeout=%d", dsn, opts.statementTimeout.Milliseconds())
+	}
+	if opts.poolerMode {
+		dsn += " binary_parameters=yes"
+	}
+	return dsn, nil
+}
+
+// observe records the duration of a storage call started at start as a span
+// of the request ctx belongs to, logging it with the bucket ID and keeping the
+// request's trace if it exceeds the slow query threshold.
+func (kv *kvStore) observe(ctx context.Context, op, id string, start time.Time) {
+	elapsed := time.Since(start)
+	storageDuration.Observe(elapsed.Seconds(), op)
+	recordSpan(ctx, "storage."+op, start, false, map[string]string{"migp.bucket": kv.bucketLabel(id)})
+	if kv.slowThreshold > 0 && elapsed >= kv.slowThreshold {
+		storageSlow.Inc(op)
+		keepTrace(ctx, "slow_storage")
+		log.Printf("Slow storage call: op=%s bucket=%s duration=%s", op, kv.bucketLabel(id), elapsed)
+	}
+}
+
+// isTransient reports whether err is a database error that is likely to
+// succeed on retry: serialization failures, deadlocks, dropped connections and
+// server restarts during a failover.
+func isTransient(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"53300", // too_many_connections
+			"57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03": // cannot_connect_now
+			return true
+		}
+		// Class 08 covers connection exceptions.
+		return pqErr.Code.Class() == "08"
+	}
+	for _, transient := range transientErrors {
+		if transient(err) {
+			return true
+		}
+	}
+	var netErr net.Error
+	return errors.Is(err, errInjectedFault) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.As(err, &netErr)
+}
+
+// transientErrors holds the checks of isTransient for the errors of the
+// storage backends built in, see bucketBackends.
+var transientErrors []func(error) bool
+
+// retry calls f until it succeeds, fails with a non-transient error, or the
+// retry policy is exhausted. Waits between attempts use exponential backoff
+// with full jitter.
+func (kv *kvStore) retry(ctx context.Context, op string, f func() error) error {
+	deadline := time.Now().Add(kv.retryPolicy.budget)
+	backoff := kv.retryPolicy.backoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !isTransient(err) || attempt >= kv.retryPolicy.attempts || ctx.Err() != nil {
+			return err
+		}
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		if time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		storageRetries.Inc(op)
+		log.Printf("Retrying storage call after transient error: op=%s attempt=%d error=%v", op, attempt, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
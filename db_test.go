@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestConnectionOptionsStatementTimeout(t *testing.T) {
+	t.Setenv("DB_STATEMENT_TIMEOUT", "1500ms")
+	opts := newConnectionOptions()
+	for _, dsn := range []string{
+		"host=db user=migp dbname=migp",
+		"postgres://migp@db/migp",
+	} {
+		got, err := opts.apply(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(got, " statement_timeout=1500") || strings.Contains(got, "://") {
+			t.Errorf("apply(%q) = %q, want a key/value string with the timeout", dsn, got)
+		}
+	}
+
+	t.Setenv("DB_STATEMENT_TIMEOUT", "soon")
+	if opts := newConnectionOptions(); opts.statementTimeout != 0 {
+		t.Errorf("invalid timeout parsed as %s, want none", opts.statementTimeout)
+	}
+}
+
+func TestSlowStorageCalls(t *testing.T) {
+	slow := func() float64 {
+		v, _, _, _ := storageSlow.total(func(v []string) bool { return v[0] == "test_op" })
+		return v
+	}
+	kv := &kvStore{slowThreshold: 10 * time.Millisecond}
+	before := slow()
+	kv.observe(context.Background(), "test_op", "0a1b2", time.Now())
+	if slow() != before {
+		t.Error("fast call counted as slow")
+	}
+	kv.observe(context.Background(), "test_op", "0a1b2", time.Now().Add(-time.Second))
+	if slow() != before+1 {
+		t.Error("slow call not counted")
+	}
+	kv.slowThreshold = 0
+	kv.observe(context.Background(), "test_op", "0a1b2", time.Now().Add(-time.Second))
+	if slow() != before+1 {
+		t.Error("slow call counted with the threshold disabled")
+	}
+}
+
+func TestEnvHelpers(t *testing.T) {
+	t.Setenv("TEST_BOOL", "true")
+	t.Setenv("TEST_DURATION", "-1s")
+	t.Setenv("TEST_INT", "seven")
+	if !envBool("TEST_BOOL", false) || envBool("TEST_UNSET", false) {
+		t.Error("envBool")
+	}
+	if envDuration("TEST_DURATION", time.Second) != time.Second {
+		t.Error("negative duration accepted")
+	}
+	if envInt("TEST_INT", 7) != 7 {
+		t.Error("invalid integer not defaulted")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "08006"}, true},
+		{fmt.Errorf("wrapped: %w", &pq.Error{Code: "57P01"}), true},
+		{&pq.Error{Code: "23505"}, false},
+		{driver.ErrBadConn, true},
+		{io.ErrUnexpectedEOF, true},
+		{sql.ErrNoRows, false},
+		{errors.New("syntax error"), false},
+	} {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	kv := &kvStore{retryPolicy: retryPolicy{attempts: 3, budget: time.Second, backoff: time.Millisecond}}
+	calls := 0
+	sequence := func(errs ...error) func() error {
+		calls = 0
+		return func() error {
+			calls++
+			if calls <= len(errs) {
+				return errs[calls-1]
+			}
+			return nil
+		}
+	}
+	transient := &pq.Error{Code: "40P01"}
+
+	if err := kv.retry(context.Background(), "test", sequence(transient, transient)); err != nil || calls != 3 {
+		t.Errorf("two transient failures: %v after %d calls, want success after 3", err, calls)
+	}
+	if err := kv.retry(context.Background(), "test", sequence(transient, transient, transient)); err != transient || calls != 3 {
+		t.Errorf("three transient failures: %v after %d calls, want the error after 3", err, calls)
+	}
+	permanent := &pq.Error{Code: "23505"}
+	if err := kv.retry(context.Background(), "test", sequence(permanent)); err != permanent || calls != 1 {
+		t.Errorf("permanent failure: %v after %d calls, want no retry", err, calls)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := kv.retry(ctx, "test", sequence(transient)); err != transient || calls != 1 {
+		t.Errorf("canceled request: %v after %d calls, want no retry", err, calls)
+	}
+	kv.retryPolicy.budget = 0
+	if err := kv.retry(context.Background(), "test", sequence(transient)); err != transient || calls != 1 {
+		t.Errorf("exhausted budget: %v after %d calls, want no retry", err, calls)
+	}
+}
+
+func TestConnectionOptionsPoolerMode(t *testing.T) {
+	t.Setenv("DB_POOLER_MODE", "true")
+	t.Setenv("DB_STATEMENT_TIMEOUT", "5s")
+	t.Setenv("DB_MAX_OPEN_CONNS", "20")
+	opts := newConnectionOptions()
+	if opts.statementTimeout != 0 || opts.maxOpenConns != 20 {
+		t.Fatalf("pooler mode options %+v, want no statement timeout", opts)
+	}
+	got, err := opts.apply("postgres://migp@pgbouncer:6432/migp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(got, " binary_parameters=yes") || strings.Contains(got, "statement_timeout") {
+		t.Errorf("pooler mode connection string %q", got)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	dbConnections       = newGauge("migp_db_connections", "Connections of a database endpoint's pool by state.", "endpoint", "state")
+	dbMaxOpen           = newGauge("migp_db_max_open_connections", "Connection limit of a database endpoint's pool, 0 if unlimited.", "endpoint")
+	dbWaits             = newCounter("migp_db_wait_count_total", "Connections waited for because a database endpoint's pool was exhausted.", "endpoint")
+	dbWaitDuration      = newCounter("migp_db_wait_duration_seconds_total", "Time spent waiting for a connection from a database endpoint's pool.", "endpoint")
+	dbConnectionsClosed = newCounter("migp_db_connections_closed_total", "Pooled connections closed by the pool limits of a database endpoint by reason.", "endpoint", "reason")
+)
+
+// reportStats refreshes the pool metrics of every endpoint every interval.
+func (c *dbCluster) reportStats(interval time.Duration) {
+	c.recordStats()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.recordStats()
+	}
+}
+
+// recordStats copies the current pool statistics into the metrics.
+func (c *dbCluster) recordStats() {
+	for i, ep := range c.endpoints {
+		endpoint := strconv.Itoa(i)
+		stats := ep.db.Stats()
+		dbConnections.Set(float64(stats.OpenConnections), endpoint, "open")
+		dbConnections.Set(float64(stats.InUse), endpoint, "in_use")
+		dbConnections.Set(float64(stats.Idle), endpoint, "idle")
+		dbMaxOpen.Set(float64(stats.MaxOpenConnections), endpoint)
+		dbWaits.Set(float64(stats.WaitCount), endpoint)
+		dbWaitDuration.Set(stats.WaitDuration.Seconds(), endpoint)
+		dbConnectionsClosed.Set(float64(stats.MaxIdleClosed), endpoint, "max_idle")
+		dbConnectionsClosed.Set(float64(stats.MaxIdleTimeClosed), endpoint, "max_idle_time")
+		dbConnectionsClosed.Set(float64(stats.MaxLifetimeClosed), endpoint, "max_lifetime")
+	}
+}
+
+// poolStats is the JSON form of sql.DBStats served by /api/admin/db.
+type poolStats struct {
+	MaxOpenConnections int     `json:"maxOpenConnections"`
+	OpenConnections    int     `json:"openConnections"`
+	InUse              int     `json:"inUse"`
+	Idle               int     `json:"idle"`
+	WaitCount          int64   `json:"waitCount"`
+	WaitDuration       float64 `json:"waitDurationSeconds"`
+	MaxIdleClosed      int64   `json:"maxIdleClosed"`
+	MaxIdleTimeClosed  int64   `json:"maxIdleTimeClosed"`
+	MaxLifetimeClosed  int64   `json:"maxLifetimeClosed"`
+}
+
+// newPoolStats converts stats.
+func newPoolStats(stats sql.DBStats) poolStats {
+	return poolStats{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDuration:       stats.WaitDuration.Seconds(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	}
+}
+
+// endpointReport describes one database endpoint for /api/admin/db. The
+// server figures are only reported for the active endpoint, and count the
+// connections of every client of the database against its limit.
+type endpointReport struct {
+	Endpoint          int       `json:"endpoint"`
+	Active            bool      `json:"active"`
+	Pool              poolStats `json:"pool"`
+	MaxConnections    int       `json:"maxConnections,omitempty"`
+	ServerConnections int       `json:"serverConnections,omitempty"`
+}
+
+// handleAdminDB serves the connection pool statistics of every database
+// endpoint, and the connection limit and usage of the active database, to
+// size DB_MAX_OPEN_CONNS against it across instances.
+func (s *server) handleAdminDB(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	c := s.kv.cluster
+	active := int(c.active.Load())
+	reports := make([]endpointReport, len(c.endpoints))
+	for i, ep := range c.endpoints {
+		reports[i] = endpointReport{Endpoint: i, Active: i == active, Pool: newPoolStats(ep.db.Stats())}
+	}
+
+	query := `
+	SELECT current_setting('max_connections')::int,
+		(SELECT count(*) FROM pg_stat_activity WHERE datname = current_database())`
+	r := &reports[active]
+	if err := c.DB().QueryRowContext(req.Context(), query).Scan(&r.MaxConnections, &r.ServerConnections); err != nil {
+		storageError(w, "Reading connection limits", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"endpoints": reports})
+}
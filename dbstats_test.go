@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRecordStats(t *testing.T) {
+	t.Setenv("DB_MAX_OPEN_CONNS", "7")
+	t.Setenv("DB_CONN_MAX_LIFETIME", "1m")
+	c, err := detachedCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	opts := newConnectionOptions()
+	if opts.maxOpenConns != 7 || opts.connMaxLifetime != time.Minute {
+		t.Fatalf("pool options %+v", opts)
+	}
+	opts.configure(c.DB())
+	c.recordStats()
+	if limit, _, _, _ := dbMaxOpen.total(func(v []string) bool { return v[0] == "0" }); limit != 7 {
+		t.Errorf("recorded connection limit %g, want 7", limit)
+	}
+	if stats := newPoolStats(c.DB().Stats()); stats.MaxOpenConnections != 7 || stats.OpenConnections != 0 {
+		t.Errorf("pool stats %+v", stats)
+	}
+}
+
+func TestHandleAdminDB(t *testing.T) {
+	_, srv := newDBTestServer(t)
+	resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodGet, srv.URL+"/api/admin/db", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report struct {
+		Endpoints []endpointReport `json:"endpoints"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("database report answered %d: %v", resp.StatusCode, err)
+	}
+	if len(report.Endpoints) == 0 || !report.Endpoints[0].Active || report.Endpoints[0].MaxConnections == 0 || report.Endpoints[0].ServerConnections == 0 {
+		t.Errorf("database report %+v, want the active endpoint's limits", report.Endpoints)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The demo page runs the MIGP client in the browser as WebAssembly. The
+// client and the Go runtime glue it needs are build outputs of the toolchain
+// in use, so they are generated rather than checked in; until go generate has
+// been run the page says so instead of querying.
+//
+//go:generate sh -c "GOOS=js GOARCH=wasm go build -trimpath -ldflags=-s -o demo/static/migp.wasm ./demo/wasm"
+//go:generate sh -c "cp \"$(go env GOROOT)/lib/wasm/wasm_exec.js\" demo/static/"
+
+//go:embed demo/static
+var demoFiles embed.FS
+
+// demoCSP relaxes the default policy for the demo page: its scripts, styles
+// and WebAssembly client come from the server, and it only talks back to it.
+const demoCSP = "default-src 'none'; script-src 'self' 'wasm-unsafe-eval'; style-src 'self'; connect-src 'self'; " +
+	"img-src 'self'; form-action 'none'; base-uri 'none'; frame-ancestors 'none'"
+
+// newDemoHandler serves the demo page under /api/demo/, so that deployers can
+// check their corpus from a browser. The page fetches the public
+// configuration, then blinds and queries credentials with the WebAssembly
+// client like any other client would. It is disabled with DEMO_ENABLED=false.
+func newDemoHandler() http.HandlerFunc {
+	if !envBool("DEMO_ENABLED", true) {
+		return http.NotFound
+	}
+	return newStaticHandler(demoFiles, "demo/static", "/api/demo/", demoCSP)
+}
+
+// newStaticHandler serves the files under dir of fsys at the routes under
+// prefix, with the given Content-Security-Policy. The files are embedded in
+// the binary, so they may be cached for a few minutes.
+func newStaticHandler(fsys fs.FS, dir, prefix, csp string) http.HandlerFunc {
+	static, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	files := http.StripPrefix(prefix, http.FileServer(http.FS(static)))
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Security-Policy", csp)
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		files.ServeHTTP(w, req)
+	}
+}
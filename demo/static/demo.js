@@ -0,0 +1,57 @@
+// The demo page runs on the MIGP client in migp.wasm, which registers the
+// global migpQuery function once started.
+(async () => {
+  const form = document.getElementById("query");
+  const status = document.getElementById("status");
+  const metadata = document.getElementById("metadata");
+  const show = (text, kind) => {
+    status.textContent = text;
+    status.className = kind || "";
+  };
+
+  let config;
+  try {
+    const response = await fetch(new URL("../config", location.href));
+    if (!response.ok) {
+      throw new Error(`fetching the server configuration: status ${response.status}`);
+    }
+    config = await response.text();
+
+    const go = new Go();
+    const wasm = await fetch("migp.wasm");
+    if (wasm.status === 404) {
+      throw new Error("the WebAssembly client is not built; run go generate before building the server");
+    }
+    if (!wasm.ok) {
+      throw new Error(`fetching the WebAssembly client: status ${wasm.status}`);
+    }
+    const { instance } = await WebAssembly.instantiateStreaming(wasm, go.importObject);
+    go.run(instance);
+  } catch (err) {
+    show(`The demo is unavailable: ${err.message}`, "error");
+    return;
+  }
+  show("Ready.");
+  form.querySelector("button").disabled = false;
+
+  form.addEventListener("submit", async (event) => {
+    event.preventDefault();
+    const data = new FormData(form);
+    form.querySelector("button").disabled = true;
+    metadata.hidden = true;
+    show("Querying...");
+    try {
+      const result = await migpQuery(config, new URL("../query", location.href).href,
+        data.get("username"), data.get("password"));
+      show(`Result: ${result.status}.`, result.found ? "breached" : "");
+      if (result.metadata) {
+        metadata.textContent = result.metadata;
+        metadata.hidden = false;
+      }
+    } catch (err) {
+      show(`Query failed: ${err.message}`, "error");
+    } finally {
+      form.querySelector("button").disabled = false;
+    }
+  });
+})();
@@ -0,0 +1,57 @@
+//go:build js && wasm
+
+// Command wasm is the MIGP client of the demo page, compiled to WebAssembly by
+// go generate in the module root. It exposes a single function to the page,
+//
+//	migpQuery(configJSON, queryURL, username, password) Promise
+//
+// which blinds the credential, posts the query and resolves to an object with
+// the breach status, whether anything was found and the metadata. The
+// credential never leaves the browser in the clear.
+package main
+
+import (
+	"encoding/json"
+	"syscall/js"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func main() {
+	js.Global().Set("migpQuery", js.FuncOf(query))
+	select {}
+}
+
+// query implements migpQuery. The query blocks on the network, so it runs in
+// its own goroutine and settles the returned Promise when done.
+func query(this js.Value, args []js.Value) any {
+	if len(args) != 4 {
+		return js.Global().Get("Promise").Call("reject", js.Global().Get("Error").New("migpQuery takes 4 arguments"))
+	}
+	configJSON, target := args[0].String(), args[1].String()
+	username, password := []byte(args[2].String()), []byte(args[3].String())
+
+	executor := js.FuncOf(func(this js.Value, p []js.Value) any {
+		resolve, reject := p[0], p[1]
+		go func() {
+			var cfg migp.Config
+			if err := json.Unmarshal([]byte(configJSON), &cfg); err != nil {
+				reject.Invoke(js.Global().Get("Error").New("decoding the server configuration: " + err.Error()))
+				return
+			}
+			status, metadata, err := migp.Query(cfg, target, username, password)
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(map[string]any{
+				"status":   status.String(),
+				"found":    status != migp.NotInBreach,
+				"metadata": string(metadata),
+			})
+		}()
+		return nil
+	})
+	defer executor.Release()
+	return js.Global().Get("Promise").New(executor)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDemoHandler(t *testing.T) {
+	_, srv := newTestServer(t)
+	for _, tt := range []struct {
+		path, contains string
+	}{
+		{"/api/demo/", "<title>MIGP demo</title>"},
+		{"/api/demo/demo.js", "migp.wasm"},
+		{"/api/demo/demo.css", "{"},
+	} {
+		resp, err := http.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), tt.contains) {
+			t.Errorf("GET %s answered %d without %q", tt.path, resp.StatusCode, tt.contains)
+		}
+		if csp := resp.Header.Get("Content-Security-Policy"); csp != demoCSP {
+			t.Errorf("GET %s with policy %q, want the demo policy", tt.path, csp)
+		}
+	}
+	resp, err := http.Post(srv.URL+"/api/demo/", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST to the demo answered %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	t.Setenv("DEMO_ENABLED", "false")
+	rec := httptest.NewRecorder()
+	newDemoHandler()(rec, httptest.NewRequest(http.MethodGet, "/api/demo/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("disabled demo answered %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
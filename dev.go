@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// runDev implements the dev command, a local server needing neither
+// PostgreSQL nor a hand-built CONFIG_JSON. It generates a throwaway
+// configuration, keeps the buckets in memory, seeds a small synthetic corpus
+// and prints commands to try the server with. There is no metadata database,
+// so the journal, webhooks, honeytokens, feature flag overrides and the admin
+// routes built on them report errors, and everything is lost on exit.
+func runDev(args []string) error {
+	spec := defaultSeedSpec()
+	spec.Users, spec.MaxPasswordsPerUser = 20, 3
+	fs := flag.NewFlagSet("dev", flag.ExitOnError)
+	port := fs.Int("port", 8080, "local port to listen on")
+	fs.IntVar(&spec.Users, "users", spec.Users, "number of synthetic usernames to seed")
+	fs.Int64Var(&spec.Seed, "seed", spec.Seed, "seed for the synthetic corpus")
+	adminKey := fs.String("admin-key", "", "admin API key (default a random one)")
+	fs.Parse(args)
+	if err := spec.validate(); err != nil {
+		return err
+	}
+
+	if *adminKey == "" {
+		id, err := randomID()
+		if err != nil {
+			return err
+		}
+		*adminKey = id
+	}
+	cfg := migp.DefaultServerConfig()
+	configJSON, err := json.Marshal(&cfg)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "migp-dev-")
+	if err != nil {
+		return err
+	}
+	configFile := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(configFile, configJSON, 0o600); err != nil {
+		return err
+	}
+	for k, v := range map[string]string{
+		"CONFIG_JSON":            string(configJSON),
+		"STORAGE_BACKEND":        "memory",
+		"INGEST_JOURNAL_ENABLED": "false",
+		"ADMIN_API_KEY":          *adminKey,
+		"SEED_ENABLED":           "true",
+	} {
+		os.Setenv(k, v)
+	}
+
+	s, err := newServer(cfg)
+	if err != nil {
+		return err
+	}
+	s.detached = true
+	if err := s.ensureStorage(); err != nil {
+		return err
+	}
+	fmt.Printf("Seeding %d synthetic usernames, which takes a while with slow hashing...\n", spec.Users)
+	start := time.Now()
+	result := s.seed(spec, runtime.NumCPU(), nil)
+	fmt.Printf("Seeded %d synthetic credentials (%d entries) in %s\n",
+		result.Successes, result.Entries, time.Since(start).Round(time.Millisecond))
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *port))
+	if err != nil {
+		return err
+	}
+	srv := newHTTPServer(listener.Addr().String(), s.handler())
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Serve(listener) }()
+
+	base := "http://" + listener.Addr().String()
+	breached := spec.credentials()[0]
+	username, password, _ := splitCredential(breached)
+	queryFile := filepath.Join(dir, "query.json")
+	status, err := devQuery(cfg.Config, base, username, password, queryFile)
+	if err != nil {
+		return fmt.Errorf("querying the dev server: %w", err)
+	}
+
+	fmt.Printf(`
+MIGP dev server listening on %[1]s
+Throwaway configuration: %[2]s
+Admin API key:           %[3]s
+
+A query for the seeded credential %[4]q returned %[5]s.
+
+Try it:
+  curl -s %[1]s/api/config
+  curl -s -o /dev/null -w '%%{http_code} %%{size_download} bytes\n' -H 'Content-Type: application/json' --data-binary @%[6]s %[1]s/api/query
+  curl -s -H 'Authorization: Bearer %[3]s' %[1]s/api/metrics | grep migp_
+  curl -s -H 'Authorization: Bearer %[3]s' -H 'Content-Type: application/json' -d '{"users": 10, "seed": 2}' %[1]s/api/admin/seed
+
+Query the running server with the bench client:
+  CONFIG_JSON="$(cat %[2]s)" %[7]s bench -skip-ingest -n 0 -miss-ratio 1 -duration 5s -target %[1]s/api/query
+
+The query body in %[6]s is blinded for one use: the response cannot be
+decoded without the client state, which only the bench client keeps.
+`, base, configFile, *adminKey, breached, status, queryFile, os.Args[0])
+	return <-errs
+}
+
+// devQuery runs a MIGP client query for username and password against the
+// server at base, returning its breach status, and writes a fresh query body
+// to queryFile.
+func devQuery(cfg migp.Config, base string, username, password []byte, queryFile string) (migp.BreachStatus, error) {
+	client, err := migp.NewClient(cfg)
+	if err != nil {
+		return 0, err
+	}
+	request, ctx, err := client.Request(username, password)
+	if err != nil {
+		return 0, err
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return 0, err
+	}
+	status, err := queryStatus(&http.Client{Timeout: 30 * time.Second}, base+"/api/query", body, ctx, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	if request, _, err = client.Request(username, password); err != nil {
+		return 0, err
+	}
+	if body, err = json.Marshal(request); err != nil {
+		return 0, err
+	}
+	return status, os.WriteFile(queryFile, body, 0o600)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestDetachedCluster(t *testing.T) {
+	c, err := detachedCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.DB().Ping(); !errors.Is(err, errNoDatabase) {
+		t.Errorf("ping of a detached database: %v, want errNoDatabase", err)
+	}
+	if _, err := c.DB().Exec("SELECT 1"); !errors.Is(err, errNoDatabase) {
+		t.Errorf("query of a detached database: %v, want errNoDatabase", err)
+	}
+}
+
+func TestDevQuery(t *testing.T) {
+	s, srv := newTestServer(t)
+	spec := seedSpec{Users: 2, Distribution: "uniform", MaxPasswordsPerUser: 1, Seed: 5}
+	if result := s.seed(spec, 1, nil); result.Failures != 0 {
+		t.Fatalf("seed %+v", result)
+	}
+	cfg := s.suites[0].cfg.Config
+	username, password, _ := splitCredential(spec.credentials()[0])
+	queryFile := filepath.Join(t.TempDir(), "query.json")
+	status, err := devQuery(cfg, srv.URL, username, password, queryFile)
+	if err != nil || status != migp.InBreach {
+		t.Fatalf("query for a seeded credential: %s, %v, want %s", status, err, migp.InBreach)
+	}
+
+	// The written body is a fresh query the server answers.
+	body, err := os.ReadFile(queryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request migp.ClientRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		t.Fatalf("query file: %v", err)
+	}
+	resp, err := http.Post(srv.URL+"/api/query", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("query from the query file answered %d", resp.StatusCode)
+	}
+
+	if status, err := devQuery(cfg, srv.URL, []byte("nobody"), []byte("nothing"), queryFile); err != nil || status != migp.NotInBreach {
+		t.Errorf("query for an unseeded credential: %s, %v, want %s", status, err, migp.NotInBreach)
+	}
+}
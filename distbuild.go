@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// A distributed corpus build splits breach dumps into byte ranges,
+// partitions, that several build-corpus workers claim from a table in a
+// coordinator PostgreSQL database and build into an artifact each. Every
+// worker needs the dumps at the same paths, on shared storage, and the
+// CONFIG_JSON of the deployment. A worker holds a lease on the partition it
+// builds and renews it while it works; the partitions of a worker that goes
+// away are claimed again by the others once their lease lapses.
+//
+// The partition artifacts are written below the output directory of their
+// worker, and merge-corpus combines them into one artifact for
+// import-corpus.
+
+// corpusBuildDDL creates the tables of the coordinator database.
+const corpusBuildDDL = `
+	CREATE TABLE IF NOT EXISTS corpus_builds (
+		id TEXT PRIMARY KEY,
+		spec JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS corpus_build_partitions (
+		build_id TEXT NOT NULL REFERENCES corpus_builds (id) ON DELETE CASCADE,
+		part INT NOT NULL,
+		dump TEXT NOT NULL,
+		start_offset BIGINT NOT NULL,
+		end_offset BIGINT NOT NULL,
+		state TEXT NOT NULL DEFAULT 'pending',
+		worker TEXT,
+		lease_until TIMESTAMPTZ,
+		attempts INT NOT NULL DEFAULT 0,
+		artifact TEXT,
+		credentials BIGINT,
+		entries BIGINT,
+		error TEXT,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (build_id, part)
+	);`
+
+// maxPartitionAttempts bounds how often a partition is claimed before the
+// build gives up on it.
+const maxPartitionAttempts = 3
+
+// corpusBuildSpec is what every worker of a distributed build must agree
+// on: the dumps, how they are partitioned and the artifact parameters.
+type corpusBuildSpec struct {
+	Dumps                  []string `json:"dumps"`
+	PartitionSize          int64    `json:"partitionSize"`
+	Version                uint16   `json:"version"`
+	KeyFingerprint         string   `json:"keyFingerprint"`
+	Metadata               string   `json:"metadata"`
+	NumVariants            int      `json:"numVariants"`
+	IncludeUsernameVariant bool     `json:"includeUsernameVariant"`
+}
+
+// buildPartition is a byte range of a dump, from the first line starting at
+// or after Start to the last line starting before End.
+type buildPartition struct {
+	Part  int
+	Dump  string
+	Start int64
+	End   int64
+}
+
+// buildCoordinator claims partitions of one distributed build.
+type buildCoordinator struct {
+	db     *sql.DB
+	build  string
+	worker string
+	lease  time.Duration
+}
+
+// register creates the build with spec and its partitions unless another
+// worker did, in which case the specs must match.
+func (c *buildCoordinator) register(ctx context.Context, spec corpusBuildSpec) error {
+	if _, err := c.db.ExecContext(ctx, corpusBuildDDL); err != nil {
+		return err
+	}
+	body, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `INSERT INTO corpus_builds (id, spec) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING`, c.build, body)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		var recorded []byte
+		if err := tx.QueryRowContext(ctx, `SELECT spec FROM corpus_builds WHERE id = $1`, c.build).Scan(&recorded); err != nil {
+			return err
+		}
+		var other corpusBuildSpec
+		if err := json.Unmarshal(recorded, &other); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(other, spec) {
+			return fmt.Errorf("build %s was started with other dumps or parameters: %+v", c.build, other)
+		}
+		return nil
+	}
+
+	part := 0
+	for _, dump := range spec.Dumps {
+		info, err := os.Stat(dump)
+		if err != nil {
+			return err
+		}
+		for start := int64(0); start < info.Size(); start += spec.PartitionSize {
+			query := `INSERT INTO corpus_build_partitions (build_id, part, dump, start_offset, end_offset) VALUES ($1, $2, $3, $4, $5)`
+			if _, err := tx.ExecContext(ctx, query, c.build, part, dump, start, min(start+spec.PartitionSize, info.Size())); err != nil {
+				return err
+			}
+			part += 1
+		}
+	}
+	log.Printf("Registered build %s with %d partitions", c.build, part)
+	return tx.Commit()
+}
+
+// claim leases the next pending partition, or one whose lease lapsed, and
+// returns nil if there is none.
+func (c *buildCoordinator) claim(ctx context.Context) (*buildPartition, error) {
+	query := `
+	UPDATE corpus_build_partitions p SET
+		state = 'running', worker = $2, lease_until = now() + $3 * interval '1 second',
+		attempts = p.attempts + 1, error = NULL, updated_at = now()
+	FROM (
+		SELECT part FROM corpus_build_partitions
+		WHERE build_id = $1 AND attempts < $4
+			AND (state = 'pending' OR (state = 'running' AND lease_until < now()))
+		ORDER BY part LIMIT 1 FOR UPDATE SKIP LOCKED
+	) next
+	WHERE p.build_id = $1 AND p.part = next.part
+	RETURNING p.part, p.dump, p.start_offset, p.end_offset`
+	p := &buildPartition{}
+	err := c.db.QueryRowContext(ctx, query, c.build, c.worker, c.lease.Seconds(), maxPartitionAttempts).Scan(&p.Part, &p.Dump, &p.Start, &p.End)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// renew extends the lease on p until done is closed.
+func (c *buildCoordinator) renew(p *buildPartition, done <-chan struct{}) {
+	ticker := time.NewTicker(c.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			query := `
+			UPDATE corpus_build_partitions SET lease_until = now() + $4 * interval '1 second'
+			WHERE build_id = $1 AND part = $2 AND worker = $3 AND state = 'running'`
+			if _, err := c.db.Exec(query, c.build, p.Part, c.worker, c.lease.Seconds()); err != nil {
+				log.Printf("Renewing the lease on partition %d failed: %v", p.Part, err)
+			}
+		}
+	}
+}
+
+// finish records the outcome of building p into the artifact at artifact.
+func (c *buildCoordinator) finish(ctx context.Context, p *buildPartition, artifact string, m *corpusManifest, buildErr error) error {
+	if buildErr != nil {
+		query := `
+		UPDATE corpus_build_partitions SET state = 'pending', worker = NULL, lease_until = NULL, error = $4, updated_at = now()
+		WHERE build_id = $1 AND part = $2 AND worker = $3`
+		_, err := c.db.ExecContext(ctx, query, c.build, p.Part, c.worker, buildErr.Error())
+		return err
+	}
+	query := `
+	UPDATE corpus_build_partitions SET state = 'done', lease_until = NULL, artifact = $4, credentials = $5, entries = $6, updated_at = now()
+	WHERE build_id = $1 AND part = $2 AND worker = $3`
+	res, err := c.db.ExecContext(ctx, query, c.build, p.Part, c.worker, artifact, m.Credentials, m.Entries)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		// Another worker claimed the partition after the lease lapsed.
+		// Both artifacts hold the same entries, which import-corpus
+		// stores once.
+		log.Printf("Lost the lease on partition %d before finishing it", p.Part)
+	}
+	return nil
+}
+
+// buildProgress counts the partitions of a build by state, and those that
+// failed too often to be claimed again.
+type buildProgress struct {
+	Total, Pending, Running, Done, Exhausted int
+}
+
+// progress returns the progress of the build.
+func (c *buildCoordinator) progress(ctx context.Context) (buildProgress, error) {
+	var p buildProgress
+	query := `
+	SELECT count(*),
+		count(*) FILTER (WHERE state = 'pending' AND attempts < $2),
+		count(*) FILTER (WHERE state = 'running'),
+		count(*) FILTER (WHERE state = 'done'),
+		count(*) FILTER (WHERE state = 'pending' AND attempts >= $2)
+	FROM corpus_build_partitions WHERE build_id = $1`
+	err := c.db.QueryRowContext(ctx, query, c.build, maxPartitionAttempts).Scan(&p.Total, &p.Pending, &p.Running, &p.Done, &p.Exhausted)
+	return p, err
+}
+
+// readDumpRange sends the lines of the partition p to lines in slices of
+// journalBatchSize, and closes it.
+func readDumpRange(p *buildPartition, lines chan<- []string) error {
+	defer close(lines)
+	f, err := os.Open(p.Dump)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Start from the byte before the range, so that a line starting
+	// exactly at Start is not mistaken for the tail of the previous one.
+	pos := max(p.Start-1, 0)
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(f, 1<<16)
+	if p.Start > 0 {
+		skipped, err := r.ReadString('\n')
+		pos += int64(len(skipped))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	batch := make([]string, 0, journalBatchSize)
+	for pos < p.End {
+		line, err := r.ReadString('\n')
+		pos += int64(len(line))
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			batch = append(batch, line)
+		}
+		if len(batch) == journalBatchSize {
+			lines <- batch
+			batch = make([]string, 0, journalBatchSize)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.Dump, err)
+		}
+	}
+	if len(batch) > 0 {
+		lines <- batch
+	}
+	return nil
+}
+
+// runDistributedBuild works on the build of c until none of its partitions
+// is left to claim, building each into an artifact below out, and returns
+// the final progress.
+func runDistributedBuild(ctx context.Context, c *buildCoordinator, cs *cryptoSuite, template corpusManifest, workers int, out string) (buildProgress, error) {
+	for {
+		p, err := c.claim(ctx)
+		if err != nil {
+			return buildProgress{}, err
+		}
+		if p == nil {
+			progress, err := c.progress(ctx)
+			if err != nil || progress.Running == 0 {
+				return progress, err
+			}
+			// Wait for the other workers, whose partitions come back
+			// if they stop renewing their lease.
+			time.Sleep(min(c.lease, 10*time.Second))
+			continue
+		}
+
+		start := time.Now()
+		dir := filepath.Join(out, fmt.Sprintf("part-%05d", p.Part))
+		// A partition claimed again is rebuilt from scratch.
+		if err := os.RemoveAll(dir); err != nil {
+			return buildProgress{}, err
+		}
+		m := template
+		done := make(chan struct{})
+		go c.renew(p, done)
+		buildErr := buildArtifact(cs, func(lines chan<- []string) error { return readDumpRange(p, lines) }, workers, dir, &m)
+		close(done)
+		if err := c.finish(ctx, p, dir, &m, buildErr); err != nil {
+			return buildProgress{}, err
+		}
+		if buildErr != nil {
+			log.Printf("Building partition %d of %s failed: %v", p.Part, p.Dump, buildErr)
+			continue
+		}
+		log.Printf("Built partition %d of %s (%d credentials, %d entries) in %s",
+			p.Part, p.Dump, m.Credentials, m.Entries, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// runDistributedBuildCorpus is build-corpus with -coordinator set.
+func runDistributedBuildCorpus(dsn, build string, partitionSize int64, lease time.Duration, cs *cryptoSuite, m *corpusManifest, dumps []string, workers int, out string) error {
+	if build == "" {
+		return errors.New("-build is required with -coordinator")
+	}
+	if partitionSize < 1 || lease < time.Second {
+		return errors.New("-partition-size must be positive and -lease at least a second")
+	}
+	abs := make([]string, len(dumps))
+	for i, dump := range dumps {
+		var err error
+		if abs[i], err = filepath.Abs(dump); err != nil {
+			return err
+		}
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	hostname, _ := os.Hostname()
+	c := &buildCoordinator{db: db, build: build, worker: fmt.Sprintf("%s-%d", hostname, os.Getpid()), lease: lease}
+
+	ctx := context.Background()
+	spec := corpusBuildSpec{
+		Dumps:                  abs,
+		PartitionSize:          partitionSize,
+		Version:                m.Version,
+		KeyFingerprint:         m.KeyFingerprint,
+		Metadata:               m.Metadata,
+		NumVariants:            m.NumVariants,
+		IncludeUsernameVariant: m.IncludeUsernameVariant,
+	}
+	if err := c.register(ctx, spec); err != nil {
+		return err
+	}
+	start := time.Now()
+	progress, err := runDistributedBuild(ctx, c, cs, *m, workers, out)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Build %s: %d of %d partitions done after %s on this worker\n",
+		build, progress.Done, progress.Total, time.Since(start).Round(time.Millisecond))
+	if progress.Exhausted > 0 {
+		return fmt.Errorf("%d partitions failed %d times and were given up", progress.Exhausted, maxPartitionAttempts)
+	}
+	return nil
+}
+
+// mergeArtifacts combines the artifacts in dirs, which must have been built
+// for the same suite and parameters, into one artifact in out.
+func mergeArtifacts(out string, dirs []string) (*corpusManifest, error) {
+	var merged *corpusManifest
+	w, err := newArtifactWriter(out)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		m, err := readCorpusManifest(dir)
+		if err != nil {
+			w.abort()
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+		if merged == nil {
+			template := *m
+			template.Credentials, template.Malformed, template.Failures, template.Entries, template.Shards = 0, 0, 0, 0, nil
+			merged = &template
+		}
+		if m.Version != merged.Version || m.KeyFingerprint != merged.KeyFingerprint || m.BucketIDBitSize != merged.BucketIDBitSize ||
+			m.Metadata != merged.Metadata || m.NumVariants != merged.NumVariants || m.IncludeUsernameVariant != merged.IncludeUsernameVariant {
+			w.abort()
+			return nil, fmt.Errorf("%s was built for another suite or with other parameters", dir)
+		}
+		merged.Credentials += m.Credentials
+		merged.Malformed += m.Malformed
+		merged.Failures += m.Failures
+		merged.Entries += m.Entries
+		for _, shard := range m.Shards {
+			if err := w.copyShard(dir, shard); err != nil {
+				w.abort()
+				return nil, err
+			}
+		}
+	}
+	if merged == nil {
+		w.abort()
+		return nil, errors.New("no artifacts to merge")
+	}
+	if merged.Shards, err = w.close(); err != nil {
+		return nil, err
+	}
+	return merged, writeCorpusManifest(out, merged)
+}
+
+// copyShard appends the shard of the artifact in dir to the matching shard
+// of w, after verifying its checksum.
+func (w *artifactWriter) copyShard(dir string, shard artifactShard) error {
+	var i int
+	if _, err := fmt.Sscanf(shard.Name, "shard-%02x.bin", &i); err != nil || i < 0 || i >= len(w.files) {
+		return fmt.Errorf("%s: unexpected shard %s", dir, shard.Name)
+	}
+	contents, err := readShardFile(dir, shard)
+	if err != nil {
+		return err
+	}
+	if _, err := w.bufs[i].Write(contents); err != nil {
+		return err
+	}
+	w.shards[i].Entries += shard.Entries
+	w.shards[i].Bytes += int64(len(contents))
+	return nil
+}
+
+// runMergeCorpus implements the merge-corpus command, which combines the
+// partition artifacts of a distributed build into one.
+func runMergeCorpus(args []string) error {
+	fs := flag.NewFlagSet("merge-corpus", flag.ExitOnError)
+	out := fs.String("out", "", "directory to write the merged corpus artifact to")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: merge-corpus -out DIR ARTIFACT...")
+		fmt.Fprintln(fs.Output(), "An ARTIFACT holding no manifest.json is searched for part-* artifacts.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *out == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("an output directory and at least one artifact are required")
+	}
+	var dirs []string
+	for _, dir := range fs.Args() {
+		if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+			dirs = append(dirs, dir)
+			continue
+		}
+		parts, err := filepath.Glob(filepath.Join(dir, "part-*"))
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, parts...)
+	}
+	m, err := mergeArtifacts(*out, dirs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Merged %d artifacts (%d credentials, %d entries) into %s\n", len(dirs), m.Credentials, m.Entries, *out)
+	return nil
+}
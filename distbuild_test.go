@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadDumpRange(t *testing.T) {
+	var want []string
+	for i := 0; i < 40; i++ {
+		want = append(want, fmt.Sprintf("user%d@example.com:password%d", i, i*i))
+	}
+	// Line endings vary, and the last line has none.
+	dump := filepath.Join(t.TempDir(), "dump.txt")
+	contents := strings.Join(want[:20], "\n") + "\r\n" + strings.Join(want[20:], "\r\n")
+	if err := os.WriteFile(dump, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int64{1, 7, 31, 32, 100, int64(len(contents))} {
+		var got []string
+		for start := int64(0); start < int64(len(contents)); start += size {
+			lines := make(chan []string)
+			errs := make(chan error, 1)
+			p := &buildPartition{Dump: dump, Start: start, End: min(start+size, int64(len(contents)))}
+			go func() { errs <- readDumpRange(p, lines) }()
+			for batch := range lines {
+				got = append(got, batch...)
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("partitions of %d bytes read %d lines, want each of the %d once", size, len(got), len(want))
+		}
+	}
+}
+
+func TestMergeArtifacts(t *testing.T) {
+	s, _ := newTestServer(t)
+	setConfigJSON(t, s.suites[0])
+	build := func(dir string, metadata string, credentials ...string) {
+		cs, m, err := newCorpusBuild(0, metadata, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dump := writeDump(t, t.TempDir(), credentials...)
+		if err := buildArtifact(cs, func(lines chan<- []string) error { return readDumps([]string{dump}, lines) }, 1, dir, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	parts := t.TempDir()
+	a, b, other := filepath.Join(parts, "part-00000"), filepath.Join(parts, "part-00001"), filepath.Join(parts, "other")
+	build(a, "", "a@example.com:password1", "b@example.com:hunter2", "no separator")
+	build(b, "", "c@example.com:letmein", "d@example.com:123456")
+	build(other, "other metadata", "e@example.com:qwerty")
+
+	out := filepath.Join(t.TempDir(), "merged")
+	m, err := mergeArtifacts(out, []string{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Credentials != 4 || m.Malformed != 1 || m.Entries != 4 {
+		t.Fatalf("merged manifest %+v", m)
+	}
+	entries := 0
+	for _, shard := range m.Shards {
+		e, err := readArtifactShard(out, shard, s.suites[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries += len(e)
+	}
+	if entries != m.Entries {
+		t.Errorf("merged shards hold %d entries, want %d", entries, m.Entries)
+	}
+
+	if _, err := mergeArtifacts(filepath.Join(t.TempDir(), "mixed"), []string{a, other}); err == nil {
+		t.Error("artifacts built with other parameters merged")
+	}
+	if _, err := mergeArtifacts(filepath.Join(t.TempDir(), "empty"), nil); err == nil {
+		t.Error("merge of no artifacts succeeded")
+	}
+	if _, err := mergeArtifacts(out, []string{a}); err == nil {
+		t.Error("merge written over an existing artifact")
+	}
+}
+
+func TestDistributedBuild(t *testing.T) {
+	dsn := os.Getenv(testDatabaseEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDatabaseEnv)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s, _ := newTestServer(t)
+	setConfigJSON(t, s.suites[0])
+	cs, template, err := newCorpusBuild(0, "", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var credentials []string
+	for i := 0; i < 12; i++ {
+		credentials = append(credentials, fmt.Sprintf("%s%d@example.com:password%d", testName(t), i, i))
+	}
+	dump := writeDump(t, t.TempDir(), credentials...)
+	build := testName(t)
+	t.Cleanup(func() { db.Exec(`DELETE FROM corpus_builds WHERE id = $1`, build) })
+	spec := corpusBuildSpec{Dumps: []string{dump}, PartitionSize: 64, Version: template.Version, KeyFingerprint: template.KeyFingerprint}
+
+	// Two workers share the partitions.
+	out := t.TempDir()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		c := &buildCoordinator{db: db, build: build, worker: fmt.Sprintf("worker-%d", i), lease: time.Minute}
+		if err := c.register(context.Background(), spec); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			progress, err := runDistributedBuild(context.Background(), c, cs, *template, 1, out)
+			if err != nil || progress.Done != progress.Total || progress.Exhausted != 0 {
+				t.Errorf("%s ended with %+v, %v", c.worker, progress, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	parts, err := filepath.Glob(filepath.Join(out, "part-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mergeArtifacts(filepath.Join(t.TempDir(), "merged"), parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Credentials != len(credentials) || m.Malformed != 0 {
+		t.Errorf("merged build %+v, want %d credentials", m, len(credentials))
+	}
+
+	spec.PartitionSize *= 2
+	c := &buildCoordinator{db: db, build: build, worker: "late", lease: time.Minute}
+	if err := c.register(context.Background(), spec); err == nil {
+		t.Error("worker with another partition size joined the build")
+	}
+}
@@ -0,0 +1,260 @@
+//go:build e2e
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// TestE2E boots the server on a random port with a throwaway configuration,
+// ingests a fixture corpus through QueueIngest envelopes as the Functions
+// host does, and checks the responses to real MIGP client queries. It needs
+// the e2e build tag and PostgreSQL: the database of MIGP_TEST_DATABASE_URL,
+// whose buckets it writes to, or else an ephemeral container run with
+// docker:
+//
+//	go test -tags e2e -run TestE2E
+
+// e2eCredentials is the fixture corpus ingested by TestE2E.
+var e2eCredentials = []string{
+	"e2e-alice@example.com:correct horse battery staple",
+	"e2e-bob@example.com:hunter2",
+	"e2e-carol@example.com:Tr0ub4dor&3",
+}
+
+// e2eQueries are the queries of TestE2E and their expected status
+// against the fixture corpus, ingested with username variants.
+var e2eQueries = []struct {
+	username, password string
+	expected           migp.BreachStatus
+}{
+	{"e2e-alice@example.com", "correct horse battery staple", migp.InBreach},
+	{"e2e-bob@example.com", "hunter2", migp.InBreach},
+	{"e2e-bob@example.com", "an unrelated passphrase", migp.UsernameInBreach},
+	{"e2e-dave@example.com", "hunter2", migp.NotInBreach},
+}
+
+// e2eHarness is a server booted by TestE2E on a random local port.
+type e2eHarness struct {
+	baseURL string
+	client  *http.Client
+	config  migp.Config
+}
+
+// startPostgres runs an ephemeral PostgreSQL container from image, published
+// on a random local port, and returns its connection string once it accepts
+// connections. stop removes the container.
+func startPostgres(image string) (dsn string, stop func(), err error) {
+	out, err := exec.Command("docker", "run", "-d", "--rm",
+		"-e", "POSTGRES_USER=migp", "-e", "POSTGRES_PASSWORD=migp", "-e", "POSTGRES_DB=migp",
+		"-p", "127.0.0.1::5432", image).Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("starting PostgreSQL container: %w", err)
+	}
+	id := strings.TrimSpace(string(out))
+	stop = func() { exec.Command("docker", "rm", "-f", id).Run() }
+
+	out, err = exec.Command("docker", "port", id, "5432/tcp").Output()
+	if err != nil {
+		stop()
+		return "", nil, fmt.Errorf("reading PostgreSQL container port: %w", err)
+	}
+	addr := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	dsn = fmt.Sprintf("postgres://migp:migp@%s/migp?sslmode=disable", addr)
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		stop()
+		return "", nil, err
+	}
+	defer db.Close()
+	for deadline := time.Now().Add(time.Minute); ; time.Sleep(500 * time.Millisecond) {
+		if err = db.Ping(); err == nil {
+			return dsn, stop, nil
+		}
+		if time.Now().After(deadline) {
+			stop()
+			return "", nil, fmt.Errorf("waiting for PostgreSQL: %w", err)
+		}
+	}
+}
+
+// startE2EServer boots a server for cfg on a random local port, with storage
+// initialized.
+func startE2EServer(cfg migp.ServerConfig) (*e2eHarness, func(), error) {
+	s, err := newServer(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.ensureStorage(); err != nil {
+		return nil, nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	srv := newHTTPServer(listener.Addr().String(), s.handler())
+	go srv.Serve(listener)
+	h := &e2eHarness{
+		baseURL: "http://" + listener.Addr().String(),
+		client:  &http.Client{Timeout: 30 * time.Second},
+		config:  cfg.Config,
+	}
+	return h, func() { srv.Close() }, nil
+}
+
+// invoke posts a custom handler invocation of function with the given input
+// bindings, as the Functions host does, and returns the decoded response.
+func (h *e2eHarness) invoke(function string, data map[string]interface{}) (*invocationResponse, error) {
+	inv := map[string]interface{}{"Data": data, "Metadata": map[string]interface{}{}}
+	body, err := json.Marshal(inv)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client.Post(h.baseURL+"/"+function, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s invocation: status %d: %s", function, resp.StatusCode, bytes.TrimSpace(data))
+	}
+	var out invocationResponse
+	return &out, json.NewDecoder(resp.Body).Decode(&out)
+}
+
+// checkIngest ingests the fixture corpus through the queue trigger, twice to
+// check that replays add no entries.
+func (h *e2eHarness) checkIngest() error {
+	item, err := json.Marshal(ingestRequest{Credentials: e2eCredentials, Metadata: "e2e", NumVariants: 9, IncludeUsernameVariant: true})
+	if err != nil {
+		return err
+	}
+	for i, want := range []string{"Ingested 3 credentials", "Ingested 3 credentials (0 new entries)"} {
+		out, err := h.invoke("QueueIngest", map[string]interface{}{"item": string(item)})
+		if err != nil {
+			return err
+		}
+		logs := strings.Join(out.Logs, "\n")
+		if !strings.Contains(logs, want) {
+			return fmt.Errorf("ingestion #%d logged %q, want %q", i+1, logs, want)
+		}
+	}
+	return nil
+}
+
+// checkConfig fetches the public configuration.
+func (h *e2eHarness) checkConfig() error {
+	resp, err := h.client.Get(h.baseURL + "/api/config")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /api/config: status %d", resp.StatusCode)
+	}
+	var cfg migp.Config
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		return fmt.Errorf("GET /api/config: %w", err)
+	}
+	if cfg.BucketIDBitSize != h.config.BucketIDBitSize {
+		return fmt.Errorf("GET /api/config returned %d bucket ID bits, want %d", cfg.BucketIDBitSize, h.config.BucketIDBitSize)
+	}
+	return nil
+}
+
+// checkQueries runs MIGP client queries against the corpus, with and without
+// asking for chunked responses, and compares their statuses.
+func (h *e2eHarness) checkQueries() error {
+	client, err := migp.NewClient(h.config)
+	if err != nil {
+		return err
+	}
+	for _, chunkSize := range []int{0, minChunkSize} {
+		for _, q := range e2eQueries {
+			request, ctx, err := client.Request([]byte(q.username), []byte(q.password))
+			if err != nil {
+				return err
+			}
+			body, err := json.Marshal(request)
+			if err != nil {
+				return err
+			}
+			status, err := queryStatus(h.client, h.baseURL+"/api/query", body, ctx, chunkSize)
+			if err != nil {
+				return fmt.Errorf("querying %s: %w", q.username, err)
+			}
+			if status != q.expected {
+				return fmt.Errorf("querying %s returned %s, want %s", q.username, status, q.expected)
+			}
+		}
+	}
+	return nil
+}
+
+// checkMalformedQuery sends a query the server must reject.
+func (h *e2eHarness) checkMalformedQuery() error {
+	resp, err := h.client.Post(h.baseURL+"/api/query", "application/json", strings.NewReader(`{"bucketID": `))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("a malformed query returned status %d, want 400", resp.StatusCode)
+	}
+	return nil
+}
+
+func TestE2E(t *testing.T) {
+	dsn := os.Getenv(testDatabaseEnv)
+	if dsn == "" {
+		var stop func()
+		var err error
+		if dsn, stop, err = startPostgres("postgres:16-alpine"); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(stop)
+	}
+	t.Setenv("DB_CONNECTION_ST", dsn)
+	t.Setenv("STORAGE_BACKEND", "postgres")
+	// Ingest through QueueIngest envelopes as the Functions host does.
+	t.Setenv("FUNCTIONS_CUSTOMHANDLER_PORT", "0")
+	// Serve every bucket through the chunked response path when asked to.
+	t.Setenv("CHUNKED_RESPONSE_THRESHOLD", "0")
+
+	h, stop, err := startE2EServer(migp.DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+
+	for _, c := range []struct {
+		name string
+		run  func() error
+	}{
+		{"Config", h.checkConfig},
+		{"Ingest", h.checkIngest},
+		{"Queries", h.checkQueries},
+		{"MalformedQuery", h.checkMalformedQuery},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.run(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// Pre-encrypted ingestion stores bucket entries that were encrypted ahead of
+// time by a pipeline holding the MIGP configuration of a corpus, so that
+// bulk loads never hand plaintext credentials to this service. The entries
+// are stored as they are, so the pipeline must have encrypted them with the
+// key of the target suite; entries encrypted with any other key are never
+// matched by queries.
+
+// encryptedIngestRequest is a batch of pre-encrypted bucket entries. It is
+// recognized on the ingestion queue by its entries field. Version selects
+// the suite whose corpus is written and Tenant the tenant, as for
+// credentials, and Namespace is passwordNamespace to write the password
+// corpus instead. Generation is generationNext to write the next corpus of
+// the suite, see nextcorpus.go.
+type encryptedIngestRequest struct {
+	Version    uint16           `json:"version"`
+	Tenant     string           `json:"tenant,omitempty"`
+	Namespace  string           `json:"namespace,omitempty"`
+	Generation string           `json:"generation,omitempty"`
+	Entries    []encryptedEntry `json:"entries"`
+	Source     string           `json:"source,omitempty"`
+}
+
+// encryptedEntry is a bucket entry as produced by EncryptBucketEntry, with
+// the bucket it belongs in. BucketHash is the full 32-bit hash of the
+// username, or of the password in the password corpus; it places the entry
+// in the sub-buckets of a split bucket and implies the bucket ID, so either
+// may be omitted but not both.
+type encryptedEntry struct {
+	BucketID   string  `json:"bucketId,omitempty"`
+	BucketHash *uint32 `json:"bucketHash,omitempty"`
+	Value      []byte  `json:"value"`
+}
+
+// decodeEncryptedIngestRequest parses an encryptedIngestRequest, reporting
+// false if data is not one, so that the queue can carry every kind of
+// request.
+func decodeEncryptedIngestRequest(data []byte) (encryptedIngestRequest, bool, error) {
+	var req encryptedIngestRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.Entries == nil {
+		return req, false, nil
+	}
+	if len(req.Entries) == 0 {
+		return req, true, errors.New("encrypted ingest request has no entries")
+	}
+	return req, true, nil
+}
+
+// encryptedSuite returns the suite whose corpus req writes.
+func (s *server) encryptedSuite(req encryptedIngestRequest) (*cryptoSuite, error) {
+	switch req.Generation {
+	case "", generationCurrent:
+	case generationNext:
+		if req.Namespace != "" {
+			return nil, fmt.Errorf("namespace %q has no next corpus", req.Namespace)
+		}
+		req.Generation = ""
+		cs, err := s.encryptedSuite(req)
+		if err != nil {
+			return nil, err
+		}
+		return cs.next(), nil
+	default:
+		return nil, fmt.Errorf("unknown corpus generation %q", req.Generation)
+	}
+	if req.Tenant != "" && (s.tenants[req.Tenant] == nil || req.Namespace != "") {
+		return nil, fmt.Errorf("tenant %q has no corpus of its own in namespace %q", req.Tenant, req.Namespace)
+	}
+	switch req.Namespace {
+	case "":
+		suites := s.tenantSuites(req.Tenant)
+		if len(suites) == 0 {
+			return nil, fmt.Errorf("the key of tenant %q is unavailable", req.Tenant)
+		}
+		if req.Version == 0 {
+			return suites[0], nil
+		}
+		if cs := suiteIn(suites, req.Version); cs != nil {
+			return cs, nil
+		}
+		return nil, fmt.Errorf("unsupported MIGP version %d", req.Version)
+	case passwordNamespace:
+		if s.passwords == nil {
+			return nil, errors.New("the password namespace is not configured")
+		}
+		if req.Version != 0 && req.Version != s.passwords.cfg.Version {
+			return nil, fmt.Errorf("unsupported password corpus version %d", req.Version)
+		}
+		return s.passwords, nil
+	default:
+		return nil, fmt.Errorf("unknown namespace %q", req.Namespace)
+	}
+}
+
+// journalEntry validates e for the corpus of cs and returns it in the form
+// stored. The value must be exactly one well-formed bucket entry.
+func (e encryptedEntry) journalEntry(cs *cryptoSuite) (journalEntry, error) {
+	bits := cs.cfg.BucketIDBitSize
+	var bucketID uint32
+	switch {
+	case e.BucketHash != nil:
+		bucketID = *e.BucketHash >> (32 - bits)
+		if e.BucketID != "" && e.BucketID != migp.BucketIDToHex(bucketID) {
+			return journalEntry{}, fmt.Errorf("bucket ID %s does not match bucket hash %08x", e.BucketID, *e.BucketHash)
+		}
+	case e.BucketID != "":
+		id, err := strconv.ParseUint(e.BucketID, 16, 32)
+		if err != nil || len(e.BucketID) != 8 {
+			return journalEntry{}, fmt.Errorf("bucket ID %q is not 8 hex digits", e.BucketID)
+		}
+		if id>>bits != 0 {
+			return journalEntry{}, fmt.Errorf("bucket ID %s exceeds %d bits", e.BucketID, bits)
+		}
+		bucketID = uint32(id)
+	default:
+		return journalEntry{}, errors.New("entry has neither a bucket ID nor a bucket hash")
+	}
+	values, err := bucketEntries(e.Value)
+	if err != nil {
+		return journalEntry{}, err
+	}
+	if len(values) != 1 {
+		return journalEntry{}, fmt.Errorf("value holds %d bucket entries, not one", len(values))
+	}
+
+	entry := journalEntry{Key: cs.bucketKey(migp.BucketIDToHex(bucketID)), Value: e.Value}
+	if e.BucketHash != nil {
+		hash := int64(*e.BucketHash)
+		entry.BucketHash = &hash
+	}
+	return entry, nil
+}
+
+// ingestEncrypted stores every entry of req. Malformed entries are counted
+// and skipped; the others are journaled as one batch before any of them is
+// stored, as for credentials, and count as successes.
+func (s *server) ingestEncrypted(ctx context.Context, req encryptedIngestRequest) ingestResult {
+	var result ingestResult
+	cs, err := s.encryptedSuite(req)
+	if err != nil {
+		log.Println("Ingesting encrypted entries failed:", err)
+		result.Failures = len(req.Entries)
+		return result
+	}
+	batch := make([]journalEntry, 0, len(req.Entries))
+	for i, e := range req.Entries {
+		entry, err := e.journalEntry(cs)
+		if err != nil {
+			log.Printf("Encrypted entry %d is malformed: %v", i, err)
+			result.Malformed += 1
+			continue
+		}
+		batch = append(batch, entry)
+	}
+
+	enabled, err := s.registerSource(ctx, req.Source)
+	if err != nil {
+		log.Println("Registering ingestion source failed:", err)
+		result.Failures += len(batch)
+		return result
+	}
+	seq, err := s.journalSource(ctx, cs.cfg.Version, journalAppend, req.Source, batch)
+	if err != nil {
+		log.Println("Journaling encrypted batch failed:", err)
+		result.Failures += len(batch)
+		return result
+	}
+	if !enabled {
+		s.journalSkipped(ctx, seq)
+		result.Successes += len(batch)
+		return result
+	}
+	for i := 0; i < len(batch); i += journalBatchSize {
+		chunk := batch[i:min(i+journalBatchSize, len(batch))]
+		n, err := s.insert(ctx, chunk)
+		if err != nil {
+			log.Println("Inserting encrypted entries failed:", err)
+			result.Failures += len(chunk)
+			continue
+		}
+		result.Successes += len(chunk)
+		result.Entries += n
+	}
+	if result.Failures == 0 {
+		s.journalApplied(ctx, seq)
+	}
+	if result.Entries > 0 {
+		s.corpusChanged()
+	}
+	return result
+}
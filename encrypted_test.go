@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// encryptedTestEntry encrypts username and password for the corpus of cs as
+// a pipeline would.
+func encryptedTestEntry(t *testing.T, cs *cryptoSuite, username, password string) encryptedEntry {
+	t.Helper()
+	value, err := cs.server.EncryptBucketEntry([]byte(username), []byte(password), migp.MetadataBreachedPassword, []byte("offline"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := cs.bucketHash([]byte(username))
+	return encryptedEntry{BucketHash: &hash, Value: value}
+}
+
+func TestDecodeEncryptedIngestRequest(t *testing.T) {
+	for _, tt := range []struct {
+		data      string
+		ok, valid bool
+	}{
+		{`{"entries": [{"bucketId": "00000a1b", "value": "AA=="}]}`, true, true},
+		{`{"entries": []}`, true, false},
+		{`{"passwords": ["hunter2"]}`, false, true},
+		{`not json`, false, true},
+	} {
+		if _, ok, err := decodeEncryptedIngestRequest([]byte(tt.data)); ok != tt.ok || (err == nil) != tt.valid {
+			t.Errorf("decodeEncryptedIngestRequest(%s) = %v, %v, want %v, valid %v", tt.data, ok, err, tt.ok, tt.valid)
+		}
+	}
+}
+
+func TestEncryptedEntry(t *testing.T) {
+	s, _ := newTestServer(t)
+	cs := s.suites[0]
+	e := encryptedTestEntry(t, cs, "offline@example.com", "password1")
+	bucketID := migp.BucketIDToHex(*e.BucketHash >> (32 - cs.cfg.BucketIDBitSize))
+	other := *e.BucketHash ^ 1<<31
+	for _, tt := range []struct {
+		name  string
+		entry encryptedEntry
+		ok    bool
+	}{
+		{"bucket hash", e, true},
+		{"bucket ID", encryptedEntry{BucketID: bucketID, Value: e.Value}, true},
+		{"both", encryptedEntry{BucketID: bucketID, BucketHash: e.BucketHash, Value: e.Value}, true},
+		{"mismatched hash", encryptedEntry{BucketID: bucketID, BucketHash: &other, Value: e.Value}, false},
+		{"short bucket ID", encryptedEntry{BucketID: "a1b", Value: e.Value}, false},
+		{"oversized bucket ID", encryptedEntry{BucketID: "ffffffff", Value: e.Value}, false},
+		{"no bucket", encryptedEntry{Value: e.Value}, false},
+		{"two entries", encryptedEntry{BucketHash: e.BucketHash, Value: append(append([]byte{}, e.Value...), e.Value...)}, false},
+		{"truncated value", encryptedEntry{BucketHash: e.BucketHash, Value: e.Value[:len(e.Value)-1]}, false},
+	} {
+		entry, err := tt.entry.journalEntry(cs)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: journalEntry() = %v", tt.name, err)
+			continue
+		}
+		if tt.ok && entry.Key != cs.bucketKey(bucketID) {
+			t.Errorf("%s: entry stored under %q, want %q", tt.name, entry.Key, cs.bucketKey(bucketID))
+		}
+	}
+}
+
+func TestEncryptedSuite(t *testing.T) {
+	s, _ := newTestServer(t)
+	for _, tt := range []struct {
+		name string
+		req  encryptedIngestRequest
+		want *cryptoSuite
+	}{
+		{"current suite", encryptedIngestRequest{}, s.suites[0]},
+		{"version", encryptedIngestRequest{Version: s.suites[0].cfg.Version}, s.suites[0]},
+		{"unsupported version", encryptedIngestRequest{Version: 99}, nil},
+		{"unknown tenant", encryptedIngestRequest{Tenant: "nobody"}, nil},
+		{"unconfigured password namespace", encryptedIngestRequest{Namespace: passwordNamespace}, nil},
+		{"unknown namespace", encryptedIngestRequest{Namespace: "usernames"}, nil},
+		{"next password corpus", encryptedIngestRequest{Namespace: passwordNamespace, Generation: generationNext}, nil},
+		{"unknown generation", encryptedIngestRequest{Generation: "previous"}, nil},
+	} {
+		cs, err := s.encryptedSuite(tt.req)
+		if cs != tt.want || (err == nil) != (tt.want != nil) {
+			t.Errorf("%s: encryptedSuite() = %v, %v", tt.name, cs, err)
+		}
+	}
+}
+
+func TestIngestEncrypted(t *testing.T) {
+	t.Setenv("FUNCTIONS_CUSTOMHANDLER_PORT", "7071")
+	s, srv := newTestServer(t)
+	cs := s.suites[0]
+	e := encryptedTestEntry(t, cs, "offline@example.com", "password1")
+	req := encryptedIngestRequest{Entries: []encryptedEntry{e, {Value: e.Value}}}
+	if result := s.ingestEncrypted(context.Background(), req); result.Successes != 1 || result.Entries != 1 || result.Malformed != 1 {
+		t.Fatalf("encrypted ingestion %+v", result)
+	}
+
+	client, err := migp.NewClient(cs.cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, ctx, err := client.Request([]byte("offline@example.com"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(request)
+	if status, err := queryStatus(http.DefaultClient, srv.URL+"/api/query", body, ctx, 0); err != nil || status != migp.InBreach {
+		t.Fatalf("query for the encrypted credential: %s, %v, want %s", status, err, migp.InBreach)
+	}
+
+	// Replaying the batch from the queue stores nothing new.
+	batch, _ := json.Marshal(encryptedIngestRequest{Entries: []encryptedEntry{e}})
+	item, _ := json.Marshal(string(batch))
+	if status, resp := invoke(t, s.handler(), "QueueIngest", `{"item": `+string(item)+`}`); status != http.StatusOK || len(resp.Logs) != 1 || !strings.HasPrefix(resp.Logs[0], "Ingested 1 encrypted entries (0 new entries)") {
+		t.Errorf("QueueIngest of encrypted entries answered %d with %+v", status, resp)
+	}
+}
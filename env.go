@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envBool returns the boolean value of the named environment variable, or def
+// if it is unset or invalid.
+func envBool(name string, def bool) bool {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Printf("Invalid %s value %q. Using %t.", name, val, def)
+		return def
+	}
+	return b
+}
+
+// envDuration returns the duration value of the named environment variable,
+// such as "250ms" or "5s", or def if it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		log.Printf("Invalid %s value %q. Using %s.", name, val, def)
+		return def
+	}
+	return d
+}
+
+// envInt returns the integer value of the named environment variable, or def
+// if it is unset or invalid.
+func envInt(name string, def int) int {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		log.Printf("Invalid %s value %q. Using %d.", name, val, def)
+		return def
+	}
+	return i
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// invocationRequest is the JSON envelope the Functions host posts to
+// /{functionName} for every invocation that is not forwarded as a raw HTTP
+// request. Data holds one entry per input binding, keyed by binding name.
+type invocationRequest struct {
+	Data     map[string]json.RawMessage `json:"Data"`
+	Metadata map[string]json.RawMessage `json:"Metadata"`
+}
+
+// invocationResponse is the JSON envelope returned to the Functions host.
+// Outputs holds one entry per output binding, keyed by binding name.
+type invocationResponse struct {
+	Outputs     map[string]interface{} `json:"Outputs"`
+	Logs        []string               `json:"Logs"`
+	ReturnValue interface{}            `json:"ReturnValue"`
+}
+
+// httpTriggerData is the envelope representation of an HTTP trigger input.
+type httpTriggerData struct {
+	URL     string              `json:"Url"`
+	Method  string              `json:"Method"`
+	Query   map[string]string   `json:"Query"`
+	Headers map[string][]string `json:"Headers"`
+	Params  map[string]string   `json:"Params"`
+	Body    json.RawMessage     `json:"Body"`
+}
+
+// httpOutputData is the envelope representation of an HTTP output binding.
+// A header value is a string, or a list of strings for a header sent once
+// per value.
+type httpOutputData struct {
+	StatusCode string                 `json:"statusCode"`
+	Headers    map[string]interface{} `json:"headers"`
+	Body       string                 `json:"body"`
+}
+
+// newInvocationResponse returns an empty invocationResponse.
+func newInvocationResponse() *invocationResponse {
+	return &invocationResponse{
+		Outputs: make(map[string]interface{}),
+		Logs:    []string{},
+	}
+}
+
+// Log appends a message to the invocation logs shown by the Functions host.
+func (r *invocationResponse) Log(msg string) {
+	r.Logs = append(r.Logs, msg)
+}
+
+// decodeInvocation reads an invocationRequest from the body of a host request.
+func decodeInvocation(body io.Reader) (*invocationRequest, error) {
+	var inv invocationRequest
+	if err := json.NewDecoder(body).Decode(&inv); err != nil {
+		return nil, err
+	}
+	if inv.Data == nil {
+		return nil, errors.New("invocation has no Data")
+	}
+	return &inv, nil
+}
+
+// bindingString decodes the named input binding as a string. Queue messages
+// and blob contents arrive as JSON strings; anything else is returned as raw
+// JSON text.
+func (inv *invocationRequest) bindingString(name string) (string, error) {
+	raw, ok := inv.Data[name]
+	if !ok {
+		return "", errors.New("invocation has no binding named " + name)
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	return string(raw), nil
+}
+
+// httpRequest rebuilds the HTTP request carried in the named trigger binding.
+func (inv *invocationRequest) httpRequest(name string) (*http.Request, error) {
+	raw, ok := inv.Data[name]
+	if !ok {
+		return nil, errors.New("invocation has no binding named " + name)
+	}
+	var data httpTriggerData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+
+	target, err := url.Parse(data.URL)
+	if err != nil {
+		return nil, err
+	}
+	if len(data.Query) > 0 {
+		q := target.Query()
+		for k, v := range data.Query {
+			q.Set(k, v)
+		}
+		target.RawQuery = q.Encode()
+	}
+
+	// The host passes text bodies as JSON strings and JSON bodies as
+	// already-decoded values.
+	var body []byte
+	var s string
+	if err := json.Unmarshal(data.Body, &s); err == nil {
+		body = []byte(s)
+	} else if len(data.Body) > 0 && string(data.Body) != "null" {
+		body = data.Body
+	}
+
+	req, err := http.NewRequest(data.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, values := range data.Headers {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	return req, nil
+}
+
+// bufferedResponse is an http.ResponseWriter that captures a response so it
+// can be returned through an HTTP output binding.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   *bytes.Buffer
+}
+
+// newBufferedResponse returns an empty bufferedResponse.
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), body: getBuffer()}
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// output converts the captured response into an HTTP output binding. The
+// envelope can only carry text, so binary bodies (such as MIGP query
+// responses) are base64 encoded and flagged with Content-Transfer-Encoding.
+// Repeated headers keep every value: Set-Cookie values cannot be combined,
+// so they are listed, and the values of any other header are joined as a
+// comma-separated list, which HTTP defines to mean the same.
+func (b *bufferedResponse) output() httpOutputData {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	out := httpOutputData{
+		StatusCode: strconv.Itoa(b.status),
+		Headers:    make(map[string]interface{}),
+		Body:       b.body.String(),
+	}
+	for k, values := range b.header {
+		switch {
+		case len(values) == 1:
+			out.Headers[k] = values[0]
+		case k == "Set-Cookie":
+			out.Headers[k] = values
+		case len(values) > 1:
+			out.Headers[k] = strings.Join(values, ", ")
+		}
+	}
+	if !utf8.Valid(b.body.Bytes()) {
+		out.Body = base64.StdEncoding.EncodeToString(b.body.Bytes())
+		out.Headers["Content-Transfer-Encoding"] = "base64"
+	}
+	return out
+}
+
+// httpInvocation returns an invocationFunc for HTTP-triggered functions that
+// serves the embedded request through h as if it had been forwarded directly.
+// trigger and output name the bindings declared in the function's
+// function.json.
+func httpInvocation(h http.Handler, trigger, output string) invocationFunc {
+	return func(ctx context.Context, inv *invocationRequest, resp *invocationResponse) error {
+		req, err := inv.httpRequest(trigger)
+		if err != nil {
+			return err
+		}
+
+		rec := newBufferedResponse()
+		defer putBuffer(rec.body)
+		h.ServeHTTP(rec, req.WithContext(ctx))
+		resp.Outputs[output] = rec.output()
+		return nil
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBufferedResponseOutputHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		values []string
+		want   interface{}
+	}{
+		{"single", "Content-Type", []string{"application/json"}, "application/json"},
+		{"joined", "Vary", []string{"Accept", "Accept-Encoding"}, "Accept, Accept-Encoding"},
+		{"cookies", "Set-Cookie", []string{"a=1", "b=2"}, []string{"a=1", "b=2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := newBufferedResponse()
+			defer putBuffer(rec.body)
+			for _, v := range tt.values {
+				rec.Header().Add(tt.header, v)
+			}
+			rec.Write([]byte("ok"))
+			out := rec.output()
+			if got := out.Headers[tt.header]; !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("%s = %#v, want %#v", tt.header, got, tt.want)
+			}
+			if out.StatusCode != "200" || out.Body != "ok" {
+				t.Fatalf("output %+v, want a 200 with the body", out)
+			}
+		})
+	}
+}
+
+func TestHTTPInvocation(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		w.Header().Set("X-Method", req.Method)
+		w.Header().Set("X-Query", req.URL.Query().Get("generation"))
+		w.Header().Set("X-Auth", req.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(body)
+	})
+	tests := []struct {
+		name     string
+		body     string
+		wantBody string
+	}{
+		{"text", `"plain text"`, "plain text"},
+		{"json", `{"a":1}`, `{"a":1}`},
+		{"none", `null`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope := `{"Data":{"req":{"Url":"http://localhost/api/query","Method":"POST",` +
+				`"Query":{"generation":"next"},"Headers":{"Authorization":["Bearer key"]},"Body":` + tt.body + `}},"Metadata":{}}`
+			inv, err := decodeInvocation(strings.NewReader(envelope))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := newInvocationResponse()
+			if err := httpInvocation(echo, "req", "res")(context.Background(), inv, resp); err != nil {
+				t.Fatal(err)
+			}
+			out := resp.Outputs["res"].(httpOutputData)
+			if out.StatusCode != "202" || out.Headers["X-Method"] != "POST" || out.Headers["X-Query"] != "next" || out.Headers["X-Auth"] != "Bearer key" {
+				t.Fatalf("output %+v does not reflect the request", out)
+			}
+			if out.Body != tt.wantBody {
+				t.Fatalf("body %q, want %q", out.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestBufferedResponseBinaryBody(t *testing.T) {
+	rec := newBufferedResponse()
+	defer putBuffer(rec.body)
+	rec.Write([]byte{0xff, 0x00, 0xfe})
+	out := rec.output()
+	if out.Headers["Content-Transfer-Encoding"] != "base64" || out.Body != base64.StdEncoding.EncodeToString([]byte{0xff, 0x00, 0xfe}) {
+		t.Fatalf("binary body output %+v, want base64", out)
+	}
+}
+
+func TestDecodeInvocation(t *testing.T) {
+	for _, body := range []string{`{"Metadata":{}}`, `{"Data":`, `[]`} {
+		if _, err := decodeInvocation(strings.NewReader(body)); err == nil {
+			t.Errorf("invocation %s decoded", body)
+		}
+	}
+	inv, err := decodeInvocation(strings.NewReader(`{"Data":{"item":"{\"a\":1}","raw":{"a":1}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"item": `{"a":1}`, "raw": `{"a":1}`} {
+		if got, err := inv.bindingString(name); err != nil || got != want {
+			t.Errorf("binding %s = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := inv.bindingString("missing"); err == nil {
+		t.Error("missing binding decoded")
+	}
+}
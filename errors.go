@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// Error codes of the JSON error envelope. They are part of the API and must
+// not change meaning; clients branch on them rather than on status text.
+const (
+	// errInvalidRequest: the request is malformed. Do not retry it as is.
+	errInvalidRequest = "invalid_request"
+	// errUnsupportedVersion: the MIGP version is not served. Refetch
+	// /api/config and retry with a supported version.
+	errUnsupportedVersion = "unsupported_version"
+	// errUnauthorized: the admin key is missing or wrong.
+	errUnauthorized = "unauthorized"
+	// errForbidden: the operation is not allowed in this deployment.
+	errForbidden = "forbidden"
+	// errFeatureDisabled: the route is behind a feature flag that is off.
+	errFeatureDisabled = "feature_disabled"
+	// errNotFound: the resource does not exist.
+	errNotFound = "not_found"
+	// errMethodNotAllowed: the route does not accept the method.
+	errMethodNotAllowed = "method_not_allowed"
+	// errUnsupportedMediaType: the request body is not in a format the
+	// route accepts. Send it as application/json.
+	errUnsupportedMediaType = "unsupported_media_type"
+	// errConflict: the request conflicts with the current state of the
+	// resource.
+	errConflict = "conflict"
+	// errOverloaded: the query was shed under load. Retry after the
+	// Retry-After delay.
+	errOverloaded = "overloaded"
+	// errRateLimited: the caller sent more queries than its rate limit
+	// allows. Retry after the Retry-After delay.
+	errRateLimited = "rate_limited"
+	// errUnavailable: a dependency such as the database is unavailable.
+	errUnavailable = "unavailable"
+	// errReadOnly: corpus writes are paused, usually for a backup. Retry
+	// after the Retry-After delay.
+	errReadOnly = "read_only"
+	// errTimeout: the request ran out of its timeout budget.
+	errTimeout = "timeout"
+	// errInternal: an unexpected server error.
+	errInternal = "internal"
+)
+
+// errorEnvelope is the body of every error response on /api routes, served
+// as application/json:
+//
+//	{"code": "unsupported_version", "message": "unsupported version",
+//	 "requestId": "…", "retryable": false}
+//
+// Message is human readable and may change. RequestID matches the
+// X-Request-ID response header and identifies the request in server logs.
+// Responses with status 429 or 503 always carry Retry-After, by default
+// defaultRetryAfter.
+type errorEnvelope struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+	Retryable bool   `json:"retryable"`
+}
+
+// statusCodes maps status codes to the error code used when a handler does
+// not name a more specific one.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:           errInvalidRequest,
+	http.StatusUnauthorized:         errUnauthorized,
+	http.StatusForbidden:            errForbidden,
+	http.StatusNotFound:             errNotFound,
+	http.StatusMethodNotAllowed:     errMethodNotAllowed,
+	http.StatusUnsupportedMediaType: errUnsupportedMediaType,
+	http.StatusConflict:             errConflict,
+	http.StatusTooManyRequests:      errRateLimited,
+	http.StatusServiceUnavailable:   errUnavailable,
+	http.StatusGatewayTimeout:       errTimeout,
+	http.StatusInternalServerError:  errInternal,
+}
+
+// retryableCodes lists the error codes for which retrying the same request
+// may succeed.
+var retryableCodes = map[string]bool{
+	errOverloaded:            true,
+	errRateLimited:           true,
+	errUnavailable:           true,
+	errReadOnly:              true,
+	errTimeout:               true,
+	errIdempotencyInProgress: true,
+	errInternal:              true,
+}
+
+// writeError writes an error envelope with the code for status. It replaces
+// http.Error on API routes.
+func writeError(w http.ResponseWriter, message string, status int) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = errInternal
+	}
+	writeErrorCode(w, code, message, status)
+}
+
+// defaultRetryAfter is the Retry-After delay, in seconds, of 429 and 503
+// responses whose handler does not know a better one.
+const defaultRetryAfter = "5"
+
+// writeErrorCode writes an error envelope with a specific code.
+func writeErrorCode(w http.ResponseWriter, code, message string, status int) {
+	body, err := json.Marshal(errorEnvelope{
+		Code:      code,
+		Message:   message,
+		RequestID: w.Header().Get("X-Request-ID"),
+		Retryable: retryableCodes[code],
+	})
+	if err != nil {
+		log.Println("Error serialization failed:", err)
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable) && h.Get("Retry-After") == "" {
+		h.Set("Retry-After", defaultRetryAfter)
+	}
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// requestIDPattern accepts caller-provided request IDs that are safe to echo
+// and log.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// withRequestID assigns every request an ID, taken from its X-Request-ID
+// header when valid and generated otherwise, and returns it in the
+// X-Request-ID response header.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			var err error
+			if id, err = randomID(); err != nil {
+				log.Println("Request ID generation failed:", err)
+				id = ""
+			}
+		}
+		if id != "" {
+			w.Header().Set("X-Request-ID", id)
+		}
+		h.ServeHTTP(w, req)
+	})
+}
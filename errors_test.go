@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	for _, tt := range []struct {
+		status     int
+		code       string
+		retryable  bool
+		retryAfter string
+	}{
+		{http.StatusBadRequest, errInvalidRequest, false, ""},
+		{http.StatusServiceUnavailable, errUnavailable, true, defaultRetryAfter},
+		{http.StatusTooManyRequests, errRateLimited, true, defaultRetryAfter},
+		{http.StatusTeapot, errInternal, true, ""},
+	} {
+		rec := httptest.NewRecorder()
+		rec.Header().Set("X-Request-ID", "req-1")
+		rec.Header().Set("Content-Length", "3")
+		writeError(rec, "message", tt.status)
+		var env errorEnvelope
+		if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil {
+			t.Fatal(err)
+		}
+		want := errorEnvelope{Code: tt.code, Message: "message", RequestID: "req-1", Retryable: tt.retryable}
+		if rec.Code != tt.status || env != want || rec.Header().Get("Content-Type") != "application/json" || rec.Header().Get("Content-Length") != "" {
+			t.Errorf("status %d: answered %d with %+v and headers %v, want %+v", tt.status, rec.Code, env, rec.Header(), want)
+		}
+		if got := rec.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("status %d: Retry-After %q, want %q", tt.status, got, tt.retryAfter)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Retry-After", "30")
+	writeErrorCode(rec, errReadOnly, "read only", http.StatusServiceUnavailable)
+	if rec.Header().Get("Retry-After") != "30" || !strings.Contains(rec.Body.String(), `"code":"read_only"`) {
+		t.Errorf("specific error answered %q with Retry-After %q", rec.Body, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	var seen string
+	h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = w.Header().Get("X-Request-ID")
+	}))
+	for _, tt := range []struct {
+		header string
+		echoed bool
+	}{
+		{"client-id:42", true},
+		{"", false},
+		{"bad id\n", false},
+		{strings.Repeat("a", 129), false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/config", nil)
+		req.Header.Set("X-Request-ID", tt.header)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		got := rec.Header().Get("X-Request-ID")
+		if got == "" || got != seen || (got == tt.header) != tt.echoed {
+			t.Errorf("request ID %q answered with %q", tt.header, got)
+		}
+	}
+}
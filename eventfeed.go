@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /api/admin/events follows the events the instance publishes, the job
+// updates, corpus changes and alerts also sent to Event Grid and webhooks,
+// without any of them configured. With stream=true, or when it accepts
+// text/event-stream, a caller gets the recent events and then every new one
+// as it is published: as Server-Sent Events named after the event type and
+// with the event ID, or as JSON lines. Otherwise, as for callers the
+// Functions host wraps in an invocation envelope, it gets the recent events
+// as JSON and polls again with the last ID it saw. Either way, the events
+// after the Last-Event-ID header or the after query parameter are returned,
+// and the types query parameter keeps only the comma-separated event types,
+// or type prefixes such as MIGP.Job.
+
+// eventFeed keeps the recent events of the instance and hands new ones to
+// the streams following them.
+type eventFeed struct {
+	mu      sync.Mutex
+	backlog int
+	recent  []event
+	streams map[chan event]struct{}
+}
+
+// eventFeedBuffer is the number of events a stream may fall behind by
+// before it is closed. Its client reconnects and resumes from the recent
+// events.
+const eventFeedBuffer = 64
+
+// newEventFeed returns a feed keeping the last EVENT_FEED_BACKLOG (default
+// 256) events.
+func newEventFeed() *eventFeed {
+	return &eventFeed{backlog: envInt("EVENT_FEED_BACKLOG", 256), streams: map[chan event]struct{}{}}
+}
+
+// publish records ev and hands it to every stream.
+func (f *eventFeed) publish(ev event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.backlog > 0 {
+		if len(f.recent) >= f.backlog {
+			f.recent = append(f.recent[:0], f.recent[len(f.recent)-f.backlog+1:]...)
+		}
+		f.recent = append(f.recent, ev)
+	}
+	for ch := range f.streams {
+		select {
+		case ch <- ev:
+		default:
+			delete(f.streams, ch)
+			close(ch)
+		}
+	}
+}
+
+// since returns the recent events after the one with ID after, or every
+// recent event if after is empty or no longer recent.
+func (f *eventFeed) since(after string) []event {
+	for i := len(f.recent) - 1; i >= 0 && after != ""; i-- {
+		if f.recent[i].ID == after {
+			return append([]event{}, f.recent[i+1:]...)
+		}
+	}
+	return append([]event{}, f.recent...)
+}
+
+// follow returns the recent events after the one with ID after, a channel
+// receiving the events published from then on, and the function to call
+// once the caller stops following. The channel is closed if the caller
+// falls behind.
+func (f *eventFeed) follow(after string) ([]event, <-chan event, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan event, eventFeedBuffer)
+	f.streams[ch] = struct{}{}
+	stop := func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.streams[ch]; ok {
+			delete(f.streams, ch)
+			close(ch)
+		}
+	}
+	return f.since(after), ch, stop
+}
+
+// eventFilter reports whether an event type was asked for by the types
+// query parameter.
+func eventFilter(types string) func(eventType string) bool {
+	var patterns []string
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			patterns = append(patterns, t)
+		}
+	}
+	return func(eventType string) bool {
+		if len(patterns) == 0 {
+			return true
+		}
+		for _, p := range patterns {
+			if eventType == p || strings.HasPrefix(eventType, strings.TrimSuffix(p, ".")+".") {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// handleEvents serves the events of the instance, see above.
+func (s *server) handleEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	after := req.Header.Get("Last-Event-ID")
+	if after == "" {
+		after = q.Get("after")
+	}
+	wanted := eventFilter(q.Get("types"))
+	feed := s.events.feed
+
+	streaming := streamRequested(req) || strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+	if !streaming || !canStream(w) {
+		feed.mu.Lock()
+		recent := feed.since(after)
+		feed.mu.Unlock()
+		events := []event{}
+		for _, ev := range recent {
+			if wanted(ev.EventType) {
+				events = append(events, ev)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"events": events})
+		return
+	}
+
+	recent, updates, stop := feed.follow(after)
+	defer stop()
+	// Like job streams, the feed outlives the timeout budget of the route
+	// and ends when the client goes away.
+	ctx := requestContext(req)
+	st := newEventStream(w, req, http.StatusOK)
+	for _, ev := range recent {
+		if wanted(ev.EventType) && st.send(ev.EventType, ev.ID, ev) != nil {
+			return
+		}
+	}
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-updates:
+			if !ok {
+				return
+			}
+			if wanted(ev.EventType) && st.send(ev.EventType, ev.ID, ev) != nil {
+				return
+			}
+		case <-ticker.C:
+			if st.keepAlive() != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// readEvent reads the next Server-Sent Event from r, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (name, id string, ev event) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && name != "":
+			return name, id, ev
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+				t.Fatalf("decoding event data %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func TestEventFeedStream(t *testing.T) {
+	s, srv := newTestServer(t)
+	s.events.Publish(eventSnapshotPublished, "migp/snapshots", map[string]interface{}{"generation": 1})
+	s.events.Publish(eventJobStarted, "migp/jobs/feed", map[string]interface{}{"jobId": "feed"})
+
+	req := adminRequest(t, http.MethodGet, srv.URL+"/api/admin/events?types=MIGP.Job", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q, want text/event-stream", ct)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	name, id, ev := readEvent(t, r)
+	if name != eventJobStarted || ev.Subject != "migp/jobs/feed" || id != ev.ID {
+		t.Fatalf("first event %s %s %+v, want the recent job start", name, id, ev)
+	}
+	s.events.Publish(eventGenerationSwitched, "migp/corpus", map[string]interface{}{"generation": 2})
+	s.events.Publish(eventJobCompleted, "migp/jobs/feed", map[string]interface{}{"jobId": "feed"})
+	if name, _, ev = readEvent(t, r); name != eventJobCompleted || ev.Subject != "migp/jobs/feed" {
+		t.Fatalf("next event %s %+v, want the job completion only", name, ev)
+	}
+}
+
+func TestEventFeedPoll(t *testing.T) {
+	s, srv := newTestServer(t)
+	for _, subject := range []string{"a", "b", "c"} {
+		s.events.Publish(eventSnapshotPublished, subject, nil)
+	}
+	list := func(query string) []event {
+		resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodGet, srv.URL+"/api/admin/events"+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Events []event `json:"events"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Events
+	}
+	all := list("")
+	if len(all) != 3 || all[0].Subject != "a" || all[2].Subject != "c" {
+		t.Fatalf("events %+v, want the three published, oldest first", all)
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"after", "?after=" + all[0].ID, 2},
+		{"after the last", "?after=" + all[2].ID, 0},
+		{"unknown after", "?after=gone", 3},
+		{"other types", "?types=MIGP.Job", 0},
+		{"exact type", "?types=" + eventSnapshotPublished, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := list(tt.query); len(got) != tt.want {
+				t.Fatalf("got %d events, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// Corpus-change event types published to Event Grid and webhook subscribers.
+const (
+	eventIngestionCompleted = "MIGP.Corpus.IngestionCompleted"
+	eventGenerationSwitched = "MIGP.Corpus.GenerationSwitched"
+	eventKeyRotated         = "MIGP.Corpus.KeyRotated"
+	eventSnapshotPublished  = "MIGP.Corpus.SnapshotPublished"
+	eventCorpusRestored     = "MIGP.Corpus.Restored"
+)
+
+// event is a corpus-change notification in the Event Grid event schema.
+type event struct {
+	ID          string      `json:"id"`
+	Subject     string      `json:"subject"`
+	EventType   string      `json:"eventType"`
+	EventTime   time.Time   `json:"eventTime"`
+	Data        interface{} `json:"data"`
+	DataVersion string      `json:"dataVersion"`
+}
+
+// eventPublisher delivers events to an Event Grid topic, a static list of
+// webhook URLs and any webhooks registered through the admin API.
+type eventPublisher struct {
+	client            *http.Client
+	eventGridEndpoint string
+	eventGridKey      string
+	webhookURLs       []string
+	webhooks          *webhookStore
+
+	// jobs tracks the admin jobs reported by job events.
+	jobs *jobTracker
+
+	// feed keeps the recent events for GET /api/admin/events.
+	feed *eventFeed
+
+	// inflight tracks deliveries still in progress, see Wait.
+	inflight sync.WaitGroup
+}
+
+// newEventPublisher returns an eventPublisher configured from the
+// EVENT_GRID_TOPIC_ENDPOINT, EVENT_GRID_TOPIC_KEY and EVENT_WEBHOOK_URLS
+// environment variables, also delivering to the webhooks registered in
+// webhooks.
+func newEventPublisher(webhooks *webhookStore) *eventPublisher {
+	p := &eventPublisher{
+		client:            &http.Client{Timeout: 10 * time.Second},
+		eventGridEndpoint: os.Getenv("EVENT_GRID_TOPIC_ENDPOINT"),
+		eventGridKey:      os.Getenv("EVENT_GRID_TOPIC_KEY"),
+		webhooks:          webhooks,
+		jobs:              newJobTracker(),
+		feed:              newEventFeed(),
+	}
+	for _, u := range strings.Split(os.Getenv("EVENT_WEBHOOK_URLS"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			p.webhookURLs = append(p.webhookURLs, u)
+		}
+	}
+	return p
+}
+
+// enabled reports whether any event destination is configured.
+func (p *eventPublisher) enabled() bool {
+	return p.eventGridEndpoint != "" || len(p.webhookURLs) > 0 || p.webhooks != nil
+}
+
+// Publish sends an event to all configured destinations in the background,
+// and to the event feed. Delivery failures are logged and never surface to
+// the caller.
+func (p *eventPublisher) Publish(eventType, subject string, data interface{}) {
+	p.jobs.record(eventType, subject, data)
+
+	id, err := randomID()
+	if err != nil {
+		log.Println("Event ID generation failed:", err)
+		return
+	}
+	ev := event{
+		ID:          id,
+		Subject:     subject,
+		EventType:   eventType,
+		EventTime:   time.Now().UTC(),
+		Data:        data,
+		DataVersion: "1.0",
+	}
+	p.feed.publish(ev)
+	if !p.enabled() {
+		return
+	}
+
+	p.inflight.Add(1)
+	go func() {
+		defer p.inflight.Done()
+		if p.eventGridEndpoint != "" {
+			if err := p.post(p.eventGridEndpoint, []event{ev}, p.eventGridKey, ""); err != nil {
+				log.Printf("Publishing %s to Event Grid failed: %v", eventType, err)
+			}
+		}
+		for _, u := range p.webhookURLs {
+			if err := p.post(u, ev, "", ""); err != nil {
+				log.Printf("Publishing %s to webhook failed: %v", eventType, err)
+			}
+		}
+		if p.webhooks == nil {
+			return
+		}
+		registered, err := p.webhooks.subscribers(context.Background())
+		if err != nil {
+			log.Printf("Listing webhooks for %s failed: %v", eventType, err)
+			return
+		}
+		for _, wh := range registered {
+			if wh.subscribed(eventType) {
+				p.inflight.Add(1)
+				go func(wh webhook) {
+					defer p.inflight.Done()
+					p.deliverWebhook(wh, ev)
+				}(wh)
+			}
+		}
+	}()
+}
+
+// Wait blocks until every published event has been delivered or has failed,
+// so that commands can publish events before exiting.
+func (p *eventPublisher) Wait() {
+	p.inflight.Wait()
+}
+
+// post delivers a JSON payload to url, authenticating with an Event Grid SAS
+// key and signing the body with an HMAC secret if either is given.
+func (p *eventPublisher) post(url string, payload interface{}, sasKey, secret string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sasKey != "" {
+		req.Header.Set("aeg-sas-key", sasKey)
+	}
+	if secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signPayload(secret, body))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return deliveryStatusError(resp.StatusCode)
+	}
+	return nil
+}
+
+// deliveryStatusError is the status code of a rejected event delivery.
+type deliveryStatusError int
+
+func (e deliveryStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", int(e))
+}
+
+// randomID returns a random 128-bit hex identifier.
+func randomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// keyFingerprint returns a hex SHA-256 digest of the server's public OPRF key.
+func keyFingerprint(cfg *migp.ServerConfig) (string, error) {
+	publicKey, err := cfg.PrivateKey.Public().Serialize()
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(publicKey)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// recordKeyFingerprint stores the fingerprint of the active MIGP key and
+// publishes a key rotation event when it differs from the previously recorded
+// one. Only the first instance to observe a new key publishes the event.
+func recordKeyFingerprint(db *sql.DB, events *eventPublisher, cfg *migp.ServerConfig) error {
+	fingerprint, err := keyFingerprint(cfg)
+	if err != nil {
+		return err
+	}
+
+	var previous sql.NullString
+	query := `
+	WITH old AS (SELECT fingerprint FROM migp_key WHERE id = 1 FOR UPDATE)
+	INSERT INTO migp_key (id, fingerprint) VALUES (1, $1)
+	ON CONFLICT (id) DO UPDATE SET fingerprint = $1, updated_at = now()
+		WHERE migp_key.fingerprint <> $1
+	RETURNING (SELECT fingerprint FROM old)`
+	err = db.QueryRow(query, fingerprint).Scan(&previous)
+	if err == sql.ErrNoRows {
+		// The recorded key is already current.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if previous.Valid {
+		events.Publish(eventKeyRotated, "migp/key", map[string]string{
+			"previousFingerprint": previous.String,
+			"fingerprint":         fingerprint,
+		})
+	}
+	return nil
+}
+
+// suiteKey is the key fingerprint of one served crypto suite.
+type suiteKey struct {
+	Version     uint16 `json:"version"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// handleKeyStatus reports the key fingerprints of the served suites and the
+// fingerprint recorded by the last key rotation, so that operators can check
+// that every instance picked up a new key.
+func (s *server) handleKeyStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	keys := make([]suiteKey, len(s.suites))
+	for i, cs := range s.suites {
+		fingerprint, err := keyFingerprint(&cs.cfg)
+		if err != nil {
+			log.Println("Computing key fingerprint failed:", err)
+			writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		keys[i] = suiteKey{Version: cs.cfg.Version, Fingerprint: fingerprint}
+	}
+
+	status := map[string]interface{}{"suites": keys}
+	if len(s.tenants) > 0 {
+		tenants, err := s.tenantKeys()
+		if err != nil {
+			log.Println("Computing key fingerprint failed:", err)
+			writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		status["tenants"] = tenants
+	}
+	var recorded string
+	var recordedAt time.Time
+	err := s.kv.db().QueryRowContext(req.Context(), `SELECT fingerprint, updated_at FROM migp_key WHERE id = 1`).Scan(&recorded, &recordedAt)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		storageError(w, "Reading the recorded key", err)
+		return
+	default:
+		status["recordedFingerprint"] = recorded
+		status["recordedAt"] = recordedAt
+	}
+	status["current"] = recorded == keys[0].Fingerprint
+	writeJSON(w, http.StatusOK, status)
+}
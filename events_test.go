@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// delivery is an event delivery received by newEventReceiver.
+type delivery struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// newEventReceiver returns a server recording the deliveries it receives.
+func newEventReceiver(t *testing.T) (*httptest.Server, func() []delivery) {
+	t.Helper()
+	var mu sync.Mutex
+	var deliveries []delivery
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		deliveries = append(deliveries, delivery{req.URL.Path, req.Header.Clone(), body})
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []delivery {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]delivery(nil), deliveries...)
+	}
+}
+
+func TestIngestionEvents(t *testing.T) {
+	receiver, deliveries := newEventReceiver(t)
+	t.Setenv("EVENT_GRID_TOPIC_ENDPOINT", receiver.URL+"/grid")
+	t.Setenv("EVENT_GRID_TOPIC_KEY", "sas-key")
+	t.Setenv("EVENT_WEBHOOK_URLS", receiver.URL+"/hook, ")
+	s, _ := newTestServer(t)
+
+	req := ingestRequest{Credentials: []string{"events@example.com:password"}}
+	err := s.runQueueIngest(&invocationResponse{}, "ingest", "migp/ingest", "credentials", func(func(int)) ingestResult {
+		return s.ingestParallel(context.Background(), req, 1, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.events.Wait()
+
+	var grid, hook int
+	for _, d := range deliveries() {
+		var ev event
+		switch d.path {
+		case "/grid":
+			if d.header.Get("aeg-sas-key") != "sas-key" {
+				t.Errorf("Event Grid delivery without the SAS key: %v", d.header)
+			}
+			var events []event
+			if err := json.Unmarshal(d.body, &events); err != nil || len(events) != 1 {
+				t.Fatalf("Event Grid delivery %s is not a single event array: %v", d.body, err)
+			}
+			ev = events[0]
+		case "/hook":
+			if d.header.Get("aeg-sas-key") != "" {
+				t.Errorf("webhook delivery carries the SAS key")
+			}
+			if err := json.Unmarshal(d.body, &ev); err != nil {
+				t.Fatalf("webhook delivery %s: %v", d.body, err)
+			}
+		}
+		if ev.EventType != eventIngestionCompleted {
+			continue
+		}
+		if ev.Subject != "migp/ingest" || ev.DataVersion != "1.0" || ev.ID == "" {
+			t.Errorf("ingestion event %+v", ev)
+		}
+		if d.path == "/grid" {
+			grid++
+		} else {
+			hook++
+		}
+	}
+	if grid != 1 || hook != 1 {
+		t.Fatalf("ingestion event delivered %d times to Event Grid and %d times to the webhook, want once each", grid, hook)
+	}
+}
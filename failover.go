@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	dbActiveEndpoint  = newGauge("migp_db_active_endpoint", "Index of the database endpoint currently serving reads and writes.")
+	dbEndpointHealthy = newGauge("migp_db_endpoint_healthy", "Whether the last health check of a database endpoint succeeded.", "endpoint")
+	dbFailovers       = newCounter("migp_db_failovers_total", "Switches of the active database endpoint by direction.", "direction")
+)
+
+// dbEndpoint is one database in the ordered failover list.
+type dbEndpoint struct {
+	db        *sql.DB
+	failures  int
+	successes int
+}
+
+// dbCluster routes storage calls to the first healthy database in an ordered
+// list of connection strings, an endpoint being healthy if it is reachable
+// and accepts writes. A background monitor fails over to the next
+// healthy endpoint after sustained failures of the active one, and fails back
+// to a preferred endpoint once it has been healthy for a while.
+type dbCluster struct {
+	endpoints []*dbEndpoint
+	active    atomic.Int32
+
+	interval          time.Duration
+	failoverThreshold int
+	failbackThreshold int
+
+	mu sync.Mutex
+}
+
+// databaseConnectionStrings returns the ordered list of connection strings:
+// DB_CONNECTION_ST followed by DB_CONNECTION_ST_1, DB_CONNECTION_ST_2 and so
+// on, up to the first one that is unset.
+func databaseConnectionStrings() []string {
+	dbConnectionString := os.Getenv("DB_CONNECTION_ST")
+	if dbConnectionString == "" {
+		log.Println("DB_CONNECTION_ST environment variable not set. Using default localhost connection string.")
+		dbConnectionString = "user=user password=pw dbname=db sslmode=disable host=localhost"
+	}
+
+	dsns := []string{dbConnectionString}
+	for i := 1; ; i++ {
+		dsn := os.Getenv("DB_CONNECTION_ST_" + strconv.Itoa(i))
+		if dsn == "" {
+			return dsns
+		}
+		dsns = append(dsns, dsn)
+	}
+}
+
+// openCluster opens every connection string, applying opts, and makes the
+// first reachable one active.
+func openCluster(dsns []string, opts connectionOptions) (*dbCluster, error) {
+	c := &dbCluster{
+		interval:          envDuration("DB_HEALTH_INTERVAL", 5*time.Second),
+		failoverThreshold: envInt("DB_FAILOVER_THRESHOLD", 3),
+		failbackThreshold: envInt("DB_FAILBACK_THRESHOLD", 12),
+	}
+	for i, dsn := range dsns {
+		log.Printf("Using database endpoint %d: %s", i, describeDSN(dsn))
+		dsn, err := opts.apply(dsn)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("parsing database connection string %d: %w", i, err)
+		}
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("opening database %d: %w", i, err)
+		}
+		opts.configure(db)
+		c.endpoints = append(c.endpoints, &dbEndpoint{db: db})
+	}
+
+	// The first writable endpoint is made active. If every reachable one is
+	// a replica, the first of them serves reads until a primary appears.
+	var lastErr error
+	replica := -1
+	for i, ep := range c.endpoints {
+		lastErr = probeEndpoint(context.Background(), ep.db)
+		if lastErr == nil {
+			replica = i
+			break
+		}
+		if errors.Is(lastErr, errReadOnlyEndpoint) && replica < 0 {
+			replica = i
+		}
+		log.Printf("Database endpoint %d unavailable for writes: %v", i, lastErr)
+	}
+	if replica < 0 {
+		c.Close()
+		return nil, fmt.Errorf("connecting to the database: %w", lastErr)
+	}
+	c.setActive(replica)
+	if len(c.endpoints) > 1 {
+		go c.monitor()
+	}
+	return c, nil
+}
+
+// errReadOnlyEndpoint is returned by probeEndpoint for a replica.
+var errReadOnlyEndpoint = errors.New("database is in recovery and read-only")
+
+// probeEndpoint checks that db is reachable and accepts writes, so that
+// failover never makes a replica active.
+func probeEndpoint(ctx context.Context, db *sql.DB) error {
+	var recovery bool
+	if err := db.QueryRowContext(ctx, `SELECT pg_is_in_recovery()`).Scan(&recovery); err != nil {
+		return err
+	}
+	if recovery {
+		return errReadOnlyEndpoint
+	}
+	return nil
+}
+
+// describeDSN returns the host, port and database name of a connection
+// string, for logging it without its credentials.
+func describeDSN(dsn string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			return "unparsable connection URL"
+		}
+	}
+	var parts []string
+	for _, key := range []string{"host", "port", "dbname"} {
+		if v, ok := dsnValue(dsn, key); ok {
+			parts = append(parts, key+"="+v)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// dsnValue returns the value of key in a key=value connection string,
+// unquoting values in single quotes.
+func dsnValue(dsn, key string) (string, bool) {
+	for rest := dsn; ; {
+		rest = strings.TrimLeft(rest, " \t\n")
+		if rest == "" {
+			return "", false
+		}
+		name, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			return "", false
+		}
+		name = strings.TrimSpace(name)
+		after = strings.TrimLeft(after, " ")
+		var value strings.Builder
+		if strings.HasPrefix(after, "'") {
+			i := 1
+			for ; i < len(after) && after[i] != '\''; i++ {
+				if after[i] == '\\' && i+1 < len(after) {
+					i++
+				}
+				value.WriteByte(after[i])
+			}
+			rest = after[min(i+1, len(after)):]
+		} else {
+			end := strings.IndexAny(after, " \t\n")
+			if end < 0 {
+				end = len(after)
+			}
+			value.WriteString(after[:end])
+			rest = after[end:]
+		}
+		if name == key {
+			return value.String(), true
+		}
+	}
+}
+
+// errNoDatabase is returned by every database call of a detached server.
+var errNoDatabase = errors.New("no metadata database in this mode")
+
+// detachedDriver is a database/sql driver whose connections always fail.
+type detachedDriver struct{}
+
+func (detachedDriver) Open(string) (driver.Conn, error) { return nil, errNoDatabase }
+
+func init() {
+	sql.Register("detached", detachedDriver{})
+}
+
+// detachedCluster returns a cluster whose database fails every call with
+// errNoDatabase, for servers running without a metadata database.
+func detachedCluster() (*dbCluster, error) {
+	db, err := sql.Open("detached", "")
+	if err != nil {
+		return nil, err
+	}
+	c := &dbCluster{endpoints: []*dbEndpoint{{db: db}}}
+	c.setActive(0)
+	return c, nil
+}
+
+// DB returns the active database.
+func (c *dbCluster) DB() *sql.DB {
+	return c.endpoints[c.active.Load()].db
+}
+
+// Close closes every endpoint.
+func (c *dbCluster) Close() {
+	for _, ep := range c.endpoints {
+		ep.db.Close()
+	}
+}
+
+func (c *dbCluster) setActive(i int) {
+	c.active.Store(int32(i))
+	dbActiveEndpoint.Set(float64(i))
+}
+
+// monitor periodically health checks every endpoint and switches the active
+// one when needed.
+func (c *dbCluster) monitor() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.check()
+	}
+}
+
+// check runs one round of health checks.
+func (c *dbCluster) check() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, ep := range c.endpoints {
+		ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+		err := probeEndpoint(ctx, ep.db)
+		cancel()
+		if err != nil {
+			ep.failures++
+			ep.successes = 0
+			dbEndpointHealthy.Set(0, strconv.Itoa(i))
+		} else {
+			ep.successes++
+			ep.failures = 0
+			dbEndpointHealthy.Set(1, strconv.Itoa(i))
+		}
+	}
+
+	active := int(c.active.Load())
+	// Fail back to the most preferred endpoint that has been stable for
+	// failbackThreshold checks.
+	for i := 0; i < active; i++ {
+		if c.endpoints[i].successes >= c.failbackThreshold {
+			log.Printf("Failing back from database endpoint %d to %d", active, i)
+			dbFailovers.Inc("failback")
+			c.setActive(i)
+			return
+		}
+	}
+	if c.endpoints[active].failures < c.failoverThreshold {
+		return
+	}
+	for i, ep := range c.endpoints {
+		if i != active && ep.failures == 0 {
+			log.Printf("Failing over from database endpoint %d to %d", active, i)
+			dbFailovers.Inc("failover")
+			c.setActive(i)
+			return
+		}
+	}
+	log.Printf("Database endpoint %d is unhealthy and no other endpoint is available", active)
+}
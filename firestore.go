@@ -0,0 +1,497 @@
+//go:build full || !(minimal || azure || aws)
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	bucketBackends["firestore"] = func(bool) (bucketBackend, error) {
+		b, err := openFirestoreBackend()
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+}
+
+// firestoreBackend keeps the corpus buckets in Cloud Firestore, selected with
+// STORAGE_BACKEND=firestore, for deployments of the handler on Cloud Run. It
+// uses the FIRESTORE_DATABASE database (default "(default)") of the
+// FIRESTORE_PROJECT project, defaulting to GOOGLE_CLOUD_PROJECT, and
+// authenticates as the service account of the instance through the metadata
+// server. FIRESTORE_EMULATOR_HOST selects the emulator instead.
+//
+// Each bucket is a document of the FIRESTORE_COLLECTION collection (default
+// migp_buckets), and each of its entries a document of its entries
+// subcollection named by the SHA-256 of the entry. Appends and removals are
+// commits that write the entries and the bucket together, on the condition
+// that the bucket was not updated since it was read. Documents are limited to
+// 1 MiB, which bounds the size of a bucket.
+type firestoreBackend struct {
+	base       string // URL of the documents of the database
+	root       string // resource name of the documents of the database
+	collection string
+	emulator   bool
+	httpClient *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// firestoreCommitWrites is the maximum number of writes in a commit.
+const firestoreCommitWrites = 500
+
+var (
+	// errFirestoreConflict is returned when a commit lost a race with another
+	// change of the bucket.
+	errFirestoreConflict = errors.New("firestore commit conflict")
+
+	// errFirestoreBucketTooLarge is returned for appends that would make a
+	// bucket exceed the document size limit.
+	errFirestoreBucketTooLarge = errors.New("bucket exceeds the firestore document size limit")
+)
+
+// firestoreMaxBucket leaves room in the 1 MiB document limit for the name and
+// fields of a bucket document.
+const firestoreMaxBucket = 1<<20 - 4096
+
+// openFirestoreBackend connects to the Firestore database configured by the
+// environment.
+func openFirestoreBackend() (*firestoreBackend, error) {
+	project := os.Getenv("FIRESTORE_PROJECT")
+	if project == "" {
+		project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	if project == "" {
+		return nil, errors.New("FIRESTORE_PROJECT is not set")
+	}
+	database := os.Getenv("FIRESTORE_DATABASE")
+	if database == "" {
+		database = "(default)"
+	}
+	b := &firestoreBackend{
+		root:       fmt.Sprintf("projects/%s/databases/%s/documents", project, database),
+		collection: os.Getenv("FIRESTORE_COLLECTION"),
+		httpClient: &http.Client{Timeout: time.Minute},
+	}
+	if b.collection == "" {
+		b.collection = "migp_buckets"
+	}
+	host := "https://firestore.googleapis.com"
+	if emulator := os.Getenv("FIRESTORE_EMULATOR_HOST"); emulator != "" {
+		host, b.emulator = "http://"+emulator, true
+	}
+	b.base = host + "/v1/" + b.root
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, _, err := b.do(ctx, http.MethodGet, "/"+b.collection, url.Values{"pageSize": {"1"}}, nil); err != nil {
+		return nil, fmt.Errorf("connecting to Firestore: %w", err)
+	}
+	return b, nil
+}
+
+// accessToken returns an OAuth token of the service account of the instance,
+// refreshing it from the metadata server shortly before it expires.
+func (b *firestoreBackend) accessToken(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.token != "" && time.Until(b.expires) > time.Minute {
+		return b.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching access token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching access token: status %d", resp.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	b.token, b.expires = token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second)
+	return b.token, nil
+}
+
+// do sends a request for path, relative to the documents of the database,
+// and returns the status and body of the response. A 404 returns a nil body
+// and no error, and failed preconditions errFirestoreConflict.
+func (b *firestoreBackend) do(ctx context.Context, method, path string, query url.Values, body []byte) (int, []byte, error) {
+	u := b.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.emulator {
+		req.Header.Set("Authorization", "Bearer owner")
+	} else {
+		token, err := b.accessToken(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return resp.StatusCode, nil, nil
+	case resp.StatusCode == http.StatusConflict,
+		resp.StatusCode == http.StatusBadRequest && bytes.Contains(data, []byte("FAILED_PRECONDITION")):
+		return resp.StatusCode, nil, errFirestoreConflict
+	case resp.StatusCode != http.StatusOK:
+		return resp.StatusCode, nil, fmt.Errorf("firestore %s %s: status %d: %s", method, path, resp.StatusCode, bytes.TrimSpace(data))
+	}
+	return resp.StatusCode, data, nil
+}
+
+// firestoreValue is a field value of a document.
+type firestoreValue struct {
+	BytesValue   []byte  `json:"bytesValue,omitempty"`
+	IntegerValue *string `json:"integerValue,omitempty"`
+}
+
+// firestoreDocument is a document with the fields of buckets and entries.
+type firestoreDocument struct {
+	Name       string                    `json:"name,omitempty"`
+	Fields     map[string]firestoreValue `json:"fields"`
+	UpdateTime string                    `json:"updateTime,omitempty"`
+}
+
+// firestoreWrite is a write of a commit.
+type firestoreWrite struct {
+	Update          *firestoreDocument `json:"update,omitempty"`
+	Delete          string             `json:"delete,omitempty"`
+	CurrentDocument map[string]any     `json:"currentDocument,omitempty"`
+}
+
+// docID returns the document ID of the bucket stored under id, as IDs cannot
+// contain slashes. Bucket IDs need no escaping otherwise.
+func docID(id string) string {
+	return strings.ReplaceAll(id, "/", "!")
+}
+
+// bucketPath returns the path of the bucket document of id.
+func (b *firestoreBackend) bucketPath(id string) string {
+	return "/" + b.collection + "/" + docID(id)
+}
+
+// bucket reads the bucket document of id, or nil if there is none.
+func (b *firestoreBackend) bucket(ctx context.Context, id string) (*firestoreDocument, error) {
+	_, data, err := b.do(ctx, http.MethodGet, b.bucketPath(id), nil, nil)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var doc firestoreDocument
+	err = json.Unmarshal(data, &doc)
+	return &doc, err
+}
+
+// Get returns the bucket stored under id.
+func (b *firestoreBackend) Get(ctx context.Context, id string) ([]byte, error) {
+	doc, err := b.bucket(ctx, id)
+	if err != nil || doc == nil || doc.Fields["value"].BytesValue == nil {
+		return []byte{}, err
+	}
+	return doc.Fields["value"].BytesValue, nil
+}
+
+// entries returns the entry documents of the bucket stored under id.
+func (b *firestoreBackend) entries(ctx context.Context, id string) ([]firestoreDocument, error) {
+	var docs []firestoreDocument
+	query := url.Values{"pageSize": {"300"}}
+	for {
+		_, data, err := b.do(ctx, http.MethodGet, b.bucketPath(id)+"/entries", query, nil)
+		if err != nil || data == nil {
+			return docs, err
+		}
+		var page struct {
+			Documents     []firestoreDocument `json:"documents"`
+			NextPageToken string              `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, err
+		}
+		docs = append(docs, page.Documents...)
+		if page.NextPageToken == "" {
+			return docs, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// bucketWrite returns the write storing value in the bucket document of id,
+// on the condition that it is unchanged since doc was read.
+func (b *firestoreBackend) bucketWrite(id string, value []byte, doc *firestoreDocument) (firestoreWrite, error) {
+	if len(value) > firestoreMaxBucket {
+		return firestoreWrite{}, errFirestoreBucketTooLarge
+	}
+	if len(value) == 0 && doc != nil {
+		// Empty byte values cannot be written, and a missing bucket reads
+		// as an empty one.
+		return firestoreWrite{Delete: doc.Name, CurrentDocument: map[string]any{"updateTime": doc.UpdateTime}}, nil
+	}
+	w := firestoreWrite{
+		Update:          &firestoreDocument{Name: b.root + b.bucketPath(id), Fields: map[string]firestoreValue{"value": {BytesValue: value}}},
+		CurrentDocument: map[string]any{"exists": false},
+	}
+	if doc != nil {
+		w.CurrentDocument = map[string]any{"updateTime": doc.UpdateTime}
+	}
+	return w, nil
+}
+
+// commit applies writes atomically.
+func (b *firestoreBackend) commit(ctx context.Context, writes []firestoreWrite) error {
+	body, err := json.Marshal(map[string]any{"writes": writes})
+	if err != nil {
+		return err
+	}
+	_, _, err = b.do(ctx, http.MethodPost, ":commit", nil, body)
+	return err
+}
+
+// AppendUnique appends value to the bucket stored under id unless it was
+// appended before.
+func (b *firestoreBackend) AppendUnique(ctx context.Context, id string, bucketHash sql.NullInt64, value []byte) (bool, error) {
+	e := journalEntry{Key: id, Value: value}
+	if bucketHash.Valid {
+		e.BucketHash = &bucketHash.Int64
+	}
+	n, err := b.AppendBatch(ctx, []journalEntry{e})
+	return n > 0, err
+}
+
+// AppendBatch appends entries with one commit for each bucket.
+func (b *firestoreBackend) AppendBatch(ctx context.Context, entries []journalEntry) (int, error) {
+	var keys []string
+	byKey := map[string][]journalEntry{}
+	for _, e := range entries {
+		if _, ok := byKey[e.Key]; !ok {
+			keys = append(keys, e.Key)
+		}
+		byKey[e.Key] = append(byKey[e.Key], e)
+	}
+	added := 0
+	for _, key := range keys {
+		n, err := b.appendBucket(ctx, key, byKey[key])
+		added += n
+		if err != nil {
+			return added, err
+		}
+	}
+	return added, nil
+}
+
+// appendBucket appends entries to the bucket stored under id, retrying
+// commits that lost a race with another change of it.
+func (b *firestoreBackend) appendBucket(ctx context.Context, id string, entries []journalEntry) (int, error) {
+	for attempt := 0; attempt < conflictAttempts; attempt++ {
+		if attempt > 0 {
+			if err := conflictBackoff(ctx, attempt); err != nil {
+				return 0, err
+			}
+		}
+		doc, err := b.bucket(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		stored, err := b.entries(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		seen := map[string]bool{}
+		for _, e := range stored {
+			seen[e.Name[strings.LastIndex(e.Name, "/")+1:]] = true
+		}
+		value := []byte{}
+		if doc != nil && doc.Fields["value"].BytesValue != nil {
+			value = doc.Fields["value"].BytesValue
+		}
+		var writes []firestoreWrite
+		for _, e := range entries {
+			sum := sha256.Sum256(e.Value)
+			hash := hex.EncodeToString(sum[:])
+			if seen[hash] || len(writes) == firestoreCommitWrites-1 {
+				continue
+			}
+			seen[hash] = true
+			fields := map[string]firestoreValue{"value": {BytesValue: e.Value}}
+			if e.BucketHash != nil {
+				h := strconv.FormatInt(*e.BucketHash, 10)
+				fields["bucketHash"] = firestoreValue{IntegerValue: &h}
+			}
+			writes = append(writes, firestoreWrite{
+				Update:          &firestoreDocument{Name: b.root + b.bucketPath(id) + "/entries/" + hash, Fields: fields},
+				CurrentDocument: map[string]any{"exists": false},
+			})
+			value = append(value[:len(value):len(value)], e.Value...)
+		}
+		if len(writes) == 0 {
+			return 0, nil
+		}
+		added := len(writes)
+		w, err := b.bucketWrite(id, value, doc)
+		if err != nil {
+			return 0, err
+		}
+		err = b.commit(ctx, append(writes, w))
+		if err == errFirestoreConflict {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if added == firestoreCommitWrites-1 {
+			// The rest did not fit in the commit.
+			more, err := b.appendBucket(ctx, id, entries)
+			return added + more, err
+		}
+		return added, nil
+	}
+	return 0, errFirestoreConflict
+}
+
+// RemoveEntries removes values from the bucket stored under id and rebuilds
+// it from the remaining entries.
+func (b *firestoreBackend) RemoveEntries(ctx context.Context, id string, values [][]byte) (int, error) {
+	remove := map[string]bool{}
+	for _, value := range values {
+		sum := sha256.Sum256(value)
+		remove[hex.EncodeToString(sum[:])] = true
+	}
+	for attempt := 0; attempt < conflictAttempts; attempt++ {
+		if attempt > 0 {
+			if err := conflictBackoff(ctx, attempt); err != nil {
+				return 0, err
+			}
+		}
+		doc, err := b.bucket(ctx, id)
+		if err != nil || doc == nil {
+			return 0, err
+		}
+		stored, err := b.entries(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		var writes []firestoreWrite
+		value := []byte{}
+		for _, e := range stored {
+			if remove[e.Name[strings.LastIndex(e.Name, "/")+1:]] && len(writes) < firestoreCommitWrites-1 {
+				writes = append(writes, firestoreWrite{Delete: e.Name})
+				continue
+			}
+			value = append(value, e.Fields["value"].BytesValue...)
+		}
+		if len(writes) == 0 {
+			return 0, nil
+		}
+		removed := len(writes)
+		w, err := b.bucketWrite(id, value, doc)
+		if err != nil {
+			return 0, err
+		}
+		err = b.commit(ctx, append(writes, w))
+		if err == errFirestoreConflict {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if removed == firestoreCommitWrites-1 {
+			more, err := b.RemoveEntries(ctx, id, values)
+			return removed + more, err
+		}
+		return removed, nil
+	}
+	return 0, errFirestoreConflict
+}
+
+// Entries calls f for every entry document, with a collection group query
+// over the entries subcollections of the buckets.
+func (b *firestoreBackend) Entries(f func(id string, bucketHash sql.NullInt64, value []byte) error) error {
+	query := map[string]any{"structuredQuery": map[string]any{
+		"from": []map[string]any{{"collectionId": "entries", "allDescendants": true}},
+	}}
+	body, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+	_, data, err := b.do(context.Background(), http.MethodPost, ":runQuery", nil, body)
+	if err != nil {
+		return err
+	}
+	var results []struct {
+		Document *firestoreDocument `json:"document"`
+	}
+	if err := json.Unmarshal(data, &results); err != nil {
+		return err
+	}
+	prefix := b.root + "/" + b.collection + "/"
+	for _, r := range results {
+		if r.Document == nil || !strings.HasPrefix(r.Document.Name, prefix) {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(r.Document.Name, prefix), "/")
+		if len(parts) != 3 {
+			continue
+		}
+		var bucketHash sql.NullInt64
+		if h := r.Document.Fields["bucketHash"].IntegerValue; h != nil {
+			n, err := strconv.ParseInt(*h, 10, 64)
+			if err != nil {
+				return err
+			}
+			bucketHash = sql.NullInt64{Int64: n, Valid: true}
+		}
+		if err := f(strings.ReplaceAll(parts[0], "!", "/"), bucketHash, r.Document.Fields["value"].BytesValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close releases idle connections.
+func (b *firestoreBackend) Close() error {
+	b.httpClient.CloseIdleConnections()
+	return nil
+}
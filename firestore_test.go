@@ -0,0 +1,217 @@
+//go:build full || !(minimal || azure || aws)
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeFirestore is the subset of the Firestore REST API used by
+// firestoreBackend, as served by the emulator for one database. It checks
+// the preconditions of commits and pages listings to exercise page tokens.
+type fakeFirestore struct {
+	root string
+
+	mu    sync.Mutex
+	clock int
+	docs  map[string]firestoreDocument
+}
+
+func newFakeFirestore(t *testing.T) *fakeFirestore {
+	f := &fakeFirestore{root: "projects/test/databases/(default)/documents", docs: map[string]firestoreDocument{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	t.Setenv("FIRESTORE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	t.Setenv("FIRESTORE_PROJECT", "test")
+	return f
+}
+
+func (f *fakeFirestore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer owner" {
+		http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/v1/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case req.Method == http.MethodPost && name == f.root+":commit":
+		var commit struct {
+			Writes []firestoreWrite `json:"writes"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&commit); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.commit(w, commit.Writes)
+	case req.Method == http.MethodPost && name == f.root+":runQuery":
+		results := []map[string]any{{"readTime": "2026-01-01T00:00:00Z"}}
+		for _, name := range f.names() {
+			if parts := strings.Split(name, "/"); parts[len(parts)-2] == "entries" {
+				results = append(results, map[string]any{"document": f.docs[name]})
+			}
+		}
+		json.NewEncoder(w).Encode(results)
+	case req.Method == http.MethodGet && strings.Count(strings.TrimPrefix(name, f.root), "/")%2 == 0:
+		doc, ok := f.docs[name]
+		if !ok {
+			http.Error(w, "NOT_FOUND", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(doc)
+	case req.Method == http.MethodGet:
+		f.list(w, name, req.URL.Query())
+	default:
+		http.Error(w, "unexpected request", http.StatusNotImplemented)
+	}
+}
+
+// names returns the names of the documents in order.
+func (f *fakeFirestore) names() []string {
+	var names []string
+	for name := range f.docs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// list answers a listing of the documents of the collection named
+// collection, a page of pageSize documents at a time.
+func (f *fakeFirestore) list(w http.ResponseWriter, collection string, query url.Values) {
+	var docs []firestoreDocument
+	for _, name := range f.names() {
+		if rest, ok := strings.CutPrefix(name, collection+"/"); ok && !strings.Contains(rest, "/") {
+			docs = append(docs, f.docs[name])
+		}
+	}
+	size, _ := strconv.Atoi(query.Get("pageSize"))
+	start, _ := strconv.Atoi(query.Get("pageToken"))
+	page := map[string]any{}
+	if start < len(docs) {
+		end := min(start+size, len(docs))
+		page["documents"] = docs[start:end]
+		if end < len(docs) {
+			page["nextPageToken"] = strconv.Itoa(end)
+		}
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// commit applies writes if all their preconditions hold, and fails the
+// commit like Firestore otherwise.
+func (f *fakeFirestore) commit(w http.ResponseWriter, writes []firestoreWrite) {
+	if len(writes) > firestoreCommitWrites {
+		http.Error(w, "INVALID_ARGUMENT: too many writes", http.StatusBadRequest)
+		return
+	}
+	for _, write := range writes {
+		name := write.Delete
+		if write.Update != nil {
+			name = write.Update.Name
+		}
+		doc, exists := f.docs[name]
+		if want, ok := write.CurrentDocument["exists"].(bool); ok && want != exists {
+			http.Error(w, "ALREADY_EXISTS", http.StatusConflict)
+			return
+		}
+		if updateTime, ok := write.CurrentDocument["updateTime"].(string); ok && (!exists || doc.UpdateTime != updateTime) {
+			http.Error(w, "FAILED_PRECONDITION", http.StatusBadRequest)
+			return
+		}
+	}
+	f.clock++
+	updateTime := fmt.Sprintf("2026-01-01T00:00:00.%09dZ", f.clock)
+	for _, write := range writes {
+		if write.Update == nil {
+			delete(f.docs, write.Delete)
+			continue
+		}
+		f.docs[write.Update.Name] = firestoreDocument{Name: write.Update.Name, Fields: write.Update.Fields, UpdateTime: updateTime}
+	}
+	json.NewEncoder(w).Encode(map[string]any{"commitTime": updateTime})
+}
+
+func TestDocID(t *testing.T) {
+	b := &firestoreBackend{collection: "migp_buckets"}
+	if got := b.bucketPath("v1/0a1b2"); got != "/migp_buckets/v1!0a1b2" {
+		t.Errorf("bucketPath = %q", got)
+	}
+	if _, err := b.bucketWrite("v1/0a1b2", make([]byte, firestoreMaxBucket+1), nil); err != errFirestoreBucketTooLarge {
+		t.Errorf("oversized bucket: %v, want errFirestoreBucketTooLarge", err)
+	}
+	w, err := b.bucketWrite("v1/0a1b2", nil, &firestoreDocument{Name: "bucket", UpdateTime: "t"})
+	if err != nil || w.Delete != "bucket" || w.CurrentDocument["updateTime"] != "t" {
+		t.Errorf("emptied bucket write %+v, %v, want a conditional delete", w, err)
+	}
+}
+
+func TestFirestoreBackend(t *testing.T) {
+	t.Setenv("FIRESTORE_PROJECT", "")
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "")
+	if _, err := openFirestoreBackend(); err == nil {
+		t.Fatal("backend opened without a project")
+	}
+	newFakeFirestore(t)
+	b, err := openFirestoreBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	runBackendChecks(t, b, "conformance/", BackendChecks(256<<10))
+}
+
+func TestFirestoreCommitLimit(t *testing.T) {
+	f := newFakeFirestore(t)
+	b, err := openFirestoreBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ctx := context.Background()
+	id := "commit/limit"
+	var entries []journalEntry
+	var values [][]byte
+	for i := 0; i < 2*firestoreCommitWrites; i++ {
+		entries = append(entries, journalEntry{Key: id, Value: conformanceValue(i)})
+		values = append(values, conformanceValue(i))
+	}
+	if n, err := b.AppendBatch(ctx, entries); err != nil || n != len(entries) {
+		t.Fatalf("AppendBatch of %d entries: %d, %v", len(entries), n, err)
+	}
+	if commits := f.clock; commits != 3 {
+		t.Errorf("%d entries appended in %d commits, want 3", len(entries), commits)
+	}
+	if err := expectBucket(ctx, b, id, conformanceEntrySize, values...); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b.RemoveEntries(ctx, id, values); err != nil || n != len(values) {
+		t.Fatalf("RemoveEntries: %d, %v", n, err)
+	}
+	if got, err := b.Get(ctx, id); err != nil || len(got) != 0 {
+		t.Errorf("Get after removing every entry: %d bytes, %v", len(got), err)
+	}
+	if n, err := b.AppendUnique(ctx, id, sql.NullInt64{Int64: 7, Valid: true}, values[0]); err != nil || !n {
+		t.Fatalf("AppendUnique after removal: %v, %v", n, err)
+	}
+	err = b.Entries(func(got string, bucketHash sql.NullInt64, value []byte) error {
+		if got != id || bucketHash.Int64 != 7 || string(value) != string(values[0]) {
+			t.Errorf("entry %q %v %x", got, bucketHash, value)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Feature flags gating behaviours that are rolled out incrementally.
+const (
+	flagQueryCache     = "query_cache"
+	flagPIR            = "pir"
+	flagDebugEndpoints = "debug_endpoints"
+	flagReadOnly       = "read_only"
+)
+
+// featureFlag describes a known flag. Env is the environment variable that
+// enabled the behaviour before it became a flag, and still sets its
+// deployment-wide default.
+type featureFlag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Env         string `json:"env"`
+	Default     bool   `json:"default"`
+}
+
+// knownFlags lists every feature flag.
+var knownFlags = []featureFlag{
+	{flagQueryCache, "Cacheable GET variant of /api/query", "QUERY_GET_ENABLED", false},
+	{flagPIR, "Two-server PIR bucket fetch through /api/pir", "PIR_ENABLED", false},
+	{flagDebugEndpoints, "Golden vectors under /api/debug", "DEBUG_ENDPOINTS_ENABLED", false},
+	{flagReadOnly, "Reject corpus writes, for consistent backups", "READ_ONLY", false},
+}
+
+// flagRules holds flag values for the deployment and per tenant.
+type flagRules struct {
+	Flags   map[string]bool            `json:"flags"`
+	Tenants map[string]map[string]bool `json:"tenants"`
+}
+
+// lookup returns the value of name for tenant, falling back to the
+// deployment-wide value.
+func (r flagRules) lookup(name, tenant string) (bool, bool) {
+	if v, ok := r.Tenants[tenant][name]; ok && tenant != "" {
+		return v, true
+	}
+	v, ok := r.Flags[name]
+	return v, ok
+}
+
+// featureFlags resolves flags from, in order of precedence, rules stored in
+// the feature_flags table, the FEATURE_FLAGS JSON document, such as
+// {"flags": {"pir": true}, "tenants": {"acme": {"pir": false}}}, and the
+// flag's environment variable. Within each source a tenant rule wins over a
+// deployment-wide one. Stored rules are reloaded after FEATURE_FLAGS_TTL.
+type featureFlags struct {
+	static flagRules
+	ttl    time.Duration
+
+	mu        sync.Mutex
+	stored    flagRules
+	fetchedAt time.Time
+}
+
+// newFeatureFlags returns the feature flags configured by the environment.
+func newFeatureFlags() *featureFlags {
+	f := &featureFlags{ttl: envDuration("FEATURE_FLAGS_TTL", 30*time.Second)}
+	if val := os.Getenv("FEATURE_FLAGS"); val != "" {
+		if err := json.Unmarshal([]byte(val), &f.static); err != nil {
+			log.Println("Invalid FEATURE_FLAGS value. Ignoring it:", err)
+		}
+	}
+	return f
+}
+
+// flagState is the resolved value of a flag and the source it came from.
+type flagState struct {
+	Enabled bool   `json:"enabled"`
+	Source  string `json:"source"`
+}
+
+// resolveFlag returns the state of name for tenant. Stored rules are only
+// consulted once storage is up.
+func (s *server) resolveFlag(name, tenant string) flagState {
+	if s.storageReady.Load() {
+		if v, ok := s.storedFlags().lookup(name, tenant); ok {
+			return flagState{v, "database"}
+		}
+	}
+	if v, ok := s.flags.static.lookup(name, tenant); ok {
+		return flagState{v, "FEATURE_FLAGS"}
+	}
+	for _, f := range knownFlags {
+		if f.Name == name {
+			if _, ok := os.LookupEnv(f.Env); ok {
+				return flagState{envBool(f.Env, f.Default), f.Env}
+			}
+			return flagState{f.Default, "default"}
+		}
+	}
+	return flagState{false, "unknown"}
+}
+
+// flagEnabled reports whether name is enabled for the tenant of req, or for
+// the deployment if req is nil.
+func (s *server) flagEnabled(name string, req *http.Request) bool {
+	tenant := ""
+	if req != nil {
+		tenant = tenantOf(req)
+	}
+	return s.resolveFlag(name, tenant).Enabled
+}
+
+// storedFlags returns the rules in the feature_flags table, reloading them
+// once they are older than the TTL. On failure the previous rules are kept.
+func (s *server) storedFlags() flagRules {
+	f := s.flags
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.fetchedAt) < f.ttl {
+		return f.stored
+	}
+	f.fetchedAt = time.Now()
+
+	rows, err := s.kv.db().Query(`SELECT name, tenant, enabled FROM feature_flags`)
+	if err != nil {
+		log.Println("Loading feature flags failed:", err)
+		return f.stored
+	}
+	defer rows.Close()
+	rules := flagRules{Flags: map[string]bool{}, Tenants: map[string]map[string]bool{}}
+	for rows.Next() {
+		var name, tenant string
+		var enabled bool
+		if err := rows.Scan(&name, &tenant, &enabled); err != nil {
+			log.Println("Loading feature flags failed:", err)
+			return f.stored
+		}
+		if tenant == "" {
+			rules.Flags[name] = enabled
+			continue
+		}
+		if rules.Tenants[tenant] == nil {
+			rules.Tenants[tenant] = map[string]bool{}
+		}
+		rules.Tenants[tenant][name] = enabled
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Loading feature flags failed:", err)
+		return f.stored
+	}
+	f.stored = rules
+	return rules
+}
+
+// invalidate makes the next lookup reload the stored rules.
+func (f *featureFlags) invalidate() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fetchedAt = time.Time{}
+}
+
+// flagRule is a stored flag value, for the deployment if Tenant is empty.
+type flagRule struct {
+	Name    string `json:"name"`
+	Tenant  string `json:"tenant"`
+	Enabled bool   `json:"enabled"`
+}
+
+// known reports whether the rule names a known flag.
+func (r flagRule) known() bool {
+	for _, f := range knownFlags {
+		if f.Name == r.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// setFlag stores rule.
+func (s *server) setFlag(ctx context.Context, rule flagRule) error {
+	query := `
+	INSERT INTO feature_flags (name, tenant, enabled) VALUES ($1, $2, $3)
+	ON CONFLICT (name, tenant) DO UPDATE SET enabled = $3, updated_at = now()`
+	_, err := s.kv.db().ExecContext(ctx, query, rule.Name, rule.Tenant, rule.Enabled)
+	s.flags.invalidate()
+	return err
+}
+
+// clearFlag removes the stored rule for name and tenant.
+func (s *server) clearFlag(ctx context.Context, name, tenant string) error {
+	_, err := s.kv.db().ExecContext(ctx, `DELETE FROM feature_flags WHERE name = $1 AND tenant = $2`, name, tenant)
+	s.flags.invalidate()
+	return err
+}
+
+// flagReport is the state of a flag served by /api/admin/config.
+type flagReport struct {
+	featureFlag
+	flagState
+	Tenants map[string]flagState `json:"tenants,omitempty"`
+}
+
+// handleAdminConfig serves the deployment configuration and the state of
+// every feature flag, deployment-wide and for each tenant with a rule. POST
+// stores a flag rule and DELETE removes the rule for the name and tenant
+// query parameters.
+func (s *server) handleAdminConfig(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var rule flagRule
+		if err := json.NewDecoder(req.Body).Decode(&rule); err != nil {
+			writeError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if !rule.known() {
+			writeError(w, "unknown feature flag", http.StatusBadRequest)
+			return
+		}
+		if err := s.setFlag(req.Context(), rule); err != nil {
+			storageError(w, "Storing feature flag", err)
+			return
+		}
+	case http.MethodDelete:
+		q := req.URL.Query()
+		if err := s.clearFlag(req.Context(), q.Get("name"), q.Get("tenant")); err != nil {
+			storageError(w, "Deleting feature flag", err)
+			return
+		}
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	tenants := map[string]bool{}
+	for t := range s.flags.static.Tenants {
+		tenants[t] = true
+	}
+	for t := range s.storedFlags().Tenants {
+		tenants[t] = true
+	}
+	var reports []flagReport
+	for _, f := range knownFlags {
+		r := flagReport{featureFlag: f, flagState: s.resolveFlag(f.Name, "")}
+		for t := range tenants {
+			if state := s.resolveFlag(f.Name, t); state != r.flagState {
+				if r.Tenants == nil {
+					r.Tenants = map[string]flagState{}
+				}
+				r.Tenants[t] = state
+			}
+		}
+		reports = append(reports, r)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"versions": supportedVersions(s.suites),
+		"flags":    reports,
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveFlag(t *testing.T) {
+	t.Setenv("FEATURE_FLAGS", `{"flags": {"pir": true}, "tenants": {"acme": {"pir": false, "query_cache": true}}}`)
+	t.Setenv("PIR_ENABLED", "false")
+	t.Setenv("READ_ONLY", "true")
+	s, _ := newTestServer(t)
+	for _, tt := range []struct {
+		name, tenant string
+		want         flagState
+	}{
+		{flagPIR, "", flagState{true, "FEATURE_FLAGS"}},
+		{flagPIR, "acme", flagState{false, "FEATURE_FLAGS"}},
+		{flagQueryCache, "acme", flagState{true, "FEATURE_FLAGS"}},
+		{flagQueryCache, "other", flagState{false, "default"}},
+		{flagReadOnly, "", flagState{true, "READ_ONLY"}},
+		{"missing", "", flagState{false, "unknown"}},
+	} {
+		if got := s.resolveFlag(tt.name, tt.tenant); got != tt.want {
+			t.Errorf("resolveFlag(%q, %q) = %+v, want %+v", tt.name, tt.tenant, got, tt.want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/config", nil)
+	req.Header.Set(tenantHeader(), "acme")
+	if s.flagEnabled(flagPIR, req) || !s.flagEnabled(flagPIR, nil) {
+		t.Error("flagEnabled ignores the tenant of the request")
+	}
+	if !(flagRule{Name: flagPIR}).known() || (flagRule{Name: "missing"}).known() {
+		t.Error("flagRule.known")
+	}
+}
+
+func TestAdminConfigFlags(t *testing.T) {
+	s, srv := newDBTestServer(t)
+	tenant := testName(t)
+	do := func(method, path, body string) int {
+		req := adminRequest(t, method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	t.Cleanup(func() { s.kv.db().Exec(`DELETE FROM feature_flags WHERE tenant = $1`, tenant) })
+
+	if status := do(http.MethodPost, "/api/admin/config", `{"name": "missing", "tenant": "`+tenant+`", "enabled": true}`); status != http.StatusBadRequest {
+		t.Errorf("unknown flag stored with %d", status)
+	}
+	if status := do(http.MethodPost, "/api/admin/config", `{"name": "pir", "tenant": "`+tenant+`", "enabled": true}`); status != http.StatusOK {
+		t.Fatalf("storing a flag answered %d", status)
+	}
+	if got := s.resolveFlag(flagPIR, tenant); got != (flagState{true, "database"}) {
+		t.Errorf("stored flag resolved to %+v", got)
+	}
+
+	req := adminRequest(t, http.MethodGet, srv.URL+"/api/admin/config", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Flags []flagReport `json:"flags"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range report.Flags {
+		if f.Name == flagPIR && f.Tenants[tenant] != (flagState{true, "database"}) {
+			t.Errorf("config report for %s lacks the tenant rule: %+v", f.Name, f.Tenants)
+		}
+	}
+
+	if status := do(http.MethodDelete, "/api/admin/config?name=pir&tenant="+tenant, ""); status != http.StatusOK {
+		t.Fatalf("deleting a flag answered %d", status)
+	}
+	if got := s.resolveFlag(flagPIR, tenant); got.Source == "database" {
+		t.Errorf("deleted flag resolved to %+v", got)
+	}
+}
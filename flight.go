@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var storageCoalesced = newCounter("migp_storage_coalesced_total", "Storage calls served by a concurrent identical call by operation.", "op")
+
+// flight is a call in progress or completed within a flightGroup.
+type flight struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+// flightGroup coalesces concurrent identical storage fetches, so that a burst
+// of queries for one bucket, as during a credential stuffing attack, runs a
+// single database query whose result is shared by every waiter.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// do runs fetch for key unless a fetch for key is already in progress, in
+// which case it waits for and returns that fetch's result. A waiter whose
+// shared fetch was cut short by the deadline of the caller running it fetches
+// again under its own ctx. The returned value is shared and must not be
+// modified.
+func (g *flightGroup) do(ctx context.Context, op, key string, fetch func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		storageCoalesced.Inc(op)
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if isContextError(f.err) && ctx.Err() == nil {
+			return fetch(ctx)
+		}
+		return f.value, f.err
+	}
+	if g.flights == nil {
+		g.flights = map[string]*flight{}
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.value, f.err = fetch(ctx)
+	return f.value, f.err
+}
+
+// isContextError reports whether err stems from a canceled or expired
+// context.
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
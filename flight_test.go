@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) ([]byte, error) {
+		calls.Add(1)
+		<-release
+		return []byte("bucket"), nil
+	}
+
+	coalesced := func() float64 {
+		v, _, _, _ := storageCoalesced.total(func(v []string) bool { return v[0] == "test_get" })
+		return v
+	}
+	before := coalesced()
+	var wg sync.WaitGroup
+	results := make([]string, 8)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := g.do(context.Background(), "test_get", "0a1b2", fetch)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = string(value)
+		}()
+	}
+	// Let every caller join the flight before it completes.
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if coalesced()-before == float64(len(results)-1) {
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Errorf("%d concurrent fetches ran %d times, want once", len(results), calls.Load())
+	}
+	for _, r := range results {
+		if r != "bucket" {
+			t.Fatalf("caller got %q", r)
+		}
+	}
+	if _, err := g.do(context.Background(), "test_get", "0a1b2", fetch); err != nil || calls.Load() != 2 {
+		t.Errorf("completed flight reused: %d calls, %v", calls.Load(), err)
+	}
+}
+
+func TestFlightGroupDeadline(t *testing.T) {
+	var g flightGroup
+	started := make(chan struct{})
+	short, cancel := context.WithCancel(context.Background())
+	go g.do(short, "test_deadline", "0a1b2", func(ctx context.Context) ([]byte, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+
+	// A waiter outliving the caller that ran the fetch fetches again.
+	done := make(chan error)
+	go func() {
+		value, err := g.do(context.Background(), "test_deadline", "0a1b2", func(ctx context.Context) ([]byte, error) {
+			return []byte("retried"), nil
+		})
+		if err == nil && string(value) != "retried" {
+			err = errors.New("waiter got " + string(value))
+		}
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if !isContextError(ctx.Err()) || isContextError(errors.New("timeout")) {
+		t.Error("isContextError")
+	}
+}
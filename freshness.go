@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The freshness report summarizes how current the corpus is, so that
+// operators can show the deployment keeps up with new breaches: when the
+// corpus last changed, against FRESHNESS_MAX_AGE (default 7 days), when the
+// last batch was ingested, what each source ingested over the report period,
+// and, with buckets stored in PostgreSQL, how many buckets of each suite
+// were not modified for FRESHNESS_STALE_DAYS (default 30). Buckets last
+// modified before their modification times were recorded count as
+// untracked. /api/admin/freshness serves the report, with the days query
+// parameter overriding FRESHNESS_STALE_DAYS.
+//
+// With FRESHNESS_REPORT_INTERVAL set, one instance also publishes the report
+// every interval as a MIGP.Corpus.FreshnessReport event to webhook and Event
+// Grid subscribers, which can forward it to mail. The report period is the
+// interval, 24 hours if unset.
+
+// eventFreshnessReport is the event type of scheduled freshness reports.
+const eventFreshnessReport = "MIGP.Corpus.FreshnessReport"
+
+// freshnessReport is the freshness report, see above.
+type freshnessReport struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	Generation  int64     `json:"generation"`
+
+	// LastChangeAt is when the corpus generation last switched, CorpusAge
+	// the time since, and Current whether that is within MaxAge.
+	LastChangeAt *time.Time `json:"lastChangeAt,omitempty"`
+	CorpusAge    string     `json:"corpusAge,omitempty"`
+	MaxAge       string     `json:"maxAge"`
+	Current      bool       `json:"current"`
+
+	// LastIngestionAt is when the last journaled batch was applied.
+	LastIngestionAt *time.Time `json:"lastIngestionAt,omitempty"`
+
+	Period         string            `json:"period"`
+	Sources        []sourceFreshness `json:"sources"`
+	StaleAfterDays int               `json:"staleAfterDays"`
+	Suites         []suiteFreshness  `json:"suites,omitempty"`
+}
+
+// sourceFreshness is what a source ingested. Batches and Entries count the
+// batches appended over the report period.
+type sourceFreshness struct {
+	ID              string     `json:"id"`
+	Enabled         bool       `json:"enabled"`
+	LastIngestionAt *time.Time `json:"lastIngestionAt,omitempty"`
+	Batches         int64      `json:"batches"`
+	Entries         int64      `json:"entries"`
+}
+
+// suiteFreshness counts the stale buckets of a suite.
+type suiteFreshness struct {
+	Version          uint16 `json:"version"`
+	Buckets          int64  `json:"buckets"`
+	StaleBuckets     int64  `json:"staleBuckets"`
+	UntrackedBuckets int64  `json:"untrackedBuckets"`
+}
+
+// freshnessPeriod returns the report period, see above.
+func freshnessPeriod() time.Duration {
+	if interval := envDuration("FRESHNESS_REPORT_INTERVAL", 0); interval > 0 {
+		return interval
+	}
+	return 24 * time.Hour
+}
+
+// freshnessReport computes the report for buckets stale after staleDays.
+func (s *server) freshnessReport(ctx context.Context, staleDays int) (freshnessReport, error) {
+	now := time.Now().UTC()
+	period := freshnessPeriod()
+	maxAge := envDuration("FRESHNESS_MAX_AGE", 7*24*time.Hour)
+	r := freshnessReport{
+		GeneratedAt:    now,
+		MaxAge:         maxAge.String(),
+		Period:         period.String(),
+		Sources:        []sourceFreshness{},
+		StaleAfterDays: staleDays,
+	}
+	db := s.kv.db()
+
+	var changed sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT generation, updated_at FROM corpus_generation WHERE id = 1`).Scan(&r.Generation, &changed)
+	if err != nil && err != sql.ErrNoRows {
+		return r, err
+	}
+	if changed.Valid {
+		age := now.Sub(changed.Time)
+		r.LastChangeAt = &changed.Time
+		r.CorpusAge = age.Round(time.Minute).String()
+		r.Current = age <= maxAge
+	}
+
+	var ingested sql.NullTime
+	if err := db.QueryRowContext(ctx, `SELECT max(applied_at) FROM ingest_journal WHERE op = $1`, journalAppend).Scan(&ingested); err != nil {
+		return r, err
+	}
+	if ingested.Valid {
+		r.LastIngestionAt = &ingested.Time
+	}
+
+	query := `
+	SELECT s.id, s.enabled, max(j.applied_at),
+		count(j.seq) FILTER (WHERE j.created_at >= $2),
+		COALESCE(sum(j.entry_count) FILTER (WHERE j.created_at >= $2), 0)
+	FROM sources s LEFT JOIN ingest_journal j ON j.source = s.id AND j.op = $1 AND j.applied_at IS NOT NULL
+	GROUP BY s.id, s.enabled ORDER BY s.id`
+	rows, err := db.QueryContext(ctx, query, journalAppend, now.Add(-period))
+	if err != nil {
+		return r, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var src sourceFreshness
+		var last sql.NullTime
+		if err := rows.Scan(&src.ID, &src.Enabled, &last, &src.Batches, &src.Entries); err != nil {
+			return r, err
+		}
+		if last.Valid {
+			src.LastIngestionAt = &last.Time
+		}
+		r.Sources = append(r.Sources, src)
+	}
+	if err := rows.Err(); err != nil {
+		return r, err
+	}
+
+	if s.kv.buckets != nil {
+		return r, nil
+	}
+	query = `
+	SELECT count(*),
+		count(*) FILTER (WHERE updated_at < now() - make_interval(days => $2)),
+		count(*) FILTER (WHERE updated_at IS NULL)
+	FROM kv_store WHERE length(value) > 0 AND ` + suiteKeys
+	for _, cs := range s.suites {
+		st := suiteFreshness{Version: cs.cfg.Version}
+		if err := db.QueryRowContext(ctx, query, cs.bucketKey(""), staleDays).Scan(&st.Buckets, &st.StaleBuckets, &st.UntrackedBuckets); err != nil {
+			return r, err
+		}
+		r.Suites = append(r.Suites, st)
+	}
+	return r, nil
+}
+
+// handleFreshness serves the freshness report, see above.
+func (s *server) handleFreshness(w http.ResponseWriter, req *http.Request) {
+	days := envInt("FRESHNESS_STALE_DAYS", 30)
+	if v := req.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 3650 {
+			writeError(w, "days must be between 1 and 3650", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	r, err := s.freshnessReport(req.Context(), days)
+	if err != nil {
+		storageError(w, "Computing freshness report", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, r)
+}
+
+// runFreshnessReports publishes the freshness report every
+// FRESHNESS_REPORT_INTERVAL until ctx is done. It returns at once if the
+// interval is not set.
+func (s *server) runFreshnessReports(ctx context.Context) {
+	interval := envDuration("FRESHNESS_REPORT_INTERVAL", 0)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := s.ensureStorage(); err != nil {
+			log.Println("Freshness report skipped:", err)
+			continue
+		}
+		_, err := s.runScheduledJob(ctx, "freshness-report", func(ctx context.Context) error {
+			r, err := s.freshnessReport(ctx, envInt("FRESHNESS_STALE_DAYS", 30))
+			if err != nil {
+				return err
+			}
+			switch {
+			case r.LastChangeAt == nil:
+				log.Println("Corpus generation was never switched")
+			case !r.Current:
+				log.Printf("Corpus is older than FRESHNESS_MAX_AGE: last changed %s ago", r.CorpusAge)
+			}
+			s.events.Publish(eventFreshnessReport, "migp/corpus/freshness", r)
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Println("Freshness report failed:", err)
+		}
+	}
+}
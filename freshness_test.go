@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFreshnessReport(t *testing.T) {
+	s, _ := newDBTestServer(t)
+	ctx := context.Background()
+	cs := s.suites[0]
+	key := cs.bucketKey(testName(t))
+	t.Cleanup(func() { s.kv.db().Exec(`DELETE FROM kv_store WHERE id = $1`, key) })
+
+	if _, err := s.kv.db().Exec(`INSERT INTO kv_store (id, value) VALUES ($1, 'entry')`, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.kv.db().Exec(`UPDATE kv_store SET updated_at = now() - interval '40 days' WHERE id = $1`, key); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.freshnessReport(ctx, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Suites) == 0 || r.Suites[0].StaleBuckets < 1 {
+		t.Errorf("stale bucket not counted: %+v", r.Suites)
+	}
+
+	// Modifying the bucket marks it as updated.
+	_, version, err := s.kv.GetVersioned(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.kv.CompareAndSwap(ctx, key, version, []byte("entries")); err != nil || !ok {
+		t.Fatalf("updating bucket: %v, %v", ok, err)
+	}
+	var updated time.Time
+	if err := s.kv.db().QueryRow(`SELECT updated_at FROM kv_store WHERE id = $1`, key).Scan(&updated); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(updated) > time.Hour {
+		t.Errorf("bucket updated at %s after modification", updated)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// The fuzz targets parse untrusted input the way the handler does, and must
+// return an error rather than panic on any input. Without -fuzz only their
+// seeds run, as part of go test.
+
+// addSeeds adds seeds to the corpus of f.
+func addSeeds(f *testing.F, seeds ...string) {
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+}
+
+// FuzzQueryRequest decodes and validates a query body as handleEvaluate does.
+func FuzzQueryRequest(f *testing.F) {
+	s, err := newServer(migp.DefaultServerConfig())
+	if err != nil {
+		f.Fatal(err)
+	}
+	addSeeds(f,
+		`{"version":1,"bucketID":"0a1b2","blindElement":"AAAA"}`,
+		`{"version":1,"bucketID":"0a1b2c3","bucketIDBitSize":28,"blindElement":"AAAA"}`,
+		`{"version":0}`, `{}`, `[]`, `null`,
+	)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s.decodeQuery("", data)
+	})
+}
+
+// FuzzDecodeEnvelope decodes a custom handler envelope and its bindings.
+func FuzzDecodeEnvelope(f *testing.F) {
+	addSeeds(f,
+		`{"Data":{"item":"{\"credentials\":[\"a:b\"]}"},"Metadata":{}}`,
+		`{"Data":{"req":{"Url":"http://localhost/api/query","Method":"POST","Query":{},"Headers":{"Content-Type":["application/json"]},"Params":{},"Body":"{}"}},"Metadata":{}}`,
+		`{"Data":{"req":{"Url":"%zz","Method":"GET"}}}`,
+		`{"Data":{"timer":{"IsPastDue":true}}}`,
+	)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		inv, err := decodeInvocation(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		names := make([]string, 0, len(inv.Data))
+		for name := range inv.Data {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			inv.bindingString(name)
+			if req, err := inv.httpRequest(name); err == nil {
+				req.Body.Close()
+			}
+		}
+	})
+}
+
+// FuzzIngestRequest decodes an ingestion request and splits its credentials.
+func FuzzIngestRequest(f *testing.F) {
+	addSeeds(f,
+		`{"credentials":["alice@example.com:hunter2"],"metadata":"x","numVariants":9}`,
+		`{"version":2,"credentials":["no-colon","::",":"],"includeUsernameVariant":false}`,
+		`{"credentials":[]}`,
+	)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := decodeIngestRequest(data)
+		if err != nil {
+			return
+		}
+		for _, credential := range req.Credentials {
+			splitCredential(credential)
+		}
+	})
+}
+
+// FuzzContinuation decodes a continuation token of a chunked query.
+func FuzzContinuation(f *testing.F) {
+	addSeeds(f,
+		continuation{Version: 1, BucketID: "0a1b2", Bits: 20, Offset: 65536, Chunk: minChunkSize, Digest: make([]byte, 16)}.encode(),
+		"", "e30", "!!!",
+	)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeContinuation(string(data))
+	})
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/erikathea/migp-go/pkg/migp"
 	_ "github.com/lib/pq"
@@ -15,99 +20,577 @@ import (
 
 // kvStore is a wrapper for a KV store backed by PostgreSQL.
 type kvStore struct {
-	db *sql.DB
+	cluster       *dbCluster
+	slowThreshold time.Duration
+	retryPolicy   retryPolicy
+	chaos         *faultInjector
+
+	// flights coalesces concurrent Gets of the same key, unless nil.
+	flights *flightGroup
+
+	// verifyChecksums checks values read against their stored checksum.
+	verifyChecksums bool
+
+	// redactBuckets keeps bucket IDs out of log lines and errors.
+	redactBuckets bool
+
+	// tombstones marks removed entries deleted instead of rewriting their
+	// bucket, see tombstones.go.
+	tombstones bool
+
+	// limits caps the size of buckets at append, and limitExceeded, unless
+	// nil, is called with the size of a bucket an append exceeded them for.
+	limits        bucketLimits
+	limitExceeded func(id string, u bucketUsage)
+
+	// buckets keeps the buckets in another backend than the kv_store
+	// tables, unless nil. Checksums, splits and bucket limits are only
+	// maintained in kv_store.
+	buckets bucketBackend
 }
 
-// newKVStore initializes a new kvStore with a PostgreSQL database connection.
-func newKVStore(db *sql.DB) (*kvStore, error) {
-	kv := &kvStore{db: db}
+// newKVStore initializes a new kvStore with a PostgreSQL database cluster.
+// Calls taking longer than slowThreshold are logged, and transient errors are
+// retried according to retryPolicy.
+func newKVStore(cluster *dbCluster, slowThreshold time.Duration, retryPolicy retryPolicy) *kvStore {
+	return &kvStore{cluster: cluster, slowThreshold: slowThreshold, retryPolicy: retryPolicy}
+}
 
-	query := `
-	CREATE TABLE IF NOT EXISTS kv_store (
-		id TEXT NOT NULL,
-		value BYTEA,
-		PRIMARY KEY (id)
-	) PARTITION BY HASH (id);
-
-	CREATE TABLE IF NOT EXISTS kv_store_p0 PARTITION OF kv_store FOR VALUES WITH (MODULUS 4, REMAINDER 0);
-	CREATE TABLE IF NOT EXISTS kv_store_p1 PARTITION OF kv_store FOR VALUES WITH (MODULUS 4, REMAINDER 1);
-	CREATE TABLE IF NOT EXISTS kv_store_p2 PARTITION OF kv_store FOR VALUES WITH (MODULUS 4, REMAINDER 2);
-	CREATE TABLE IF NOT EXISTS kv_store_p3 PARTITION OF kv_store FOR VALUES WITH (MODULUS 4, REMAINDER 3);
-
-	CREATE TABLE IF NOT EXISTS kv_store_shadow (
-		id TEXT,
-		value BYTEA,
-		PRIMARY KEY (id, value)
-	);
-	CREATE INDEX IF NOT EXISTS kv_store_shadow_values ON kv_store_shadow (value);
-	`
-	_, err := db.Exec(query)
-	if err != nil {
-		return nil, err
-	}
+// db returns the currently active database.
+func (kv *kvStore) db() *sql.DB {
+	return kv.cluster.DB()
+}
 
-	return kv, nil
+// Get returns the value in the key identified by id. The returned value may
+// be shared with concurrent callers and must not be modified.
+func (kv *kvStore) Get(ctx context.Context, id string) ([]byte, error) {
+	if kv.flights == nil {
+		return kv.get(ctx, id)
+	}
+	return kv.flights.do(ctx, "get", id, func(ctx context.Context) ([]byte, error) {
+		return kv.get(ctx, id)
+	})
 }
 
-// Get returns the value in the key identified by id.
-func (kv *kvStore) Get(id string) ([]byte, error) {
-	query := `SELECT value FROM kv_store WHERE id = $1`
-	var value []byte
-	err := kv.db.QueryRow(query, id).Scan(&value)
+// get reads the value in the key identified by id from the database.
+func (kv *kvStore) get(ctx context.Context, id string) ([]byte, error) {
+	defer kv.observe(ctx, "get", id, time.Now())
+	query := `SELECT value, checksum, tombstones FROM kv_store WHERE id = $1`
+	var value, checksum []byte
+	var tombstones int
+	err := kv.retry(ctx, "get", func() error {
+		if err := kv.chaos.storageFault(); err != nil {
+			return err
+		}
+		if kv.buckets != nil {
+			var err error
+			value, err = kv.buckets.Get(ctx, id)
+			return err
+		}
+		return kv.db().QueryRowContext(ctx, query, id).Scan(&value, &checksum, &tombstones)
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return []byte{}, nil
 		}
 		return nil, err
 	}
+	if kv.buckets != nil {
+		return value, nil
+	}
+	if err := kv.verifyChecksum("get", id, value, checksum); err != nil {
+		return nil, err
+	}
+	if tombstones > 0 {
+		return kv.dropTombstoned(ctx, id, value)
+	}
 	return value, nil
 }
 
-// newServer returns a new server initialized using the provided configuration
-func newServer(cfg migp.ServerConfig) (*server, error) {
-	migpServer, err := migp.NewServer(cfg)
+// AppendUnique appends value to the key identified by id unless the same value
+// was appended before, reporting whether it was added. The shadow table
+// records every appended value so that re-ingesting a credential is a no-op.
+// bucketHash is the full 32-bit username hash of the entry when known, and
+// places it in the matching sub-bucket if the bucket has been split.
+func (kv *kvStore) AppendUnique(ctx context.Context, id string, bucketHash sql.NullInt64, value []byte) (bool, error) {
+	defer kv.observe(ctx, "append", id, time.Now())
+	var added bool
+	err := kv.retry(ctx, "append", func() error {
+		var err error
+		added, err = kv.appendUnique(ctx, id, bucketHash, value)
+		return err
+	})
+	return added, err
+}
+
+// appendUnique performs a single attempt of AppendUnique. Retrying after an
+// ambiguous commit failure is safe because the shadow table makes it
+// idempotent.
+func (kv *kvStore) appendUnique(ctx context.Context, id string, bucketHash sql.NullInt64, value []byte) (bool, error) {
+	if err := kv.chaos.storageFault(); err != nil {
+		return false, err
+	}
+	if kv.buckets != nil {
+		return kv.buckets.AppendUnique(ctx, id, bucketHash, value)
+	}
+	tx, err := kv.db().BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
+	defer tx.Rollback()
 
-	dbConnectionString := os.Getenv("DB_CONNECTION_ST")
-	if dbConnectionString == "" {
-		log.Println("DB_CONNECTION_ST environment variable not set. Using default localhost connection string.")
-		dbConnectionString = "user=user password=pw dbname=db sslmode=disable host=localhost"
+	if kv.tombstones {
+		// Take the row lock of the bucket first, as removals and
+		// compaction do, so that a tombstone cannot be compacted away
+		// between finding it and clearing it.
+		if _, err := tx.ExecContext(ctx, `SELECT 1 FROM kv_store WHERE id = $1 FOR UPDATE`, id); err != nil {
+			return false, err
+		}
 	}
-
-	log.Printf("Using database connection string: %s", dbConnectionString)
-	db, err := sql.Open("postgres", dbConnectionString)
+	res, err := tx.ExecContext(ctx, `INSERT INTO kv_store_shadow (id, value, bucket_hash) VALUES ($1, $2, $3) ON CONFLICT (id, value) DO NOTHING`, id, value, bucketHash)
 	if err != nil {
-		log.Fatalf("Error opening database: %v", err)
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err != nil || !kv.tombstones {
+			return false, err
+		}
+		revived, err := kv.reviveEntry(ctx, tx, id, value)
+		if err != nil || !revived {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+	if kv.limits.enabled() {
+		if ok, err := kv.checkLimits(ctx, tx, id, bucketHash, value); !ok {
+			return false, err
+		}
 	}
 
-	if err = db.Ping(); err != nil {
-		log.Fatalf("Error connecting to the database: %v", err)
+	query := `
+	INSERT INTO kv_store (id, value) VALUES ($1, $2)
+	ON CONFLICT (id) DO UPDATE SET value = kv_store.value || EXCLUDED.value, version = kv_store.version + 1`
+	if _, err := tx.ExecContext(ctx, query, id, value); err != nil {
+		return false, err
 	}
+	// The upsert above holds the bucket's row lock and bumps its version,
+	// so a concurrent split either sees this entry or fails its version
+	// check and retries.
+	if bucketHash.Valid {
+		if _, err := tx.ExecContext(ctx, appendSplitQuery, id, value, bucketHash); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
 
-	kv, err := newKVStore(db)
+// newServer returns a new server initialized using the provided configuration.
+// The server also answers requests for the versions in previous, so that
+// clients on older crypto suites keep working. Storage is connected on first
+// use so that it stays off the cold-start path.
+func newServer(cfg migp.ServerConfig, previous ...migp.ServerConfig) (*server, error) {
+	var suites []*cryptoSuite
+	for _, c := range append([]migp.ServerConfig{cfg}, previous...) {
+		cs, err := newCryptoSuite(c)
+		if err != nil {
+			return nil, err
+		}
+		suites = append(suites, cs)
+	}
+	passwords, err := newPasswordSuite()
+	if err != nil {
+		return nil, err
+	}
+	tenants, err := newTenants()
+	if err != nil {
+		return nil, err
+	}
+	shares, err := newSplitKeys(suites)
 	if err != nil {
 		return nil, err
 	}
+	responseKey, err := responseSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	hsmCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	err = newHSMKeys(hsmCtx, suites)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	canary, err := newCanary()
+	if err != nil {
+		return nil, err
+	}
+	privacy := privacyMode()
+	var tr *tracer
+	if privacy != privacyStrict {
+		tr = newTracer()
+	} else if os.Getenv("TRACE_EXPORT_URL") != "" {
+		log.Println("TRACE_EXPORT_URL is ignored in strict privacy mode.")
+	}
+	mirror := newMirror()
+	if privacy == privacyStrict && mirror != nil {
+		log.Println("MIRROR_URL is ignored in strict privacy mode.")
+		mirror = nil
+	}
+	analytics := newUsageAnalytics()
+	if privacy == privacyStrict && analytics != nil && analytics.epsilon == 0 {
+		log.Println("Usage analytics require ANALYTICS_DP_EPSILON in strict privacy mode. Disabling them.")
+		analytics = nil
+	}
 
 	return &server{
-		migpServer: migpServer,
-		kv:         kv,
+		cfg:          cfg,
+		suites:       suites,
+		passwords:    passwords,
+		tenants:      tenants,
+		shares:       shares,
+		responseKey:  responseKey,
+		manageSchema: manageSchema(),
+		chaos:        newFaultInjector(),
+		limiter:      newQueryLimiter(),
+		crypto:       newCryptoPool(),
+		rateLimiter:  newRateLimiter(),
+		budgets:      newTimeoutBudgets(),
+		flags:        newFeatureFlags(),
+		canary:       canary,
+		mirror:       mirror,
+		privacy:      privacy,
+		clientIDs:    newClientIdentifiers(privacy),
+		tracer:       tr,
+		analytics:    analytics,
+		outcomes:     newOutcomeAnalytics(),
+		journaling:   journalEnabled(),
+		rangeIndex:   envBool("RANGE_INDEX_ENABLED", false),
+
+		queryStatsRate: envRate("QUERY_STATS_SAMPLE_RATE"),
 	}, nil
 }
 
-// server wraps a MIGP server and backing KV store
+// server wraps a MIGP server, backing KV store and corpus event publisher
 type server struct {
-	migpServer *migp.Server
-	kv         *kvStore
+	cfg migp.ServerConfig
+
+	// suites holds every served crypto suite, the current one first.
+	suites []*cryptoSuite
+
+	// passwords is the suite of the password-only corpus, nil unless
+	// PASSWORD_CONFIG_JSON is set.
+	passwords *cryptoSuite
+
+	// tenants holds the tenants with a key of their own, see newTenants.
+	tenants map[string]*tenant
+
+	// shares holds the key shares served to the server answering queries
+	// when this one is its split-key evaluator, by version.
+	shares map[uint16]*oprfKey
+
+	// responseKey signs query responses unless nil, see respsign.go.
+	responseKey ed25519.PrivateKey
+
+	// manageSchema is false when the database schema is owned by DBAs and
+	// the server must never issue DDL.
+	manageSchema bool
+
+	// detached runs without a metadata database, as the dev command does.
+	// Every database call fails with errNoDatabase, so only the features
+	// served by the bucket backend work.
+	detached bool
+
+	// chaos injects faults for resilience testing when CHAOS_ENABLED is set.
+	chaos *faultInjector
+
+	// limiter bounds concurrent query evaluations and sheds excess load.
+	limiter *queryLimiter
+
+	// crypto evaluates OPRFs apart from the request goroutines, see
+	// cryptoPool.
+	crypto *cryptoPool
+
+	// rateLimiter limits the query rate of each caller when
+	// RATE_LIMIT_QPS is set.
+	rateLimiter *rateLimiter
+
+	// budgets bounds the time spent handling requests by route and tenant.
+	budgets *timeoutBudgets
+
+	// flags gates incrementally rolled out behaviours.
+	flags *featureFlags
+
+	// canary shadows queries against a candidate configuration or storage
+	// backend when one is configured.
+	canary *canary
+
+	// mirror copies a sample of queries to a secondary deployment when
+	// MIRROR_URL is set.
+	mirror *mirror
+
+	// privacy is the privacy mode, see privacyMode.
+	privacy string
+
+	// clientIDs filters client addresses and user agents, see
+	// clientIdentifiers.
+	clientIDs *clientIdentifiers
+
+	// tracer exports sampled request traces when TRACE_EXPORT_URL is set.
+	tracer *tracer
+
+	// analytics aggregates bucket accesses when ANALYTICS_ENABLED is set.
+	analytics *usageAnalytics
+
+	// outcomes counts the query outcomes clients report when
+	// OUTCOME_ANALYTICS_ENABLED is set.
+	outcomes *outcomeAnalytics
+
+	// journaling records ingestion batches before they are applied.
+	journaling bool
+
+	// rangeIndex also stores the SHA-1 hashes of ingested passwords for
+	// /api/range.
+	rangeIndex bool
+
+	// queryStatsRate is the fraction of queries whose protocol stats are
+	// logged, see queryStats.
+	queryStatsRate float64
+
+	// Storage is set up by ensureStorage and must not be used before it
+	// succeeds.
+	storageMu    sync.Mutex
+	storageReady atomic.Bool
+	kv           *kvStore
+	events       *eventPublisher
+	webhooks     *webhookStore
+
+	// draining is set once shutdown starts, failing the readiness probe.
+	draining atomic.Bool
+
+	// honeytokens caches the registered honeytokens checked by queries.
+	honeytokens honeytokenRegistry
+
+	// limitAlerts throttles the alerts of buckets exceeding their limits.
+	limitAlerts bucketLimitAlerts
+
+	// corpusGeneration caches the generation keying query response caching.
+	corpusGeneration corpusGeneration
+
+	// sketches caches the Bloom filters served by /api/sketch.
+	sketches sketchCache
+
+	// Golden vectors are generated on first use by goldenVectors.
+	vectorsOnce sync.Once
+	vectors     *goldenVectors
+	vectorsErr  error
+}
+
+var (
+	initDuration = newGauge("migp_init_duration_seconds", "Duration of the last storage initialization by phase.", "phase")
+	initAttempts = newCounter("migp_init_attempts_total", "Storage initialization attempts by result.", "result")
+)
+
+// ensureStorage connects to the database and prepares the storage layer the
+// first time it is called. Concurrent callers wait for the same attempt, and a
+// failed attempt is retried by the next caller.
+func (s *server) ensureStorage() error {
+	if s.storageReady.Load() {
+		return nil
+	}
+	s.storageMu.Lock()
+	defer s.storageMu.Unlock()
+	if s.storageReady.Load() {
+		return nil
+	}
+
+	start := time.Now()
+	if err := s.initStorage(); err != nil {
+		initAttempts.Inc("error")
+		return err
+	}
+	initDuration.Set(time.Since(start).Seconds(), "total")
+	initAttempts.Inc("success")
+	s.storageReady.Store(true)
+	return nil
+}
+
+// initStorage opens the database connections and applies the schema if needed.
+func (s *server) initStorage() error {
+	start := time.Now()
+	var cluster *dbCluster
+	var err error
+	if s.detached {
+		cluster, err = detachedCluster()
+	} else {
+		cluster, err = openCluster(databaseConnectionStrings(), newConnectionOptions())
+	}
+	if err != nil {
+		return err
+	}
+	initDuration.Set(time.Since(start).Seconds(), "connect")
+	go cluster.reportStats(envDuration("DB_STATS_INTERVAL", 15*time.Second))
+
+	db := cluster.DB()
+	start = time.Now()
+	switch {
+	case s.detached:
+		// There is no database to apply the schema to.
+	case s.manageSchema:
+		applied, err := ensureSchema(db)
+		if err != nil {
+			cluster.Close()
+			return fmt.Errorf("applying schema: %w", err)
+		}
+		if applied {
+			log.Printf("Applied database schema version %d", schemaVersion)
+		}
+	default:
+		if version, err := storedSchemaVersion(db); err != nil {
+			log.Println("Reading schema version failed:", err)
+		} else if version < schemaVersion {
+			log.Printf("Database schema version %d is older than %d and DB_MANAGE_SCHEMA is false. Apply the output of `handler schema`.", version, schemaVersion)
+		}
+	}
+	initDuration.Set(time.Since(start).Seconds(), "schema")
+
+	backend, err := openBucketBackend(storageBackend(), s.manageSchema)
+	if err != nil {
+		cluster.Close()
+		return err
+	}
+
+	s.kv = newKVStore(cluster, envDuration("DB_SLOW_QUERY_THRESHOLD", 500*time.Millisecond), newRetryPolicy())
+	s.kv.buckets = backend
+	s.kv.chaos = s.chaos
+	s.kv.verifyChecksums = envBool("BUCKET_CHECKSUM_VERIFY", true)
+	s.kv.redactBuckets = s.privacy == privacyStrict
+	s.kv.tombstones = tombstonesEnabled()
+	s.kv.limits = bucketLimitsFromEnv()
+	s.kv.limitExceeded = s.alertBucketLimit
+	if envBool("BUCKET_FETCH_COALESCING", true) {
+		s.kv.flights = &flightGroup{}
+	}
+	s.webhooks = newWebhookStore(cluster)
+	s.events = newEventPublisher(s.webhooks)
+	if err := recordKeyFingerprint(db, s.events, &s.cfg); err != nil {
+		log.Println("Recording key fingerprint failed:", err)
+	}
+	if s.analytics != nil {
+		go s.recordAnalytics()
+	}
+	if s.outcomes != nil {
+		go s.recordOutcomes()
+	}
+	return nil
+}
+
+// withStorage wraps a handler that needs the storage layer, failing the
+// request with a 503 if the storage cannot be initialized.
+func (s *server) withStorage(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := s.ensureStorage(); err != nil {
+			log.Println("Storage initialization failed:", err)
+			writeError(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// withStorageInvocation wraps an invocationFunc that needs the storage layer.
+func (s *server) withStorageInvocation(f invocationFunc) invocationFunc {
+	return func(ctx context.Context, inv *invocationRequest, resp *invocationResponse) error {
+		if err := s.ensureStorage(); err != nil {
+			return err
+		}
+		return f(ctx, inv, resp)
+	}
 }
 
 // handler handles client requests
 func (s *server) handler() http.Handler {
+	if adminDisabled() {
+		log.Println("ADMIN_API_KEY environment variable not set. Admin API disabled.")
+	}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/query", s.handleEvaluate)
-	return mux
+	api := s.tracer.wrap(withRequestID(withTenantAuth(s.withCorpusGeneration(newSLOTracker(mux).wrap(newSecurityHeaders(mux).wrap(withRecovery(mux, mux)))))))
+	query := s.withBudget(budgetQuery, s.withRateLimit(s.withTenantKey(s.withMirror(s.chaos.wrap(s.withStorage(s.withResponseSignature(s.handleEvaluate)))))))
+	mux.HandleFunc("/api/query", withNextCorpus(withQueryAuth(query), query))
+	batch := s.withBudget(budgetQuery, s.withRateLimit(s.withTenantKey(s.withMirror(s.chaos.wrap(s.withStorage(s.withResponseSignature(s.handleQueryBatch)))))))
+	mux.HandleFunc("/api/query/batch", withNextCorpus(withQueryAuth(batch), batch))
+	mux.HandleFunc("/api/query/next", withQueryAuth(s.withBudget(budgetQuery, s.withTenantKey(s.withStorage(s.withResponseSignature(s.handleQueryContinuation))))))
+	mux.HandleFunc("/api/passwords/config", s.withPasswords(s.handlePasswordConfig))
+	mux.HandleFunc("/api/passwords/query", withQueryAuth(s.withBudget(budgetQuery, s.withRateLimit(s.withPasswords(s.withStorage(s.handlePasswordQuery))))))
+	mux.HandleFunc("/api/range/", withQueryAuth(s.withBudget(budgetQuery, s.withRateLimit(s.withStorage(s.handleRange)))))
+	mux.HandleFunc("/api/outcomes", withQueryAuth(s.withRateLimit(s.withTenantKey(s.handleOutcome))))
+	mux.HandleFunc("/api/config", s.withTenantKey(s.handleConfig))
+	mux.HandleFunc("/api/attestation", s.withTenantKey(s.withStorage(s.handleAttestation)))
+	mux.HandleFunc("/api/buckets", s.withStorage(s.handleBucketLayout))
+	mux.HandleFunc("/api/pir", withQueryAuth(s.withBudget(budgetQuery, s.withRateLimit(s.withStorage(s.withSQLBuckets(s.handlePIR))))))
+	mux.HandleFunc("/api/sketch", s.withStorage(s.withSQLBuckets(s.handleSketch)))
+	mux.HandleFunc("/api/snapshots/manifest", s.withStorage(s.withSQLBuckets(s.handleSnapshotManifest)))
+	mux.HandleFunc("/api/metrics", requireAdmin(handleMetrics))
+	mux.HandleFunc("/api/scale", requireAdmin(s.handleScale))
+	mux.HandleFunc("/api/auth/token", newTokenHandler())
+	mux.HandleFunc("/api/admin/config", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.withIdempotency(s.handleAdminConfig)))))
+	mux.HandleFunc("/api/admin/webhooks", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.withIdempotency(s.handleWebhooks)))))
+	mux.HandleFunc("/api/admin/seed", s.withBudget(budgetAdmin, requireIngest(s.withStorage(s.withIdempotency(s.withWritable(s.handleSeed))))))
+	mux.HandleFunc("/api/admin/backup", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.withSQLBuckets(s.withIdempotency(s.handleBackup))))))
+	mux.HandleFunc("/api/admin/db", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.handleAdminDB))))
+	mux.HandleFunc("/api/admin/honeytokens", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.withIdempotency(s.withWritable(s.handleHoneytokens))))))
+	mux.HandleFunc("/api/admin/sources", s.withBudget(budgetAdmin, requireIngest(s.withStorage(s.withIdempotency(s.withWritable(s.handleSources))))))
+	mux.HandleFunc("/api/admin/sources/rollback", s.withBudget(budgetAdmin, requireIngest(s.withStorage(s.withIdempotency(s.withWritable(s.handleSourceAction(sourceRollback)))))))
+	mux.HandleFunc("/api/admin/sources/reingest", s.withBudget(budgetAdmin, requireIngest(s.withStorage(s.withIdempotency(s.withWritable(s.handleSourceAction(sourceReingest)))))))
+	mux.HandleFunc("/api/admin/analytics", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.handleAnalytics))))
+	mux.HandleFunc("/api/admin/analytics/outcomes", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.handleOutcomeAnalytics))))
+	mux.HandleFunc("/api/admin/corpus/promote", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.withSQLBuckets(s.withTenantKey(s.withIdempotency(s.withWritable(s.handlePromoteCorpus))))))))
+	mux.HandleFunc("/api/admin/freshness", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.handleFreshness))))
+	mux.HandleFunc("/api/admin/stats/corpus", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.withSQLBuckets(s.withIdempotency(s.handleCorpusStats))))))
+	mux.HandleFunc("/api/admin/journal", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.withIdempotency(s.withWritable(s.handleJournal))))))
+	mux.HandleFunc("/api/admin/buckets/repair", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.withSQLBuckets(s.withIdempotency(s.withWritable(s.handleRepairBucket)))))))
+	mux.HandleFunc("/api/admin/buckets/scrub", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.withSQLBuckets(s.withIdempotency(s.handleScrub))))))
+	mux.HandleFunc("/api/admin/buckets/compact", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.withSQLBuckets(s.withIdempotency(s.withWritable(s.handleCompact)))))))
+	mux.HandleFunc("/api/admin/buckets/overflow", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.withSQLBuckets(s.withIdempotency(s.withWritable(s.handleOverflow)))))))
+	mux.HandleFunc("/api/admin/buckets/rebalance", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.withSQLBuckets(s.withIdempotency(s.withWritable(s.handleRebalance)))))))
+	mux.HandleFunc("/api/admin/jobs", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.handleJobs))))
+	mux.HandleFunc("/api/admin/events", s.withBudget(budgetAdmin, requireAdmin(s.handleEvents)))
+	mux.HandleFunc("/api/admin/key", s.withBudget(budgetAdmin, requireAdmin(s.withStorage(s.handleKeyStatus))))
+	mux.HandleFunc("/api/oprf/partial", s.withBudget(budgetQuery, requireRole(roleEvaluator, s.handleOPRFPartial)))
+	mux.HandleFunc("/api/admin/ui/", newDashboardHandler())
+	mux.HandleFunc("/api/debug/vectors", s.handleVectors)
+	mux.HandleFunc("/api/demo/", newDemoHandler())
+	mux.HandleFunc("/healthz", s.handleLiveness)
+	mux.HandleFunc("/readyz", s.handleReadiness)
+	mux.HandleFunc("/version", s.handleVersion)
+
+	// Invocations that the host wraps in the custom handler envelope are
+	// dispatched by function name. HTTP functions reach the routes above
+	// directly when the host forwards the HTTP request instead.
+	router := newInvocationRouter()
+	router.Handle("HttpQuery", httpInvocation(api, "req", "res"))
+	router.Handle("HttpQueryNext", httpInvocation(api, "req", "res"))
+	router.Handle("HttpQueryBatch", httpInvocation(api, "req", "res"))
+	router.Handle("HttpOPRF", httpInvocation(api, "req", "res"))
+	router.Handle("HttpPasswords", httpInvocation(api, "req", "res"))
+	router.Handle("HttpRange", httpInvocation(api, "req", "res"))
+	router.Handle("HttpOutcomes", httpInvocation(api, "req", "res"))
+	router.Handle("HttpConfig", httpInvocation(api, "req", "res"))
+	router.Handle("HttpAttestation", httpInvocation(api, "req", "res"))
+	router.Handle("HttpAuth", httpInvocation(api, "req", "res"))
+	router.Handle("HttpBuckets", httpInvocation(api, "req", "res"))
+	router.Handle("HttpPIR", httpInvocation(api, "req", "res"))
+	router.Handle("HttpSketch", httpInvocation(api, "req", "res"))
+	router.Handle("HttpSnapshots", httpInvocation(api, "req", "res"))
+	router.Handle("HttpAdmin", httpInvocation(api, "req", "res"))
+	router.Handle("HttpMetrics", httpInvocation(api, "req", "res"))
+	router.Handle("HttpScale", httpInvocation(api, "req", "res"))
+	router.Handle("HttpDebug", httpInvocation(api, "req", "res"))
+	router.Handle("HttpDemo", httpInvocation(api, "req", "res"))
+	router.Handle("QueueIngest", s.withBudgetInvocation(budgetIngest, s.withStorageInvocation(s.invokeQueueIngest)))
+	router.Handle("TimerMaintenance", s.withStorageInvocation(s.invokeTimerMaintenance))
+	if underFunctions() {
+		mux.Handle("/", router)
+	}
+	return api
 }
 
 // handleIndex returns a welcome message
@@ -115,73 +598,218 @@ func (s *server) handleIndex(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "Welcome to the MIGP demo server\n")
 }
 
-// handleConfig returns the MIGP configuration
+// handleConfig returns the MIGP configuration of the current suite, or of the
+// suite for the version query parameter, along with the PIR parameters when
+// PIR is enabled. Tenants with a key of their own get the configuration of
+// their suites. Supported versions are listed in the X-MIGP-Versions header.
 func (s *server) handleConfig(w http.ResponseWriter, req *http.Request) {
+	suites := s.tenantSuites(tenantOf(req))
+	cs := suiteParamIn(w, req, suites)
+	if cs == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(s.tenants) > 0 {
+		w.Header().Set("Vary", tenantHeader())
+	}
+	w.Header().Set("X-MIGP-Versions", strings.Join(supportedVersions(suites), ", "))
 	encoder := json.NewEncoder(w)
-	cfg := s.migpServer.Config().Config
+	cfg := struct {
+		migp.Config
+		PIR                *pirParams    `json:"pir,omitempty"`
+		Privacy            privacyReport `json:"privacy"`
+		ResponseSigningKey []byte        `json:"responseSigningKey,omitempty"`
+	}{cs.server.Config().Config, s.pirParams(req), s.privacyReport(), nil}
+	if s.responseKey != nil {
+		cfg.ResponseSigningKey = s.responseKey.Public().(ed25519.PublicKey)
+	}
 	if err := encoder.Encode(cfg); err != nil {
 		log.Println("Writing response failed:", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 }
 
+// queryRequest is the body of a query. BucketIDBitSize is set by clients
+// requesting a sub-bucket of a split bucket, and is otherwise the suite's
+// bucket ID bit length.
+type queryRequest struct {
+	migp.ClientRequest
+	BucketIDBitSize int `json:"bucketIDBitSize"`
+}
+
+// decodeQuery parses and validates the body of a query of tenant, returning
+// the suite that serves it.
+func (s *server) decodeQuery(tenant string, body []byte) (queryRequest, *cryptoSuite, *validationError) {
+	var request queryRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return request, nil, invalid(errMalformedJSON, "request body is not a valid query: %v", err)
+	}
+	cs, verr := s.validateVersion(tenant, request.Version)
+	if verr == nil {
+		verr = validateQuery(cs, request.ClientRequest, request.BucketIDBitSize)
+	}
+	return request, cs, verr
+}
+
 // handleEvaluate serves a request from a MIGP client
 func (s *server) handleEvaluate(w http.ResponseWriter, req *http.Request) {
-	body, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		log.Println("Request body reading failed:", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
+	st, ctx := s.newQueryStats(req)
+	var (
+		body        []byte
+		notModified bool
+	)
+	if req.Method == http.MethodGet {
+		var ok bool
+		if w, body, notModified, ok = s.cacheableQuery(w, req); !ok {
+			return
+		}
+	} else {
+		buf, err := readBody(req.Body)
+		if err != nil {
+			log.Println("Request body reading failed:", err)
+			writeError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		defer putBuffer(buf)
+		body = buf.Bytes()
 	}
 
-	var request migp.ClientRequest
-	if err := json.Unmarshal(body, &request); err != nil {
-		log.Println("Request body unmarshal failed:", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	request, cs, verr := s.decodeQuery(tenantOf(req), body)
+	if verr != nil {
+		verr.write(w)
+		return
+	}
+	if queriesNextCorpus(ctx) {
+		cs = cs.next()
+	} else {
+		s.checkHoneytokens(w, req, cs, request.BucketID, request.BucketIDBitSize)
+		s.analytics.record(cs, request.BucketID, request.BucketIDBitSize)
+	}
+	st.decoded(cs, request.BucketIDBitSize)
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	queued := time.Now()
+	release := s.limiter.acquire(w, req)
+	if release == nil {
+		return
+	}
+	st.queued(queued)
+	start := time.Now()
+	migpResponse, err := s.evaluate(ctx, cs, request.ClientRequest, suiteGetter{ctx, cs, s.kv, request.BucketIDBitSize})
+	release()
+	if cs == s.suites[0] {
+		s.canary.shadow(s, cs, request.ClientRequest, request.BucketIDBitSize, evaluation{migpResponse, err, time.Since(start)})
 	}
-
-	migpResponse, err := s.migpServer.HandleRequest(request, s.kv)
 	if err != nil {
-		log.Println("HandleRequest failed:", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		evaluationError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
+	written := time.Now()
+	if err := writeChunkedResponse(w, req, cs, request.BucketID, request.BucketIDBitSize, &migpResponse); err != nil {
+		log.Println("Writing response failed:", err)
+	}
+	st.written(written, 4+len(migpResponse.EvaluatedElement)+len(migpResponse.BucketContents))
+}
 
-	respBody, err := migpResponse.MarshalBinary()
-	log.Println(respBody)
+// loadConfig returns the current MIGP server configuration from CONFIG_JSON.
+func loadConfig() (migp.ServerConfig, error) {
+	configs, err := loadConfigs()
 	if err != nil {
-		log.Println("Response serialization failed:", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-	}
-	if _, err := w.Write(respBody); err != nil {
-		log.Println("Writing response failed:", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return migp.ServerConfig{}, err
 	}
+	return configs[0], nil
 }
 
 func main() {
-	listenAddr := ":8080"
-	if val, ok := os.LookupEnv("FUNCTIONS_CUSTOMHANDLER_PORT"); ok {
-		listenAddr = ":" + val
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		if err := parseServeFlags(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	} else if err := loadConfigFile(); err != nil {
+		log.Fatal(err)
 	}
-
-	var config migp.ServerConfig
-	configJSON := os.Getenv("CONFIG_JSON")
-	if configJSON == "" {
-		log.Fatal("CONFIG_JSON environment variable not set")
+	if err := resolveSecrets(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		var err error
+		switch os.Args[1] {
+		case "schema":
+			fmt.Print(schemaSQL())
+		case "bench":
+			err = runBench(os.Args[2:])
+		case "seed":
+			err = runSeed(os.Args[2:])
+		case "snapshot":
+			err = runSnapshot(os.Args[2:])
+		case "rebucket":
+			err = runRebucket(os.Args[2:])
+		case "restore":
+			err = runRestore(os.Args[2:])
+		case "repair-bucket":
+			err = runRepairBucket(os.Args[2:])
+		case "vectors":
+			err = runVectors()
+		case "version":
+			err = runVersion()
+		case "dev":
+			err = runDev(os.Args[2:])
+		case "build-corpus":
+			err = runBuildCorpus(os.Args[2:])
+		case "import-corpus":
+			err = runImportCorpus(os.Args[2:])
+		case "merge-corpus":
+			err = runMergeCorpus(os.Args[2:])
+		case "split-key":
+			err = runSplitKey()
+		case "hsm-key":
+			err = runHSMKey()
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	err := json.Unmarshal([]byte(configJSON), &config)
+	closeLogs, err := setupLogSinks()
 	if err != nil {
-		log.Fatalf("Error parsing CONFIG_JSON: %v", err)
+		log.Fatal(err)
 	}
-	s, err := newServer(config)
+	defer closeLogs()
+	configs, err := loadConfigs()
 	if err != nil {
 		log.Fatal(err)
 	}
+	s, err := newServer(configs[0], configs[1:]...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Warm the storage layer without holding up the listener; requests that
+	// arrive first wait for the same initialization.
+	go func() {
+		if err := s.ensureStorage(); err != nil {
+			log.Println("Storage initialization failed:", err)
+		}
+	}()
+
+	ctx, stop := context.WithCancel(context.Background())
+	go s.runMaintenanceSchedule(ctx)
+	go s.runFreshnessReports(ctx)
+	go s.runTenantKeyRefresh(ctx)
+	for _, run := range exporters {
+		go run(ctx)
+	}
 
-	log.Printf("About to listen on %s", listenAddr)
-	log.Fatal(http.ListenAndServe(listenAddr, s.handler()))
+	srv := newHTTPServer(listenAddress(), s.handler())
+	srv.ErrorLog = s.clientIDs.errorLog()
+	if err := s.run(srv, stop); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/mutator"
+	"github.com/lib/pq"
+)
+
+// Honeytokens are canary credentials planted in the corpus by operators.
+// Nobody legitimately checks them, so a query for one is a sign that a list
+// of stolen credentials containing it is being tested against the service.
+//
+// Queries are blinded, so the server only learns the bucket ID a query asks
+// for. A honeytoken triggers on every query for its bucket at the bit length
+// the client asked for, including queries for other usernames sharing the
+// bucket. Clients asking for split sub-buckets narrow that down.
+
+// eventHoneytokenTriggered is published, with severity "high", for queries
+// matching a honeytoken. Webhooks can subscribe to it alone to page on it.
+const eventHoneytokenTriggered = "MIGP.Security.HoneytokenTriggered"
+
+var honeytokenHits = newCounter("migp_honeytoken_hits_total", "Queries for the bucket of a honeytoken.")
+
+// honeytoken is a registered canary credential. Only the bucket of its
+// username and its encrypted corpus entries are stored, never the
+// credential itself.
+type honeytoken struct {
+	ID        int64     `json:"id"`
+	Version   uint16    `json:"version"`
+	Label     string    `json:"label"`
+	BucketID  string    `json:"bucketId"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	bucketHash uint32
+	entries    [][]byte
+}
+
+// honeytokenRegistry caches the registered honeytokens for query matching
+// and throttles their alerts.
+type honeytokenRegistry struct {
+	mu        sync.RWMutex
+	tokens    []honeytoken
+	loaded    bool
+	fetchedAt time.Time
+	// epoch counts invalidations, so that a reload that started before
+	// one does not mark its result fresh.
+	epoch int
+	// loading is set while a reload runs, so that only one does at a time.
+	loading atomic.Bool
+
+	// alerted holds when each honeytoken last alerted and suppressed the
+	// hits since then that did not, both guarded by alertMu.
+	alertMu    sync.Mutex
+	alerted    map[int64]time.Time
+	suppressed map[int64]int
+}
+
+// honeytokenCacheTTL is how long the registered honeytokens are cached,
+// HONEYTOKEN_CACHE_TTL (default 30s).
+var honeytokenCacheTTL = sync.OnceValue(func() time.Duration {
+	return envDuration("HONEYTOKEN_CACHE_TTL", 30*time.Second)
+})
+
+// honeytokenList returns the registered honeytokens. Once they are stale,
+// one caller reloads them in the background while every query keeps
+// matching the cached ones; only the first load is waited for.
+func (s *server) honeytokenList() []honeytoken {
+	r := &s.honeytokens
+	r.mu.RLock()
+	tokens, loaded := r.tokens, r.loaded
+	fresh := time.Since(r.fetchedAt) < honeytokenCacheTTL()
+	r.mu.RUnlock()
+	if fresh || !r.loading.CompareAndSwap(false, true) {
+		return tokens
+	}
+	if !loaded {
+		return s.reloadHoneytokens()
+	}
+	go s.reloadHoneytokens()
+	return tokens
+}
+
+// reloadHoneytokens replaces the cached honeytokens with the registered
+// ones and returns them. If they cannot be loaded, the cached ones are kept
+// until the next reload.
+func (s *server) reloadHoneytokens() []honeytoken {
+	r := &s.honeytokens
+	defer r.loading.Store(false)
+	r.mu.RLock()
+	epoch := r.epoch
+	r.mu.RUnlock()
+
+	tokens, err := s.loadHoneytokens(context.Background(), 0)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.epoch == epoch {
+		r.fetchedAt = time.Now()
+	}
+	if err != nil {
+		log.Println("Loading honeytokens failed:", err)
+		return r.tokens
+	}
+	r.tokens, r.loaded = tokens, true
+	return tokens
+}
+
+// loadHoneytokens reads every honeytoken, or only the one with id if it is
+// not zero.
+func (s *server) loadHoneytokens(ctx context.Context, id int64) ([]honeytoken, error) {
+	query := `
+	SELECT id, version, label, bucket_hash, entries, created_at FROM honeytokens
+	WHERE $1 = 0 OR id = $1 ORDER BY id`
+	rows, err := s.kv.db().QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []honeytoken{}
+	for rows.Next() {
+		var t honeytoken
+		var hash int64
+		if err := rows.Scan(&t.ID, &t.Version, &t.Label, &hash, (*pq.ByteaArray)(&t.entries), &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		t.bucketHash = uint32(hash)
+		if cs := s.suite(t.Version); cs != nil {
+			t.BucketID = migp.BucketIDToHex(t.bucketHash >> (32 - cs.cfg.BucketIDBitSize))
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// checkHoneytokens alerts if the query of req, for bucketID at bits of the
+// bucket ID bit length of cs, asks for the bucket of a honeytoken.
+func (s *server) checkHoneytokens(w http.ResponseWriter, req *http.Request, cs *cryptoSuite, bucketID string, bits int) {
+	if bits < cs.cfg.BucketIDBitSize {
+		bits = cs.cfg.BucketIDBitSize
+	}
+	raw, err := hex.DecodeString(bucketID)
+	if err != nil || len(raw) != 4 {
+		return
+	}
+	id := binary.BigEndian.Uint32(raw)
+	for _, t := range s.honeytokenList() {
+		if t.Version == cs.cfg.Version && t.bucketHash>>(32-bits) == id {
+			s.alertHoneytoken(w, req, t, bucketID, bits)
+		}
+	}
+}
+
+// alertHoneytoken publishes a honeytoken alert with the request metadata,
+// at most once per HONEYTOKEN_ALERT_INTERVAL (default 1m) for each
+// honeytoken; the hits in between are counted in the next alert.
+func (s *server) alertHoneytoken(w http.ResponseWriter, req *http.Request, t honeytoken, bucketID string, bits int) {
+	honeytokenHits.Inc()
+	r := &s.honeytokens
+	r.alertMu.Lock()
+	if r.alerted == nil {
+		r.alerted, r.suppressed = map[int64]time.Time{}, map[int64]int{}
+	}
+	if time.Since(r.alerted[t.ID]) < envDuration("HONEYTOKEN_ALERT_INTERVAL", time.Minute) {
+		r.suppressed[t.ID]++
+		r.alertMu.Unlock()
+		return
+	}
+	suppressed := r.suppressed[t.ID]
+	r.alerted[t.ID], r.suppressed[t.ID] = time.Now(), 0
+	r.alertMu.Unlock()
+
+	requestID := w.Header().Get("X-Request-ID")
+	data := map[string]interface{}{
+		"severity":        "high",
+		"honeytokenId":    t.ID,
+		"label":           t.Label,
+		"version":         t.Version,
+		"bucketId":        bucketID,
+		"bucketIdBitSize": bits,
+		"requestId":       requestID,
+		"tenant":          tenantOf(req),
+		"suppressedHits":  suppressed,
+	}
+	if s.clientIDs.mode == clientIDsStrip {
+		log.Printf("Honeytoken %d (%s) triggered by request %s", t.ID, t.Label, requestID)
+	} else {
+		client := s.clientIDs.record(clientAddress(req))
+		log.Printf("Honeytoken %d (%s) triggered by request %s from %s", t.ID, t.Label, requestID, client)
+		data["remoteAddr"] = client
+		data["forwardedFor"] = s.clientIDs.record(req.Header.Get("X-Forwarded-For"))
+		data["userAgent"] = s.clientIDs.record(req.UserAgent())
+	}
+	s.events.Publish(eventHoneytokenTriggered, "migp/honeytokens/"+strconv.FormatInt(t.ID, 10), data)
+}
+
+// honeytokenSpec registers a honeytoken.
+type honeytokenSpec struct {
+	Version  uint16 `json:"version"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Label    string `json:"label"`
+}
+
+// addHoneytoken ingests the credential of spec into the corpus of cs as a
+// breached password and registers it.
+func (s *server) addHoneytoken(ctx context.Context, cs *cryptoSuite, spec honeytokenSpec) (honeytoken, error) {
+	username, password := []byte(spec.Username), []byte(spec.Password)
+	t := honeytoken{Version: cs.cfg.Version, Label: spec.Label, bucketHash: cs.bucketHash(username)}
+	t.BucketID = migp.BucketIDToHex(t.bucketHash >> (32 - cs.cfg.BucketIDBitSize))
+	entries, err := encryptCredential(mutator.NewRDasMutator(), cs, username, password, nil, 0, false)
+	if err != nil {
+		return t, err
+	}
+	seq, err := s.journal(ctx, cs, journalAppend, entries)
+	if err != nil {
+		return t, err
+	}
+	if _, err := s.insert(ctx, entries); err != nil {
+		return t, err
+	}
+	s.journalApplied(ctx, seq)
+	s.corpusChanged()
+
+	for _, e := range entries {
+		t.entries = append(t.entries, e.Value)
+	}
+	query := `
+	INSERT INTO honeytokens (version, label, bucket_hash, entries) VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at`
+	err = s.kv.db().QueryRowContext(ctx, query, t.Version, t.Label, int64(t.bucketHash), pq.ByteaArray(t.entries)).Scan(&t.ID, &t.CreatedAt)
+	s.honeytokens.invalidate()
+	return t, err
+}
+
+// errUnknownHoneytoken is returned when deleting a honeytoken that is not
+// registered.
+var errUnknownHoneytoken = errors.New("unknown honeytoken")
+
+// deleteHoneytoken unregisters the honeytoken with id and removes its
+// entries from the corpus.
+func (s *server) deleteHoneytoken(ctx context.Context, id int64) error {
+	tokens, err := s.loadHoneytokens(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return errUnknownHoneytoken
+	}
+	t := tokens[0]
+	if cs := s.suite(t.Version); cs != nil {
+		key := cs.bucketKey(t.BucketID)
+		hash := int64(t.bucketHash)
+		entries := make([]journalEntry, len(t.entries))
+		for i, value := range t.entries {
+			entries[i] = journalEntry{Key: key, BucketHash: &hash, Value: value}
+		}
+		seq, err := s.journal(ctx, cs, journalRemove, entries)
+		if err != nil {
+			return err
+		}
+		if _, err := s.removeEntries(ctx, entries); err != nil {
+			return err
+		}
+		s.journalApplied(ctx, seq)
+		s.corpusChanged()
+	}
+	_, err = s.kv.db().ExecContext(ctx, `DELETE FROM honeytokens WHERE id = $1`, id)
+	s.honeytokens.invalidate()
+	return err
+}
+
+// invalidate makes the next honeytokenList reload the honeytokens.
+func (r *honeytokenRegistry) invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fetchedAt = time.Time{}
+	r.epoch++
+}
+
+// handleHoneytokens lists, registers and deletes honeytokens. Changes reach
+// the query path of other instances within HONEYTOKEN_CACHE_TTL.
+func (s *server) handleHoneytokens(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		tokens, err := s.loadHoneytokens(req.Context(), 0)
+		if err != nil {
+			storageError(w, "Listing honeytokens", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, tokens)
+
+	case http.MethodPost:
+		var spec honeytokenSpec
+		if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+			log.Println("Request body unmarshal failed:", err)
+			writeError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		cs, verr := s.validateVersion("", uint32(spec.Version))
+		if verr != nil {
+			verr.write(w)
+			return
+		}
+		if spec.Username == "" || spec.Password == "" {
+			invalid(errInvalidRequest, "username and password are required").write(w)
+			return
+		}
+		t, err := s.addHoneytoken(req.Context(), cs, spec)
+		if err != nil {
+			storageError(w, "Registering honeytoken", err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, t)
+
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(req.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, "missing or invalid honeytoken id", http.StatusBadRequest)
+			return
+		}
+		err = s.deleteHoneytoken(req.Context(), id)
+		if err == errUnknownHoneytoken {
+			writeErrorCode(w, errNotFound, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			storageError(w, "Deleting honeytoken", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
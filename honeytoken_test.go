@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func honeytokenHitCount() float64 {
+	v, _, _, _ := honeytokenHits.total(func([]string) bool { return true })
+	return v
+}
+
+func TestCheckHoneytokens(t *testing.T) {
+	receiver, deliveries := newEventReceiver(t)
+	t.Setenv("EVENT_WEBHOOK_URLS", receiver.URL)
+	t.Setenv("HONEYTOKEN_ALERT_INTERVAL", "1h")
+	s, _ := newTestServer(t)
+	cs := s.suites[0]
+	bits := cs.cfg.BucketIDBitSize
+	hash := cs.bucketHash([]byte("canary@example.com"))
+	s.honeytokens.tokens = []honeytoken{{ID: 1, Version: cs.cfg.Version, Label: "canary", bucketHash: hash}}
+	s.honeytokens.loaded, s.honeytokens.fetchedAt = true, time.Now()
+
+	before := honeytokenHitCount()
+	for _, tt := range []struct {
+		bucketID string
+		bits     int
+		hit      bool
+	}{
+		{migp.BucketIDToHex(hash >> (32 - bits)), 0, true},
+		{migp.BucketIDToHex(hash >> (32 - bits - 4)), bits + 4, true},
+		{migp.BucketIDToHex(hash>>(32-bits) ^ 1), bits, false},
+		{migp.BucketIDToHex(hash>>(32-bits-4) ^ 1), bits + 4, false},
+		{"not hex", bits, false},
+	} {
+		hits := honeytokenHitCount()
+		s.checkHoneytokens(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/query", nil), cs, tt.bucketID, tt.bits)
+		if hit := honeytokenHitCount() > hits; hit != tt.hit {
+			t.Errorf("query for %s at %d bits hit %v, want %v", tt.bucketID, tt.bits, hit, tt.hit)
+		}
+	}
+	if hits := honeytokenHitCount() - before; hits != 2 {
+		t.Fatalf("%g honeytoken hits, want 2", hits)
+	}
+
+	s.events.Wait()
+	alerts := 0
+	for _, d := range deliveries() {
+		var ev event
+		if err := json.Unmarshal(d.body, &ev); err == nil && ev.EventType == eventHoneytokenTriggered {
+			alerts++
+		}
+	}
+	if alerts != 1 || s.honeytokens.suppressed[1] != 1 {
+		t.Errorf("%d alerts with %d suppressed hits, want one alert and the second hit suppressed", alerts, s.honeytokens.suppressed[1])
+	}
+}
+
+func TestHandleHoneytokens(t *testing.T) {
+	s, srv := newDBTestServer(t)
+	do := func(method, query, body string) *http.Response {
+		req := adminRequest(t, method, srv.URL+"/api/admin/honeytokens"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	if resp := do(http.MethodPost, "", `{"username": "canary@example.com"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("honeytoken without a password answered %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	username := testName(t) + "@example.com"
+	resp := do(http.MethodPost, "", `{"username": "`+username+`", "password": "canary", "label": "test"}`)
+	var token honeytoken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || resp.StatusCode != http.StatusCreated || token.ID == 0 {
+		t.Fatalf("registering a honeytoken answered %d with %+v: %v", resp.StatusCode, token, err)
+	}
+
+	queries, err := prepareQueries(s.suites[0].cfg.Config, []string{username + ":canary"}, 1, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := honeytokenHitCount()
+	if status, err := queryStatus(http.DefaultClient, srv.URL+"/api/query", queries[0].body, queries[0].ctx, 0); err != nil || status != migp.InBreach {
+		t.Errorf("query for the honeytoken: %v, %v, want %v", status, err, migp.InBreach)
+	}
+	if honeytokenHitCount() == before {
+		t.Error("query for the honeytoken did not trigger it")
+	}
+
+	id := "?id=" + strconv.FormatInt(token.ID, 10)
+	if resp := do(http.MethodDelete, id, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("deleting the honeytoken answered %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if resp := do(http.MethodDelete, id, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleting it again answered %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if status, err := queryStatus(http.DefaultClient, srv.URL+"/api/query", queries[0].body, queries[0].ctx, 0); err != nil || status == migp.InBreach {
+		t.Errorf("query after deletion: %v, %v, want the credential gone", status, err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/cloudflare/circl/group"
+	"github.com/cloudflare/circl/oprf"
+)
+
+// With OPRF_KEY_PROVIDER set, the OPRF of the suites named in OPRF_KEY_IDS,
+// as {"1": "<key ID>"} by version, is evaluated by a key management service
+// holding the evaluation scalar 1/(k+m) of oprfKey as an elliptic curve
+// private key, for deployments that must not hold private keys in memory.
+// As with split keys, the privateKey of those suites in CONFIG_JSON is then
+// a placeholder and credentials are not ingested into them. The hsm-key
+// command prints the scalar of every suite of CONFIG_JSON, by version, as a
+// base64 PKCS #8 private key to import into the service.
+//
+// Key management services do not evaluate the OPRF as such, but agree on
+// keys by ECDH, which for a peer public key P returns the x-coordinate of sP
+// only. Each blinded element B is therefore agreed on twice, as B and B+G:
+// of the two points with the x-coordinate of sB, the evaluation is the one
+// whose sum with the public key sG has the x-coordinate of s(B+G).
+//
+// The providers are, in the builds profile.go lists:
+//
+//	aws-kms  AWS KMS, in AWS_REGION with the credentials of
+//	         AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN,
+//	         or at AWS_KMS_ENDPOINT
+//
+// Azure Key Vault and Managed HSM have no key agreement on elliptic curve
+// keys, so they cannot be providers.
+
+// keyAgreement agrees on keys with the private keys of a key management
+// service.
+type keyAgreement interface {
+	// publicKey returns the public key of the key named keyID.
+	publicKey(ctx context.Context, keyID string) (*ecdh.PublicKey, error)
+
+	// agree returns the x-coordinate of the product of the private key named
+	// keyID and peer.
+	agree(ctx context.Context, keyID string, peer *ecdh.PublicKey) ([]byte, error)
+}
+
+// keyAgreements maps OPRF_KEY_PROVIDER values to the providers built in,
+// see profile.go.
+var keyAgreements = map[string]keyAgreement{}
+
+// oprfCurves maps the OPRF suites to their curves.
+var oprfCurves = map[oprf.SuiteID]ecdh.Curve{
+	oprf.OPRFP256: ecdh.P256(),
+	oprf.OPRFP384: ecdh.P384(),
+	oprf.OPRFP521: ecdh.P521(),
+}
+
+// hsmKey evaluates with a private key of a key management service.
+type hsmKey struct {
+	group    group.Group
+	curve    ecdh.Curve
+	public   group.Element
+	keyID    string
+	provider keyAgreement
+}
+
+// newHSMKeys sets up the suites of OPRF_KEY_IDS to be evaluated by the
+// provider of OPRF_KEY_PROVIDER, reading their public keys.
+func newHSMKeys(ctx context.Context, suites []*cryptoSuite) error {
+	name := os.Getenv("OPRF_KEY_PROVIDER")
+	if name == "" {
+		return nil
+	}
+	provider, ok := keyAgreements[name]
+	if !ok {
+		return fmt.Errorf("unknown OPRF_KEY_PROVIDER %q, or not built into this binary", name)
+	}
+	var keyIDs map[string]string
+	if err := json.Unmarshal([]byte(os.Getenv("OPRF_KEY_IDS")), &keyIDs); err != nil {
+		return fmt.Errorf("parsing OPRF_KEY_IDS: %w", err)
+	}
+	for v, keyID := range keyIDs {
+		version, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return fmt.Errorf("OPRF_KEY_IDS: invalid version %q", v)
+		}
+		cs := suiteIn(suites, uint16(version))
+		if cs == nil {
+			return fmt.Errorf("OPRF_KEY_IDS: MIGP version %d is not served", version)
+		}
+		if cs.remote != nil {
+			return fmt.Errorf("OPRF_KEY_IDS: MIGP version %d is evaluated elsewhere", version)
+		}
+		curve, ok := oprfCurves[cs.cfg.OPRFSuite]
+		if !ok {
+			return fmt.Errorf("OPRF_KEY_IDS: MIGP version %d: no key agreement on OPRF suite %d", version, cs.cfg.OPRFSuite)
+		}
+		pub, err := provider.publicKey(ctx, keyID)
+		if err != nil {
+			return fmt.Errorf("reading OPRF key %s: %w", keyID, err)
+		}
+		if pub.Curve() != curve {
+			return fmt.Errorf("OPRF key %s is not on the curve of MIGP version %d", keyID, version)
+		}
+		public := cs.key.group.NewElement()
+		if err := public.UnmarshalBinary(pub.Bytes()); err != nil {
+			return fmt.Errorf("OPRF key %s: %w", keyID, err)
+		}
+		cs.remote = &hsmKey{group: cs.key.group, curve: curve, public: public, keyID: keyID, provider: provider}
+	}
+	return nil
+}
+
+// evaluate evaluates the blinded elements, agreeing on their keys
+// concurrently. The point arithmetic is too cheap to need the pool.
+func (k *hsmKey) evaluate(ctx context.Context, _ *cryptoPool, blinded [][]byte) ([][]byte, error) {
+	out := make([][]byte, len(blinded))
+	errs := make([]error, len(blinded))
+	var wg sync.WaitGroup
+	for i, b := range blinded {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out[i], errs[i] = k.evaluateOne(ctx, b)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// evaluateOne evaluates a blinded element as described above.
+func (k *hsmKey) evaluateOne(ctx context.Context, blinded []byte) ([]byte, error) {
+	b := k.group.NewElement()
+	if err := b.UnmarshalBinary(blinded); err != nil {
+		return nil, err
+	}
+	shifted := k.group.NewElement().Add(b, k.group.Generator())
+	if b.IsIdentity() || shifted.IsIdentity() {
+		return nil, errors.New("blinded element is the identity or the inverse of the generator")
+	}
+	x, err := k.agree(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	xShifted, err := k.agree(ctx, shifted)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range []byte{0x02, 0x03} {
+		candidate := k.group.NewElement()
+		if err := candidate.UnmarshalBinary(append([]byte{prefix}, x...)); err != nil {
+			return nil, fmt.Errorf("%w: key agreement is not on the curve", errEvaluatorUnavailable)
+		}
+		sum, err := k.group.NewElement().Add(candidate, k.public).MarshalBinaryCompress()
+		if err != nil {
+			return nil, err
+		}
+		if len(sum) > 1 && bytes.Equal(sum[1:], xShifted) {
+			return candidate.MarshalBinaryCompress()
+		}
+	}
+	return nil, fmt.Errorf("%w: key agreements of OPRF key %s are inconsistent", errEvaluatorUnavailable, k.keyID)
+}
+
+// agree returns the x-coordinate of the product of the key and e, padded to
+// the field size.
+func (k *hsmKey) agree(ctx context.Context, e group.Element) ([]byte, error) {
+	encoded, err := e.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	peer, err := k.curve.NewPublicKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	x, err := k.provider.agree(ctx, k.keyID, peer)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errEvaluatorUnavailable, err)
+	}
+	size := (len(encoded) - 1) / 2
+	if len(x) > size {
+		return nil, fmt.Errorf("%w: key agreement of %d bytes", errEvaluatorUnavailable, len(x))
+	}
+	return append(make([]byte, size-len(x)), x...), nil
+}
+
+// hsmPrivateKey returns the evaluation scalar of key as a private key on
+// curve, to import into a key management service.
+func hsmPrivateKey(key *oprfKey, curve ecdh.Curve) (*ecdh.PrivateKey, error) {
+	scalar, err := key.inverse.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return curve.NewPrivateKey(scalar)
+}
+
+// runHSMKey implements the hsm-key command, see above.
+func runHSMKey() error {
+	configs, err := loadConfigs()
+	if err != nil {
+		return err
+	}
+	out := map[string][]byte{}
+	for _, cfg := range configs {
+		curve, ok := oprfCurves[cfg.OPRFSuite]
+		if !ok {
+			return fmt.Errorf("MIGP version %d: no key agreement on OPRF suite %d", cfg.Version, cfg.OPRFSuite)
+		}
+		key, err := newOPRFKey(cfg)
+		if err != nil {
+			return fmt.Errorf("MIGP version %d: %w", cfg.Version, err)
+		}
+		private, err := hsmPrivateKey(key, curve)
+		if err != nil {
+			return fmt.Errorf("MIGP version %d: %w", cfg.Version, err)
+		}
+		if out[strconv.Itoa(int(cfg.Version))], err = x509.MarshalPKCS8PrivateKey(private); err != nil {
+			return err
+		}
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(out)
+}
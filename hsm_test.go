@@ -0,0 +1,106 @@
+//go:build full || aws || !(minimal || azure)
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+)
+
+func TestHSMKey(t *testing.T) {
+	full, _ := newTestServer(t)
+	key := full.suites[0].key
+	private, err := hsmPrivateKey(key, oprfCurves[full.suites[0].cfg.OPRFSuite])
+	if err != nil {
+		t.Fatal(err)
+	}
+	kms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access-key/") {
+			http.Error(w, "unsigned request", http.StatusForbidden)
+			return
+		}
+		var body struct {
+			KeyId     string
+			PublicKey []byte
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.KeyId != "oprf-key" {
+			http.Error(w, "unknown key", http.StatusBadRequest)
+			return
+		}
+		switch req.Header.Get("X-Amz-Target") {
+		case "TrentService.GetPublicKey":
+			der, _ := x509.MarshalPKIXPublicKey(private.PublicKey())
+			json.NewEncoder(w).Encode(map[string][]byte{"PublicKey": der})
+		case "TrentService.DeriveSharedSecret":
+			pub, err := x509.ParsePKIXPublicKey(body.PublicKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			peer, _ := pub.(*ecdsa.PublicKey).ECDH()
+			secret, err := private.ECDH(peer)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string][]byte{"SharedSecret": secret})
+		default:
+			http.Error(w, "unknown action", http.StatusBadRequest)
+		}
+	}))
+	defer kms.Close()
+
+	t.Setenv("OPRF_KEY_PROVIDER", "aws-kms")
+	t.Setenv("OPRF_KEY_IDS", `{"1": "oprf-key"}`)
+	t.Setenv("AWS_KMS_ENDPOINT", kms.URL)
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret-key")
+	s, _ := newTestServer(t)
+	cs := suiteIn(s.suites, 1)
+	if _, ok := cs.remote.(*hsmKey); !ok {
+		t.Fatal("suite not evaluated by the key management service")
+	}
+
+	client, err := oprf.NewClient(cs.cfg.OPRFSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough elements for evaluations of both signs.
+	inputs := make([][]byte, 16)
+	for i := range inputs {
+		inputs[i] = []byte{byte(i)}
+	}
+	req, err := client.Request(inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := key.evaluate(req.BlindedElements())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.evaluateBatch(context.Background(), cs, req.BlindedElements())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("element %d: evaluation differs", i)
+		}
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "other-key")
+	if _, err := s.evaluateBatch(context.Background(), cs, req.BlindedElements()); !errors.Is(err, errEvaluatorUnavailable) {
+		t.Errorf("evaluation with refused credentials: %v, want errEvaluatorUnavailable", err)
+	}
+}
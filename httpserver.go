@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	httpConnections      = newGauge("migp_http_connections", "Open HTTP connections by state.", "state")
+	httpConnectionsTotal = newCounter("migp_http_connections_total", "Accepted HTTP connections.")
+)
+
+// connTracker maintains the connection metrics from http.Server state
+// changes.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+// track records conn moving to state.
+func (t *connTracker) track(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if previous, ok := t.conns[conn]; ok {
+		httpConnections.Add(-1, previous.String())
+	} else {
+		httpConnectionsTotal.Inc()
+	}
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		delete(t.conns, conn)
+	default:
+		t.conns[conn] = state
+		httpConnections.Add(1, state.String())
+	}
+}
+
+// newHTTPServer returns the server listening on addr. The timeouts and
+// header limit are configured by HTTP_READ_HEADER_TIMEOUT,
+// HTTP_READ_TIMEOUT, HTTP_WRITE_TIMEOUT, HTTP_IDLE_TIMEOUT and
+// HTTP_MAX_HEADER_BYTES. Cleartext HTTP/2 (h2c), which the Functions host or
+// a sidecar can use to multiplex requests over few connections, is accepted
+// alongside HTTP/1.1 unless HTTP_H2C_ENABLED is false.
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	tracker := &connTracker{conns: map[net.Conn]http.ConnState{}}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: envDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    envInt("HTTP_MAX_HEADER_BYTES", 64<<10),
+		ConnState:         tracker.track,
+		Protocols:         new(http.Protocols),
+	}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	srv.Protocols.SetUnencryptedHTTP2(envBool("HTTP_H2C_ENABLED", true))
+	return srv
+}
+
+// serve runs srv until it fails. When TLS_CERT_FILE and TLS_KEY_FILE are set,
+// for running standalone outside the Functions host, it serves HTTPS with
+// HTTP/2 negotiated through ALPN.
+func serve(srv *http.Server) error {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile != "" || keyFile != "" {
+		log.Printf("About to listen on %s with TLS", srv.Addr)
+		return srv.ListenAndServeTLS(certFile, keyFile)
+	}
+	log.Printf("About to listen on %s", srv.Addr)
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPServer(t *testing.T) {
+	t.Setenv("HTTP_READ_TIMEOUT", "3s")
+	t.Setenv("HTTP_MAX_HEADER_BYTES", "1024")
+	t.Setenv("HTTP_H2C_ENABLED", "false")
+	srv := newHTTPServer(":0", http.NotFoundHandler())
+	if srv.ReadTimeout != 3*time.Second || srv.WriteTimeout != time.Minute || srv.MaxHeaderBytes != 1024 {
+		t.Errorf("server timeouts %s and %s, header limit %d", srv.ReadTimeout, srv.WriteTimeout, srv.MaxHeaderBytes)
+	}
+	if srv.Protocols.UnencryptedHTTP2() || !srv.Protocols.HTTP1() {
+		t.Errorf("protocols %v with HTTP_H2C_ENABLED=false", srv.Protocols)
+	}
+}
+
+// TestH2C serves a request over cleartext HTTP/2, as the Functions host or a
+// sidecar sends them, and checks the connection metrics.
+func TestH2C(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(l.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	}))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	accepted := func() float64 {
+		v, _, _, _ := httpConnectionsTotal.total(func([]string) bool { return true })
+		return v
+	}
+	before := accepted()
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{Protocols: protocols}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("request served over %s, want HTTP/2", resp.Proto)
+		}
+	}
+	if n := accepted() - before; n != 1 {
+		t.Errorf("%g connections accepted for three requests, want one multiplexed connection", n)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Error codes for Idempotency-Key conflicts, see errors.go.
+const (
+	// errIdempotencyMismatch: the key was used for a different request.
+	errIdempotencyMismatch = "idempotency_key_mismatch"
+	// errIdempotencyInProgress: a request with the key is still running.
+	// Retry later to get its stored response.
+	errIdempotencyInProgress = "idempotency_key_in_progress"
+)
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
+var idempotentReplays = newCounter("migp_idempotent_replays_total", "POST requests answered from a stored idempotent response.")
+
+// recordingResponse passes a response through while keeping a copy for
+// storage.
+type recordingResponse struct {
+	http.ResponseWriter
+	status      int
+	contentType string
+	body        bytes.Buffer
+
+	// recorded is set once the response to store is known, so that what
+	// follows, such as a job stream, is passed through without a copy.
+	recorded bool
+}
+
+func (r *recordingResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recordingResponse) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if !r.recorded {
+		r.body.Write(p)
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController flush streamed responses.
+func (r *recordingResponse) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// recordJob stores the response naming a streamed job, so that a retry
+// gets it instead of a copy of the stream.
+func (r *recordingResponse) recordJob(status int, contentType string, body []byte) {
+	r.status, r.contentType, r.recorded = status, contentType, true
+	r.body.Reset()
+	r.body.Write(body)
+}
+
+// withIdempotency makes POST requests carrying an Idempotency-Key header
+// safe to retry. The first request with a key runs h and its response is
+// stored for IDEMPOTENCY_TTL (default 24h); retries with the same key and
+// request body get the stored response with an Idempotent-Replayed header
+// instead of running h again. Reusing a key for a different request is
+// rejected with a 422, and retrying while the first request still runs with
+// a 409. Server errors are not stored, so the request can be retried. Keys
+// are scoped to the route and tenant.
+func (s *server) withIdempotency(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("Idempotency-Key")
+		if req.Method != http.MethodPost || key == "" {
+			h(w, req)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, "Idempotency-Key must be at most 255 characters", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		digest := sha256.Sum256(body)
+		scope := tenantOf(req) + " " + req.URL.Path
+
+		ctx := req.Context()
+		db := s.kv.db()
+		ttl := envDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+		query := `
+		INSERT INTO idempotency_keys (scope, key, request_hash, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (scope, key) DO UPDATE SET
+			request_hash = EXCLUDED.request_hash, status = NULL, content_type = NULL, body = NULL,
+			created_at = now(), expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < now()`
+		res, err := db.ExecContext(ctx, query, scope, key, digest[:], time.Now().Add(ttl))
+		if err != nil {
+			storageError(w, "Reserving idempotency key", err)
+			return
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			s.replayIdempotent(w, req, scope, key, digest[:])
+			return
+		}
+
+		rec := &recordingResponse{ResponseWriter: w}
+		returned := false
+		// Record the outcome even if the request ran out of its budget, and
+		// release the key if the handler panicked, so that the key is not
+		// left in progress.
+		defer func() {
+			ctx := context.WithoutCancel(ctx)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			if !returned || rec.status >= 500 {
+				if _, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2`, scope, key); err != nil {
+					log.Println("Releasing idempotency key failed:", err)
+				}
+				return
+			}
+			query := `UPDATE idempotency_keys SET status = $3, content_type = $4, body = $5 WHERE scope = $1 AND key = $2`
+			contentType := rec.contentType
+			if contentType == "" {
+				contentType = rec.Header().Get("Content-Type")
+			}
+			if _, err := db.ExecContext(ctx, query, scope, key, rec.status, contentType, rec.body.Bytes()); err != nil {
+				log.Println("Storing idempotent response failed:", err)
+			}
+		}()
+		h(rec, req)
+		returned = true
+	}
+}
+
+// replayIdempotent answers a request whose idempotency key is already taken.
+func (s *server) replayIdempotent(w http.ResponseWriter, req *http.Request, scope, key string, digest []byte) {
+	var (
+		requestHash []byte
+		status      sql.NullInt64
+		contentType sql.NullString
+		body        []byte
+	)
+	query := `SELECT request_hash, status, content_type, body FROM idempotency_keys WHERE scope = $1 AND key = $2`
+	err := s.kv.db().QueryRowContext(req.Context(), query, scope, key).Scan(&requestHash, &status, &contentType, &body)
+	if err == sql.ErrNoRows {
+		// The first request failed and released the key in between.
+		writeErrorCode(w, errIdempotencyInProgress, "a request with this Idempotency-Key is in progress", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		storageError(w, "Loading idempotent response", err)
+		return
+	}
+	if !bytes.Equal(requestHash, digest) {
+		writeErrorCode(w, errIdempotencyMismatch, "Idempotency-Key was used for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	if !status.Valid {
+		w.Header().Set("Retry-After", "1")
+		writeErrorCode(w, errIdempotencyInProgress, "a request with this Idempotency-Key is in progress", http.StatusConflict)
+		return
+	}
+
+	idempotentReplays.Inc()
+	if contentType.Valid && contentType.String != "" {
+		w.Header().Set("Content-Type", contentType.String)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(int(status.Int64))
+	w.Write(body)
+}
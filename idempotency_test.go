@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecordingResponse(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r := &recordingResponse{ResponseWriter: rec}
+	r.Write([]byte("first"))
+	r.WriteHeader(http.StatusTeapot)
+	if r.status != http.StatusOK || r.body.String() != "first" {
+		t.Fatalf("recorded %d %q", r.status, r.body.String())
+	}
+	r.recordJob(http.StatusAccepted, "application/json", []byte(`{"jobId": "j"}`))
+	r.Write([]byte("data: streamed\n\n"))
+	if r.status != http.StatusAccepted || r.body.String() != `{"jobId": "j"}` || !strings.HasSuffix(rec.Body.String(), "streamed\n\n") {
+		t.Fatalf("recorded %d %q after the job response, passed %q", r.status, r.body.String(), rec.Body.String())
+	}
+}
+
+func TestWithIdempotency(t *testing.T) {
+	s, _ := newDBTestServer(t)
+	key := testName(t)
+	t.Cleanup(func() { s.kv.db().Exec(`DELETE FROM idempotency_keys WHERE key LIKE $1 || '%'`, key) })
+	calls := 0
+	status := http.StatusCreated
+	h := s.withIdempotency(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		writeJSON(w, status, map[string]int{"call": calls})
+	})
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/ingest", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	first := post(key, `{"a": 1}`)
+	replay := post(key, `{"a": 1}`)
+	if calls != 1 || replay.Code != http.StatusCreated || replay.Body.String() != first.Body.String() || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry ran the handler %d times and answered %d %q", calls, replay.Code, replay.Body)
+	}
+	if rec := post(key, `{"a": 2}`); rec.Code != http.StatusUnprocessableEntity || calls != 1 {
+		t.Errorf("key reused for another request answered %d", rec.Code)
+	}
+	if rec := post(key+"-other", `{"a": 1}`); rec.Code != http.StatusCreated || calls != 2 {
+		t.Errorf("other key answered %d after %d calls", rec.Code, calls)
+	}
+
+	// Server errors release the key.
+	status = http.StatusInternalServerError
+	post(key+"-failed", `{}`)
+	post(key+"-failed", `{}`)
+	if calls != 4 {
+		t.Errorf("failed request not retried: %d calls", calls)
+	}
+	if rec := post(strings.Repeat("k", maxIdempotencyKeyLength+1), `{}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("overlong key answered %d", rec.Code)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/mutator"
+)
+
+// ingestRequest is a batch of breach credentials to encrypt and store, in the
+// same <username>:<password> format accepted by the migp-go ingestion tool.
+// Version selects the crypto suite whose corpus is written, and defaults to
+// the current one. Tenant selects the corpus of a tenant with a key of its
+// own, see newTenantSuites. Source names the breach the credentials came
+// from, if known.
+type ingestRequest struct {
+	Version                uint16   `json:"version"`
+	Tenant                 string   `json:"tenant,omitempty"`
+	Credentials            []string `json:"credentials"`
+	Metadata               string   `json:"metadata"`
+	NumVariants            int      `json:"numVariants"`
+	IncludeUsernameVariant bool     `json:"includeUsernameVariant"`
+	Source                 string   `json:"source,omitempty"`
+}
+
+// ingestResult summarizes the outcome of an ingestRequest.
+type ingestResult struct {
+	Successes int `json:"successes"`
+	Failures  int `json:"failures"`
+	Malformed int `json:"malformed"`
+	Entries   int `json:"entries"`
+}
+
+// decodeIngestRequest parses an ingestRequest, applying the migp-go defaults
+// for fields that are omitted.
+func decodeIngestRequest(data []byte) (ingestRequest, error) {
+	req := ingestRequest{
+		NumVariants:            9,
+		IncludeUsernameVariant: true,
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return req, err
+	}
+	if len(req.Credentials) == 0 {
+		return req, errors.New("ingest request has no credentials")
+	}
+	return req, nil
+}
+
+// splitCredential splits a <username>:<password> credential at its first
+// colon, reporting whether it has one.
+func splitCredential(credential string) (username, password []byte, ok bool) {
+	fields := bytes.SplitN([]byte(credential), []byte(":"), 2)
+	if len(fields) < 2 {
+		return nil, nil, false
+	}
+	return fields[0], fields[1], true
+}
+
+// ingestWith ingests req using m to generate password variants. Every
+// credential is encrypted first, and the resulting entries are journaled as
+// one batch before any of them is stored.
+func (s *server) ingestWith(ctx context.Context, m mutator.Mutator, req ingestRequest) ingestResult {
+	var result ingestResult
+	suites := s.tenantSuites(req.Tenant)
+	if req.Tenant != "" && s.tenants[req.Tenant] == nil || len(suites) == 0 {
+		log.Printf("Ingesting into tenant %q without an available key", req.Tenant)
+		result.Failures = len(req.Credentials)
+		return result
+	}
+	cs := suites[0]
+	if req.Version != 0 {
+		if cs = suiteIn(suites, req.Version); cs == nil {
+			log.Printf("Ingesting into unsupported MIGP version %d", req.Version)
+			result.Failures = len(req.Credentials)
+			return result
+		}
+	}
+	if cs.remote != nil {
+		log.Printf("Ingesting credentials into MIGP version %d, whose key is not held to encrypt them", cs.cfg.Version)
+		result.Failures = len(req.Credentials)
+		return result
+	}
+	var (
+		credentials [][]journalEntry
+		passwords   [][]byte
+		batch       []journalEntry
+	)
+	for _, credential := range req.Credentials {
+		username, password, ok := splitCredential(credential)
+		if !ok {
+			result.Malformed += 1
+			continue
+		}
+		entries, err := encryptCredential(m, cs, username, password, []byte(req.Metadata), req.NumVariants, req.IncludeUsernameVariant)
+		if err != nil {
+			log.Println("Encrypting credential failed:", err)
+			result.Failures += 1
+			continue
+		}
+		credentials = append(credentials, entries)
+		passwords = append(passwords, password)
+		batch = append(batch, entries...)
+	}
+
+	enabled, err := s.registerSource(ctx, req.Source)
+	if err != nil {
+		log.Println("Registering ingestion source failed:", err)
+		result.Failures += len(credentials)
+		return result
+	}
+	seq, err := s.journalSource(ctx, cs.cfg.Version, journalAppend, req.Source, batch)
+	if err != nil {
+		log.Println("Journaling ingestion batch failed:", err)
+		result.Failures += len(credentials)
+		return result
+	}
+	if !enabled {
+		// The batch is only journaled, so that enabling its source adds
+		// it to the corpus.
+		s.journalSkipped(ctx, seq)
+		result.Successes += len(credentials)
+		return result
+	}
+	var indexed [][]byte
+	for i, entries := range credentials {
+		n, err := s.insert(ctx, entries)
+		if err != nil {
+			log.Println("Inserting credential failed:", err)
+			result.Failures += 1
+			continue
+		}
+		result.Successes += 1
+		result.Entries += n
+		// Only credentials new to the corpus are counted in the range
+		// index, so that replayed batches do not inflate the counts.
+		if n > 0 && s.rangeIndex && cs == s.suites[0] {
+			indexed = append(indexed, passwords[i])
+		}
+	}
+	if err := s.indexPasswords(ctx, indexed); err != nil {
+		log.Println("Indexing password hashes failed:", err)
+	}
+	if result.Failures == 0 {
+		s.journalApplied(ctx, seq)
+	}
+	return result
+}
+
+// ingestParallel ingests req with workers concurrent goroutines, each taking
+// journalBatchSize credentials at a time. If progress is not nil it is called
+// with the number of credentials processed so far after each batch.
+func (s *server) ingestParallel(ctx context.Context, req ingestRequest, workers int, progress func(done int)) ingestResult {
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		mu    sync.Mutex
+		total ingestResult
+		done  int
+		wg    sync.WaitGroup
+	)
+	batches := make(chan []string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := mutator.NewRDasMutator()
+			for batch := range batches {
+				one := req
+				one.Credentials = batch
+				result := s.ingestWith(ctx, m, one)
+
+				mu.Lock()
+				total.Successes += result.Successes
+				total.Failures += result.Failures
+				total.Malformed += result.Malformed
+				total.Entries += result.Entries
+				done += len(batch)
+				if progress != nil {
+					progress(done)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < len(req.Credentials); i += journalBatchSize {
+		batches <- req.Credentials[i:min(i+journalBatchSize, len(req.Credentials))]
+	}
+	close(batches)
+	wg.Wait()
+	if total.Entries > 0 {
+		s.corpusChanged()
+	}
+	return total
+}
+
+// encryptCredential encrypts a credential pair, its username-only variant
+// and similar password variants generated by m for the corpus of cs.
+func encryptCredential(m mutator.Mutator, cs *cryptoSuite, username, password, metadata []byte, numVariants int, includeUsernameVariant bool) ([]journalEntry, error) {
+	bucketKey := cs.bucketKey(migp.BucketIDToHex(cs.server.BucketID(username)))
+	bucketHash := int64(cs.bucketHash(username))
+
+	type variant struct {
+		password []byte
+		flag     migp.MetadataType
+	}
+	variants := []variant{{password, migp.MetadataBreachedPassword}}
+	if includeUsernameVariant {
+		variants = append(variants, variant{nil, migp.MetadataBreachedUsername})
+	}
+	for _, p := range m.Mutate(password, numVariants) {
+		variants = append(variants, variant{p, migp.MetadataSimilarPassword})
+	}
+
+	entries := make([]journalEntry, 0, len(variants))
+	for _, v := range variants {
+		newEntry, err := cs.server.EncryptBucketEntry(username, v.password, v.flag, metadata)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, journalEntry{Key: bucketKey, BucketHash: &bucketHash, Value: newEntry})
+	}
+	return entries, nil
+}
+
+// insert stores the entries of one credential. It returns the number of
+// entries that were not already present. Entries the bucket limits dropped or
+// parked are not counted.
+func (s *server) insert(ctx context.Context, entries []journalEntry) (int, error) {
+	if b, ok := s.kv.buckets.(batchAppender); ok {
+		return s.kv.appendBatch(ctx, b, entries)
+	}
+	added := 0
+	for _, e := range entries {
+		ok, err := s.kv.AppendUnique(ctx, e.Key, e.bucketHash(), e.Value)
+		if err == errBucketFull || err == errBucketOverflowed {
+			continue
+		}
+		if err != nil {
+			return added, err
+		}
+		if ok {
+			added += 1
+		}
+	}
+	return added, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+)
+
+// Background jobs that work on the whole corpus, scheduled maintenance and
+// the compaction and scrub jobs, run on one instance at a time however many
+// the app scales to. Each takes a PostgreSQL advisory lock named after the
+// job in a transaction kept open for as long as it runs, so the lock is let
+// go if the instance holding it dies, see tryAdvisoryLock. Jobs should not
+// run longer than idle_in_transaction_session_timeout, if the database sets
+// one. A scheduled run that finds its lock
+// held is skipped, as another instance is doing the work, and a job started
+// from the admin API is refused with a 409. Detached servers have no
+// database to hold locks in and run jobs unlocked.
+
+// errJobRunning is returned when another instance holds the lock of a job.
+var errJobRunning = errors.New("job is already running")
+
+// jobLockID returns the advisory lock key of the job named name, kept clear
+// of the fixed keys next to schemaLockID.
+func jobLockID(name string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return schemaLockID<<32 | int64(h.Sum32())
+}
+
+// lockJob takes the lock of the job named name and returns the function
+// releasing it, or an error wrapping errJobRunning if another instance holds
+// it.
+func (s *server) lockJob(ctx context.Context, name string) (func(), error) {
+	if s.detached {
+		return func() {}, nil
+	}
+	busy := fmt.Errorf("a %s %w", name, errJobRunning)
+	return s.tryAdvisoryLock(ctx, jobLockID(name), name, busy)
+}
+
+// lockJobRequest takes the lock of the job named name for an admin request
+// and returns the function releasing it, or responds with a 409 if another
+// instance holds it and returns nil.
+func (s *server) lockJobRequest(w http.ResponseWriter, req *http.Request, name string) func() {
+	release, err := s.lockJob(req.Context(), name)
+	if errors.Is(err, errJobRunning) {
+		writeErrorCode(w, errConflict, err.Error(), http.StatusConflict)
+		return nil
+	}
+	if err != nil {
+		storageError(w, "Taking "+name+" lock", err)
+		return nil
+	}
+	return release
+}
+
+// runScheduledJob runs f under the lock of the job named name, skipping it
+// if another instance holds the lock. It reports whether f ran.
+func (s *server) runScheduledJob(ctx context.Context, name string, f func(context.Context) error) (bool, error) {
+	release, err := s.lockJob(ctx, name)
+	if errors.Is(err, errJobRunning) {
+		log.Printf("Skipping %s, another instance is running it", name)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	return true, f(ctx)
+}
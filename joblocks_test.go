@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestJobLocks(t *testing.T) {
+	s, srv := newDBTestServer(t)
+	ctx := context.Background()
+	name := testName(t)
+
+	release, err := s.lockJob(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.lockJob(ctx, name); !errors.Is(err, errJobRunning) {
+		t.Fatalf("second lock returned %v, want errJobRunning", err)
+	}
+	ran, err := s.runScheduledJob(ctx, name, func(context.Context) error { return errors.New("ran") })
+	if ran || err != nil {
+		t.Fatalf("scheduled job ran (%v, %v) while its lock was held", ran, err)
+	}
+	other, err := s.lockJob(ctx, name+"-other")
+	if err != nil {
+		t.Fatalf("lock of another job: %v", err)
+	}
+	other()
+	release()
+	if ran, err := s.runScheduledJob(ctx, name, func(context.Context) error { return nil }); !ran || err != nil {
+		t.Fatalf("scheduled job did not run (%v, %v) once the lock was released", ran, err)
+	}
+
+	release, err = s.lockJob(ctx, "scrub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodPost, srv.URL+"/api/admin/buckets/scrub", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("scrub status %d while another instance scrubs, want %d", resp.StatusCode, http.StatusConflict)
+	}
+}
+
+func TestJobLockOutlivesContext(t *testing.T) {
+	s, _ := newDBTestServer(t)
+	name := testName(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	release, err := s.lockJob(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Jobs started from admin requests keep running past the request.
+	cancel()
+	if _, err := s.lockJob(context.Background(), name); !errors.Is(err, errJobRunning) {
+		t.Fatalf("lock taken again after the context of the holder ended: %v", err)
+	}
+	release()
+	again, err := s.lockJob(context.Background(), name)
+	if err != nil {
+		t.Fatalf("lock not released: %v", err)
+	}
+	again()
+}
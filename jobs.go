@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTrackedJobs bounds the jobs remembered by a jobTracker.
+const maxTrackedJobs = 100
+
+// jobStatus is the state of an admin job as last reported by its events.
+type jobStatus struct {
+	ID        string      `json:"jobId"`
+	Type      string      `json:"type,omitempty"`
+	State     string      `json:"state"`
+	Percent   int         `json:"percent,omitempty"`
+	StartedAt time.Time   `json:"startedAt"`
+	UpdatedAt time.Time   `json:"updatedAt"`
+	Error     string      `json:"error,omitempty"`
+	Result    interface{} `json:"result,omitempty"`
+}
+
+// jobTracker remembers the most recent admin jobs of this instance from the
+// job events published for them, whether or not any event destination is
+// configured, for GET /api/admin/jobs.
+type jobTracker struct {
+	mu       sync.Mutex
+	jobs     map[string]*jobStatus
+	order    []string
+	watchers map[string][]chan jobStatus
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{jobs: make(map[string]*jobStatus), watchers: make(map[string][]chan jobStatus)}
+}
+
+// record updates the job of subject from an event, ignoring other subjects.
+func (t *jobTracker) record(eventType, subject string, data interface{}) {
+	id, ok := strings.CutPrefix(subject, "migp/jobs/")
+	if !ok {
+		return
+	}
+	fields, _ := data.(map[string]interface{})
+	now := time.Now().UTC()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	job := t.jobs[id]
+	if job == nil {
+		job = &jobStatus{ID: id, StartedAt: now}
+		t.jobs[id] = job
+		t.order = append(t.order, id)
+		if len(t.order) > maxTrackedJobs {
+			evicted := t.order[0]
+			for _, ch := range t.watchers[evicted] {
+				close(ch)
+			}
+			delete(t.watchers, evicted)
+			delete(t.jobs, evicted)
+			t.order = t.order[1:]
+		}
+	}
+	job.UpdatedAt = now
+	if typ, ok := fields["type"].(string); ok {
+		job.Type = typ
+	}
+	switch eventType {
+	case eventJobStarted:
+		job.State = "running"
+	case eventJobProgress:
+		job.State = "running"
+		if percent, ok := fields["percent"].(int); ok {
+			job.Percent = percent
+		}
+	case eventJobCompleted:
+		job.State, job.Percent = "completed", 100
+	case eventJobFailed:
+		job.State = "failed"
+		if msg, ok := fields["error"].(string); ok {
+			job.Error = msg
+		}
+	}
+	if result, ok := fields["result"]; ok {
+		job.Result = result
+	}
+	// Each watcher holds only the latest status, so that a slow reader
+	// skips the ones it missed instead of blocking the job.
+	for _, ch := range t.watchers[id] {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- *job
+	}
+}
+
+// get returns the tracked job id.
+func (t *jobTracker) get(id string) (jobStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	job, ok := t.jobs[id]
+	if !ok {
+		return jobStatus{}, false
+	}
+	return *job, true
+}
+
+// watch returns the status of the tracked job id and a channel receiving
+// its status after each later update, which stop unregisters. The channel
+// is closed if the job is no longer tracked.
+func (t *jobTracker) watch(id string) (status jobStatus, ok bool, updates <-chan jobStatus, stop func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	job, ok := t.jobs[id]
+	if !ok {
+		return jobStatus{}, false, nil, func() {}
+	}
+	ch := make(chan jobStatus, 1)
+	t.watchers[id] = append(t.watchers[id], ch)
+	stop = func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		watchers := t.watchers[id]
+		for i, c := range watchers {
+			if c == ch {
+				watchers = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+		if len(watchers) == 0 {
+			delete(t.watchers, id)
+		} else {
+			t.watchers[id] = watchers
+		}
+	}
+	return *job, true, ch, stop
+}
+
+// list returns the tracked jobs, most recently started first.
+func (t *jobTracker) list() []jobStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	jobs := make([]jobStatus, 0, len(t.order))
+	for i := len(t.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, *t.jobs[t.order[i]])
+	}
+	return jobs
+}
+
+// jobProgress returns a function publishing the progress of job id in
+// percent, skipping updates until the percentage reaches the next multiple
+// of 10 so that a job reports progress without an event per item.
+func (s *server) jobProgress(id string) func(percent int) {
+	last := 0
+	return func(percent int) {
+		if percent/10 > last/10 && percent < 100 {
+			last = percent
+			s.events.Publish(eventJobProgress, "migp/jobs/"+id, map[string]interface{}{"jobId": id, "percent": percent})
+		}
+	}
+}
+
+// handleJobs lists the recent admin jobs started on this instance, or
+// returns the one of the id query parameter, streaming its updates with
+// stream=true as acceptJob does. Jobs run on the instance that
+// accepted them, so with several instances each only knows its own.
+func (s *server) handleJobs(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if id := req.URL.Query().Get("id"); id != "" {
+		if streamRequested(req) && canStream(w) {
+			s.streamJob(w, req, id, http.StatusOK)
+			return
+		}
+		job, ok := s.events.jobs.get(id)
+		if !ok {
+			writeErrorCode(w, errNotFound, "unknown job", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"jobs": s.events.jobs.list()})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Long admin operations run as background jobs. Instead of polling GET
+// /api/admin/jobs, a caller can add stream=true to the request starting a
+// job, or to GET /api/admin/jobs?id=, to receive the status of the job
+// after every update until it completes or fails: as Server-Sent Events if
+// it accepts text/event-stream, and as JSON lines otherwise. Requests the
+// Functions host wraps in an invocation envelope cannot be streamed to, so
+// they get the usual response naming the job and poll for its status.
+
+// streamKeepAlive is the interval of the comments an idle Server-Sent
+// Events stream is kept open with.
+const streamKeepAlive = 15 * time.Second
+
+// eventStream writes JSON events to a client as they happen.
+type eventStream struct {
+	w   http.ResponseWriter
+	rc  *http.ResponseController
+	sse bool
+}
+
+// newEventStream starts a streamed response with status. The stream is
+// exempt from the server's write timeout, since it lasts as long as what it
+// reports on.
+func newEventStream(w http.ResponseWriter, req *http.Request, status int) *eventStream {
+	st := &eventStream{
+		w:   w,
+		rc:  http.NewResponseController(w),
+		sse: strings.Contains(req.Header.Get("Accept"), "text/event-stream"),
+	}
+	st.rc.SetWriteDeadline(time.Time{})
+	h := w.Header()
+	if st.sse {
+		h.Set("Content-Type", "text/event-stream")
+	} else {
+		h.Set("Content-Type", "application/x-ndjson")
+	}
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(status)
+	st.flush()
+	return st
+}
+
+// send writes data as an event of type event, with id as its event ID if
+// it is set.
+func (st *eventStream) send(event, id string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if st.sse {
+		if id != "" {
+			fmt.Fprintf(st.w, "id: %s\n", id)
+		}
+		_, err = fmt.Fprintf(st.w, "event: %s\ndata: %s\n\n", event, body)
+	} else {
+		_, err = st.w.Write(append(body, '\n'))
+	}
+	if err != nil {
+		return err
+	}
+	return st.flush()
+}
+
+// keepAlive writes a comment to a Server-Sent Events stream, so that
+// proxies do not close it while it is idle. JSON lines have no comments,
+// so they are left alone.
+func (st *eventStream) keepAlive() error {
+	if !st.sse {
+		return nil
+	}
+	if _, err := fmt.Fprint(st.w, ": keep-alive\n\n"); err != nil {
+		return err
+	}
+	return st.flush()
+}
+
+func (st *eventStream) flush() error {
+	if err := st.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// streamJob streams the status of job id with status until the job ends,
+// is no longer tracked or the client goes away.
+func (s *server) streamJob(w http.ResponseWriter, req *http.Request, id string, status int) {
+	job, ok, updates, stop := s.events.jobs.watch(id)
+	defer stop()
+	if !ok {
+		writeErrorCode(w, errNotFound, "unknown job", http.StatusNotFound)
+		return
+	}
+	// The stream outlives the timeout budget of the route, which bounds
+	// starting the job, and ends when the client goes away.
+	ctx := requestContext(req)
+	st := newEventStream(w, req, status)
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for changed := true; ; {
+		if changed {
+			if err := st.send("job", "", job); err != nil || job.State == "completed" || job.State == "failed" {
+				return
+			}
+		}
+		select {
+		case job, changed = <-updates:
+			if !changed {
+				return
+			}
+		case <-ticker.C:
+			if st.keepAlive() != nil {
+				return
+			}
+			changed = false
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// streamRequested reports whether req asks for the job it starts to be
+// streamed with the stream query parameter.
+func streamRequested(req *http.Request) bool {
+	stream, err := strconv.ParseBool(req.URL.Query().Get("stream"))
+	return err == nil && stream
+}
+
+// canStream reports whether responses written to w reach the client as they
+// are written. A response buffered for the invocation envelope cannot, and
+// streaming to it would only answer once the job ends.
+func canStream(w http.ResponseWriter) bool {
+	for {
+		if _, ok := w.(http.Flusher); ok {
+			return true
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = u.Unwrap()
+	}
+}
+
+// jobRecorder is implemented by response writers that keep a copy of the
+// response, so that a streamed job is kept as the response naming it.
+type jobRecorder interface {
+	recordJob(status int, contentType string, body []byte)
+}
+
+// acceptJob answers a request that started job id with a 202 and body, or,
+// if the request asks for it and w can stream, with the status of the job
+// after every update. Callers that cannot be streamed to get the 202 and
+// poll GET /api/admin/jobs?id= instead.
+func (s *server) acceptJob(w http.ResponseWriter, req *http.Request, id string, body interface{}) {
+	if !streamRequested(req) || !canStream(w) {
+		writeJSON(w, http.StatusAccepted, body)
+		return
+	}
+	if data, err := json.Marshal(body); err == nil {
+		for rw := w; ; {
+			if r, ok := rw.(jobRecorder); ok {
+				r.recordJob(http.StatusAccepted, "application/json", data)
+			}
+			u, ok := rw.(interface{ Unwrap() http.ResponseWriter })
+			if !ok {
+				break
+			}
+			rw = u.Unwrap()
+		}
+	}
+	s.streamJob(w, req, id, http.StatusAccepted)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readFrame reads the next Server-Sent Event from r, skipping comments.
+func readFrame(t *testing.T, r *bufio.Reader) (event string, job jobStatus) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading frame: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return event, job
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &job); err != nil {
+				t.Fatalf("decoding frame data %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func TestStreamJob(t *testing.T) {
+	tests := []struct {
+		name     string
+		terminal string
+		percents []int
+		state    string
+	}{
+		{"completed", eventJobCompleted, []int{10, 40, 70}, "completed"},
+		{"failed", eventJobFailed, []int{20}, "failed"},
+		{"no progress", eventJobCompleted, nil, "completed"},
+	}
+	s, srv := newTestServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := randomID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			subject := "migp/jobs/" + id
+			publish := func(eventType string, data map[string]interface{}) {
+				data["jobId"] = id
+				s.events.Publish(eventType, subject, data)
+			}
+			publish(eventJobStarted, map[string]interface{}{"type": "test"})
+
+			req := adminRequest(t, http.MethodGet, srv.URL+"/api/admin/jobs?stream=true&id="+id, nil)
+			req.Header.Set("Accept", "text/event-stream")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+				t.Fatalf("Content-Type %q, want text/event-stream", ct)
+			}
+
+			r := bufio.NewReader(resp.Body)
+			event, job := readFrame(t, r)
+			if event != "job" || job.ID != id || job.State != "running" || job.Type != "test" {
+				t.Fatalf("first frame %s %+v, want a running test job", event, job)
+			}
+			// Each update is published once the previous frame has been
+			// read, as a stream only holds the latest status.
+			for _, percent := range tt.percents {
+				publish(eventJobProgress, map[string]interface{}{"percent": percent})
+				if _, job = readFrame(t, r); job.State != "running" || job.Percent != percent {
+					t.Fatalf("progress frame %+v, want running at %d%%", job, percent)
+				}
+			}
+			publish(tt.terminal, map[string]interface{}{"error": "boom", "result": map[string]int{"n": 1}})
+			if _, job = readFrame(t, r); job.State != tt.state || job.Result == nil {
+				t.Fatalf("terminal frame %+v, want state %s with a result", job, tt.state)
+			}
+			if tt.state == "failed" && job.Error != "boom" {
+				t.Fatalf("failed frame error %q, want boom", job.Error)
+			}
+			if line, err := r.ReadString('\n'); err == nil {
+				t.Fatalf("stream continued after the terminal frame with %q", line)
+			}
+		})
+	}
+}
+
+func TestStreamJobLines(t *testing.T) {
+	s, srv := newTestServer(t)
+	s.events.Publish(eventJobStarted, "migp/jobs/lines", map[string]interface{}{"jobId": "lines"})
+	s.events.Publish(eventJobCompleted, "migp/jobs/lines", map[string]interface{}{"jobId": "lines"})
+
+	resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodGet, srv.URL+"/api/admin/jobs?stream=true&id=lines", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Content-Type %q, want application/x-ndjson", ct)
+	}
+	var job jobStatus
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&job); err != nil || job.State != "completed" || job.Percent != 100 {
+		t.Fatalf("line %+v (%v), want the completed job", job, err)
+	}
+	if dec.More() {
+		t.Fatal("stream continued after the completed job")
+	}
+}
+
+func TestStreamJobUnknown(t *testing.T) {
+	_, srv := newTestServer(t)
+	resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodGet, srv.URL+"/api/admin/jobs?stream=true&id=missing", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+// TestAcceptJobEnvelope checks that a request buffered for the invocation
+// envelope gets the response naming the job instead of waiting for it.
+func TestAcceptJobEnvelope(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.events.Publish(eventJobStarted, "migp/jobs/envelope", map[string]interface{}{"jobId": "envelope"})
+
+	rec := newBufferedResponse()
+	defer putBuffer(rec.body)
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/seed?stream=true", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	s.acceptJob(rec, req, "envelope", map[string]string{"jobId": "envelope"})
+	if rec.status != http.StatusAccepted {
+		t.Fatalf("status %d, want %d", rec.status, http.StatusAccepted)
+	}
+	var body struct {
+		JobID string `json:"jobId"`
+	}
+	if err := json.Unmarshal(rec.body.Bytes(), &body); err != nil || body.JobID != "envelope" {
+		t.Fatalf("body %q, want the job ID", rec.body.String())
+	}
+}
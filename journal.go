@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var journalReplayed = newCounter("migp_journal_replayed_entries_total", "Journaled entries re-applied by replay after an interrupted ingestion.")
+
+// journalEntry is one encrypted bucket entry of a journaled batch, as passed
+// to AppendUnique. Values are ciphertexts, so the journal holds nothing that
+// the corpus does not already hold.
+type journalEntry struct {
+	Key        string `json:"key"`
+	BucketHash *int64 `json:"bucketHash,omitempty"`
+	Value      []byte `json:"value"`
+}
+
+// bucketHash returns the username hash of e in the form taken by
+// AppendUnique.
+func (e journalEntry) bucketHash() sql.NullInt64 {
+	if e.BucketHash == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *e.BucketHash, Valid: true}
+}
+
+// Journal operations. Ingestion appends entries, and a point-in-time restore
+// removes the entries appended after its target.
+const (
+	journalAppend = "append"
+	journalRemove = "remove"
+)
+
+// journalBatch is a journaled batch of entries. AppliedAt is nil until every
+// entry of the batch has been stored, or removed. SkippedAt is set instead
+// for a batch that is kept only as a record and never applied, such as one
+// from a disabled source, so mirrors must not apply it either.
+type journalBatch struct {
+	Seq       int64          `json:"seq"`
+	Op        string         `json:"op"`
+	Version   uint16         `json:"version"`
+	CreatedAt time.Time      `json:"createdAt"`
+	AppliedAt *time.Time     `json:"appliedAt,omitempty"`
+	SkippedAt *time.Time     `json:"skippedAt,omitempty"`
+	Source    string         `json:"source,omitempty"`
+	Entries   []journalEntry `json:"entries"`
+}
+
+// journalBatchSize is the number of credentials that ingestParallel hands to
+// a worker at a time, and so the number journaled together.
+const journalBatchSize = 64
+
+// journalEnabled reports whether ingestion batches are journaled before they
+// are applied. INGEST_JOURNAL_ENABLED=false skips the journal, trading crash
+// recovery and change history for one less write per batch.
+func journalEnabled() bool {
+	return envBool("INGEST_JOURNAL_ENABLED", true)
+}
+
+// journalReplayAfter returns how long a batch may stay unapplied before it
+// is considered interrupted and replayed. It must exceed INGEST_TIMEOUT so
+// that batches still being applied are left alone.
+func journalReplayAfter() time.Duration {
+	return envDuration("INGEST_JOURNAL_REPLAY_AFTER", 10*time.Minute)
+}
+
+// journal records op on entries of cs as a pending batch and returns its
+// sequence number. It returns zero without writing anything if journaling is
+// disabled.
+func (s *server) journal(ctx context.Context, cs *cryptoSuite, op string, entries []journalEntry) (int64, error) {
+	return s.journalSource(ctx, cs.cfg.Version, op, "", entries)
+}
+
+// journalSource is journal for the corpus of version, tagging the batch with
+// the breach source its entries came from unless source is empty.
+func (s *server) journalSource(ctx context.Context, version uint16, op, source string, entries []journalEntry) (int64, error) {
+	if !s.journaling || len(entries) == 0 {
+		return 0, nil
+	}
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return 0, err
+	}
+	var seq int64
+	query := `INSERT INTO ingest_journal (op, version, entries, entry_count, source) VALUES ($1, $2, $3, $4, $5) RETURNING seq`
+	tag := sql.NullString{String: source, Valid: source != ""}
+	err = s.kv.retry(ctx, "journal", func() error {
+		return s.kv.db().QueryRowContext(ctx, query, op, version, body, len(entries), tag).Scan(&seq)
+	})
+	return seq, err
+}
+
+// journalApplied marks the batch seq as fully applied. Batches that are
+// never marked are replayed by replayJournal.
+func (s *server) journalApplied(ctx context.Context, seq int64) {
+	if seq == 0 {
+		return
+	}
+	query := `UPDATE ingest_journal SET applied_at = now() WHERE seq = $1`
+	if _, err := s.kv.db().ExecContext(context.WithoutCancel(ctx), query, seq); err != nil {
+		log.Printf("Marking journal batch %d applied failed: %v", seq, err)
+	}
+}
+
+// journalSkipped marks the batch seq as settled without applying it, so
+// that it is neither replayed nor applied by mirrors.
+func (s *server) journalSkipped(ctx context.Context, seq int64) {
+	if seq == 0 {
+		return
+	}
+	query := `UPDATE ingest_journal SET skipped_at = now() WHERE seq = $1`
+	if _, err := s.kv.db().ExecContext(context.WithoutCancel(ctx), query, seq); err != nil {
+		log.Printf("Marking journal batch %d skipped failed: %v", seq, err)
+	}
+}
+
+// replayJournal applies every batch left pending for longer than age, in
+// journal order, and returns the number of batches replayed. An entry that
+// a later batch, such as a rollback, a source being disabled or a restore,
+// removed or re-added is left as that batch left it, and the appends of
+// sources disabled since are skipped, so replay never undoes a deliberate
+// change. What remains is idempotent, so replaying a batch twice, or
+// concurrently from two instances, is harmless.
+func (s *server) replayJournal(ctx context.Context, age time.Duration) (int, error) {
+	query := `
+	SELECT seq, op, version, COALESCE(source, ''), entries,
+		applied_at IS NULL AND created_at < now() - make_interval(secs => $1)
+	FROM ingest_journal
+	WHERE skipped_at IS NULL AND seq >= (
+		SELECT min(seq) FROM ingest_journal
+		WHERE applied_at IS NULL AND skipped_at IS NULL AND created_at < now() - make_interval(secs => $1))
+	ORDER BY seq`
+	rows, err := s.kv.db().QueryContext(ctx, query, age.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	var batches []journalBatch
+	due := map[int64]bool{}
+	for rows.Next() {
+		var b journalBatch
+		var body []byte
+		var pending bool
+		if err := rows.Scan(&b.Seq, &b.Op, &b.Version, &b.Source, &body, &pending); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if err := json.Unmarshal(body, &b.Entries); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batches = append(batches, b)
+		if pending {
+			due[b.Seq] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(due) == 0 {
+		return 0, nil
+	}
+	sources, err := s.loadSources(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	disabled := map[string]bool{}
+	for _, src := range sources {
+		disabled[src.ID] = !src.Enabled
+	}
+
+	replayed := 0
+	for _, p := range planReplay(batches, due, disabled) {
+		if p.skip {
+			s.journalSkipped(ctx, p.seq)
+			log.Printf("Skipped journal %s batch %d of disabled source %s", p.op, p.seq, p.source)
+			continue
+		}
+		var changed int
+		var err error
+		switch {
+		case len(p.entries) == 0:
+		case p.op == journalRemove:
+			changed, err = s.removeEntries(ctx, p.entries)
+		default:
+			changed, err = s.insert(ctx, p.entries)
+		}
+		if err != nil {
+			return replayed, err
+		}
+		journalReplayed.Add(float64(changed))
+		s.journalApplied(ctx, p.seq)
+		if changed > 0 {
+			s.corpusChanged()
+		}
+		log.Printf("Replayed journal %s batch %d (%d of %d entries were outstanding, %d superseded)", p.op, p.seq, changed, len(p.entries), p.superseded)
+		replayed++
+	}
+	return replayed, nil
+}
+
+// replayStep is a batch for replayJournal to apply with the entries left
+// once superseded ones are dropped, or to mark skipped.
+type replayStep struct {
+	seq        int64
+	op         string
+	source     string
+	entries    []journalEntry
+	superseded int
+	skip       bool
+}
+
+// planReplay returns the steps replaying the batches of due, in journal
+// order. batches must hold every batch that is not skipped from the oldest
+// due one on, in journal order, and disabled the sources currently
+// disabled. An entry of a due batch is dropped if a later batch applied the
+// opposite operation to it, and appends of disabled sources are skipped.
+func planReplay(batches []journalBatch, due map[int64]bool, disabled map[string]bool) []replayStep {
+	type entryID struct {
+		version    uint16
+		key, value string
+	}
+	// Walking the journal backwards, latest holds the last operation on
+	// each entry after the batch at hand.
+	latest := map[entryID]string{}
+	var steps []replayStep
+	for i := len(batches) - 1; i >= 0; i-- {
+		b := batches[i]
+		if due[b.Seq] {
+			step := replayStep{seq: b.Seq, op: b.Op, source: b.Source}
+			if b.Op == journalAppend && disabled[b.Source] {
+				step.skip = true
+			} else {
+				for _, e := range b.Entries {
+					if op, ok := latest[entryID{b.Version, e.Key, string(e.Value)}]; ok && op != b.Op {
+						step.superseded++
+						continue
+					}
+					step.entries = append(step.entries, e)
+				}
+			}
+			steps = append(steps, step)
+			if step.skip {
+				continue
+			}
+		}
+		for _, e := range b.Entries {
+			latest[entryID{b.Version, e.Key, string(e.Value)}] = b.Op
+		}
+	}
+	for i, j := 0, len(steps)-1; i < j; i, j = i+1, j-1 {
+		steps[i], steps[j] = steps[j], steps[i]
+	}
+	return steps
+}
+
+// journalBatches returns up to limit batches following seq after, oldest
+// first. Unless pending is set, the listing stops before the oldest pending
+// batch, so that a reader paging through the journal never skips past a
+// batch that is applied later. Skipped batches are listed, marked as such.
+func (s *server) journalBatches(ctx context.Context, after int64, limit int, pending bool) ([]journalBatch, error) {
+	query := `
+	SELECT seq, op, version, created_at, applied_at, skipped_at, COALESCE(source, ''), entries FROM ingest_journal
+	WHERE seq > $1 AND ($3 OR seq < COALESCE(
+		(SELECT min(seq) FROM ingest_journal WHERE applied_at IS NULL AND skipped_at IS NULL), 9223372036854775807))
+	ORDER BY seq LIMIT $2`
+	rows, err := s.kv.db().QueryContext(ctx, query, after, limit, pending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batches := []journalBatch{}
+	for rows.Next() {
+		var b journalBatch
+		var appliedAt, skippedAt sql.NullTime
+		var body []byte
+		if err := rows.Scan(&b.Seq, &b.Op, &b.Version, &b.CreatedAt, &appliedAt, &skippedAt, &b.Source, &body); err != nil {
+			return nil, err
+		}
+		if appliedAt.Valid {
+			b.AppliedAt = &appliedAt.Time
+		}
+		if skippedAt.Valid {
+			b.SkippedAt = &skippedAt.Time
+		}
+		if err := json.Unmarshal(body, &b.Entries); err != nil {
+			return nil, err
+		}
+		batches = append(batches, b)
+	}
+	return batches, rows.Err()
+}
+
+// journalPage is served by GET /api/admin/journal. Next is the after value
+// for the following page.
+type journalPage struct {
+	Batches []journalBatch `json:"batches"`
+	Next    int64          `json:"next"`
+}
+
+// handleJournal serves the ingestion journal for building downstream
+// mirrors. GET lists applied and skipped batches after the after query
+// parameter, or pending ones too with pending=true. POST replays pending batches older
+// than the olderThan query parameter, INGEST_JOURNAL_REPLAY_AFTER by
+// default.
+func (s *server) handleJournal(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	switch req.Method {
+	case http.MethodGet:
+		var after int64
+		if v := q.Get("after"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				writeError(w, "invalid after", http.StatusBadRequest)
+				return
+			}
+			after = n
+		}
+		limit := 100
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 1000 {
+				writeError(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		batches, err := s.journalBatches(req.Context(), after, limit, q.Get("pending") == "true")
+		if err != nil {
+			storageError(w, "Listing journal", err)
+			return
+		}
+		page := journalPage{Batches: batches, Next: after}
+		if len(batches) > 0 {
+			page.Next = batches[len(batches)-1].Seq
+		}
+		writeJSON(w, http.StatusOK, page)
+	case http.MethodPost:
+		age := journalReplayAfter()
+		if v := q.Get("olderThan"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				writeError(w, "invalid olderThan", http.StatusBadRequest)
+				return
+			}
+			age = d
+		}
+		replayed, err := s.replayJournal(req.Context(), age)
+		if err != nil {
+			storageError(w, "Replaying journal", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"replayed": replayed})
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
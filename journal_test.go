@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanReplay(t *testing.T) {
+	entry := func(key, value string) journalEntry {
+		return journalEntry{Key: key, Value: []byte(value)}
+	}
+	a, b, c := entry("k1", "a"), entry("k1", "b"), entry("k2", "c")
+	batch := func(seq int64, op, source string, entries ...journalEntry) journalBatch {
+		return journalBatch{Seq: seq, Op: op, Version: 1, Source: source, Entries: entries}
+	}
+	tests := []struct {
+		name     string
+		batches  []journalBatch
+		due      []int64
+		disabled []string
+		want     []replayStep
+	}{
+		{
+			name:    "nothing later",
+			batches: []journalBatch{batch(1, journalAppend, "", a, b)},
+			due:     []int64{1},
+			want:    []replayStep{{seq: 1, op: journalAppend, entries: []journalEntry{a, b}}},
+		},
+		{
+			name:    "removed by a later rollback",
+			batches: []journalBatch{batch(1, journalAppend, "", a, b), batch(2, journalRemove, "", a)},
+			due:     []int64{1},
+			want:    []replayStep{{seq: 1, op: journalAppend, entries: []journalEntry{b}, superseded: 1}},
+		},
+		{
+			name:    "re-added after the removal",
+			batches: []journalBatch{batch(1, journalAppend, "", a), batch(2, journalRemove, "", a), batch(3, journalAppend, "", a)},
+			due:     []int64{1},
+			want:    []replayStep{{seq: 1, op: journalAppend, superseded: 1}},
+		},
+		{
+			name:    "appended again later",
+			batches: []journalBatch{batch(1, journalAppend, "", a), batch(2, journalAppend, "", a)},
+			due:     []int64{1},
+			want:    []replayStep{{seq: 1, op: journalAppend, entries: []journalEntry{a}}},
+		},
+		{
+			name:    "removal undone by a restore",
+			batches: []journalBatch{batch(1, journalRemove, "", a, c), batch(2, journalAppend, "", c)},
+			due:     []int64{1},
+			want:    []replayStep{{seq: 1, op: journalRemove, entries: []journalEntry{a}, superseded: 1}},
+		},
+		{
+			name:     "disabled source",
+			batches:  []journalBatch{batch(1, journalAppend, "breach", a), batch(2, journalAppend, "other", c)},
+			due:      []int64{1, 2},
+			disabled: []string{"breach"},
+			want: []replayStep{
+				{seq: 1, op: journalAppend, source: "breach", skip: true},
+				{seq: 2, op: journalAppend, source: "other", entries: []journalEntry{c}},
+			},
+		},
+		{
+			name:     "skipped append does not supersede",
+			batches:  []journalBatch{batch(1, journalRemove, "", a), batch(2, journalAppend, "breach", a)},
+			due:      []int64{1, 2},
+			disabled: []string{"breach"},
+			want: []replayStep{
+				{seq: 1, op: journalRemove, entries: []journalEntry{a}},
+				{seq: 2, op: journalAppend, source: "breach", skip: true},
+			},
+		},
+		{
+			name:    "two due batches",
+			batches: []journalBatch{batch(1, journalAppend, "", a), batch(2, journalRemove, "", a)},
+			due:     []int64{1, 2},
+			want: []replayStep{
+				{seq: 1, op: journalAppend, superseded: 1},
+				{seq: 2, op: journalRemove, entries: []journalEntry{a}},
+			},
+		},
+		{
+			name: "other versions differ",
+			batches: []journalBatch{
+				batch(1, journalAppend, "", a),
+				{Seq: 2, Op: journalRemove, Version: 2, Entries: []journalEntry{a}},
+			},
+			due:  []int64{1},
+			want: []replayStep{{seq: 1, op: journalAppend, entries: []journalEntry{a}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			due, disabled := map[int64]bool{}, map[string]bool{}
+			for _, seq := range tt.due {
+				due[seq] = true
+			}
+			for _, source := range tt.disabled {
+				disabled[source] = true
+			}
+			if got := planReplay(tt.batches, due, disabled); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("planReplay() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
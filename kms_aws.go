@@ -0,0 +1,143 @@
+//go:build full || aws || !(minimal || azure)
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	keyAgreements["aws-kms"] = awsKMS{client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// awsKMS agrees on keys with AWS KMS, calling its JSON API with requests
+// signed with Signature Version 4.
+type awsKMS struct {
+	client *http.Client
+}
+
+func (k awsKMS) publicKey(ctx context.Context, keyID string) (*ecdh.PublicKey, error) {
+	var resp struct {
+		PublicKey []byte
+	}
+	if err := k.call(ctx, "GetPublicKey", map[string]string{"KeyId": keyID}, &resp); err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(resp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	ec, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key %s is not an elliptic curve key", keyID)
+	}
+	return ec.ECDH()
+}
+
+func (k awsKMS) agree(ctx context.Context, keyID string, peer *ecdh.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		SharedSecret []byte
+	}
+	req := map[string]any{"KeyId": keyID, "KeyAgreementAlgorithm": "ECDH", "PublicKey": der}
+	if err := k.call(ctx, "DeriveSharedSecret", req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.SharedSecret, nil
+}
+
+// call calls the KMS action with body, decoding the response into out.
+func (k awsKMS) call(ctx context.Context, action string, body, out any) error {
+	region := os.Getenv("AWS_REGION")
+	endpoint := os.Getenv("AWS_KMS_ENDPOINT")
+	if endpoint == "" {
+		if region == "" {
+			return errors.New("AWS_REGION environment variable not set")
+		}
+		endpoint = "https://kms." + region + ".amazonaws.com"
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	signAWS(req, data, "kms", region, time.Now())
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("KMS %s: %s: %s", action, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// signAWS signs req, with body, for service in region with Signature
+// Version 4 and the credentials of the AWS_ variables.
+func signAWS(req *http.Request, body []byte, service, region string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, path, req.URL.RawQuery)
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+	signed := strings.Join(names, ";")
+	bodyHash := sha256.Sum256(body)
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, hex.EncodeToString(bodyHash[:]))
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	key := []byte("AWS4" + os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	for _, part := range []string{date, region, service, "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		os.Getenv("AWS_ACCESS_KEY_ID"), scope, signed, hex.EncodeToString(key)))
+}
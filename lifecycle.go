@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Outside Azure Functions, as on Kubernetes, the server listens on PORT
+// when FUNCTIONS_CUSTOMHANDLER_PORT is not set and answers the probes
+// below. On SIGTERM it starts failing the readiness probe, keeps serving for
+// SHUTDOWN_DELAY (default 5s) while the endpoint is taken out of rotation,
+// and then stops accepting connections and waits up to SHUTDOWN_TIMEOUT
+// (default 20s) for in-flight requests, before closing streams still open.
+// The two should add up to less than terminationGracePeriodSeconds. Secrets
+// can be mounted as files, see secrets.go. The invocation envelopes of the
+// Functions host, which carry no credential, are only served under
+// Functions, so that nobody reaching the port can post a QueueIngest batch
+// or run TimerMaintenance.
+//
+//	GET /healthz  200 while the process serves requests (liveness)
+//	GET /readyz   200 once storage is initialized and until shutdown starts,
+//	              503 otherwise (readiness)
+
+// underFunctions reports whether the server runs as a Functions custom
+// handler.
+func underFunctions() bool {
+	_, ok := os.LookupEnv("FUNCTIONS_CUSTOMHANDLER_PORT")
+	return ok
+}
+
+// listenAddress returns the address to listen on.
+func listenAddress() string {
+	if underFunctions() {
+		return ":" + os.Getenv("FUNCTIONS_CUSTOMHANDLER_PORT")
+	}
+	if port, ok := os.LookupEnv("PORT"); ok {
+		return ":" + port
+	}
+	return ":8080"
+}
+
+// handleLiveness answers the liveness probe.
+func (s *server) handleLiveness(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadiness answers the readiness probe, initializing storage if it
+// has not been yet.
+func (s *server) handleReadiness(w http.ResponseWriter, req *http.Request) {
+	if s.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	if err := s.ensureStorage(); err != nil {
+		log.Println("Storage initialization failed:", err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// run serves srv until SIGTERM or SIGINT, then drains it as described
+// above. stop is called once draining starts, to end background work.
+func (s *server) run(srv *http.Server, stop func()) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- serve(srv) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down, draining requests")
+	s.draining.Store(true)
+	stop()
+	time.Sleep(envDuration("SHUTDOWN_DELAY", 5*time.Second))
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 20*time.Second))
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("Draining requests did not complete:", err)
+		srv.Close()
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Println("Shut down")
+	return nil
+}
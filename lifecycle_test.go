@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProbes(t *testing.T) {
+	s, srv := newTestServer(t)
+	probe := func(path string) int {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := probe("/healthz"); status != http.StatusOK {
+		t.Fatalf("liveness status %d, want %d", status, http.StatusOK)
+	}
+	if status := probe("/readyz"); status != http.StatusOK {
+		t.Fatalf("readiness status %d, want %d", status, http.StatusOK)
+	}
+	s.draining.Store(true)
+	if status := probe("/readyz"); status != http.StatusServiceUnavailable {
+		t.Fatalf("readiness status while draining %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	if status := probe("/healthz"); status != http.StatusOK {
+		t.Fatalf("liveness status while draining %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	t.Setenv("PORT", "9000")
+	t.Setenv("FUNCTIONS_CUSTOMHANDLER_PORT", "7071")
+	if got := listenAddress(); got != ":7071" {
+		t.Fatalf("listenAddress() = %q, want the Functions port", got)
+	}
+}
+
+func TestEnvelopesOnlyUnderFunctions(t *testing.T) {
+	post := func(srv *httptest.Server, function string) int {
+		t.Helper()
+		resp, err := http.Post(srv.URL+"/"+function, "application/json", strings.NewReader(`{"Data": {"item": "{\"credentials\": [\"user@example.com:password1\"]}"}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	_, srv := newTestServer(t)
+	for _, function := range []string{"QueueIngest", "TimerMaintenance"} {
+		if status := post(srv, function); status != http.StatusNotFound {
+			t.Errorf("%s envelope outside Functions: status %d, want %d", function, status, http.StatusNotFound)
+		}
+	}
+
+	t.Setenv("FUNCTIONS_CUSTOMHANDLER_PORT", "7071")
+	_, srv = newTestServer(t)
+	if status := post(srv, "QueueIngest"); status == http.StatusNotFound {
+		t.Error("QueueIngest envelope not served under Functions")
+	}
+}
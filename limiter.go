@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+var (
+	queryInflight = newGauge("migp_query_inflight", "Query evaluations currently running.")
+	queryQueued   = newGauge("migp_query_queued", "Queries waiting for an evaluation slot.")
+	queryShed     = newCounter("migp_query_shed_total", "Queries rejected by the concurrency limiter by reason.", "reason")
+)
+
+// queryLimiter bounds the number of concurrent query evaluations. Queries
+// beyond the limit wait in a bounded queue for up to a timeout, and queries
+// that find the queue full or time out are shed with a 503, so that overload
+// shows up as fast rejections rather than piled up goroutines and database
+// connections.
+type queryLimiter struct {
+	slots      chan struct{}
+	queue      chan struct{}
+	timeout    time.Duration
+	retryAfter time.Duration
+}
+
+// newQueryLimiter returns a queryLimiter configured from QUERY_MAX_CONCURRENCY
+// (default 8 per CPU), QUERY_QUEUE_SIZE, QUERY_QUEUE_TIMEOUT and
+// QUERY_RETRY_AFTER, or nil if QUERY_MAX_CONCURRENCY is 0.
+func newQueryLimiter() *queryLimiter {
+	concurrency := envInt("QUERY_MAX_CONCURRENCY", 8*runtime.NumCPU())
+	if concurrency <= 0 {
+		return nil
+	}
+	queueSize := envInt("QUERY_QUEUE_SIZE", 4*concurrency)
+	if queueSize < 0 {
+		log.Printf("Invalid QUERY_QUEUE_SIZE value %d. Using 0.", queueSize)
+		queueSize = 0
+	}
+	return &queryLimiter{
+		slots:      make(chan struct{}, concurrency),
+		queue:      make(chan struct{}, queueSize),
+		timeout:    envDuration("QUERY_QUEUE_TIMEOUT", time.Second),
+		retryAfter: envDuration("QUERY_RETRY_AFTER", time.Second),
+	}
+}
+
+// acquire waits for an evaluation slot for req, returning the function
+// releasing it. If the query is shed, acquire responds with a 503 and returns
+// nil. A nil limiter admits every query.
+func (l *queryLimiter) acquire(w http.ResponseWriter, req *http.Request) func() {
+	queryRate.mark(time.Now())
+	if l == nil {
+		return func() {}
+	}
+	release := func() {
+		<-l.slots
+		queryInflight.Add(-1)
+	}
+	select {
+	case l.slots <- struct{}{}:
+		queryInflight.Add(1)
+		return release
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}:
+	default:
+		l.shed(w, "queue_full")
+		return nil
+	}
+	queryQueued.Add(1)
+	defer func() {
+		<-l.queue
+		queryQueued.Add(-1)
+	}()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		queryInflight.Add(1)
+		return release
+	case <-timer.C:
+		l.shed(w, "timeout")
+	case <-req.Context().Done():
+		l.shed(w, "canceled")
+	}
+	return nil
+}
+
+// shed rejects a query with a 503 and a Retry-After hint.
+func (l *queryLimiter) shed(w http.ResponseWriter, reason string) {
+	queryShed.Inc(reason)
+	seconds := int((l.retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeErrorCode(w, errOverloaded, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryLimiter(t *testing.T) {
+	t.Setenv("QUERY_MAX_CONCURRENCY", "0")
+	if l := newQueryLimiter(); l != nil {
+		t.Fatal("limiter enabled with QUERY_MAX_CONCURRENCY=0")
+	}
+	var disabled *queryLimiter
+	if release := disabled.acquire(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/query", nil)); release == nil {
+		t.Fatal("nil limiter shed a query")
+	}
+
+	t.Setenv("QUERY_MAX_CONCURRENCY", "1")
+	t.Setenv("QUERY_QUEUE_SIZE", "1")
+	t.Setenv("QUERY_QUEUE_TIMEOUT", "20ms")
+	t.Setenv("QUERY_RETRY_AFTER", "1500ms")
+	l := newQueryLimiter()
+	acquire := func(ctx context.Context) (func(), *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		return l.acquire(rec, httptest.NewRequest(http.MethodPost, "/api/query", nil).WithContext(ctx)), rec
+	}
+
+	release, _ := acquire(context.Background())
+	if release == nil {
+		t.Fatal("first query shed")
+	}
+	if shed, rec := acquire(context.Background()); shed != nil || rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "2" {
+		t.Fatalf("queued query past its timeout answered %d with Retry-After %q, want a 503 after 2s", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// A query waiting in the queue gets the slot once it is released.
+	l.timeout = time.Minute
+	admitted := make(chan func())
+	go func() {
+		r, _ := acquire(context.Background())
+		admitted <- r
+	}()
+	for len(l.queue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if shed, rec := acquire(context.Background()); shed != nil || rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("query finding the queue full answered %d", rec.Code)
+	}
+	release()
+	if r := <-admitted; r == nil {
+		t.Fatal("queued query shed after a slot was released")
+	} else {
+		r()
+	}
+
+	release, _ = acquire(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if shed, rec := acquire(ctx); shed != nil || rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("canceled query answered %d", rec.Code)
+	}
+	release()
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LOG_SINKS selects where the server logs, as a comma-separated list of
+// sinks, each line going to all of them. Without it, lines go to stderr as
+// the Functions host expects. The sinks are:
+//
+//	stderr       text lines on stderr
+//	stdout-json  JSON lines on stdout, {"time": "<RFC 3339>", "message": "..."}
+//	file         text lines appended to LOG_FILE, rotated once larger than
+//	             LOG_FILE_MAX_SIZE bytes (default 100 MiB), keeping
+//	             LOG_FILE_MAX_BACKUPS (default 5) as LOG_FILE.1 and so on
+//	syslog       RFC 5424 messages to LOG_SYSLOG_ADDRESS, as udp://host:port
+//	             or tcp://host:port, with the app name LOG_SYSLOG_TAG
+//	             (default migp)
+//	blob         text lines appended to an append blob per instance and day
+//	             in the Azure Blob Storage container of the SAS URL
+//	             LOG_BLOB_CONTAINER_URL, every LOG_BLOB_FLUSH_INTERVAL
+//	             (default 5s)
+//
+// Sinks apply to the server only; commands log to stderr. A sink that fails
+// reports it on stderr, at most once a minute, and the line is lost to it.
+
+// logSink writes log lines somewhere.
+type logSink interface {
+	// write writes line, logged at t and without its newline.
+	write(t time.Time, line []byte) error
+
+	// close flushes what the sink holds back.
+	close() error
+}
+
+// logSinks maps the LOG_SINKS names to the constructors of their sinks.
+var logSinks = map[string]func() (logSink, error){
+	"stderr":      func() (logSink, error) { return textSink{os.Stderr}, nil },
+	"stdout-json": func() (logSink, error) { return jsonSink{os.Stdout}, nil },
+	"file":        newFileSink,
+	"syslog":      newSyslogSink,
+	"blob":        newBlobLogSink,
+}
+
+// setupLogSinks directs the standard logger to the sinks of LOG_SINKS and
+// returns a function closing them, or does nothing if it is not set.
+func setupLogSinks() (func(), error) {
+	names := strings.TrimSpace(os.Getenv("LOG_SINKS"))
+	if names == "" {
+		return func() {}, nil
+	}
+	fan := &logFanout{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		open, ok := logSinks[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown log sink %q in LOG_SINKS", name)
+		}
+		sink, err := open()
+		if err != nil {
+			return nil, fmt.Errorf("log sink %s: %w", name, err)
+		}
+		fan.names = append(fan.names, name)
+		fan.sinks = append(fan.sinks, sink)
+		fan.failed = append(fan.failed, time.Time{})
+	}
+	// The sinks timestamp lines themselves.
+	log.SetFlags(0)
+	log.SetOutput(fan)
+	return fan.close, nil
+}
+
+// logFanout writes every line to each sink.
+type logFanout struct {
+	mu     sync.Mutex
+	names  []string
+	sinks  []logSink
+	failed []time.Time
+}
+
+func (f *logFanout) Write(p []byte) (int, error) {
+	now := time.Now().UTC()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, line := range bytes.Split(bytes.TrimSuffix(p, []byte("\n")), []byte("\n")) {
+		for i, sink := range f.sinks {
+			if err := sink.write(now, line); err != nil && now.Sub(f.failed[i]) >= time.Minute {
+				f.failed[i] = now
+				fmt.Fprintf(os.Stderr, "Log sink %s failed: %v\n", f.names[i], err)
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// close closes the sinks, reporting failures on stderr.
+func (f *logFanout) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, sink := range f.sinks {
+		if err := sink.close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Closing log sink %s failed: %v\n", f.names[i], err)
+		}
+	}
+}
+
+// appendTextLine appends line as written by the standard logger with
+// log.LstdFlags.
+func appendTextLine(b []byte, t time.Time, line []byte) []byte {
+	b = t.AppendFormat(b, "2006/01/02 15:04:05 ")
+	b = append(b, line...)
+	return append(b, '\n')
+}
+
+// textSink writes text lines to w.
+type textSink struct{ w io.Writer }
+
+func (s textSink) write(t time.Time, line []byte) error {
+	_, err := s.w.Write(appendTextLine(nil, t, line))
+	return err
+}
+
+func (s textSink) close() error { return nil }
+
+// jsonSink writes JSON lines to w.
+type jsonSink struct{ w io.Writer }
+
+func (s jsonSink) write(t time.Time, line []byte) error {
+	b, err := json.Marshal(struct {
+		Time    time.Time `json:"time"`
+		Message string    `json:"message"`
+	}{t, string(line)})
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+func (s jsonSink) close() error { return nil }
+
+// fileSink appends text lines to a file it rotates by size.
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// newFileSink opens the file sink configured as described above.
+func newFileSink() (logSink, error) {
+	s := &fileSink{
+		path:       os.Getenv("LOG_FILE"),
+		maxSize:    int64(envInt("LOG_FILE_MAX_SIZE", 100<<20)),
+		maxBackups: envInt("LOG_FILE_MAX_BACKUPS", 5),
+	}
+	if s.path == "" {
+		return nil, errors.New("LOG_FILE is not set")
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the log file for appending.
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+func (s *fileSink) write(t time.Time, line []byte) error {
+	b := appendTextLine(nil, t, line)
+	if s.size > 0 && s.size+int64(len(b)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+// rotate shifts the backups up by one, dropping the oldest, and starts a
+// new file.
+func (s *fileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+	if s.maxBackups <= 0 {
+		return os.Remove(s.path)
+	}
+	for i := s.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(s.path+"."+strconv.Itoa(i), s.path+"."+strconv.Itoa(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(s.path, s.path+".1")
+}
+
+func (s *fileSink) close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// syslogSink sends RFC 5424 messages over UDP, or over TCP with octet
+// counting framing, reconnecting after failures. While the server cannot be
+// reached, lines are dropped for syslogRetryDelay rather than holding up
+// logging with another connection attempt.
+type syslogSink struct {
+	network, address string
+	tag, hostname    string
+	conn             net.Conn
+	retryAt          time.Time
+}
+
+// syslogRetryDelay is the time between connection attempts.
+const syslogRetryDelay = 10 * time.Second
+
+// newSyslogSink returns the syslog sink configured as described above.
+func newSyslogSink() (logSink, error) {
+	u, err := url.Parse(os.Getenv("LOG_SYSLOG_ADDRESS"))
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return nil, errors.New("LOG_SYSLOG_ADDRESS must be udp://host:port or tcp://host:port")
+	}
+	s := &syslogSink{network: u.Scheme, address: u.Host, tag: os.Getenv("LOG_SYSLOG_TAG")}
+	if s.tag == "" {
+		s.tag = "migp"
+	}
+	if s.hostname, err = os.Hostname(); err != nil || s.hostname == "" {
+		s.hostname = "-"
+	}
+	return s, nil
+}
+
+// syslogPriority is the priority of the messages: facility user, severity
+// informational.
+const syslogPriority = 1*8 + 6
+
+func (s *syslogSink) write(t time.Time, line []byte) error {
+	msg := fmt.Appendf(nil, "<%d>1 %s %s %s %d - - ", syslogPriority, t.Format(time.RFC3339Nano), s.hostname, s.tag, os.Getpid())
+	msg = append(msg, line...)
+	if s.network == "tcp" {
+		frame := strconv.AppendInt(nil, int64(len(msg)), 10)
+		msg = append(append(frame, ' '), msg...)
+	}
+	if s.conn == nil {
+		if time.Now().Before(s.retryAt) {
+			return errors.New("server unreachable, dropping lines")
+		}
+		conn, err := net.DialTimeout(s.network, s.address, 5*time.Second)
+		if err != nil {
+			s.retryAt = time.Now().Add(syslogRetryDelay)
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.conn.Write(msg); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *syslogSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// maxBlobLogBuffer bounds the lines a blob sink holds back, a little below
+// the 4 MiB limit of an appended block.
+const maxBlobLogBuffer = 4<<20 - 64<<10
+
+// blobLogSink appends text lines to append blobs named
+// <instance>/<YYYY-MM-DD>.log, flushing them from the background.
+type blobLogSink struct {
+	client       *http.Client
+	containerURL *url.URL
+	instance     string
+	created      map[string]bool
+
+	mu      sync.Mutex
+	chunks  []blobLogChunk
+	size    int
+	dropped int
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// blobLogChunk holds lines of one day waiting to be appended.
+type blobLogChunk struct {
+	day  string
+	data []byte
+}
+
+// newBlobLogSink returns the blob sink configured as described above. The
+// instance is WEBSITE_INSTANCE_ID in Azure, the host name elsewhere.
+func newBlobLogSink() (logSink, error) {
+	containerURL, err := url.Parse(os.Getenv("LOG_BLOB_CONTAINER_URL"))
+	if err != nil || containerURL.Host == "" {
+		return nil, errors.New("LOG_BLOB_CONTAINER_URL must be a container SAS URL")
+	}
+	instance := os.Getenv("WEBSITE_INSTANCE_ID")
+	if instance == "" {
+		if instance, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	s := &blobLogSink{
+		client:       &http.Client{Timeout: 30 * time.Second},
+		containerURL: containerURL,
+		instance:     fmt.Sprintf("%s-%d", instance, os.Getpid()),
+		created:      map[string]bool{},
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	go s.run(envDuration("LOG_BLOB_FLUSH_INTERVAL", 5*time.Second))
+	return s, nil
+}
+
+func (s *blobLogSink) write(t time.Time, line []byte) error {
+	b := appendTextLine(nil, t, line)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size+len(b) > maxBlobLogBuffer {
+		s.dropped++
+		return errors.New("buffer full, dropping lines")
+	}
+	day := t.Format(time.DateOnly)
+	if n := len(s.chunks); n == 0 || s.chunks[n-1].day != day {
+		s.chunks = append(s.chunks, blobLogChunk{day: day})
+	}
+	last := &s.chunks[len(s.chunks)-1]
+	last.data = append(last.data, b...)
+	s.size += len(b)
+	return nil
+}
+
+// run flushes the buffered lines every interval until the sink is closed.
+func (s *blobLogSink) run(interval time.Duration) {
+	defer close(s.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		if err := s.flush(); err != nil {
+			fmt.Fprintln(os.Stderr, "Log sink blob failed:", err)
+		}
+	}
+}
+
+// flush appends the buffered lines to the blobs of their days, putting back
+// those it could not append.
+func (s *blobLogSink) flush() error {
+	s.mu.Lock()
+	chunks, dropped := s.chunks, s.dropped
+	s.chunks, s.size, s.dropped = nil, 0, 0
+	s.mu.Unlock()
+	if dropped > 0 && len(chunks) > 0 {
+		last := &chunks[len(chunks)-1]
+		last.data = appendTextLine(last.data, time.Now().UTC(), fmt.Appendf(nil, "Log sink blob dropped %d lines", dropped))
+	}
+	for i, c := range chunks {
+		if err := s.appendChunk(c); err != nil {
+			s.mu.Lock()
+			s.chunks = append(chunks[i:], s.chunks...)
+			for _, c := range s.chunks {
+				s.size += len(c.data)
+			}
+			s.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// appendChunk appends c to the blob of its day, creating it first.
+func (s *blobLogSink) appendChunk(c blobLogChunk) error {
+	name := path.Join(s.instance, c.day+".log")
+	if !s.created[name] {
+		if err := s.blobRequest(name, "", nil, http.StatusCreated, http.StatusConflict); err != nil {
+			return err
+		}
+		s.created[name] = true
+	}
+	return s.blobRequest(name, "appendblock", c.data, http.StatusCreated)
+}
+
+// blobRequest creates the append blob name, or with comp set to appendblock
+// appends data to it, accepting the given statuses.
+func (s *blobLogSink) blobRequest(name, comp string, data []byte, statuses ...int) error {
+	u := *s.containerURL
+	u.Path = path.Join(u.Path, name)
+	if comp != "" {
+		q := u.Query()
+		q.Set("comp", comp)
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-version", "2021-08-06")
+	if comp == "" {
+		req.Header.Set("x-ms-blob-type", "AppendBlob")
+		req.Header.Set("If-None-Match", "*")
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	for _, status := range statuses {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s: status code %d", req.Method, name, resp.StatusCode)
+}
+
+func (s *blobLogSink) close() error {
+	close(s.done)
+	<-s.stopped
+	return s.flush()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	t.Setenv("LOG_FILE", path)
+	t.Setenv("LOG_FILE_MAX_SIZE", "100")
+	t.Setenv("LOG_FILE_MAX_BACKUPS", "2")
+	sink, err := newFileSink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.close()
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, line := range []string{"one", "two", "three", "four", "five", "six", "seven", "eight"} {
+		if err := sink.write(now, []byte(strings.Repeat(line, 5))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 100 {
+			t.Errorf("%s holds %d bytes, more than the maximum", filepath.Base(name), info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more backups than LOG_FILE_MAX_BACKUPS: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.HasPrefix(string(data), "2026/01/02 03:04:05 ") || !strings.Contains(string(data), "eight") {
+		t.Errorf("last file holds %q", data)
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	var out bytes.Buffer
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := (jsonSink{&out}).write(now, []byte(`Storage "ready"`)); err != nil {
+		t.Fatal(err)
+	}
+	var line struct {
+		Time    time.Time
+		Message string
+	}
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if !line.Time.Equal(now) || line.Message != `Storage "ready"` {
+		t.Errorf("logged %s", out.Bytes())
+	}
+}
+
+func TestBlobLogSink(t *testing.T) {
+	var mu sync.Mutex
+	blobs := map[string]string{}
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.URL.Query().Get("sig") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		data, _ := io.ReadAll(req.Body)
+		switch req.URL.Query().Get("comp") {
+		case "":
+			if _, ok := blobs[req.URL.Path]; ok {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			blobs[req.URL.Path] = ""
+		case "appendblock":
+			if _, ok := blobs[req.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			blobs[req.URL.Path] += string(data)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer storage.Close()
+
+	t.Setenv("LOG_BLOB_CONTAINER_URL", storage.URL+"/logs?sig=secret")
+	t.Setenv("WEBSITE_INSTANCE_ID", "instance")
+	t.Setenv("LOG_BLOB_FLUSH_INTERVAL", "1h")
+	sink, err := newBlobLogSink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 1, 2, 23, 59, 59, 0, time.UTC)
+	sink.write(day, []byte("first"))
+	sink.write(day.Add(2*time.Second), []byte("second"))
+	if err := sink.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	prefix := "/logs/instance-" + strconv.Itoa(os.Getpid())
+	if got := blobs[prefix+"/2026-01-02.log"]; got != "2026/01/02 23:59:59 first\n" {
+		t.Errorf("first day blob %q (blobs %v)", got, blobs)
+	}
+	if got := blobs[prefix+"/2026-01-03.log"]; got != "2026/01/03 00:00:01 second\n" {
+		t.Errorf("second day blob %q", got)
+	}
+}
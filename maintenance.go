@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// maintain runs periodic storage maintenance. Interrupted ingestion batches
+// are replayed from the journal and buckets with tombstones are compacted
+// unless the corpus is read-only, the latter also unless
+// COMPACT_ON_MAINTENANCE is false. The corpus is scrubbed for corrupted
+// buckets unless SCRUB_ON_MAINTENANCE is false, corpus statistics are
+// recorded unless CORPUS_STATS_ON_MAINTENANCE is false, expired idempotency
+// keys are deleted, and planner statistics are refreshed so that lookups
+// keep using the primary key index after large ingestions. Scheduled
+// maintenance pauses under load between and within the tasks after replay,
+// see scheduler.go.
+func (s *server) maintain(ctx context.Context) error {
+	if !s.readOnly() {
+		if _, err := s.replayJournal(ctx, journalReplayAfter()); err != nil {
+			return err
+		}
+	}
+	if s.kv.buckets != nil {
+		// Scrubbing, corpus statistics and ANALYZE work on the kv_store
+		// tables, which do not hold the buckets.
+		return s.expireIdempotencyKeys(ctx)
+	}
+	if !s.readOnly() && envBool("COMPACT_ON_MAINTENANCE", true) {
+		_, err := s.runScheduledJob(ctx, "compact", func(ctx context.Context) error {
+			result, err := s.compact(ctx)
+			if result.Entries > 0 {
+				log.Printf("Compaction dropped %d tombstoned entries from %d buckets", result.Entries, result.Buckets)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if envBool("SCRUB_ON_MAINTENANCE", true) {
+		_, err := s.runScheduledJob(ctx, "scrub", func(ctx context.Context) error {
+			result, err := s.scrub(ctx)
+			if len(result.Corrupt) > 0 {
+				log.Printf("Scrub found %d of %d buckets corrupt", len(result.Corrupt), result.Buckets)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if envBool("CORPUS_STATS_ON_MAINTENANCE", true) {
+		if err := maintenancePause(ctx); err != nil {
+			return err
+		}
+		if _, err := s.recordCorpusStats(ctx); err != nil {
+			return err
+		}
+	}
+	if err := s.expireIdempotencyKeys(ctx); err != nil {
+		return err
+	}
+	if !s.manageSchema {
+		// ANALYZE requires table ownership, which unmanaged deployments
+		// do not grant.
+		return nil
+	}
+	if err := maintenancePause(ctx); err != nil {
+		return err
+	}
+	_, err := s.kv.db().ExecContext(ctx, `ANALYZE kv_store; ANALYZE kv_store_shadow;`)
+	return err
+}
+
+// idempotencyExpiryBatch is the number of expired idempotency keys deleted
+// at a time, so that scheduled maintenance can pause between batches.
+const idempotencyExpiryBatch = 1000
+
+// expireIdempotencyKeys deletes the expired idempotency keys.
+func (s *server) expireIdempotencyKeys(ctx context.Context) error {
+	query := `
+	DELETE FROM idempotency_keys WHERE (scope, key) IN (
+		SELECT scope, key FROM idempotency_keys WHERE expires_at < now() LIMIT $1
+	)`
+	for {
+		if err := maintenancePause(ctx); err != nil {
+			return err
+		}
+		res, err := s.kv.db().ExecContext(ctx, query, idempotencyExpiryBatch)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n < idempotencyExpiryBatch {
+			return err
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"sort"
+	"sync"
+)
+
+// memoryBackend keeps the corpus buckets in process memory, selected with
+// STORAGE_BACKEND=memory. It loses everything on exit and is not shared
+// between instances, so it only suits local development and unit tests of
+// the handler, where its behavior is deterministic: entries are enumerated
+// by bucket ID, in the order they were appended.
+type memoryBackend struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+// memoryBucket is a bucket of the memory backend.
+type memoryBucket struct {
+	value   []byte
+	entries []memoryEntry
+}
+
+// memoryEntry is an entry of a bucket of the memory backend.
+type memoryEntry struct {
+	hash       [sha256.Size]byte
+	bucketHash sql.NullInt64
+	value      []byte
+}
+
+// newMemoryBackend returns an empty memory backend.
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{buckets: map[string]*memoryBucket{}}
+}
+
+// Get returns a copy of the bucket stored under id.
+func (b *memoryBackend) Get(ctx context.Context, id string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if bucket, ok := b.buckets[id]; ok {
+		return append([]byte{}, bucket.value...), nil
+	}
+	return []byte{}, nil
+}
+
+// AppendUnique appends value to the bucket stored under id unless it was
+// appended before.
+func (b *memoryBackend) AppendUnique(ctx context.Context, id string, bucketHash sql.NullInt64, value []byte) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.append(id, bucketHash, value), nil
+}
+
+// AppendBatch appends entries under a single lock.
+func (b *memoryBackend) AppendBatch(ctx context.Context, entries []journalEntry) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	added := 0
+	for _, e := range entries {
+		if b.append(e.Key, e.bucketHash(), e.Value) {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// append appends value to the bucket stored under id unless it was appended
+// before. b.mu must be held.
+func (b *memoryBackend) append(id string, bucketHash sql.NullInt64, value []byte) bool {
+	bucket, ok := b.buckets[id]
+	if !ok {
+		bucket = &memoryBucket{}
+		b.buckets[id] = bucket
+	}
+	hash := sha256.Sum256(value)
+	for _, e := range bucket.entries {
+		if e.hash == hash {
+			return false
+		}
+	}
+	value = append([]byte{}, value...)
+	bucket.entries = append(bucket.entries, memoryEntry{hash: hash, bucketHash: bucketHash, value: value})
+	bucket.value = append(bucket.value, value...)
+	return true
+}
+
+// RemoveEntries removes values from the bucket stored under id and rebuilds
+// it from the remaining entries.
+func (b *memoryBackend) RemoveEntries(ctx context.Context, id string, values [][]byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, ok := b.buckets[id]
+	if !ok {
+		return 0, nil
+	}
+	remove := map[[sha256.Size]byte]bool{}
+	for _, value := range values {
+		remove[sha256.Sum256(value)] = true
+	}
+	kept := bucket.entries[:0]
+	var value []byte
+	for _, e := range bucket.entries {
+		if !remove[e.hash] {
+			kept = append(kept, e)
+			value = append(value, e.value...)
+		}
+	}
+	removed := len(bucket.entries) - len(kept)
+	if len(kept) == 0 {
+		delete(b.buckets, id)
+		return removed, nil
+	}
+	bucket.entries, bucket.value = kept, value
+	return removed, nil
+}
+
+// Entries calls f for every entry, by bucket ID and then in the order they
+// were appended. f runs without the lock held, on a copy of the entries.
+func (b *memoryBackend) Entries(f func(id string, bucketHash sql.NullInt64, value []byte) error) error {
+	type entry struct {
+		id string
+		memoryEntry
+	}
+	b.mu.Lock()
+	ids := make([]string, 0, len(b.buckets))
+	for id := range b.buckets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var entries []entry
+	for _, id := range ids {
+		for _, e := range b.buckets[id].entries {
+			entries = append(entries, entry{id, e})
+		}
+	}
+	b.mu.Unlock()
+
+	for _, e := range entries {
+		if err := f(e.id, e.bucketHash, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close does nothing, so that a backend shared by tests stays usable.
+func (b *memoryBackend) Close() error {
+	return nil
+}
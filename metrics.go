@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultLatencyBuckets are histogram upper bounds, in seconds, suited to
+// request and storage latencies.
+var defaultLatencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is a collector exposed in the Prometheus text format.
+type metric interface {
+	metricName() string
+	write(w io.Writer)
+}
+
+var (
+	metricsMu  sync.Mutex
+	registered []metric
+)
+
+// register adds m to the set of metrics served by handleMetrics.
+func register(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	registered = append(registered, m)
+}
+
+// series is a single labelled time series of a metric.
+type series struct {
+	labelValues []string
+	value       float64
+	buckets     []uint64
+	sum         float64
+	count       uint64
+}
+
+// metricVec holds every series of a counter, gauge or histogram.
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newMetricVec(kind, name, help string, buckets []float64, labels []string) *metricVec {
+	m := &metricVec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	register(m)
+	return m
+}
+
+// get returns the series for labelValues, creating it if needed. The caller
+// must hold m.mu.
+func (m *metricVec) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", m.name, len(labelValues), len(m.labels)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if m.buckets != nil {
+			s.buckets = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metricVec) metricName() string { return m.name }
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatValue(s.value))
+			continue
+		}
+		names := append(append([]string(nil), m.labels...), "le")
+		values := append(append([]string(nil), s.labelValues...), "")
+		var cumulative uint64
+		for i, le := range m.buckets {
+			cumulative += s.buckets[i]
+			values[len(values)-1] = formatValue(le)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), cumulative)
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues), s.count)
+	}
+}
+
+// total returns the sum of the values of the series of m whose label values
+// match, or for histograms of their bucket counts, observation sums and
+// counts. A nil match matches every series.
+func (m *metricVec) total(match func(labelValues []string) bool) (value float64, buckets []uint64, sum float64, count uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	buckets = make([]uint64, len(m.buckets))
+	for _, s := range m.series {
+		if match != nil && !match(s.labelValues) {
+			continue
+		}
+		value += s.value
+		sum += s.sum
+		count += s.count
+		for i, n := range s.buckets {
+			buckets[i] += n
+		}
+	}
+	return value, buckets, sum, count
+}
+
+// counterVec is a monotonically increasing metric.
+type counterVec struct{ *metricVec }
+
+// newCounter registers a counter with the given label names.
+func newCounter(name, help string, labels ...string) counterVec {
+	return counterVec{newMetricVec("counter", name, help, nil, labels)}
+}
+
+// Inc adds one to the series identified by labelValues.
+func (c counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the series identified by labelValues.
+func (c counterVec) Add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(labelValues).value += v
+}
+
+// Set sets the series identified by labelValues to v, for counters mirroring
+// a cumulative value maintained elsewhere.
+func (c counterVec) Set(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(labelValues).value = v
+}
+
+// gaugeVec is a metric that can go up and down.
+type gaugeVec struct{ *metricVec }
+
+// newGauge registers a gauge with the given label names.
+func newGauge(name, help string, labels ...string) gaugeVec {
+	return gaugeVec{newMetricVec("gauge", name, help, nil, labels)}
+}
+
+// Set sets the series identified by labelValues to v.
+func (g gaugeVec) Set(v float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(labelValues).value = v
+}
+
+// Add adds v, which may be negative, to the series identified by labelValues.
+func (g gaugeVec) Add(v float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(labelValues).value += v
+}
+
+// histogramVec samples observations into cumulative buckets.
+type histogramVec struct{ *metricVec }
+
+// newHistogram registers a histogram with the given bucket upper bounds and
+// label names.
+func newHistogram(name, help string, buckets []float64, labels ...string) histogramVec {
+	return histogramVec{newMetricVec("histogram", name, help, buckets, labels)}
+}
+
+// Observe records v in the series identified by labelValues.
+func (h histogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.get(labelValues)
+	for i, le := range h.buckets {
+		if v <= le {
+			s.buckets[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// formatLabels renders a Prometheus label set.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// formatValue renders a sample value.
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// handleMetrics serves all registered metrics in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, req *http.Request) {
+	metricsMu.Lock()
+	metrics := append([]metric(nil), registered...)
+	metricsMu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].metricName() < metrics[j].metricName() })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
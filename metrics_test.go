@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+var (
+	testCounter   = newCounter("migp_test_events_total", "Test events by kind.", "kind")
+	testHistogram = newHistogram("migp_test_duration_seconds", "Test durations.", []float64{.1, 1}, "route")
+)
+
+func TestMetricsExposition(t *testing.T) {
+	testCounter.Inc(`quoted "kind"`)
+	testCounter.Add(2, `quoted "kind"`)
+	testHistogram.Observe(.05, "/a")
+	testHistogram.Observe(.5, "/a")
+	testHistogram.Observe(5, "/a")
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE migp_test_events_total counter\n",
+		`migp_test_events_total{kind="quoted \"kind\""} 3` + "\n",
+		"# TYPE migp_test_duration_seconds histogram\n",
+		`migp_test_duration_seconds_bucket{route="/a",le="0.1"} 1` + "\n",
+		`migp_test_duration_seconds_bucket{route="/a",le="1"} 2` + "\n",
+		`migp_test_duration_seconds_bucket{route="/a",le="+Inf"} 3` + "\n",
+		`migp_test_duration_seconds_sum{route="/a"} 5.55` + "\n",
+		`migp_test_duration_seconds_count{route="/a"} 3` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+}
+
+func TestLazyStorageInitialization(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "memory")
+	s, err := newServer(migp.DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.detached = true
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || s.storageReady.Load() {
+		t.Fatalf("config answered %d and initialized storage %v, want a 200 without storage", resp.StatusCode, s.storageReady.Load())
+	}
+
+	before, _, _, _ := initAttempts.total(func(v []string) bool { return v[0] == "success" })
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.ensureStorage(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	after, _, _, _ := initAttempts.total(func(v []string) bool { return v[0] == "success" })
+	if after-before != 1 || !s.storageReady.Load() {
+		t.Fatalf("concurrent first requests initialized storage %v times", after-before)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	mirrorRequests     = newCounter("migp_mirror_requests_total", "Queries mirrored to the secondary deployment by route and outcome.", "route", "outcome")
+	mirrorLatency      = newHistogram("migp_mirror_duration_seconds", "Duration of mirrored queries by side.", defaultLatencyBuckets, "side")
+	mirrorLatencyDelta = newHistogram("migp_mirror_latency_delta_seconds", "Duration of mirrored queries on the secondary minus that on the primary.", mirrorDeltaBuckets)
+)
+
+// mirrorDeltaBuckets are the buckets of migp_mirror_latency_delta_seconds,
+// negative where the secondary is faster.
+var mirrorDeltaBuckets = []float64{-1, -0.25, -0.1, -0.05, -0.01, 0, 0.01, 0.05, 0.1, 0.25, 1}
+
+// maxMirrorBody bounds the query bodies mirrored.
+const maxMirrorBody = 1 << 20
+
+// mirror copies a sample of queries to a secondary deployment, such as a new
+// version under test, while they are answered. Where canary shadows
+// evaluations within this server, the mirror exercises a whole other
+// deployment over HTTP. The primary's response is always the one served; the
+// secondary's is only compared with it by status and body, and divergences
+// are logged and counted with the latency of both sides. Bodies are hashed
+// rather than kept, and neither bucket IDs nor bodies are logged.
+//
+// The secondary receives the query's body, content type and tenant header,
+// not the client's credentials, but is called with the API key in
+// MIRROR_API_KEY, and marks mirrored requests with X-MIGP-Mirror: 1, which
+// a secondary mirroring itself does not mirror on.
+// Mirroring forwards client queries to another deployment, so it is disabled
+// in strict privacy mode, and reported in the privacy report.
+type mirror struct {
+	url    string
+	apiKey string
+	rate   float64
+	client *http.Client
+	slots  chan struct{}
+}
+
+// newMirror returns the mirror configured by MIRROR_URL, the base URL of the
+// secondary deployment, or nil if it is not set. MIRROR_SAMPLE_RATE (default
+// 0.01) is the fraction of queries mirrored, each with a timeout of
+// MIRROR_TIMEOUT (default 5s), and at most MIRROR_MAX_CONCURRENCY (default
+// 16) are mirrored at once; queries sampled beyond that are not mirrored.
+func newMirror() *mirror {
+	base := strings.TrimSuffix(os.Getenv("MIRROR_URL"), "/")
+	if base == "" {
+		return nil
+	}
+	m := &mirror{
+		url:    base,
+		apiKey: os.Getenv("MIRROR_API_KEY"),
+		rate:   0.01,
+		client: &http.Client{Timeout: envDuration("MIRROR_TIMEOUT", 5*time.Second)},
+		slots:  make(chan struct{}, envInt("MIRROR_MAX_CONCURRENCY", 16)),
+	}
+	if _, ok := os.LookupEnv("MIRROR_SAMPLE_RATE"); ok {
+		m.rate = envRate("MIRROR_SAMPLE_RATE")
+	}
+	return m
+}
+
+// mirroredResponse is the outcome of one side of a mirrored query.
+type mirroredResponse struct {
+	status  int
+	size    int64
+	sum     []byte
+	err     error
+	elapsed time.Duration
+}
+
+// mirrorRecorder passes a response through while hashing it.
+type mirrorRecorder struct {
+	statusRecorder
+	size int64
+	hash hash.Hash
+}
+
+func (r *mirrorRecorder) Write(p []byte) (int, error) {
+	n, err := r.statusRecorder.Write(p)
+	r.size += int64(n)
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+// withMirror mirrors a sample of the queries served by h, see above.
+func (s *server) withMirror(h http.HandlerFunc) http.HandlerFunc {
+	m := s.mirror
+	if m == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		// Queries mirrored to this server are not mirrored on, nor are
+		// queries of the next corpus.
+		if rand.Float64() >= m.rate || req.Method != http.MethodPost || req.Header.Get("X-MIGP-Mirror") != "" || queriesNextCorpus(req.Context()) {
+			h(w, req)
+			return
+		}
+		route := req.URL.Path
+		select {
+		case m.slots <- struct{}{}:
+		default:
+			mirrorRequests.Inc(route, "skipped")
+			h(w, req)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxMirrorBody+1))
+		req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		if err != nil || len(body) > maxMirrorBody {
+			<-m.slots
+			mirrorRequests.Inc(route, "skipped")
+			h(w, req)
+			return
+		}
+
+		uri, header := req.URL.RequestURI(), req.Header.Clone()
+		primary := make(chan mirroredResponse, 1)
+		go func() {
+			defer func() { <-m.slots }()
+			secondary := m.send(uri, header, body)
+			p := <-primary
+			mirrorLatency.Observe(p.elapsed.Seconds(), "primary")
+			if secondary.err != nil {
+				mirrorRequests.Inc(route, "error")
+				log.Printf("Mirrored query failed: route=%s error=%v", route, secondary.err)
+				return
+			}
+			mirrorLatency.Observe(secondary.elapsed.Seconds(), "secondary")
+			mirrorLatencyDelta.Observe((secondary.elapsed - p.elapsed).Seconds())
+			if reason := mirrorDiff(p, secondary); reason != "" {
+				mirrorRequests.Inc(route, "diverged")
+				log.Printf("Mirrored query diverged: route=%s reason=%s primary=%s secondary=%s", route, reason, p.elapsed, secondary.elapsed)
+				return
+			}
+			mirrorRequests.Inc(route, "match")
+		}()
+
+		rec := &mirrorRecorder{statusRecorder: statusRecorder{ResponseWriter: w}, hash: sha256.New()}
+		start := time.Now()
+		defer func() {
+			// Sent even if h panics, recorded as the status it got to.
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			primary <- mirroredResponse{status: rec.status, size: rec.size, sum: rec.hash.Sum(nil), elapsed: time.Since(start)}
+		}()
+		h(rec, req)
+	}
+}
+
+// send sends the query to uri on the secondary with the given body and
+// some of the original headers, and hashes its response.
+func (m *mirror) send(uri string, header http.Header, body []byte) mirroredResponse {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, m.url+uri, bytes.NewReader(body))
+	if err != nil {
+		return mirroredResponse{err: err}
+	}
+	for _, name := range []string{"Content-Type", "Accept", tenantHeader()} {
+		if v := header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	if m.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+	req.Header.Set("X-MIGP-Mirror", "1")
+	start := time.Now()
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return mirroredResponse{err: err}
+	}
+	defer resp.Body.Close()
+	sum := sha256.New()
+	size, err := io.Copy(sum, resp.Body)
+	if err != nil {
+		return mirroredResponse{err: err}
+	}
+	return mirroredResponse{status: resp.StatusCode, size: size, sum: sum.Sum(nil), elapsed: time.Since(start)}
+}
+
+// mirrorDiff returns why secondary's response differs from primary's, or an
+// empty string if it does not.
+func mirrorDiff(primary, secondary mirroredResponse) string {
+	switch {
+	case primary.status != secondary.status:
+		return fmt.Sprintf("status mismatch: primary=%d secondary=%d", primary.status, secondary.status)
+	case !bytes.Equal(primary.sum, secondary.sum):
+		return fmt.Sprintf("body mismatch: primary=%d bytes secondary=%d bytes", primary.size, secondary.size)
+	}
+	return ""
+}
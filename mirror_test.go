@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestMirror(t *testing.T) {
+	type mirrored struct {
+		body   []byte
+		header http.Header
+	}
+	received := make(chan mirrored, 1)
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		received <- mirrored{body, req.Header}
+		http.Error(w, "new version under test", http.StatusInternalServerError)
+	}))
+	defer secondary.Close()
+
+	t.Setenv("MIRROR_URL", secondary.URL)
+	t.Setenv("MIRROR_SAMPLE_RATE", "1")
+	t.Setenv("MIRROR_API_KEY", "mirror-key")
+	s, srv := newTestServer(t)
+	client, err := migp.NewClient(s.suites[0].cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _, err := client.Request([]byte("user@example.com"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/query", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer client-credential")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("primary answered %d", resp.StatusCode)
+	}
+
+	select {
+	case m := <-received:
+		if !bytes.Equal(m.body, body) {
+			t.Error("mirrored body differs from the query")
+		}
+		if m.header.Get("Authorization") != "Bearer mirror-key" || m.header.Get("X-MIGP-Mirror") != "1" {
+			t.Errorf("mirrored headers %v", m.header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query not mirrored")
+	}
+	diverged := func(v []string) bool { return v[0] == "/api/query" && v[1] == "diverged" }
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if n, _, _, _ := mirrorRequests.total(diverged); n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("divergence not counted")
+		}
+	}
+	if !s.privacyReport().Mirroring {
+		t.Error("privacy report does not disclose mirroring")
+	}
+}
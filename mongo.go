@@ -0,0 +1,456 @@
+//go:build full || !(minimal || azure || aws)
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func init() {
+	bucketBackends["mongodb"] = func(manageSchema bool) (bucketBackend, error) {
+		b, err := openMongoBackend(os.Getenv("MONGO_CONNECTION_ST"), newConnectionOptions(), manageSchema)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	transientErrors = append(transientErrors, mongo.IsNetworkError)
+}
+
+// mongoBackend keeps the corpus buckets in MongoDB, selected with
+// STORAGE_BACKEND=mongodb and connected with the connection string in
+// MONGO_CONNECTION_ST to the MONGO_DATABASE database (default migp). Writes
+// and reads are retried by the driver, on top of the storage retries.
+//
+// Each bucket is a document of the buckets collection with the bucket ID as
+// _id, holding its entries inline. A bucket growing past MONGO_INLINE_LIMIT
+// (default 8 MiB) bytes, well below the 16 MiB document limit, moves to
+// GridFS: its entries move to the bucket_entries collection, and its
+// contents are stored as a GridFS file rewritten on every change.
+type mongoBackend struct {
+	client      *mongo.Client
+	db          *mongo.Database
+	buckets     *mongo.Collection
+	entries     *mongo.Collection
+	inlineLimit int
+}
+
+// mongoEntry is an entry of a bucket held inline.
+type mongoEntry struct {
+	Hash       []byte `bson:"h"`
+	Value      []byte `bson:"v"`
+	BucketHash *int64 `bson:"b,omitempty"`
+}
+
+// mongoBucket is a document of the buckets collection. Version is bumped on
+// every change. GridFS buckets have no inline entries, and File and
+// FileEntries identify the GridFS file of their contents and the number of
+// entries it holds.
+type mongoBucket struct {
+	ID          string             `bson:"_id"`
+	Entries     []mongoEntry       `bson:"entries,omitempty"`
+	Size        int                `bson:"size"`
+	Version     int64              `bson:"version"`
+	GridFS      bool               `bson:"gridfs,omitempty"`
+	File        primitive.ObjectID `bson:"file,omitempty"`
+	FileEntries int                `bson:"fileEntries,omitempty"`
+}
+
+// mongoStoredEntry is a document of the bucket_entries collection, holding an
+// entry of a GridFS bucket.
+type mongoStoredEntry struct {
+	Bucket     string `bson:"bucket"`
+	Hash       []byte `bson:"h"`
+	Value      []byte `bson:"v"`
+	BucketHash *int64 `bson:"b,omitempty"`
+}
+
+// openMongoBackend connects to uri with the pool limit of opts, creating the
+// indexes if manageSchema is set.
+func openMongoBackend(uri string, opts connectionOptions, manageSchema bool) (*mongoBackend, error) {
+	if uri == "" {
+		return nil, errors.New("MONGO_CONNECTION_ST is not set")
+	}
+	clientOpts := options.Client().ApplyURI(uri).SetRetryWrites(true).SetRetryReads(true)
+	if opts.maxOpenConns > 0 {
+		clientOpts.SetMaxPoolSize(uint64(opts.maxOpenConns))
+	}
+	if opts.connMaxIdleTime > 0 {
+		clientOpts.SetMaxConnIdleTime(opts.connMaxIdleTime)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, clientOpts)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	name := os.Getenv("MONGO_DATABASE")
+	if name == "" {
+		name = "migp"
+	}
+	db := client.Database(name)
+	b := &mongoBackend{
+		client:      client,
+		db:          db,
+		buckets:     db.Collection("buckets"),
+		entries:     db.Collection("bucket_entries"),
+		inlineLimit: envInt("MONGO_INLINE_LIMIT", 8<<20),
+	}
+	if manageSchema {
+		index := mongo.IndexModel{
+			Keys:    bson.D{{Key: "bucket", Value: 1}, {Key: "h", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		}
+		if _, err := b.entries.Indexes().CreateOne(ctx, index); err != nil {
+			client.Disconnect(ctx)
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// files returns the GridFS bucket of the bucket contents, with its deadlines
+// set from ctx as the GridFS API does not take one.
+func (b *mongoBackend) files(ctx context.Context) (*gridfs.Bucket, error) {
+	fs, err := gridfs.NewBucket(b.db, options.GridFSBucket().SetName("buckets"))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		fs.SetReadDeadline(deadline)
+		fs.SetWriteDeadline(deadline)
+	}
+	return fs, nil
+}
+
+// Get returns the bucket stored under id.
+func (b *mongoBackend) Get(ctx context.Context, id string) ([]byte, error) {
+	var doc mongoBucket
+	err := b.buckets.FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return []byte{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !doc.GridFS {
+		value := make([]byte, 0, doc.Size)
+		for _, e := range doc.Entries {
+			value = append(value, e.Value...)
+		}
+		return value, nil
+	}
+	if doc.File.IsZero() {
+		// The bucket is moving to GridFS and has no file yet.
+		value, _, err := b.storedContents(ctx, id, doc.Entries)
+		return value, err
+	}
+	fs, err := b.files(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(doc.Size)
+	if _, err := fs.DownloadToStream(doc.File, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// AppendUnique appends value to the bucket stored under id unless it was
+// appended before. Inline appends are a single conditional upsert, which
+// fails with a duplicate key error if the bucket holds the entry already, is
+// full or is in GridFS.
+func (b *mongoBackend) AppendUnique(ctx context.Context, id string, bucketHash sql.NullInt64, value []byte) (bool, error) {
+	sum := sha256.Sum256(value)
+	e := mongoEntry{Hash: sum[:], Value: value}
+	if bucketHash.Valid {
+		e.BucketHash = &bucketHash.Int64
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		filter := bson.M{
+			"_id":       id,
+			"gridfs":    bson.M{"$ne": true},
+			"entries.h": bson.M{"$ne": e.Hash},
+			"size":      bson.M{"$lte": b.inlineLimit - len(value)},
+		}
+		update := bson.M{"$push": bson.M{"entries": e}, "$inc": bson.M{"size": len(value), "version": 1}}
+		_, err := b.buckets.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		if err == nil {
+			return true, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return false, err
+		}
+
+		var doc mongoBucket
+		projection := options.FindOne().SetProjection(bson.M{"entries.v": 0})
+		if err := b.buckets.FindOne(ctx, bson.M{"_id": id}, projection).Decode(&doc); err != nil {
+			return false, err
+		}
+		for _, other := range doc.Entries {
+			if bytes.Equal(other.Hash, e.Hash) {
+				return false, nil
+			}
+		}
+		if doc.GridFS {
+			return b.appendGridFS(ctx, id, e)
+		}
+		if doc.Size+len(value) > b.inlineLimit {
+			if err := b.moveToGridFS(ctx, id); err != nil {
+				return false, err
+			}
+			return b.appendGridFS(ctx, id, e)
+		}
+		// A concurrent append created the bucket first.
+	}
+	return false, errors.New("mongodb append kept conflicting")
+}
+
+// appendGridFS appends e to the GridFS bucket stored under id. The file is
+// rewritten also if e was added before but the file is missing entries, as
+// after an interrupted earlier attempt.
+func (b *mongoBackend) appendGridFS(ctx context.Context, id string, e mongoEntry) (bool, error) {
+	_, err := b.entries.InsertOne(ctx, mongoStoredEntry{Bucket: id, Hash: e.Hash, Value: e.Value, BucketHash: e.BucketHash})
+	added := err == nil
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return false, err
+	}
+	if added {
+		if _, err := b.buckets.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{"version": 1}}); err != nil {
+			return false, err
+		}
+	} else {
+		var doc mongoBucket
+		if err := b.buckets.FindOne(ctx, bson.M{"_id": id}).Decode(&doc); err != nil {
+			return false, err
+		}
+		n, err := b.entries.CountDocuments(ctx, bson.M{"bucket": id})
+		if err != nil || int(n) == doc.FileEntries {
+			return false, err
+		}
+	}
+	return added, b.rewriteFile(ctx, id)
+}
+
+// moveToGridFS moves the inline entries of the bucket stored under id to the
+// bucket_entries collection and its contents to a GridFS file. Marking the
+// bucket first stops further inline appends.
+func (b *mongoBackend) moveToGridFS(ctx context.Context, id string) error {
+	update := bson.M{"$set": bson.M{"gridfs": true}, "$inc": bson.M{"version": 1}}
+	if _, err := b.buckets.UpdateOne(ctx, bson.M{"_id": id}, update); err != nil {
+		return err
+	}
+	var doc mongoBucket
+	if err := b.buckets.FindOne(ctx, bson.M{"_id": id}).Decode(&doc); err != nil {
+		return err
+	}
+	if len(doc.Entries) > 0 {
+		docs := make([]interface{}, len(doc.Entries))
+		for i, e := range doc.Entries {
+			docs[i] = mongoStoredEntry{Bucket: id, Hash: e.Hash, Value: e.Value, BucketHash: e.BucketHash}
+		}
+		_, err := b.entries.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	if err := b.rewriteFile(ctx, id); err != nil {
+		return err
+	}
+	_, err := b.buckets.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"entries": ""}})
+	return err
+}
+
+// storedContents returns the contents of the GridFS bucket stored under id
+// from the bucket_entries collection, and the number of entries. Inline
+// entries of a bucket being moved are included.
+func (b *mongoBackend) storedContents(ctx context.Context, id string, inline []mongoEntry) ([]byte, int, error) {
+	cursor, err := b.entries.Find(ctx, bson.M{"bucket": id})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+	seen := map[string]bool{}
+	value := []byte{}
+	for cursor.Next(ctx) {
+		var e mongoStoredEntry
+		if err := cursor.Decode(&e); err != nil {
+			return nil, 0, err
+		}
+		seen[string(e.Hash)] = true
+		value = append(value, e.Value...)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, 0, err
+	}
+	for _, e := range inline {
+		if !seen[string(e.Hash)] {
+			seen[string(e.Hash)] = true
+			value = append(value, e.Value...)
+		}
+	}
+	return value, len(seen), nil
+}
+
+// rewriteFile uploads the current contents of the GridFS bucket stored under
+// id and replaces its file. The replacement is conditional on the bucket
+// version, and a rewrite losing to a concurrent change is dropped: the
+// rewrite of that change includes every entry stored before it.
+func (b *mongoBackend) rewriteFile(ctx context.Context, id string) error {
+	var doc mongoBucket
+	if err := b.buckets.FindOne(ctx, bson.M{"_id": id}).Decode(&doc); err != nil {
+		return err
+	}
+	contents, n, err := b.storedContents(ctx, id, doc.Entries)
+	if err != nil {
+		return err
+	}
+	fs, err := b.files(ctx)
+	if err != nil {
+		return err
+	}
+	file, err := fs.UploadFromStream(id, bytes.NewReader(contents))
+	if err != nil {
+		return err
+	}
+	filter := bson.M{"_id": id, "version": doc.Version}
+	update := bson.M{"$set": bson.M{"file": file, "fileEntries": n, "size": len(contents)}}
+	res, err := b.buckets.UpdateOne(ctx, filter, update)
+	if err == nil && res.MatchedCount == 0 {
+		return fs.DeleteContext(ctx, file)
+	}
+	if err != nil {
+		fs.DeleteContext(ctx, file)
+		return err
+	}
+	if !doc.File.IsZero() {
+		return fs.DeleteContext(ctx, doc.File)
+	}
+	return nil
+}
+
+// RemoveEntries removes values from the bucket stored under id.
+func (b *mongoBackend) RemoveEntries(ctx context.Context, id string, values [][]byte) (int, error) {
+	hashes := make([][]byte, len(values))
+	for i, value := range values {
+		sum := sha256.Sum256(value)
+		hashes[i] = sum[:]
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		var doc mongoBucket
+		err := b.buckets.FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if doc.GridFS {
+			res, err := b.entries.DeleteMany(ctx, bson.M{"bucket": id, "h": bson.M{"$in": hashes}})
+			if err != nil || res.DeletedCount == 0 {
+				return 0, err
+			}
+			if _, err := b.buckets.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{"version": 1}}); err != nil {
+				return 0, err
+			}
+			return int(res.DeletedCount), b.rewriteFile(ctx, id)
+		}
+
+		remove := map[string]bool{}
+		for _, h := range hashes {
+			remove[string(h)] = true
+		}
+		kept := []mongoEntry{}
+		size := 0
+		for _, e := range doc.Entries {
+			if !remove[string(e.Hash)] {
+				kept = append(kept, e)
+				size += len(e.Value)
+			}
+		}
+		removed := len(doc.Entries) - len(kept)
+		if removed == 0 {
+			return 0, nil
+		}
+		filter := bson.M{"_id": id, "version": doc.Version}
+		update := bson.M{"$set": bson.M{"entries": kept, "size": size}, "$inc": bson.M{"version": 1}}
+		res, err := b.buckets.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return 0, err
+		}
+		if res.MatchedCount > 0 {
+			return removed, nil
+		}
+	}
+	return 0, errors.New("mongodb removal kept conflicting")
+}
+
+// Entries calls f for every inline and GridFS bucket entry.
+func (b *mongoBackend) Entries(f func(id string, bucketHash sql.NullInt64, value []byte) error) error {
+	ctx := context.Background()
+	cursor, err := b.buckets.Find(ctx, bson.M{"gridfs": bson.M{"$ne": true}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc mongoBucket
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		for _, e := range doc.Entries {
+			if err := f(doc.ID, nullInt64(e.BucketHash), e.Value); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	stored, err := b.entries.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer stored.Close(ctx)
+	for stored.Next(ctx) {
+		var e mongoStoredEntry
+		if err := stored.Decode(&e); err != nil {
+			return err
+		}
+		if err := f(e.Bucket, nullInt64(e.BucketHash), e.Value); err != nil {
+			return err
+		}
+	}
+	return stored.Err()
+}
+
+// nullInt64 returns the username hash p in the form taken by AppendUnique.
+func nullInt64(p *int64) sql.NullInt64 {
+	if p == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *p, Valid: true}
+}
+
+// Close disconnects the client.
+func (b *mongoBackend) Close() error {
+	return b.client.Disconnect(context.Background())
+}
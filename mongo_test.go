@@ -0,0 +1,73 @@
+//go:build full || !(minimal || azure || aws)
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMongoEntryEncoding(t *testing.T) {
+	hash := int64(-7)
+	for _, e := range []mongoEntry{{Hash: []byte{1}, Value: []byte("v")}, {Hash: []byte{2}, Value: []byte("w"), BucketHash: &hash}} {
+		raw, err := bson.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got mongoEntry
+		if err := bson.Unmarshal(raw, &got); err != nil {
+			t.Fatal(err)
+		}
+		if n, want := nullInt64(got.BucketHash), nullInt64(e.BucketHash); n != want {
+			t.Errorf("bucket hash %+v decoded as %+v", want, n)
+		}
+	}
+	if n := nullInt64(nil); n != (sql.NullInt64{}) {
+		t.Errorf("nullInt64(nil) = %+v", n)
+	}
+}
+
+func TestOpenMongoBackend(t *testing.T) {
+	if _, err := openMongoBackend("", newConnectionOptions(), false); err == nil {
+		t.Error("backend opened without MONGO_CONNECTION_ST")
+	}
+}
+
+// TestMongoBackendGridFS runs the conformance checks with a small inline
+// limit, so that buckets move to GridFS as they grow.
+func TestMongoBackendGridFS(t *testing.T) {
+	if os.Getenv(testBackendEnv) != "mongodb" {
+		t.Skipf("%s is not mongodb", testBackendEnv)
+	}
+	b, err := openMongoBackend(os.Getenv("MONGO_CONNECTION_ST"), newConnectionOptions(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.inlineLimit = 256
+	runBackendChecks(t, b, "conformance/"+testName(t)+"/", BackendChecks(64<<10))
+
+	ctx := context.Background()
+	id := "conformance/" + testName(t) + "/spill"
+	var values [][]byte
+	for i := 0; len(values)*conformanceEntrySize <= 2*b.inlineLimit; i++ {
+		values = append(values, conformanceValue(i))
+		if _, err := b.AppendUnique(ctx, id, sql.NullInt64{}, values[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var doc mongoBucket
+	if err := b.buckets.FindOne(ctx, bson.M{"_id": id}).Decode(&doc); err != nil || !doc.GridFS || doc.FileEntries != len(values) {
+		t.Errorf("bucket past the inline limit %+v, %v, want it in GridFS with %d entries", doc, err, len(values))
+	}
+	if err := expectBucket(ctx, b, id, conformanceEntrySize, values...); err != nil {
+		t.Error(err)
+	}
+	if err := cleanup(ctx, b, id, values...); err != nil {
+		t.Error(err)
+	}
+}
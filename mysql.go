@@ -0,0 +1,250 @@
+//go:build full || !(minimal || azure || aws)
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func init() {
+	bucketBackends["mysql"] = func(manageSchema bool) (bucketBackend, error) {
+		b, err := openMySQLBackend(os.Getenv("MYSQL_CONNECTION_ST"), newConnectionOptions(), manageSchema)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	transientErrors = append(transientErrors, isTransientMySQL)
+}
+
+// isTransientMySQL reports whether err is a MySQL error likely to succeed on
+// retry, see isTransient.
+func isTransientMySQL(err error) bool {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case 1040, // ER_CON_COUNT_ERROR
+			1205, // ER_LOCK_WAIT_TIMEOUT
+			1213: // ER_LOCK_DEADLOCK
+			return true
+		}
+	}
+	return false
+}
+
+// mysqlBackend keeps the corpus buckets in MySQL or MariaDB, selected with
+// STORAGE_BACKEND=mysql and connected with the go-sql-driver DSN in
+// MYSQL_CONNECTION_ST, such as user:pw@tcp(host:3306)/migp. The pool limits
+// of the DB_* variables apply. Buckets are replaced whole on every append, so
+// max_allowed_packet must exceed the largest bucket.
+//
+// The tables mirror kv_store and kv_store_shadow: buckets are hash
+// partitioned by ID into MYSQL_PARTITIONS (default 4) partitions, and the
+// shadow table deduplicates entries by their SHA-256, as BLOB columns cannot
+// be part of a key.
+type mysqlBackend struct {
+	db *sql.DB
+}
+
+// mysqlSchema returns the statements creating the tables of the MySQL
+// backend. MySQL runs one statement per call and all are idempotent.
+func mysqlSchema(partitions int) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS kv_store (
+			id VARCHAR(255) NOT NULL,
+			value LONGBLOB NOT NULL,
+			version BIGINT NOT NULL DEFAULT 1,
+			PRIMARY KEY (id)
+		) PARTITION BY KEY (id) PARTITIONS %d`, partitions),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS kv_store_shadow (
+			id VARCHAR(255) NOT NULL,
+			value_hash BINARY(32) NOT NULL,
+			value BLOB NOT NULL,
+			bucket_hash BIGINT NULL,
+			PRIMARY KEY (id, value_hash)
+		) PARTITION BY KEY (id) PARTITIONS %d`, partitions),
+	}
+}
+
+// openMySQLBackend connects to dsn with the pool limits of opts, creating
+// the tables if manageSchema is set.
+func openMySQLBackend(dsn string, opts connectionOptions, manageSchema bool) (*mysqlBackend, error) {
+	if dsn == "" {
+		return nil, errors.New("MYSQL_CONNECTION_ST is not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	opts.configure(db)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to MySQL: %w", err)
+	}
+	if manageSchema {
+		partitions := envInt("MYSQL_PARTITIONS", 4)
+		for _, stmt := range mysqlSchema(partitions) {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				db.Close()
+				return nil, fmt.Errorf("applying MySQL schema: %w", err)
+			}
+		}
+	}
+	return &mysqlBackend{db: db}, nil
+}
+
+// Get returns the bucket stored under id.
+func (b *mysqlBackend) Get(ctx context.Context, id string) ([]byte, error) {
+	var value []byte
+	err := b.db.QueryRowContext(ctx, `SELECT value FROM kv_store WHERE id = ?`, id).Scan(&value)
+	if err == sql.ErrNoRows {
+		return []byte{}, nil
+	}
+	return value, err
+}
+
+// AppendUnique appends value to the bucket stored under id unless it was
+// appended before.
+func (b *mysqlBackend) AppendUnique(ctx context.Context, id string, bucketHash sql.NullInt64, value []byte) (bool, error) {
+	e := journalEntry{Key: id, Value: value}
+	if bucketHash.Valid {
+		e.BucketHash = &bucketHash.Int64
+	}
+	n, err := b.AppendBatch(ctx, []journalEntry{e})
+	return n > 0, err
+}
+
+// AppendBatch appends entries in one transaction, with a single upsert for
+// each bucket they belong to.
+func (b *mysqlBackend) AppendBatch(ctx context.Context, entries []journalEntry) (int, error) {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var keys []string
+	added := map[string][]byte{}
+	n := 0
+	for _, e := range entries {
+		sum := sha256.Sum256(e.Value)
+		query := `INSERT INTO kv_store_shadow (id, value_hash, value, bucket_hash) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = id`
+		res, err := tx.ExecContext(ctx, query, e.Key, sum[:], e.Value, e.bucketHash())
+		if err != nil {
+			return 0, err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if rows == 0 {
+			continue
+		}
+		if _, ok := added[e.Key]; !ok {
+			keys = append(keys, e.Key)
+		}
+		added[e.Key] = append(added[e.Key], e.Value...)
+		n++
+	}
+	for _, key := range keys {
+		query := `
+		INSERT INTO kv_store (id, value) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE value = CONCAT(value, VALUES(value)), version = version + 1`
+		if _, err := tx.ExecContext(ctx, query, key, added[key]); err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit()
+}
+
+// RemoveEntries removes values from the bucket stored under id and rebuilds
+// it from the remaining entries.
+func (b *mysqlBackend) RemoveEntries(ctx context.Context, id string, values [][]byte) (int, error) {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM kv_store WHERE id = ? FOR UPDATE`, id); err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, value := range values {
+		sum := sha256.Sum256(value)
+		res, err := tx.ExecContext(ctx, `DELETE FROM kv_store_shadow WHERE id = ? AND value_hash = ?`, id, sum[:])
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		removed += int(n)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT value FROM kv_store_shadow WHERE id = ?`, id)
+	if err != nil {
+		return 0, err
+	}
+	var rebuilt []byte
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		rebuilt = append(rebuilt, value...)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if rebuilt == nil {
+		rebuilt = []byte{}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE kv_store SET value = ?, version = version + 1 WHERE id = ?`, rebuilt, id); err != nil {
+		return 0, err
+	}
+	return removed, tx.Commit()
+}
+
+// Entries calls f for every entry in the shadow table.
+func (b *mysqlBackend) Entries(f func(id string, bucketHash sql.NullInt64, value []byte) error) error {
+	rows, err := b.db.Query(`SELECT id, bucket_hash, value FROM kv_store_shadow`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var bucketHash sql.NullInt64
+		var value []byte
+		if err := rows.Scan(&id, &bucketHash, &value); err != nil {
+			return err
+		}
+		if err := f(id, bucketHash, value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Close closes the connection pool.
+func (b *mysqlBackend) Close() error {
+	return b.db.Close()
+}
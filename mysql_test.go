@@ -0,0 +1,48 @@
+//go:build full || !(minimal || azure || aws)
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestIsTransientMySQL(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{&mysql.MySQLError{Number: 1213}, true},
+		{fmt.Errorf("append: %w", &mysql.MySQLError{Number: 1205}), true},
+		{&mysql.MySQLError{Number: 1040}, true},
+		{&mysql.MySQLError{Number: 1062}, false},
+	} {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestMySQLSchema(t *testing.T) {
+	stmts := mysqlSchema(8)
+	if len(stmts) != 2 {
+		t.Fatalf("%d schema statements, want 2", len(stmts))
+	}
+	for _, stmt := range stmts {
+		if !strings.HasPrefix(strings.TrimSpace(stmt), "CREATE TABLE IF NOT EXISTS") || !strings.HasSuffix(stmt, "PARTITIONS 8") {
+			t.Errorf("schema statement %q is not an idempotent partitioned table", stmt)
+		}
+	}
+}
+
+func TestOpenMySQLBackend(t *testing.T) {
+	if _, err := openMySQLBackend("", newConnectionOptions(), false); err == nil {
+		t.Error("backend opened without MYSQL_CONNECTION_ST")
+	}
+	if _, err := openMySQLBackend("migp@tcp(127.0.0.1:1)/migp?timeout=1s", newConnectionOptions(), false); err == nil {
+		t.Error("backend opened without a reachable server")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// The next corpus generation is staged beside the current one, with the
+// storage keys of the current corpus prefixed by "next/", and fed like it:
+// by encrypted ingestion with "generation": "next", or by import-corpus
+// -next. Queries to /api/query and /api/query/batch with ?generation=next
+// are answered from the next corpus for callers whose credential has the
+// preview role, so that client teams can validate against the upcoming
+// corpus before it is switched in. These answers carry X-MIGP-Corpus: next
+// and Cache-Control: no-store, and are not answers of the corpus in service:
+// they are not signed, mirrored, shadowed to the canary or chunked, and are
+// neither counted in usage analytics nor checked against honeytokens.
+//
+// POST /api/admin/corpus/promote?version=N switches the next corpus of the
+// suite in, for the tenant of the request if it has a key of its own,
+// atomically: in one transaction, the buckets of the current corpus are
+// dropped and those of the next one take their keys, leaving the next corpus
+// empty. Queries see either the whole previous corpus or the whole next one.
+// Promotion requires buckets stored in PostgreSQL. The journal, sources and
+// snapshots keep the keys entries were ingested under, so take a snapshot
+// after promoting, and stop feeding the next corpus while it is promoted.
+
+const (
+	// rolePreview is the role of callers querying the next corpus.
+	rolePreview = "preview"
+
+	generationCurrent = "current"
+	generationNext    = "next"
+
+	// corpusHeader marks answers from the next corpus.
+	corpusHeader = "X-MIGP-Corpus"
+)
+
+// nextCorpusKey is the context key marking queries of the next corpus.
+type nextCorpusKey struct{}
+
+// queriesNextCorpus reports whether the request of ctx queries the next
+// corpus.
+func queriesNextCorpus(ctx context.Context) bool {
+	next, _ := ctx.Value(nextCorpusKey{}).(bool)
+	return next
+}
+
+// next returns the suite serving the next corpus of cs.
+func (cs *cryptoSuite) next() *cryptoSuite {
+	next := *cs
+	next.namespace = generationNext
+	if cs.namespace != "" {
+		next.namespace += "/" + cs.namespace
+	}
+	return &next
+}
+
+// withNextCorpus serves queries with the generation query parameter set to
+// next with preview, and others with current, see above.
+func withNextCorpus(current, preview http.HandlerFunc) http.HandlerFunc {
+	next := requireRole(rolePreview, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Del("X-Corpus-Generation")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set(corpusHeader, generationNext)
+		preview(w, req.WithContext(context.WithValue(req.Context(), nextCorpusKey{}, true)))
+	})
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Query().Get("generation") {
+		case "", generationCurrent:
+			current(w, req)
+		case generationNext:
+			if req.Method != http.MethodPost {
+				writeError(w, "the next corpus is queried with POST", http.StatusMethodNotAllowed)
+				return
+			}
+			next(w, req)
+		default:
+			invalid(errInvalidRequest, "generation must be %q or %q", generationCurrent, generationNext).write(w)
+		}
+	}
+}
+
+// promotion is the result of a promotion of the next corpus.
+type promotion struct {
+	Version uint16 `json:"version"`
+	Dropped int64  `json:"dropped"`
+	Buckets int64  `json:"buckets"`
+}
+
+// corpusKeys returns a regular expression matching the keys of the buckets
+// and sub-buckets of the corpus of cs.
+func corpusKeys(cs *cryptoSuite) string {
+	return `^` + regexp.QuoteMeta(cs.bucketKey("")) + `[0-9a-f]{8}(/[0-9]+/[0-9a-f]{8})?$`
+}
+
+// promoteNextCorpus replaces the corpus of cs with its next corpus, see
+// above.
+func (s *server) promoteNextCorpus(ctx context.Context, cs *cryptoSuite) (promotion, error) {
+	result := promotion{Version: cs.cfg.Version}
+	current, next := cs.bucketKey(""), cs.next().bucketKey("")
+	currentKeys, nextKeys := corpusKeys(cs), corpusKeys(cs.next())
+
+	tx, err := s.kv.db().BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+	// Promoted buckets get versions above any the current ones had, so that
+	// no write based on a read of the previous corpus succeeds.
+	var base sql.NullInt64
+	if err := tx.QueryRowContext(ctx, `SELECT max(version) FROM kv_store WHERE id ~ $1`, currentKeys).Scan(&base); err != nil {
+		return result, err
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM kv_store WHERE id ~ $1`, currentKeys)
+	if err != nil {
+		return result, err
+	}
+	if result.Dropped, err = res.RowsAffected(); err != nil {
+		return result, err
+	}
+	for _, table := range []string{"kv_store_shadow", "bucket_splits", "bucket_overflow"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE id ~ $1`, currentKeys); err != nil {
+			return result, err
+		}
+	}
+
+	rename := `$2 || substr(id, length($1) + 1)`
+	query := `UPDATE kv_store SET id = ` + rename + `, version = version + $4 WHERE id ~ $3`
+	res, err = tx.ExecContext(ctx, query, next, current, nextKeys, base.Int64)
+	if err != nil {
+		return result, err
+	}
+	if result.Buckets, err = res.RowsAffected(); err != nil {
+		return result, err
+	}
+	for _, table := range []string{"kv_store_shadow", "bucket_splits", "bucket_overflow"} {
+		if _, err := tx.ExecContext(ctx, `UPDATE `+table+` SET id = `+rename+` WHERE id ~ $3`, next, current, nextKeys); err != nil {
+			return result, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+	s.corpusChanged()
+	return result, nil
+}
+
+// handlePromoteCorpus switches the next corpus of a suite in, see above.
+func (s *server) handlePromoteCorpus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	cs := suiteParamIn(w, req, s.tenantSuites(tenantOf(req)))
+	if cs == nil {
+		return
+	}
+	release := s.lockJobRequest(w, req, "promote")
+	if release == nil {
+		return
+	}
+	defer release()
+	result, err := s.promoteNextCorpus(req.Context(), cs)
+	if err != nil {
+		storageError(w, "Promoting next corpus", err)
+		return
+	}
+	log.Printf("Promoted the next corpus of version %d: %d buckets replaced %d", result.Version, result.Buckets, result.Dropped)
+	writeJSON(w, http.StatusOK, result)
+}
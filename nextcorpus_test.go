@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestNextCorpusQueries(t *testing.T) {
+	t.Setenv("API_KEYS", `{"query-key": ["query"], "preview-key": ["preview"]}`)
+	s, srv := newTestServer(t)
+	cs := s.suites[0]
+	username, password := []byte("user@example.com"), []byte("password1")
+	value, err := cs.server.EncryptBucketEntry(username, password, migp.MetadataBreachedPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := cs.bucketHash(username)
+	req := encryptedIngestRequest{Generation: generationNext, Entries: []encryptedEntry{{BucketHash: &hash, Value: value}}}
+	if result := s.ingestEncrypted(context.Background(), req); result.Successes != 1 {
+		t.Fatalf("ingestion into the next corpus %+v", result)
+	}
+
+	client, err := migp.NewClient(cs.cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(generation, key string) (*http.Response, migp.BreachStatus) {
+		t.Helper()
+		request, qctx, err := client.Request(username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/query?generation="+generation, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return resp, migp.NotInBreach
+		}
+		var response migp.ServerResponse
+		if err := response.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		status, _, err := qctx.Finalize(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, status
+	}
+
+	if resp, status := query(generationCurrent, ""); resp.StatusCode != http.StatusOK || status != migp.NotInBreach {
+		t.Errorf("current corpus answered %d with %v", resp.StatusCode, status)
+	}
+	for _, tt := range []struct {
+		key  string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"query-key", http.StatusForbidden},
+		{"preview-key", http.StatusOK},
+		{testAdminKey, http.StatusOK},
+	} {
+		resp, status := query(generationNext, tt.key)
+		if resp.StatusCode != tt.want {
+			t.Errorf("next corpus query with %q answered %d, want %d", tt.key, resp.StatusCode, tt.want)
+			continue
+		}
+		if tt.want != http.StatusOK {
+			continue
+		}
+		if status != migp.InBreach {
+			t.Errorf("next corpus query with %q: status %v, want %v", tt.key, status, migp.InBreach)
+		}
+		if resp.Header.Get(corpusHeader) != generationNext || resp.Header.Get("Cache-Control") != "no-store" {
+			t.Errorf("next corpus answer headers %v", resp.Header)
+		}
+	}
+	if resp, _ := query("upcoming", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown generation answered %d", resp.StatusCode)
+	}
+}
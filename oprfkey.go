@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/circl/group"
+	"github.com/cloudflare/circl/oprf"
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// In base mode the OPRF evaluates a blinded element B to B^(1/(k+m)), where
+// k is the private key and m a hash of the evaluation context, the same for
+// every query since MIGP always evaluates with migp.OprfInfo. The circl
+// server recomputes the hash and the scalar inversion on each evaluation,
+// a good share of its cost for a single element, so each suite computes
+// 1/(k+m) once, when it is built at startup or for a new key, and evaluates
+// with a single scalar multiplication. BenchmarkOPRFEvaluate compares the
+// two.
+
+// oprfEvaluator evaluates the OPRF of a suite whose key this server does not
+// hold, as with split keys, see splitkey.go, or keys in a key management
+// service, see hsm.go. Evaluations may run on pool.
+type oprfEvaluator interface {
+	evaluate(ctx context.Context, pool *cryptoPool, blinded [][]byte) ([][]byte, error)
+}
+
+// errEvaluatorUnavailable wraps failures of remote evaluators.
+var errEvaluatorUnavailable = errors.New("OPRF evaluator unavailable")
+
+// oprfKey is the precomputed evaluation key of a suite.
+type oprfKey struct {
+	group   group.Group
+	inverse group.Scalar
+}
+
+// oprfDST returns the domain separation tag name of suite in base mode, as
+// the circl implementation of VOPRF draft 08 derives it.
+func oprfDST(name string, suite oprf.SuiteID) []byte {
+	return append([]byte(name+"VOPRF08-"), oprf.BaseMode, byte(suite>>8), byte(suite))
+}
+
+// newOPRFKey precomputes the evaluation key of cfg.
+func newOPRFKey(cfg migp.ServerConfig) (*oprfKey, error) {
+	g, ok := oprfGroups[cfg.OPRFSuite]
+	if !ok {
+		return nil, fmt.Errorf("unsupported OPRF suite %d", cfg.OPRFSuite)
+	}
+	if cfg.PrivateKey == nil {
+		return nil, errors.New("no OPRF private key")
+	}
+	serialized, err := cfg.PrivateKey.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	k := g.NewScalar()
+	if err := k.UnmarshalBinary(serialized); err != nil {
+		return nil, err
+	}
+	info := binary.BigEndian.AppendUint16(oprfDST("Context-", cfg.OPRFSuite), uint16(len(migp.OprfInfo)))
+	m := g.HashToScalar(append(info, migp.OprfInfo...), oprfDST("HashToScalar-", cfg.OPRFSuite))
+	t := g.NewScalar().Add(k, m)
+	if t.IsEqual(g.NewScalar()) {
+		return nil, errors.New("OPRF key not invertible")
+	}
+	return &oprfKey{group: g, inverse: g.NewScalar().Inv(t)}, nil
+}
+
+// evaluate evaluates the blinded elements, as oprf.Server.Evaluate does.
+func (k *oprfKey) evaluate(blinded [][]byte) ([][]byte, error) {
+	out := make([][]byte, len(blinded))
+	for i, b := range blinded {
+		e := k.group.NewElement()
+		if err := e.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		var err error
+		if out[i], err = e.Mul(e, k.inverse).MarshalBinaryCompress(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
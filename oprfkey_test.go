@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestOPRFKey(t *testing.T) {
+	for _, suite := range []oprf.SuiteID{oprf.OPRFP256, oprf.OPRFP384, oprf.OPRFP521} {
+		privateKey, err := oprf.GenerateKey(suite, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := migp.ServerConfig{Config: migp.Config{OPRFSuite: suite}, PrivateKey: privateKey}
+		key, err := newOPRFKey(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := oprf.NewServer(suite, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := oprf.NewClient(suite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := client.Request([][]byte{[]byte("input")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := server.Evaluate(req.BlindedElements(), migp.OprfInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := key.evaluate(req.BlindedElements())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[0], want.Elements[0]) {
+			t.Errorf("suite %d: precomputed evaluation differs", suite)
+		}
+		if _, err := key.evaluate([][]byte{{1, 2, 3}}); err == nil {
+			t.Errorf("suite %d: invalid element evaluated", suite)
+		}
+	}
+}
+
+func BenchmarkOPRFEvaluate(b *testing.B) {
+	suite := oprf.OPRFP256
+	privateKey, err := oprf.GenerateKey(suite, rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	client, err := oprf.NewClient(suite)
+	if err != nil {
+		b.Fatal(err)
+	}
+	req, err := client.Request([][]byte{[]byte("input")})
+	if err != nil {
+		b.Fatal(err)
+	}
+	blinded := req.BlindedElements()
+
+	b.Run("circl", func(b *testing.B) {
+		server, err := oprf.NewServer(suite, privateKey)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := server.Evaluate(blinded, migp.OprfInfo); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("precomputed", func(b *testing.B) {
+		key, err := newOPRFKey(migp.ServerConfig{Config: migp.Config{OPRFSuite: suite}, PrivateKey: privateKey})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := key.evaluate(blinded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The server never learns whether a query matched: clients decrypt the
+// bucket and compare its entries themselves. With OUTCOME_ANALYTICS_ENABLED
+// set, clients may report the outcome of a check afterwards, carrying
+// nothing but the outcome:
+//
+//	POST /api/outcomes {"outcome": "compromised" | "similar" | "not_found"}
+//
+// Reports hold no bucket ID or credential, and bodies with any other field
+// are rejected, so that no report can say which bucket matched. Outcomes are
+// counted in memory by UTC day and tenant, and every
+// OUTCOME_ANALYTICS_FLUSH (default 1h) the counts are stored with Laplace
+// noise for the privacy budget OUTCOME_DP_EPSILON (default 1) added; exact
+// counts are never stored. A report changes one count of one flush by 1, so
+// each report is protected by the full budget. Clients should send their
+// reports after a random delay, or batch them, so that a report cannot be
+// tied to the query preceding it by its timing. /api/admin/analytics/outcomes
+// serves the daily totals and match rates. /api/config advertises whether
+// reports are accepted in its privacy report.
+
+// Query outcomes reported by clients.
+const (
+	outcomeCompromised = "compromised"
+	outcomeSimilar     = "similar"
+	outcomeNotFound    = "not_found"
+)
+
+// outcomeCounts counts the outcomes of one day of one tenant.
+type outcomeCounts struct {
+	Compromised int64 `json:"compromised"`
+	Similar     int64 `json:"similar"`
+	NotFound    int64 `json:"notFound"`
+}
+
+// outcomeDay identifies the counts of one day of one tenant.
+type outcomeDay struct {
+	day    string
+	tenant string
+}
+
+// outcomeAnalytics counts the reported outcomes since the last flush.
+type outcomeAnalytics struct {
+	flush   time.Duration
+	epsilon float64
+
+	mu     sync.Mutex
+	counts map[outcomeDay]*outcomeCounts
+}
+
+// newOutcomeAnalytics returns the recorder configured as described above,
+// or nil if outcome reports are disabled.
+func newOutcomeAnalytics() *outcomeAnalytics {
+	if !envBool("OUTCOME_ANALYTICS_ENABLED", false) {
+		return nil
+	}
+	a := &outcomeAnalytics{
+		flush:   envDuration("OUTCOME_ANALYTICS_FLUSH", time.Hour),
+		epsilon: 1,
+		counts:  map[outcomeDay]*outcomeCounts{},
+	}
+	if val := os.Getenv("OUTCOME_DP_EPSILON"); val != "" {
+		eps, err := strconv.ParseFloat(val, 64)
+		if err != nil || eps <= 0 || math.IsInf(eps, 0) {
+			log.Printf("Invalid OUTCOME_DP_EPSILON value %q. Using 1.", val)
+		} else {
+			a.epsilon = eps
+		}
+	}
+	return a
+}
+
+// record counts an outcome of tenant at now.
+func (a *outcomeAnalytics) record(tenant, outcome string, now time.Time) {
+	key := outcomeDay{day: now.UTC().Format(time.DateOnly), tenant: tenant}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c := a.counts[key]
+	if c == nil {
+		c = &outcomeCounts{}
+		a.counts[key] = c
+	}
+	switch outcome {
+	case outcomeCompromised:
+		c.Compromised++
+	case outcomeSimilar:
+		c.Similar++
+	case outcomeNotFound:
+		c.NotFound++
+	}
+}
+
+// rotate returns the counts since the last call with noise added, and
+// starts counting afresh. The noisy counts are not rounded or clamped, so
+// that the sums of many flushes stay unbiased.
+func (a *outcomeAnalytics) rotate() map[outcomeDay][3]float64 {
+	a.mu.Lock()
+	counts := a.counts
+	a.counts = map[outcomeDay]*outcomeCounts{}
+	a.mu.Unlock()
+
+	scale := 1 / a.epsilon
+	out := make(map[outcomeDay][3]float64, len(counts))
+	for key, c := range counts {
+		out[key] = [3]float64{
+			float64(c.Compromised) + laplaceNoise(scale),
+			float64(c.Similar) + laplaceNoise(scale),
+			float64(c.NotFound) + laplaceNoise(scale),
+		}
+	}
+	return out
+}
+
+// recordOutcomes stores the noisy counts every OUTCOME_ANALYTICS_FLUSH.
+func (s *server) recordOutcomes() {
+	ticker := time.NewTicker(s.outcomes.flush)
+	defer ticker.Stop()
+	for range ticker.C {
+		for key, n := range s.outcomes.rotate() {
+			query := `INSERT INTO outcome_analytics (day, tenant, compromised, similar, not_found, epsilon) VALUES ($1, $2, $3, $4, $5, $6)`
+			if _, err := s.kv.db().Exec(query, key.day, key.tenant, n[0], n[1], n[2], s.outcomes.epsilon); err != nil {
+				log.Println("Storing outcome analytics failed:", err)
+			}
+		}
+	}
+}
+
+// handleOutcome counts an outcome report, see above.
+func (s *server) handleOutcome(w http.ResponseWriter, req *http.Request) {
+	if s.outcomes == nil {
+		writeErrorCode(w, errFeatureDisabled, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var report struct {
+		Outcome string `json:"outcome"`
+	}
+	decoder := json.NewDecoder(io.LimitReader(req.Body, 1<<10))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&report); err != nil {
+		invalid(errMalformedJSON, "request body must be {\"outcome\": ...} only").write(w)
+		return
+	}
+	switch report.Outcome {
+	case outcomeCompromised, outcomeSimilar, outcomeNotFound:
+	default:
+		invalid(errInvalidRequest, "outcome must be %s, %s or %s", outcomeCompromised, outcomeSimilar, outcomeNotFound).write(w)
+		return
+	}
+	// Tenant names of unknown tenants are not recorded, so that callers
+	// cannot grow the counts without bound.
+	tenant := tenantOf(req)
+	if s.tenants[tenant] == nil {
+		tenant = ""
+	}
+	s.outcomes.record(tenant, report.Outcome, time.Now())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// outcomeTotals are the outcomes of one day of one tenant summed across
+// flushes and instances, with the share of checks in each outcome.
+type outcomeTotals struct {
+	Day    string `json:"day"`
+	Tenant string `json:"tenant,omitempty"`
+	outcomeCounts
+	CompromisedRate float64 `json:"compromisedRate"`
+	SimilarRate     float64 `json:"similarRate"`
+	Epsilon         float64 `json:"epsilon"`
+}
+
+// handleOutcomeAnalytics serves the daily outcome totals since the since
+// query parameter (a date, default 30 days ago), by day and tenant.
+func (s *server) handleOutcomeAnalytics(w http.ResponseWriter, req *http.Request) {
+	since := time.Now().UTC().AddDate(0, 0, -30)
+	if v := req.URL.Query().Get("since"); v != "" {
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			writeError(w, "since must be a date such as 2006-01-02", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	query := `
+	SELECT to_char(day, 'YYYY-MM-DD'), tenant, sum(compromised), sum(similar), sum(not_found), max(epsilon)
+	FROM outcome_analytics WHERE day >= $1 GROUP BY day, tenant ORDER BY day, tenant`
+	rows, err := s.kv.db().QueryContext(req.Context(), query, since.Format(time.DateOnly))
+	if err != nil {
+		storageError(w, "Loading outcome analytics", err)
+		return
+	}
+	defer rows.Close()
+	totals := []outcomeTotals{}
+	for rows.Next() {
+		var t outcomeTotals
+		var compromised, similar, notFound float64
+		if err := rows.Scan(&t.Day, &t.Tenant, &compromised, &similar, &notFound, &t.Epsilon); err != nil {
+			storageError(w, "Loading outcome analytics", err)
+			return
+		}
+		t.outcomeCounts = outcomeCounts{
+			Compromised: countOf(compromised),
+			Similar:     countOf(similar),
+			NotFound:    countOf(notFound),
+		}
+		if all := t.Compromised + t.Similar + t.NotFound; all > 0 {
+			t.CompromisedRate = float64(t.Compromised) / float64(all)
+			t.SimilarRate = float64(t.Similar) / float64(all)
+		}
+		totals = append(totals, t)
+	}
+	if err := rows.Err(); err != nil {
+		storageError(w, "Loading outcome analytics", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, totals)
+}
+
+// countOf rounds a sum of noisy counts, clamped at zero.
+func countOf(sum float64) int64 {
+	return max(0, int64(math.Round(sum)))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutcomeReports(t *testing.T) {
+	t.Setenv("OUTCOME_ANALYTICS_ENABLED", "true")
+	s, srv := newTestServer(t)
+	report := func(body string) int {
+		t.Helper()
+		resp, err := http.Post(srv.URL+"/api/outcomes", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, body := range []string{`{"outcome": "compromised"}`, `{"outcome": "not_found"}`, `{"outcome": "not_found"}`} {
+		if code := report(body); code != http.StatusNoContent {
+			t.Errorf("report %s: got %d, want 204", body, code)
+		}
+	}
+	for _, body := range []string{`{"outcome": "matched"}`, `{"outcome": "compromised", "bucketId": "00a1b2c3"}`} {
+		if code := report(body); code != http.StatusBadRequest {
+			t.Errorf("report %s: got %d, want 400", body, code)
+		}
+	}
+
+	key := outcomeDay{day: time.Now().UTC().Format(time.DateOnly)}
+	if got := *s.outcomes.counts[key]; got != (outcomeCounts{Compromised: 1, NotFound: 2}) {
+		t.Errorf("counts %+v", got)
+	}
+	if noisy := s.outcomes.rotate(); len(noisy) != 1 || len(s.outcomes.counts) != 0 {
+		t.Errorf("rotation kept %d counts and released %d", len(s.outcomes.counts), len(noisy))
+	}
+	if r := s.privacyReport(); !r.OutcomeReports || r.OutcomeEpsilon != 1 {
+		t.Errorf("privacy report %+v", r)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/mutator"
+)
+
+// The password namespace is a second MIGP corpus holding breached passwords
+// without usernames, for "is this password in any breach" checks such as
+// those of sign-up forms. It has its own configuration and key, from
+// PASSWORD_CONFIG_JSON, and its buckets are stored under passwordNamespace.
+//
+// An entry is encrypted with the password in place of the username and an
+// empty password, so clients query it with a stock MIGP client by calling
+// Request(password, nil): the bucket ID is then derived from the slow hash of
+// the password, as it is from the username in the credential corpus.
+// Similar password variants are stored in their own buckets, so a query for
+// one of them reports a similar password in breach.
+
+// passwordNamespace prefixes the storage keys of the password corpus.
+const passwordNamespace = "pw"
+
+// passwordIngestRequest is a batch of breached passwords to encrypt and store
+// in the password corpus. It is recognized on the ingestion queue by its
+// passwords field. Source names the breach the passwords came from, as for
+// credentials.
+type passwordIngestRequest struct {
+	Passwords   []string `json:"passwords"`
+	Metadata    string   `json:"metadata"`
+	NumVariants int      `json:"numVariants"`
+	Source      string   `json:"source,omitempty"`
+}
+
+// newPasswordSuite returns the suite of the password corpus configured by
+// PASSWORD_CONFIG_JSON, or nil if it is not set.
+func newPasswordSuite() (*cryptoSuite, error) {
+	configJSON := strings.TrimSpace(os.Getenv("PASSWORD_CONFIG_JSON"))
+	if configJSON == "" {
+		return nil, nil
+	}
+	var cfg migp.ServerConfig
+	if err := json.Unmarshal([]byte(configJSON), &cfg); err != nil {
+		return nil, fmt.Errorf("parsing PASSWORD_CONFIG_JSON: %w", err)
+	}
+	cs, err := newCryptoSuite(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("password namespace: %w", err)
+	}
+	cs.namespace = passwordNamespace
+	return cs, nil
+}
+
+// decodePasswordIngestRequest parses a passwordIngestRequest, reporting false
+// if data is not one, so that the queue can carry both kinds of request.
+func decodePasswordIngestRequest(data []byte) (passwordIngestRequest, bool, error) {
+	req := passwordIngestRequest{NumVariants: 9}
+	if err := json.Unmarshal(data, &req); err != nil || req.Passwords == nil {
+		return req, false, nil
+	}
+	if len(req.Passwords) == 0 {
+		return req, true, errors.New("password ingest request has no passwords")
+	}
+	return req, true, nil
+}
+
+// encryptPassword encrypts a password and the similar variants generated by
+// m for the password corpus of cs. Each lands in its own bucket.
+func encryptPassword(m mutator.Mutator, cs *cryptoSuite, password, metadata []byte, numVariants int) ([]journalEntry, error) {
+	type variant struct {
+		password []byte
+		flag     migp.MetadataType
+	}
+	variants := []variant{{password, migp.MetadataBreachedPassword}}
+	for _, p := range m.Mutate(password, numVariants) {
+		variants = append(variants, variant{p, migp.MetadataSimilarPassword})
+	}
+
+	entries := make([]journalEntry, 0, len(variants))
+	for _, v := range variants {
+		newEntry, err := cs.server.EncryptBucketEntry(v.password, nil, v.flag, metadata)
+		if err != nil {
+			return nil, err
+		}
+		bucketHash := int64(cs.bucketHash(v.password))
+		bucketKey := cs.bucketKey(migp.BucketIDToHex(cs.server.BucketID(v.password)))
+		entries = append(entries, journalEntry{Key: bucketKey, BucketHash: &bucketHash, Value: newEntry})
+	}
+	return entries, nil
+}
+
+// ingestPasswords encrypts and stores every password in req in the password
+// corpus. Like credentials, the entries are journaled as one batch before
+// any of them is stored.
+func (s *server) ingestPasswords(ctx context.Context, req passwordIngestRequest) ingestResult {
+	var result ingestResult
+	cs := s.passwords
+	if cs == nil {
+		log.Println("Ingesting passwords without PASSWORD_CONFIG_JSON")
+		result.Failures = len(req.Passwords)
+		return result
+	}
+	m := mutator.NewRDasMutator()
+	var (
+		passwords [][]journalEntry
+		batch     []journalEntry
+	)
+	for _, password := range req.Passwords {
+		if password == "" {
+			result.Malformed += 1
+			continue
+		}
+		entries, err := encryptPassword(m, cs, []byte(password), []byte(req.Metadata), req.NumVariants)
+		if err != nil {
+			log.Println("Encrypting password failed:", err)
+			result.Failures += 1
+			continue
+		}
+		passwords = append(passwords, entries)
+		batch = append(batch, entries...)
+	}
+
+	enabled, err := s.registerSource(ctx, req.Source)
+	if err != nil {
+		log.Println("Registering ingestion source failed:", err)
+		result.Failures += len(passwords)
+		return result
+	}
+	seq, err := s.journalSource(ctx, cs.cfg.Version, journalAppend, req.Source, batch)
+	if err != nil {
+		log.Println("Journaling password batch failed:", err)
+		result.Failures += len(passwords)
+		return result
+	}
+	if !enabled {
+		s.journalSkipped(ctx, seq)
+		result.Successes += len(passwords)
+		return result
+	}
+	for _, entries := range passwords {
+		n, err := s.insert(ctx, entries)
+		if err != nil {
+			log.Println("Inserting password failed:", err)
+			result.Failures += 1
+			continue
+		}
+		result.Successes += 1
+		result.Entries += n
+	}
+	if result.Failures == 0 {
+		s.journalApplied(ctx, seq)
+	}
+	if result.Entries > 0 {
+		s.corpusChanged()
+	}
+	return result
+}
+
+// withPasswords wraps a handler of the password namespace, failing requests
+// with a 404 when it is not configured.
+func (s *server) withPasswords(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.passwords == nil {
+			writeErrorCode(w, errFeatureDisabled, "the password namespace is not configured", http.StatusNotFound)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// handlePasswordConfig serves the public configuration of the password
+// corpus, which clients need to blind their queries.
+func (s *server) handlePasswordConfig(w http.ResponseWriter, req *http.Request) {
+	cfg := struct {
+		migp.Config
+		Privacy privacyReport `json:"privacy"`
+	}{s.passwords.server.Config().Config, s.privacyReport()}
+	writeJSON(w, http.StatusOK, cfg)
+}
+
+// handlePasswordQuery evaluates a MIGP query against the password corpus. It
+// takes the same request as /api/query, but responses are not chunked, as
+// continuation tokens name a suite of the credential corpus.
+func (s *server) handlePasswordQuery(w http.ResponseWriter, req *http.Request) {
+	st, ctx := s.newQueryStats(req)
+	buf, err := readBody(req.Body)
+	if err != nil {
+		log.Println("Request body reading failed:", err)
+		writeError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	defer putBuffer(buf)
+
+	cs := s.passwords
+	var request queryRequest
+	if err := json.Unmarshal(buf.Bytes(), &request); err != nil {
+		invalid(errMalformedJSON, "request body is not a valid query: %v", err).write(w)
+		return
+	}
+	if request.Version != uint32(cs.cfg.Version) {
+		invalid(errUnsupportedVersion, "unsupported version %d", request.Version).write(w)
+		return
+	}
+	if verr := validateQuery(cs, request.ClientRequest, request.BucketIDBitSize); verr != nil {
+		verr.write(w)
+		return
+	}
+	st.decoded(cs, request.BucketIDBitSize)
+	queued := time.Now()
+	release := s.limiter.acquire(w, req)
+	if release == nil {
+		return
+	}
+	st.queued(queued)
+	migpResponse, err := s.evaluate(ctx, cs, request.ClientRequest, suiteGetter{ctx, cs, s.kv, request.BucketIDBitSize})
+	release()
+	if err != nil {
+		evaluationError(w, err)
+		return
+	}
+	written := time.Now()
+	if err := writeMIGPResponse(w, &migpResponse); err != nil {
+		log.Println("Writing response failed:", err)
+	}
+	st.written(written, 4+len(migpResponse.EvaluatedElement)+len(migpResponse.BucketContents))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/erikathea/migp-go/pkg/mutator"
+)
+
+// setPasswordConfig configures the password namespace of the servers created
+// afterwards with a fresh key, returning its configuration.
+func setPasswordConfig(t *testing.T) migp.ServerConfig {
+	cfg := migp.DefaultServerConfig()
+	configJSON, err := json.Marshal(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PASSWORD_CONFIG_JSON", string(configJSON))
+	return cfg
+}
+
+func TestDecodePasswordIngestRequest(t *testing.T) {
+	for _, tt := range []struct {
+		data      string
+		ok, valid bool
+	}{
+		{`{"passwords": ["hunter2"], "source": "s"}`, true, true},
+		{`{"passwords": []}`, true, false},
+		{`{"credentials": ["a@example.com:hunter2"]}`, false, true},
+		{`not json`, false, true},
+	} {
+		req, ok, err := decodePasswordIngestRequest([]byte(tt.data))
+		if ok != tt.ok || (err == nil) != tt.valid {
+			t.Errorf("decodePasswordIngestRequest(%s) = %v, %v, want %v, valid %v", tt.data, ok, err, tt.ok, tt.valid)
+		}
+		if ok && req.NumVariants != 9 {
+			t.Errorf("decodePasswordIngestRequest(%s) defaulted to %d variants", tt.data, req.NumVariants)
+		}
+	}
+}
+
+func TestPasswordBucketKey(t *testing.T) {
+	setPasswordConfig(t)
+	cs, err := newPasswordSuite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := cs.bucketKey("0a1b2"); key != "pw/0a1b2" {
+		t.Errorf("bucketKey = %q, want the pw namespace", key)
+	}
+	t.Setenv("PASSWORD_CONFIG_JSON", "{")
+	if _, err := newPasswordSuite(); err == nil {
+		t.Error("invalid PASSWORD_CONFIG_JSON accepted")
+	}
+}
+
+func TestPasswordNamespace(t *testing.T) {
+	_, srv := newTestServer(t)
+	resp, err := http.Get(srv.URL + "/api/passwords/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("password config without PASSWORD_CONFIG_JSON answered %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	t.Setenv("FUNCTIONS_CUSTOMHANDLER_PORT", "7071")
+	cfg := setPasswordConfig(t)
+	s, srv := newTestServer(t)
+	if result := s.ingestPasswords(context.Background(), passwordIngestRequest{Passwords: []string{"correct horse", ""}, NumVariants: 1}); result.Successes != 1 || result.Malformed != 1 || result.Entries != 2 {
+		t.Fatalf("password ingestion %+v", result)
+	}
+	err = s.kv.buckets.Entries(func(id string, _ sql.NullInt64, _ []byte) error {
+		if !strings.HasPrefix(id, passwordNamespace+"/") {
+			t.Errorf("password entry stored under %q", id)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, _ := json.Marshal(`{"passwords": ["tr0ub4dor"], "numVariants": 0}`)
+	if status, resp := invoke(t, s.handler(), "QueueIngest", `{"item": `+string(item)+`}`); status != http.StatusOK || len(resp.Logs) != 1 || !strings.HasPrefix(resp.Logs[0], "Ingested 1 passwords (1 new entries)") {
+		t.Errorf("QueueIngest of passwords answered %d with %+v", status, resp)
+	}
+
+	resp, err = http.Get(srv.URL + "/api/passwords/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var public migp.Config
+	err = json.NewDecoder(resp.Body).Decode(&public)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || public.Version != cfg.Version {
+		t.Fatalf("password config answered %d: %v", resp.StatusCode, err)
+	}
+
+	client, err := migp.NewClient(cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	variant := mutator.NewRDasMutator().Mutate([]byte("correct horse"), 1)[0]
+	for _, tt := range []struct {
+		password string
+		want     migp.BreachStatus
+	}{
+		{"correct horse", migp.InBreach},
+		{string(variant), migp.SimilarInBreach},
+		{"battery staple", migp.NotInBreach},
+	} {
+		request, ctx, err := client.Request([]byte(tt.password), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(request)
+		if status, err := queryStatus(http.DefaultClient, srv.URL+"/api/passwords/query", body, ctx, 0); err != nil || status != tt.want {
+			t.Errorf("password query for %q: %s, %v, want %s", tt.password, status, err, tt.want)
+		}
+		// The credential corpus knows nothing of the password.
+		if status, err := queryStatus(http.DefaultClient, srv.URL+"/api/query", body, ctx, 0); err == nil && status != migp.NotInBreach {
+			t.Errorf("credential query for %q: %s", tt.password, status)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/lib/pq"
+)
+
+// pirScheme identifies the private information retrieval scheme served by
+// /api/pir. It is the classic two-server XOR scheme: the client picks a window
+// of 2^windowBits buckets around its target and sends each of two
+// non-colluding deployments a random-looking selection mask, the two masks
+// differing only in the target's position. Each deployment returns the XOR
+// of the selected buckets, and XORing both answers yields the target bucket.
+// Either deployment alone learns the window but not the bucket within it.
+const pirScheme = "xor-2server"
+
+// errInvalidMask is the error code for a PIR selection mask of the wrong
+// length.
+const errInvalidMask = "invalid_mask"
+
+// pirParams advertises PIR support in /api/config.
+type pirParams struct {
+	Scheme     string `json:"scheme"`
+	WindowBits int    `json:"windowBits"`
+	PeerURL    string `json:"peerURL,omitempty"`
+}
+
+// pirParams returns the PIR parameters when the pir feature flag is enabled
+// for req, or nil. PIR_PEER_URL is the query endpoint of the other
+// deployment, operated independently and serving the same corpus. PIR only
+// serves the deployment corpus, so tenants with a key of their own do not
+// get it.
+func (s *server) pirParams(req *http.Request) *pirParams {
+	if !s.flagEnabled(flagPIR, req) || s.ownKey(req) {
+		return nil
+	}
+	windowBits := envInt("PIR_WINDOW_BITS", 8)
+	if windowBits < 1 || windowBits > 12 {
+		log.Printf("PIR_WINDOW_BITS must be between 1 and 12, got %d. Using 8.", windowBits)
+		windowBits = 8
+	}
+	return &pirParams{Scheme: pirScheme, WindowBits: windowBits, PeerURL: os.Getenv("PIR_PEER_URL")}
+}
+
+// pirRequest is a PIR bucket fetch. Window is the hex ID of the window at the
+// suite's bucket ID bit length minus windowBits, and Mask holds one bit per
+// bucket in the window, most significant bit first.
+type pirRequest struct {
+	Version      uint32 `json:"version"`
+	BlindElement []byte `json:"blindElement"`
+	Window       string `json:"window"`
+	Mask         []byte `json:"mask"`
+}
+
+// pirGetter answers a PIR request in place of a single bucket lookup.
+type pirGetter struct {
+	ctx        context.Context
+	suite      *cryptoSuite
+	kv         *kvStore
+	windowBits int
+	mask       []byte
+}
+
+// validate checks that window and the mask are well formed.
+func (g pirGetter) validate(window string) *validationError {
+	if err := validateBucketID(window, g.suite.cfg.BucketIDBitSize-g.windowBits); err != nil {
+		return invalid(errInvalidBucketID, "window: %s", err.message)
+	}
+	if n := (1<<g.windowBits + 7) / 8; len(g.mask) != n {
+		return invalid(errInvalidMask, "mask must be %d bytes", n)
+	}
+	return nil
+}
+
+// Get returns the XOR of the buckets selected by the mask in the window
+// identified by id, which must be valid. Every bucket is zero-padded to the
+// largest one in the window, so the response length does not depend on the
+// mask.
+func (g pirGetter) Get(id string) ([]byte, error) {
+	raw, _ := hex.DecodeString(id)
+	first := binary.BigEndian.Uint32(raw) << g.windowBits
+	size := 1 << g.windowBits
+
+	keys := make([]string, size)
+	index := map[string]int{}
+	for i := range keys {
+		keys[i] = g.suite.bucketKey(migp.BucketIDToHex(first + uint32(i)))
+		index[keys[i]] = i
+	}
+	rows, err := g.kv.db().QueryContext(g.ctx, `SELECT id, value, checksum, tombstones FROM kv_store WHERE id = ANY($1)`, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	xor := make([]byte, 0, bucketSizes.get())
+	for rows.Next() {
+		var key string
+		var value, checksum []byte
+		var tombstones int
+		if err := rows.Scan(&key, &value, &checksum, &tombstones); err != nil {
+			return nil, err
+		}
+		if err := g.kv.verifyChecksum("pir", key, value, checksum); err != nil {
+			return nil, err
+		}
+		if tombstones > 0 {
+			if value, err = g.kv.dropTombstoned(g.ctx, key, value); err != nil {
+				return nil, err
+			}
+		}
+		bucketSizes.observe(len(value))
+		if len(value) > len(xor) {
+			xor = append(xor, make([]byte, len(value)-len(xor))...)
+		}
+		if i := index[key]; g.mask[i/8]&(0x80>>(i%8)) != 0 {
+			for j, b := range value {
+				xor[j] ^= b
+			}
+		}
+	}
+	return xor, rows.Err()
+}
+
+// handlePIR serves a PIR bucket fetch together with the usual OPRF
+// evaluation, in the same binary response format as /api/query.
+func (s *server) handlePIR(w http.ResponseWriter, req *http.Request) {
+	params := s.pirParams(req)
+	if params == nil {
+		writeErrorCode(w, errFeatureDisabled, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var request pirRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		invalid(errMalformedJSON, "request body is not a valid PIR query: %v", err).write(w)
+		return
+	}
+	cs, verr := s.validateVersion("", request.Version)
+	if verr != nil {
+		verr.write(w)
+		return
+	}
+	if cs.cfg.BucketIDBitSize <= params.WindowBits {
+		writeError(w, "bucket ID bit length too short for PIR", http.StatusBadRequest)
+		return
+	}
+	if verr := validateBlindElement(cs, request.BlindElement); verr != nil {
+		verr.write(w)
+		return
+	}
+
+	getter := pirGetter{ctx: req.Context(), suite: cs, kv: s.kv, windowBits: params.WindowBits, mask: request.Mask}
+	if verr := getter.validate(request.Window); verr != nil {
+		verr.write(w)
+		return
+	}
+	release := s.limiter.acquire(w, req)
+	if release == nil {
+		return
+	}
+	response, err := s.evaluate(req.Context(), cs, migp.ClientRequest{
+		Version:      request.Version,
+		BucketID:     request.Window,
+		BlindElement: request.BlindElement,
+	}, getter)
+	release()
+	if err != nil {
+		evaluationError(w, err)
+		return
+	}
+	if err := writeMIGPResponse(w, &response); err != nil {
+		log.Println("Writing response failed:", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestPIRParams(t *testing.T) {
+	s, _ := newTestServer(t)
+	req := httptest.NewRequest(http.MethodGet, "/api/config", nil)
+	if params := s.pirParams(req); params != nil {
+		t.Fatalf("PIR advertised without the pir flag: %+v", params)
+	}
+	t.Setenv("PIR_ENABLED", "true")
+	t.Setenv("PIR_PEER_URL", "https://peer.example/api/pir")
+	for _, tt := range []struct {
+		windowBits string
+		want       int
+	}{
+		{"4", 4},
+		{"12", 12},
+		{"13", 8},
+		{"0", 8},
+	} {
+		t.Setenv("PIR_WINDOW_BITS", tt.windowBits)
+		params := s.pirParams(req)
+		if params == nil || params.WindowBits != tt.want || params.Scheme != pirScheme || params.PeerURL != "https://peer.example/api/pir" {
+			t.Errorf("PIR_WINDOW_BITS=%s: params %+v, want %d window bits", tt.windowBits, params, tt.want)
+		}
+	}
+}
+
+func TestPIRGetterValidate(t *testing.T) {
+	s, _ := newTestServer(t)
+	g := pirGetter{suite: s.suites[0], windowBits: 8, mask: make([]byte, 32)}
+	windowBits := s.suites[0].cfg.BucketIDBitSize - g.windowBits
+	last := migp.BucketIDToHex(1<<windowBits - 1)
+	if err := g.validate(last); err != nil {
+		t.Errorf("last window %s rejected: %s", last, err.message)
+	}
+	if err := g.validate(migp.BucketIDToHex(1 << windowBits)); err == nil || err.code != errInvalidBucketID {
+		t.Errorf("window out of range accepted with %v", err)
+	}
+	g.mask = g.mask[1:]
+	if err := g.validate(last); err == nil || err.code != errInvalidMask {
+		t.Errorf("short mask accepted with %v", err)
+	}
+}
+
+// TestPIR fetches a bucket from two masks differing in its position, as a
+// client does from two deployments, and checks that the XOR of both answers
+// is the bucket.
+func TestPIR(t *testing.T) {
+	t.Setenv("PIR_ENABLED", "true")
+	t.Setenv("PIR_WINDOW_BITS", "8")
+	s, srv := newDBTestServer(t)
+	cs := s.suites[0]
+	username := testName(t) + "@example.com"
+	if result := s.ingestParallel(context.Background(), ingestRequest{Credentials: []string{username + ":password1"}}, 1, nil); result.Successes != 1 {
+		t.Fatalf("ingestion %+v", result)
+	}
+	client, err := migp.NewClient(cs.cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _, err := client.Request([]byte(username), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := s.kv.Get(context.Background(), cs.bucketKey(request.BucketID))
+	if err != nil || len(want) == 0 {
+		t.Fatalf("bucket %s: %d bytes, %v", request.BucketID, len(want), err)
+	}
+
+	raw, _ := hex.DecodeString(request.BucketID)
+	id := binary.BigEndian.Uint32(raw)
+	window, position := migp.BucketIDToHex(id>>8), id&0xff
+	mask := make([]byte, 32)
+	rand.Read(mask)
+	var answers [2][]byte
+	for i := range answers {
+		body, _ := json.Marshal(pirRequest{Version: request.Version, BlindElement: request.BlindElement, Window: window, Mask: mask})
+		resp, err := http.Post(srv.URL+"/api/pir", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("PIR query answered %d: %s", resp.StatusCode, data)
+		}
+		var response migp.ServerResponse
+		if err := response.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		answers[i] = response.BucketContents
+		mask[position/8] ^= 0x80 >> (position % 8)
+	}
+	if len(answers[0]) != len(answers[1]) || len(answers[0]) < len(want) {
+		t.Fatalf("answers of %d and %d bytes, want equal lengths of at least %d", len(answers[0]), len(answers[1]), len(want))
+	}
+	bucket := make([]byte, len(answers[0]))
+	for i := range bucket {
+		bucket[i] = answers[0][i] ^ answers[1][i]
+	}
+	if !bytes.Equal(bucket[:len(want)], want) || !bytes.Equal(bucket[len(want):], make([]byte, len(bucket)-len(want))) {
+		t.Fatal("XOR of the answers is not the zero-padded bucket")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// maxPooledBufferSize caps the buffers returned to bufferPool, so that an
+// occasional oversized body does not stay pinned in memory.
+const maxPooledBufferSize = 1 << 20
+
+// bufferPool recycles the buffers used for request bodies and responses in
+// the query path.
+var bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// getBuffer returns an empty buffer from bufferPool.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns b to bufferPool. b must not be used afterwards.
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBufferSize {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+// readBody reads r into a pooled buffer, which the caller releases with
+// putBuffer once the body has been decoded.
+func readBody(r io.Reader) (*bytes.Buffer, error) {
+	buf := getBuffer()
+	if _, err := buf.ReadFrom(r); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeMIGPResponse writes resp in the binary format of
+// migp.ServerResponse.MarshalBinary without building an intermediate copy of
+// the bucket contents.
+func writeMIGPResponse(w http.ResponseWriter, resp *migp.ServerResponse) error {
+	var version [4]byte
+	binary.BigEndian.PutUint32(version[:], resp.Version)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(version)+len(resp.EvaluatedElement)+len(resp.BucketContents)))
+	for _, p := range [][]byte{version[:], resp.EvaluatedElement, resp.BucketContents} {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sizeHint tracks an exponentially weighted moving average of observed
+// sizes, used to preallocate buffers for typical buckets.
+type sizeHint struct {
+	avg atomic.Int64
+}
+
+// bucketSizes tracks the size of fetched buckets.
+var bucketSizes sizeHint
+
+// observe records a size of n bytes.
+func (h *sizeHint) observe(n int) {
+	old := h.avg.Load()
+	h.avg.Store(old + (int64(n)-old)/16)
+}
+
+// get returns the current average size.
+func (h *sizeHint) get() int {
+	return int(h.avg.Load())
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Privacy modes selected by PRIVACY_MODE.
+const (
+	privacyStandard = "standard"
+	privacyStrict   = "strict"
+)
+
+// privacyMode returns the configured privacy mode. In strict mode nothing
+// derived from an individual request is logged or exported: bucket IDs are
+// redacted from log lines and errors, traces are not exported, honeytoken
+// alerts carry no client metadata, and usage analytics are only recorded
+// with differential privacy noise. Aggregate metrics are unaffected.
+func privacyMode() string {
+	switch mode := os.Getenv("PRIVACY_MODE"); mode {
+	case "", privacyStandard:
+		return privacyStandard
+	case privacyStrict:
+		return privacyStrict
+	default:
+		log.Printf("Invalid PRIVACY_MODE value %q. Using %s.", mode, privacyStrict)
+		return privacyStrict
+	}
+}
+
+// Client addresses and user agents identify the people checking their
+// passwords, so they are not recorded as sent. CLIENT_IDS selects what log
+// lines, events and rate limit keys carry instead: hash, the default, keyed
+// hashes that tell clients apart without naming them; strip, nothing, as
+// strict mode always does; or raw, the identifiers unchanged. Rate limits
+// still hash them when stripped, their callers having to be told apart. The
+// hash key is derived from CLIENT_ID_SALT, random for each process unless
+// set, and rotates every CLIENT_ID_SALT_ROTATION (default 24h) so that hashes
+// cannot be linked across periods; instances sharing the salt hash alike.
+// A rotation also starts every caller on a fresh rate limit bucket.
+const (
+	clientIDsHash  = "hash"
+	clientIDsStrip = "strip"
+	clientIDsRaw   = "raw"
+)
+
+// clientIdentifiers filters the identifiers of clients, see above.
+type clientIdentifiers struct {
+	mode     string
+	salt     []byte
+	rotation time.Duration
+}
+
+// newClientIdentifiers returns the filter configured as described above for
+// the privacy mode privacy.
+func newClientIdentifiers(privacy string) *clientIdentifiers {
+	c := &clientIdentifiers{mode: os.Getenv("CLIENT_IDS"), salt: []byte(os.Getenv("CLIENT_ID_SALT")), rotation: envDuration("CLIENT_ID_SALT_ROTATION", 24*time.Hour)}
+	switch c.mode {
+	case "":
+		c.mode = clientIDsHash
+	case clientIDsHash, clientIDsStrip, clientIDsRaw:
+	default:
+		log.Printf("Invalid CLIENT_IDS value %q. Using %s.", c.mode, clientIDsStrip)
+		c.mode = clientIDsStrip
+	}
+	if privacy == privacyStrict {
+		c.mode = clientIDsStrip
+	}
+	if len(c.salt) == 0 {
+		c.salt = make([]byte, 32)
+		rand.Read(c.salt)
+	}
+	if c.rotation <= 0 {
+		log.Printf("Invalid CLIENT_ID_SALT_ROTATION value %s. Using 24h.", c.rotation)
+		c.rotation = 24 * time.Hour
+	}
+	return c
+}
+
+// hash returns the keyed hash of value in the salt period of now.
+func (c *clientIdentifiers) hash(value string, now time.Time) string {
+	mac := hmac.New(sha256.New, c.salt)
+	mac.Write([]byte(strconv.FormatInt(now.UnixNano()/int64(c.rotation), 10)))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return "h:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// record returns value as log lines and events may record it, empty if
+// stripped.
+func (c *clientIdentifiers) record(value string) string {
+	switch {
+	case value == "" || c.mode == clientIDsRaw:
+		return value
+	case c.mode == clientIDsHash:
+		return c.hash(value, time.Now())
+	}
+	return ""
+}
+
+// key returns value as rate limit keys may carry it.
+func (c *clientIdentifiers) key(value string) string {
+	if c.mode == clientIDsRaw {
+		return value
+	}
+	return c.hash(value, time.Now())
+}
+
+// clientAddress returns the address of the client of req: the last in
+// X-Forwarded-For as added by the proxy in front of the service, or else the
+// host of the connection.
+func clientAddress(req *http.Request) string {
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// peerAddress matches the client addresses net/http puts in its error log
+// lines, such as "http: TLS handshake error from 10.0.0.1:5000: EOF".
+var peerAddress = regexp.MustCompile(`(from|serving) ([^ ]+?):( |$)`)
+
+// errorLog returns the error log of the HTTP server, filtering the client
+// addresses of its lines.
+func (c *clientIdentifiers) errorLog() *log.Logger {
+	if c.mode == clientIDsRaw {
+		return nil
+	}
+	return log.New(clientAddressFilter{c, log.Writer()}, "", log.Flags())
+}
+
+// clientAddressFilter filters the client addresses of the lines written
+// through it.
+type clientAddressFilter struct {
+	ids *clientIdentifiers
+	w   io.Writer
+}
+
+func (f clientAddressFilter) Write(p []byte) (int, error) {
+	line := peerAddress.ReplaceAllFunc(p, func(m []byte) []byte {
+		sub := peerAddress.FindSubmatch(m)
+		host, _, err := net.SplitHostPort(string(sub[2]))
+		if err != nil {
+			host = string(sub[2])
+		}
+		id := f.ids.record(host)
+		if id == "" {
+			id = "[redacted]"
+		}
+		return bytes.Join([][]byte{sub[1], []byte(" "), []byte(id), []byte(":"), sub[3]}, nil)
+	})
+	if _, err := f.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactedBucket replaces bucket IDs in log lines and errors in strict mode.
+const redactedBucket = "[redacted]"
+
+// bucketLabel returns id for log lines and errors, or redactedBucket if
+// bucket IDs must not be recorded.
+func (kv *kvStore) bucketLabel(id string) string {
+	if kv.redactBuckets {
+		return redactedBucket
+	}
+	return id
+}
+
+// privacyReport describes what the server records about requests. It is
+// served by /api/config so that deployers and clients can verify it, and is
+// derived from the running configuration rather than restating it.
+type privacyReport struct {
+	Mode string `json:"mode"`
+
+	// BucketLogging is whether log lines and errors may include the bucket
+	// IDs of queries.
+	BucketLogging bool `json:"bucketLogging"`
+
+	// Tracing is whether request traces are exported.
+	Tracing bool `json:"tracing"`
+
+	// HoneytokenMetadata is whether honeytoken alerts include the address
+	// and user agent of the client.
+	HoneytokenMetadata bool `json:"honeytokenMetadata"`
+
+	// ClientIdentifiers is how client addresses and user agents are
+	// recorded: hash, strip or raw. SaltRotation is the period of the hash
+	// key, when hashed.
+	ClientIdentifiers string `json:"clientIdentifiers"`
+	SaltRotation      string `json:"saltRotation,omitempty"`
+
+	// Analytics is whether aggregate usage analytics are recorded, and
+	// AnalyticsEpsilon the privacy budget of their noise, 0 if exact.
+	Analytics        bool    `json:"analytics"`
+	AnalyticsEpsilon float64 `json:"analyticsEpsilon,omitempty"`
+
+	// OutcomeReports is whether clients may report query outcomes to
+	// /api/outcomes, and OutcomeEpsilon the privacy budget of their noise.
+	OutcomeReports bool    `json:"outcomeReports"`
+	OutcomeEpsilon float64 `json:"outcomeEpsilon,omitempty"`
+
+	// Mirroring is whether a sample of queries is copied to a secondary
+	// deployment.
+	Mirroring bool `json:"mirroring"`
+
+	// RangeIndex is whether ingested passwords are also stored as unsalted
+	// SHA-1 hashes, served by the range API.
+	RangeIndex bool `json:"rangeIndex"`
+}
+
+// privacyReport returns the privacy report of the running server.
+func (s *server) privacyReport() privacyReport {
+	r := privacyReport{
+		Mode:               s.privacy,
+		BucketLogging:      s.privacy != privacyStrict,
+		Tracing:            s.tracer != nil,
+		HoneytokenMetadata: s.clientIDs.mode != clientIDsStrip,
+		ClientIdentifiers:  s.clientIDs.mode,
+		Analytics:          s.analytics != nil,
+		Mirroring:          s.mirror != nil,
+		RangeIndex:         s.rangeIndex,
+	}
+	if s.clientIDs.mode == clientIDsHash {
+		r.SaltRotation = s.clientIDs.rotation.String()
+	}
+	if s.analytics != nil {
+		r.AnalyticsEpsilon = s.analytics.epsilon
+	}
+	if s.outcomes != nil {
+		r.OutcomeReports = true
+		r.OutcomeEpsilon = s.outcomes.epsilon
+	}
+	return r
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientIdentifiers(t *testing.T) {
+	t.Setenv("CLIENT_ID_SALT", "salt")
+	t.Setenv("CLIENT_ID_SALT_ROTATION", "1h")
+	ids := newClientIdentifiers(privacyStandard)
+	now := time.Unix(7200, 0)
+	if ids.hash("10.0.0.1", now) != ids.hash("10.0.0.1", now.Add(time.Minute)) {
+		t.Error("hash changed within a salt period")
+	}
+	if ids.hash("10.0.0.1", now) == ids.hash("10.0.0.1", now.Add(time.Hour)) {
+		t.Error("hash did not change across salt periods")
+	}
+	if ids.hash("10.0.0.1", now) == ids.hash("10.0.0.2", now) {
+		t.Error("different clients hash alike")
+	}
+	if got := ids.record("10.0.0.1"); !strings.HasPrefix(got, "h:") {
+		t.Errorf("recorded %q, want a hash", got)
+	}
+
+	var buf bytes.Buffer
+	clientAddressFilter{ids, &buf}.Write([]byte("http: TLS handshake error from 10.0.0.1:5000: EOF\n"))
+	if strings.Contains(buf.String(), "10.0.0.1") || !strings.Contains(buf.String(), "from h:") {
+		t.Errorf("error log line %q not filtered", buf.String())
+	}
+
+	strict := newClientIdentifiers(privacyStrict)
+	if got := strict.record("10.0.0.1"); got != "" {
+		t.Errorf("strict mode recorded %q", got)
+	}
+	if got := strict.key("10.0.0.1"); got == "10.0.0.1" || got == "" {
+		t.Errorf("strict mode rate limit key %q, want a hash", got)
+	}
+
+	t.Setenv("CLIENT_IDS", "raw")
+	if got := newClientIdentifiers(privacyStandard).record("10.0.0.1"); got != "10.0.0.1" {
+		t.Errorf("raw mode recorded %q", got)
+	}
+}
+
+func TestPrivacyMode(t *testing.T) {
+	for mode, want := range map[string]string{"": privacyStandard, "standard": privacyStandard, "strict": privacyStrict, "lax": privacyStrict} {
+		t.Setenv("PRIVACY_MODE", mode)
+		if got := privacyMode(); got != want {
+			t.Errorf("PRIVACY_MODE=%q selected %s, want %s", mode, got, want)
+		}
+	}
+}
+
+func TestPrivacyReport(t *testing.T) {
+	config := func(srv *httptest.Server) privacyReport {
+		resp, err := http.Get(srv.URL + "/api/config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Privacy privacyReport `json:"privacy"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Privacy
+	}
+	t.Setenv("TRACE_EXPORT_URL", "http://127.0.0.1:1/v1/traces")
+	t.Setenv("ANALYTICS_ENABLED", "true")
+	t.Setenv("ANALYTICS_DP_EPSILON", "0.5")
+	s, srv := newTestServer(t)
+	if r := config(srv); r.Mode != privacyStandard || !r.BucketLogging || !r.Tracing || !r.HoneytokenMetadata || !r.Analytics || r.AnalyticsEpsilon != 0.5 {
+		t.Errorf("standard mode privacy report %+v", r)
+	}
+	if got := s.kv.bucketLabel("0a1b2"); got != "0a1b2" {
+		t.Errorf("standard mode bucket label %q", got)
+	}
+
+	t.Setenv("PRIVACY_MODE", "strict")
+	t.Setenv("ANALYTICS_DP_EPSILON", "")
+	s, srv = newTestServer(t)
+	if r := config(srv); r.Mode != privacyStrict || r.BucketLogging || r.Tracing || r.HoneytokenMetadata || r.Analytics || r.ClientIdentifiers != clientIDsStrip {
+		t.Errorf("strict mode privacy report %+v", r)
+	}
+	if got := s.kv.bucketLabel("0a1b2"); got != redactedBucket {
+		t.Errorf("strict mode bucket label %q, want it redacted", got)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "context"
+
+// Optional backends and integrations are built in by profile, selected with
+// build tags, so that the binary deployed to Functions carries only what it
+// uses and starts quickly:
+//
+//	(none), full  everything, for self-hosted deployments
+//	minimal       the postgres and memory storage backends only
+//	azure         minimal with the aztable storage backend and Azure Monitor
+//	aws           minimal with the aws-kms OPRF key provider
+//
+// Build tags combine, as in -tags azure,aws. The mysql, mongodb, consul and
+// firestore storage backends are only in full builds. Key Vault and Vault
+// secret references, which need no dependencies, are in every build. A file
+// of an optional component registers it, in bucketBackends, keyAgreements or
+// exporters, under the constraint of its profile:
+//
+//	//go:build full || !(minimal || azure || aws)
+//	//go:build full || azure || !(minimal || aws)
+//	//go:build full || aws || !(minimal || azure)
+//
+// /version lists the storage backends and key providers built in.
+
+// exporters run the background exporters built in until ctx is done.
+var exporters []func(ctx context.Context)
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// POST /api/query/batch answers up to QUERY_BATCH_MAX (default 32) queries in
+// one request, for services checking many credentials at once. The blinded
+// elements of every suite are evaluated in a single task, which takes one
+// crypto worker and one evaluation slot for the whole batch.
+// Responses are in the order of the queries, each the base64-encoded binary
+// MIGP response of /api/query or the error of that query alone:
+//
+//	{"queries": [{"version": 1, "bucketId": "…", "blindElement": "…"}, …]}
+//	→ {"responses": [{"response": "AAAAAQ…"}, {"error": {"code": "invalid_request", …}}]}
+
+// queryBatch is the body of a batch query.
+type queryBatch struct {
+	Queries []json.RawMessage `json:"queries"`
+}
+
+// batchResult is the answer to one query of a batch.
+type batchResult struct {
+	Response []byte         `json:"response,omitempty"`
+	Error    *errorEnvelope `json:"error,omitempty"`
+}
+
+// batchResponse is the body of a batch query response.
+type batchResponse struct {
+	Responses []batchResult `json:"responses"`
+}
+
+// handleQueryBatch serves batch queries, see above.
+func (s *server) handleQueryBatch(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	buf, err := readBody(req.Body)
+	if err != nil {
+		log.Println("Request body reading failed:", err)
+		writeError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	defer putBuffer(buf)
+	var batch queryBatch
+	if err := json.Unmarshal(buf.Bytes(), &batch); err != nil {
+		invalid(errMalformedJSON, "request body is not a valid batch query: %v", err).write(w)
+		return
+	}
+	limit := envInt("QUERY_BATCH_MAX", 32)
+	if len(batch.Queries) == 0 || len(batch.Queries) > limit {
+		invalid(errInvalidRequest, "a batch holds 1 to %d queries", limit).write(w)
+		return
+	}
+
+	results := make([]batchResult, len(batch.Queries))
+	queries := make([]queryRequest, len(batch.Queries))
+	bySuite := map[*cryptoSuite][]int{}
+	next := queriesNextCorpus(req.Context())
+	var suites []*cryptoSuite
+	for i, raw := range batch.Queries {
+		request, cs, verr := s.decodeQuery(tenantOf(req), raw)
+		if verr != nil {
+			requestsInvalid.Inc(verr.code)
+			results[i].Error = &errorEnvelope{Code: verr.code, Message: verr.message, RequestID: w.Header().Get("X-Request-ID")}
+			continue
+		}
+		if !next {
+			s.checkHoneytokens(w, req, cs, request.BucketID, request.BucketIDBitSize)
+			s.analytics.record(cs, request.BucketID, request.BucketIDBitSize)
+		}
+		queries[i] = request
+		if bySuite[cs] == nil {
+			suites = append(suites, cs)
+		}
+		bySuite[cs] = append(bySuite[cs], i)
+	}
+
+	release := s.limiter.acquire(w, req)
+	if release == nil {
+		return
+	}
+	defer release()
+	for _, cs := range suites {
+		indices := bySuite[cs]
+		elements := make([][]byte, len(indices))
+		for j, i := range indices {
+			elements[j] = queries[i].BlindElement
+		}
+		evaluated, err := s.evaluateBatch(req.Context(), cs, elements)
+		if err != nil {
+			evaluationError(w, err)
+			return
+		}
+		corpus := cs
+		if next {
+			corpus = cs.next()
+		}
+		for j, i := range indices {
+			request := queries[i]
+			contents, err := suiteGetter{req.Context(), corpus, s.kv, request.BucketIDBitSize}.Get(request.BucketID)
+			if err != nil {
+				storageError(w, "Bucket fetch", err)
+				return
+			}
+			resp := migp.ServerResponse{Version: request.Version, EvaluatedElement: evaluated[j], BucketContents: contents}
+			if results[i].Response, err = resp.MarshalBinary(); err != nil {
+				storageError(w, "Response encoding", err)
+				return
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, batchResponse{Responses: results})
+}
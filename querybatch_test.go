@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestQueryBatch(t *testing.T) {
+	s, srv := newTestServer(t)
+	cs := s.suites[0]
+	client, err := migp.NewClient(cs.cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		batch    queryBatch
+		requests []migp.ClientRequest
+	)
+	for i := range 3 {
+		request, _, err := client.Request([]byte(fmt.Sprintf("user%d@example.com", i)), []byte("password1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, request)
+		batch.Queries = append(batch.Queries, raw)
+	}
+	batch.Queries = append(batch.Queries, json.RawMessage(`{"version": 1, "bucketId": "zz"}`))
+	body, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(srv.URL+"/api/query/batch", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("batch status %d", resp.StatusCode)
+	}
+	var got batchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Responses) != len(batch.Queries) {
+		t.Fatalf("%d responses to %d queries", len(got.Responses), len(batch.Queries))
+	}
+	for i, request := range requests {
+		want, err := cs.server.HandleRequest(request, fixtureBuckets{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r migp.ServerResponse
+		if err := r.UnmarshalBinary(got.Responses[i].Response); err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+		if !bytes.Equal(r.EvaluatedElement, want.EvaluatedElement) {
+			t.Errorf("response %d: batch evaluation differs from a single one", i)
+		}
+	}
+	if e := got.Responses[len(requests)].Error; e == nil || e.Code != errInvalidBucketID {
+		t.Errorf("invalid query answered with %+v", got.Responses[len(requests)])
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"empty", `{"queries": []}`},
+		{"malformed", `{"queries": `},
+	}
+	for _, tt := range tests {
+		resp, err := http.Post(srv.URL+"/api/query/batch", "application/json", bytes.NewReader([]byte(tt.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s batch: status %d, want %d", tt.name, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
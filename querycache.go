@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var queryCacheRequests = newCounter("migp_query_cache_requests_total", "Cacheable GET queries by whether the client's cached response was still valid.", "result")
+
+// queryCacheMaxAge is the max-age of cacheable query responses, set by
+// QUERY_CACHE_MAX_AGE. It is at most corpusGenerationTTL, so that a cache
+// stops serving a response about as soon as this instance notices the
+// corpus generation it is keyed on has changed.
+var queryCacheMaxAge = sync.OnceValue(func() time.Duration {
+	maxAge := envDuration("QUERY_CACHE_MAX_AGE", corpusGenerationTTL)
+	if maxAge > corpusGenerationTTL {
+		log.Printf("QUERY_CACHE_MAX_AGE exceeds the corpus generation TTL. Using %s.", corpusGenerationTTL)
+		maxAge = corpusGenerationTTL
+	}
+	return maxAge
+})
+
+// cacheableQuery handles the GET variant of /api/query, where the JSON client
+// request is passed base64url encoded in the q parameter. Identical requests
+// against the same corpus generation get identical responses, so they carry
+// an ETag and Cache-Control letting a CDN or API gateway absorb repeats. It
+// returns the writer to respond with, the decoded request and whether the
+// client's cached response is still valid, or false if a response has
+// already been written. A request answered from the client's cache is still
+// checked like any other before the 304 is sent.
+func (s *server) cacheableQuery(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, []byte, bool, bool) {
+	if !s.flagEnabled(flagQueryCache, req) {
+		writeErrorCode(w, errFeatureDisabled, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return w, nil, false, false
+	}
+	q := req.URL.Query().Get("q")
+	body, err := base64.RawURLEncoding.DecodeString(q)
+	if err != nil || len(body) == 0 {
+		writeError(w, "q must be a base64url encoded query", http.StatusBadRequest)
+		return w, nil, false, false
+	}
+	generation, err := s.generation()
+	if err != nil {
+		log.Println("Reading corpus generation failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return w, nil, false, false
+	}
+
+	digest := sha256.Sum256(body)
+	etag := fmt.Sprintf(`"g%d-%x"`, generation, digest[:16])
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(queryCacheMaxAge().Seconds())))
+	w.Header().Set("Vary", "Accept-Encoding")
+	if len(s.tenants) > 0 {
+		// Tenants with a key get responses of their own corpus.
+		w.Header().Add("Vary", tenantHeader())
+	}
+	if req.Header.Get("If-None-Match") == etag {
+		queryCacheRequests.Inc("hit")
+		return cacheableWriter{w}, body, true, true
+	}
+	queryCacheRequests.Inc("miss")
+	return cacheableWriter{w}, body, false, true
+}
+
+// cacheableWriter drops the caching headers set by cacheableQuery from error
+// responses, so that caches never store them.
+type cacheableWriter struct {
+	http.ResponseWriter
+}
+
+// WriteHeader sends the status code, marking errors as uncacheable.
+func (w cacheableWriter) WriteHeader(code int) {
+	if code != http.StatusOK && code != http.StatusNotModified {
+		w.Header().Del("ETag")
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
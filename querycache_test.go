@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestCacheableQueryRejections(t *testing.T) {
+	_, srv := newTestServer(t)
+	get := func(q string) *http.Response {
+		resp, err := http.Get(srv.URL + "/api/query?q=" + q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := get("e30"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET query without the query_cache flag answered %d", resp.StatusCode)
+	}
+	t.Setenv("QUERY_GET_ENABLED", "true")
+	if resp := get("not+base64"); resp.StatusCode != http.StatusBadRequest || resp.Header.Get("ETag") != "" {
+		t.Errorf("invalid q answered %d with ETag %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	rec := httptest.NewRecorder()
+	rec.Header().Set("ETag", `"g1-00"`)
+	rec.Header().Set("Cache-Control", "public, max-age=5")
+	cacheableWriter{rec}.WriteHeader(http.StatusTooManyRequests)
+	if rec.Header().Get("ETag") != "" || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("error response headers %v, want it uncacheable", rec.Header())
+	}
+}
+
+func TestCacheableQuery(t *testing.T) {
+	t.Setenv("QUERY_GET_ENABLED", "true")
+	s, srv := newDBTestServer(t)
+	cs := s.suites[0]
+	username := testName(t) + "@example.com"
+	if result := s.ingestParallel(context.Background(), ingestRequest{Credentials: []string{username + ":password1"}}, 1, nil); result.Successes != 1 {
+		t.Fatalf("ingestion %+v", result)
+	}
+	client, err := migp.NewClient(cs.cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, ctx, err := client.Request([]byte(username), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(request)
+	target := srv.URL + "/api/query?q=" + base64.RawURLEncoding.EncodeToString(body)
+
+	resp, err := http.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response migp.ServerResponse
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" || resp.Header.Get("Cache-Control") != "public, max-age=5" {
+		t.Fatalf("GET query answered %d with headers %v", resp.StatusCode, resp.Header)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := response.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if status, _, err := ctx.Finalize(response); err != nil || status != migp.InBreach {
+		t.Fatalf("GET query finalized to %v, %v", status, err)
+	}
+
+	hits := func() float64 {
+		v, _, _, _ := queryCacheRequests.total(func(v []string) bool { return v[0] == "hit" })
+		return v
+	}
+	before := hits()
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified || resp.Header.Get("ETag") != etag {
+		t.Errorf("revalidation answered %d with ETag %q, want %d with %q", resp.StatusCode, resp.Header.Get("ETag"), http.StatusNotModified, etag)
+	}
+	if hits() != before+1 {
+		t.Error("revalidation not counted as a cache hit")
+	}
+}
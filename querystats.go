@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// The phases of every query are timed into migp_query_phase_duration_seconds,
+// to tell whether slowness is crypto-bound or storage-bound. With
+// QUERY_STATS_SAMPLE_RATE set, that fraction of queries is also logged as a
+// JSON line of its protocol stats:
+//
+//	query stats {"route":"/api/query","version":1,"bucketIdBits":20,"bucketBytes":5120,
+//	  "responseBytes":5157,"decodeMs":0.1,"queueMs":0,"oprfMs":0.9,"fetchMs":3.2,"writeMs":0.1,"totalMs":4.3}
+//
+// Decoding covers reading and validating the query, queueing the wait for an
+// evaluation slot, and writing the response. The OPRF evaluation is the time
+// spent handling the request apart from fetching the bucket from storage,
+// including any wait for a crypto worker, see cryptoPool.
+// Bucket entries are encrypted along with their lengths, so buckets are only
+// measured in bytes; bucket IDs are never logged.
+
+var queryPhaseDuration = newHistogram("migp_query_phase_duration_seconds", "Time spent in each phase of handling queries by route and phase.", defaultLatencyBuckets, "route", "phase")
+
+// Query phases.
+const (
+	phaseDecode = "decode"
+	phaseQueue  = "queue"
+	phaseOPRF   = "oprf"
+	phaseFetch  = "fetch"
+	phaseWrite  = "write"
+)
+
+// queryStats are the protocol stats of one query.
+type queryStats struct {
+	start   time.Time
+	sampled bool
+
+	Route         string  `json:"route"`
+	Version       uint16  `json:"version"`
+	BucketIDBits  int     `json:"bucketIdBits"`
+	BucketBytes   int     `json:"bucketBytes"`
+	ResponseBytes int     `json:"responseBytes"`
+	DecodeMs      float64 `json:"decodeMs"`
+	QueueMs       float64 `json:"queueMs"`
+	OPRFMs        float64 `json:"oprfMs"`
+	FetchMs       float64 `json:"fetchMs"`
+	WriteMs       float64 `json:"writeMs"`
+	TotalMs       float64 `json:"totalMs"`
+}
+
+// queryStatsKey is the context key of the stats of a query.
+type queryStatsKey struct{}
+
+// newQueryStats returns the stats of the query req, logged if it is sampled,
+// and the context carrying them. Every method of queryStats does nothing on
+// nil stats, such as those of the contexts of other requests.
+func (s *server) newQueryStats(req *http.Request) (*queryStats, context.Context) {
+	st := &queryStats{start: time.Now(), Route: req.URL.Path}
+	st.sampled = s.queryStatsRate > 0 && rand.Float64() < s.queryStatsRate
+	return st, context.WithValue(req.Context(), queryStatsKey{}, st)
+}
+
+// queryStatsFrom returns the stats of the query of ctx, or nil.
+func queryStatsFrom(ctx context.Context) *queryStats {
+	st, _ := ctx.Value(queryStatsKey{}).(*queryStats)
+	return st
+}
+
+// since returns the milliseconds since start.
+func since(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+// observe records ms milliseconds spent in phase.
+func (st *queryStats) observe(phase string, ms float64) {
+	queryPhaseDuration.Observe(ms/1000, st.Route, phase)
+}
+
+// decoded records the end of decoding a query of cs for bits-bit bucket
+// IDs, those of the suite if bits is 0.
+func (st *queryStats) decoded(cs *cryptoSuite, bits int) {
+	if st == nil {
+		return
+	}
+	if bits == 0 {
+		bits = cs.cfg.BucketIDBitSize
+	}
+	st.Version, st.BucketIDBits, st.DecodeMs = cs.cfg.Version, bits, since(st.start)
+	st.observe(phaseDecode, st.DecodeMs)
+}
+
+// queued records the wait for an evaluation slot that started at start.
+func (st *queryStats) queued(start time.Time) {
+	if st != nil {
+		st.QueueMs = since(start)
+		st.observe(phaseQueue, st.QueueMs)
+	}
+}
+
+// fetched records a storage fetch of size bytes that started at start.
+func (st *queryStats) fetched(start time.Time, size int) {
+	if st == nil {
+		return
+	}
+	ms := since(start)
+	st.FetchMs += ms
+	st.BucketBytes += size
+	st.observe(phaseFetch, ms)
+}
+
+// evaluated records the handling of the request that started at start,
+// less the fetches made meanwhile.
+func (st *queryStats) evaluated(start time.Time) {
+	if st == nil {
+		return
+	}
+	st.OPRFMs = max(0, since(start)-st.FetchMs)
+	st.observe(phaseOPRF, st.OPRFMs)
+}
+
+// written records writing a response of size bytes that started at start,
+// and logs the stats if they are sampled.
+func (st *queryStats) written(start time.Time, size int) {
+	if st == nil {
+		return
+	}
+	st.ResponseBytes, st.WriteMs, st.TotalMs = size, since(start), since(st.start)
+	st.observe(phaseWrite, st.WriteMs)
+	if !st.sampled {
+		return
+	}
+	line, err := json.Marshal(st)
+	if err != nil {
+		return
+	}
+	log.Printf("query stats %s", line)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestQueryStats(t *testing.T) {
+	t.Setenv("QUERY_STATS_SAMPLE_RATE", "1")
+	s, srv := newTestServer(t)
+	client, err := migp.NewClient(s.suites[0].cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _, err := client.Request([]byte("user@example.com"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+	resp, err := http.Post(srv.URL+"/api/query", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("query status %d", resp.StatusCode)
+	}
+
+	_, line, ok := strings.Cut(logged.String(), "query stats ")
+	if !ok {
+		t.Fatalf("no query stats logged in %q", logged.String())
+	}
+	var st queryStats
+	if err := json.Unmarshal([]byte(line), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Route != "/api/query" || st.BucketIDBits != s.suites[0].cfg.BucketIDBitSize || st.ResponseBytes == 0 || st.TotalMs < st.FetchMs {
+		t.Fatalf("stats %s", line)
+	}
+	if strings.Contains(line, request.BucketID) {
+		t.Fatalf("stats %s contain the bucket ID", line)
+	}
+	for _, phase := range []string{phaseDecode, phaseQueue, phaseOPRF, phaseFetch, phaseWrite} {
+		_, _, _, count := queryPhaseDuration.total(func(v []string) bool { return v[0] == "/api/query" && v[1] == phase })
+		if count == 0 {
+			t.Errorf("no %s phase observed", phase)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The range index serves the k-anonymity range API of Have I Been Pwned for
+// integrations that cannot speak MIGP. Passwords ingested into the current
+// suite are also stored there as unsalted SHA-1 hashes, split into a 5 hex
+// digit prefix and 35 digit suffix, with the number of distinct credentials
+// using them. Clients fetch every suffix of the prefix of their hash and
+// look for theirs, so the server never learns the hash queried.
+//
+// Unlike the MIGP corpus, the index is not bound to usernames or protected by
+// the OPRF key: anyone can check candidate passwords against it offline. It
+// is therefore off unless RANGE_INDEX_ENABLED is set, and reported by
+// /api/config.
+
+const (
+	rangePrefixLength = 5
+	rangeSuffixLength = 2*sha1.Size - rangePrefixLength
+
+	// Padded responses have between rangePaddingMin and rangePaddingMax
+	// suffixes, as those of Have I Been Pwned do.
+	rangePaddingMin = 800
+	rangePaddingMax = 1000
+)
+
+// passwordHash returns the prefix and suffix of the SHA-1 hash of password,
+// in upper case hex.
+func passwordHash(password []byte) (prefix, suffix string) {
+	digest := sha1.Sum(password)
+	h := strings.ToUpper(hex.EncodeToString(digest[:]))
+	return h[:rangePrefixLength], h[rangePrefixLength:]
+}
+
+// indexPasswords adds passwords to the range index, counting each once per
+// occurrence.
+func (s *server) indexPasswords(ctx context.Context, passwords [][]byte) error {
+	counts := make(map[[2]string]int64)
+	for _, password := range passwords {
+		prefix, suffix := passwordHash(password)
+		counts[[2]string{prefix, suffix}]++
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	prefixes := make([]string, 0, len(counts))
+	suffixes := make([]string, 0, len(counts))
+	values := make([]int64, 0, len(counts))
+	for h, n := range counts {
+		prefixes, suffixes, values = append(prefixes, h[0]), append(suffixes, h[1]), append(values, n)
+	}
+	query := `
+	INSERT INTO password_hashes (prefix, suffix, count)
+	SELECT * FROM unnest($1::text[], $2::text[], $3::bigint[])
+	ON CONFLICT (prefix, suffix) DO UPDATE SET count = password_hashes.count + EXCLUDED.count`
+	_, err := s.kv.db().ExecContext(ctx, query, pq.Array(prefixes), pq.Array(suffixes), pq.Array(values))
+	return err
+}
+
+// rangeSuffix is one line of a range response.
+type rangeSuffix struct {
+	suffix string
+	count  int64
+}
+
+// randomInt returns a uniform random integer in [0, n).
+func randomInt(n int) int {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
+	}
+	return int(v.Int64())
+}
+
+// padRange adds random suffixes with a count of 0 to suffixes, up to a random
+// number between rangePaddingMin and rangePaddingMax, so that the response
+// size does not reveal how many hashes share the prefix.
+func padRange(suffixes []rangeSuffix) []rangeSuffix {
+	target := rangePaddingMin + randomInt(rangePaddingMax-rangePaddingMin+1)
+	random := make([]byte, (rangeSuffixLength+1)/2)
+	for len(suffixes) < target {
+		if _, err := rand.Read(random); err != nil {
+			panic(err)
+		}
+		suffix := strings.ToUpper(hex.EncodeToString(random))[:rangeSuffixLength]
+		suffixes = append(suffixes, rangeSuffix{suffix: suffix})
+	}
+	sort.Slice(suffixes, func(i, j int) bool { return suffixes[i].suffix < suffixes[j].suffix })
+	return suffixes
+}
+
+// handleRange serves GET /api/range/{prefix}, the suffixes of the SHA-1
+// password hashes starting with a 5 hex digit prefix, one SUFFIX:COUNT line
+// each. With an Add-Padding: true header, the suffixes are padded with random
+// ones of count 0. Responses are cacheable for RANGE_CACHE_MAX_AGE (default
+// 1h).
+func (s *server) handleRange(w http.ResponseWriter, req *http.Request) {
+	if !s.rangeIndex {
+		writeErrorCode(w, errFeatureDisabled, "the range index is disabled", http.StatusNotFound)
+		return
+	}
+	prefix := strings.ToUpper(strings.TrimPrefix(req.URL.Path, "/api/range/"))
+	if _, err := hex.DecodeString(prefix + "0"); len(prefix) != rangePrefixLength || err != nil {
+		writeError(w, "the hash prefix must be 5 hexadecimal characters", http.StatusBadRequest)
+		return
+	}
+	if mode := req.URL.Query().Get("mode"); mode != "" && mode != "sha1" {
+		writeError(w, "only SHA-1 password hashes are indexed", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.kv.db().QueryContext(req.Context(), `SELECT suffix, count FROM password_hashes WHERE prefix = $1 ORDER BY suffix`, prefix)
+	if err != nil {
+		storageError(w, "Loading password hash range", err)
+		return
+	}
+	defer rows.Close()
+	suffixes := []rangeSuffix{}
+	for rows.Next() {
+		var r rangeSuffix
+		if err := rows.Scan(&r.suffix, &r.count); err != nil {
+			storageError(w, "Loading password hash range", err)
+			return
+		}
+		suffixes = append(suffixes, r)
+	}
+	if err := rows.Err(); err != nil {
+		storageError(w, "Loading password hash range", err)
+		return
+	}
+	if strings.EqualFold(req.Header.Get("Add-Padding"), "true") {
+		suffixes = padRange(suffixes)
+	}
+
+	maxAge := envDuration("RANGE_CACHE_MAX_AGE", time.Hour)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	w.Header().Set("Vary", "Add-Padding")
+	var b strings.Builder
+	for _, r := range suffixes {
+		fmt.Fprintf(&b, "%s:%d\r\n", r.suffix, r.count)
+	}
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		log.Println("Writing range response failed:", err)
+	}
+}
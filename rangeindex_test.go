@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHash(t *testing.T) {
+	prefix, suffix := passwordHash([]byte("password"))
+	if prefix != "5BAA6" || suffix != "1E4C9B93F3F0682250B6CF8331B7EE68FD8" {
+		t.Errorf("passwordHash = %s, %s", prefix, suffix)
+	}
+}
+
+func TestPadRange(t *testing.T) {
+	stored := []rangeSuffix{{suffix: "1E4C9B93F3F0682250B6CF8331B7EE68FD8", count: 3}}
+	padded := padRange(stored)
+	if len(padded) < rangePaddingMin || len(padded) > rangePaddingMax {
+		t.Fatalf("padded to %d suffixes, want %d to %d", len(padded), rangePaddingMin, rangePaddingMax)
+	}
+	if !sort.SliceIsSorted(padded, func(i, j int) bool { return padded[i].suffix < padded[j].suffix }) {
+		t.Error("padded suffixes are not sorted")
+	}
+	found := false
+	for _, r := range padded {
+		if len(r.suffix) != rangeSuffixLength || strings.ToUpper(r.suffix) != r.suffix {
+			t.Fatalf("padding suffix %q", r.suffix)
+		}
+		if r == stored[0] {
+			found = true
+		} else if r.count != 0 {
+			t.Errorf("padding suffix %s with count %d", r.suffix, r.count)
+		}
+	}
+	if !found {
+		t.Error("padding dropped the stored suffix")
+	}
+}
+
+func TestHandleRangeRejections(t *testing.T) {
+	s, srv := newTestServer(t)
+	get := func(path string) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := get("/api/range/5BAA6"); status != http.StatusNotFound {
+		t.Errorf("range with the index disabled answered %d, want %d", status, http.StatusNotFound)
+	}
+	s.rangeIndex = true
+	for _, path := range []string{"/api/range/5BAA", "/api/range/5BAA61", "/api/range/5BAG6", "/api/range/5BAA6?mode=ntlm"} {
+		if status := get(path); status != http.StatusBadRequest {
+			t.Errorf("GET %s answered %d, want %d", path, status, http.StatusBadRequest)
+		}
+	}
+	if !s.privacyReport().RangeIndex {
+		t.Error("privacy report does not disclose the range index")
+	}
+}
+
+func TestHandleRange(t *testing.T) {
+	t.Setenv("RANGE_INDEX_ENABLED", "true")
+	s, srv := newDBTestServer(t)
+	password := testName(t) + "-password"
+	prefix, suffix := passwordHash([]byte(password))
+	for i, username := range []string{"a", "b", "a"} {
+		credential := testName(t) + username + "@example.com:" + password
+		if result := s.ingestParallel(context.Background(), ingestRequest{Credentials: []string{credential}}, 1, nil); result.Successes != 1 {
+			t.Fatalf("ingestion %d: %+v", i, result)
+		}
+	}
+
+	get := func(padding bool) string {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/range/"+strings.ToLower(prefix), nil)
+		if padding {
+			req.Header.Set("Add-Padding", "true")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Control") != "public, max-age=3600" {
+			t.Fatalf("range answered %d with headers %v", resp.StatusCode, resp.Header)
+		}
+		return string(body)
+	}
+	// The replayed credential adds no entries, so it is not counted again.
+	want := suffix + ":2\r\n"
+	if body := get(false); !strings.Contains(body, want) {
+		t.Errorf("range lacks %q", want)
+	}
+	body := get(true)
+	if lines := strings.Count(body, "\r\n"); !strings.Contains(body, want) || lines < rangePaddingMin || lines > rangePaddingMax {
+		t.Errorf("padded range of %d lines, want %d to %d with %q", lines, rangePaddingMin, rangePaddingMax, want)
+	}
+}
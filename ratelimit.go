@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Queries are rate limited per caller when RATE_LIMIT_QPS is set. Each
+// tenant a credential is bound to, or for requests without one each client
+// address, see clientAddress and clientIdentifiers, may send RATE_LIMIT_QPS
+// queries a second in bursts of up to RATE_LIMIT_BURST (default twice the
+// rate). Queries beyond the limit are refused with a 429 and the
+// Retry-After delay until a token is available. Every response to a rate
+// limited route carries the state of the bucket of its caller in the
+// headers of the IETF RateLimit draft, which SDKs and gateways can back off
+// on without parsing bodies:
+//
+//	RateLimit-Policy: <burst>;w=<seconds to refill the burst>
+//	RateLimit-Limit: <burst>
+//	RateLimit-Remaining: <tokens left>
+//	RateLimit-Reset: <seconds until the bucket is full again>
+//
+// Without a shared store each instance keeps its own token buckets, which
+// lets a caller through at the rate times the number of instances. With
+// REDIS_ADDR set, as host:port, the buckets are kept in Redis and shared by
+// every instance, each refilled and taken from atomically by a script using
+// the clock of the Redis server, see redisFromEnv. When Redis fails, the
+// instance falls back to its own buckets, limited to RATE_LIMIT_LOCAL_QPS
+// (default RATE_LIMIT_QPS) a second for each caller, for
+// RATE_LIMIT_FALLBACK_PERIOD (default 10s) before trying Redis again.
+
+var (
+	rateLimited       = newCounter("migp_rate_limited_total", "Queries refused by the rate limiter by bucket store.", "store")
+	rateLimitFallback = newGauge("migp_rate_limit_fallback", "Whether the rate limiter fell back to local buckets.")
+)
+
+// tokenBucketScript takes a token from the bucket in KEYS[1], refilled at
+// ARGV[1] tokens a second up to ARGV[2], and returns whether it could,
+// otherwise the milliseconds until it can, and the whole tokens left.
+const tokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, wait, math.floor(tokens)}
+`
+
+// tokenBucketSHA is the SHA-1 digest by which Redis caches the script.
+var tokenBucketSHA = func() string {
+	sum := sha1.Sum([]byte(tokenBucketScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// rateLimiter hands out query tokens to callers.
+type rateLimiter struct {
+	rate, burst float64
+	local       *localBuckets
+
+	// redis is nil without a shared store.
+	redis          *redisClient
+	fallback       *localBuckets
+	fallbackPeriod time.Duration
+	fallbackUntil  atomic.Int64 // Unix nanoseconds
+}
+
+// newRateLimiter returns the limiter configured as described above, or nil
+// if RATE_LIMIT_QPS is not set.
+func newRateLimiter() *rateLimiter {
+	qps := envInt("RATE_LIMIT_QPS", 0)
+	if qps <= 0 {
+		return nil
+	}
+	burst := envInt("RATE_LIMIT_BURST", 2*qps)
+	if burst < 1 {
+		log.Printf("Invalid RATE_LIMIT_BURST value %d. Using 1.", burst)
+		burst = 1
+	}
+	l := &rateLimiter{rate: float64(qps), burst: float64(burst), local: newLocalBuckets(float64(qps), float64(burst))}
+	if l.redis = redisFromEnv(); l.redis != nil {
+		local := float64(envInt("RATE_LIMIT_LOCAL_QPS", qps))
+		l.fallback = newLocalBuckets(local, math.Max(1, local*float64(burst)/float64(qps)))
+		l.fallbackPeriod = envDuration("RATE_LIMIT_FALLBACK_PERIOD", 10*time.Second)
+	}
+	return l
+}
+
+// take takes a token for key, returning false and the time until one is
+// available if there is none, the whole tokens left and the store that
+// decided.
+func (l *rateLimiter) take(key string, now time.Time) (ok bool, wait time.Duration, remaining int, store string) {
+	if l.redis == nil {
+		ok, wait, remaining = l.local.take(key, now)
+		return ok, wait, remaining, "local"
+	}
+	if now.UnixNano() >= l.fallbackUntil.Load() {
+		ok, wait, remaining, err := l.takeShared(key)
+		if err == nil {
+			rateLimitFallback.Set(0)
+			return ok, wait, remaining, "redis"
+		}
+		log.Printf("Shared rate limiting failed, limiting locally for %s: %v", l.fallbackPeriod, err)
+		l.fallbackUntil.Store(now.Add(l.fallbackPeriod).UnixNano())
+		rateLimitFallback.Set(1)
+	}
+	ok, wait, remaining = l.fallback.take(key, now)
+	return ok, wait, remaining, "fallback"
+}
+
+// takeShared takes a token for key from Redis.
+func (l *rateLimiter) takeShared(key string) (bool, time.Duration, int, error) {
+	args := []string{"1", "migp:ratelimit:" + key, strconv.FormatFloat(l.rate, 'f', -1, 64), strconv.FormatFloat(l.burst, 'f', -1, 64)}
+	reply, err := l.redis.do(append([]string{"EVALSHA", tokenBucketSHA}, args...)...)
+	var replyErr redisError
+	if errors.As(err, &replyErr) && strings.HasPrefix(string(replyErr), "NOSCRIPT") {
+		reply, err = l.redis.do(append([]string{"EVAL", tokenBucketScript}, args...)...)
+	}
+	if err != nil {
+		return false, 0, 0, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 3 {
+		return false, 0, 0, fmt.Errorf("redis: unexpected script reply %v", reply)
+	}
+	allowed, _ := items[0].(int64)
+	wait, _ := items[1].(int64)
+	remaining, _ := items[2].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond, int(remaining), nil
+}
+
+// localBuckets keeps the token buckets of callers on this instance.
+type localBuckets struct {
+	rate, burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+// tokenBucket is the state of the bucket of one caller.
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// newLocalBuckets returns buckets refilled at rate tokens a second up to
+// burst.
+func newLocalBuckets(rate, burst float64) *localBuckets {
+	return &localBuckets{rate: rate, burst: burst, buckets: map[string]*tokenBucket{}}
+}
+
+// take takes a token from the bucket of key at now, returning the whole
+// tokens left.
+func (b *localBuckets) take(key string, now time.Time) (bool, time.Duration, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Buckets left alone long enough to fill up are as good as new.
+	full := time.Duration(b.burst / b.rate * float64(time.Second))
+	if now.Sub(b.pruned) > full {
+		for k, tb := range b.buckets {
+			if now.Sub(tb.at) > full {
+				delete(b.buckets, k)
+			}
+		}
+		b.pruned = now
+	}
+	tb, ok := b.buckets[key]
+	if !ok {
+		tb = &tokenBucket{tokens: b.burst, at: now}
+		b.buckets[key] = tb
+	}
+	if elapsed := now.Sub(tb.at); elapsed > 0 {
+		tb.tokens = math.Min(b.burst, tb.tokens+elapsed.Seconds()*b.rate)
+		tb.at = now
+	}
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0, int(tb.tokens)
+	}
+	return false, time.Duration((1 - tb.tokens) / b.rate * float64(time.Second)), 0
+}
+
+// rateLimitKey returns the caller of req that rate limits apply to: the
+// tenant its credential is bound to, or else its address filtered by ids.
+// The tenant header is not a caller, which could name a new tenant on every
+// request.
+func rateLimitKey(req *http.Request, ids *clientIdentifiers) string {
+	if p, ok := authenticated(req); ok && p.tenant != "" {
+		return "tenant:" + p.tenant
+	}
+	return "addr:" + ids.key(clientAddress(req))
+}
+
+// withRateLimit refuses queries beyond the rate limit of their caller.
+func (s *server) withRateLimit(h http.HandlerFunc) http.HandlerFunc {
+	if s.rateLimiter == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		ok, wait, remaining, store := s.rateLimiter.take(rateLimitKey(req, s.clientIDs), time.Now())
+		s.rateLimiter.setHeaders(w, remaining)
+		if !ok {
+			rateLimited.Inc(store)
+			seconds := ceilSeconds(wait)
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, seconds)))
+			writeErrorCode(w, errRateLimited, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// setHeaders sets the RateLimit headers of a response to a caller with
+// remaining tokens left, see above.
+func (l *rateLimiter) setHeaders(w http.ResponseWriter, remaining int) {
+	h := w.Header()
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", int(l.burst), ceilSeconds(time.Duration(l.burst/l.rate*float64(time.Second)))))
+	h.Set("RateLimit-Limit", strconv.Itoa(int(l.burst)))
+	h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(time.Duration((l.burst-float64(remaining))/l.rate*float64(time.Second)))))
+}
+
+// ceilSeconds returns d in whole seconds, rounded up.
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
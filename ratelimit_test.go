@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLocalBuckets(t *testing.T) {
+	b := newLocalBuckets(2, 3)
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if ok, _, _ := b.take("a", now); !ok {
+			t.Fatalf("take %d of the burst refused", i)
+		}
+	}
+	ok, wait, _ := b.take("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("take beyond the burst = %v, %s, want refused for 500ms", ok, wait)
+	}
+	if ok, _, _ := b.take("b", now); !ok {
+		t.Fatal("another caller was refused")
+	}
+	if ok, _, _ := b.take("a", now.Add(500*time.Millisecond)); !ok {
+		t.Fatal("take after the refill was refused")
+	}
+}
+
+// fakeRedis serves the token bucket script with the given replies, failing
+// EVALSHA until EVAL has been called, as a server that has not cached the
+// script does.
+func fakeRedis(t *testing.T, allowed func() bool) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var cached atomic.Bool
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					var args []string
+					for i := 0; i < n; i++ {
+						header, _ := r.ReadString('\n')
+						size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+						arg := make([]byte, size+2)
+						if _, err := io.ReadFull(r, arg); err != nil {
+							return
+						}
+						args = append(args, string(arg[:size]))
+					}
+					switch {
+					case args[0] == "EVALSHA" && !cached.Load():
+						conn.Write([]byte("-NOSCRIPT No matching script.\r\n"))
+					case allowed():
+						cached.Store(true)
+						conn.Write([]byte("*3\r\n:1\r\n:0\r\n:0\r\n"))
+					default:
+						cached.Store(true)
+						conn.Write([]byte("*3\r\n:0\r\n:1500\r\n:0\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRateLimiterShared(t *testing.T) {
+	var calls atomic.Int32
+	t.Setenv("RATE_LIMIT_QPS", "1")
+	t.Setenv("RATE_LIMIT_LOCAL_QPS", "1")
+	t.Setenv("RATE_LIMIT_BURST", "1")
+	t.Setenv("REDIS_ADDR", fakeRedis(t, func() bool { return calls.Add(1) == 1 }))
+	l := newRateLimiter()
+	now := time.Now()
+	if ok, _, _, store := l.take("a", now); !ok || store != "redis" {
+		t.Fatalf("first take = %v from %s, want allowed by redis", ok, store)
+	}
+	ok, wait, _, store := l.take("a", now)
+	if ok || wait != 1500*time.Millisecond || store != "redis" {
+		t.Fatalf("second take = %v, %s from %s, want refused by redis for 1.5s", ok, wait, store)
+	}
+
+	l.redis.addr = "127.0.0.1:1"
+	for len(l.redis.pool) > 0 {
+		(<-l.redis.pool).Close()
+	}
+	if ok, _, _, store := l.take("a", now); !ok || store != "fallback" {
+		t.Fatalf("take with redis down = %v from %s, want allowed by the fallback", ok, store)
+	}
+	if ok, _, _, store := l.take("a", now); ok || store != "fallback" {
+		t.Fatalf("second take with redis down = %v from %s, want refused by the fallback", ok, store)
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	t.Setenv("RATE_LIMIT_QPS", "1")
+	t.Setenv("RATE_LIMIT_BURST", "1")
+	t.Setenv("API_KEYS", `{"acme-key": {"roles": ["query"], "tenant": "acme"}, "globex-key": {"roles": ["query"], "tenant": "globex"}}`)
+	_, srv := newTestServer(t)
+	query := func(tenant string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/query", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tenant+"-key")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := query("acme"); resp.StatusCode == http.StatusTooManyRequests {
+		t.Fatal("first query was rate limited")
+	}
+	resp := query("acme")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("second query status %d, Retry-After %q, want a 429 after 1s", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if resp := query("globex"); resp.StatusCode == http.StatusTooManyRequests {
+		t.Fatal("another tenant was rate limited")
+	}
+}
+
+func TestRateLimitIgnoresTenantHeader(t *testing.T) {
+	t.Setenv("RATE_LIMIT_QPS", "1")
+	t.Setenv("RATE_LIMIT_BURST", "1")
+	t.Setenv("TENANT_HEADER_TRUSTED", "true")
+	_, srv := newTestServer(t)
+	for i, tenant := range []string{"acme", "globex"} {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/query", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(tenantHeader(), tenant)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if limited := resp.StatusCode == http.StatusTooManyRequests; limited != (i > 0) {
+			t.Errorf("query naming %s: status %d", tenant, resp.StatusCode)
+		}
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	t.Setenv("RATE_LIMIT_QPS", "1")
+	t.Setenv("RATE_LIMIT_BURST", "2")
+	_, srv := newTestServer(t)
+	query := func() *http.Response {
+		t.Helper()
+		resp, err := http.Post(srv.URL+"/api/query", "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp := query()
+	if got := resp.Header.Get("RateLimit-Remaining"); got != "1" || resp.Header.Get("RateLimit-Limit") != "2" || resp.Header.Get("RateLimit-Policy") != "2;w=2" {
+		t.Errorf("first query: RateLimit headers %v", resp.Header)
+	}
+	query()
+	resp = query()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("RateLimit-Remaining") != "0" || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("query beyond the limit: status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+
+	w := httptest.NewRecorder()
+	writeErrorCode(w, errUnavailable, "down", http.StatusServiceUnavailable)
+	if got := w.Header().Get("Retry-After"); got != defaultRetryAfter {
+		t.Errorf("503 without a delay: Retry-After %q, want %s", got, defaultRetryAfter)
+	}
+}
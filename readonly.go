@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// errCorpusReadOnly is returned by corpus writes while the read_only flag is
+// enabled.
+var errCorpusReadOnly = errors.New("corpus is read-only")
+
+// readOnly reports whether corpus writes are paused. The flag is shared by
+// every instance through the feature_flags table, so a change takes up to
+// FEATURE_FLAGS_TTL to reach all of them.
+func (s *server) readOnly() bool {
+	return s.flagEnabled(flagReadOnly, nil)
+}
+
+// withWritable wraps a handler that changes the corpus so that requests
+// other than GET fail with a 503 while the corpus is read-only.
+func (s *server) withWritable(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && s.readOnly() {
+			seconds := int(s.flags.ttl.Seconds())
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			writeErrorCode(w, errReadOnly, errCorpusReadOnly.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		h(w, req)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// bucketID returns the bucket ID stored under key if key belongs to this
+// suite's corpus.
+func (cs *cryptoSuite) bucketID(key string) (string, bool) {
+	if cs.cfg.Version == migp.DefaultMIGPVersion {
+		return key, !strings.Contains(key, "/")
+	}
+	prefix := fmt.Sprintf("v%d/", cs.cfg.Version)
+	id := strings.TrimPrefix(key, prefix)
+	return id, strings.HasPrefix(key, prefix) && !strings.Contains(id, "/")
+}
+
+// Entries calls f for every stored entry. Each value is a single encrypted
+// bucket entry as it was appended, with its username hash if it was recorded.
+func (kv *kvStore) Entries(f func(id string, bucketHash sql.NullInt64, value []byte) error) error {
+	if kv.buckets != nil {
+		return kv.buckets.Entries(f)
+	}
+	rows, err := kv.db().Query(`SELECT id, bucket_hash, value FROM kv_store_shadow WHERE deleted_at IS NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var bucketHash sql.NullInt64
+		var value []byte
+		if err := rows.Scan(&id, &bucketHash, &value); err != nil {
+			return err
+		}
+		if err := f(id, bucketHash, value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// rebucketable checks that entries encrypted under src can be reused as is by
+// dst, which must only differ in its version and bucket ID bit length.
+func rebucketable(src, dst *cryptoSuite) error {
+	a, b := src.cfg.Config, dst.cfg.Config
+	a.Version, a.BucketIDBitSize = b.Version, b.BucketIDBitSize
+	if a != b {
+		return fmt.Errorf("MIGP versions %d and %d differ in more than the bucket ID bit length", src.cfg.Version, dst.cfg.Version)
+	}
+	srcKey, err := keyFingerprint(&src.cfg)
+	if err != nil {
+		return err
+	}
+	dstKey, err := keyFingerprint(&dst.cfg)
+	if err != nil {
+		return err
+	}
+	if srcKey != dstKey {
+		return fmt.Errorf("MIGP versions %d and %d use different keys", src.cfg.Version, dst.cfg.Version)
+	}
+	return nil
+}
+
+// mergeBuckets copies every entry of src into dst, which has shorter bucket
+// IDs. A bucket ID is the high-order bits of the username hash, so each
+// shorter bucket is the union of the longer buckets sharing its prefix.
+func (s *server) mergeBuckets(src, dst *cryptoSuite) (ingestResult, error) {
+	shift := src.cfg.BucketIDBitSize - dst.cfg.BucketIDBitSize
+	var result ingestResult
+	err := s.kv.Entries(func(key string, bucketHash sql.NullInt64, value []byte) error {
+		id, ok := src.bucketID(key)
+		if !ok {
+			return nil
+		}
+		raw, err := hex.DecodeString(id)
+		if err != nil || len(raw) != 4 {
+			result.Malformed++
+			return nil
+		}
+		merged := migp.BucketIDToHex(binary.BigEndian.Uint32(raw) >> shift)
+		added, err := s.kv.AppendUnique(context.Background(), dst.bucketKey(merged), bucketHash, value)
+		if err == errBucketFull || err == errBucketOverflowed {
+			result.Failures++
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		result.Successes++
+		if added {
+			result.Entries++
+		}
+		return nil
+	})
+	if result.Entries > 0 {
+		s.corpusChanged()
+	}
+	return result, err
+}
+
+// readCredentials reads <username>:<password> lines from path.
+func readCredentials(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var credentials []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			credentials = append(credentials, line)
+		}
+	}
+	return credentials, scanner.Err()
+}
+
+// runRebucket implements the rebucket command, which writes the corpus of one
+// configured suite into another that differs only in bucket ID bit length.
+// Clients pick up the new length from /api/config once the target suite is
+// made current.
+//
+// Shortening bucket IDs merges existing buckets offline. Lengthening them
+// splits buckets, which needs the source credentials because the server
+// cannot tell which username an encrypted entry belongs to.
+func runRebucket(args []string) error {
+	fs := flag.NewFlagSet("rebucket", flag.ExitOnError)
+	from := fs.Uint("from", 0, "MIGP version of the existing corpus (default the current suite)")
+	to := fs.Uint("to", 0, "MIGP version to write, as configured in CONFIG_JSON")
+	credentialsPath := fs.String("credentials", "", "file of <username>:<password> lines to re-ingest, required when lengthening bucket IDs")
+	metadata := fs.String("metadata", "", "metadata string stored alongside re-ingested entries")
+	numVariants := fs.Int("num-variants", 9, "number of password variants to ingest per credential")
+	usernameVariant := fs.Bool("username-variant", true, "include a username-only variant")
+	workers := fs.Int("workers", runtime.NumCPU(), "number of concurrent ingestion workers")
+	fs.Parse(args)
+
+	configs, err := loadConfigs()
+	if err != nil {
+		return err
+	}
+	s, err := newServer(configs[0], configs[1:]...)
+	if err != nil {
+		return err
+	}
+	src := s.suites[0]
+	if *from != 0 {
+		src = s.suite(uint16(*from))
+	}
+	dst := s.suite(uint16(*to))
+	switch {
+	case src == nil:
+		return fmt.Errorf("MIGP version %d is not configured", *from)
+	case dst == nil:
+		return fmt.Errorf("MIGP version %d is not configured, add it to CONFIG_JSON", *to)
+	case src == dst:
+		return errors.New("source and target versions are the same")
+	}
+	if err := rebucketable(src, dst); err != nil {
+		return err
+	}
+	if err := s.ensureStorage(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var result ingestResult
+	if dst.cfg.BucketIDBitSize <= src.cfg.BucketIDBitSize {
+		fmt.Printf("Merging %d-bit buckets of version %d into %d-bit buckets of version %d\n",
+			src.cfg.BucketIDBitSize, src.cfg.Version, dst.cfg.BucketIDBitSize, dst.cfg.Version)
+		if result, err = s.mergeBuckets(src, dst); err != nil {
+			return err
+		}
+	} else {
+		if *credentialsPath == "" {
+			return errors.New("lengthening bucket IDs requires -credentials")
+		}
+		credentials, err := readCredentials(*credentialsPath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Re-ingesting %d credentials into %d-bit buckets of version %d\n",
+			len(credentials), dst.cfg.BucketIDBitSize, dst.cfg.Version)
+		result = s.ingestParallel(context.Background(), ingestRequest{
+			Version:                dst.cfg.Version,
+			Credentials:            credentials,
+			Metadata:               *metadata,
+			NumVariants:            *numVariants,
+			IncludeUsernameVariant: *usernameVariant,
+		}, *workers, nil)
+	}
+	fmt.Printf("Rebucketed %d records (%d new entries, %d failures, %d malformed) in %s\n",
+		result.Successes, result.Entries, result.Failures, result.Malformed, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestRebucketable(t *testing.T) {
+	v1 := migp.DefaultServerConfig()
+	shorter := v1
+	shorter.Version, shorter.BucketIDBitSize = 2, v1.BucketIDBitSize-4
+	otherHasher := shorter
+	otherHasher.SlowHasherID++
+	otherKey := migp.DefaultServerConfig()
+	otherKey.Config = shorter.Config
+	for _, tt := range []struct {
+		name string
+		dst  migp.ServerConfig
+		ok   bool
+	}{
+		{"shorter bucket IDs", shorter, true},
+		{"other slow hasher", otherHasher, false},
+		{"other key", otherKey, false},
+	} {
+		src, _ := newCryptoSuite(v1)
+		dst := &cryptoSuite{cfg: tt.dst}
+		if err := rebucketable(src, dst); (err == nil) != tt.ok {
+			t.Errorf("%s: rebucketable() = %v", tt.name, err)
+		}
+	}
+}
+
+func TestMergeBuckets(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "memory")
+	t.Setenv("INGEST_JOURNAL_ENABLED", "false")
+	v1 := migp.DefaultServerConfig()
+	v2 := v1
+	v2.Version, v2.BucketIDBitSize = 2, v1.BucketIDBitSize-4
+	s, err := newServer(v1, v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.detached = true
+	if err := s.ensureStorage(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+
+	credentials := syntheticCredentials(10, 2)
+	if result := s.ingestParallel(context.Background(), ingestRequest{Credentials: credentials}, 2, nil); result.Failures != 0 {
+		t.Fatalf("ingestion %+v", result)
+	}
+	src, dst := s.suite(1), s.suite(2)
+	if id, ok := src.bucketID(dst.bucketKey("0a1b2")); ok {
+		t.Fatalf("version 2 key read as version 1 bucket %q", id)
+	}
+	result, err := s.mergeBuckets(src, dst)
+	if err != nil || result.Entries == 0 || result.Failures != 0 || result.Malformed != 0 {
+		t.Fatalf("merge %+v, %v", result, err)
+	}
+
+	queries, err := prepareQueries(v2.Config, credentials, 8, 0.5, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queries {
+		status, err := queryStatus(http.DefaultClient, srv.URL+"/api/query", q.body, q.ctx, 0)
+		if err != nil || status != q.expected {
+			t.Fatalf("query of the merged corpus: %v, %v, want %v", status, err, q.expected)
+		}
+	}
+}
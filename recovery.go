@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+var handlerPanics = newCounter("migp_handler_panics_total", "Requests whose handler panicked by route.", "route")
+
+// withRecovery serves h, answering requests whose handler panics with a 500
+// instead of dropping the connection. A panic is a bug in the server, not
+// proof that the input was invalid, so it is reported as an internal error
+// and the stack is logged to find it. http.ErrAbortHandler is passed on, as
+// it aborts the response on purpose.
+func withRecovery(mux *http.ServeMux, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			_, route := mux.Handler(req)
+			handlerPanics.Inc(route)
+			log.Printf("Handler for %s panicked: %v\n%s", route, v, debug.Stack())
+			if rec.status == 0 {
+				writeErrorCode(rec, errInternal, "request could not be processed", http.StatusInternalServerError)
+			}
+		}()
+		h.ServeHTTP(rec, req)
+	})
+}
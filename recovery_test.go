@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithRecovery(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, req *http.Request) { panic("boom") })
+	rec := httptest.NewRecorder()
+	withRecovery(mux, mux).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	var body errorEnvelope
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != errInternal {
+		t.Fatalf("body %q, want the %s error code", rec.Body.String(), errInternal)
+	}
+}
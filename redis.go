@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisClient is a minimal client of the Redis protocol (RESP2), enough to
+// run scripts, keeping a small pool of connections. It connects to addr,
+// over TLS if useTLS is set as Azure Cache for Redis requires on port 6380,
+// and authenticates with password if it is not empty.
+type redisClient struct {
+	addr     string
+	password string
+	useTLS   bool
+	timeout  time.Duration
+	pool     chan *redisConn
+}
+
+// redisConn is a connection of a redisClient.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisFromEnv returns a client of the Redis server at REDIS_ADDR, as
+// host:port, or nil if it is not set. REDIS_PASSWORD authenticates,
+// REDIS_TLS connects over TLS, REDIS_TIMEOUT (default 100ms) bounds each
+// call and REDIS_POOL_SIZE (default 16) bounds the idle connections.
+func redisFromEnv() *redisClient {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		return nil
+	}
+	timeout := envDuration("REDIS_TIMEOUT", 100*time.Millisecond)
+	return newRedisClient(addr, os.Getenv("REDIS_PASSWORD"), envBool("REDIS_TLS", false), timeout, envInt("REDIS_POOL_SIZE", 16))
+}
+
+// newRedisClient returns a client keeping up to size idle connections.
+func newRedisClient(addr, password string, useTLS bool, timeout time.Duration, size int) *redisClient {
+	return &redisClient{addr: addr, password: password, useTLS: useTLS, timeout: timeout, pool: make(chan *redisConn, size)}
+}
+
+// dial opens and authenticates a connection.
+func (c *redisClient) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var conn net.Conn
+	var err error
+	if c.useTLS {
+		host, _, _ := net.SplitHostPort(c.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	if c.password != "" {
+		if _, err := rc.do(c.timeout, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do sends a command on a pooled connection and returns its reply. Error
+// replies are returned as redisError, which leave the connection usable.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-c.pool:
+	default:
+		var err error
+		if conn, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := conn.do(c.timeout, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// do sends a command and reads its reply within timeout.
+func (conn *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return conn.read()
+}
+
+// read reads a reply: a string, an int64, nil, a []interface{} of replies,
+// or a redisError.
+func (conn *redisConn) read() (interface{}, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			// An error within an array is part of the reply.
+			item, err := conn.read()
+			var replyErr redisError
+			if errors.As(err, &replyErr) {
+				item, err = replyErr, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Bucket repair sources.
+const (
+	repairFromJournal  = "journal"
+	repairFromSnapshot = "snapshot"
+)
+
+// repairSpec selects the bucket rebuilt by a repair and where its entries
+// are rebuilt from.
+type repairSpec struct {
+	Version  uint16 `json:"version"`
+	BucketID string `json:"bucketId"`
+	From     string `json:"from"`
+	DryRun   bool   `json:"dryRun"`
+}
+
+// repairResult reports the outcome of a bucket repair. Added and Dropped
+// count the entries the rebuilt bucket gained and lost.
+type repairResult struct {
+	Key      string `json:"key"`
+	From     string `json:"from"`
+	Snapshot int64  `json:"snapshot,omitempty"`
+	Entries  int    `json:"entries"`
+	Added    int    `json:"added"`
+	Dropped  int    `json:"dropped"`
+	DryRun   bool   `json:"dryRun"`
+}
+
+// bucketState accumulates the entries of one bucket by replaying journal
+// batches in order.
+type bucketState struct {
+	key     string
+	entries map[string]journalEntry
+	last    int64
+}
+
+// apply replays the changes of b to the bucket.
+func (st *bucketState) apply(b journalBatch) error {
+	for _, e := range b.Entries {
+		if e.Key != st.key {
+			continue
+		}
+		if b.Op == journalRemove {
+			delete(st.entries, string(e.Value))
+		} else {
+			st.entries[string(e.Value)] = e
+		}
+	}
+	st.last = b.Seq
+	return nil
+}
+
+// repairBucket rebuilds the bucket of cs stored under key, and its
+// sub-buckets, from the journal alone or, if m is not nil, from its contents
+// in that snapshot with the journal replayed on top. The recorded entries of
+// the bucket are replaced by the rebuilt ones, so entries ingested before
+// journaling was enabled are dropped by a journal rebuild; a dry run reports
+// them without changing anything.
+//
+// The journal scan reads every batch of the suite, which is slow on large
+// journals but leaves ingestion unaffected.
+func (s *server) repairBucket(ctx context.Context, cs *cryptoSuite, key string, m *snapshotManifest, source snapshotSource, dryRun bool) (repairResult, error) {
+	result := repairResult{Key: key, From: repairFromJournal, DryRun: dryRun}
+	st := &bucketState{key: key, entries: map[string]journalEntry{}}
+	var from time.Time
+	if m != nil {
+		result.From, result.Snapshot = repairFromSnapshot, m.Generation
+		buckets, err := snapshotBuckets(cs, m, source, []string{key})
+		if err != nil {
+			return result, err
+		}
+		values, err := bucketEntries(buckets[key])
+		if err != nil {
+			return result, fmt.Errorf("snapshot bucket %s: %w", key, err)
+		}
+		for _, value := range values {
+			st.entries[string(value)] = journalEntry{Key: key, Value: value}
+		}
+		from = m.CreatedAt.Add(-journalReplayAfter())
+	}
+	if err := s.scanJournal(ctx, cs, 0, from, time.Time{}, st.apply); err != nil {
+		return result, err
+	}
+
+	tx, err := s.kv.db().BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM kv_store WHERE id = $1 FOR UPDATE`, key); err != nil {
+		return result, err
+	}
+	// Appends journaled since the scan may have been stored before the lock
+	// was taken; later ones wait for it and land on the rebuilt bucket.
+	if err := s.scanJournal(ctx, cs, st.last, time.Time{}, time.Time{}, st.apply); err != nil {
+		return result, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT value, deleted_at IS NOT NULL FROM kv_store_shadow WHERE id = $1`, key)
+	if err != nil {
+		return result, err
+	}
+	current := map[string]bool{}
+	// Tombstoned entries are dropped for good, and added back like any
+	// other missing entry if the journal still lists them.
+	var dropped, tombstoned [][]byte
+	for rows.Next() {
+		var value []byte
+		var deleted bool
+		if err := rows.Scan(&value, &deleted); err != nil {
+			rows.Close()
+			return result, err
+		}
+		if deleted {
+			tombstoned = append(tombstoned, value)
+			continue
+		}
+		current[string(value)] = true
+		if _, ok := st.entries[string(value)]; !ok {
+			dropped = append(dropped, value)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	result.Entries, result.Dropped = len(st.entries), len(dropped)
+	for value := range st.entries {
+		if !current[value] {
+			result.Added++
+		}
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	if len(dropped)+len(tombstoned) > 0 {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM kv_store_shadow WHERE id = $1 AND value = ANY($2)`, key, pq.ByteaArray(append(dropped, tombstoned...))); err != nil {
+			return result, err
+		}
+	}
+	for value, e := range st.entries {
+		if current[value] {
+			continue
+		}
+		query := `INSERT INTO kv_store_shadow (id, value, bucket_hash) VALUES ($1, $2, $3) ON CONFLICT (id, value) DO NOTHING`
+		if _, err := tx.ExecContext(ctx, query, key, e.Value, e.bucketHash()); err != nil {
+			return result, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO kv_store (id, value) VALUES ($1, ''::bytea) ON CONFLICT (id) DO NOTHING`, key); err != nil {
+		return result, err
+	}
+	if _, err := tx.ExecContext(ctx, rebuildBucketQuery, key); err != nil {
+		return result, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE kv_store SET tombstones = 0 WHERE id = $1`, key); err != nil {
+		return result, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM kv_store WHERE id LIKE $1 || '/%'`, key); err != nil {
+		return result, err
+	}
+	if _, err := tx.ExecContext(ctx, rebuildSplitQuery, key); err != nil {
+		return result, err
+	}
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+	s.corpusChanged()
+	return result, nil
+}
+
+// errNoSnapshot is returned for a snapshot repair of a suite that has never
+// been exported.
+var errNoSnapshot = errors.New("no snapshot has been published")
+
+// repairSuite checks spec and returns the suite of the bucket it selects.
+func (s *server) repairSuite(spec repairSpec) (*cryptoSuite, *validationError) {
+	cs := s.suites[0]
+	if spec.Version != 0 {
+		if cs = s.suite(spec.Version); cs == nil {
+			return nil, invalid(errUnsupportedVersion, "unsupported version %d", spec.Version)
+		}
+	}
+	if err := validateBucketID(spec.BucketID, cs.cfg.BucketIDBitSize); err != nil {
+		return nil, err
+	}
+	switch spec.From {
+	case "", repairFromJournal, repairFromSnapshot:
+		return cs, nil
+	}
+	return nil, invalid(errInvalidRequest, "from must be %q or %q", repairFromJournal, repairFromSnapshot)
+}
+
+// runRepair repairs the bucket of cs selected by spec, which must have been
+// checked by repairSuite. Snapshot shards are read from dir if it is set,
+// and from the snapshot's base URL otherwise.
+func (s *server) runRepair(ctx context.Context, cs *cryptoSuite, spec repairSpec, dir string) (repairResult, error) {
+	var m *snapshotManifest
+	var source snapshotSource
+	if spec.From == repairFromSnapshot {
+		var err error
+		if m, err = s.loadManifest(ctx, cs, "true"); err != nil {
+			return repairResult{}, err
+		}
+		if m == nil {
+			return repairResult{}, errNoSnapshot
+		}
+		source = dirSource(dir)
+		if dir == "" {
+			source = httpSource(&http.Client{Timeout: time.Minute}, m.BaseURL)
+		}
+	}
+	return s.repairBucket(ctx, cs, cs.bucketKey(spec.BucketID), m, source, spec.DryRun)
+}
+
+// handleRepairBucket rebuilds a single bucket from the journal or the latest
+// snapshot, as described by a repairSpec.
+func (s *server) handleRepairBucket(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var spec repairSpec
+	if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+		log.Println("Request body unmarshal failed:", err)
+		writeError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	cs, verr := s.repairSuite(spec)
+	if verr != nil {
+		verr.write(w)
+		return
+	}
+	result, err := s.runRepair(req.Context(), cs, spec, "")
+	if errors.Is(err, errNoSnapshot) {
+		writeErrorCode(w, errNotFound, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		storageError(w, "Repairing bucket", err)
+		return
+	}
+	if !spec.DryRun {
+		log.Printf("Repaired bucket %s from %s: %d entries, %d added, %d dropped", result.Key, result.From, result.Entries, result.Added, result.Dropped)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// runRepairBucket implements the repair-bucket command, which rebuilds a
+// single corrupted or inconsistent bucket without reloading the corpus.
+func runRepairBucket(args []string) error {
+	fs := flag.NewFlagSet("repair-bucket", flag.ExitOnError)
+	version := fs.Uint("version", 0, "MIGP version of the bucket (default the current suite)")
+	bucketID := fs.String("bucket", "", "bucket ID to repair, as 8 hex digits")
+	from := fs.String("from", repairFromJournal, "rebuild from the \"journal\" or the latest \"snapshot\" and the journal since")
+	snapshots := fs.String("snapshots", "", "read snapshot shards from this directory instead of their base URL")
+	dryRun := fs.Bool("dry-run", false, "report the changes without making them")
+	fs.Parse(args)
+
+	configs, err := loadConfigs()
+	if err != nil {
+		return err
+	}
+	s, err := newServer(configs[0], configs[1:]...)
+	if err != nil {
+		return err
+	}
+	if err := s.ensureStorage(); err != nil {
+		return err
+	}
+	spec := repairSpec{Version: uint16(*version), BucketID: *bucketID, From: *from, DryRun: *dryRun}
+	cs, verr := s.repairSuite(spec)
+	if verr != nil {
+		return verr
+	}
+	result, err := s.runRepair(context.Background(), cs, spec, *snapshots)
+	if err != nil {
+		return err
+	}
+	verb := "Rebuilt"
+	if result.DryRun {
+		verb = "Would rebuild"
+	}
+	fmt.Printf("%s bucket %s from %s with %d entries (%d added, %d dropped)\n",
+		verb, result.Key, result.From, result.Entries, result.Added, result.Dropped)
+	return nil
+}
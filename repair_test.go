@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestBucketState(t *testing.T) {
+	st := &bucketState{key: "k1", entries: map[string]journalEntry{}}
+	for _, b := range []journalBatch{
+		{Seq: 1, Op: journalAppend, Entries: []journalEntry{{Key: "k1", Value: []byte("a")}, {Key: "k1", Value: []byte("b")}, {Key: "k2", Value: []byte("c")}}},
+		{Seq: 2, Op: journalRemove, Entries: []journalEntry{{Key: "k1", Value: []byte("a")}}},
+		{Seq: 3, Op: journalAppend, Entries: []journalEntry{{Key: "k2", Value: []byte("d")}}},
+	} {
+		st.apply(b)
+	}
+	if _, ok := st.entries["b"]; !ok || len(st.entries) != 1 || st.last != 3 {
+		t.Fatalf("replayed bucket %v up to %d, want only b up to 3", st.entries, st.last)
+	}
+}
+
+func TestRepairSuite(t *testing.T) {
+	s, _ := newTestServer(t)
+	for _, tt := range []struct {
+		spec repairSpec
+		code string
+	}{
+		{repairSpec{BucketID: "000a1b2c"}, ""},
+		{repairSpec{BucketID: "000a1b2c", From: repairFromSnapshot}, ""},
+		{repairSpec{BucketID: "000a1b2c", From: "backup"}, errInvalidRequest},
+		{repairSpec{BucketID: "ffffffff"}, errInvalidBucketID},
+		{repairSpec{BucketID: "000a1b2c", Version: 9}, errUnsupportedVersion},
+	} {
+		_, verr := s.repairSuite(tt.spec)
+		switch {
+		case verr == nil && tt.code != "":
+			t.Errorf("%+v accepted, want %s", tt.spec, tt.code)
+		case verr != nil && verr.code != tt.code:
+			t.Errorf("%+v rejected with %s, want %q", tt.spec, verr.code, tt.code)
+		}
+	}
+}
+
+func TestHandleRepairBucketMemory(t *testing.T) {
+	_, srv := newTestServer(t)
+	req := adminRequest(t, http.MethodPost, srv.URL+"/api/admin/buckets/repair", strings.NewReader(`{"bucketId": "000a1b2c"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("repair on the memory backend answered %d, want %d", resp.StatusCode, http.StatusNotImplemented)
+	}
+}
+
+// TestRepairBucket corrupts the recorded entries of a bucket and rebuilds it
+// from the journal.
+func TestRepairBucket(t *testing.T) {
+	s, srv := newDBTestServer(t)
+	ctx := context.Background()
+	cs := s.suites[0]
+	username := testName(t) + "@example.com"
+	credentials := []string{username + ":password1", username + ":password2"}
+	if result := s.ingestParallel(ctx, ingestRequest{Credentials: credentials}, 1, nil); result.Successes != 2 {
+		t.Fatalf("ingestion %+v", result)
+	}
+	spec := repairSpec{BucketID: migp.BucketIDToHex(cs.server.BucketID([]byte(username)))}
+	key := cs.bucketKey(spec.BucketID)
+
+	db := s.kv.db()
+	if _, err := db.Exec(`DELETE FROM kv_store_shadow WHERE id = $1`, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO kv_store_shadow (id, value) VALUES ($1, 'stray')`, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE kv_store SET value = 'garbage' WHERE id = $1`, key); err != nil {
+		t.Fatal(err)
+	}
+
+	spec.DryRun = true
+	result, err := s.runRepair(ctx, cs, spec, "")
+	if err != nil || result.Added < 2 || result.Dropped < 1 {
+		t.Fatalf("dry run %+v, %v, want the ingested entries added and the stray one dropped", result, err)
+	}
+	if value, err := s.kv.Get(ctx, key); err != nil || string(value) != "garbage" {
+		t.Fatalf("dry run changed the bucket to %q, %v", value, err)
+	}
+	spec.DryRun = false
+	if _, err := s.runRepair(ctx, cs, spec, ""); err != nil {
+		t.Fatal(err)
+	}
+	var stray int
+	if err := db.QueryRow(`SELECT count(*) FROM kv_store_shadow WHERE id = $1 AND value = 'stray'`, key).Scan(&stray); err != nil || stray != 0 {
+		t.Errorf("repair kept the stray entry: %d, %v", stray, err)
+	}
+	queries, err := prepareQueries(cs.cfg.Config, credentials, 2, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queries {
+		if status, err := queryStatus(http.DefaultClient, srv.URL+"/api/query", q.body, q.ctx, 0); err != nil || status != q.expected {
+			t.Errorf("query after repair: %v, %v, want %v", status, err, q.expected)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// With RESPONSE_SIGNING_KEY set, a hex encoded 32-byte Ed25519 seed, query
+// responses are signed so that clients relaying results to other systems can
+// prove this server produced them. Successful responses of /api/query,
+// /api/query/batch and /api/query/next carry
+//
+//	X-Corpus-Generation: <generation>
+//	X-MIGP-Signature: <base64 signature>
+//
+// where the signature is over
+//
+//	"migp-response-v1\n" 8-byte big-endian corpus generation body
+//
+// and the generation is that of the corpus when the query was answered, 0
+// without a metadata database. /api/config publishes the public key as
+// responseSigningKey.
+
+// responseSignaturePrefix separates response signatures from other uses of
+// the key.
+const responseSignaturePrefix = "migp-response-v1\n"
+
+// responseSigningKey returns the key of RESPONSE_SIGNING_KEY, or nil if it
+// is not set.
+func responseSigningKey() (ed25519.PrivateKey, error) {
+	value := os.Getenv("RESPONSE_SIGNING_KEY")
+	if value == "" {
+		return nil, nil
+	}
+	seed, err := hex.DecodeString(value)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("RESPONSE_SIGNING_KEY must be a hex encoded 32-byte Ed25519 seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// responseSignature returns the signature of body answered at generation.
+func responseSignature(key ed25519.PrivateKey, generation int64, body []byte) []byte {
+	msg := make([]byte, 0, len(responseSignaturePrefix)+8+len(body))
+	msg = append(msg, responseSignaturePrefix...)
+	msg = binary.BigEndian.AppendUint64(msg, uint64(generation))
+	return ed25519.Sign(key, append(msg, body...))
+}
+
+// signedResponse holds a response back until it is signed.
+type signedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *signedResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *signedResponse) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(p)
+}
+
+// withResponseSignature signs the successful responses of h, see above. It
+// must be applied inside withStorage.
+func (s *server) withResponseSignature(h http.HandlerFunc) http.HandlerFunc {
+	if s.responseKey == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		// Answers from the next corpus are not those of any generation.
+		if queriesNextCorpus(req.Context()) {
+			h(w, req)
+			return
+		}
+		var generation int64
+		if !s.detached {
+			var err error
+			if generation, err = s.generation(); err != nil {
+				storageError(w, "reading corpus generation", err)
+				return
+			}
+		}
+		r := &signedResponse{ResponseWriter: w}
+		h(r, req)
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		if r.status == http.StatusOK {
+			w.Header().Set("X-Corpus-Generation", strconv.FormatInt(generation, 10))
+			w.Header().Set("X-MIGP-Signature", base64.StdEncoding.EncodeToString(responseSignature(s.responseKey, generation, r.body.Bytes())))
+		}
+		w.WriteHeader(r.status)
+		if _, err := r.body.WriteTo(w); err != nil {
+			log.Println("Writing response failed:", err)
+		}
+	}
+}
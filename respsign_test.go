@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestResponseSignature(t *testing.T) {
+	t.Setenv("RESPONSE_SIGNING_KEY", strings.Repeat("02", ed25519.SeedSize))
+	s, srv := newTestServer(t)
+
+	resp, err := http.Get(srv.URL + "/api/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg struct {
+		ResponseSigningKey []byte
+	}
+	err = json.NewDecoder(resp.Body).Decode(&cfg)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.ResponseSigningKey) != ed25519.PublicKeySize {
+		t.Fatalf("config has no response signing key: %v", cfg.ResponseSigningKey)
+	}
+
+	client, err := migp.NewClient(s.suites[0].cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _, err := client.Request([]byte("user@example.com"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Post(srv.URL+"/api/query", "application/json", bytes.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("query status %d: %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get("X-Corpus-Generation") != "0" {
+		t.Errorf("X-Corpus-Generation %q, want 0", resp.Header.Get("X-Corpus-Generation"))
+	}
+	signature, err := base64.StdEncoding.DecodeString(resp.Header.Get("X-MIGP-Signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := binary.BigEndian.AppendUint64([]byte(responseSignaturePrefix), 0)
+	if !ed25519.Verify(cfg.ResponseSigningKey, append(msg, body...), signature) {
+		t.Error("response signature does not verify")
+	}
+
+	resp, err = http.Post(srv.URL+"/api/query", "application/json", strings.NewReader(`{"version": 1, "bucketId": "zz"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("X-MIGP-Signature") != "" {
+		t.Errorf("invalid query: status %d, signature %q", resp.StatusCode, resp.Header.Get("X-MIGP-Signature"))
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+	"github.com/lib/pq"
+)
+
+// rebuildBucketQuery recomputes the contents of a bucket ($1) from its
+// recorded entries.
+const rebuildBucketQuery = `
+	UPDATE kv_store SET version = version + 1, value = COALESCE(
+		(SELECT string_agg(value, ''::bytea) FROM kv_store_shadow WHERE id = $1 AND deleted_at IS NULL), ''::bytea)
+	WHERE id = $1`
+
+// rebuildSplitQuery recomputes the sub-buckets of a bucket ($1) from its
+// recorded entries if it has been split. Entries without a username hash
+// cannot be placed in a sub-bucket.
+const rebuildSplitQuery = `
+	INSERT INTO kv_store (id, value)
+	SELECT s.id || '/' || s.bits || '/' || lpad(to_hex(e.bucket_hash >> (32 - s.bits)), 8, '0'), string_agg(e.value, ''::bytea)
+	FROM kv_store_shadow e JOIN bucket_splits s ON s.id = e.id
+	WHERE e.id = $1 AND e.bucket_hash IS NOT NULL AND e.deleted_at IS NULL GROUP BY 1`
+
+// RemoveEntries removes values from the bucket stored under id and from its
+// sub-buckets, returning the number of values that were present.
+func (kv *kvStore) RemoveEntries(ctx context.Context, id string, values [][]byte) (int, error) {
+	defer kv.observe(ctx, "remove", id, time.Now())
+	var removed int
+	err := kv.retry(ctx, "remove", func() error {
+		var err error
+		removed, err = kv.removeEntries(ctx, id, values)
+		return err
+	})
+	return removed, err
+}
+
+// removeEntries performs a single attempt of RemoveEntries. The bucket's row
+// lock is held throughout, so concurrent appends are serialized with it and
+// concurrent splits fail their version check.
+func (kv *kvStore) removeEntries(ctx context.Context, id string, values [][]byte) (int, error) {
+	if kv.buckets != nil {
+		return kv.buckets.RemoveEntries(ctx, id, values)
+	}
+	tx, err := kv.db().BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM kv_store WHERE id = $1 FOR UPDATE`, id); err != nil {
+		return 0, err
+	}
+	if kv.tombstones {
+		n, ok, err := kv.tombstoneEntries(ctx, tx, id, values)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return n, tx.Commit()
+		}
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM kv_store_shadow WHERE id = $1 AND value = ANY($2)`, id, pq.ByteaArray(values))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, rebuildBucketQuery, id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM kv_store WHERE id LIKE $1 || '/%'`, id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, rebuildSplitQuery, id); err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// removeEntries removes entries from the corpus, returning the number that
+// were present.
+func (s *server) removeEntries(ctx context.Context, entries []journalEntry) (int, error) {
+	byKey := map[string][][]byte{}
+	var keys []string
+	for _, e := range entries {
+		if _, ok := byKey[e.Key]; !ok {
+			keys = append(keys, e.Key)
+		}
+		byKey[e.Key] = append(byKey[e.Key], e.Value)
+	}
+	removed := 0
+	for _, key := range keys {
+		n, err := s.kv.RemoveEntries(ctx, key, byKey[key])
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+// bucketEntries splits bucket contents into their encrypted entries. Each
+// entry is a migp.HeaderSize header, ending in the big-endian length of the
+// body that follows it.
+func bucketEntries(contents []byte) ([][]byte, error) {
+	var entries [][]byte
+	for len(contents) > 0 {
+		if len(contents) < migp.HeaderSize {
+			return nil, errors.New("truncated bucket entry header")
+		}
+		n := migp.HeaderSize + int(binary.BigEndian.Uint32(contents[migp.HeaderSize-4:migp.HeaderSize]))
+		if n > len(contents) {
+			return nil, errors.New("truncated bucket entry body")
+		}
+		entries = append(entries, contents[:n])
+		contents = contents[n:]
+	}
+	return entries, nil
+}
+
+// snapshotSource reads files exported by the snapshot command.
+type snapshotSource func(name string) ([]byte, error)
+
+// dirSource reads snapshot files below a local directory.
+func dirSource(dir string) snapshotSource {
+	return func(name string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	}
+}
+
+// httpSource downloads snapshot files below baseURL.
+func httpSource(client *http.Client, baseURL string) snapshotSource {
+	return func(name string) ([]byte, error) {
+		resp, err := client.Get(strings.TrimSuffix(baseURL, "/") + "/" + name)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			io.Copy(io.Discard, resp.Body)
+			return nil, fmt.Errorf("downloading %s: status code %d", name, resp.StatusCode)
+		}
+		return io.ReadAll(resp.Body)
+	}
+}
+
+// loadManifest returns the manifest of the latest snapshot of cs selected by
+// where, a condition on the snapshots table taking args from $2, or nil if
+// there is none.
+func (s *server) loadManifest(ctx context.Context, cs *cryptoSuite, where string, args ...interface{}) (*snapshotManifest, error) {
+	var body []byte
+	query := `SELECT manifest FROM snapshots WHERE version = $1 AND ` + where + ` ORDER BY generation DESC LIMIT 1`
+	err := s.kv.db().QueryRowContext(ctx, query, append([]interface{}{cs.cfg.Version}, args...)...).Scan(&body)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m snapshotManifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// snapshotBuckets returns the contents of the buckets of cs stored under
+// keys in the snapshot described by m, reading only the shards holding them.
+// Shards are verified against the manifest.
+func snapshotBuckets(cs *cryptoSuite, m *snapshotManifest, source snapshotSource, keys []string) (map[string][]byte, error) {
+	wanted := map[uint32]string{}
+	shards := map[uint32]bool{}
+	for _, key := range keys {
+		id, ok := cs.bucketID(key)
+		if !ok {
+			continue
+		}
+		raw, err := hex.DecodeString(id)
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		bucketID := binary.BigEndian.Uint32(raw)
+		wanted[bucketID] = key
+		shards[bucketID>>(m.BucketIDBitSize-m.ShardBits)] = true
+	}
+
+	buckets := map[string][]byte{}
+	for _, shard := range m.Shards {
+		if !shards[shard.Shard] {
+			continue
+		}
+		data, err := source(shard.Path)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(data)
+		if hex.EncodeToString(digest[:]) != shard.SHA256 {
+			return nil, fmt.Errorf("snapshot shard %s does not match its manifest", shard.Path)
+		}
+		r := bytes.NewReader(data)
+		for r.Len() > 0 {
+			var bucketID, size uint32
+			if err := binary.Read(r, binary.BigEndian, &bucketID); err != nil {
+				return nil, err
+			}
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return nil, err
+			}
+			if int(size) > r.Len() {
+				return nil, fmt.Errorf("snapshot shard %s is truncated", shard.Path)
+			}
+			contents := make([]byte, size)
+			r.Read(contents)
+			if key, ok := wanted[bucketID]; ok {
+				buckets[key] = contents
+			}
+		}
+	}
+	return buckets, nil
+}
+
+// scanJournal calls f with every batch of cs following seq after that was
+// created after from and no later than to, in journal order. A zero time
+// bound is unbounded.
+func (s *server) scanJournal(ctx context.Context, cs *cryptoSuite, after int64, from, to time.Time, f func(b journalBatch) error) error {
+	query := `
+	SELECT seq, op, created_at, entries FROM ingest_journal
+	WHERE version = $1 AND seq > $4
+		AND ($2::timestamptz IS NULL OR created_at > $2) AND ($3::timestamptz IS NULL OR created_at <= $3)
+	ORDER BY seq`
+	bound := func(t time.Time) sql.NullTime { return sql.NullTime{Time: t, Valid: !t.IsZero()} }
+	rows, err := s.kv.db().QueryContext(ctx, query, cs.cfg.Version, bound(from), bound(to), after)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		b := journalBatch{Version: cs.cfg.Version}
+		var body []byte
+		if err := rows.Scan(&b.Seq, &b.Op, &b.CreatedAt, &body); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(body, &b.Entries); err != nil {
+			return err
+		}
+		if err := f(b); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// restorePlan lists the changes returning the corpus of a suite to its state
+// at Target. Remove holds the entries appended after Target that were not
+// already present then, and Restore those removed after Target that were.
+type restorePlan struct {
+	Target   time.Time
+	Snapshot int64
+	Undone   []int64
+	Remove   []journalEntry
+	Restore  []journalEntry
+}
+
+// planRestore computes the restorePlan returning the corpus of cs to its
+// state at target. Only buckets changed by journaled batches after target
+// are considered. Their contents at target are the snapshot described by m,
+// if not nil, with the journal replayed on top of it up to target. Without a
+// snapshot the journal alone is used, which only knows about entries
+// ingested since journaling was enabled.
+func (s *server) planRestore(ctx context.Context, cs *cryptoSuite, target time.Time, m *snapshotManifest, source snapshotSource) (*restorePlan, error) {
+	plan := &restorePlan{Target: target}
+	after := map[string]map[string]journalEntry{}
+	err := s.scanJournal(ctx, cs, 0, target, time.Time{}, func(b journalBatch) error {
+		plan.Undone = append(plan.Undone, b.Seq)
+		for _, e := range b.Entries {
+			if after[e.Key] == nil {
+				after[e.Key] = map[string]journalEntry{}
+			}
+			after[e.Key][string(e.Value)] = e
+		}
+		return nil
+	})
+	if err != nil || len(after) == 0 {
+		return plan, err
+	}
+	keys := make([]string, 0, len(after))
+	for key := range after {
+		keys = append(keys, key)
+	}
+
+	// present holds, by bucket key, the values stored at target.
+	present := map[string]map[string]bool{}
+	for _, key := range keys {
+		present[key] = map[string]bool{}
+	}
+	var from time.Time
+	if m != nil {
+		plan.Snapshot = m.Generation
+		buckets, err := snapshotBuckets(cs, m, source, keys)
+		if err != nil {
+			return nil, err
+		}
+		for key, contents := range buckets {
+			entries, err := bucketEntries(contents)
+			if err != nil {
+				return nil, fmt.Errorf("snapshot bucket %s: %w", key, err)
+			}
+			for _, value := range entries {
+				present[key][string(value)] = true
+			}
+		}
+		// Batches created shortly before the snapshot may have been
+		// applied after it was exported.
+		from = m.CreatedAt.Add(-journalReplayAfter())
+	}
+	err = s.scanJournal(ctx, cs, 0, from, target, func(b journalBatch) error {
+		for _, e := range b.Entries {
+			if values, ok := present[e.Key]; ok {
+				values[string(e.Value)] = b.Op != journalRemove
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		for value, e := range after[key] {
+			if present[key][value] {
+				plan.Restore = append(plan.Restore, e)
+			} else {
+				plan.Remove = append(plan.Remove, e)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// applyRestore carries out plan on the corpus of cs. Both changes are
+// journaled like any other batch, so mirrors following the journal see the
+// restore, and the pending batches it undoes are marked skipped so that they
+// are never replayed. Ingestion should be paused while the restore runs.
+func (s *server) applyRestore(ctx context.Context, cs *cryptoSuite, plan *restorePlan) error {
+	if len(plan.Undone) > 0 {
+		query := `UPDATE ingest_journal SET skipped_at = now() WHERE seq = ANY($1) AND applied_at IS NULL`
+		if _, err := s.kv.db().ExecContext(ctx, query, pq.Array(plan.Undone)); err != nil {
+			return err
+		}
+	}
+	for _, change := range []struct {
+		op      string
+		entries []journalEntry
+		apply   func(context.Context, []journalEntry) (int, error)
+	}{
+		{journalRemove, plan.Remove, s.removeEntries},
+		{journalAppend, plan.Restore, s.insert},
+	} {
+		if len(change.entries) == 0 {
+			continue
+		}
+		seq, err := s.journal(ctx, cs, change.op, change.entries)
+		if err != nil {
+			return err
+		}
+		if _, err := change.apply(ctx, change.entries); err != nil {
+			return err
+		}
+		s.journalApplied(ctx, seq)
+	}
+	s.corpusChanged()
+	return nil
+}
+
+// runRestore implements the restore command, which returns the corpus of a
+// suite to its state at a point in time, given either as a timestamp or as
+// a snapshot generation. It is meant for recovering from a bad ingestion:
+// entries appended after the target are removed unless they were already
+// present then. Shards of the base snapshot are downloaded from the
+// manifest's base URL, or read from -snapshots.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	at := fs.String("at", "", "RFC 3339 timestamp to restore the corpus to")
+	generation := fs.Int64("generation", 0, "snapshot generation to restore the corpus to")
+	version := fs.Uint("version", 0, "MIGP version to restore (default the current suite)")
+	snapshots := fs.String("snapshots", "", "read snapshot shards from this directory instead of their base URL")
+	dryRun := fs.Bool("dry-run", false, "report the changes without making them")
+	fs.Parse(args)
+
+	if (*at == "") == (*generation == 0) {
+		return errors.New("exactly one of -at and -generation is required")
+	}
+	configs, err := loadConfigs()
+	if err != nil {
+		return err
+	}
+	s, err := newServer(configs[0], configs[1:]...)
+	if err != nil {
+		return err
+	}
+	cs := s.suites[0]
+	if *version != 0 {
+		if cs = s.suite(uint16(*version)); cs == nil {
+			return fmt.Errorf("MIGP version %d is not configured", *version)
+		}
+	}
+	if err := s.ensureStorage(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var target time.Time
+	var m *snapshotManifest
+	if *generation != 0 {
+		if m, err = s.loadManifest(ctx, cs, "generation = $2", *generation); err != nil {
+			return err
+		}
+		if m == nil {
+			return fmt.Errorf("version %d has no snapshot generation %d", cs.cfg.Version, *generation)
+		}
+		target = m.CreatedAt
+	} else {
+		if target, err = time.Parse(time.RFC3339, *at); err != nil {
+			return fmt.Errorf("parsing -at: %w", err)
+		}
+		if m, err = s.loadManifest(ctx, cs, "created_at <= $2", target); err != nil {
+			return err
+		}
+		if m == nil {
+			fmt.Println("No snapshot precedes the target, restoring from the journal alone")
+		}
+	}
+	source := dirSource(*snapshots)
+	if *snapshots == "" && m != nil {
+		source = httpSource(&http.Client{Timeout: time.Minute}, m.BaseURL)
+	}
+
+	start := time.Now()
+	plan, err := s.planRestore(ctx, cs, target, m, source)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restoring version %d to %s undoes %d journal batches: %d entries to remove, %d to restore\n",
+		cs.cfg.Version, target.Format(time.RFC3339), len(plan.Undone), len(plan.Remove), len(plan.Restore))
+	if *dryRun {
+		return nil
+	}
+	if err := s.applyRestore(ctx, cs, plan); err != nil {
+		return err
+	}
+	s.events.Publish(eventCorpusRestored, "migp/restore", map[string]interface{}{
+		"version":  cs.cfg.Version,
+		"target":   target,
+		"snapshot": plan.Snapshot,
+		"removed":  len(plan.Remove),
+		"restored": len(plan.Restore),
+	})
+	s.events.Wait()
+	fmt.Printf("Restored in %s\n", time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestBucketEntries(t *testing.T) {
+	s, _ := newTestServer(t)
+	var contents []byte
+	var want [][]byte
+	for _, password := range []string{"password1", "a much longer password than the first"} {
+		entry, err := s.suites[0].server.EncryptBucketEntry([]byte("restore@example.com"), []byte(password), migp.MetadataBreachedPassword, []byte("breach"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, entry...)
+		want = append(want, entry)
+	}
+	entries, err := bucketEntries(contents)
+	if err != nil || len(entries) != len(want) {
+		t.Fatalf("%d entries, %v, want %d", len(entries), err, len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(entries[i], want[i]) {
+			t.Errorf("entry %d differs", i)
+		}
+	}
+	for _, truncated := range [][]byte{contents[:migp.HeaderSize-1], contents[:len(contents)-1]} {
+		if _, err := bucketEntries(truncated); err == nil {
+			t.Errorf("truncated contents of %d bytes accepted", len(truncated))
+		}
+	}
+}
+
+func TestSnapshotBuckets(t *testing.T) {
+	s, _ := newTestServer(t)
+	cs := s.suites[0]
+	record := func(id uint32, contents string) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, id)
+		binary.Write(&buf, binary.BigEndian, uint32(len(contents)))
+		buf.WriteString(contents)
+		return buf.Bytes()
+	}
+	a, b := uint32(0x0a1b2), uint32(0x0a1b3)
+	shard := append(record(a, "bucket a"), record(b, "bucket b")...)
+	digest := sha256.Sum256(shard)
+	files := map[string][]byte{"v1/1/0a.bin": shard}
+	source := func(name string) ([]byte, error) {
+		if data, ok := files[name]; ok {
+			return data, nil
+		}
+		return nil, errors.New("not found")
+	}
+	m := &snapshotManifest{
+		Generation:      1,
+		BucketIDBitSize: cs.cfg.BucketIDBitSize,
+		ShardBits:       snapshotShardBits,
+		Shards:          []snapshotShard{{Shard: a >> (cs.cfg.BucketIDBitSize - snapshotShardBits), Path: "v1/1/0a.bin", SHA256: hex.EncodeToString(digest[:])}},
+	}
+
+	keyA := cs.bucketKey(migp.BucketIDToHex(a))
+	other := cs.bucketKey(migp.BucketIDToHex(0xfffff))
+	buckets, err := snapshotBuckets(cs, m, source, []string{keyA, other, "v2/" + migp.BucketIDToHex(b)})
+	if err != nil || len(buckets) != 1 || string(buckets[keyA]) != "bucket a" {
+		t.Fatalf("snapshot buckets %q, %v, want only bucket a", buckets, err)
+	}
+
+	files["v1/1/0a.bin"] = append(shard, 0)
+	if _, err := snapshotBuckets(cs, m, source, []string{keyA}); err == nil {
+		t.Error("shard not matching its manifest accepted")
+	}
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(t.TempDir())))
+	defer srv.Close()
+	if _, err := httpSource(http.DefaultClient, srv.URL+"/")("v1/1/0a.bin"); err == nil {
+		t.Error("missing snapshot file downloaded")
+	}
+}
+
+// TestRestore ingests two credentials around a point in time and restores the
+// corpus to it from the journal.
+func TestRestore(t *testing.T) {
+	s, srv := newDBTestServer(t)
+	ctx := context.Background()
+	cs := s.suites[0]
+	username := testName(t) + "@example.com"
+	ingest := func(password string) {
+		t.Helper()
+		if result := s.ingestParallel(ctx, ingestRequest{Credentials: []string{username + ":" + password}}, 1, nil); result.Successes != 1 {
+			t.Fatalf("ingestion %+v", result)
+		}
+	}
+	ingest("kept-password")
+	var target time.Time
+	if err := s.kv.db().QueryRow(`SELECT now()`).Scan(&target); err != nil {
+		t.Fatal(err)
+	}
+	ingest("bad-password")
+
+	plan, err := s.planRestore(ctx, cs, target, nil, nil)
+	if err != nil || len(plan.Undone) == 0 || len(plan.Remove) == 0 {
+		t.Fatalf("restore plan %+v, %v", plan, err)
+	}
+	if err := s.applyRestore(ctx, cs, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := migp.NewClient(cs.cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		password string
+		want     migp.BreachStatus
+	}{
+		{"kept-password", migp.InBreach},
+		{"bad-password", migp.NotInBreach},
+	} {
+		request, qctx, err := client.Request([]byte(username), []byte(tt.password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(request)
+		if status, err := queryStatus(http.DefaultClient, srv.URL+"/api/query", body, qctx, 0); err != nil || status != tt.want {
+			t.Errorf("%s after the restore: %v, %v, want %v", tt.password, status, err, tt.want)
+		}
+	}
+}
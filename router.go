@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// invocationFunc handles one custom handler invocation, recording output
+// bindings, logs and the return value in resp.
+type invocationFunc func(ctx context.Context, inv *invocationRequest, resp *invocationResponse) error
+
+// invocationRouter dispatches custom handler invocations to the function
+// registered under the name in the request path, which the Functions host
+// sets to the function's folder name.
+type invocationRouter struct {
+	functions map[string]invocationFunc
+}
+
+// newInvocationRouter returns an invocationRouter with no functions.
+func newInvocationRouter() *invocationRouter {
+	return &invocationRouter{functions: make(map[string]invocationFunc)}
+}
+
+// Handle registers f as the handler for the function called name.
+func (r *invocationRouter) Handle(name string, f invocationFunc) {
+	r.functions[name] = f
+}
+
+// ServeHTTP decodes an invocation envelope and runs the matching function. A
+// failed invocation is reported with a 500 so that the host retries it.
+func (r *invocationRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	f, ok := r.functions[name]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	inv, err := decodeInvocation(req.Body)
+	if err != nil {
+		log.Println("Invocation unmarshal failed:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	resp := newInvocationResponse()
+	if err := f(req.Context(), inv, resp); err != nil {
+		log.Printf("Invocation of %s failed: %v", name, err)
+		resp.Log(err.Error())
+		writeJSON(w, http.StatusInternalServerError, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// invokeQueueIngest ingests a batch of credentials, passwords or encrypted
+// entries delivered by the QueueIngest queue trigger, as a job reported by
+// job events like the admin ones. Re-ingesting a credential is a no-op, so
+// a batch with storage failures is failed as a whole and left for the host
+// to retry, as is every batch while the corpus is read-only.
+func (s *server) invokeQueueIngest(ctx context.Context, inv *invocationRequest, resp *invocationResponse) error {
+	if s.readOnly() {
+		return errCorpusReadOnly
+	}
+	item, err := inv.bindingString("item")
+	if err != nil {
+		return err
+	}
+	if ereq, ok, err := decodeEncryptedIngestRequest([]byte(item)); ok {
+		if err != nil {
+			return err
+		}
+		return s.runQueueIngest(resp, "ingest_encrypted", "migp/ingest/encrypted", "encrypted entries", func(func(int)) ingestResult {
+			return s.ingestEncrypted(ctx, ereq)
+		})
+	}
+	if preq, ok, err := decodePasswordIngestRequest([]byte(item)); ok {
+		if err != nil {
+			return err
+		}
+		return s.runQueueIngest(resp, "ingest_passwords", "migp/ingest/passwords", "passwords", func(func(int)) ingestResult {
+			return s.ingestPasswords(ctx, preq)
+		})
+	}
+	req, err := decodeIngestRequest([]byte(item))
+	if err != nil {
+		return err
+	}
+	return s.runQueueIngest(resp, "ingest", "migp/ingest", "credentials", func(progress func(int)) ingestResult {
+		return s.ingestParallel(ctx, req, 1, func(done int) {
+			progress(done * 100 / len(req.Credentials))
+		})
+	})
+}
+
+// runQueueIngest runs ingest as a job of type kind, passing it a function
+// to report its progress in percent with, and publishes its result under
+// subject once it succeeds.
+func (s *server) runQueueIngest(resp *invocationResponse, kind, subject, what string, ingest func(progress func(int)) ingestResult) error {
+	jobID, err := randomID()
+	if err != nil {
+		return err
+	}
+	jobSubject := "migp/jobs/" + jobID
+	s.events.Publish(eventJobStarted, jobSubject, map[string]interface{}{"jobId": jobID, "type": kind})
+
+	result := ingest(s.jobProgress(jobID))
+	resp.Log(fmt.Sprintf("Ingested %d %s (%d new entries), %d failures, %d malformed",
+		result.Successes, what, result.Entries, result.Failures, result.Malformed))
+	if result.Failures > 0 {
+		err := fmt.Errorf("%d %s failed to ingest", result.Failures, what)
+		s.events.Publish(eventJobFailed, jobSubject, map[string]interface{}{"jobId": jobID, "error": err.Error(), "result": result})
+		return err
+	}
+	s.events.Publish(eventJobCompleted, jobSubject, map[string]interface{}{"jobId": jobID, "result": result})
+	s.events.Publish(eventIngestionCompleted, subject, result)
+	return nil
+}
+
+// timerInfo is the envelope representation of a timer trigger input.
+type timerInfo struct {
+	IsPastDue bool `json:"IsPastDue"`
+}
+
+// invokeTimerMaintenance runs the scheduled storage maintenance tasks.
+func (s *server) invokeTimerMaintenance(ctx context.Context, inv *invocationRequest, resp *invocationResponse) error {
+	var timer timerInfo
+	if raw, ok := inv.Data["timer"]; ok {
+		if err := json.Unmarshal(raw, &timer); err != nil {
+			return err
+		}
+	}
+	if timer.IsPastDue {
+		resp.Log("Maintenance timer is running late")
+	}
+	ran, err := s.runScheduledJob(yieldingMaintenance(ctx), "maintenance", s.maintain)
+	if err == nil && !ran {
+		resp.Log("Maintenance is already running on another instance")
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// invoke posts an invocation envelope with data to function on h.
+func invoke(t *testing.T, h http.Handler, function, data string) (int, invocationResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/"+function, strings.NewReader(`{"Data": `+data+`, "Metadata": {}}`)))
+	var resp invocationResponse
+	if rec.Code != http.StatusBadRequest && rec.Code != http.StatusNotFound {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s response %q: %v", function, rec.Body, err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestInvocationRouter(t *testing.T) {
+	r := newInvocationRouter()
+	r.Handle("Ok", func(ctx context.Context, inv *invocationRequest, resp *invocationResponse) error {
+		resp.Outputs["out"] = "done"
+		resp.Log("ran")
+		return nil
+	})
+	r.Handle("Fail", func(ctx context.Context, inv *invocationRequest, resp *invocationResponse) error {
+		return errors.New("broken")
+	})
+
+	if status, resp := invoke(t, r, "Ok", `{}`); status != http.StatusOK || resp.Outputs["out"] != "done" || len(resp.Logs) != 1 {
+		t.Errorf("Ok answered %d with %+v", status, resp)
+	}
+	if status, resp := invoke(t, r, "Fail", `{}`); status != http.StatusInternalServerError || len(resp.Logs) != 1 || resp.Logs[0] != "broken" {
+		t.Errorf("Fail answered %d with %+v, want a 500 logging the error", status, resp)
+	}
+	if status, _ := invoke(t, r, "Missing", `{}`); status != http.StatusNotFound {
+		t.Errorf("unknown function answered %d", status)
+	}
+	if status, _ := invoke(t, r, "Ok", `null`); status != http.StatusBadRequest {
+		t.Errorf("envelope without Data answered %d", status)
+	}
+}
+
+func TestFunctionInvocations(t *testing.T) {
+	t.Setenv("FUNCTIONS_CUSTOMHANDLER_PORT", "7071")
+	s, _ := newTestServer(t)
+	h := s.handler()
+
+	item, _ := json.Marshal(`{"credentials": ["router@example.com:password1"]}`)
+	status, resp := invoke(t, h, "QueueIngest", `{"item": `+string(item)+`}`)
+	if status != http.StatusOK || len(resp.Logs) != 1 || !strings.HasPrefix(resp.Logs[0], "Ingested 1 credentials") {
+		t.Errorf("QueueIngest answered %d with %+v", status, resp)
+	}
+	if status, _ := invoke(t, h, "QueueIngest", `{"item": "not json"}`); status != http.StatusInternalServerError {
+		t.Errorf("malformed queue item answered %d, want a 500 so that the host retries", status)
+	}
+
+	status, resp = invoke(t, h, "HttpConfig", `{"req": {"Url": "http://localhost/api/config", "Method": "GET"}}`)
+	out, _ := resp.Outputs["res"].(map[string]interface{})
+	if status != http.StatusOK || out["statusCode"] != "200" {
+		t.Errorf("HttpConfig answered %d with %+v", status, resp)
+	}
+}
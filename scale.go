@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// GET /api/scale reports the backpressure of this instance for scaling
+// controllers, so that scale-out follows queries waiting for evaluation and
+// database connections rather than raw HTTP concurrency. It takes an admin
+// credential, like /api/metrics. With KEDA, a metrics-api trigger reading
+// load with metricType Value holds the average load of the instances at its
+// target, since each instance reports its own figures:
+//
+//	{"load": 0.75, "pendingRequests": 24, "inflight": 16, "queued": 8,
+//	 "concurrency": 32, "queueSize": 128, "dbPoolInUse": 12,
+//	 "dbPoolMaxOpen": 20, "dbPoolSaturation": 0.6, "queriesPerSecond": 310.5}
+//
+// Load is the larger of the pending requests per evaluation slot and the
+// saturation of the database pool, so 1 means the instance is at capacity.
+
+// scaleReport is the body of an /api/scale response.
+type scaleReport struct {
+	Load             float64 `json:"load"`
+	PendingRequests  int     `json:"pendingRequests"`
+	Inflight         int     `json:"inflight"`
+	Queued           int     `json:"queued"`
+	Concurrency      int     `json:"concurrency,omitempty"`
+	QueueSize        int     `json:"queueSize,omitempty"`
+	DBPoolInUse      int     `json:"dbPoolInUse"`
+	DBPoolMaxOpen    int     `json:"dbPoolMaxOpen,omitempty"`
+	DBPoolSaturation float64 `json:"dbPoolSaturation"`
+	QueriesPerSecond float64 `json:"queriesPerSecond"`
+}
+
+// scaleReport returns the backpressure of the instance.
+func (s *server) scaleReport() scaleReport {
+	var r scaleReport
+	if l := s.limiter; l != nil {
+		r.Inflight, r.Queued = len(l.slots), len(l.queue)
+		r.Concurrency, r.QueueSize = cap(l.slots), cap(l.queue)
+		r.Load = float64(r.Inflight+r.Queued) / float64(r.Concurrency)
+	}
+	r.PendingRequests = r.Inflight + r.Queued
+	if s.storageReady.Load() && !s.detached {
+		stats := s.kv.cluster.DB().Stats()
+		r.DBPoolInUse, r.DBPoolMaxOpen = stats.InUse, stats.MaxOpenConnections
+		if stats.MaxOpenConnections > 0 {
+			r.DBPoolSaturation = float64(stats.InUse) / float64(stats.MaxOpenConnections)
+		}
+	}
+	r.Load = max(r.Load, r.DBPoolSaturation)
+	r.QueriesPerSecond = queryRate.rate(time.Now(), 10*time.Second)
+	return r
+}
+
+// handleScale serves the scale report, see above.
+func (s *server) handleScale(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, s.scaleReport())
+}
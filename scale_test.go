@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestScaleReport(t *testing.T) {
+	t.Setenv("QUERY_MAX_CONCURRENCY", "4")
+	s, srv := newTestServer(t)
+	s.limiter.slots <- struct{}{}
+	s.limiter.slots <- struct{}{}
+	s.limiter.queue <- struct{}{}
+
+	resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodGet, srv.URL+"/api/scale", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r scaleReport
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.PendingRequests != 3 || r.Concurrency != 4 || r.Load != 0.75 {
+		t.Fatalf("report %+v, want 3 pending of 4 slots", r)
+	}
+
+	resp, err = http.Get(srv.URL + "/api/scale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
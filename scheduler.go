@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maintenance yields to queries. Scheduled maintenance, the daily timer and
+// the in-process schedule below, only works while this instance evaluates
+// fewer than MAINTENANCE_MAX_QPS queries per second over the last
+// MAINTENANCE_LOAD_WINDOW (default 1m), and, if MAINTENANCE_WINDOW is set as
+// "HH:MM-HH:MM" in UTC, within that window. Compaction, scrubbing and
+// expiry sweeps check between buckets, partitions and batches, and pause
+// while the load is above the threshold or the window has closed, resuming
+// where they stopped. Maintenance started from the admin API does not yield.
+//
+// With MAINTENANCE_INTERVAL set, the server also runs maintenance itself at
+// that interval whenever the load allows, so that deployments without the
+// timer trigger still compact. Only one instance runs it at a time, see
+// joblocks.go.
+
+var maintenancePaused = newGauge("migp_maintenance_paused", "Whether scheduled maintenance is paused for load.")
+
+// queryRate counts the queries submitted for evaluation.
+var queryRate = newRateMeter(time.Minute)
+
+// rateMeter counts events per second over a sliding window.
+type rateMeter struct {
+	mu     sync.Mutex
+	counts []int
+	start  int64 // Unix second counted by counts[0]
+}
+
+// newRateMeter returns a meter covering the given window.
+func newRateMeter(window time.Duration) *rateMeter {
+	return &rateMeter{counts: make([]int, int(window/time.Second)+1)}
+}
+
+// mark counts an event at now.
+func (m *rateMeter) mark(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now.Unix())
+	m.counts[len(m.counts)-1]++
+}
+
+// rate returns the events per second over the window seconds before now.
+func (m *rateMeter) rate(now time.Time, window time.Duration) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now.Unix())
+	seconds := int(window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	if seconds > len(m.counts)-1 {
+		seconds = len(m.counts) - 1
+	}
+	// The current second is still filling up, so it is left out.
+	var total int
+	for _, n := range m.counts[len(m.counts)-1-seconds : len(m.counts)-1] {
+		total += n
+	}
+	return float64(total) / float64(seconds)
+}
+
+// advance shifts the counts so that the last one counts the second now.
+func (m *rateMeter) advance(now int64) {
+	last := m.start + int64(len(m.counts)) - 1
+	if now <= last {
+		return
+	}
+	shift := int(now - last)
+	if shift >= len(m.counts) {
+		clear(m.counts)
+	} else {
+		copy(m.counts, m.counts[shift:])
+		clear(m.counts[len(m.counts)-shift:])
+	}
+	m.start = now - int64(len(m.counts)) + 1
+}
+
+// maintenanceWindow is a daily time range in UTC, which may wrap around
+// midnight.
+type maintenanceWindow struct {
+	start, end time.Duration // since midnight
+}
+
+// parseMaintenanceWindow parses a window written "HH:MM-HH:MM".
+func parseMaintenanceWindow(s string) (maintenanceWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return maintenanceWindow{}, fmt.Errorf("maintenance window %q is not HH:MM-HH:MM", s)
+	}
+	var w maintenanceWindow
+	for _, part := range []struct {
+		text string
+		into *time.Duration
+	}{{from, &w.start}, {to, &w.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(part.text))
+		if err != nil {
+			return maintenanceWindow{}, fmt.Errorf("maintenance window %q is not HH:MM-HH:MM", s)
+		}
+		*part.into = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return w, nil
+}
+
+// contains reports whether t falls within the window.
+func (w maintenanceWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.start <= w.end {
+		return d >= w.start && d < w.end
+	}
+	return d >= w.start || d < w.end
+}
+
+// maintenanceLoad holds the conditions under which scheduled maintenance
+// runs.
+type maintenanceLoad struct {
+	maxQPS     int
+	loadWindow time.Duration
+	window     *maintenanceWindow
+	poll       time.Duration
+}
+
+// maintenanceConditions reads the maintenance conditions from the
+// environment once. A malformed MAINTENANCE_WINDOW is logged and ignored.
+var maintenanceConditions = sync.OnceValue(func() maintenanceLoad {
+	l := maintenanceLoad{
+		maxQPS:     envInt("MAINTENANCE_MAX_QPS", 0),
+		loadWindow: envDuration("MAINTENANCE_LOAD_WINDOW", time.Minute),
+		poll:       envDuration("MAINTENANCE_PAUSE_POLL", 10*time.Second),
+	}
+	if v := os.Getenv("MAINTENANCE_WINDOW"); v != "" {
+		w, err := parseMaintenanceWindow(v)
+		if err != nil {
+			log.Println(err)
+		} else {
+			l.window = &w
+		}
+	}
+	return l
+})
+
+// allows reports whether maintenance may run at now given the query rate
+// qps, and if not, why.
+func (l maintenanceLoad) allows(now time.Time, qps float64) (bool, string) {
+	if l.window != nil && !l.window.contains(now) {
+		return false, "outside the maintenance window"
+	}
+	if l.maxQPS > 0 && qps >= float64(l.maxQPS) {
+		return false, fmt.Sprintf("at %.1f queries per second", qps)
+	}
+	return true, ""
+}
+
+// scheduledMaintenance marks the context of maintenance that yields to
+// queries.
+type scheduledMaintenance struct{}
+
+// yieldingMaintenance returns ctx for maintenance that pauses under load.
+func yieldingMaintenance(ctx context.Context) context.Context {
+	return context.WithValue(ctx, scheduledMaintenance{}, true)
+}
+
+// maintenancePause returns once scheduled maintenance may go on, or with the
+// error of ctx. It returns at once for maintenance started from the admin
+// API.
+func maintenancePause(ctx context.Context) error {
+	if ctx.Value(scheduledMaintenance{}) == nil {
+		return nil
+	}
+	l := maintenanceConditions()
+	var logged bool
+	for {
+		ok, reason := l.allows(time.Now(), queryRate.rate(time.Now(), l.loadWindow))
+		if ok {
+			if logged {
+				log.Println("Maintenance resumed")
+			}
+			maintenancePaused.Set(0)
+			return nil
+		}
+		if !logged {
+			log.Printf("Maintenance paused %s", reason)
+			logged = true
+		}
+		maintenancePaused.Set(1)
+		select {
+		case <-time.After(l.poll):
+		case <-ctx.Done():
+			maintenancePaused.Set(0)
+			return ctx.Err()
+		}
+	}
+}
+
+// runMaintenanceSchedule runs maintenance every MAINTENANCE_INTERVAL until
+// ctx is done, skipping a round while the load does not allow it or another
+// instance is running maintenance. It returns at once if the interval is
+// not set.
+func (s *server) runMaintenanceSchedule(ctx context.Context) {
+	interval := envDuration("MAINTENANCE_INTERVAL", 0)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		l := maintenanceConditions()
+		if ok, _ := l.allows(time.Now(), queryRate.rate(time.Now(), l.loadWindow)); !ok {
+			continue
+		}
+		if err := s.ensureStorage(); err != nil {
+			log.Println("Scheduled maintenance skipped:", err)
+			continue
+		}
+		start := time.Now()
+		ran, err := s.runScheduledJob(yieldingMaintenance(ctx), "maintenance", s.maintain)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Println("Scheduled maintenance failed:", err)
+		case ran && err == nil:
+			log.Printf("Scheduled maintenance completed in %s", time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		window string
+		at     time.Duration
+		want   bool
+	}{
+		{"01:00-05:00", 3 * time.Hour, true},
+		{"01:00-05:00", 5 * time.Hour, false},
+		{"01:00-05:00", 30 * time.Minute, false},
+		{"22:30-02:00", 23 * time.Hour, true},
+		{"22:30-02:00", time.Hour, true},
+		{"22:30-02:00", 12 * time.Hour, false},
+	}
+	for _, tt := range tests {
+		w, err := parseMaintenanceWindow(tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.contains(day.Add(tt.at)); got != tt.want {
+			t.Errorf("%s contains %s = %v, want %v", tt.window, tt.at, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "01:00", "1-5", "25:00-01:00"} {
+		if _, err := parseMaintenanceWindow(bad); err == nil {
+			t.Errorf("parseMaintenanceWindow(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	m := newRateMeter(10 * time.Second)
+	start := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 5; j++ {
+			m.mark(start.Add(time.Duration(i) * time.Second))
+		}
+	}
+	if got := m.rate(start.Add(10*time.Second), 10*time.Second); got != 5 {
+		t.Fatalf("rate %v, want 5", got)
+	}
+	if got := m.rate(start.Add(15*time.Second), 10*time.Second); got != 2.5 {
+		t.Fatalf("rate after 5s idle %v, want 2.5", got)
+	}
+	if got := m.rate(start.Add(time.Minute), 10*time.Second); got != 0 {
+		t.Fatalf("rate after a minute idle %v, want 0", got)
+	}
+}
+
+func TestMaintenanceLoad(t *testing.T) {
+	w, err := parseMaintenanceWindow("01:00-05:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := maintenanceLoad{maxQPS: 10, window: &w}
+	inside := time.Date(2024, 5, 1, 2, 0, 0, 0, time.UTC)
+	if ok, _ := l.allows(inside, 3); !ok {
+		t.Error("maintenance not allowed inside the window under the threshold")
+	}
+	if ok, _ := l.allows(inside, 10); ok {
+		t.Error("maintenance allowed at the threshold")
+	}
+	if ok, _ := l.allows(inside.Add(6*time.Hour), 0); ok {
+		t.Error("maintenance allowed outside the window")
+	}
+	if ok, _ := (maintenanceLoad{}).allows(inside, 1e6); !ok {
+		t.Error("maintenance not allowed without conditions")
+	}
+	// Maintenance started from the admin API never pauses.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := maintenancePause(ctx); err != nil {
+		t.Errorf("unscheduled maintenance paused: %v", err)
+	}
+}
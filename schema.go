@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// schemaVersion identifies the revision of schemaDDL. Bump it whenever
+// schemaDDL changes so that running instances apply the new statements.
+const schemaVersion = 22
+
+// schemaLockID is the advisory lock key serializing schema changes across
+// instances.
+const schemaLockID = 0x6d696770
+
+// schemaDDL creates every table used by the server. All statements are
+// idempotent.
+const schemaDDL = `
+	CREATE TABLE IF NOT EXISTS kv_store (
+		id TEXT NOT NULL,
+		value BYTEA,
+		PRIMARY KEY (id)
+	) PARTITION BY HASH (id);
+
+	CREATE TABLE IF NOT EXISTS kv_store_p0 PARTITION OF kv_store FOR VALUES WITH (MODULUS 4, REMAINDER 0);
+	CREATE TABLE IF NOT EXISTS kv_store_p1 PARTITION OF kv_store FOR VALUES WITH (MODULUS 4, REMAINDER 1);
+	CREATE TABLE IF NOT EXISTS kv_store_p2 PARTITION OF kv_store FOR VALUES WITH (MODULUS 4, REMAINDER 2);
+	CREATE TABLE IF NOT EXISTS kv_store_p3 PARTITION OF kv_store FOR VALUES WITH (MODULUS 4, REMAINDER 3);
+
+	CREATE TABLE IF NOT EXISTS kv_store_shadow (
+		id TEXT,
+		value BYTEA,
+		PRIMARY KEY (id, value)
+	);
+	CREATE INDEX IF NOT EXISTS kv_store_shadow_values ON kv_store_shadow (value);
+	ALTER TABLE kv_store_shadow ADD COLUMN IF NOT EXISTS bucket_hash BIGINT;
+	ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+	ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS checksum BYTEA;
+
+	CREATE TABLE IF NOT EXISTS bucket_splits (
+		id TEXT PRIMARY KEY,
+		bits INT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id BIGSERIAL PRIMARY KEY,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE IF NOT EXISTS migp_key (
+		id INT PRIMARY KEY,
+		fingerprint TEXT NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE IF NOT EXISTS snapshots (
+		generation BIGSERIAL PRIMARY KEY,
+		version INT NOT NULL,
+		manifest BYTEA NOT NULL,
+		signature BYTEA NOT NULL,
+		public_key BYTEA NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS snapshots_version ON snapshots (version, generation);
+
+	CREATE TABLE IF NOT EXISTS corpus_generation (
+		id INT PRIMARY KEY CHECK (id = 1),
+		generation BIGINT NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE IF NOT EXISTS feature_flags (
+		name TEXT NOT NULL,
+		tenant TEXT NOT NULL DEFAULT '',
+		enabled BOOLEAN NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (name, tenant)
+	);
+
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		request_hash BYTEA NOT NULL,
+		status INT,
+		content_type TEXT,
+		body BYTEA,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (scope, key)
+	);
+	CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at ON idempotency_keys (expires_at);
+
+	CREATE TABLE IF NOT EXISTS ingest_journal (
+		seq BIGSERIAL PRIMARY KEY,
+		version INT NOT NULL,
+		entries BYTEA NOT NULL,
+		entry_count INT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		applied_at TIMESTAMPTZ
+	);
+	ALTER TABLE ingest_journal ADD COLUMN IF NOT EXISTS op TEXT NOT NULL DEFAULT 'append';
+	CREATE INDEX IF NOT EXISTS ingest_journal_created_at ON ingest_journal (version, created_at);
+
+	CREATE TABLE IF NOT EXISTS backups (
+		id BIGSERIAL PRIMARY KEY,
+		corpus_generation BIGINT NOT NULL,
+		journal_seq BIGINT NOT NULL,
+		snapshots JSONB NOT NULL,
+		started_at TIMESTAMPTZ NOT NULL,
+		completed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE IF NOT EXISTS corpus_stats (
+		id BIGSERIAL PRIMARY KEY,
+		version INT NOT NULL,
+		computed_at TIMESTAMPTZ NOT NULL,
+		stats JSONB NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS corpus_stats_version ON corpus_stats (version, computed_at);
+
+	CREATE TABLE IF NOT EXISTS honeytokens (
+		id BIGSERIAL PRIMARY KEY,
+		version INT NOT NULL,
+		label TEXT NOT NULL DEFAULT '',
+		bucket_hash BIGINT NOT NULL,
+		entries BYTEA[] NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE IF NOT EXISTS usage_analytics (
+		id BIGSERIAL PRIMARY KEY,
+		version INT NOT NULL,
+		window_start TIMESTAMPTZ NOT NULL,
+		window_end TIMESTAMPTZ NOT NULL,
+		aggregates JSONB NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS usage_analytics_window ON usage_analytics (window_start);
+
+	CREATE TABLE IF NOT EXISTS outcome_analytics (
+		id BIGSERIAL PRIMARY KEY,
+		day DATE NOT NULL,
+		tenant TEXT NOT NULL DEFAULT '',
+		compromised DOUBLE PRECISION NOT NULL,
+		similar DOUBLE PRECISION NOT NULL,
+		not_found DOUBLE PRECISION NOT NULL,
+		epsilon DOUBLE PRECISION NOT NULL,
+		recorded_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS outcome_analytics_day ON outcome_analytics (day);
+
+	CREATE TABLE IF NOT EXISTS bucket_overflow (
+		id TEXT NOT NULL,
+		value BYTEA NOT NULL,
+		bucket_hash BIGINT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (id, value)
+	);
+
+	CREATE TABLE IF NOT EXISTS password_hashes (
+		prefix TEXT NOT NULL,
+		suffix TEXT NOT NULL,
+		count BIGINT NOT NULL,
+		PRIMARY KEY (prefix, suffix)
+	);
+
+	CREATE TABLE IF NOT EXISTS sources (
+		id TEXT PRIMARY KEY,
+		description TEXT NOT NULL DEFAULT '',
+		enabled BOOLEAN NOT NULL DEFAULT true,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	ALTER TABLE ingest_journal ADD COLUMN IF NOT EXISTS source TEXT;
+	CREATE INDEX IF NOT EXISTS ingest_journal_source ON ingest_journal (source, seq) WHERE source IS NOT NULL;
+	ALTER TABLE ingest_journal ADD COLUMN IF NOT EXISTS skipped_at TIMESTAMPTZ;
+	DROP INDEX IF EXISTS ingest_journal_pending;
+	CREATE INDEX IF NOT EXISTS ingest_journal_unsettled ON ingest_journal (seq) WHERE applied_at IS NULL AND skipped_at IS NULL;
+
+	ALTER TABLE kv_store_shadow ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+	ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS tombstones INT NOT NULL DEFAULT 0;
+	CREATE INDEX IF NOT EXISTS kv_store_tombstoned ON kv_store (id) WHERE tombstones > 0;
+
+	ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+	ALTER TABLE kv_store ALTER COLUMN updated_at SET DEFAULT now();
+	CREATE OR REPLACE FUNCTION kv_store_touch() RETURNS trigger AS $$
+	BEGIN
+		IF NEW.version IS DISTINCT FROM OLD.version THEN
+			NEW.updated_at := now();
+		END IF;
+		RETURN NEW;
+	END $$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS kv_store_touch ON kv_store;
+	CREATE TRIGGER kv_store_touch BEFORE UPDATE ON kv_store FOR EACH ROW EXECUTE FUNCTION kv_store_touch();
+
+	ALTER TABLE kv_store ALTER COLUMN checksum DROP EXPRESSION IF EXISTS;
+	CREATE OR REPLACE FUNCTION kv_store_checksum() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'INSERT' OR NEW.value IS DISTINCT FROM OLD.value THEN
+			NEW.checksum := sha256(NEW.value);
+		END IF;
+		RETURN NEW;
+	END $$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS kv_store_checksum ON kv_store;
+	CREATE TRIGGER kv_store_checksum BEFORE INSERT OR UPDATE ON kv_store FOR EACH ROW EXECUTE FUNCTION kv_store_checksum();
+
+	CREATE TABLE IF NOT EXISTS migp_schema (
+		id INT PRIMARY KEY CHECK (id = 1),
+		version INT NOT NULL
+	);
+`
+
+// manageSchema reports whether the server applies its own schema. Setting
+// DB_MANAGE_SCHEMA=false runs the server without any DDL, on tables created
+// ahead of time from schemaSQL. Its role then needs SELECT, INSERT, UPDATE and
+// DELETE on the tables, which buckets, jobs and retention rewrite and prune,
+// and USAGE on their sequences, which the BIGSERIAL columns draw ids from:
+//
+//	GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO migp;
+//	GRANT USAGE ON ALL SEQUENCES IN SCHEMA public TO migp;
+func manageSchema() bool {
+	return envBool("DB_MANAGE_SCHEMA", true)
+}
+
+// schemaSQL returns a script that creates the current schema and records its
+// version, for DBAs provisioning a database used with DB_MANAGE_SCHEMA=false.
+// The script ends with the grants the server needs, see manageSchema.
+func schemaSQL() string {
+	return fmt.Sprintf(`BEGIN;
+%s
+	INSERT INTO migp_schema (id, version) VALUES (1, %d)
+	ON CONFLICT (id) DO UPDATE SET version = GREATEST(migp_schema.version, %d);
+COMMIT;
+
+-- Grants for the role the server connects as, here migp:
+-- GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO migp;
+-- GRANT USAGE ON ALL SEQUENCES IN SCHEMA public TO migp;
+`, schemaDDL, schemaVersion, schemaVersion)
+}
+
+// ensureSchema applies schemaDDL unless the database already records
+// schemaVersion or later, reporting whether any DDL was issued.
+func ensureSchema(db *sql.DB) (bool, error) {
+	current, err := storedSchemaVersion(db)
+	if err != nil {
+		return false, err
+	}
+	if current >= schemaVersion {
+		return false, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, schemaLockID); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(schemaDDL); err != nil {
+		return false, err
+	}
+	query := `
+	INSERT INTO migp_schema (id, version) VALUES (1, $1)
+	ON CONFLICT (id) DO UPDATE SET version = GREATEST(migp_schema.version, $1)`
+	if _, err := tx.Exec(query, schemaVersion); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// storedSchemaVersion returns the schema version recorded in the database, or
+// zero if the schema has never been applied.
+func storedSchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT version FROM migp_schema WHERE id = 1`).Scan(&version)
+	var pqErr *pq.Error
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case errors.As(err, &pqErr) && pqErr.Code == "42P01": // undefined_table
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+	return version, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSchemaSQL(t *testing.T) {
+	script := schemaSQL()
+	for _, want := range []string{
+		"CREATE TABLE IF NOT EXISTS kv_store",
+		fmt.Sprintf("VALUES (1, %d)", schemaVersion),
+		"GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES",
+		"GRANT USAGE ON ALL SEQUENCES",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("schema script lacks %q", want)
+		}
+	}
+}
+
+func TestEnsureSchemaSkipsCurrentSchema(t *testing.T) {
+	s, _ := newDBTestServer(t)
+	db := s.kv.db()
+	if version, err := storedSchemaVersion(db); err != nil || version < schemaVersion {
+		t.Fatalf("stored schema version %d, %v after initialization, want %d", version, err, schemaVersion)
+	}
+	if applied, err := ensureSchema(db); err != nil || applied {
+		t.Fatalf("ensureSchema on a current schema applied it: %v, %v", applied, err)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Secrets, such as the database connection strings in DB_CONNECTION_ST and
+// the MIGP keys in CONFIG_JSON, are configured like any other variable, or
+// by reference to a secret held elsewhere, resolved once at startup:
+//
+//	file:/run/secrets/migp-config                    a mounted file
+//	env:OTHER_VARIABLE                               another variable
+//	keyvault://my-vault/db-connection[/version]      an Azure Key Vault secret
+//	@Microsoft.KeyVault(SecretUri=https://...)       the same, as App Service writes it
+//	vault://secret/data/migp#db                      a HashiCorp Vault secret field
+//
+// The secret variables below, and the replica connection strings, may also
+// be read from the file named by the variable with a _FILE suffix, such as
+// DB_CONNECTION_ST_FILE, as Docker and Kubernetes mount them.
+//
+// Key Vault is reached with the managed identity of the instance, through
+// IDENTITY_ENDPOINT on App Service and Functions or the instance metadata
+// service elsewhere, and AZURE_CLIENT_ID selects a user-assigned identity.
+// HashiCorp Vault is reached at VAULT_ADDR with the token in VAULT_TOKEN,
+// which may itself be a file: reference, and in the VAULT_NAMESPACE
+// namespace. Its KV version 2 secrets are read below data/ of the mount.
+
+// secretVariables lists the variables holding secrets, which may be read
+// from a _FILE variable.
+var secretVariables = []string{
+	"DB_CONNECTION_ST", "CANARY_DB_CONNECTION_ST", "CONFIG_JSON", "PASSWORD_CONFIG_JSON",
+	"ADMIN_API_KEY", "SNAPSHOT_SIGNING_KEY", "EVENT_GRID_TOPIC_KEY", "CONSUL_HTTP_TOKEN",
+	"TABLE_CONNECTION_ST", "VAULT_TOKEN", "API_KEYS", "JWT_HMAC_SECRET",
+	"AUTH_TOKEN_SECRET", "CLIENT_ID_SALT", "REDIS_PASSWORD",
+	"TENANT_CONFIGS", "SPLIT_KEY_SHARES", "SPLIT_KEY_PEER_KEY", "AWS_SECRET_ACCESS_KEY",
+	"ATTESTATION_SIGNING_KEY", "RESPONSE_SIGNING_KEY", "LOG_BLOB_CONTAINER_URL",
+	"MIRROR_API_KEY",
+}
+
+// replicaConnection matches the connection strings of the replicas.
+var replicaConnection = regexp.MustCompile(`^DB_CONNECTION_ST_[0-9]+$`)
+
+// isSecretVariable reports whether name holds a secret.
+func isSecretVariable(name string) bool {
+	for _, v := range secretVariables {
+		if v == name {
+			return true
+		}
+	}
+	return replicaConnection.MatchString(name)
+}
+
+// secretProvider fetches secrets from one kind of store.
+type secretProvider interface {
+	// secret returns the secret named by ref, the reference without its
+	// scheme.
+	secret(ctx context.Context, ref string) (string, error)
+}
+
+// secretProviders maps reference schemes to their providers.
+var secretProviders = map[string]secretProvider{
+	"env":      envSecrets{},
+	"file":     fileSecrets{},
+	"keyvault": keyVaultSecrets{client: &http.Client{Timeout: 30 * time.Second}},
+	"vault":    hashiVaultSecrets{client: &http.Client{Timeout: 30 * time.Second}},
+}
+
+// appServiceReference matches Key Vault references as App Service writes
+// them.
+var appServiceReference = regexp.MustCompile(`^@Microsoft\.KeyVault\(SecretUri=(https://[^)]+)\)$`)
+
+// secretReference returns the provider and reference of value, or ok false
+// if value is not a reference.
+func secretReference(value string) (p secretProvider, ref string, ok bool) {
+	if m := appServiceReference.FindStringSubmatch(value); m != nil {
+		return secretProviders["keyvault"], m[1], true
+	}
+	scheme, rest, found := strings.Cut(value, ":")
+	if !found {
+		return nil, "", false
+	}
+	p, ok = secretProviders[scheme]
+	if !ok {
+		return nil, "", false
+	}
+	return p, strings.TrimPrefix(rest, "//"), true
+}
+
+// resolveSecrets replaces every variable that references a secret with the
+// secret, after reading the _FILE variables of the secret variables.
+// VAULT_TOKEN is resolved first, as Vault references need it.
+func resolveSecrets(ctx context.Context) error {
+	for _, kv := range os.Environ() {
+		key, file, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutSuffix(key, "_FILE")
+		if !ok || file == "" || !isSecretVariable(name) {
+			continue
+		}
+		if _, ok := os.LookupEnv(name); ok {
+			return fmt.Errorf("both %s and %s_FILE are set", name, name)
+		}
+		value, err := fileSecrets{}.secret(ctx, file)
+		if err != nil {
+			return fmt.Errorf("reading %s_FILE: %w", name, err)
+		}
+		os.Setenv(name, value)
+	}
+	names := []string{"VAULT_TOKEN"}
+	for _, kv := range os.Environ() {
+		if name, _, _ := strings.Cut(kv, "="); name != "VAULT_TOKEN" {
+			names = append(names, name)
+		}
+	}
+	var resolved int
+	for _, name := range names {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		p, ref, ok := secretReference(value)
+		if !ok {
+			continue
+		}
+		secret, err := p.secret(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("resolving %s: %w", name, err)
+		}
+		os.Setenv(name, secret)
+		resolved++
+	}
+	if resolved > 0 {
+		log.Printf("Resolved %d secret references", resolved)
+	}
+	return nil
+}
+
+// envSecrets reads secrets from other variables.
+type envSecrets struct{}
+
+func (envSecrets) secret(_ context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("%s is not set", name)
+	}
+	return value, nil
+}
+
+// fileSecrets reads secrets from files, without a trailing newline.
+type fileSecrets struct{}
+
+func (fileSecrets) secret(_ context.Context, name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// keyVaultSecrets reads Azure Key Vault secrets, referenced as
+// vault-name/secret-name[/version] or by secret URI.
+type keyVaultSecrets struct {
+	client *http.Client
+}
+
+func (k keyVaultSecrets) secret(ctx context.Context, ref string) (string, error) {
+	u := ref
+	if !strings.HasPrefix(ref, "https://") {
+		vault, name, ok := strings.Cut(ref, "/")
+		if !ok || vault == "" || name == "" {
+			return "", fmt.Errorf("Key Vault reference %q is not vault/secret[/version]", ref)
+		}
+		u = "https://" + vault + ".vault.azure.net/secrets/" + name
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	q := parsed.Query()
+	q.Set("api-version", "7.4")
+	parsed.RawQuery = q.Encode()
+
+	token, err := k.accessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := getSecretJSON(ctx, k.client, parsed.String(), map[string]string{"Authorization": "Bearer " + token}, &body); err != nil {
+		return "", fmt.Errorf("Key Vault: %w", err)
+	}
+	return body.Value, nil
+}
+
+// accessToken returns a Key Vault token of the managed identity of the
+// instance.
+func (k keyVaultSecrets) accessToken(ctx context.Context) (string, error) {
+	token, _, err := managedIdentityToken(ctx, k.client, "https://vault.azure.net")
+	return token, err
+}
+
+// managedIdentityToken returns a token for resource of the managed identity
+// of the instance, from the App Service identity endpoint or else the
+// instance metadata service, and when it expires. AZURE_CLIENT_ID selects a
+// user-assigned identity.
+func managedIdentityToken(ctx context.Context, client *http.Client, resource string) (string, time.Time, error) {
+	q := url.Values{"resource": {resource}}
+	header := map[string]string{}
+	endpoint := os.Getenv("IDENTITY_ENDPOINT")
+	if endpoint != "" {
+		q.Set("api-version", "2019-08-01")
+		header["X-IDENTITY-HEADER"] = os.Getenv("IDENTITY_HEADER")
+	} else {
+		endpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+		q.Set("api-version", "2018-02-01")
+		header["Metadata"] = "true"
+	}
+	if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+		q.Set("client_id", id)
+	}
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresOn   json.Number `json:"expires_on"`
+	}
+	if err := getSecretJSON(ctx, client, endpoint+"?"+q.Encode(), header, &token); err != nil {
+		return "", time.Time{}, fmt.Errorf("fetching managed identity token: %w", err)
+	}
+	expires, err := token.ExpiresOn.Int64()
+	if err != nil {
+		expires = time.Now().Add(5 * time.Minute).Unix()
+	}
+	return token.AccessToken, time.Unix(expires, 0), nil
+}
+
+// hashiVaultSecrets reads fields of HashiCorp Vault secrets, referenced as
+// path#field.
+type hashiVaultSecrets struct {
+	client *http.Client
+}
+
+func (v hashiVaultSecrets) secret(ctx context.Context, ref string) (string, error) {
+	secretPath, field, ok := strings.Cut(ref, "#")
+	if !ok || field == "" {
+		return "", fmt.Errorf("Vault reference %q has no #field", ref)
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+	header := map[string]string{"X-Vault-Token": os.Getenv("VAULT_TOKEN")}
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		header["X-Vault-Namespace"] = ns
+	}
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	u := strings.TrimSuffix(addr, "/") + path.Join("/v1", secretPath)
+	if err := getSecretJSON(ctx, v.client, u, header, &body); err != nil {
+		return "", fmt.Errorf("Vault: %w", err)
+	}
+	fields := body.Data
+	if nested, ok := fields["data"]; ok && strings.Contains(secretPath, "/data/") {
+		// KV version 2 nests the fields of the secret with its metadata.
+		fields = nil
+		if err := json.Unmarshal(nested, &fields); err != nil {
+			return "", fmt.Errorf("Vault: %w", err)
+		}
+	}
+	raw, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no field %s", secretPath, field)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return string(raw), nil
+	}
+	return value, nil
+}
+
+// getSecretJSON fetches u with the given headers and decodes its JSON body
+// into v.
+func getSecretJSON(ctx context.Context, client *http.Client, u string, header map[string]string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	for k, val := range header {
+		req.Header.Set(k, val)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return secretStatusError{resp.StatusCode, strings.TrimSpace(string(data))}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// secretStatusError is the error response of a secret store.
+type secretStatusError struct {
+	status  int
+	message string
+}
+
+func (e secretStatusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.status, e.message)
+}
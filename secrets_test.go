@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "vault-token" {
+			http.Error(w, "no token", http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/secret/data/migp":
+			w.Write([]byte(`{"data": {"data": {"db": "vault-dsn"}, "metadata": {}}}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer vault.Close()
+
+	keyVault := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/token" && req.Header.Get("X-IDENTITY-HEADER") == "identity":
+			w.Write([]byte(`{"access_token": "kv-token"}`))
+		case req.URL.Path == "/secrets/admin" && req.Header.Get("Authorization") == "Bearer kv-token":
+			w.Write([]byte(`{"value": "kv-admin-key"}`))
+		default:
+			http.Error(w, "denied", http.StatusForbidden)
+		}
+	}))
+	defer keyVault.Close()
+	defer func(p secretProvider) { secretProviders["keyvault"] = p }(secretProviders["keyvault"])
+	secretProviders["keyvault"] = keyVaultSecrets{client: keyVault.Client()}
+
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "file:"+write("vault-token", "vault-token\n"))
+	t.Setenv("IDENTITY_ENDPOINT", keyVault.URL+"/token")
+	t.Setenv("IDENTITY_HEADER", "identity")
+	t.Setenv("CONFIG_JSON", "")
+	os.Unsetenv("CONFIG_JSON")
+	t.Setenv("CONFIG_JSON_FILE", write("config.json", `{"version": 1}`+"\n"))
+	t.Setenv("DB_CONNECTION_ST", "vault://secret/data/migp#db")
+	t.Setenv("ADMIN_API_KEY", "@Microsoft.KeyVault(SecretUri="+keyVault.URL+"/secrets/admin)")
+	t.Setenv("MIGP_TEST_ALIAS", "env:ADMIN_API_KEY_PLAIN")
+	t.Setenv("ADMIN_API_KEY_PLAIN", "plain")
+
+	if err := resolveSecrets(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"VAULT_TOKEN":      "vault-token",
+		"CONFIG_JSON":      `{"version": 1}`,
+		"DB_CONNECTION_ST": "vault-dsn",
+		"ADMIN_API_KEY":    "kv-admin-key",
+		"MIGP_TEST_ALIAS":  "plain",
+	} {
+		if got := os.Getenv(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	t.Setenv("DB_CONNECTION_ST", "vault://secret/data/migp#missing")
+	if err := resolveSecrets(t.Context()); err == nil {
+		t.Error("resolved a missing Vault field")
+	}
+}
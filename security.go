@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// routeMethods lists the methods accepted by each route, keyed by mux
+// pattern. Requests with other methods are rejected before reaching the
+// handler.
+var routeMethods = map[string][]string{
+	"/api/query":                    {http.MethodGet, http.MethodPost},
+	"/api/query/next":               {http.MethodGet},
+	"/api/query/batch":              {http.MethodPost},
+	"/api/oprf/partial":             {http.MethodPost},
+	"/api/passwords/config":         {http.MethodGet},
+	"/api/passwords/query":          {http.MethodPost},
+	"/api/range/":                   {http.MethodGet},
+	"/api/outcomes":                 {http.MethodPost},
+	"/api/config":                   {http.MethodGet},
+	"/api/attestation":              {http.MethodGet},
+	"/api/auth/token":               {http.MethodPost},
+	"/api/buckets":                  {http.MethodGet},
+	"/api/pir":                      {http.MethodPost},
+	"/api/sketch":                   {http.MethodGet},
+	"/api/snapshots/manifest":       {http.MethodGet},
+	"/api/metrics":                  {http.MethodGet},
+	"/api/scale":                    {http.MethodGet},
+	"/api/admin/config":             {http.MethodGet, http.MethodPost, http.MethodDelete},
+	"/api/admin/webhooks":           {http.MethodGet, http.MethodPost, http.MethodDelete},
+	"/api/admin/seed":               {http.MethodPost},
+	"/api/admin/backup":             {http.MethodGet, http.MethodPost},
+	"/api/admin/db":                 {http.MethodGet},
+	"/api/admin/analytics":          {http.MethodGet},
+	"/api/admin/analytics/outcomes": {http.MethodGet},
+	"/api/admin/honeytokens":        {http.MethodGet, http.MethodPost, http.MethodDelete},
+	"/api/admin/sources":            {http.MethodGet, http.MethodPost, http.MethodDelete},
+	"/api/admin/sources/rollback":   {http.MethodPost},
+	"/api/admin/sources/reingest":   {http.MethodPost},
+	"/api/admin/freshness":          {http.MethodGet},
+	"/api/admin/corpus/promote":     {http.MethodPost},
+	"/api/admin/stats/corpus":       {http.MethodGet, http.MethodPost},
+	"/api/admin/journal":            {http.MethodGet, http.MethodPost},
+	"/api/admin/buckets/repair":     {http.MethodPost},
+	"/api/admin/buckets/scrub":      {http.MethodPost},
+	"/api/admin/buckets/compact":    {http.MethodPost},
+	"/api/admin/buckets/rebalance":  {http.MethodPost},
+	"/api/admin/buckets/overflow":   {http.MethodGet, http.MethodPost},
+	"/api/admin/jobs":               {http.MethodGet},
+	"/api/admin/events":             {http.MethodGet},
+	"/api/admin/key":                {http.MethodGet},
+	"/api/admin/ui/":                {http.MethodGet, http.MethodHead},
+	"/api/debug/vectors":            {http.MethodGet, http.MethodPost},
+	"/api/demo/":                    {http.MethodGet, http.MethodHead},
+	"/healthz":                      {http.MethodGet, http.MethodHead},
+	"/readyz":                       {http.MethodGet, http.MethodHead},
+	"/version":                      {http.MethodGet},
+}
+
+// securityHeaders sets hardened response headers and rejects requests that
+// no /api route would accept.
+type securityHeaders struct {
+	mux  *http.ServeMux
+	hsts string
+
+	// requireJSON rejects POST bodies that are not application/json.
+	requireJSON bool
+}
+
+// newSecurityHeaders returns the middleware for the routes of mux. Over TLS,
+// Strict-Transport-Security is sent with a max-age of HSTS_MAX_AGE (default
+// one year, 0 to disable). POST bodies on /api routes must be sent as
+// application/json unless REQUIRE_JSON_CONTENT_TYPE is false, for clients
+// that predate the check.
+func newSecurityHeaders(mux *http.ServeMux) *securityHeaders {
+	sh := &securityHeaders{mux: mux, requireJSON: envBool("REQUIRE_JSON_CONTENT_TYPE", true)}
+	if maxAge := envDuration("HSTS_MAX_AGE", 365*24*time.Hour); maxAge > 0 {
+		sh.hsts = fmt.Sprintf("max-age=%d; includeSubDomains", int(maxAge.Seconds()))
+	}
+	return sh
+}
+
+// allowed reports whether route accepts method, and otherwise returns the
+// value of the Allow header.
+func allowed(route, method string) (bool, string) {
+	methods, ok := routeMethods[route]
+	if !ok {
+		return true, ""
+	}
+	for _, m := range methods {
+		if m == method {
+			return true, ""
+		}
+	}
+	return false, strings.Join(methods, ", ")
+}
+
+// wrap serves h with the security headers set. Responses are not cached
+// unless the handler sets its own Cache-Control, as the cacheable query,
+// sketch and snapshot manifest responses do.
+func (sh *securityHeaders) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "no-referrer")
+		header.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		header.Set("Cache-Control", "no-store")
+		if req.TLS != nil && sh.hsts != "" {
+			header.Set("Strict-Transport-Security", sh.hsts)
+		}
+
+		_, route := sh.mux.Handler(req)
+		if ok, allow := allowed(route, req.Method); !ok {
+			header.Set("Allow", allow)
+			writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if sh.requireJSON && req.Method == http.MethodPost && req.ContentLength != 0 && strings.HasPrefix(route, "/api/") {
+			mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				writeError(w, "request body must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
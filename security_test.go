@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/query", func(w http.ResponseWriter, req *http.Request) {})
+	mux.HandleFunc("/api/sketch", func(w http.ResponseWriter, req *http.Request) { w.Header().Set("Cache-Control", "max-age=60") })
+	t.Setenv("HSTS_MAX_AGE", "1h")
+	srv := httptest.NewTLSServer(newSecurityHeaders(mux).wrap(mux))
+	defer func() { srv.Close() }()
+
+	do := func(method, path, contentType string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp := do(http.MethodGet, "/api/query", "")
+	for header, want := range map[string]string{
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Cache-Control":             "no-store",
+		"Strict-Transport-Security": "max-age=3600; includeSubDomains",
+	} {
+		if got := resp.Header.Get(header); got != want {
+			t.Errorf("%s: %q, want %q", header, got, want)
+		}
+	}
+	if got := do(http.MethodGet, "/api/sketch", "").Header.Get("Cache-Control"); got != "max-age=60" {
+		t.Errorf("handler Cache-Control replaced by %q", got)
+	}
+
+	for _, tt := range []struct {
+		method, path, contentType string
+		status                    int
+	}{
+		{http.MethodPost, "/api/query", "application/json; charset=utf-8", http.StatusOK},
+		{http.MethodPost, "/api/query", "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "/api/query", "", http.StatusUnsupportedMediaType},
+		{http.MethodDelete, "/api/query", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/sketch", "application/json", http.StatusMethodNotAllowed},
+	} {
+		resp := do(tt.method, tt.path, tt.contentType)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s as %q answered %d, want %d", tt.method, tt.path, tt.contentType, resp.StatusCode, tt.status)
+		}
+		if tt.status == http.StatusMethodNotAllowed && resp.Header.Get("Allow") != strings.Join(routeMethods[tt.path], ", ") {
+			t.Errorf("%s %s answered Allow %q", tt.method, tt.path, resp.Header.Get("Allow"))
+		}
+	}
+
+	t.Setenv("REQUIRE_JSON_CONTENT_TYPE", "false")
+	t.Setenv("HSTS_MAX_AGE", "0")
+	srv.Close()
+	srv = httptest.NewTLSServer(newSecurityHeaders(mux).wrap(mux))
+	if resp := do(http.MethodPost, "/api/query", "text/plain"); resp.StatusCode != http.StatusOK || resp.Header.Get("Strict-Transport-Security") != "" {
+		t.Errorf("body check and HSTS not disabled: %d, %q", resp.StatusCode, resp.Header.Get("Strict-Transport-Security"))
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// seedSpec describes a synthetic breach corpus for staging environments.
+// Bucket sizes follow the number of passwords per username, so a zipf
+// distribution produces a few very large buckets alongside many small ones.
+type seedSpec struct {
+	Users                  int    `json:"users"`
+	Distribution           string `json:"distribution"`
+	MaxPasswordsPerUser    int    `json:"maxPasswordsPerUser"`
+	NumVariants            int    `json:"numVariants"`
+	IncludeUsernameVariant bool   `json:"includeUsernameVariant"`
+	Metadata               string `json:"metadata"`
+	Seed                   int64  `json:"seed"`
+}
+
+// defaultSeedSpec returns the seedSpec used for omitted fields.
+func defaultSeedSpec() seedSpec {
+	return seedSpec{
+		Users:                  1000,
+		Distribution:           "zipf",
+		MaxPasswordsPerUser:    200,
+		NumVariants:            9,
+		IncludeUsernameVariant: true,
+		Metadata:               "synthetic",
+		Seed:                   1,
+	}
+}
+
+// validate checks that the spec can be generated.
+func (spec seedSpec) validate() error {
+	if spec.Users < 1 {
+		return errors.New("users must be positive")
+	}
+	if spec.MaxPasswordsPerUser < 1 {
+		return errors.New("maxPasswordsPerUser must be positive")
+	}
+	if spec.NumVariants < 0 {
+		return errors.New("numVariants must not be negative")
+	}
+	if spec.Distribution != "zipf" && spec.Distribution != "uniform" {
+		return fmt.Errorf("unknown distribution %q, want zipf or uniform", spec.Distribution)
+	}
+	return nil
+}
+
+var (
+	seedFirstNames = []string{"alex", "sam", "jordan", "taylor", "casey", "morgan", "riley", "jamie", "avery", "quinn"}
+	seedLastNames  = []string{"smith", "jones", "garcia", "miller", "davis", "lopez", "wilson", "moore", "clark", "lee"}
+	seedDomains    = []string{"example.com", "example.net", "example.org", "mail.example", "corp.example"}
+	seedWords      = []string{"password", "dragon", "sunshine", "monkey", "letmein", "qwerty", "football", "princess", "welcome", "shadow"}
+)
+
+// credentials generates the corpus as <username>:<password> lines. Passwords
+// mimic common human choices: dictionary words with capitalization and digit
+// or symbol suffixes, plus some random strings.
+func (spec seedSpec) credentials() []string {
+	rng := rand.New(rand.NewSource(spec.Seed))
+	zipf := rand.NewZipf(rng, 1.2, 1, uint64(spec.MaxPasswordsPerUser-1))
+
+	var credentials []string
+	for i := 0; i < spec.Users; i++ {
+		username := fmt.Sprintf("%s.%s%d@%s",
+			seedFirstNames[rng.Intn(len(seedFirstNames))],
+			seedLastNames[rng.Intn(len(seedLastNames))],
+			i,
+			seedDomains[rng.Intn(len(seedDomains))])
+
+		n := 1 + rng.Intn(spec.MaxPasswordsPerUser)
+		if spec.Distribution == "zipf" {
+			n = 1 + int(zipf.Uint64())
+		}
+		for j := 0; j < n; j++ {
+			credentials = append(credentials, username+":"+seedPassword(rng))
+		}
+	}
+	return credentials
+}
+
+// seedPassword returns a realistic-looking fake password.
+func seedPassword(rng *rand.Rand) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	if rng.Intn(4) == 0 {
+		b := make([]byte, 8+rng.Intn(9))
+		for i := range b {
+			b[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+
+	word := seedWords[rng.Intn(len(seedWords))]
+	if rng.Intn(2) == 0 {
+		word = strings.ToUpper(word[:1]) + word[1:]
+	}
+	switch rng.Intn(3) {
+	case 0:
+		return word + fmt.Sprint(rng.Intn(100))
+	case 1:
+		return word + fmt.Sprint(1950+rng.Intn(75)) + "!"
+	default:
+		return word
+	}
+}
+
+// seed generates and ingests spec with workers concurrent workers. If
+// progress is not nil it is called with the number of credentials processed
+// and the total.
+func (s *server) seed(spec seedSpec, workers int, progress func(done, total int)) ingestResult {
+	credentials := spec.credentials()
+	var report func(int)
+	if progress != nil {
+		report = func(done int) { progress(done, len(credentials)) }
+	}
+	return s.ingestParallel(context.Background(), ingestRequest{
+		Credentials:            credentials,
+		Metadata:               spec.Metadata,
+		NumVariants:            spec.NumVariants,
+		IncludeUsernameVariant: spec.IncludeUsernameVariant,
+	}, workers, report)
+}
+
+// runSeed implements the seed command, which fills the configured storage
+// with a synthetic corpus.
+func runSeed(args []string) error {
+	spec := defaultSeedSpec()
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	fs.IntVar(&spec.Users, "users", spec.Users, "number of synthetic usernames")
+	fs.StringVar(&spec.Distribution, "distribution", spec.Distribution, "distribution of passwords per username: zipf or uniform")
+	fs.IntVar(&spec.MaxPasswordsPerUser, "max-passwords", spec.MaxPasswordsPerUser, "maximum number of passwords per username")
+	fs.IntVar(&spec.NumVariants, "num-variants", spec.NumVariants, "number of password variants to ingest per credential")
+	fs.BoolVar(&spec.IncludeUsernameVariant, "username-variant", spec.IncludeUsernameVariant, "include a username-only variant")
+	fs.StringVar(&spec.Metadata, "metadata", spec.Metadata, "metadata string stored alongside the entries")
+	fs.Int64Var(&spec.Seed, "seed", spec.Seed, "seed for the synthetic corpus")
+	workers := fs.Int("workers", runtime.NumCPU(), "number of concurrent ingestion workers")
+	fs.Parse(args)
+	if err := spec.validate(); err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	s, err := newServer(cfg)
+	if err != nil {
+		return err
+	}
+	if err := s.ensureStorage(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	result := s.seed(spec, *workers, nil)
+	fmt.Printf("Seeded %d credentials (%d entries, %d failures) in %s\n",
+		result.Successes, result.Entries, result.Failures, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// handleSeed starts a background job seeding a synthetic corpus. It is only
+// available when SEED_ENABLED is set, so production corpora cannot be
+// polluted by accident. Job progress is reported through job events.
+func (s *server) handleSeed(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !envBool("SEED_ENABLED", false) {
+		writeError(w, "seeding is disabled, set SEED_ENABLED=true in staging environments", http.StatusForbidden)
+		return
+	}
+
+	spec := defaultSeedSpec()
+	if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+		log.Println("Request body unmarshal failed:", err)
+		writeError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err := spec.validate(); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jobID, err := randomID()
+	if err != nil {
+		log.Println("Job ID generation failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	subject := "migp/jobs/" + jobID
+	s.events.Publish(eventJobStarted, subject, map[string]interface{}{"jobId": jobID, "type": "seed", "spec": spec})
+
+	go func() {
+		lastPercent := 0
+		result := s.seed(spec, runtime.NumCPU(), func(done, total int) {
+			// Report every 10% so that subscribers see steady progress
+			// without an event per credential.
+			if percent := done * 100 / total; percent/10 > lastPercent/10 {
+				lastPercent = percent
+				s.events.Publish(eventJobProgress, subject, map[string]interface{}{"jobId": jobID, "percent": percent})
+			}
+		})
+		if result.Failures > 0 {
+			log.Printf("Seed job %s finished with %d failures", jobID, result.Failures)
+			s.events.Publish(eventJobFailed, subject, map[string]interface{}{"jobId": jobID, "result": result})
+			return
+		}
+		s.events.Publish(eventJobCompleted, subject, map[string]interface{}{"jobId": jobID, "result": result})
+		s.events.Publish(eventIngestionCompleted, "migp/ingest", result)
+	}()
+
+	s.acceptJob(w, req, jobID, map[string]string{"jobId": jobID})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSeedSpecValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		edit func(*seedSpec)
+		ok   bool
+	}{
+		{"default", func(*seedSpec) {}, true},
+		{"uniform", func(s *seedSpec) { s.Distribution = "uniform" }, true},
+		{"no users", func(s *seedSpec) { s.Users = 0 }, false},
+		{"no passwords", func(s *seedSpec) { s.MaxPasswordsPerUser = 0 }, false},
+		{"negative variants", func(s *seedSpec) { s.NumVariants = -1 }, false},
+		{"unknown distribution", func(s *seedSpec) { s.Distribution = "normal" }, false},
+	} {
+		spec := defaultSeedSpec()
+		tt.edit(&spec)
+		if err := spec.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v", tt.name, err)
+		}
+	}
+}
+
+func TestSeedCredentials(t *testing.T) {
+	spec := seedSpec{Users: 50, Distribution: "uniform", MaxPasswordsPerUser: 4, Seed: 7}
+	credentials := spec.credentials()
+	if again := spec.credentials(); strings.Join(again, "\n") != strings.Join(credentials, "\n") {
+		t.Fatal("corpus differs between runs with the same seed")
+	}
+	perUser := map[string]int{}
+	for _, credential := range credentials {
+		username, password, ok := strings.Cut(credential, ":")
+		if !ok || password == "" {
+			t.Fatalf("credential %q is not <username>:<password>", credential)
+		}
+		perUser[username]++
+	}
+	if len(perUser) != spec.Users {
+		t.Errorf("%d usernames, want %d", len(perUser), spec.Users)
+	}
+	for username, n := range perUser {
+		if n > spec.MaxPasswordsPerUser {
+			t.Errorf("%s has %d passwords, want at most %d", username, n, spec.MaxPasswordsPerUser)
+		}
+	}
+}
+
+func TestSeed(t *testing.T) {
+	s, srv := newTestServer(t)
+	spec := seedSpec{Users: 10, Distribution: "zipf", MaxPasswordsPerUser: 5, Seed: 3}
+	total, calls := 0, 0
+	result := s.seed(spec, 2, func(done, n int) { total, calls = n, calls+1 })
+	if want := len(spec.credentials()); result.Successes != want || result.Failures != 0 || total != want || calls == 0 {
+		t.Fatalf("seed %+v with total %d after %d progress calls, want %d credentials", result, total, calls, want)
+	}
+
+	queries, err := prepareQueries(s.suites[0].cfg.Config, spec.credentials(), 4, 0.5, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queries {
+		status, err := queryStatus(http.DefaultClient, srv.URL+"/api/query", q.body, q.ctx, 0)
+		if err != nil || status != q.expected {
+			t.Fatalf("query for the seeded corpus: %v, %v, want %v", status, err, q.expected)
+		}
+	}
+}
+
+func TestHandleSeed(t *testing.T) {
+	_, srv := newTestServer(t)
+	post := func(body string) int {
+		req := adminRequest(t, http.MethodPost, srv.URL+"/api/admin/seed", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post(`{"users": 1}`); status != http.StatusForbidden {
+		t.Errorf("seed without SEED_ENABLED answered %d, want %d", status, http.StatusForbidden)
+	}
+	t.Setenv("SEED_ENABLED", "true")
+	if status := post(`{"distribution": "normal"}`); status != http.StatusBadRequest {
+		t.Errorf("invalid spec answered %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := post(`{"users": 2, "maxPasswordsPerUser": 1}`); status != http.StatusAccepted {
+		t.Errorf("seed answered %d, want %d", status, http.StatusAccepted)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// testAdminKey is the admin API key of servers from newTestServer.
+const testAdminKey = "test-admin-key"
+
+// newTestServer returns a server on the in-memory bucket backend without a
+// metadata database, as the dev command runs, and an HTTP server serving
+// its routes.
+func newTestServer(t testing.TB) (*server, *httptest.Server) {
+	t.Helper()
+	t.Setenv("STORAGE_BACKEND", "memory")
+	t.Setenv("INGEST_JOURNAL_ENABLED", "false")
+	t.Setenv("ADMIN_API_KEY", testAdminKey)
+	s, err := newServer(migp.DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.detached = true
+	if err := s.ensureStorage(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.handler())
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+// testDatabaseEnv names the connection string of a scratch PostgreSQL
+// database for the tests that need one. They are skipped if it is not set.
+const testDatabaseEnv = "MIGP_TEST_DATABASE_URL"
+
+// newDBTestServer is newTestServer on the database of testDatabaseEnv,
+// with the schema applied and the journal enabled. Tests share the
+// database, so they work on keys and sources of their own.
+func newDBTestServer(t *testing.T) (*server, *httptest.Server) {
+	t.Helper()
+	dsn := os.Getenv(testDatabaseEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDatabaseEnv)
+	}
+	t.Setenv("DB_CONNECTION_ST", dsn)
+	t.Setenv("STORAGE_BACKEND", "postgres")
+	t.Setenv("DB_MANAGE_SCHEMA", "true")
+	t.Setenv("INGEST_JOURNAL_ENABLED", "true")
+	t.Setenv("ADMIN_API_KEY", testAdminKey)
+	s, err := newServer(migp.DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ensureStorage(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.handler())
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+// testName returns a random name for the keys and sources of a test.
+func testName(t *testing.T) string {
+	t.Helper()
+	id, err := randomID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "test-" + id[:12]
+}
+
+// adminRequest returns a request to srv authenticated with testAdminKey.
+func adminRequest(t *testing.T, method, url string, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminKey)
+	return req
+}
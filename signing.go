@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests can be signed with an API key instead of carrying it, so that a
+// request captured on the way, by a proxy logging headers for instance,
+// neither gives the key away nor can be sent again:
+//
+//	Authorization: MIGP-HMAC-SHA256 key=<id>, ts=<unix seconds>, nonce=<random>, sig=<signature>
+//
+// The id is the first 16 hex digits of the SHA-256 digest of the key and the
+// signature the base64url-encoded HMAC-SHA256 with the key of
+//
+//	method "\n" path "\n" raw query "\n" tenant "\n" ts "\n" nonce "\n" hex SHA-256 of the body
+//
+// where tenant is the value of the tenant header, empty if it is not set,
+// so that a signed request cannot be sent again for another tenant.
+// The timestamp must be within REQUEST_SIGNATURE_MAX_SKEW (default 5m) of
+// the clock of the server and the nonce, at most 64 bytes, must not have
+// been seen with the key while the timestamp is. Nonces are remembered by
+// each instance, up to REPLAY_CACHE_SIZE (default 100000) of them, and with
+// REDIS_ADDR set in Redis too so that a request is not accepted again by
+// another instance, see redisFromEnv. When Redis fails the instance relies on
+// its own cache. With SIGNED_REQUESTS_REQUIRED set the admin and ingest
+// routes only accept signed requests.
+
+const (
+	// signatureScheme is the authorization scheme of signed requests.
+	signatureScheme = "MIGP-HMAC-SHA256"
+
+	// signedBodyLimit bounds the body of a signed request, which is read
+	// whole to check its digest.
+	signedBodyLimit = 64 << 20
+)
+
+var signedRejected = newCounter("migp_signed_requests_rejected_total", "Signed requests rejected by reason.", "reason")
+
+// signingKeyID returns the key ID of the API key key.
+func signingKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// signingKey is an API key signed requests can be signed with.
+type signingKey struct {
+	secret []byte
+	apiKey
+}
+
+// requestSignature is the parsed authorization of a signed request.
+type requestSignature struct {
+	keyID string
+	ts    int64
+	nonce string
+	sig   []byte
+}
+
+// parseRequestSignature parses the parameters of the signed authorization
+// value auth, which must have them all.
+func parseRequestSignature(auth string) (requestSignature, error) {
+	var s requestSignature
+	params, ok := strings.CutPrefix(auth, signatureScheme+" ")
+	if !ok {
+		return s, errors.New("not a signed request")
+	}
+	var ts string
+	for _, param := range strings.Split(params, ",") {
+		name, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch name {
+		case "key":
+			s.keyID = val
+		case "ts":
+			ts = val
+		case "nonce":
+			s.nonce = val
+		case "sig":
+			sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(val, "="))
+			if err != nil {
+				return s, errors.New("malformed signature")
+			}
+			s.sig = sig
+		}
+	}
+	n, err := strconv.ParseInt(ts, 10, 64)
+	switch {
+	case err != nil:
+		return s, errors.New("malformed timestamp")
+	case s.keyID == "" || len(s.sig) == 0:
+		return s, errors.New("missing key or signature")
+	case s.nonce == "" || len(s.nonce) > 64:
+		return s, errors.New("nonce must be 1 to 64 bytes")
+	}
+	s.ts = n
+	return s, nil
+}
+
+// signRequest returns the HMAC-SHA256 with key of req, including its tenant
+// header, with the body digest bodySum at ts with nonce.
+func signRequest(key []byte, req *http.Request, bodySum [32]byte, ts int64, nonce string) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range []string{req.Method, req.URL.Path, req.URL.RawQuery, tenantOf(req), strconv.FormatInt(ts, 10), nonce} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{'\n'})
+	}
+	mac.Write([]byte(hex.EncodeToString(bodySum[:])))
+	return mac.Sum(nil)
+}
+
+// verifySigned checks the signature, timestamp and nonce of the signed
+// request req and returns the holder of the key it was signed with. The
+// body of req is read and replaced by a copy.
+func (c *credentials) verifySigned(req *http.Request, now time.Time) (principal, error) {
+	var p principal
+	s, err := parseRequestSignature(req.Header.Get("Authorization"))
+	if err != nil {
+		signedRejected.Inc("malformed")
+		return p, err
+	}
+	key, ok := c.signingKeys[s.keyID]
+	if !ok {
+		signedRejected.Inc("key")
+		return p, errors.New("unknown key")
+	}
+	skew := envDuration("REQUEST_SIGNATURE_MAX_SKEW", 5*time.Minute)
+	ts := time.Unix(s.ts, 0)
+	if ts.Before(now.Add(-skew)) || ts.After(now.Add(skew)) {
+		signedRejected.Inc("stale")
+		return p, errors.New("timestamp outside the allowed skew")
+	}
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(req.Body, signedBodyLimit+1))
+		req.Body.Close()
+		if err != nil || len(body) > signedBodyLimit {
+			signedRejected.Inc("body")
+			return p, errors.New("unreadable or oversized body")
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if !hmac.Equal(signRequest(key.secret, req, sha256.Sum256(body), s.ts, s.nonce), s.sig) {
+		signedRejected.Inc("signature")
+		return p, errors.New("invalid signature")
+	}
+	// A nonce only has to be remembered while its timestamp is accepted.
+	if !nonces().add(s.keyID+":"+s.nonce, ts.Add(skew), now) {
+		signedRejected.Inc("replay")
+		return p, errors.New("replayed request")
+	}
+	return principal{roles: key.roles, tenant: key.tenant, signed: true}, nil
+}
+
+// nonceStore remembers the nonces of signed requests.
+type nonceStore struct {
+	size int
+
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	order  []nonceEntry
+	redis  *redisClient
+	logged time.Time
+}
+
+// nonceEntry is a nonce remembered until expires.
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+// nonces returns the nonce store of the process, configured as described
+// above.
+var nonces = sync.OnceValue(func() *nonceStore {
+	size := envInt("REPLAY_CACHE_SIZE", 100000)
+	if size < 1 {
+		log.Printf("Invalid REPLAY_CACHE_SIZE value %d. Using 100000.", size)
+		size = 100000
+	}
+	return &nonceStore{size: size, seen: map[string]time.Time{}, redis: redisFromEnv()}
+})
+
+// add remembers nonce until expires and reports whether it was new at now.
+func (n *nonceStore) add(nonce string, expires, now time.Time) bool {
+	if !n.addLocal(nonce, expires, now) {
+		return false
+	}
+	if n.redis == nil {
+		return true
+	}
+	ms := max(1, expires.Sub(now).Milliseconds())
+	reply, err := n.redis.do("SET", "migp:nonce:"+nonce, "1", "NX", "PX", strconv.FormatInt(ms, 10))
+	if err != nil {
+		n.mu.Lock()
+		if now.Sub(n.logged) > time.Minute {
+			log.Println("Shared nonce check failed, checking locally:", err)
+			n.logged = now
+		}
+		n.mu.Unlock()
+		return true
+	}
+	return reply != nil
+}
+
+// addLocal remembers nonce on this instance. When the cache is full the
+// nonces closest to expiring are forgotten first.
+func (n *nonceStore) addLocal(nonce string, expires, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if exp, ok := n.seen[nonce]; ok && now.Before(exp) {
+		return false
+	}
+	// Entries are added with nearly increasing expiry, so those at the
+	// front expire first.
+	drop := 0
+	for drop < len(n.order) && (!now.Before(n.order[drop].expires) || len(n.order)-drop >= n.size) {
+		if n.seen[n.order[drop].nonce] == n.order[drop].expires {
+			delete(n.seen, n.order[drop].nonce)
+		}
+		drop++
+	}
+	n.order = append(n.order[drop:], nonceEntry{nonce: nonce, expires: expires})
+	n.seen[nonce] = expires
+	return true
+}
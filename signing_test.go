@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedRequests(t *testing.T) {
+	t.Setenv("API_KEYS", `{"ingest-key": ["ingest"]}`)
+	t.Setenv("SEED_ENABLED", "true")
+	t.Setenv("SIGNED_REQUESTS_REQUIRED", "true")
+	_, srv := newTestServer(t)
+
+	// The request is signed for signedTenant and sent for sentTenant.
+	do := func(key, body, nonce string, ts time.Time, tamper bool, signedTenant, sentTenant string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/admin/seed", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		sum := sha256.Sum256([]byte(body))
+		if tamper {
+			sum = sha256.Sum256([]byte(body + " "))
+		}
+		if signedTenant != "" {
+			req.Header.Set(tenantHeader(), signedTenant)
+		}
+		sig := signRequest([]byte(key), req, sum, ts.Unix(), nonce)
+		req.Header.Del(tenantHeader())
+		if sentTenant != "" {
+			req.Header.Set(tenantHeader(), sentTenant)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("%s key=%s, ts=%d, nonce=%s, sig=%s",
+			signatureScheme, signingKeyID(key), ts.Unix(), nonce, base64.RawURLEncoding.EncodeToString(sig)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		key    string
+		nonce  string
+		ts     time.Time
+		tamper bool
+		signed string
+		sent   string
+		want   int
+	}{
+		{"signed", "ingest-key", "n1", now, false, "", "", http.StatusBadRequest},
+		{"replayed", "ingest-key", "n1", now, false, "", "", http.StatusUnauthorized},
+		{"new nonce", "ingest-key", "n2", now, false, "", "", http.StatusBadRequest},
+		{"stale", "ingest-key", "n3", now.Add(-10 * time.Minute), false, "", "", http.StatusUnauthorized},
+		{"future", "ingest-key", "n4", now.Add(10 * time.Minute), false, "", "", http.StatusUnauthorized},
+		{"tampered body", "ingest-key", "n5", now, true, "", "", http.StatusUnauthorized},
+		{"unknown key", "other-key", "n6", now, false, "", "", http.StatusUnauthorized},
+		{"admin key", testAdminKey, "n1", now, false, "", "", http.StatusBadRequest},
+		{"signed tenant", testAdminKey, "n2", now, false, "acme", "acme", http.StatusBadRequest},
+		{"tenant added", testAdminKey, "n3", now, false, "", "acme", http.StatusUnauthorized},
+		{"tenant changed", testAdminKey, "n4", now, false, "acme", "globex", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := do(tt.key, "{", tt.nonce, tt.ts, tt.tamper, tt.signed, tt.sent); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/admin/seed", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer ingest-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned request: status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestNonceStore(t *testing.T) {
+	n := &nonceStore{size: 2, seen: map[string]time.Time{}}
+	now := time.Now()
+	if !n.add("a", now.Add(time.Minute), now) || n.add("a", now.Add(time.Minute), now) {
+		t.Fatal("first nonce not accepted exactly once")
+	}
+	if !n.add("a", now.Add(2*time.Minute), now.Add(time.Minute)) {
+		t.Error("expired nonce not accepted again")
+	}
+	n.add("b", now.Add(2*time.Minute), now.Add(time.Minute))
+	n.add("c", now.Add(2*time.Minute), now.Add(time.Minute))
+	if len(n.seen) != 2 || len(n.order) != 2 {
+		t.Errorf("cache holds %d nonces, want the size 2", len(n.seen))
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bucketSketch is a Bloom filter of the IDs of non-empty buckets. Clients
+// whose bucket is not in the filter know the query would return an empty
+// bucket and can skip it. Bucket ID i is hashed as SHA-256 of its 4-byte
+// big-endian encoding, with h1 and h2 the first two big-endian uint32s of the
+// digest, and sets bits (h1 + j*h2) mod Bits for j < Hashes. Bits are numbered
+// from the most significant bit of the first filter byte.
+type bucketSketch struct {
+	Version         uint16    `json:"version"`
+	BucketIDBitSize int       `json:"bucketIDBitSize"`
+	Buckets         int       `json:"buckets"`
+	Bits            uint32    `json:"bits"`
+	Hashes          int       `json:"hashes"`
+	Filter          []byte    `json:"filter"`
+	GeneratedAt     time.Time `json:"generatedAt"`
+
+	etag string
+}
+
+// newBucketSketch returns an empty filter sized for n bucket IDs at the false
+// positive rate p.
+func newBucketSketch(n int, p float64) *bucketSketch {
+	if n < 1 {
+		n = 1
+	}
+	bits := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(bits / float64(n) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	m := uint32(math.Max(8, bits))
+	return &bucketSketch{Bits: m, Hashes: hashes, Filter: make([]byte, (m+7)/8)}
+}
+
+// positions returns the filter bits for bucketID.
+func (b *bucketSketch) positions(bucketID uint32) []uint32 {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], bucketID)
+	digest := sha256.Sum256(buf[:])
+	h1, h2 := binary.BigEndian.Uint32(digest[0:4]), binary.BigEndian.Uint32(digest[4:8])
+	positions := make([]uint32, b.Hashes)
+	for j := range positions {
+		positions[j] = uint32((uint64(h1) + uint64(j)*uint64(h2)) % uint64(b.Bits))
+	}
+	return positions
+}
+
+// add inserts bucketID into the filter.
+func (b *bucketSketch) add(bucketID uint32) {
+	for _, pos := range b.positions(bucketID) {
+		b.Filter[pos/8] |= 0x80 >> (pos % 8)
+	}
+}
+
+// sketchCache holds the most recent sketch of every suite.
+type sketchCache struct {
+	mu       sync.Mutex
+	sketches map[uint16]*bucketSketch
+}
+
+// buildSketch scans the corpus of cs for non-empty buckets.
+func (s *server) buildSketch(cs *cryptoSuite) (*bucketSketch, error) {
+	rows, err := s.kv.db().Query(`SELECT id FROM kv_store WHERE length(value) > 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uint32
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		id, ok := cs.bucketID(key)
+		if !ok {
+			continue
+		}
+		raw, err := hex.DecodeString(id)
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		ids = append(ids, binary.BigEndian.Uint32(raw))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	p := envRate("SKETCH_FALSE_POSITIVE_RATE")
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	sketch := newBucketSketch(len(ids), p)
+	for _, id := range ids {
+		sketch.add(id)
+	}
+	sketch.Version = cs.cfg.Version
+	sketch.BucketIDBitSize = cs.cfg.BucketIDBitSize
+	sketch.Buckets = len(ids)
+	sketch.GeneratedAt = time.Now().UTC()
+	digest := sha256.Sum256(sketch.Filter)
+	sketch.etag = fmt.Sprintf(`"%d-%x"`, sketch.Version, digest[:8])
+	return sketch, nil
+}
+
+// sketch returns the sketch of cs, regenerating it once it is older than
+// SKETCH_TTL.
+func (s *server) sketch(cs *cryptoSuite, ttl time.Duration) (*bucketSketch, error) {
+	s.sketches.mu.Lock()
+	defer s.sketches.mu.Unlock()
+	if sketch := s.sketches.sketches[cs.cfg.Version]; sketch != nil && time.Since(sketch.GeneratedAt) < ttl {
+		return sketch, nil
+	}
+
+	start := time.Now()
+	sketch, err := s.buildSketch(cs)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Generated sketch of %d buckets for MIGP version %d in %s", sketch.Buckets, cs.cfg.Version, time.Since(start))
+	if s.sketches.sketches == nil {
+		s.sketches.sketches = map[uint16]*bucketSketch{}
+	}
+	s.sketches.sketches[cs.cfg.Version] = sketch
+	return sketch, nil
+}
+
+// handleSketch serves the Bloom filter of non-empty buckets of the current
+// suite, or of the suite for the version query parameter
+func (s *server) handleSketch(w http.ResponseWriter, req *http.Request) {
+	cs := s.suiteParam(w, req)
+	if cs == nil {
+		return
+	}
+	ttl := envDuration("SKETCH_TTL", 10*time.Minute)
+	sketch, err := s.sketch(cs, ttl)
+	if err != nil {
+		log.Println("Generating sketch failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", sketch.etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(ttl.Seconds())))
+	if req.Header.Get("If-None-Match") == sketch.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, sketch)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// sketchContains reports whether every filter bit of bucketID is set, as a
+// client checks it.
+func sketchContains(b *bucketSketch, bucketID uint32) bool {
+	for _, pos := range b.positions(bucketID) {
+		if b.Filter[pos/8]&(0x80>>(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBucketSketch(t *testing.T) {
+	const n, p = 1000, 0.01
+	b := newBucketSketch(n, p)
+	if b.Hashes != 7 || len(b.Filter) != int(b.Bits+7)/8 {
+		t.Fatalf("sketch for %d buckets at %g: %d bits, %d hashes", n, p, b.Bits, b.Hashes)
+	}
+	for i := uint32(0); i < n; i++ {
+		b.add(i * 7919)
+	}
+	for i := uint32(0); i < n; i++ {
+		if !sketchContains(b, i*7919) {
+			t.Fatalf("added bucket %d missing from the filter", i*7919)
+		}
+	}
+	falsePositives := 0
+	for i := uint32(0); i < 10000; i++ {
+		if sketchContains(b, 1<<31+i) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 3*p {
+		t.Errorf("false positive rate %g, want about %g", rate, p)
+	}
+
+	if empty := newBucketSketch(0, p); empty.Bits < 8 || empty.Hashes < 1 {
+		t.Errorf("sketch for no buckets: %d bits, %d hashes", empty.Bits, empty.Hashes)
+	}
+}
+
+func TestHandleSketch(t *testing.T) {
+	s, srv := newDBTestServer(t)
+	username := testName(t) + "@example.com"
+	if result := s.ingestParallel(context.Background(), ingestRequest{Credentials: []string{username + ":password1"}}, 1, nil); result.Successes != 1 {
+		t.Fatalf("ingestion %+v", result)
+	}
+	resp, err := http.Get(srv.URL + "/api/sketch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sketch bucketSketch
+	err = json.NewDecoder(resp.Body).Decode(&sketch)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("sketch answered %d, %v", resp.StatusCode, err)
+	}
+	raw, _ := hex.DecodeString(migp.BucketIDToHex(s.suites[0].server.BucketID([]byte(username))))
+	if !sketchContains(&sketch, binary.BigEndian.Uint32(raw)) {
+		t.Error("sketch lacks the ingested bucket")
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/sketch", nil)
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidation answered %d, want %d", resp.StatusCode, http.StatusNotModified)
+	}
+}
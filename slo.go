@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Every request is counted as a good or bad event against two service level
+// objectives of its route: availability, where server errors are bad, and
+// latency, where responses slower than the route's threshold are bad. The
+// error budget burn rate over a window is then
+//
+//	rate(bad[w]) / rate(good[w] + bad[w]) / (1 - objective)
+//
+// from migp_slo_events_total and migp_slo_objective, for multi-window alerts.
+
+var (
+	sloEvents       = newCounter("migp_slo_events_total", "Requests counted against an SLO by route, SLO and result.", "route", "slo", "result")
+	sloObjective    = newGauge("migp_slo_objective", "Target ratio of good events of an SLO.", "slo")
+	requestDuration = newHistogram("migp_request_duration_seconds", "Request latency by route.", defaultLatencyBuckets, "route")
+)
+
+// SLOs tracked for every route.
+const (
+	sloAvailability = "availability"
+	sloLatency      = "latency"
+)
+
+// routeThreshold is a latency threshold override for the routes under prefix.
+type routeThreshold struct {
+	prefix    string
+	threshold time.Duration
+}
+
+// sloTracker records SLO events for the routes of a mux.
+type sloTracker struct {
+	mux        *http.ServeMux
+	threshold  time.Duration
+	thresholds []routeThreshold
+}
+
+// newSLOTracker returns a tracker for the routes of mux. Responses are good
+// for the latency SLO within SLO_LATENCY_THRESHOLD (default 500ms), or the
+// threshold of the longest matching prefix in SLO_LATENCY_THRESHOLDS, a
+// comma-separated list of route-prefix=duration overrides such as
+// "/api/query=250ms,/api/admin/=5s". The objectives exported for burn-rate
+// alerts are SLO_AVAILABILITY_OBJECTIVE (default 0.999) and
+// SLO_LATENCY_OBJECTIVE (default 0.99).
+func newSLOTracker(mux *http.ServeMux) *sloTracker {
+	t := &sloTracker{mux: mux, threshold: envDuration("SLO_LATENCY_THRESHOLD", 500*time.Millisecond)}
+	for _, entry := range strings.Split(os.Getenv("SLO_LATENCY_THRESHOLDS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, val, ok := strings.Cut(entry, "=")
+		d, err := time.ParseDuration(val)
+		if !ok || !strings.HasPrefix(prefix, "/") || err != nil || d <= 0 {
+			log.Printf("Ignoring invalid SLO_LATENCY_THRESHOLDS entry %q", entry)
+			continue
+		}
+		t.thresholds = append(t.thresholds, routeThreshold{prefix, d})
+	}
+	sort.Slice(t.thresholds, func(i, j int) bool { return len(t.thresholds[i].prefix) > len(t.thresholds[j].prefix) })
+
+	sloObjective.Set(sloObjectiveFromEnv("SLO_AVAILABILITY_OBJECTIVE", 0.999), sloAvailability)
+	sloObjective.Set(sloObjectiveFromEnv("SLO_LATENCY_OBJECTIVE", 0.99), sloLatency)
+	return t
+}
+
+// sloObjectiveFromEnv returns the named objective, or def if it is unset.
+func sloObjectiveFromEnv(name string, def float64) float64 {
+	if _, ok := os.LookupEnv(name); !ok {
+		return def
+	}
+	return envRate(name)
+}
+
+// latencyThreshold returns the latency threshold of route.
+func (t *sloTracker) latencyThreshold(route string) time.Duration {
+	for _, r := range t.thresholds {
+		if strings.HasPrefix(route, r.prefix) {
+			return r.threshold
+		}
+	}
+	return t.threshold
+}
+
+// wrap records an availability and a latency event for every request served
+// by h, labelled with the mux pattern matching the request. Invocation
+// envelopes are not recorded themselves: the HTTP requests they carry are
+// recorded under their own route once unwrapped, and queue and timer
+// invocations are not user-facing.
+func (t *sloTracker) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, route := t.mux.Handler(req)
+		if route == "" || route == "/" {
+			h.ServeHTTP(w, req)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		h.ServeHTTP(rec, req)
+		elapsed := time.Since(start)
+		requestDuration.Observe(elapsed.Seconds(), route)
+
+		result := "good"
+		if rec.status >= 500 {
+			result = "bad"
+		}
+		sloEvents.Inc(route, sloAvailability, result)
+		result = "good"
+		if elapsed > t.latencyThreshold(route) {
+			result = "bad"
+		}
+		sloEvents.Inc(route, sloLatency, result)
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSLOTracker(t *testing.T) {
+	t.Setenv("SLO_LATENCY_THRESHOLD", "1h")
+	t.Setenv("SLO_LATENCY_THRESHOLDS", "/slo/=1ns, /slo/quick=1h, slow=1s, /slo/bad=-1s")
+	t.Setenv("SLO_LATENCY_OBJECTIVE", "0.95")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slo/slow", func(w http.ResponseWriter, req *http.Request) { time.Sleep(time.Millisecond) })
+	mux.HandleFunc("/slo/quick", func(w http.ResponseWriter, req *http.Request) {})
+	mux.HandleFunc("/slo/fail", func(w http.ResponseWriter, req *http.Request) { w.WriteHeader(http.StatusBadGateway) })
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {})
+	tracker := newSLOTracker(mux)
+	if objective, _, _, _ := sloObjective.total(func(v []string) bool { return v[0] == sloLatency }); objective != 0.95 {
+		t.Errorf("latency objective %g, want 0.95", objective)
+	}
+	if got := tracker.latencyThreshold("/slo/bad"); got != time.Nanosecond {
+		t.Errorf("threshold of /slo/bad %s, want the /slo/ prefix's", got)
+	}
+
+	events := func(route, slo, result string) float64 {
+		v, _, _, _ := sloEvents.total(func(v []string) bool { return v[0] == route && v[1] == slo && v[2] == result })
+		return v
+	}
+	for _, tt := range []struct {
+		path                string
+		availability, speed string
+	}{
+		{"/slo/slow", "good", "bad"},
+		{"/slo/quick", "good", "good"},
+		{"/slo/fail", "bad", "bad"},
+	} {
+		availability, speed := events(tt.path, sloAvailability, tt.availability), events(tt.path, sloLatency, tt.speed)
+		tracker.wrap(mux).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if events(tt.path, sloAvailability, tt.availability) != availability+1 || events(tt.path, sloLatency, tt.speed) != speed+1 {
+			t.Errorf("%s not counted as %s availability and %s latency", tt.path, tt.availability, tt.speed)
+		}
+	}
+
+	before, _, _, _ := sloEvents.total(func(v []string) bool { return v[0] == "/" })
+	tracker.wrap(mux).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	if after, _, _, _ := sloEvents.total(func(v []string) bool { return v[0] == "/" }); after != before {
+		t.Error("invocation envelope counted against an SLO")
+	}
+}
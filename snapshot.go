@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// snapshotShardBits is the number of leading bucket ID bits selecting the
+// shard a bucket is exported to. Clients sync the shards holding the buckets
+// they care about.
+const snapshotShardBits = 8
+
+// snapshotManifest describes one exported generation of a suite's corpus.
+// Shard files concatenate, in bucket ID order, records of a 4-byte big-endian
+// bucket ID, a 4-byte big-endian length and the bucket contents.
+type snapshotManifest struct {
+	Generation      int64           `json:"generation"`
+	Version         uint16          `json:"version"`
+	BucketIDBitSize int             `json:"bucketIDBitSize"`
+	ShardBits       int             `json:"shardBits"`
+	BaseURL         string          `json:"baseURL"`
+	CreatedAt       time.Time       `json:"createdAt"`
+	Shards          []snapshotShard `json:"shards"`
+}
+
+// snapshotShard is one exported shard file.
+type snapshotShard struct {
+	Shard   uint32 `json:"shard"`
+	Path    string `json:"path"`
+	Size    int    `json:"size"`
+	Buckets int    `json:"buckets"`
+	SHA256  string `json:"sha256"`
+}
+
+// signedManifest is served by /api/snapshots/manifest. Signature is the
+// Ed25519 signature of the exact Manifest bytes.
+type signedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature []byte          `json:"signature"`
+	PublicKey []byte          `json:"publicKey"`
+}
+
+// snapshotSigningKey returns the Ed25519 key in SNAPSHOT_SIGNING_KEY, a hex
+// encoded 32-byte seed. It is only needed by the snapshot command. Clients
+// should pin the public key rather than trust the one served alongside the
+// manifest.
+func snapshotSigningKey() (ed25519.PrivateKey, error) {
+	seed, err := hex.DecodeString(os.Getenv("SNAPSHOT_SIGNING_KEY"))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("SNAPSHOT_SIGNING_KEY must be a hex encoded 32-byte Ed25519 seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// snapshotSink stores exported snapshot files.
+type snapshotSink interface {
+	Put(name string, data []byte) error
+}
+
+// dirSink writes snapshot files below a local directory.
+type dirSink string
+
+// Put writes data to name below the directory.
+func (d dirSink) Put(name string, data []byte) error {
+	p := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0o644)
+}
+
+// blobSink uploads snapshot files to an Azure Blob Storage container through
+// a container SAS URL.
+type blobSink struct {
+	client       *http.Client
+	containerURL *url.URL
+}
+
+// Put uploads data as a block blob named name.
+func (b blobSink) Put(name string, data []byte) error {
+	u := *b.containerURL
+	u.Path = path.Join(u.Path, name)
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-blob-cache-control", "public, max-age=31536000, immutable")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("uploading %s: status code %d", name, resp.StatusCode)
+	}
+	return nil
+}
+
+// exportSnapshot writes the corpus of cs to sink as a new generation and
+// records its signed manifest.
+func (s *server) exportSnapshot(cs *cryptoSuite, sink snapshotSink, baseURL string, key ed25519.PrivateKey) (*snapshotManifest, error) {
+	db := s.kv.db()
+	var generation int64
+	if err := db.QueryRow(`SELECT nextval(pg_get_serial_sequence('snapshots', 'generation'))`).Scan(&generation); err != nil {
+		return nil, err
+	}
+	shardBits := snapshotShardBits
+	if cs.cfg.BucketIDBitSize < shardBits {
+		shardBits = cs.cfg.BucketIDBitSize
+	}
+	manifest := &snapshotManifest{
+		Generation:      generation,
+		Version:         cs.cfg.Version,
+		BucketIDBitSize: cs.cfg.BucketIDBitSize,
+		ShardBits:       shardBits,
+		BaseURL:         baseURL,
+		CreatedAt:       time.Now().UTC(),
+	}
+
+	var (
+		buf     bytes.Buffer
+		current = uint32(0)
+		buckets = 0
+	)
+	flush := func() error {
+		if buckets == 0 {
+			return nil
+		}
+		name := fmt.Sprintf("v%d/%d/%0*x.bin", cs.cfg.Version, generation, (shardBits+3)/4, current)
+		if err := sink.Put(name, buf.Bytes()); err != nil {
+			return err
+		}
+		digest := sha256.Sum256(buf.Bytes())
+		manifest.Shards = append(manifest.Shards, snapshotShard{
+			Shard:   current,
+			Path:    name,
+			Size:    buf.Len(),
+			Buckets: buckets,
+			SHA256:  hex.EncodeToString(digest[:]),
+		})
+		buf.Reset()
+		buckets = 0
+		return nil
+	}
+
+	rows, err := db.Query(`SELECT id, value, checksum, tombstones FROM kv_store WHERE length(value) > 0 ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var value, checksum []byte
+		var tombstones int
+		if err := rows.Scan(&key, &value, &checksum, &tombstones); err != nil {
+			return nil, err
+		}
+		// A corrupted bucket must not be published to clients, and
+		// neither must removed entries.
+		if err := s.kv.verifyChecksum("snapshot", key, value, checksum); err != nil {
+			return nil, err
+		}
+		if tombstones > 0 {
+			if value, err = s.kv.dropTombstoned(context.Background(), key, value); err != nil {
+				return nil, err
+			}
+		}
+		id, ok := cs.bucketID(key)
+		if !ok {
+			continue
+		}
+		raw, err := hex.DecodeString(id)
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		bucketID := binary.BigEndian.Uint32(raw)
+		if shard := bucketID >> (cs.cfg.BucketIDBitSize - shardBits); shard != current {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			current = shard
+		}
+		binary.Write(&buf, binary.BigEndian, bucketID)
+		binary.Write(&buf, binary.BigEndian, uint32(len(value)))
+		buf.Write(value)
+		buckets++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	query := `INSERT INTO snapshots (generation, version, manifest, signature, public_key) VALUES ($1, $2, $3, $4, $5)`
+	publicKey := []byte(key.Public().(ed25519.PublicKey))
+	if _, err := db.Exec(query, generation, cs.cfg.Version, body, ed25519.Sign(key, body), publicKey); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// snapshotTarget returns the sink snapshot files are exported to and the base
+// URL clients download them from: the SNAPSHOT_BLOB_CONTAINER_URL container,
+// or the directory out if it is set.
+func snapshotTarget(out string) (snapshotSink, string, error) {
+	baseURL := os.Getenv("SNAPSHOT_BASE_URL")
+	if out != "" {
+		return dirSink(out), baseURL, nil
+	}
+	containerURL, err := url.Parse(os.Getenv("SNAPSHOT_BLOB_CONTAINER_URL"))
+	if err != nil || containerURL.Host == "" {
+		return nil, "", errors.New("SNAPSHOT_BLOB_CONTAINER_URL must be a container SAS URL, or use -out")
+	}
+	if baseURL == "" {
+		baseURL = (&url.URL{Scheme: containerURL.Scheme, Host: containerURL.Host, Path: containerURL.Path}).String()
+	}
+	return blobSink{client: &http.Client{Timeout: time.Minute}, containerURL: containerURL}, baseURL, nil
+}
+
+// runSnapshot implements the snapshot command, which exports a new generation
+// of the corpus to SNAPSHOT_BLOB_CONTAINER_URL, or to -out for testing.
+func runSnapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	version := fs.Uint("version", 0, "MIGP version to export (default the current suite)")
+	out := fs.String("out", "", "write shard files to this directory instead of Blob Storage")
+	fs.Parse(args)
+
+	key, err := snapshotSigningKey()
+	if err != nil {
+		return err
+	}
+	sink, baseURL, err := snapshotTarget(*out)
+	if err != nil {
+		return err
+	}
+
+	configs, err := loadConfigs()
+	if err != nil {
+		return err
+	}
+	s, err := newServer(configs[0], configs[1:]...)
+	if err != nil {
+		return err
+	}
+	cs := s.suites[0]
+	if *version != 0 {
+		if cs = s.suite(uint16(*version)); cs == nil {
+			return fmt.Errorf("MIGP version %d is not configured", *version)
+		}
+	}
+	if err := s.ensureStorage(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	manifest, err := s.exportSnapshot(cs, sink, baseURL, key)
+	if err != nil {
+		return err
+	}
+	s.events.Publish(eventSnapshotPublished, "migp/snapshots", map[string]interface{}{
+		"generation": manifest.Generation,
+		"version":    manifest.Version,
+	})
+	s.events.Wait()
+	fmt.Printf("Exported generation %d with %d shards in %s\n",
+		manifest.Generation, len(manifest.Shards), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// handleSnapshotManifest serves the signed manifest of the latest snapshot of
+// the current suite, or of the suite for the version query parameter
+func (s *server) handleSnapshotManifest(w http.ResponseWriter, req *http.Request) {
+	cs := s.suiteParam(w, req)
+	if cs == nil {
+		return
+	}
+	var manifest, signature, publicKey []byte
+	query := `SELECT manifest, signature, public_key FROM snapshots WHERE version = $1 ORDER BY generation DESC LIMIT 1`
+	err := s.kv.db().QueryRow(query, cs.cfg.Version).Scan(&manifest, &signature, &publicKey)
+	if err == sql.ErrNoRows {
+		writeError(w, "no snapshot has been published", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Loading snapshot manifest failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	m := signedManifest{Manifest: manifest, Signature: signature, PublicKey: publicKey}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, m)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+const testSnapshotSeed = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func TestSnapshotSigningKey(t *testing.T) {
+	for _, seed := range []string{"", "00", "not hex"} {
+		t.Setenv("SNAPSHOT_SIGNING_KEY", seed)
+		if _, err := snapshotSigningKey(); err == nil {
+			t.Errorf("seed %q accepted", seed)
+		}
+	}
+	t.Setenv("SNAPSHOT_SIGNING_KEY", testSnapshotSeed)
+	if key, err := snapshotSigningKey(); err != nil || len(key) != ed25519.PrivateKeySize {
+		t.Fatalf("key %x, %v", key, err)
+	}
+}
+
+func TestSnapshotSinks(t *testing.T) {
+	dir := t.TempDir()
+	if err := dirSink(dir).Put("v1/3/0a.bin", []byte("shard")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "v1", "3", "0a.bin")); err != nil || string(data) != "shard" {
+		t.Fatalf("directory sink wrote %q, %v", data, err)
+	}
+
+	var uploaded string
+	status := http.StatusCreated
+	container := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if req.Method == http.MethodPut && req.Header.Get("x-ms-blob-type") == "BlockBlob" && strings.Contains(req.Header.Get("x-ms-blob-cache-control"), "immutable") {
+			uploaded = req.URL.Path + "?" + req.URL.RawQuery + " " + string(body)
+		}
+		w.WriteHeader(status)
+	}))
+	defer container.Close()
+	t.Setenv("SNAPSHOT_BLOB_CONTAINER_URL", container.URL+"/snapshots?sig=secret")
+	t.Setenv("SNAPSHOT_BASE_URL", "")
+	sink, baseURL, err := snapshotTarget("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseURL != container.URL+"/snapshots" {
+		t.Errorf("base URL %q exposes or lacks parts of the container URL", baseURL)
+	}
+	if err := sink.Put("v1/3/0a.bin", []byte("shard")); err != nil || uploaded != "/snapshots/v1/3/0a.bin?sig=secret shard" {
+		t.Fatalf("uploaded %q, %v", uploaded, err)
+	}
+	status = http.StatusForbidden
+	if err := sink.Put("v1/3/0b.bin", []byte("shard")); err == nil {
+		t.Error("rejected upload succeeded")
+	}
+
+	t.Setenv("SNAPSHOT_BLOB_CONTAINER_URL", "")
+	if _, _, err := snapshotTarget(""); err == nil {
+		t.Error("snapshot target without a container or directory")
+	}
+}
+
+// TestSnapshotExport exports the corpus to a directory and checks the served
+// manifest against the signing key and the shard files.
+func TestSnapshotExport(t *testing.T) {
+	s, srv := newDBTestServer(t)
+	cs := s.suites[0]
+	username := testName(t) + "@example.com"
+	if result := s.ingestParallel(context.Background(), ingestRequest{Credentials: []string{username + ":password1"}}, 1, nil); result.Successes != 1 {
+		t.Fatalf("ingestion %+v", result)
+	}
+	t.Setenv("SNAPSHOT_SIGNING_KEY", testSnapshotSeed)
+	key, err := snapshotSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	manifest, err := s.exportSnapshot(cs, dirSink(dir), "https://cdn.example/snapshots", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(srv.URL + "/api/snapshots/manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signed signedManifest
+	err = json.NewDecoder(resp.Body).Decode(&signed)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("manifest answered %d, %v", resp.StatusCode, err)
+	}
+	if !ed25519.Verify(key.Public().(ed25519.PublicKey), signed.Manifest, signed.Signature) {
+		t.Fatal("manifest signature does not verify under the signing key")
+	}
+	var served snapshotManifest
+	if err := json.Unmarshal(signed.Manifest, &served); err != nil || served.Generation != manifest.Generation {
+		t.Fatalf("served generation %d, %v, want the exported %d", served.Generation, err, manifest.Generation)
+	}
+
+	raw, _ := hex.DecodeString(migp.BucketIDToHex(cs.server.BucketID([]byte(username))))
+	bucketID := binary.BigEndian.Uint32(raw)
+	found := false
+	for _, shard := range served.Shards {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(shard.Path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest := sha256.Sum256(data); hex.EncodeToString(digest[:]) != shard.SHA256 || len(data) != shard.Size {
+			t.Fatalf("shard %s does not match its manifest entry", shard.Path)
+		}
+		if shard.Shard != bucketID>>(cs.cfg.BucketIDBitSize-served.ShardBits) {
+			continue
+		}
+		for len(data) >= 8 {
+			id, n := binary.BigEndian.Uint32(data), int(binary.BigEndian.Uint32(data[4:]))
+			found = found || id == bucketID
+			data = data[8+n:]
+		}
+	}
+	if !found {
+		t.Error("snapshot lacks the ingested bucket")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Rolling back a source removes the entries only it contributed, and
+// re-ingesting it adds back the ones missing from the corpus, for example
+// after a bucket restore or repair lost them. Either touches only the
+// buckets the journal lists entries of the source in, and a dry run reports
+// those buckets and the entries that would change without changing them.
+
+// The actions of a sourcePlan.
+const (
+	sourceRollback = "rollback"
+	sourceReingest = "reingest"
+)
+
+// maxPlanBuckets bounds the buckets listed by a sourcePlan. The totals
+// cover all of them.
+const maxPlanBuckets = 1000
+
+// sourcePlan lists the changes an action makes to the corpus for one
+// source. Journaled counts the distinct entries journaled from the source,
+// Shared those of them a rollback keeps because another enabled source or
+// untagged ingestion also contributed them, and Entries those the action
+// removes or adds, in BucketCount buckets. Changed is set once it has been
+// applied.
+type sourcePlan struct {
+	Source      string             `json:"source"`
+	Action      string             `json:"action"`
+	DryRun      bool               `json:"dryRun"`
+	Journaled   int                `json:"journaled"`
+	Shared      int                `json:"shared"`
+	Entries     int                `json:"entries"`
+	BucketCount int                `json:"bucketCount"`
+	Buckets     []sourcePlanBucket `json:"buckets"`
+	Truncated   bool               `json:"truncated,omitempty"`
+	Changed     int                `json:"changed"`
+
+	changes map[uint16][]journalEntry
+}
+
+// sourcePlanBucket is a bucket changed by a sourcePlan.
+type sourcePlanBucket struct {
+	Key     string `json:"key"`
+	Entries int    `json:"entries"`
+}
+
+// planSource computes the sourcePlan of action for source. The stored
+// contents of every bucket the journal lists entries of source in are read,
+// so that only entries actually stored are removed and only missing ones
+// are added.
+func (s *server) planSource(ctx context.Context, source, action string) (*sourcePlan, error) {
+	plan := &sourcePlan{Source: source, Action: action, Buckets: []sourcePlanBucket{}, changes: map[uint16][]journalEntry{}}
+	entries, err := s.collectSource(ctx, source)
+	if err != nil {
+		return plan, err
+	}
+	plan.Journaled = entries.count()
+	if action == sourceRollback {
+		if err := s.dropShared(ctx, source, entries); err != nil {
+			return plan, err
+		}
+		plan.Shared = plan.Journaled - entries.count()
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key, values := range entries {
+		if len(values) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		contents, err := s.kv.Get(ctx, key)
+		if err != nil {
+			return plan, err
+		}
+		values, err := bucketEntries(contents)
+		if err != nil {
+			return plan, fmt.Errorf("bucket %s: %w", key, err)
+		}
+		stored := make(map[string]bool, len(values))
+		for _, value := range values {
+			stored[string(value)] = true
+		}
+		n := 0
+		for value, v := range entries[key] {
+			if stored[value] == (action == sourceRollback) {
+				plan.changes[v.version] = append(plan.changes[v.version], v.entry)
+				n += 1
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		plan.Entries += n
+		plan.BucketCount += 1
+		if len(plan.Buckets) < maxPlanBuckets {
+			plan.Buckets = append(plan.Buckets, sourcePlanBucket{key, n})
+		} else {
+			plan.Truncated = true
+		}
+	}
+	return plan, nil
+}
+
+// applySourcePlan carries out plan. Its changes are journaled tagged with
+// the source, so that they are attributed to it like the batches they undo
+// or redo.
+func (s *server) applySourcePlan(ctx context.Context, plan *sourcePlan) error {
+	op, apply := journalRemove, s.removeEntries
+	if plan.Action == sourceReingest {
+		op, apply = journalAppend, s.insert
+	}
+	n, err := s.applySource(ctx, plan.Source, op, plan.changes, apply)
+	plan.Changed = n
+	return err
+}
+
+// handleSourceAction serves POST /api/admin/sources/rollback and
+// /api/admin/sources/reingest, which run action for the source of the id
+// query parameter in a background job, only planning it with dryRun=true.
+// Rolling back a source also disables it, so that later batches from it
+// stay out of the corpus; a disabled source cannot be re-ingested before
+// it is enabled.
+func (s *server) handleSourceAction(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		q := req.URL.Query()
+		id := q.Get("id")
+		dryRun, err := strconv.ParseBool(q.Get("dryRun"))
+		if err != nil && q.Get("dryRun") != "" {
+			invalid(errInvalidRequest, "dryRun must be a boolean").write(w)
+			return
+		}
+		sources, err := s.loadSources(req.Context(), id)
+		if err != nil {
+			storageError(w, "Loading source", err)
+			return
+		}
+		if id == "" || len(sources) == 0 {
+			writeErrorCode(w, errNotFound, errUnknownSource.Error(), http.StatusNotFound)
+			return
+		}
+		src := sources[0]
+		if action == sourceReingest && !src.Enabled {
+			writeErrorCode(w, errConflict, "the source is disabled: enable it to add its entries back", http.StatusConflict)
+			return
+		}
+
+		release := s.lockSources(w, req)
+		if release == nil {
+			return
+		}
+		s.startSourceJob(w, req, release, "source_"+action, id, src, func(ctx context.Context, source string) (interface{}, error) {
+			// The source is disabled before planning, so that no batch
+			// from it is stored after the journal has been scanned.
+			if action == sourceRollback && src.Enabled && !dryRun {
+				if _, err := s.kv.db().ExecContext(ctx, `UPDATE sources SET enabled = false, updated_at = now() WHERE id = $1`, source); err != nil {
+					return nil, err
+				}
+				log.Printf("Disabled source %s to roll it back", source)
+			}
+			plan, err := s.planSource(ctx, source, action)
+			plan.DryRun = dryRun
+			if err != nil || dryRun {
+				return plan, err
+			}
+			return plan, s.applySourcePlan(ctx, plan)
+		})
+	}
+}
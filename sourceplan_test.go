@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// postSourceAction posts action for source with the given dryRun value and
+// returns the status of the response and, for a job, the plan it reported.
+func postSourceAction(t *testing.T, url, action, source, dryRun string) (int, sourcePlan) {
+	t.Helper()
+	req := adminRequest(t, http.MethodPost, url+"/api/admin/sources/"+action+"?stream=true&id="+source+"&dryRun="+dryRun, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var plan sourcePlan
+	if resp.StatusCode != http.StatusAccepted {
+		return resp.StatusCode, plan
+	}
+	var job jobStatus
+	for dec := json.NewDecoder(resp.Body); dec.More(); {
+		if err := dec.Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job.State != "completed" {
+		t.Fatalf("%s job ended %s: %s", action, job.State, job.Error)
+	}
+	result, _ := json.Marshal(job.Result)
+	if err := json.Unmarshal(result, &plan); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, plan
+}
+
+func TestSourceActionRejections(t *testing.T) {
+	_, srv := newTestServer(t)
+	if status, _ := postSourceAction(t, srv.URL, sourceRollback, "s", "maybe"); status != http.StatusBadRequest {
+		t.Errorf("rollback with an invalid dryRun answered %d, want %d", status, http.StatusBadRequest)
+	}
+	resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodGet, srv.URL+"/api/admin/sources/reingest?id=s", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET of reingest answered %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSourceRollbackAndReingest(t *testing.T) {
+	s, srv := newDBTestServer(t)
+	ctx := context.Background()
+	a, b := testName(t)+"-a", testName(t)+"-b"
+	own, shared := a+"/own", a+"/shared"
+	t.Cleanup(func() {
+		s.kv.db().Exec(`DELETE FROM kv_store WHERE id = $1 OR id = $2`, own, shared)
+		s.kv.db().Exec(`DELETE FROM sources WHERE id = $1 OR id = $2`, a, b)
+	})
+
+	ownValue, sharedValue := make([]byte, conformanceEntrySize), make([]byte, conformanceEntrySize)
+	rand.Read(ownValue)
+	rand.Read(sharedValue)
+	version := s.suites[0].cfg.Version
+	for source, entries := range map[string][]journalEntry{
+		a: {{Key: own, Value: ownValue}, {Key: shared, Value: sharedValue}},
+		b: {{Key: shared, Value: sharedValue}},
+	} {
+		if _, err := s.registerSource(ctx, source); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.applySource(ctx, source, journalAppend, map[uint16][]journalEntry{version: entries}, s.insert); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := func(key string, value []byte) bool {
+		t.Helper()
+		bucket, err := s.kv.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Contains(bucket, value)
+	}
+
+	if status, _ := postSourceAction(t, srv.URL, sourceRollback, testName(t)+"-unknown", ""); status != http.StatusNotFound {
+		t.Errorf("rollback of an unknown source answered %d, want %d", status, http.StatusNotFound)
+	}
+	status, plan := postSourceAction(t, srv.URL, sourceRollback, a, "true")
+	if status != http.StatusAccepted || !plan.DryRun || plan.Journaled != 2 || plan.Shared != 1 || plan.Entries != 1 || plan.Changed != 0 ||
+		len(plan.Buckets) != 1 || plan.Buckets[0] != (sourcePlanBucket{own, 1}) {
+		t.Fatalf("dry run answered %d with plan %+v", status, plan)
+	}
+	if !stored(own, ownValue) {
+		t.Fatal("dry run removed the entry")
+	}
+
+	// The entry b also contributed stays.
+	if status, plan = postSourceAction(t, srv.URL, sourceRollback, a, ""); status != http.StatusAccepted || plan.Changed != 1 {
+		t.Fatalf("rollback answered %d with plan %+v", status, plan)
+	}
+	if stored(own, ownValue) || !stored(shared, sharedValue) {
+		t.Fatal("rollback removed the wrong entries")
+	}
+	if sources, err := s.loadSources(ctx, a); err != nil || sources[0].Enabled {
+		t.Fatalf("rolled back source %+v, %v, want it disabled", sources, err)
+	}
+	if status, _ := postSourceAction(t, srv.URL, sourceReingest, a, ""); status != http.StatusConflict {
+		t.Errorf("reingest of a disabled source answered %d, want %d", status, http.StatusConflict)
+	}
+
+	// Re-ingestion adds back only what the corpus lost.
+	if _, err := s.removeEntries(ctx, []journalEntry{{Key: shared, Value: sharedValue}}); err != nil {
+		t.Fatal(err)
+	}
+	if status, plan = postSourceAction(t, srv.URL, sourceReingest, b, ""); status != http.StatusAccepted || plan.Entries != 1 || plan.Changed != 1 {
+		t.Fatalf("reingest answered %d with plan %+v", status, plan)
+	}
+	if !stored(shared, sharedValue) {
+		t.Fatal("reingest did not add the lost entry back")
+	}
+	if status, plan = postSourceAction(t, srv.URL, sourceReingest, b, ""); status != http.StatusAccepted || plan.Entries != 0 {
+		t.Errorf("second reingest answered %d with plan %+v, want no changes", status, plan)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Breach sources name the breach an ingestion batch came from. A batch
+// tagged with a source, by the source field of its ingestion request, is
+// journaled with it, so that every entry the source contributed can be found
+// again. Disabling a source removes those entries from the corpus, except
+// for the ones also contributed by another enabled source or by untagged
+// ingestion, and keeps later batches from it out of the corpus; enabling it
+// again adds them back. Both start a corpus generation, so cached query
+// responses are revalidated.
+//
+// This relies on the journal: entries ingested with journaling disabled
+// cannot be attributed to their source, and the range index, which only
+// counts password hashes, is not updated.
+
+// sourceLockID is the advisory lock key held while the entries of a source
+// are being removed or restored, so that two such jobs never interleave.
+const sourceLockID = schemaLockID + 2
+
+// errSourceJobRunning is returned when another source job holds the lock.
+var errSourceJobRunning = errors.New("a source job is already running")
+
+// errUnknownSource is returned for operations on a source that does not
+// exist.
+var errUnknownSource = errors.New("unknown source")
+
+// sourceIDPattern matches valid source IDs, such as "example-2024".
+var sourceIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// breachSource is a registered breach source.
+type breachSource struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Enabled     bool      `json:"enabled"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// sourceSpec is the body of a request creating or updating a source.
+// Omitted fields keep their current value, or their default for a new
+// source.
+type sourceSpec struct {
+	ID          string  `json:"id"`
+	Description *string `json:"description"`
+	Enabled     *bool   `json:"enabled"`
+}
+
+// registerSource registers the source of an ingestion batch if it is new,
+// and reports whether it is enabled. Batches without a source always are.
+func (s *server) registerSource(ctx context.Context, id string) (bool, error) {
+	if id == "" {
+		return true, nil
+	}
+	if !sourceIDPattern.MatchString(id) {
+		return false, fmt.Errorf("invalid source %q", id)
+	}
+	query := `
+	INSERT INTO sources (id) VALUES ($1)
+	ON CONFLICT (id) DO UPDATE SET id = EXCLUDED.id
+	RETURNING enabled, xmax = 0`
+	var enabled, created bool
+	if err := s.kv.db().QueryRowContext(ctx, query, id).Scan(&enabled, &created); err != nil {
+		return false, err
+	}
+	if created && !s.journaling {
+		log.Printf("Ingesting source %s with the journal disabled: its entries cannot be removed later", id)
+	}
+	return enabled, nil
+}
+
+// loadSources returns the registered sources, or only the one with id if it
+// is not empty.
+func (s *server) loadSources(ctx context.Context, id string) ([]breachSource, error) {
+	query := `
+	SELECT id, description, enabled, created_at, updated_at FROM sources
+	WHERE $1 = '' OR id = $1
+	ORDER BY id`
+	rows, err := s.kv.db().QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sources := []breachSource{}
+	for rows.Next() {
+		var src breachSource
+		if err := rows.Scan(&src.ID, &src.Description, &src.Enabled, &src.CreatedAt, &src.UpdatedAt); err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	return sources, rows.Err()
+}
+
+// scanAppended calls f with every append batch of the journal matching the
+// SQL condition where on its columns, in journal order. The arguments of
+// where are numbered from $2.
+func (s *server) scanAppended(ctx context.Context, where string, f func(b journalBatch) error, args ...interface{}) error {
+	query := `
+	SELECT seq, version, created_at, entries FROM ingest_journal
+	WHERE op = $1 AND (` + where + `)
+	ORDER BY seq`
+	rows, err := s.kv.db().QueryContext(ctx, query, append([]interface{}{journalAppend}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		b := journalBatch{Op: journalAppend}
+		var body []byte
+		if err := rows.Scan(&b.Seq, &b.Version, &b.CreatedAt, &body); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(body, &b.Entries); err != nil {
+			return err
+		}
+		if err := f(b); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// sourceEntries is the set of entries contributed by a source, by bucket key
+// and value, with the version of the corpus each was journaled for.
+type sourceEntries map[string]map[string]versionedEntry
+
+// versionedEntry is a journaled entry and the version of its corpus.
+type versionedEntry struct {
+	version uint16
+	entry   journalEntry
+}
+
+// count returns the number of entries in e.
+func (e sourceEntries) count() int {
+	n := 0
+	for _, values := range e {
+		n += len(values)
+	}
+	return n
+}
+
+// collectSource returns the entries journaled as appended from source.
+func (s *server) collectSource(ctx context.Context, source string) (sourceEntries, error) {
+	entries := sourceEntries{}
+	err := s.scanAppended(ctx, `source = $2`, func(b journalBatch) error {
+		for _, e := range b.Entries {
+			if entries[e.Key] == nil {
+				entries[e.Key] = map[string]versionedEntry{}
+			}
+			entries[e.Key][string(e.Value)] = versionedEntry{b.Version, e}
+		}
+		return nil
+	}, source)
+	return entries, err
+}
+
+// dropShared deletes from the entries of source those also appended by
+// untagged ingestion or from another enabled source, leaving the ones that
+// should leave the corpus with it.
+func (s *server) dropShared(ctx context.Context, source string, entries sourceEntries) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	where := `source IS NULL OR source IN (SELECT id FROM sources WHERE enabled AND id <> $2)`
+	return s.scanAppended(ctx, where, func(b journalBatch) error {
+		for _, e := range b.Entries {
+			delete(entries[e.Key], string(e.Value))
+		}
+		return nil
+	}, source)
+}
+
+// removeSource removes the entries only source contributed from the corpus.
+func (s *server) removeSource(ctx context.Context, source string) (interface{}, error) {
+	plan, err := s.planSource(ctx, source, sourceRollback)
+	if err != nil {
+		return plan, err
+	}
+	return plan, s.applySourcePlan(ctx, plan)
+}
+
+// restoreSource adds the entries of source missing from the corpus back.
+func (s *server) restoreSource(ctx context.Context, source string) (interface{}, error) {
+	plan, err := s.planSource(ctx, source, sourceReingest)
+	if err != nil {
+		return plan, err
+	}
+	return plan, s.applySourcePlan(ctx, plan)
+}
+
+// applySource journals op on the entries of source, one batch per version,
+// and applies it.
+func (s *server) applySource(ctx context.Context, source, op string, entries map[uint16][]journalEntry, apply func(context.Context, []journalEntry) (int, error)) (int, error) {
+	changed := 0
+	defer func() {
+		if changed > 0 {
+			s.corpusChanged()
+		}
+	}()
+	for version, batch := range entries {
+		if len(batch) == 0 {
+			continue
+		}
+		seq, err := s.journalSource(ctx, version, op, source, batch)
+		if err != nil {
+			return changed, err
+		}
+		n, err := apply(ctx, batch)
+		changed += n
+		if err != nil {
+			return changed, err
+		}
+		s.journalApplied(ctx, seq)
+	}
+	return changed, nil
+}
+
+// updateSource creates or updates the source of spec, returning it and
+// whether it was enabled before. A new source is reported as previously
+// enabled, as it has no entries to restore or remove.
+func (s *server) updateSource(ctx context.Context, spec sourceSpec) (breachSource, bool, error) {
+	var src breachSource
+	tx, err := s.kv.db().BeginTx(ctx, nil)
+	if err != nil {
+		return src, false, err
+	}
+	defer tx.Rollback()
+	wasEnabled := true
+	err = tx.QueryRowContext(ctx, `SELECT enabled FROM sources WHERE id = $1 FOR UPDATE`, spec.ID).Scan(&wasEnabled)
+	if err != nil && err != sql.ErrNoRows {
+		return src, false, err
+	}
+	query := `
+	INSERT INTO sources (id, description, enabled) VALUES ($1, COALESCE($2, ''), COALESCE($3, true))
+	ON CONFLICT (id) DO UPDATE SET
+		description = COALESCE($2, sources.description),
+		enabled = COALESCE($3, sources.enabled),
+		updated_at = now()
+	RETURNING id, description, enabled, created_at, updated_at`
+	err = tx.QueryRowContext(ctx, query, spec.ID, spec.Description, spec.Enabled).
+		Scan(&src.ID, &src.Description, &src.Enabled, &src.CreatedAt, &src.UpdatedAt)
+	if err != nil {
+		return src, false, err
+	}
+	return src, wasEnabled, tx.Commit()
+}
+
+// deleteSource removes the entries only source contributed from the corpus
+// and unregisters it. The journaled batches keep their tag.
+func (s *server) deleteSource(ctx context.Context, source string) (interface{}, error) {
+	plan, err := s.removeSource(ctx, source)
+	if err != nil {
+		return plan, err
+	}
+	_, err = s.kv.db().ExecContext(ctx, `DELETE FROM sources WHERE id = $1`, source)
+	return plan, err
+}
+
+// lockSources takes the source lock for a source job and returns the
+// function releasing it, or responds with a 409 if another job holds it and
+// returns nil.
+func (s *server) lockSources(w http.ResponseWriter, req *http.Request) func() {
+	release, err := s.tryAdvisoryLock(req.Context(), sourceLockID, "source", errSourceJobRunning)
+	if err == errSourceJobRunning {
+		writeErrorCode(w, errConflict, err.Error(), http.StatusConflict)
+		return nil
+	}
+	if err != nil {
+		storageError(w, "Taking source lock", err)
+		return nil
+	}
+	return release
+}
+
+// startSourceJob runs f on source in the background under the source lock,
+// released with release once it is done, publishing its progress as a job
+// of type kind, and responds with the job ID and extra. The job result is
+// the one f returns.
+func (s *server) startSourceJob(w http.ResponseWriter, req *http.Request, release func(), kind, source string, extra interface{}, f func(context.Context, string) (interface{}, error)) {
+	jobID, err := randomID()
+	if err != nil {
+		release()
+		log.Println("Job ID generation failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	subject := "migp/jobs/" + jobID
+	s.events.Publish(eventJobStarted, subject, map[string]interface{}{"jobId": jobID, "type": kind, "source": source})
+
+	go func() {
+		defer release()
+		start := time.Now()
+		result, err := f(context.Background(), source)
+		if err != nil {
+			log.Printf("Source job %s (%s %s) failed: %v", jobID, kind, source, err)
+			s.events.Publish(eventJobFailed, subject, map[string]interface{}{"jobId": jobID, "error": err.Error(), "result": result})
+			return
+		}
+		log.Printf("Source job %s (%s %s) completed in %s", jobID, kind, source, time.Since(start))
+		s.events.Publish(eventJobCompleted, subject, map[string]interface{}{"jobId": jobID, "result": result})
+	}()
+
+	s.acceptJob(w, req, jobID, map[string]interface{}{"jobId": jobID, "source": extra})
+}
+
+// handleSources lists, creates, updates and deletes breach sources.
+// Enabling or disabling a source, and deleting one, restore or remove its
+// entries in a background job and respond with its ID.
+func (s *server) handleSources(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		id := req.URL.Query().Get("id")
+		sources, err := s.loadSources(req.Context(), id)
+		if err != nil {
+			storageError(w, "Listing sources", err)
+			return
+		}
+		if id == "" {
+			writeJSON(w, http.StatusOK, sources)
+			return
+		}
+		if len(sources) == 0 {
+			writeErrorCode(w, errNotFound, errUnknownSource.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, sources[0])
+
+	case http.MethodPost:
+		var spec sourceSpec
+		if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+			log.Println("Request body unmarshal failed:", err)
+			writeError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if !sourceIDPattern.MatchString(spec.ID) {
+			invalid(errInvalidRequest, "id must be 1 to 64 letters, digits, dots, dashes or underscores").write(w)
+			return
+		}
+		// A request that may flip the source takes the lock first, so
+		// that the flag never changes without the job following it.
+		release := func() {}
+		if spec.Enabled != nil {
+			if release = s.lockSources(w, req); release == nil {
+				return
+			}
+		}
+		src, wasEnabled, err := s.updateSource(req.Context(), spec)
+		if err != nil {
+			release()
+			storageError(w, "Updating source", err)
+			return
+		}
+		switch {
+		case wasEnabled && !src.Enabled:
+			s.startSourceJob(w, req, release, "source_disable", src.ID, src, s.removeSource)
+		case !wasEnabled && src.Enabled:
+			s.startSourceJob(w, req, release, "source_enable", src.ID, src, s.restoreSource)
+		default:
+			release()
+			writeJSON(w, http.StatusOK, src)
+		}
+
+	case http.MethodDelete:
+		id := req.URL.Query().Get("id")
+		sources, err := s.loadSources(req.Context(), id)
+		if err != nil {
+			storageError(w, "Loading source", err)
+			return
+		}
+		if id == "" || len(sources) == 0 {
+			writeErrorCode(w, errNotFound, errUnknownSource.Error(), http.StatusNotFound)
+			return
+		}
+		if release := s.lockSources(w, req); release != nil {
+			s.startSourceJob(w, req, release, "source_delete", id, sources[0], s.deleteSource)
+		}
+
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
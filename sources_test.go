@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// setSourceEnabled posts enabled for source and returns the status of the
+// response and, for a job, the state it ended in.
+func setSourceEnabled(t *testing.T, url, source string, enabled bool) (int, string) {
+	t.Helper()
+	body, _ := json.Marshal(sourceSpec{ID: source, Enabled: &enabled})
+	req := adminRequest(t, http.MethodPost, url+"/api/admin/sources?stream=true", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return resp.StatusCode, ""
+	}
+	var job jobStatus
+	for dec := json.NewDecoder(resp.Body); dec.More(); {
+		if err := dec.Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, job.State
+}
+
+func TestSourceEnableDisable(t *testing.T) {
+	s, srv := newDBTestServer(t)
+	ctx := context.Background()
+	source := testName(t)
+	key := source + "/bucket"
+	t.Cleanup(func() {
+		s.kv.db().Exec(`DELETE FROM kv_store WHERE id = $1`, key)
+		s.kv.db().Exec(`DELETE FROM sources WHERE id = $1`, source)
+	})
+
+	value := make([]byte, conformanceEntrySize)
+	rand.Read(value)
+	if _, err := s.registerSource(ctx, source); err != nil {
+		t.Fatal(err)
+	}
+	entries := map[uint16][]journalEntry{s.suites[0].cfg.Version: {{Key: key, Value: value}}}
+	if _, err := s.applySource(ctx, source, journalAppend, entries, s.insert); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each step runs on the state the previous ones left.
+	tests := []struct {
+		name    string
+		enabled bool
+		locked  bool
+		status  int
+		state   string
+		stored  bool
+	}{
+		{"disable while a job runs", false, true, http.StatusConflict, "", true},
+		{"disable", false, false, http.StatusAccepted, "completed", false},
+		{"disable again", false, false, http.StatusOK, "", false},
+		{"enable while a job runs", true, true, http.StatusConflict, "", false},
+		{"enable", true, false, http.StatusAccepted, "completed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.locked {
+				release, err := s.tryAdvisoryLock(ctx, sourceLockID, "source", errSourceJobRunning)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer release()
+			}
+			status, state := setSourceEnabled(t, srv.URL, source, tt.enabled)
+			if status != tt.status || state != tt.state {
+				t.Fatalf("response %d with job %q, want %d with job %q", status, state, tt.status, tt.state)
+			}
+			sources, err := s.loadSources(ctx, source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.locked && sources[0].Enabled != tt.enabled {
+				t.Fatalf("source enabled %v, want %v", sources[0].Enabled, tt.enabled)
+			}
+			if tt.locked && sources[0].Enabled == tt.enabled {
+				t.Fatal("a conflicting request changed the source")
+			}
+			bucket, err := s.kv.Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored := len(bucket) > 0; stored != tt.stored {
+				t.Fatalf("entry stored %v, want %v", stored, tt.stored)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/circl/group"
+)
+
+// Experimentally, the OPRF key of a suite can be split between this server
+// and a second evaluator service, so that neither host alone can evaluate
+// the OPRF. The evaluation scalar 1/(k+m) of oprfKey is split into two
+// random shares adding up to it. Each service multiplies the blinded
+// elements by its own share, and the server answering queries adds the two
+// partial evaluations up to the evaluation. The split-key command prints the
+// two shares of every suite of CONFIG_JSON, by version:
+//
+//	{"1": {"server": "<base64 share>", "evaluator": "<base64 share>"}}
+//
+// SPLIT_KEY_SHARES holds the share of the service by version, as
+// {"1": "<base64 share>"}.
+//
+// On the server answering queries, SPLIT_KEY_PEER_URL is the base URL of the
+// evaluator, called with the API key in SPLIT_KEY_PEER_KEY. The privateKey
+// of a split suite in CONFIG_JSON must then be a placeholder such as a fresh
+// random key: it never evaluates queries, and credentials are not ingested
+// into split suites, whose corpus is fed pre-encrypted entries instead, see
+// encrypted.go. On the evaluator, where SPLIT_KEY_PEER_URL is not set,
+// /api/oprf/partial serves partial evaluations to callers with the evaluator
+// role:
+//
+//	POST /api/oprf/partial {"version": 1, "elements": ["<base64 blinded element>", …]}
+//	→ {"elements": ["<base64 partial evaluation>", …]}
+
+const (
+	// roleEvaluator is the role of the server calling the evaluator.
+	roleEvaluator = "evaluator"
+
+	// maxPartialElements bounds the elements of a partial evaluation.
+	maxPartialElements = 256
+)
+
+var splitKeyPeerFailures = newCounter("migp_split_key_peer_failures_total", "Failed partial evaluations of the split-key evaluator.")
+
+// splitKey evaluates with the share of this server and that of the
+// evaluator.
+type splitKey struct {
+	version uint16
+	local   *oprfKey
+	peer    string
+	peerKey string
+	client  *http.Client
+}
+
+// partialRequest is the body of a partial evaluation.
+type partialRequest struct {
+	Version  uint16   `json:"version"`
+	Elements [][]byte `json:"elements"`
+}
+
+// partialResponse is the body of a partial evaluation response.
+type partialResponse struct {
+	Elements [][]byte `json:"elements"`
+}
+
+// splitKeyShares returns the shares of SPLIT_KEY_SHARES for the versions of
+// suites, as keys evaluating with a share, or nil if it is not set.
+func splitKeyShares(suites []*cryptoSuite) (map[uint16]*oprfKey, error) {
+	sharesJSON := strings.TrimSpace(os.Getenv("SPLIT_KEY_SHARES"))
+	if sharesJSON == "" {
+		return nil, nil
+	}
+	var encoded map[string][]byte
+	if err := json.Unmarshal([]byte(sharesJSON), &encoded); err != nil {
+		return nil, fmt.Errorf("parsing SPLIT_KEY_SHARES: %w", err)
+	}
+	shares := map[uint16]*oprfKey{}
+	for v, data := range encoded {
+		version, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("SPLIT_KEY_SHARES: invalid version %q", v)
+		}
+		cs := suiteIn(suites, uint16(version))
+		if cs == nil {
+			return nil, fmt.Errorf("SPLIT_KEY_SHARES: MIGP version %d is not served", version)
+		}
+		g := cs.key.group
+		share := g.NewScalar()
+		if err := share.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("SPLIT_KEY_SHARES: share of MIGP version %d: %w", version, err)
+		}
+		shares[uint16(version)] = &oprfKey{group: g, inverse: share}
+	}
+	return shares, nil
+}
+
+// newSplitKeys sets up split-key evaluation as described above. It splits
+// the suites with a share when SPLIT_KEY_PEER_URL is set, and otherwise
+// returns the shares for the evaluator to serve.
+func newSplitKeys(suites []*cryptoSuite) (map[uint16]*oprfKey, error) {
+	shares, err := splitKeyShares(suites)
+	if err != nil || shares == nil {
+		return nil, err
+	}
+	peer := strings.TrimSuffix(os.Getenv("SPLIT_KEY_PEER_URL"), "/")
+	if peer == "" {
+		return shares, nil
+	}
+	client := &http.Client{Timeout: envDuration("SPLIT_KEY_PEER_TIMEOUT", 2*time.Second)}
+	for version, share := range shares {
+		cs := suiteIn(suites, version)
+		if cs.remote != nil {
+			return nil, fmt.Errorf("SPLIT_KEY_SHARES: MIGP version %d is evaluated elsewhere", version)
+		}
+		cs.remote = &splitKey{version: version, local: share, peer: peer + "/api/oprf/partial", peerKey: os.Getenv("SPLIT_KEY_PEER_KEY"), client: client}
+	}
+	return nil, nil
+}
+
+// evaluate evaluates the blinded elements with both shares, the share of
+// this server on pool while the evaluator is called.
+func (k *splitKey) evaluate(ctx context.Context, pool *cryptoPool, blinded [][]byte) ([][]byte, error) {
+	type result struct {
+		elements [][]byte
+		err      error
+	}
+	remote := make(chan result, 1)
+	go func() {
+		elements, err := k.partial(ctx, blinded)
+		remote <- result{elements, err}
+	}()
+	var (
+		local [][]byte
+		err   error
+	)
+	if perr := pool.run(ctx, func() { local, err = k.local.evaluate(blinded) }); perr != nil {
+		return nil, perr
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := <-remote
+	if r.err != nil {
+		splitKeyPeerFailures.Inc()
+		return nil, fmt.Errorf("%w: %v", errEvaluatorUnavailable, r.err)
+	}
+	if len(r.elements) != len(local) {
+		splitKeyPeerFailures.Inc()
+		return nil, fmt.Errorf("%w: %d partial evaluations of %d elements", errEvaluatorUnavailable, len(r.elements), len(local))
+	}
+	g := k.local.group
+	out := make([][]byte, len(local))
+	for i := range local {
+		a, b := g.NewElement(), g.NewElement()
+		if err := a.UnmarshalBinary(local[i]); err != nil {
+			return nil, err
+		}
+		if err := b.UnmarshalBinary(r.elements[i]); err != nil {
+			splitKeyPeerFailures.Inc()
+			return nil, fmt.Errorf("%w: invalid partial evaluation: %v", errEvaluatorUnavailable, err)
+		}
+		if out[i], err = a.Add(a, b).MarshalBinaryCompress(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// partial asks the evaluator for its partial evaluations of blinded.
+func (k *splitKey) partial(ctx context.Context, blinded [][]byte) ([][]byte, error) {
+	body, err := json.Marshal(partialRequest{Version: k.version, Elements: blinded})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.peer, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+k.peerKey)
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var partial partialResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&partial); err != nil {
+		return nil, err
+	}
+	return partial.Elements, nil
+}
+
+// handleOPRFPartial serves partial evaluations on the evaluator, see above.
+func (s *server) handleOPRFPartial(w http.ResponseWriter, req *http.Request) {
+	if s.shares == nil {
+		writeErrorCode(w, errFeatureDisabled, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var body partialRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil {
+		invalid(errMalformedJSON, "request body is not a valid partial evaluation: %v", err).write(w)
+		return
+	}
+	share, ok := s.shares[body.Version]
+	if !ok {
+		invalid(errUnsupportedVersion, "no share of version %d", body.Version).write(w)
+		return
+	}
+	if len(body.Elements) == 0 || len(body.Elements) > maxPartialElements {
+		invalid(errInvalidRequest, "a partial evaluation holds 1 to %d elements", maxPartialElements).write(w)
+		return
+	}
+	var (
+		elements [][]byte
+		err      error
+	)
+	if perr := s.crypto.run(req.Context(), func() { elements, err = share.evaluate(body.Elements) }); perr != nil {
+		evaluationError(w, perr)
+		return
+	}
+	if err != nil {
+		invalid(errInvalidBlindElement, "invalid blinded element: %v", err).write(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, partialResponse{Elements: elements})
+}
+
+// splitShares splits the evaluation scalar of key into two random shares.
+func splitShares(key *oprfKey) (group.Scalar, group.Scalar) {
+	first := key.group.RandomScalar(rand.Reader)
+	return first, key.group.NewScalar().Sub(key.inverse, first)
+}
+
+// runSplitKey implements the split-key command, see above.
+func runSplitKey() error {
+	configs, err := loadConfigs()
+	if err != nil {
+		return err
+	}
+	type shares struct {
+		Server    []byte `json:"server"`
+		Evaluator []byte `json:"evaluator"`
+	}
+	out := map[string]shares{}
+	for _, cfg := range configs {
+		key, err := newOPRFKey(cfg)
+		if err != nil {
+			return fmt.Errorf("MIGP version %d: %w", cfg.Version, err)
+		}
+		server, evaluator := splitShares(key)
+		var sh shares
+		if sh.Server, err = server.MarshalBinary(); err != nil {
+			return err
+		}
+		if sh.Evaluator, err = evaluator.MarshalBinary(); err != nil {
+			return err
+		}
+		out[strconv.Itoa(int(cfg.Version))] = sh
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(out)
+}
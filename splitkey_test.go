@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+)
+
+func TestSplitKey(t *testing.T) {
+	full, _ := newTestServer(t)
+	key := full.suites[0].key
+	serverShare, evaluatorShare := splitShares(key)
+	shareJSON := func(share interface{ MarshalBinary() ([]byte, error) }) string {
+		data, err := share.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf(`{"%d": %q}`, full.suites[0].cfg.Version, base64.StdEncoding.EncodeToString(data))
+	}
+
+	t.Setenv("API_KEYS", `{"evaluator-key": ["evaluator"]}`)
+	t.Setenv("SPLIT_KEY_SHARES", shareJSON(evaluatorShare))
+	_, evaluator := newTestServer(t)
+
+	t.Setenv("SPLIT_KEY_SHARES", shareJSON(serverShare))
+	t.Setenv("SPLIT_KEY_PEER_URL", evaluator.URL)
+	t.Setenv("SPLIT_KEY_PEER_KEY", "evaluator-key")
+	s, _ := newTestServer(t)
+	cs := s.suites[0]
+	if cs.remote == nil {
+		t.Fatal("suite not split")
+	}
+
+	client, err := oprf.NewClient(cs.cfg.OPRFSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := client.Request([][]byte{[]byte("first"), []byte("second")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := key.evaluate(req.BlindedElements())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.evaluateBatch(context.Background(), cs, req.BlindedElements())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("element %d: split evaluation differs", i)
+		}
+	}
+
+	if result := s.ingestWith(context.Background(), nil, ingestRequest{Credentials: []string{"u:p"}}); result.Failures != 1 {
+		t.Errorf("ingested into a split suite: %+v", result)
+	}
+
+	cs.remote.(*splitKey).peerKey = "wrong-key"
+	if _, err := s.evaluateBatch(context.Background(), cs, req.BlindedElements()); !errors.Is(err, errEvaluatorUnavailable) {
+		t.Errorf("evaluation with a refused peer: %v, want errEvaluatorUnavailable", err)
+	}
+}
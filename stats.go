@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var corpusEntries = newGauge("migp_corpus_entries", "Entries in the corpus of a suite when its statistics were last computed.", "version")
+
+// sizeClass is one bin of the bucket size histogram: the number of buckets
+// larger than half of MaxBytes and no larger than it.
+type sizeClass struct {
+	MaxBytes int64 `json:"maxBytes"`
+	Buckets  int64 `json:"buckets"`
+}
+
+// corpusStats are the statistics of one suite's corpus at ComputedAt.
+// Split sub-buckets are not counted, as they duplicate their bucket's
+// entries.
+type corpusStats struct {
+	Version          uint16      `json:"version"`
+	ComputedAt       time.Time   `json:"computedAt"`
+	Buckets          int64       `json:"buckets"`
+	Entries          int64       `json:"entries"`
+	TotalBytes       int64       `json:"totalBytes"`
+	EntriesPerBucket float64     `json:"entriesPerBucket"`
+	P50Bytes         float64     `json:"p50Bytes"`
+	P90Bytes         float64     `json:"p90Bytes"`
+	P99Bytes         float64     `json:"p99Bytes"`
+	MaxBytes         int64       `json:"maxBytes"`
+	Histogram        []sizeClass `json:"histogram"`
+}
+
+// suiteKeys is a condition on id matching the bucket keys, but not the
+// sub-bucket keys, of the suite whose keys start with $1.
+const suiteKeys = `id LIKE $1 || '%' AND strpos(substr(id, length($1) + 1), '/') = 0`
+
+// computeCorpusStats scans the corpus of cs and returns its statistics.
+func (s *server) computeCorpusStats(ctx context.Context, cs *cryptoSuite) (corpusStats, error) {
+	st := corpusStats{Version: cs.cfg.Version, ComputedAt: time.Now().UTC(), Histogram: []sizeClass{}}
+	db := s.kv.db()
+	prefix := cs.bucketKey("")
+
+	var percentiles []float64
+	query := `
+	SELECT count(*), COALESCE(sum(length(value)), 0), COALESCE(max(length(value)), 0),
+		COALESCE(percentile_cont(ARRAY[0.5, 0.9, 0.99]) WITHIN GROUP (ORDER BY length(value)), '{0,0,0}')
+	FROM kv_store WHERE length(value) > 0 AND ` + suiteKeys
+	err := db.QueryRowContext(ctx, query, prefix).Scan(&st.Buckets, &st.TotalBytes, &st.MaxBytes, pq.Array(&percentiles))
+	if err != nil {
+		return st, err
+	}
+	if len(percentiles) == 3 {
+		st.P50Bytes, st.P90Bytes, st.P99Bytes = percentiles[0], percentiles[1], percentiles[2]
+	}
+
+	query = `SELECT count(*) FROM kv_store_shadow WHERE deleted_at IS NULL AND ` + suiteKeys
+	if err := db.QueryRowContext(ctx, query, prefix).Scan(&st.Entries); err != nil {
+		return st, err
+	}
+	if st.Buckets > 0 {
+		st.EntriesPerBucket = float64(st.Entries) / float64(st.Buckets)
+	}
+
+	query = `
+	SELECT ceil(log(2, length(value)::numeric))::int AS class, count(*)
+	FROM kv_store WHERE length(value) > 0 AND ` + suiteKeys + `
+	GROUP BY class ORDER BY class`
+	rows, err := db.QueryContext(ctx, query, prefix)
+	if err != nil {
+		return st, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var class int
+		var c sizeClass
+		if err := rows.Scan(&class, &c.Buckets); err != nil {
+			return st, err
+		}
+		c.MaxBytes = 1 << class
+		st.Histogram = append(st.Histogram, c)
+	}
+	return st, rows.Err()
+}
+
+// recordCorpusStats computes and stores the statistics of every suite.
+func (s *server) recordCorpusStats(ctx context.Context) ([]corpusStats, error) {
+	var all []corpusStats
+	for _, cs := range s.suites {
+		st, err := s.computeCorpusStats(ctx, cs)
+		if err != nil {
+			return all, fmt.Errorf("version %d: %w", cs.cfg.Version, err)
+		}
+		corpusEntries.Set(float64(st.Entries), strconv.FormatUint(uint64(st.Version), 10))
+		body, err := json.Marshal(st)
+		if err != nil {
+			return all, err
+		}
+		query := `INSERT INTO corpus_stats (version, computed_at, stats) VALUES ($1, $2, $3)`
+		if _, err := s.kv.db().ExecContext(ctx, query, st.Version, st.ComputedAt, body); err != nil {
+			return all, err
+		}
+		all = append(all, st)
+	}
+	return all, nil
+}
+
+// storedCorpusStats returns up to history statistics per suite, newest
+// first.
+func (s *server) storedCorpusStats(ctx context.Context, history int) ([]corpusStats, error) {
+	query := `
+	SELECT stats FROM (
+		SELECT stats, version, computed_at, row_number() OVER (PARTITION BY version ORDER BY computed_at DESC) AS n
+		FROM corpus_stats
+	) s WHERE n <= $1 ORDER BY version, computed_at DESC`
+	rows, err := s.kv.db().QueryContext(ctx, query, history)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	all := []corpusStats{}
+	for rows.Next() {
+		var body []byte
+		if err := rows.Scan(&body); err != nil {
+			return nil, err
+		}
+		var st corpusStats
+		if err := json.Unmarshal(body, &st); err != nil {
+			return nil, err
+		}
+		all = append(all, st)
+	}
+	return all, rows.Err()
+}
+
+// handleCorpusStats serves the latest corpus statistics of every suite, or
+// the given number of past computations with the history query parameter.
+// POST starts a job recomputing them ahead of the maintenance timer.
+func (s *server) handleCorpusStats(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		history := 1
+		if v := req.URL.Query().Get("history"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 365 {
+				writeError(w, "history must be between 1 and 365", http.StatusBadRequest)
+				return
+			}
+			history = n
+		}
+		all, err := s.storedCorpusStats(req.Context(), history)
+		if err != nil {
+			storageError(w, "Loading corpus statistics", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, all)
+	case http.MethodPost:
+		jobID, err := randomID()
+		if err != nil {
+			log.Println("Job ID generation failed:", err)
+			writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		subject := "migp/jobs/" + jobID
+		s.events.Publish(eventJobStarted, subject, map[string]interface{}{"jobId": jobID, "type": "corpus_stats"})
+		go func() {
+			all, err := s.recordCorpusStats(context.Background())
+			if err != nil {
+				log.Printf("Corpus statistics job %s failed: %v", jobID, err)
+				s.events.Publish(eventJobFailed, subject, map[string]interface{}{"jobId": jobID, "error": err.Error()})
+				return
+			}
+			s.events.Publish(eventJobCompleted, subject, map[string]interface{}{"jobId": jobID, "result": all})
+		}()
+		s.acceptJob(w, req, jobID, map[string]string{"jobId": jobID})
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCorpusStats(t *testing.T) {
+	s, srv := newDBTestServer(t)
+	ctx := context.Background()
+	username := testName(t) + "@example.com"
+	if result := s.ingestParallel(ctx, ingestRequest{Credentials: []string{username + ":password1", username + ":password2"}}, 1, nil); result.Successes != 2 {
+		t.Fatalf("ingestion %+v", result)
+	}
+
+	st, err := s.computeCorpusStats(ctx, s.suites[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Buckets == 0 || st.Entries < 2 || st.TotalBytes == 0 || float64(st.MaxBytes) < st.P99Bytes || st.P99Bytes < st.P50Bytes {
+		t.Errorf("corpus statistics %+v", st)
+	}
+	var binned int64
+	for _, c := range st.Histogram {
+		binned += c.Buckets
+	}
+	if binned != st.Buckets {
+		t.Errorf("histogram counts %d buckets, want %d", binned, st.Buckets)
+	}
+
+	recorded, err := s.recordCorpusStats(ctx)
+	if err != nil || len(recorded) != len(s.suites) {
+		t.Fatalf("recorded statistics %+v, %v", recorded, err)
+	}
+	stored, err := s.storedCorpusStats(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, st := range stored {
+		found = found || st.Version == recorded[0].Version && st.ComputedAt.Equal(recorded[0].ComputedAt)
+	}
+	if !found {
+		t.Errorf("latest stored statistics %+v lack %+v", stored, recorded[0])
+	}
+
+	for _, tt := range []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusOK},
+		{"?history=3", http.StatusOK},
+		{"?history=0", http.StatusBadRequest},
+		{"?history=366", http.StatusBadRequest},
+	} {
+		resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodGet, srv.URL+"/api/admin/stats/corpus"+tt.query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var all []corpusStats
+		json.NewDecoder(resp.Body).Decode(&all)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || tt.status == http.StatusOK && len(all) == 0 {
+			t.Errorf("statistics%s answered %d with %d entries, want %d", tt.query, resp.StatusCode, len(all), tt.status)
+		}
+	}
+}
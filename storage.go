@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+)
+
+// bucketBackend stores the corpus buckets outside of PostgreSQL. STORAGE_BACKEND
+// selects it, and defaults to postgres, which keeps the buckets in the
+// kv_store tables of the database cluster.
+//
+// Whichever backend holds the buckets, the PostgreSQL database configured by
+// DB_CONNECTION_ST keeps the server metadata: the ingestion journal, webhooks,
+// bucket splits, honeytokens and so on. Features that read or rewrite the
+// kv_store tables directly, such as scrubbing, rebalancing and snapshots, are
+// only available with the postgres backend.
+type bucketBackend interface {
+	// Get returns the bucket stored under id, or an empty bucket if there
+	// is none.
+	Get(ctx context.Context, id string) ([]byte, error)
+
+	// AppendUnique appends value to the bucket stored under id unless the
+	// same value was appended before, reporting whether it was added.
+	// Retrying it after an ambiguous failure must be safe.
+	AppendUnique(ctx context.Context, id string, bucketHash sql.NullInt64, value []byte) (bool, error)
+
+	// RemoveEntries removes values from the bucket stored under id,
+	// returning the number of values that were present.
+	RemoveEntries(ctx context.Context, id string, values [][]byte) (int, error)
+
+	// Entries calls f for every stored entry, as it was appended.
+	Entries(f func(id string, bucketHash sql.NullInt64, value []byte) error) error
+
+	// Close releases the connections of the backend.
+	Close() error
+}
+
+// batchAppender is implemented by backends that can append the entries of a
+// credential in a single round trip. It has the semantics of AppendUnique
+// for each entry, and returns the number of entries added.
+type batchAppender interface {
+	AppendBatch(ctx context.Context, entries []journalEntry) (int, error)
+}
+
+// storageBackend returns the configured STORAGE_BACKEND.
+func storageBackend() string {
+	if name := os.Getenv("STORAGE_BACKEND"); name != "" {
+		return name
+	}
+	return "postgres"
+}
+
+// bucketBackends maps the STORAGE_BACKEND values other than postgres to the
+// functions opening their backend, which create its tables if manageSchema
+// is set. Backends left out of the build profile are not registered, see
+// profile.go.
+var bucketBackends = map[string]func(manageSchema bool) (bucketBackend, error){
+	"memory": func(bool) (bucketBackend, error) { return newMemoryBackend(), nil },
+}
+
+// openBucketBackend opens the backend called name, or returns nil for the
+// postgres backend. Its tables are created if manageSchema is set.
+func openBucketBackend(name string, manageSchema bool) (bucketBackend, error) {
+	if name == "postgres" {
+		return nil, nil
+	}
+	open, ok := bucketBackends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q, or not built into this binary", name)
+	}
+	return open(manageSchema)
+}
+
+// conflictAttempts bounds the attempts of a backend write that checks and
+// sets a bucket, before it fails with the backend's conflict error.
+const conflictAttempts = 10
+
+// conflictBackoff waits before retrying a write that lost attempt
+// check-and-set races on a bucket, a random time with a bound doubling with
+// every attempt, so that writers racing on a bucket spread out.
+func conflictBackoff(ctx context.Context, attempt int) error {
+	wait := time.Duration(rand.Int63n(int64(5*time.Millisecond) << attempt))
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withSQLBuckets wraps a handler that reads or rewrites the kv_store tables
+// directly, failing the request if the buckets are kept in another backend.
+// It must be applied inside withStorage.
+func (s *server) withSQLBuckets(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.kv.buckets != nil {
+			writeErrorCode(w, errFeatureDisabled, fmt.Sprintf("not supported by the %s storage backend", storageBackend()), http.StatusNotImplemented)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// appendBatch appends entries through b with the retries and instrumentation
+// of AppendUnique.
+func (kv *kvStore) appendBatch(ctx context.Context, b batchAppender, entries []journalEntry) (int, error) {
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	defer kv.observe(ctx, "append", entries[0].Key, time.Now())
+	var added int
+	err := kv.retry(ctx, "append", func() error {
+		if err := kv.chaos.storageFault(); err != nil {
+			return err
+		}
+		var err error
+		added, err = b.AppendBatch(ctx, entries)
+		return err
+	})
+	return added, err
+}
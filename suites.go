@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// cryptoSuite is one MIGP parameter set served by this deployment: a protocol
+// version with its OPRF suite, hashers, bucket encryptor and key. Requests are
+// routed to the suite matching their version, so clients on an older suite
+// keep working while a newer one is rolled out.
+type cryptoSuite struct {
+	cfg    migp.ServerConfig
+	server *migp.Server
+	hasher migp.BucketHasher
+
+	// key evaluates blinded elements with the private key of the suite,
+	// see oprfKey.
+	key *oprfKey
+
+	// remote evaluates in place of key when this server does not hold the
+	// key, see oprfEvaluator.
+	remote oprfEvaluator
+
+	// namespace prefixes the storage keys of a corpus other than the
+	// credential corpus, such as the password-only one.
+	namespace string
+}
+
+// newCryptoSuite returns a cryptoSuite for cfg.
+func newCryptoSuite(cfg migp.ServerConfig) (*cryptoSuite, error) {
+	if cfg.BucketIDBitSize < 1 || cfg.BucketIDBitSize > 32 {
+		return nil, fmt.Errorf("MIGP version %d: bucket ID bit length %d is not between 1 and 32", cfg.Version, cfg.BucketIDBitSize)
+	}
+	migpServer, err := migp.NewServer(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("MIGP version %d: %w", cfg.Version, err)
+	}
+	hasher, err := migp.NewBucketHasher(cfg.BucketHasherID)
+	if err != nil {
+		return nil, fmt.Errorf("MIGP version %d: %w", cfg.Version, err)
+	}
+	key, err := newOPRFKey(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("MIGP version %d: %w", cfg.Version, err)
+	}
+	return &cryptoSuite{cfg: cfg, server: migpServer, hasher: hasher, key: key}, nil
+}
+
+// bucketHash returns the full 32-bit username hash, of which bucket IDs are
+// the high-order bits.
+func (cs *cryptoSuite) bucketHash(username []byte) uint32 {
+	return binary.BigEndian.Uint32(cs.hasher.Hash(username))
+}
+
+// bucketKey returns the storage key of a bucket under this suite. Each suite
+// has its own corpus. Version 1 buckets are stored under their bare bucket ID,
+// the layout used before multiple suites were supported, and under the
+// suite's namespace if it has one.
+func (cs *cryptoSuite) bucketKey(bucketID string) string {
+	key := bucketID
+	if cs.cfg.Version != migp.DefaultMIGPVersion {
+		key = fmt.Sprintf("v%d/%s", cs.cfg.Version, bucketID)
+	}
+	if cs.namespace != "" {
+		key = cs.namespace + "/" + key
+	}
+	return key
+}
+
+// suiteGetter reads the buckets of a single suite from the KV store. Bucket
+// IDs are bits long, which is the suite's bucket ID bit length unless the
+// client asked for a split bucket.
+type suiteGetter struct {
+	ctx   context.Context
+	suite *cryptoSuite
+	kv    *kvStore
+	bits  int
+}
+
+// Get returns the bucket identified by id in the suite's corpus.
+func (g suiteGetter) Get(id string) ([]byte, error) {
+	start := time.Now()
+	var value []byte
+	var err error
+	if g.bits <= g.suite.cfg.BucketIDBitSize {
+		value, err = g.kv.Get(g.ctx, g.suite.bucketKey(id))
+	} else {
+		value, err = g.kv.getSplit(g.ctx, g.suite, id, g.bits)
+	}
+	if err == nil {
+		bucketSizes.observe(len(value))
+	}
+	queryStatsFrom(g.ctx).fetched(start, len(value))
+	return value, err
+}
+
+// suite returns the deployment suite serving version, or nil if it is not
+// supported.
+func (s *server) suite(version uint16) *cryptoSuite {
+	return suiteIn(s.suites, version)
+}
+
+// suiteIn returns the suite of suites serving version, or nil.
+func suiteIn(suites []*cryptoSuite, version uint16) *cryptoSuite {
+	for _, cs := range suites {
+		if cs.cfg.Version == version {
+			return cs
+		}
+	}
+	return nil
+}
+
+// suiteParam returns the deployment suite for the version query parameter of
+// req, see suiteParamIn.
+func (s *server) suiteParam(w http.ResponseWriter, req *http.Request) *cryptoSuite {
+	return suiteParamIn(w, req, s.suites)
+}
+
+// suiteParamIn returns the suite of suites for the version query parameter
+// of req, or the current one if it is not set. It writes an error response
+// and returns nil for an invalid or unsupported version.
+func suiteParamIn(w http.ResponseWriter, req *http.Request, suites []*cryptoSuite) *cryptoSuite {
+	v := req.URL.Query().Get("version")
+	if v == "" {
+		return suites[0]
+	}
+	version, err := strconv.ParseUint(v, 10, 16)
+	if err != nil {
+		writeError(w, "invalid version", http.StatusBadRequest)
+		return nil
+	}
+	cs := suiteIn(suites, uint16(version))
+	if cs == nil {
+		writeErrorCode(w, errUnsupportedVersion, "unsupported version", http.StatusNotFound)
+	}
+	return cs
+}
+
+// supportedVersions returns the versions of suites, current first.
+func supportedVersions(suites []*cryptoSuite) []string {
+	versions := make([]string, len(suites))
+	for i, cs := range suites {
+		versions[i] = fmt.Sprint(cs.cfg.Version)
+	}
+	return versions
+}
+
+// loadConfigs parses the MIGP server configurations from CONFIG_JSON, which
+// holds either a single configuration or an array of them. The first one is
+// the current suite, used for ingestion by default and advertised to new
+// clients. The others stay available to clients that still request them.
+func loadConfigs() ([]migp.ServerConfig, error) {
+	configJSON := strings.TrimSpace(os.Getenv("CONFIG_JSON"))
+	if configJSON == "" {
+		return nil, errors.New("CONFIG_JSON environment variable not set")
+	}
+	return parseConfigs("CONFIG_JSON", configJSON)
+}
+
+// parseConfigs parses configJSON, a single configuration or an array of
+// them, read from source.
+func parseConfigs(source, configJSON string) ([]migp.ServerConfig, error) {
+	var configs []migp.ServerConfig
+	if strings.HasPrefix(strings.TrimSpace(configJSON), "[") {
+		if err := json.Unmarshal([]byte(configJSON), &configs); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", source, err)
+		}
+	} else {
+		var config migp.ServerConfig
+		if err := json.Unmarshal([]byte(configJSON), &config); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", source, err)
+		}
+		configs = append(configs, config)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("%s holds no configuration", source)
+	}
+
+	seen := map[uint16]bool{}
+	for _, cfg := range configs {
+		if seen[cfg.Version] {
+			return nil, fmt.Errorf("%s holds MIGP version %d more than once", source, cfg.Version)
+		}
+		seen[cfg.Version] = true
+	}
+	return configs, nil
+}
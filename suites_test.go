@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestParseConfigs(t *testing.T) {
+	v1 := migp.DefaultServerConfig()
+	v2 := v1
+	v2.Version = v1.Version + 1
+	single, _ := json.Marshal(&v1)
+	pair, _ := json.Marshal([]*migp.ServerConfig{&v2, &v1})
+	duplicate, _ := json.Marshal([]*migp.ServerConfig{&v1, &v1})
+	for _, tt := range []struct {
+		name     string
+		json     string
+		versions []uint16
+	}{
+		{"single", string(single), []uint16{v1.Version}},
+		{"array", " " + string(pair), []uint16{v2.Version, v1.Version}},
+		{"empty array", "[]", nil},
+		{"duplicate version", string(duplicate), nil},
+		{"malformed", "{", nil},
+	} {
+		configs, err := parseConfigs("CONFIG_JSON", tt.json)
+		if tt.versions == nil {
+			if err == nil {
+				t.Errorf("%s: parsed %d configurations, want an error", tt.name, len(configs))
+			}
+			continue
+		}
+		if err != nil || len(configs) != len(tt.versions) {
+			t.Errorf("%s: %d configurations, %v", tt.name, len(configs), err)
+			continue
+		}
+		for i, cfg := range configs {
+			if cfg.Version != tt.versions[i] {
+				t.Errorf("%s: configuration %d has version %d, want %d", tt.name, i, cfg.Version, tt.versions[i])
+			}
+		}
+	}
+}
+
+func TestCryptoSuite(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	for _, bits := range []int{0, 33} {
+		invalid := cfg
+		invalid.BucketIDBitSize = bits
+		if _, err := newCryptoSuite(invalid); err == nil {
+			t.Errorf("bucket ID bit length %d accepted", bits)
+		}
+	}
+
+	current, err := newCryptoSuite(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := *current
+	next.cfg.Version = cfg.Version + 1
+	passwords := *current
+	passwords.namespace = "passwords"
+	for _, tt := range []struct {
+		cs   *cryptoSuite
+		want string
+	}{
+		{current, "0a1b2"},
+		{&next, "v2/0a1b2"},
+		{&passwords, "passwords/0a1b2"},
+	} {
+		if got := tt.cs.bucketKey("0a1b2"); got != tt.want {
+			t.Errorf("bucketKey of version %d in %q = %q, want %q", tt.cs.cfg.Version, tt.cs.namespace, got, tt.want)
+		}
+	}
+
+	suites := []*cryptoSuite{&next, current}
+	for _, tt := range []struct {
+		query  string
+		status int
+		suite  *cryptoSuite
+	}{
+		{"", http.StatusOK, &next},
+		{"?version=1", http.StatusOK, current},
+		{"?version=9", http.StatusNotFound, nil},
+		{"?version=one", http.StatusBadRequest, nil},
+	} {
+		rec := httptest.NewRecorder()
+		if cs := suiteParamIn(rec, httptest.NewRequest(http.MethodGet, "/api/config"+tt.query, nil), suites); cs != tt.suite || rec.Code != tt.status {
+			t.Errorf("suite for %q answered %d", tt.query, rec.Code)
+		}
+	}
+}
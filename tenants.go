@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// With TENANT_CONFIGS set, tenants can have MIGP keys and corpora of their
+// own. It maps tenant names, as tenantOf returns them, to configurations in
+// the format of CONFIG_JSON: a single one, or an array with the current
+// first, so that a tenant rotates its key by prepending a configuration with
+// a new version while its clients move over.
+//
+//	{"acme": {"version": 1, …, "privateKey": "…"}, "globex": [{"version": 2, …}, {"version": 1, …}]}
+//
+// The corpus of a tenant is stored under tenantNamespace and is only ever
+// read and written with its suites: queries, continuations, /api/config and
+// ingestion requests of the tenant are served by them alone, never by the
+// deployment suites or those of another tenant. A request is that of a
+// tenant only with a credential acting for it, see withTenantAuth, so that
+// naming a tenant in the tenant header does not reach its corpus. Tenants
+// without a configuration share the deployment suites and corpus. PIR
+// queries, which read the deployment bucket table, are refused for tenants
+// with a key.
+// Tenants can also keep their key in a Key Vault of their own, see byok.go.
+
+// tenantNamespace prefixes the storage keys of the corpus of tenant.
+func tenantNamespace(tenant string) string {
+	return "tenant/" + tenant
+}
+
+// validTenantName reports whether name can key a tenant corpus. Names are
+// restricted so that the storage keys of one tenant can never be those of
+// another.
+func validTenantName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// tenant is a tenant with a key of its own.
+type tenant struct {
+	name string
+
+	// configs holds the configurations of the tenant, current first, with
+	// their key references unresolved.
+	configs []json.RawMessage
+
+	// byok is set when a configuration references its key, see byok.go.
+	byok bool
+
+	// suites holds the suites of the tenant, nil while a referenced key is
+	// unavailable.
+	suites atomic.Pointer[[]*cryptoSuite]
+}
+
+// newTenants returns every tenant configured in TENANT_CONFIGS, or nil if it
+// is not set. Keys given in the configurations are loaded right away and
+// referenced ones as described in byok.go.
+func newTenants() (map[string]*tenant, error) {
+	configJSON := strings.TrimSpace(os.Getenv("TENANT_CONFIGS"))
+	if configJSON == "" {
+		return nil, nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(configJSON), &raw); err != nil {
+		return nil, fmt.Errorf("parsing TENANT_CONFIGS: %w", err)
+	}
+	tenants := map[string]*tenant{}
+	for name, data := range raw {
+		if !validTenantName(name) {
+			return nil, fmt.Errorf("TENANT_CONFIGS: invalid tenant name %q", name)
+		}
+		t := &tenant{name: name}
+		if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+			if err := json.Unmarshal(data, &t.configs); err != nil {
+				return nil, fmt.Errorf("parsing TENANT_CONFIGS tenant %s: %w", name, err)
+			}
+		} else {
+			t.configs = []json.RawMessage{data}
+		}
+		for _, cfg := range t.configs {
+			ref, err := tenantKeyRef(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("TENANT_CONFIGS tenant %s: %w", name, err)
+			}
+			t.byok = t.byok || ref != ""
+		}
+		if t.byok {
+			t.loadReferenced()
+		} else if err := t.load(context.Background()); err != nil {
+			return nil, err
+		}
+		tenants[name] = t
+	}
+	return tenants, nil
+}
+
+// load builds the suites of t, resolving its key references, and makes them
+// current.
+func (t *tenant) load(ctx context.Context) error {
+	resolved := make([]json.RawMessage, len(t.configs))
+	for i, cfg := range t.configs {
+		var err error
+		if resolved[i], err = resolveTenantKey(ctx, cfg); err != nil {
+			return fmt.Errorf("tenant %s: %w", t.name, err)
+		}
+	}
+	data, err := json.Marshal(resolved)
+	if err != nil {
+		return err
+	}
+	configs, err := parseConfigs("TENANT_CONFIGS tenant "+t.name, string(data))
+	if err != nil {
+		return err
+	}
+	suites := make([]*cryptoSuite, len(configs))
+	for i, cfg := range configs {
+		cs, err := newCryptoSuite(cfg)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", t.name, err)
+		}
+		cs.namespace = tenantNamespace(t.name)
+		suites[i] = cs
+	}
+	t.suites.Store(&suites)
+	return nil
+}
+
+// tenantSuites returns the suites serving tenant, current first: its own if
+// it has a key, and the deployment suites otherwise. It returns nil for a
+// tenant whose referenced key is unavailable.
+func (s *server) tenantSuites(tenant string) []*cryptoSuite {
+	if t, ok := s.tenants[tenant]; ok && tenant != "" {
+		if suites := t.suites.Load(); suites != nil {
+			return *suites
+		}
+		return nil
+	}
+	return s.suites
+}
+
+// tenantSuite returns the suite serving version for tenant, or nil if it
+// is not supported.
+func (s *server) tenantSuite(tenant string, version uint16) *cryptoSuite {
+	return suiteIn(s.tenantSuites(tenant), version)
+}
+
+// ownKey reports whether the tenant of req has a key of its own.
+func (s *server) ownKey(req *http.Request) bool {
+	tenant := tenantOf(req)
+	return tenant != "" && s.tenants[tenant] != nil
+}
+
+// tenantKeys returns the key fingerprints of the suites of every tenant with
+// a key, by tenant, leaving out those whose key is unavailable.
+func (s *server) tenantKeys() (map[string][]suiteKey, error) {
+	names := make([]string, 0, len(s.tenants))
+	for tenant := range s.tenants {
+		names = append(names, tenant)
+	}
+	sort.Strings(names)
+	keys := map[string][]suiteKey{}
+	for _, tenant := range names {
+		for _, cs := range s.tenantSuites(tenant) {
+			fingerprint, err := keyFingerprint(&cs.cfg)
+			if err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", tenant, err)
+			}
+			keys[tenant] = append(keys[tenant], suiteKey{Version: cs.cfg.Version, Fingerprint: fingerprint})
+		}
+	}
+	return keys, nil
+}
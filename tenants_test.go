@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	acme := migp.DefaultServerConfig()
+	acme.Version = 2
+	configs, err := json.Marshal(map[string]*migp.ServerConfig{"acme": &acme})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TENANT_CONFIGS", string(configs))
+	t.Setenv("API_KEYS", `{"acme-key": {"roles": ["query"], "tenant": "acme"}, "globex-key": {"roles": ["query"], "tenant": "globex"}}`)
+	s, srv := newTestServer(t)
+
+	result := s.ingestParallel(context.Background(), ingestRequest{Tenant: "acme", Credentials: []string{"user@example.com:password1"}}, 1, nil)
+	if result.Successes != 1 || result.Entries == 0 {
+		t.Fatalf("tenant ingestion %+v", result)
+	}
+
+	// unanswered stands for a query refused as unsupported.
+	const unanswered = migp.BreachStatus(255)
+	query := func(cfg migp.Config, key, tenant string) migp.BreachStatus {
+		t.Helper()
+		client, err := migp.NewClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, ctx, err := client.Request([]byte("user@example.com"), []byte("password1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/query", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		if tenant != "" {
+			req.Header.Set(tenantHeader(), tenant)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return unanswered
+		}
+		var response migp.ServerResponse
+		if err := response.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		status, _, err := ctx.Finalize(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	tests := []struct {
+		name   string
+		cfg    migp.Config
+		key    string
+		tenant string
+		want   migp.BreachStatus
+	}{
+		{"own tenant", acme.Config, "acme-key", "", migp.InBreach},
+		{"own tenant named", acme.Config, "acme-key", "acme", migp.InBreach},
+		{"deployment", s.suites[0].cfg.Config, "", "", migp.NotInBreach},
+		{"tenant without a key", s.suites[0].cfg.Config, "globex-key", "", migp.NotInBreach},
+		{"tenant version without it", acme.Config, "", "", unanswered},
+		{"deployment version for the tenant", s.suites[0].cfg.Config, "acme-key", "", unanswered},
+		{"another tenant", acme.Config, "globex-key", "acme", unanswered},
+		{"tenant named without a credential", acme.Config, "", "acme", unanswered},
+		{"tenant named by the admin", acme.Config, testAdminKey, "acme", migp.InBreach},
+	}
+	for _, tt := range tests {
+		if got := query(tt.cfg, tt.key, tt.tenant); got != tt.want {
+			t.Errorf("%s: status %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/config", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer acme-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-MIGP-Versions"); got != "2" {
+		t.Errorf("tenant config versions %q, want 2", got)
+	}
+
+	t.Setenv("TENANT_CONFIGS", `{"../acme": {}}`)
+	if _, err := newTenants(); err == nil {
+		t.Error("invalid tenant name accepted")
+	}
+}
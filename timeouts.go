@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Routes with distinct timeout budgets.
+const (
+	budgetQuery  = "query"
+	budgetIngest = "ingest"
+	budgetAdmin  = "admin"
+)
+
+// timeoutBudgets holds the time allowed for handling a request on each kind
+// of route, enforced through the request context so that storage calls
+// running past the budget are canceled in the database too.
+type timeoutBudgets struct {
+	routes map[string]time.Duration
+
+	// tenants overrides the route budgets per tenant, see tenantOf.
+	tenants map[string]map[string]time.Duration
+}
+
+// tenantOf returns the tenant of req, named in the TENANT_HEADER request
+// header (default X-MIGP-Tenant), or an empty string. withTenantAuth only
+// lets requests through with a tenant their credential acts for.
+func tenantOf(req *http.Request) string {
+	return req.Header.Get(tenantHeader())
+}
+
+// tenantHeader returns the name of the request header naming the tenant.
+func tenantHeader() string {
+	if header := os.Getenv("TENANT_HEADER"); header != "" {
+		return header
+	}
+	return "X-MIGP-Tenant"
+}
+
+// newTimeoutBudgets returns the budgets configured by QUERY_TIMEOUT,
+// INGEST_TIMEOUT and ADMIN_TIMEOUT, with per-tenant overrides from
+// TENANT_TIMEOUTS, a JSON object such as {"acme": {"query": "2s"}}. A zero
+// budget leaves the route unbounded.
+func newTimeoutBudgets() *timeoutBudgets {
+	b := &timeoutBudgets{
+		routes: map[string]time.Duration{
+			budgetQuery:  envDuration("QUERY_TIMEOUT", 5*time.Second),
+			budgetIngest: envDuration("INGEST_TIMEOUT", 5*time.Minute),
+			budgetAdmin:  envDuration("ADMIN_TIMEOUT", 30*time.Second),
+		},
+		tenants: map[string]map[string]time.Duration{},
+	}
+	if val := os.Getenv("TENANT_TIMEOUTS"); val != "" {
+		var overrides map[string]map[string]string
+		if err := json.Unmarshal([]byte(val), &overrides); err != nil {
+			log.Println("Invalid TENANT_TIMEOUTS value. Ignoring tenant overrides:", err)
+			return b
+		}
+		for tenant, routes := range overrides {
+			b.tenants[tenant] = map[string]time.Duration{}
+			for route, d := range routes {
+				if _, ok := b.routes[route]; !ok {
+					log.Printf("Ignoring TENANT_TIMEOUTS entry for unknown route %q of tenant %q", route, tenant)
+					continue
+				}
+				budget, err := time.ParseDuration(d)
+				if err != nil || budget < 0 {
+					log.Printf("Ignoring invalid TENANT_TIMEOUTS %s budget %q of tenant %q", route, d, tenant)
+					continue
+				}
+				b.tenants[tenant][route] = budget
+			}
+		}
+	}
+	return b
+}
+
+// budget returns the budget of route for tenant, which may be empty.
+func (b *timeoutBudgets) budget(route, tenant string) time.Duration {
+	if d, ok := b.tenants[tenant][route]; ok {
+		return d
+	}
+	return b.routes[route]
+}
+
+// withBudget runs h with the request context bounded by the budget of route
+// for the request's tenant.
+func (s *server) withBudget(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d := s.budgets.budget(route, tenantOf(req))
+		if d == 0 {
+			h(w, req)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.WithValue(req.Context(), unbudgetedContext{}, req.Context()), d)
+		defer cancel()
+		h(w, req.WithContext(ctx))
+	}
+}
+
+// unbudgetedContext is the context key of the request context before
+// withBudget bounded it.
+type unbudgetedContext struct{}
+
+// requestContext returns the context of req without its timeout budget, so
+// that a response meant to outlive the budget still ends with the request.
+func requestContext(req *http.Request) context.Context {
+	if ctx, ok := req.Context().Value(unbudgetedContext{}).(context.Context); ok {
+		return ctx
+	}
+	return req.Context()
+}
+
+// withBudgetInvocation runs f with its context bounded by the budget of
+// route.
+func (s *server) withBudgetInvocation(route string, f invocationFunc) invocationFunc {
+	return func(ctx context.Context, inv *invocationRequest, resp *invocationResponse) error {
+		if d := s.budgets.budget(route, ""); d > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+		return f(ctx, inv, resp)
+	}
+}
+
+// storageError responds to a failed storage call, with a 504 if it ran out of
+// its timeout budget.
+func storageError(w http.ResponseWriter, what string, err error) {
+	log.Printf("%s failed: %v", what, err)
+	code := http.StatusInternalServerError
+	if isContextError(err) {
+		code = http.StatusGatewayTimeout
+	}
+	writeError(w, http.StatusText(code), code)
+}
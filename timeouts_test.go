@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeoutBudgets(t *testing.T) {
+	t.Setenv("QUERY_TIMEOUT", "2s")
+	t.Setenv("ADMIN_TIMEOUT", "0s")
+	t.Setenv("TENANT_TIMEOUTS", `{"acme": {"query": "500ms", "ingest": "never", "unknown": "1s"}}`)
+	b := newTimeoutBudgets()
+	for _, tt := range []struct {
+		route, tenant string
+		want          time.Duration
+	}{
+		{budgetQuery, "", 2 * time.Second},
+		{budgetQuery, "acme", 500 * time.Millisecond},
+		{budgetIngest, "acme", 5 * time.Minute},
+		{budgetAdmin, "other", 0},
+	} {
+		if got := b.budget(tt.route, tt.tenant); got != tt.want {
+			t.Errorf("budget(%q, %q) = %s, want %s", tt.route, tt.tenant, got, tt.want)
+		}
+	}
+
+	t.Setenv("TENANT_TIMEOUTS", "{")
+	if b := newTimeoutBudgets(); len(b.tenants) != 0 || b.budget(budgetQuery, "acme") != 2*time.Second {
+		t.Errorf("malformed TENANT_TIMEOUTS applied: %v", b.tenants)
+	}
+}
+
+func TestWithBudget(t *testing.T) {
+	t.Setenv("QUERY_TIMEOUT", "10ms")
+	t.Setenv("TENANT_TIMEOUTS", `{"acme": {"query": "0s"}}`)
+	s, _ := newTestServer(t)
+	h := s.withBudget(budgetQuery, func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+			if requestContext(req).Err() != nil {
+				t.Error("budget canceled the request context")
+			}
+			storageError(w, "Test call", req.Context().Err())
+		case <-time.After(100 * time.Millisecond):
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPost, "/api/query", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("query past its budget answered %d, want %d", rec.Code, http.StatusGatewayTimeout)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/query", nil)
+	req.Header.Set(tenantHeader(), "acme")
+	start := time.Now()
+	rec = httptest.NewRecorder()
+	h(rec, req)
+	if rec.Code != http.StatusOK || time.Since(start) < 100*time.Millisecond {
+		t.Errorf("unbounded tenant answered %d after %s", rec.Code, time.Since(start))
+	}
+
+	rec = httptest.NewRecorder()
+	storageError(rec, "Test call", errors.New("connection refused"))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("storage failure answered %d", rec.Code)
+	}
+
+	f := s.withBudgetInvocation(budgetQuery, func(ctx context.Context, inv *invocationRequest, resp *invocationResponse) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err := f(context.Background(), nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("invocation past its budget returned %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// POST /api/auth/token exchanges a long-lived credential granting the query
+// role for a short-lived token granting only that role, so that browser and
+// WebAssembly clients can be handed a token instead of the key. The token is
+// bound to the tenant of the request, see withTenantAuth, and queries made
+// with it count as that tenant's. The body may only name another tenant for
+// a credential with the admin role that is bound to none; credentials
+// cannot otherwise mint tokens for tenants they do not act for. It expires
+// after the ttl of the body, at most AUTH_TOKEN_MAX_TTL (default 1h) and by
+// default AUTH_TOKEN_TTL (default 5m). Tokens are signed with
+// AUTH_TOKEN_SECRET, without which the route is disabled; changing the
+// secret revokes every token issued. With QUERY_AUTH_REQUIRED set the
+// tokens are then the only credential clients need.
+//
+//	{"tenant": "acme", "ttl": "10m"}
+//	→ {"token": "eyJ…", "tokenType": "Bearer", "expiresAt": "…", "scope": "query", "tenant": "acme"}
+
+const (
+	// issuedTokenKeyID is the key ID of the tokens the server issues,
+	// telling them apart from those of identity providers.
+	issuedTokenKeyID = "migp-issued"
+	// issuedTokenIssuer is the issuer claim of the tokens the server
+	// issues.
+	issuedTokenIssuer = "migp"
+)
+
+var tokensIssued = newCounter("migp_auth_tokens_issued_total", "Short-lived query tokens issued.")
+
+// tokenRequest is the body of a token request.
+type tokenRequest struct {
+	Tenant string `json:"tenant"`
+	TTL    string `json:"ttl"`
+}
+
+// tokenResponse is the body of a token response.
+type tokenResponse struct {
+	Token     string    `json:"token"`
+	TokenType string    `json:"tokenType"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Scope     string    `json:"scope"`
+	Tenant    string    `json:"tenant,omitempty"`
+}
+
+// issueToken returns an HS256 token of claims signed with secret.
+func issueToken(secret []byte, claims tokenClaims) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT", "kid": issuedTokenKeyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// newTokenHandler returns the handler issuing short-lived query tokens, see
+// above. Issued tokens cannot be exchanged for new ones, and a token bound
+// to a tenant only for one bound to the same tenant.
+func newTokenHandler() http.HandlerFunc {
+	c := newCredentials()
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if len(c.issuedSecret) == 0 {
+			writeErrorCode(w, errFeatureDisabled, "token issuance is disabled, set AUTH_TOKEN_SECRET", http.StatusNotFound)
+			return
+		}
+		p, ok := c.principal(req)
+		if !ok {
+			writeError(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if !grants(p.roles, roleQuery) || p.issued {
+			writeErrorCode(w, errForbidden, "credential cannot be exchanged for a query token", http.StatusForbidden)
+			return
+		}
+		issueQueryToken(w, req, c.issuedSecret, p)
+	}
+}
+
+// issueQueryToken responds with a query token for p signed with secret.
+func issueQueryToken(w http.ResponseWriter, req *http.Request, secret []byte, p principal) {
+	var body tokenRequest
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4<<10)).Decode(&body); err != nil {
+			invalid(errMalformedJSON, "malformed token request").write(w)
+			return
+		}
+	}
+	maxTTL := envDuration("AUTH_TOKEN_MAX_TTL", time.Hour)
+	ttl := envDuration("AUTH_TOKEN_TTL", 5*time.Minute)
+	if body.TTL != "" {
+		d, err := time.ParseDuration(body.TTL)
+		if err != nil || d <= 0 {
+			invalid(errInvalidRequest, "ttl must be a positive duration such as 5m").write(w)
+			return
+		}
+		ttl = d
+	}
+	ttl = min(ttl, maxTTL)
+	tenant := tenantOf(req)
+	if body.Tenant != "" && body.Tenant != tenant {
+		if p.tenant != "" || !grants(p.roles, roleAdmin) {
+			writeErrorCode(w, errForbidden, "credential does not act for tenant "+body.Tenant, http.StatusForbidden)
+			return
+		}
+		tenant = body.Tenant
+	}
+
+	now := time.Now()
+	expires := now.Add(ttl).Truncate(time.Second)
+	token, err := issueToken(secret, tokenClaims{
+		Issuer:    issuedTokenIssuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+		Scope:     roleQuery,
+		Tenant:    tenant,
+	})
+	if err != nil {
+		log.Println("Token issuance failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	tokensIssued.Inc()
+	writeJSON(w, http.StatusOK, tokenResponse{Token: token, TokenType: "Bearer", ExpiresAt: expires, Scope: roleQuery, Tenant: tenant})
+}
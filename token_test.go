@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssueToken(t *testing.T) {
+	t.Setenv("API_KEYS", `{"query-key": ["query"], "ingest-key": ["ingest"], "acme-key": {"roles": ["query"], "tenant": "acme"}}`)
+	t.Setenv("AUTH_TOKEN_SECRET", "token-secret")
+	t.Setenv("AUTH_TOKEN_MAX_TTL", "10m")
+	t.Setenv("QUERY_AUTH_REQUIRED", "true")
+	_, srv := newTestServer(t)
+
+	do := func(method, path, bearer, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	issue := func(bearer, body string) (tokenResponse, int) {
+		t.Helper()
+		resp := do(http.MethodPost, "/api/auth/token", bearer, body)
+		defer resp.Body.Close()
+		var tok tokenResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tok, resp.StatusCode
+	}
+
+	tok, status := issue("acme-key", `{"tenant": "acme", "ttl": "1h"}`)
+	if status != http.StatusOK || tok.Scope != roleQuery || tok.Tenant != "acme" {
+		t.Fatalf("issued %+v with status %d, want a query token for acme", tok, status)
+	}
+	if until := time.Until(tok.ExpiresAt); until > 10*time.Minute || until < 9*time.Minute {
+		t.Fatalf("token expires in %s, want the 10m maximum", until)
+	}
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		want   int
+	}{
+		{"query", http.MethodPost, "/api/query", http.StatusBadRequest},
+		{"admin", http.MethodGet, "/api/admin/jobs", http.StatusForbidden},
+		{"ingest", http.MethodPost, "/api/admin/seed", http.StatusForbidden},
+	} {
+		resp := do(tt.method, tt.path, tok.Token, "{")
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s with the token: status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+
+	if _, status := issue(tok.Token, ""); status != http.StatusForbidden {
+		t.Errorf("exchanging an issued token: status %d, want %d", status, http.StatusForbidden)
+	}
+	if _, status := issue("ingest-key", ""); status != http.StatusForbidden {
+		t.Errorf("exchanging an ingest key: status %d, want %d", status, http.StatusForbidden)
+	}
+	if _, status := issue("wrong-key", ""); status != http.StatusUnauthorized {
+		t.Errorf("exchanging an unknown key: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if _, status := issue("query-key", `{"tenant": "acme"}`); status != http.StatusForbidden {
+		t.Errorf("unbound key naming a tenant: status %d, want %d", status, http.StatusForbidden)
+	}
+	if _, status := issue("acme-key", `{"tenant": "globex"}`); status != http.StatusForbidden {
+		t.Errorf("key naming another tenant: status %d, want %d", status, http.StatusForbidden)
+	}
+	if tok, status := issue("query-key", ""); status != http.StatusOK || tok.Tenant != "" {
+		t.Errorf("unbound key: issued %+v with status %d, want a token bound to no tenant", tok, status)
+	}
+	if tok, status := issue(testAdminKey, `{"tenant": "globex"}`); status != http.StatusOK || tok.Tenant != "globex" {
+		t.Errorf("admin key naming a tenant: issued %+v with status %d", tok, status)
+	}
+	if _, status := issue("query-key", `{"ttl": "soon"}`); status != http.StatusBadRequest {
+		t.Errorf("invalid ttl: status %d, want %d", status, http.StatusBadRequest)
+	}
+}
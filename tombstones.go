@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// With STORAGE_TOMBSTONES=true, removing entries from a bucket in kv_store
+// marks their kv_store_shadow rows deleted and counts them in the tombstones
+// column of the bucket instead of rewriting it, so that a removal takes time
+// in the number of entries removed rather than in the size of the bucket.
+// Reads of a bucket with tombstones leave the marked entries out, and
+// compaction rewrites such buckets without them to reclaim the space. It
+// runs with maintenance unless COMPACT_ON_MAINTENANCE is false, and on POST
+// /api/admin/buckets/compact. Appending a tombstoned entry again clears its
+// tombstone.
+//
+// Split buckets are still rewritten on removal, as their sub-buckets are
+// served without the tombstones of the parent, and so are the buckets of
+// other backends.
+
+var tombstonesCompacted = newCounter("migp_tombstones_compacted_total", "Tombstoned bucket entries dropped by compaction.")
+
+// tombstonesEnabled reports whether removals tombstone entries.
+func tombstonesEnabled() bool {
+	return envBool("STORAGE_TOMBSTONES", false)
+}
+
+// tombstoneEntries marks values of the bucket stored under id deleted within
+// tx, which holds the row lock of the bucket, and returns the number that
+// were present. ok is false if the bucket has been split, so that it must be
+// rewritten instead.
+func (kv *kvStore) tombstoneEntries(ctx context.Context, tx *sql.Tx, id string, values [][]byte) (removed int, ok bool, err error) {
+	var split bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM bucket_splits WHERE id = $1)`, id).Scan(&split); err != nil || split {
+		return 0, false, err
+	}
+	query := `UPDATE kv_store_shadow SET deleted_at = now() WHERE id = $1 AND value = ANY($2) AND deleted_at IS NULL`
+	res, err := tx.ExecContext(ctx, query, id, pq.ByteaArray(values))
+	if err != nil {
+		return 0, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return 0, err == nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE kv_store SET tombstones = tombstones + $2, version = version + 1 WHERE id = $1`, id, n); err != nil {
+		return 0, false, err
+	}
+	return int(n), true, nil
+}
+
+// reviveEntry clears the tombstone of value in the bucket stored under id
+// within tx, which holds the row lock of the bucket, reporting whether it
+// had one. The entry is still stored until the bucket is compacted, so this
+// appends it again.
+func (kv *kvStore) reviveEntry(ctx context.Context, tx *sql.Tx, id string, value []byte) (bool, error) {
+	res, err := tx.ExecContext(ctx, `UPDATE kv_store_shadow SET deleted_at = NULL WHERE id = $1 AND value = $2 AND deleted_at IS NOT NULL`, id, value)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE kv_store SET tombstones = tombstones - 1, version = version + 1 WHERE id = $1`, id); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// dropTombstoned returns value, the stored contents of the bucket under id,
+// without its tombstoned entries.
+func (kv *kvStore) dropTombstoned(ctx context.Context, id string, value []byte) ([]byte, error) {
+	rows, err := kv.db().QueryContext(ctx, `SELECT value FROM kv_store_shadow WHERE id = $1 AND deleted_at IS NOT NULL`, id)
+	if err != nil {
+		return nil, err
+	}
+	deleted := map[string]bool{}
+	for rows.Next() {
+		var entry []byte
+		if err := rows.Scan(&entry); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		deleted[string(entry)] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(deleted) == 0 {
+		return value, err
+	}
+	entries, err := bucketEntries(value)
+	if err != nil {
+		return nil, err
+	}
+	live := make([]byte, 0, len(value))
+	for _, e := range entries {
+		if !deleted[string(e)] {
+			live = append(live, e...)
+		}
+	}
+	return live, nil
+}
+
+// compactResult reports the outcome of a compaction.
+type compactResult struct {
+	Buckets int `json:"buckets"`
+	Entries int `json:"entries"`
+}
+
+// compact rewrites every bucket with tombstones without its tombstoned
+// entries.
+func (s *server) compact(ctx context.Context) (compactResult, error) {
+	var result compactResult
+	rows, err := s.kv.db().QueryContext(ctx, `SELECT id FROM kv_store WHERE tombstones > 0 ORDER BY id`)
+	if err != nil {
+		return result, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return result, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	for _, key := range keys {
+		if err := maintenancePause(ctx); err != nil {
+			return result, err
+		}
+		n, err := s.kv.compactBucket(ctx, key)
+		if err != nil {
+			return result, err
+		}
+		result.Buckets++
+		result.Entries += n
+		tombstonesCompacted.Add(float64(n))
+	}
+	return result, nil
+}
+
+// compactBucket rewrites the bucket stored under id without its tombstoned
+// entries, returning the number dropped. The served contents do not change,
+// so the corpus generation is left alone.
+func (kv *kvStore) compactBucket(ctx context.Context, id string) (int, error) {
+	defer kv.observe(ctx, "compact", id, time.Now())
+	var dropped int
+	err := kv.retry(ctx, "compact", func() error {
+		tx, err := kv.db().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.ExecContext(ctx, `SELECT 1 FROM kv_store WHERE id = $1 FOR UPDATE`, id); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `DELETE FROM kv_store_shadow WHERE id = $1 AND deleted_at IS NOT NULL`, id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, rebuildBucketQuery, id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE kv_store SET tombstones = 0 WHERE id = $1`, id); err != nil {
+			return err
+		}
+		dropped = int(n)
+		return tx.Commit()
+	})
+	return dropped, err
+}
+
+// handleCompact starts a background job compacting the buckets with
+// tombstones, unless another instance is running one. Job progress is
+// reported through job events.
+func (s *server) handleCompact(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	release := s.lockJobRequest(w, req, "compact")
+	if release == nil {
+		return
+	}
+	jobID, err := randomID()
+	if err != nil {
+		release()
+		log.Println("Job ID generation failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	subject := "migp/jobs/" + jobID
+	s.events.Publish(eventJobStarted, subject, map[string]interface{}{"jobId": jobID, "type": "compact"})
+
+	go func() {
+		defer release()
+		start := time.Now()
+		result, err := s.compact(context.Background())
+		if err != nil {
+			log.Printf("Compaction job %s failed: %v", jobID, err)
+			s.events.Publish(eventJobFailed, subject, map[string]interface{}{"jobId": jobID, "error": err.Error(), "result": result})
+			return
+		}
+		log.Printf("Compaction job %s dropped %d entries from %d buckets in %s", jobID, result.Entries, result.Buckets, time.Since(start))
+		s.events.Publish(eventJobCompleted, subject, map[string]interface{}{"jobId": jobID, "result": result})
+	}()
+
+	s.acceptJob(w, req, jobID, map[string]string{"jobId": jobID})
+}
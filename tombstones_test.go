@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestTombstones(t *testing.T) {
+	t.Setenv("STORAGE_TOMBSTONES", "true")
+	s, _ := newDBTestServer(t)
+	ctx := context.Background()
+	key := testName(t) + "/tombstones"
+	t.Cleanup(func() {
+		s.kv.db().Exec(`DELETE FROM kv_store WHERE id = $1`, key)
+		s.kv.db().Exec(`DELETE FROM kv_store_shadow WHERE id = $1`, key)
+	})
+	entry := func() []byte {
+		e := make([]byte, migp.HeaderSize+8)
+		rand.Read(e)
+		binary.BigEndian.PutUint32(e[migp.HeaderSize-4:], 8)
+		return e
+	}
+	a, b := entry(), entry()
+
+	// Each step runs on the state the previous ones left.
+	tests := []struct {
+		name       string
+		run        func() error
+		want       [][]byte
+		tombstones int
+	}{
+		{"append", func() error {
+			for _, e := range [][]byte{a, b} {
+				if _, err := s.kv.AppendUnique(ctx, key, sql.NullInt64{}, e); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, [][]byte{a, b}, 0},
+		{"remove", func() error {
+			_, err := s.kv.RemoveEntries(ctx, key, [][]byte{a})
+			return err
+		}, [][]byte{b}, 1},
+		{"append again", func() error {
+			_, err := s.kv.AppendUnique(ctx, key, sql.NullInt64{}, a)
+			return err
+		}, [][]byte{a, b}, 0},
+		{"remove again", func() error {
+			_, err := s.kv.RemoveEntries(ctx, key, [][]byte{a})
+			return err
+		}, [][]byte{b}, 1},
+		{"compact", func() error {
+			_, err := s.kv.compactBucket(ctx, key)
+			return err
+		}, [][]byte{b}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.run(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.kv.Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := bytes.Join(tt.want, nil); !bytes.Equal(got, want) {
+				t.Fatalf("bucket holds %d bytes, want %d", len(got), len(want))
+			}
+			var tombstones int
+			if err := s.kv.db().QueryRow(`SELECT tombstones FROM kv_store WHERE id = $1`, key).Scan(&tombstones); err != nil {
+				t.Fatal(err)
+			}
+			if tombstones != tt.tombstones {
+				t.Fatalf("%d tombstones, want %d", tombstones, tt.tombstones)
+			}
+		})
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests are traced in the W3C Trace Context format: a request carrying a
+// traceparent header continues the caller's trace, and a span is recorded for
+// the request and for each of its storage calls. Whether a trace is exported
+// is decided once the request completes, so that failed and slow requests are
+// always kept while the rest are sampled at a low rate.
+
+var (
+	traceDecisions      = newCounter("migp_traces_total", "Completed request traces by sampling decision.", "decision")
+	traceExportFailures = newCounter("migp_trace_export_failures_total", "Sampled traces lost because the export queue was full or the collector failed.")
+)
+
+// Sampling decisions, in the order they are checked. A trace is kept for the
+// first that applies.
+const (
+	sampledParent = "parent"
+	sampledForced = "forced"
+	sampledError  = "error"
+	sampledSlow   = "slow"
+	sampledRate   = "rate"
+	notSampled    = "dropped"
+)
+
+// span is one timed operation of a trace.
+type span struct {
+	id         string
+	parent     string
+	name       string
+	start, end time.Time
+	failed     bool
+	attrs      map[string]string
+}
+
+// requestTrace collects the spans of one request until it completes.
+type requestTrace struct {
+	id            string
+	root          span
+	parentSampled bool
+
+	mu     sync.Mutex
+	route  string
+	status int
+	forced string
+	spans  []span
+}
+
+type traceContextKey struct{}
+
+// traceFrom returns the trace of the request ctx belongs to, or nil if it is
+// not traced.
+func traceFrom(ctx context.Context) *requestTrace {
+	t, _ := ctx.Value(traceContextKey{}).(*requestTrace)
+	return t
+}
+
+// recordSpan adds a span named name, which started at start and ends now, to
+// the trace of ctx. It does nothing if the request is not traced.
+func recordSpan(ctx context.Context, name string, start time.Time, failed bool, attrs map[string]string) {
+	t := traceFrom(ctx)
+	if t == nil {
+		return
+	}
+	sp := span{id: randomHex(8), parent: t.root.id, name: name, start: start, end: time.Now(), failed: failed, attrs: attrs}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, sp)
+}
+
+// keepTrace is the tail-based sampling hook: it marks the trace of ctx to be
+// exported whatever the sampling rate, for a reason that is not visible in the
+// response, such as a slow storage call within an otherwise fast request.
+func keepTrace(ctx context.Context, reason string) {
+	t := traceFrom(ctx)
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.forced == "" {
+		t.forced = reason
+	}
+}
+
+// routeRate is a sampling rate override for the routes under prefix.
+type routeRate struct {
+	prefix string
+	rate   float64
+}
+
+// traceSampler decides which completed traces are exported.
+type traceSampler struct {
+	rate   float64
+	routes []routeRate
+	errors bool
+	slow   time.Duration
+}
+
+// newTraceSampler returns the sampler configured by TRACE_SAMPLE_RATE
+// (default 0.01), TRACE_SAMPLE_ROUTES, a comma-separated list of
+// path-prefix=rate overrides such as "/api/admin/=1,/api/query=0.001" where
+// the longest matching prefix applies, TRACE_SAMPLE_ERRORS (default true)
+// keeping every request answered with a server error, and TRACE_SAMPLE_SLOW
+// (default 1s, 0 to disable) keeping every request taking at least that long.
+func newTraceSampler() *traceSampler {
+	ts := &traceSampler{
+		rate:   0.01,
+		errors: envBool("TRACE_SAMPLE_ERRORS", true),
+		slow:   envDuration("TRACE_SAMPLE_SLOW", time.Second),
+	}
+	if _, ok := os.LookupEnv("TRACE_SAMPLE_RATE"); ok {
+		ts.rate = envRate("TRACE_SAMPLE_RATE")
+	}
+	for _, entry := range strings.Split(os.Getenv("TRACE_SAMPLE_ROUTES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, val, ok := strings.Cut(entry, "=")
+		rate, err := strconv.ParseFloat(val, 64)
+		if !ok || !strings.HasPrefix(prefix, "/") || err != nil || rate < 0 || rate > 1 {
+			log.Printf("Ignoring invalid TRACE_SAMPLE_ROUTES entry %q", entry)
+			continue
+		}
+		ts.routes = append(ts.routes, routeRate{prefix, rate})
+	}
+	sort.Slice(ts.routes, func(i, j int) bool { return len(ts.routes[i].prefix) > len(ts.routes[j].prefix) })
+	return ts
+}
+
+// routeRate returns the sampling rate of the route at path.
+func (ts *traceSampler) routeRate(path string) float64 {
+	for _, r := range ts.routes {
+		if strings.HasPrefix(path, r.prefix) {
+			return r.rate
+		}
+	}
+	return ts.rate
+}
+
+// decide returns the sampling decision for t, a completed request that took
+// elapsed. The caller must hold t.mu.
+func (ts *traceSampler) decide(t *requestTrace, elapsed time.Duration) string {
+	switch {
+	case t.parentSampled:
+		return sampledParent
+	case t.forced != "":
+		return sampledForced
+	case ts.errors && t.status >= 500:
+		return sampledError
+	case ts.slow > 0 && elapsed >= ts.slow:
+		return sampledSlow
+	case mathrand.Float64() < ts.routeRate(t.route):
+		return sampledRate
+	}
+	return notSampled
+}
+
+// tracer traces requests and exports sampled traces to an OTLP/HTTP collector.
+type tracer struct {
+	sampler  *traceSampler
+	endpoint string
+	service  string
+	client   *http.Client
+	queue    chan *requestTrace
+}
+
+// newTracer returns a tracer exporting to TRACE_EXPORT_URL, the OTLP/HTTP
+// traces endpoint of a collector such as http://localhost:4318/v1/traces, or
+// nil if it is unset. Spans are reported under OTEL_SERVICE_NAME (default
+// migp-server).
+func newTracer() *tracer {
+	endpoint := os.Getenv("TRACE_EXPORT_URL")
+	if endpoint == "" {
+		return nil
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "migp-server"
+	}
+	t := &tracer{
+		sampler:  newTraceSampler(),
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: envDuration("TRACE_EXPORT_TIMEOUT", 5*time.Second)},
+		queue:    make(chan *requestTrace, envInt("TRACE_EXPORT_QUEUE", 256)),
+	}
+	go t.export()
+	return t
+}
+
+// statusRecorder passes a response through while recording its status.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController flush streamed responses.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// wrap traces the requests served by h. A nil tracer returns h. Requests the
+// Functions host wraps in an invocation envelope reach h again once
+// unwrapped; the inner request is recorded as a span of the envelope's trace,
+// and its route and status are the ones sampled.
+func (t *tracer) wrap(h http.Handler) http.Handler {
+	if t == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		if outer := traceFrom(req.Context()); outer != nil {
+			h.ServeHTTP(rec, req)
+			recordSpan(req.Context(), req.Method+" "+req.URL.Path, start, rec.status >= 500, nil)
+			outer.mu.Lock()
+			outer.route, outer.status = req.URL.Path, rec.status
+			outer.mu.Unlock()
+			return
+		}
+
+		tr := newRequestTrace(req.Header.Get("traceparent"))
+		tr.route = req.URL.Path
+		tr.root.name = req.Method + " " + req.URL.Path
+		tr.root.start = start
+		h.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), traceContextKey{}, tr)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		if tr.status == 0 {
+			tr.status = rec.status
+		}
+		tr.root.end = time.Now()
+		tr.root.failed = tr.status >= 500
+		tr.root.attrs = map[string]string{
+			"http.request.method":       req.Method,
+			"url.path":                  tr.route,
+			"http.response.status_code": strconv.Itoa(tr.status),
+		}
+		decision := t.sampler.decide(tr, tr.root.end.Sub(start))
+		traceDecisions.Inc(decision)
+		if decision == notSampled {
+			return
+		}
+		tr.root.attrs["sampling.decision"] = decision
+		select {
+		case t.queue <- tr:
+		default:
+			traceExportFailures.Inc()
+		}
+	})
+}
+
+// newRequestTrace starts a trace continuing traceparent if it is valid, and a
+// new trace otherwise.
+func newRequestTrace(traceparent string) *requestTrace {
+	tr := &requestTrace{root: span{id: randomHex(8)}}
+	parts := strings.Split(traceparent, "-")
+	if len(parts) == 4 && parts[0] == "00" && isTraceHex(parts[1], 32) && isTraceHex(parts[2], 16) && len(parts[3]) == 2 && isLowerHex(parts[3]) {
+		flags, _ := strconv.ParseUint(parts[3], 16, 8)
+		tr.id, tr.root.parent, tr.parentSampled = parts[1], parts[2], flags&1 == 1
+		return tr
+	}
+	tr.id = randomHex(16)
+	return tr
+}
+
+// isTraceHex reports whether s is a non-zero lowercase hex string of the
+// given length, as trace context IDs must be.
+func isTraceHex(s string, length int) bool {
+	return len(s) == length && strings.Trim(s, "0") != "" && isLowerHex(s)
+}
+
+// isLowerHex reports whether s only holds lowercase hex digits.
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns n random bytes hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b) // never fails since Go 1.24
+	return hex.EncodeToString(b)
+}
+
+// export posts the queued traces to the collector, one request per trace.
+func (t *tracer) export() {
+	for tr := range t.queue {
+		if err := t.post(tr); err != nil {
+			traceExportFailures.Inc()
+			log.Println("Trace export failed:", err)
+		}
+	}
+}
+
+// OTLP/HTTP JSON encoding of spans, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+type (
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpStatus struct {
+		Code int `json:"code"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+)
+
+// OTLP span kinds and status codes used by the tracer.
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+)
+
+// otlpAttributes converts attrs in a stable order.
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]otlpAttribute, len(keys))
+	for i, k := range keys {
+		out[i] = otlpAttribute{k, otlpValue{attrs[k]}}
+	}
+	return out
+}
+
+// encode converts sp, a span of trace traceID, for export.
+func (sp span) encode(traceID string, kind int) otlpSpan {
+	status := otlpStatusOK
+	if sp.failed {
+		status = otlpStatusError
+	}
+	return otlpSpan{
+		TraceID:           traceID,
+		SpanID:            sp.id,
+		ParentSpanID:      sp.parent,
+		Name:              sp.name,
+		Kind:              kind,
+		StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+		Attributes:        otlpAttributes(sp.attrs),
+		Status:            otlpStatus{status},
+	}
+}
+
+// post sends the spans of tr to the collector.
+func (t *tracer) post(tr *requestTrace) error {
+	tr.mu.Lock()
+	spans := []otlpSpan{tr.root.encode(tr.id, otlpKindServer)}
+	for _, sp := range tr.spans {
+		spans = append(spans, sp.encode(tr.id, otlpKindInternal))
+	}
+	tr.mu.Unlock()
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{{"service.name", otlpValue{t.service}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "be-az-func"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with status code %d", resp.StatusCode)
+	}
+	return nil
+}
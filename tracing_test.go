@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewRequestTrace(t *testing.T) {
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	for _, tt := range []struct {
+		traceparent string
+		continued   bool
+		sampled     bool
+	}{
+		{"00-" + traceID + "-" + parentID + "-01", true, true},
+		{"00-" + traceID + "-" + parentID + "-00", true, false},
+		{"01-" + traceID + "-" + parentID + "-01", false, false},
+		{"00-00000000000000000000000000000000-" + parentID + "-01", false, false},
+		{"00-" + traceID + "-00F067AA0BA902B7-01", false, false},
+		{"", false, false},
+	} {
+		tr := newRequestTrace(tt.traceparent)
+		if continued := tr.id == traceID && tr.root.parent == parentID; continued != tt.continued || tr.parentSampled != tt.sampled {
+			t.Errorf("traceparent %q continued %v and sampled %v, want %v and %v", tt.traceparent, continued, tr.parentSampled, tt.continued, tt.sampled)
+		}
+		if !isTraceHex(tr.id, 32) || !isTraceHex(tr.root.id, 16) {
+			t.Errorf("traceparent %q started trace %q span %q", tt.traceparent, tr.id, tr.root.id)
+		}
+	}
+}
+
+func TestTraceSampler(t *testing.T) {
+	t.Setenv("TRACE_SAMPLE_RATE", "0")
+	t.Setenv("TRACE_SAMPLE_ROUTES", "/api/=0.5, /api/admin/=1, query=1, /api/query=2")
+	t.Setenv("TRACE_SAMPLE_SLOW", "100ms")
+	ts := newTraceSampler()
+	for path, want := range map[string]float64{"/api/admin/stats": 1, "/api/query": 0.5, "/health": 0} {
+		if got := ts.routeRate(path); got != want {
+			t.Errorf("routeRate(%q) = %g, want %g", path, got, want)
+		}
+	}
+	for _, tt := range []struct {
+		trace   *requestTrace
+		elapsed time.Duration
+		want    string
+	}{
+		{&requestTrace{parentSampled: true, route: "/health"}, 0, sampledParent},
+		{&requestTrace{forced: "slow_storage", route: "/health"}, 0, sampledForced},
+		{&requestTrace{status: http.StatusServiceUnavailable, route: "/health"}, 0, sampledError},
+		{&requestTrace{status: http.StatusOK, route: "/health"}, time.Second, sampledSlow},
+		{&requestTrace{status: http.StatusOK, route: "/api/admin/db"}, 0, sampledRate},
+		{&requestTrace{status: http.StatusNotFound, route: "/health"}, 0, notSampled},
+	} {
+		if got := ts.decide(tt.trace, tt.elapsed); got != tt.want {
+			t.Errorf("decision for route %s status %d after %s is %s, want %s", tt.trace.route, tt.trace.status, tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	exported := make(chan []otlpSpan, 4)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var payload struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		exported <- payload.ResourceSpans[0].ScopeSpans[0].Spans
+	}))
+	defer collector.Close()
+
+	if newTracer() != nil {
+		t.Fatal("tracer enabled without TRACE_EXPORT_URL")
+	}
+	t.Setenv("TRACE_EXPORT_URL", collector.URL)
+	t.Setenv("TRACE_SAMPLE_RATE", "0")
+	tr := newTracer()
+	h := tr.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		recordSpan(req.Context(), "storage get", time.Now(), false, map[string]string{"bucket": "0a1b2"})
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	dropped := func() float64 {
+		v, _, _, _ := traceDecisions.total(func(v []string) bool { return v[0] == notSampled })
+		return v
+	}
+
+	before := dropped()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ok", nil))
+	if dropped() != before+1 {
+		t.Error("successful request not dropped at rate 0")
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fail", nil))
+	select {
+	case spans := <-exported:
+		if len(spans) != 2 || spans[0].Name != "GET /fail" || spans[0].Status.Code != otlpStatusError || spans[1].ParentSpanID != spans[0].SpanID || spans[1].TraceID != spans[0].TraceID {
+			t.Errorf("exported spans %+v, want the failed request and its storage call", spans)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed request trace not exported")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/cloudflare/circl/group"
+	"github.com/cloudflare/circl/oprf"
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// Error codes for requests failing validation, see errors.go.
+const (
+	errMalformedJSON       = "malformed_json"
+	errMissingField        = "missing_field"
+	errInvalidBucketID     = "invalid_bucket_id"
+	errInvalidBucketIDBits = "invalid_bucket_id_bits"
+	errInvalidBlindElement = "invalid_blind_element"
+)
+
+var requestsInvalid = newCounter("migp_requests_invalid_total", "Queries rejected by validation by error code.", "code")
+
+// oprfGroups maps OPRF suites to their prime-order group.
+var oprfGroups = map[oprf.SuiteID]group.Group{
+	oprf.OPRFP256: group.P256,
+	oprf.OPRFP384: group.P384,
+	oprf.OPRFP521: group.P521,
+}
+
+// validationError is a request validation failure, reported to the client
+// with a specific error code.
+type validationError struct {
+	code    string
+	message string
+}
+
+func (e *validationError) Error() string { return e.message }
+
+// write responds to the request with a 400 describing e.
+func (e *validationError) write(w http.ResponseWriter) {
+	requestsInvalid.Inc(e.code)
+	writeErrorCode(w, e.code, e.message, http.StatusBadRequest)
+}
+
+func invalid(code, format string, args ...interface{}) *validationError {
+	return &validationError{code, fmt.Sprintf(format, args...)}
+}
+
+// validateVersion returns the suite serving version for tenant.
+func (s *server) validateVersion(tenant string, version uint32) (*cryptoSuite, *validationError) {
+	if version == 0 {
+		return nil, invalid(errMissingField, "version is required")
+	}
+	cs := s.tenantSuite(tenant, uint16(version))
+	if cs == nil || version > 0xffff {
+		return nil, invalid(errUnsupportedVersion, "unsupported version %d", version)
+	}
+	return cs, nil
+}
+
+// validateQuery checks request, a query for a bucket ID of the given bit
+// length (0 for the suite's own), against cs before any cryptographic or
+// storage work is done.
+func validateQuery(cs *cryptoSuite, request migp.ClientRequest, bits int) *validationError {
+	if bits < 0 || bits > 32 {
+		return invalid(errInvalidBucketIDBits, "bucketIDBitSize must be between 0 and 32, got %d", bits)
+	}
+	if bits < cs.cfg.BucketIDBitSize {
+		bits = cs.cfg.BucketIDBitSize
+	}
+	if request.BucketID == "" {
+		return invalid(errMissingField, "bucketId is required")
+	}
+	if err := validateBucketID(request.BucketID, bits); err != nil {
+		return err
+	}
+	return validateBlindElement(cs, request.BlindElement)
+}
+
+// validateBucketID checks that id is the hex encoding of a 32-bit integer
+// that fits in bits.
+func validateBucketID(id string, bits int) *validationError {
+	raw, err := hex.DecodeString(id)
+	if err != nil || len(raw) != 4 {
+		return invalid(errInvalidBucketID, "bucketId must be 8 hex digits")
+	}
+	if bits < 32 && uint64(binary.BigEndian.Uint32(raw)) >= 1<<bits {
+		return invalid(errInvalidBucketID, "bucketId out of range for a %d-bit bucket ID", bits)
+	}
+	return nil
+}
+
+// validateBlindElement checks that element is a serialized element of the
+// OPRF group of cs other than the identity.
+func validateBlindElement(cs *cryptoSuite, element []byte) *validationError {
+	if len(element) == 0 {
+		return invalid(errMissingField, "blindElement is required")
+	}
+	g, ok := oprfGroups[cs.cfg.OPRFSuite]
+	if !ok {
+		// The suite was accepted by migp, so element checks are left to it.
+		return nil
+	}
+	if n := g.Params().CompressedElementLength; uint(len(element)) != n {
+		return invalid(errInvalidBlindElement, "blindElement must be %d bytes, got %d", n, len(element))
+	}
+	e := g.NewElement()
+	if err := e.UnmarshalBinary(element); err != nil {
+		return invalid(errInvalidBlindElement, "blindElement is not a valid group element")
+	}
+	if e.IsIdentity() {
+		return invalid(errInvalidBlindElement, "blindElement must not be the identity element")
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestDecodeQuery(t *testing.T) {
+	s, srv := newTestServer(t)
+	client, err := migp.NewClient(s.suites[0].cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, _, err := client.Request([]byte("validate@example.com"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(edit func(map[string]interface{})) []byte {
+		var fields map[string]interface{}
+		body, _ := json.Marshal(valid)
+		json.Unmarshal(body, &fields)
+		edit(fields)
+		body, _ = json.Marshal(fields)
+		return body
+	}
+	for _, tt := range []struct {
+		name string
+		body []byte
+		code string
+	}{
+		{"valid", query(func(map[string]interface{}) {}), ""},
+		{"malformed", []byte(`{"version": "1"`), errMalformedJSON},
+		{"no version", query(func(f map[string]interface{}) { delete(f, "version") }), errMissingField},
+		{"unknown version", query(func(f map[string]interface{}) { f["version"] = 9 }), errUnsupportedVersion},
+		{"version overflow", query(func(f map[string]interface{}) { f["version"] = 1<<16 + 1 }), errUnsupportedVersion},
+		{"no bucket", query(func(f map[string]interface{}) { delete(f, "bucketID") }), errMissingField},
+		{"bucket not hex", query(func(f map[string]interface{}) { f["bucketID"] = "0000000g" }), errInvalidBucketID},
+		{"bucket out of range", query(func(f map[string]interface{}) { f["bucketID"] = "ffffffff" }), errInvalidBucketID},
+		{"bit length", query(func(f map[string]interface{}) { f["bucketIDBitSize"] = 33 }), errInvalidBucketIDBits},
+		{"no element", query(func(f map[string]interface{}) { delete(f, "blindElement") }), errMissingField},
+		{"short element", query(func(f map[string]interface{}) { f["blindElement"] = []byte{2, 1} }), errInvalidBlindElement},
+		{"off-curve element", query(func(f map[string]interface{}) { f["blindElement"] = append([]byte{5}, make([]byte, 32)...) }), errInvalidBlindElement},
+	} {
+		_, _, verr := s.decodeQuery("", tt.body)
+		switch {
+		case verr == nil && tt.code != "":
+			t.Errorf("%s: accepted, want %s", tt.name, tt.code)
+		case verr != nil && verr.code != tt.code:
+			t.Errorf("%s: rejected with %s: %s, want %q", tt.name, verr.code, verr.message, tt.code)
+		}
+	}
+
+	resp, err := http.Post(srv.URL+"/api/query", "application/json", bytes.NewReader(query(func(f map[string]interface{}) { f["bucketID"] = "ffffffff" })))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env errorEnvelope
+	err = json.NewDecoder(resp.Body).Decode(&env)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusBadRequest || env.Code != errInvalidBucketID || env.Retryable {
+		t.Errorf("invalid query answered %d with %+v", resp.StatusCode, env)
+	}
+}
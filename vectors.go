@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+// vectorKeySeed derives the OPRF key used for golden vectors. The key is
+// public, so vectors never involve the deployment's own key.
+var vectorKeySeed = []byte("MIGP golden vector test key")
+
+// vectorFixtures is the fixed breach corpus that golden vectors are generated
+// from. A username-only entry has an empty password.
+var vectorFixtures = []struct {
+	username string
+	password string
+	flag     migp.MetadataType
+	metadata string
+}{
+	{"alice@example.com", "correct horse battery staple", migp.MetadataBreachedPassword, "golden-vector-breach"},
+	{"alice@example.com", "", migp.MetadataBreachedUsername, "golden-vector-breach"},
+	{"alice@example.com", "correct horse battery staple1", migp.MetadataSimilarPassword, "golden-vector-breach"},
+	{"bob@example.com", "hunter2", migp.MetadataBreachedPassword, ""},
+}
+
+// vectorMisses are credentials queried against the fixture corpus that must
+// not be found.
+var vectorMisses = [][2]string{
+	{"alice@example.com", "Tr0ub4dor&3"},
+	{"carol@example.com", "hunter2"},
+}
+
+// goldenVectors is a set of known-answer tests for client implementers. All
+// byte strings are hex encoded.
+type goldenVectors struct {
+	Config     migp.Config       `json:"config"`
+	PrivateKey string            `json:"privateKey"`
+	PublicKey  string            `json:"publicKey"`
+	Buckets    map[string]string `json:"buckets"`
+	Vectors    []goldenVector    `json:"vectors"`
+
+	server  *migp.Server
+	buckets fixtureBuckets
+}
+
+// goldenVector is the expected protocol trace of a single query. OPRFInput
+// is the slow hash of the serialized credential, and OPRFOutput is the value
+// a client must obtain after unblinding the server's evaluation.
+type goldenVector struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	BucketID   string `json:"bucketID"`
+	OPRFInput  string `json:"oprfInput"`
+	OPRFOutput string `json:"oprfOutput"`
+	Status     string `json:"status"`
+	Metadata   string `json:"metadata"`
+}
+
+// fixtureBuckets is an in-memory migp.Getter holding the fixture corpus.
+type fixtureBuckets map[string][]byte
+
+// Get returns the contents of the bucket identified by id.
+func (b fixtureBuckets) Get(id string) ([]byte, error) {
+	return b[id], nil
+}
+
+// newGoldenVectors generates golden vectors for the parameters in cfg under
+// the public test key. Every vector is checked by running a full query
+// against the fixture corpus.
+func newGoldenVectors(cfg migp.Config) (*goldenVectors, error) {
+	privateKey, err := oprf.DeriveKey(cfg.OPRFSuite, oprf.BaseMode, vectorKeySeed)
+	if err != nil {
+		return nil, err
+	}
+	server, err := migp.NewServer(migp.ServerConfig{Config: cfg, PrivateKey: privateKey})
+	if err != nil {
+		return nil, err
+	}
+	oprfServer, err := oprf.NewServer(cfg.OPRFSuite, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	slowHasher, err := migp.NewSlowHasher(cfg.SlowHasherID)
+	if err != nil {
+		return nil, err
+	}
+	client, err := migp.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &goldenVectors{Config: cfg, Buckets: map[string]string{}, server: server, buckets: fixtureBuckets{}}
+	serializedPrivateKey, err := privateKey.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	serializedPublicKey, err := privateKey.Public().Serialize()
+	if err != nil {
+		return nil, err
+	}
+	v.PrivateKey = hex.EncodeToString(serializedPrivateKey)
+	v.PublicKey = hex.EncodeToString(serializedPublicKey)
+
+	queries := [][2]string{}
+	for _, f := range vectorFixtures {
+		entry, err := server.EncryptBucketEntry([]byte(f.username), []byte(f.password), f.flag, []byte(f.metadata))
+		if err != nil {
+			return nil, err
+		}
+		bucketID := migp.BucketIDToHex(server.BucketID([]byte(f.username)))
+		v.buckets[bucketID] = append(v.buckets[bucketID], entry...)
+		queries = append(queries, [2]string{f.username, f.password})
+	}
+	for id, contents := range v.buckets {
+		v.Buckets[id] = hex.EncodeToString(contents)
+	}
+
+	for _, q := range append(queries, vectorMisses...) {
+		username, password := []byte(q[0]), []byte(q[1])
+		input := slowHasher.Hash(serializeCredential(username, password))
+		output, err := oprfServer.FullEvaluate(input, migp.OprfInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		request, ctx, err := client.Request(username, password)
+		if err != nil {
+			return nil, err
+		}
+		response, err := server.HandleRequest(request, v.buckets)
+		if err != nil {
+			return nil, err
+		}
+		status, metadata, err := ctx.Finalize(response)
+		if err != nil {
+			return nil, fmt.Errorf("finalizing vector for %s: %w", username, err)
+		}
+
+		v.Vectors = append(v.Vectors, goldenVector{
+			Username:   q[0],
+			Password:   q[1],
+			BucketID:   request.BucketID,
+			OPRFInput:  hex.EncodeToString(input),
+			OPRFOutput: hex.EncodeToString(output),
+			Status:     status.String(),
+			Metadata:   string(metadata),
+		})
+	}
+	return v, nil
+}
+
+// serializeCredential encodes a credential as the OPRF input does before slow
+// hashing: each field is prefixed with its 16-bit big-endian length.
+func serializeCredential(username, password []byte) []byte {
+	buf := make([]byte, 0, 4+len(username)+len(password))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(username)))
+	buf = append(buf, username...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(password)))
+	return append(buf, password...)
+}
+
+// goldenVectors returns the golden vectors for the server's parameters,
+// generating them on first use.
+func (s *server) goldenVectors() (*goldenVectors, error) {
+	s.vectorsOnce.Do(func() {
+		s.vectors, s.vectorsErr = newGoldenVectors(s.cfg.Config)
+	})
+	return s.vectors, s.vectorsErr
+}
+
+// handleVectors serves golden vectors. GET returns the vector set, and POST
+// answers a client request under the test key against the fixture corpus, so
+// that implementers can check their blinding and response parsing. It is
+// only available when the debug_endpoints feature flag is enabled.
+func (s *server) handleVectors(w http.ResponseWriter, req *http.Request) {
+	if !s.flagEnabled(flagDebugEndpoints, req) {
+		writeErrorCode(w, errFeatureDisabled, "debug endpoints are disabled, enable the debug_endpoints feature flag", http.StatusForbidden)
+		return
+	}
+	vectors, err := s.goldenVectors()
+	if err != nil {
+		log.Println("Generating golden vectors failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, vectors)
+
+	case http.MethodPost:
+		var request migp.ClientRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			log.Println("Request body unmarshal failed:", err)
+			writeError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		response, err := vectors.server.HandleRequest(request, vectors.buckets)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := writeMIGPResponse(w, &response); err != nil {
+			log.Println("Writing response failed:", err)
+		}
+
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// runVectors implements the vectors command, which prints the golden vectors
+// for the parameters in CONFIG_JSON, or the default parameters if it is not
+// set.
+func runVectors() error {
+	cfg := migp.DefaultConfig()
+	if os.Getenv("CONFIG_JSON") != "" {
+		serverConfig, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		cfg = serverConfig.Config
+	}
+
+	vectors, err := newGoldenVectors(cfg)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(vectors)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/erikathea/migp-go/pkg/migp"
+)
+
+func TestGoldenVectorsDeterministic(t *testing.T) {
+	a, err := newGoldenVectors(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newGoldenVectors(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.PrivateKey != b.PrivateKey || !reflect.DeepEqual(a.Buckets, b.Buckets) {
+		t.Fatal("key or fixture buckets differ between generations")
+	}
+	if len(a.Vectors) != len(vectorFixtures)+len(vectorMisses) {
+		t.Fatalf("%d vectors, want one per fixture and miss", len(a.Vectors))
+	}
+	for i, v := range a.Vectors {
+		if v.OPRFOutput != b.Vectors[i].OPRFOutput {
+			t.Errorf("OPRF output for %s differs between generations", v.Username)
+		}
+		if i >= len(vectorFixtures) && v.Status != migp.NotInBreach.String() {
+			t.Errorf("miss %s:%s has status %s", v.Username, v.Password, v.Status)
+		}
+	}
+}
+
+func TestHandleVectors(t *testing.T) {
+	_, srv := newTestServer(t)
+	resp, err := http.Get(srv.URL + "/api/debug/vectors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("vectors without the debug_endpoints flag answered %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	t.Setenv("DEBUG_ENDPOINTS_ENABLED", "true")
+	resp, err = http.Get(srv.URL + "/api/debug/vectors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors goldenVectors
+	err = json.NewDecoder(resp.Body).Decode(&vectors)
+	resp.Body.Close()
+	if err != nil || len(vectors.Vectors) == 0 {
+		t.Fatalf("vectors %+v, %v", vectors, err)
+	}
+
+	client, err := migp.NewClient(vectors.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vectors.Vectors {
+		req, ctx, err := client.Request([]byte(v.Username), []byte(v.Password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := queryStatus(http.DefaultClient, srv.URL+"/api/debug/vectors", body, ctx, 0)
+		if err != nil || status.String() != v.Status {
+			t.Errorf("query for %s:%s finalized to %v, %v, want %s", v.Username, v.Password, status, err, v.Status)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// The build metadata of the binary is set at build time with
+//
+//	go build -ldflags "-X main.buildVersion=1.4.0 -X main.buildCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// and otherwise taken from what the Go toolchain records: the module version,
+// and the commit and time of the checkout when built in a git repository.
+// /version serves it with the build tags and the feature flags enabled for
+// the deployment, so that support can tell what is deployed from a single
+// request, and the version command prints it.
+var (
+	buildVersion string
+	buildCommit  string
+	buildDate    string
+)
+
+// buildReport describes the build of the running binary.
+type buildReport struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	Date      string   `json:"date,omitempty"`
+	Modified  bool     `json:"modified,omitempty"`
+	GoVersion string   `json:"goVersion"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// runningBuild returns the build of the running binary, see above.
+var runningBuild = sync.OnceValue(func() buildReport {
+	r := buildReport{Version: "dev", GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v := info.Main.Version; v != "" && v != "(devel)" {
+			r.Version = strings.TrimPrefix(v, "v")
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				r.Commit = setting.Value
+			case "vcs.time":
+				r.Date = setting.Value
+			case "vcs.modified":
+				r.Modified = setting.Value == "true"
+			case "-tags":
+				r.Tags = strings.Split(setting.Value, ",")
+			}
+		}
+	}
+	if buildVersion != "" {
+		r.Version = strings.TrimPrefix(buildVersion, "v")
+	}
+	if buildCommit != "" {
+		r.Commit = buildCommit
+	}
+	if buildDate != "" {
+		r.Date = buildDate
+	}
+	return r
+})
+
+// versionReport is the body of /version. StorageBackends and KeyProviders
+// are those built in, see profile.go.
+type versionReport struct {
+	buildReport
+	Features        []string `json:"features"`
+	StorageBackends []string `json:"storageBackends"`
+	KeyProviders    []string `json:"keyProviders"`
+}
+
+// handleVersion serves the build of the binary and its enabled features.
+func (s *server) handleVersion(w http.ResponseWriter, req *http.Request) {
+	r := versionReport{
+		buildReport:     runningBuild(),
+		Features:        []string{},
+		StorageBackends: append(slices.Sorted(maps.Keys(bucketBackends)), "postgres"),
+		KeyProviders:    slices.Sorted(maps.Keys(keyAgreements)),
+	}
+	for _, f := range knownFlags {
+		if s.resolveFlag(f.Name, "").Enabled {
+			r.Features = append(r.Features, f.Name)
+		}
+	}
+	slices.Sort(r.StorageBackends)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, r)
+}
+
+// runVersion implements the version command.
+func runVersion() error {
+	return json.NewEncoder(os.Stdout).Encode(runningBuild())
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	t.Setenv("QUERY_GET_ENABLED", "true")
+	_, srv := newTestServer(t)
+	resp, err := http.Get(srv.URL + "/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r versionReport
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Version == "" || r.GoVersion != runtime.Version() {
+		t.Errorf("build %+v", r.buildReport)
+	}
+	if !slices.Contains(r.Features, flagQueryCache) || slices.Contains(r.Features, flagPIR) {
+		t.Errorf("features %v, want %s only", r.Features, flagQueryCache)
+	}
+	if !slices.Contains(r.StorageBackends, "postgres") || !slices.Contains(r.StorageBackends, "memory") {
+		t.Errorf("storage backends %v", r.StorageBackends)
+	}
+}
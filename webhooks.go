@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Ingestion job lifecycle event types delivered to registered webhooks.
+const (
+	eventJobStarted   = "MIGP.Job.Started"
+	eventJobProgress  = "MIGP.Job.Progress"
+	eventJobCompleted = "MIGP.Job.Completed"
+	eventJobFailed    = "MIGP.Job.Failed"
+)
+
+const (
+	// webhookSignatureHeader carries the hex HMAC-SHA256 of the request body,
+	// keyed with the webhook's secret.
+	webhookSignatureHeader = "X-MIGP-Signature"
+
+	// webhookAttempts is the number of delivery attempts made per event.
+	webhookAttempts = 4
+)
+
+// webhook is a registered event subscriber.
+type webhook struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// webhookStore persists webhook registrations in PostgreSQL so they are
+// shared by every function instance. The registrations events are delivered
+// to are cached for ttl (WEBHOOK_CACHE_TTL, default 30s), so that publishing
+// does not query the database per event; changes made through another
+// instance reach this one within ttl.
+type webhookStore struct {
+	cluster *dbCluster
+	ttl     time.Duration
+
+	mu        sync.Mutex
+	cached    []webhook
+	fetchedAt time.Time
+}
+
+// newWebhookStore initializes a new webhookStore with a PostgreSQL database
+// cluster.
+func newWebhookStore(cluster *dbCluster) *webhookStore {
+	return &webhookStore{cluster: cluster, ttl: envDuration("WEBHOOK_CACHE_TTL", 30*time.Second)}
+}
+
+// subscribers returns the registered webhooks, as cached for ttl.
+func (ws *webhookStore) subscribers(ctx context.Context) ([]webhook, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if !ws.fetchedAt.IsZero() && time.Since(ws.fetchedAt) < ws.ttl {
+		return ws.cached, nil
+	}
+	webhooks, err := ws.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ws.cached, ws.fetchedAt = webhooks, time.Now()
+	return webhooks, nil
+}
+
+// invalidate drops the cached registrations after a change.
+func (ws *webhookStore) invalidate() {
+	ws.mu.Lock()
+	ws.fetchedAt = time.Time{}
+	ws.mu.Unlock()
+}
+
+// Add registers a webhook and returns it with its assigned ID.
+func (ws *webhookStore) Add(ctx context.Context, wh webhook) (webhook, error) {
+	query := `INSERT INTO webhooks (url, secret, events) VALUES ($1, $2, $3) RETURNING id, created_at`
+	err := ws.cluster.DB().QueryRowContext(ctx, query, wh.URL, wh.Secret, pq.Array(wh.Events)).Scan(&wh.ID, &wh.CreatedAt)
+	ws.invalidate()
+	return wh, err
+}
+
+// Delete removes the webhook identified by id.
+func (ws *webhookStore) Delete(ctx context.Context, id int64) error {
+	_, err := ws.cluster.DB().ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	ws.invalidate()
+	return err
+}
+
+// List returns all registered webhooks.
+func (ws *webhookStore) List(ctx context.Context) ([]webhook, error) {
+	rows, err := ws.cluster.DB().QueryContext(ctx, `SELECT id, url, secret, events, created_at FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []webhook{}
+	for rows.Next() {
+		var wh webhook
+		if err := rows.Scan(&wh.ID, &wh.URL, &wh.Secret, pq.Array(&wh.Events), &wh.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, rows.Err()
+}
+
+// subscribed reports whether the webhook wants events of the given type. A
+// webhook with no event filter receives everything.
+func (wh webhook) subscribed(eventType string) bool {
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// signPayload returns the hex HMAC-SHA256 of body keyed with secret.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook posts an event to a registered webhook, retrying with
+// exponential backoff on network errors and server errors. A client error
+// will not go away by retrying, so the event is dropped.
+func (p *eventPublisher) deliverWebhook(wh webhook, ev event) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := p.post(wh.URL, ev, "", wh.Secret)
+		if err == nil {
+			return
+		}
+		var status deliveryStatusError
+		if errors.As(err, &status) && status < 500 {
+			log.Printf("Delivering %s to webhook %d was rejected: %v", ev.EventType, wh.ID, err)
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Printf("Delivering %s to webhook %d failed after %d attempts: %v", ev.EventType, wh.ID, attempt, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// handleWebhooks lists, registers and deletes webhooks
+func (s *server) handleWebhooks(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		webhooks, err := s.webhooks.List(req.Context())
+		if err != nil {
+			storageError(w, "Listing webhooks", err)
+			return
+		}
+		for i := range webhooks {
+			webhooks[i].Secret = ""
+		}
+		writeJSON(w, http.StatusOK, webhooks)
+
+	case http.MethodPost:
+		var wh webhook
+		if err := json.NewDecoder(req.Body).Decode(&wh); err != nil {
+			log.Println("Request body unmarshal failed:", err)
+			writeError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if u, err := url.Parse(wh.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			writeError(w, "webhook url must be an absolute http(s) URL", http.StatusBadRequest)
+			return
+		}
+		if wh.Secret == "" {
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				log.Println("Webhook secret generation failed:", err)
+				writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			wh.Secret = hex.EncodeToString(secret)
+		}
+		wh, err := s.webhooks.Add(req.Context(), wh)
+		if err != nil {
+			storageError(w, "Registering webhook", err)
+			return
+		}
+		// The secret is only ever returned on registration.
+		writeJSON(w, http.StatusCreated, wh)
+
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(req.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, "missing or invalid webhook id", http.StatusBadRequest)
+			return
+		}
+		if err := s.webhooks.Delete(req.Context(), id); err != nil {
+			storageError(w, "Deleting webhook", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// writeJSON writes v as a JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		log.Println("Response serialization failed:", err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Println("Writing response failed:", err)
+	}
+}
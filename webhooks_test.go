@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	var attempts atomic.Int32
+	var status atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if got, want := req.Header.Get(webhookSignatureHeader), "sha256="+signPayload("secret", body); got != want {
+			t.Errorf("signature %q, want %q", got, want)
+		}
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(int(status.Load()))
+		}
+	}))
+	defer srv.Close()
+
+	p := newEventPublisher(nil)
+	wh := webhook{ID: 1, URL: srv.URL, Secret: "secret"}
+	ev := event{ID: "1", EventType: eventJobStarted}
+	for _, tt := range []struct {
+		status int
+		want   int32
+	}{
+		{http.StatusServiceUnavailable, 2},
+		{http.StatusBadRequest, 1},
+	} {
+		attempts.Store(0)
+		status.Store(int32(tt.status))
+		p.deliverWebhook(wh, ev)
+		if got := attempts.Load(); got != tt.want {
+			t.Errorf("delivery answered %d first made %d attempts, want %d", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookSubscribed(t *testing.T) {
+	if !(webhook{}).subscribed(eventJobFailed) {
+		t.Error("webhook without an event filter is not subscribed")
+	}
+	wh := webhook{Events: []string{eventJobCompleted, eventJobFailed}}
+	if !wh.subscribed(eventJobFailed) || wh.subscribed(eventJobProgress) {
+		t.Errorf("webhook filtering %v", wh.Events)
+	}
+}
+
+func TestWebhookRegistration(t *testing.T) {
+	_, srv := newDBTestServer(t)
+	register := func(body string) *http.Response {
+		t.Helper()
+		resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodPost, srv.URL+"/api/admin/webhooks", strings.NewReader(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := register(`{"url": "ftp://example.com"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("non-http webhook registered with %d", resp.StatusCode)
+	}
+	resp := register(`{"url": "https://example.com/hook", "events": ["` + eventJobCompleted + `"]}`)
+	defer resp.Body.Close()
+	var wh webhook
+	if err := json.NewDecoder(resp.Body).Decode(&wh); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("registration answered %d: %v", resp.StatusCode, err)
+	}
+	if len(wh.Secret) != 64 {
+		t.Errorf("registration returned secret %q, want a generated one", wh.Secret)
+	}
+
+	resp, err := http.DefaultClient.Do(adminRequest(t, http.MethodGet, srv.URL+"/api/admin/webhooks", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var listed []webhook
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, l := range listed {
+		if l.ID == wh.ID {
+			found = true
+			if l.Secret != "" {
+				t.Error("listing returned the webhook secret")
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("registered webhook %d not listed", wh.ID)
+	}
+
+	resp, err = http.DefaultClient.Do(adminRequest(t, http.MethodDelete, srv.URL+"/api/admin/webhooks?id="+strconv.FormatInt(wh.ID, 10), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("deletion answered %d", resp.StatusCode)
+	}
+}